@@ -0,0 +1,163 @@
+// Traffic of every connection the frontend closes. Records are queued and written to the database
+// in the background so closing a connection never waits on it, and rolled up into daily totals
+// once their day is over.
+package accounting
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+	"wwfc/common"
+	"wwfc/database"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// Records waiting to be written, any more are dropped while the database is falling behind
+const queueSize = 4096
+
+var (
+	ctx   = context.Background()
+	store database.Store
+
+	retentionDays int
+
+	queue   chan database.ConnectionRecord
+	stop    chan struct{}
+	stopped chan struct{}
+	dropped atomic.Uint64
+
+	// How often finished days are rolled up
+	rollupInterval = time.Hour
+
+	// Replaced in tests
+	insertConnection = func(record database.ConnectionRecord) error {
+		return store.InsertConnection(ctx, record)
+	}
+	rollupTraffic = func(cutoff time.Time, retentionCutoff time.Time) (int64, error) {
+		return store.RollupTraffic(ctx, cutoff, retentionCutoff)
+	}
+)
+
+func StartServer(reload bool) {
+	config := common.GetConfig()
+	retentionDays = *config.TrafficRetention
+
+	var err error
+	store, err = database.Connect(ctx, config)
+	if err != nil {
+		panic(err)
+	}
+
+	startWriter()
+}
+
+// Shutdown writes the queued records before returning
+func Shutdown() {
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-stopped
+	stop = nil
+}
+
+func startWriter() {
+	queue = make(chan database.ConnectionRecord, queueSize)
+	stop = make(chan struct{})
+	stopped = make(chan struct{})
+	dropped.Store(0)
+
+	go writer(queue, stop, stopped)
+}
+
+// RecordConnection queues the traffic of a closed connection. The profile ID is 0 if the
+// connection never logged in to a profile.
+func RecordConnection(server string, address string, profileId uint32, stats common.ConnectionStats) {
+	if queue == nil {
+		return
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	record := database.ConnectionRecord{
+		ProfileID:  profileId,
+		IPAddress:  host,
+		Server:     server,
+		Opened:     stats.Opened,
+		Duration:   stats.Duration,
+		BytesIn:    stats.BytesIn,
+		BytesOut:   stats.BytesOut,
+		PacketsIn:  stats.PacketsIn,
+		PacketsOut: stats.PacketsOut,
+	}
+
+	select {
+	case queue <- record:
+	default:
+		if count := dropped.Add(1); count == 1 || count%1000 == 0 {
+			logging.Warn("ACCOUNTING", "Queue is full, dropped", aurora.Cyan(count), "connection records")
+		}
+	}
+}
+
+func writer(queue chan database.ConnectionRecord, stop chan struct{}, stopped chan struct{}) {
+	defer close(stopped)
+
+	ticker := time.NewTicker(rollupInterval)
+	defer ticker.Stop()
+
+	rollup()
+
+	for {
+		select {
+		case record := <-queue:
+			write(record)
+
+		case <-ticker.C:
+			rollup()
+
+		case <-stop:
+			for {
+				select {
+				case record := <-queue:
+					write(record)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func write(record database.ConnectionRecord) {
+	if err := insertConnection(record); err != nil {
+		logging.Error("ACCOUNTING", "Failed to record connection from", aurora.BrightCyan(record.IPAddress), "to", aurora.Cyan(record.Server).String()+":", err)
+	}
+}
+
+// rollup totals the connections from before today (in UTC) and expires old totals
+func rollup() {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	var retentionCutoff time.Time
+	if retentionDays > 0 {
+		retentionCutoff = today.AddDate(0, 0, -retentionDays)
+	}
+
+	totals, err := rollupTraffic(today, retentionCutoff)
+	if err != nil {
+		logging.Error("ACCOUNTING", "Failed to roll up traffic:", err)
+		return
+	}
+
+	if totals != 0 {
+		logging.Info("ACCOUNTING", "Rolled up traffic into", aurora.Cyan(totals), "daily totals")
+	}
+}
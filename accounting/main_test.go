@@ -0,0 +1,86 @@
+package accounting
+
+import (
+	"sync"
+	"testing"
+	"time"
+	"wwfc/common"
+	"wwfc/database"
+)
+
+func fakeDatabase(t *testing.T) (*[]database.ConnectionRecord, *[]time.Time, *sync.Mutex) {
+	var records []database.ConnectionRecord
+	var cutoffs []time.Time
+	var mutex sync.Mutex
+
+	oldInsert, oldRollup, oldRetention := insertConnection, rollupTraffic, retentionDays
+	insertConnection = func(record database.ConnectionRecord) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		records = append(records, record)
+		return nil
+	}
+	rollupTraffic = func(cutoff time.Time, retentionCutoff time.Time) (int64, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		cutoffs = append(cutoffs, cutoff, retentionCutoff)
+		return 0, nil
+	}
+
+	t.Cleanup(func() {
+		Shutdown()
+		queue = nil
+		insertConnection, rollupTraffic, retentionDays = oldInsert, oldRollup, oldRetention
+	})
+
+	return &records, &cutoffs, &mutex
+}
+
+func TestRecordConnection(t *testing.T) {
+	records, cutoffs, mutex := fakeDatabase(t)
+	retentionDays = 30
+	startWriter()
+
+	opened := time.Now().Add(-time.Minute)
+	RecordConnection("gpcm", "1.2.3.4:5678", 600000001, common.ConnectionStats{Opened: opened, Duration: time.Minute, BytesIn: 100, BytesOut: 200, PacketsIn: 3, PacketsOut: 4})
+	RecordConnection("serverbrowser", "[::1]:28910", 0, common.ConnectionStats{Opened: opened})
+
+	// Shutdown writes everything still queued
+	Shutdown()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(*records) != 2 {
+		t.Fatalf("got %d records, expected 2", len(*records))
+	}
+
+	record := (*records)[0]
+	if record.IPAddress != "1.2.3.4" || record.ProfileID != 600000001 || record.Server != "gpcm" || record.BytesIn != 100 || record.BytesOut != 200 || record.PacketsIn != 3 || record.PacketsOut != 4 || record.Duration != time.Minute {
+		t.Errorf("record doesn't match the connection: %+v", record)
+	}
+	if (*records)[1].IPAddress != "::1" {
+		t.Errorf("IPv6 address kept its port: %s", (*records)[1].IPAddress)
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	if len(*cutoffs) != 2 || !(*cutoffs)[0].Equal(today) || !(*cutoffs)[1].Equal(today.AddDate(0, 0, -30)) {
+		t.Errorf("unexpected rollup cutoffs: %v", *cutoffs)
+	}
+}
+
+func TestRecordConnectionQueueFull(t *testing.T) {
+	fakeDatabase(t)
+
+	// Nothing reads the queue without the writer
+	queue = make(chan database.ConnectionRecord, 1)
+	dropped.Store(0)
+
+	for i := 0; i < 3; i++ {
+		RecordConnection("gpcm", "1.2.3.4:5678", 0, common.ConnectionStats{})
+	}
+
+	if dropped.Load() != 2 {
+		t.Errorf("dropped %d records, expected 2", dropped.Load())
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"wwfc/common"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// allowList is the parsed allow list of each server, a server missing from it accepts anyone
+type allowList map[string][]*net.IPNet
+
+// nil when every server accepts anyone
+var allowListState atomic.Pointer[allowList]
+
+// loadAllowList parses the allow list of each server from the config, falling back to the global one
+func loadAllowList(config common.Config, servers []serverInfo) (*allowList, error) {
+	list := allowList{}
+	for _, server := range servers {
+		networks, err := common.ParseAllowList(config.GetAllowList(server.rpcName))
+		if err != nil {
+			return nil, errors.New("allow list of " + server.rpcName + ": " + err.Error())
+		}
+
+		if len(networks) != 0 {
+			list[server.rpcName] = networks
+			logging.Notice("FRONTEND", "Only", aurora.Cyan(len(networks)), "allowed ranges can connect to", aurora.BrightCyan(server.rpcName))
+		}
+	}
+
+	if len(list) == 0 {
+		return nil, nil
+	}
+
+	return &list, nil
+}
+
+// checkAllowList returns false if the server has an allow list and the address isn't in it
+func checkAllowList(server string, addr net.Addr) bool {
+	list := allowListState.Load()
+	if list == nil {
+		return true
+	}
+
+	networks, ok := (*list)[server]
+	if !ok {
+		return true
+	}
+
+	var ip net.IP
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		ip = tcpAddr.IP
+	}
+
+	// An IPv4 client on a dual stack socket arrives as an IPv4-mapped IPv6 address, Contains
+	// matches it against IPv4 ranges
+	for _, network := range networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	logging.Info("FRONTEND", "Rejected connection from", aurora.BrightCyan(addr.String()), "not in the allow list of", aurora.BrightCyan(server))
+	return false
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"wwfc/common"
+)
+
+func TestAllowList(t *testing.T) {
+	servers := []serverInfo{{rpcName: "gpcm"}, {rpcName: "gpsp"}, {rpcName: "serverbrowser"}}
+	config := common.Config{
+		// Overlapping ranges and a plain address
+		AllowList: "192.0.2.0/24, 192.0.2.128/25, 198.51.100.7, 2001:db8::/32",
+		Servers: []common.ServerConfig{
+			{Name: "gpsp", AllowList: "203.0.113.0/24"},
+		},
+	}
+
+	list, err := loadAllowList(config, servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowListState.Store(list)
+	defer allowListState.Store(nil)
+
+	for _, test := range []struct {
+		server  string
+		ip      string
+		allowed bool
+	}{
+		{"gpcm", "192.0.2.200", true},
+		{"gpcm", "192.0.3.1", false},
+		{"gpcm", "198.51.100.7", true},
+		{"gpcm", "198.51.100.8", false},
+		{"gpcm", "::ffff:192.0.2.1", true},
+		{"gpcm", "2001:db8::1", true},
+		{"gpcm", "2001:db9::1", false},
+		// The server's own list replaces the global one
+		{"gpsp", "203.0.113.5", true},
+		{"gpsp", "192.0.2.1", false},
+		{"serverbrowser", "192.0.2.1", true},
+	} {
+		addr := &net.TCPAddr{IP: net.ParseIP(test.ip), Port: 1234}
+		if allowed := checkAllowList(test.server, addr); allowed != test.allowed {
+			t.Errorf("%s from %s: allowed %v, expected %v", test.server, test.ip, allowed, test.allowed)
+		}
+	}
+}
+
+func TestAllowListEmpty(t *testing.T) {
+	list, err := loadAllowList(common.Config{AllowList: " , "}, []serverInfo{{rpcName: "gpcm"}})
+	if err != nil || list != nil {
+		t.Fatalf("got %v, %v for an empty allow list", list, err)
+	}
+
+	allowListState.Store(list)
+	if !checkAllowList("gpcm", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}) {
+		t.Error("connection rejected without an allow list")
+	}
+}
+
+func TestAllowListInvalid(t *testing.T) {
+	for _, list := range []string{"192.0.2.0/33", "192.0.2.256", "2001:db8::/129", "example.com", "192.0.2.0/24,/24"} {
+		if _, err := loadAllowList(common.Config{AllowList: list}, []serverInfo{{rpcName: "gpcm"}}); err == nil {
+			t.Errorf("no error for %q", list)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"wwfc/database"
+)
+
+func HandleAllowlist(w http.ResponseWriter, r *http.Request) {
+	var jsonData []byte
+	entries, errorString := handleAllowlistImpl(r)
+	if errorString != "" {
+		jsonData, _ = json.Marshal(map[string]string{"error": errorString})
+	} else if entries != nil {
+		jsonData, _ = json.Marshal(entries)
+	} else {
+		jsonData, _ = json.Marshal(map[string]string{"success": "true"})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Length", strconv.Itoa(len(jsonData)))
+	w.Write(jsonData)
+}
+
+// AllowlistChange adds a console or profile to the allowlist or removes it, or lists the allowlist.
+// Either the console friend code or the profile ID is set.
+type AllowlistChange struct {
+	Action    string
+	ConsoleFC uint64
+	ProfileID uint32
+	Moderator string
+}
+
+// The messages are returned to API clients as is
+var (
+	ErrAllowlistAction     = errors.New("Invalid action, expected add, remove or list")
+	ErrAllowlistTarget     = errors.New("Missing pid, fc or cfc in request")
+	ErrAllowlistNotFound   = errors.New("Not on the allowlist")
+	errAllowlistFetch      = errors.New("Failed to fetch allowlist")
+	errAllowlistAddConsole = errors.New("Failed to add console to the allowlist")
+	errAllowlistRemConsole = errors.New("Failed to remove console from the allowlist")
+	errAllowlistAddProfile = errors.New("Failed to add profile to the allowlist")
+	errAllowlistRemProfile = errors.New("Failed to remove profile from the allowlist")
+)
+
+// ChangeAllowlist applies the change, used by the API and "cmd b allow". Returns the entries for
+// the list action.
+func ChangeAllowlist(change AllowlistChange) ([]database.AllowlistEntry, error) {
+	switch change.Action {
+	case "list":
+		entries, err := store.FetchAllowlist(ctx)
+		if err != nil {
+			return nil, errAllowlistFetch
+		}
+		return entries, nil
+
+	case "add", "remove":
+	default:
+		return nil, ErrAllowlistAction
+	}
+
+	if change.ConsoleFC != 0 {
+		if change.Action == "add" {
+			if store.AllowConsole(ctx, change.ConsoleFC, change.Moderator) != nil {
+				return nil, errAllowlistAddConsole
+			}
+			return nil, nil
+		}
+
+		removed, err := store.DisallowConsole(ctx, change.ConsoleFC)
+		if err != nil {
+			return nil, errAllowlistRemConsole
+		} else if !removed {
+			return nil, ErrAllowlistNotFound
+		}
+		return nil, nil
+	}
+
+	if change.ProfileID == 0 {
+		return nil, ErrAllowlistTarget
+	}
+
+	if change.Action == "add" {
+		if store.AllowProfile(ctx, change.ProfileID, change.Moderator) != nil {
+			return nil, errAllowlistAddProfile
+		}
+		return nil, nil
+	}
+
+	removed, err := store.DisallowProfile(ctx, change.ProfileID)
+	if err != nil {
+		return nil, errAllowlistRemProfile
+	} else if !removed {
+		return nil, ErrAllowlistNotFound
+	}
+	return nil, nil
+}
+
+// ParseAllowlistTarget reads a console friend code (cfc) or a profile, either by profile ID (pid)
+// or by friend code (fc), into the change
+func ParseAllowlistTarget(kind string, value string, change *AllowlistChange) error {
+	switch kind {
+	case "cfc":
+		cfc, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || cfc == 0 || cfc > 9999999999999999 {
+			return errors.New("Invalid cfc")
+		}
+		change.ConsoleFC = cfc
+
+	case "fc":
+		fc, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || fc > 999999999999 {
+			return errors.New("Invalid fc")
+		}
+		// The lower 32 bits of a friend code are the profile ID
+		change.ProfileID = uint32(fc & 0xffffffff)
+
+	case "pid":
+		pid, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return errors.New("Invalid pid")
+		}
+		change.ProfileID = uint32(pid)
+
+	default:
+		return ErrAllowlistTarget
+	}
+
+	return nil
+}
+
+func handleAllowlistImpl(r *http.Request) ([]database.AllowlistEntry, string) {
+	// TODO: Use POST instead of GET
+
+	u, err := url.Parse(r.URL.String())
+	if err != nil {
+		return nil, "Bad request"
+	}
+
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, "Bad request"
+	}
+
+	if !checkAPISecret(query) {
+		return nil, "Invalid API secret"
+	}
+
+	change := AllowlistChange{Action: query.Get("action"), Moderator: query.Get("moderator")}
+	if change.Action == "add" || change.Action == "remove" {
+		for _, kind := range []string{"cfc", "fc", "pid"} {
+			if value := query.Get(kind); value != "" {
+				if err := ParseAllowlistTarget(kind, value, &change); err != nil {
+					return nil, err.Error()
+				}
+				break
+			}
+		}
+	}
+
+	entries, err := ChangeAllowlist(change)
+	if errors.Is(err, ErrAllowlistNotFound) {
+		if change.ConsoleFC != 0 {
+			return nil, "Console is not on the allowlist"
+		}
+		return nil, "Profile is not on the allowlist"
+	}
+	if err != nil {
+		return nil, err.Error()
+	}
+
+	return entries, ""
+}
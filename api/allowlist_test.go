@@ -0,0 +1,48 @@
+package api
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseAllowlistTarget(t *testing.T) {
+	tests := []struct {
+		kind      string
+		value     string
+		consoleFC uint64
+		profileID uint32
+		valid     bool
+	}{
+		{"cfc", "1234567890123456", 1234567890123456, 0, true},
+		{"cfc", "0", 0, 0, false},
+		{"cfc", "12345678901234567", 0, 0, false},
+		// The profile ID is the lower 32 bits of the friend code
+		{"fc", "141733920768", 0, 0, true},
+		{"fc", "141733920769", 0, 1, true},
+		{"fc", "1000000000000", 0, 0, false},
+		{"pid", "600000001", 0, 600000001, true},
+		{"pid", "4294967296", 0, 0, false},
+		{"pid", "abc", 0, 0, false},
+		{"ip", "1", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		var change AllowlistChange
+		err := ParseAllowlistTarget(test.kind, test.value, &change)
+		if (err == nil) != test.valid {
+			t.Errorf("%s %s: got %v", test.kind, test.value, err)
+			continue
+		}
+		if change.ConsoleFC != test.consoleFC || change.ProfileID != test.profileID {
+			t.Errorf("%s %s: got cfc %d pid %d", test.kind, test.value, change.ConsoleFC, change.ProfileID)
+		}
+	}
+
+	// Checked before the database is used
+	if _, err := ChangeAllowlist(AllowlistChange{Action: "ban", ProfileID: 1}); !errors.Is(err, ErrAllowlistAction) {
+		t.Errorf("invalid action: got %v", err)
+	}
+	if _, err := ChangeAllowlist(AllowlistChange{Action: "add"}); !errors.Is(err, ErrAllowlistTarget) {
+		t.Errorf("missing target: got %v", err)
+	}
+}
@@ -7,8 +7,8 @@ import (
 	"strconv"
 	"time"
 	"wwfc/common"
-	"wwfc/database"
 	"wwfc/gpcm"
+	"wwfc/logging"
 )
 
 func HandleBan(w http.ResponseWriter, r *http.Request) {
@@ -29,7 +29,6 @@ func HandleBan(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleBanImpl(w http.ResponseWriter, r *http.Request) string {
-	// TODO: Actual authentication rather than a fixed secret
 	// TODO: Use POST instead of GET
 
 	u, err := url.Parse(r.URL.String())
@@ -42,7 +41,7 @@ func handleBanImpl(w http.ResponseWriter, r *http.Request) string {
 		return "Bad request"
 	}
 
-	if apiSecret == "" || query.Get("secret") != apiSecret {
+	if !checkAPISecret(query) {
 		return "Invalid API secret"
 	}
 
@@ -66,6 +65,23 @@ func handleBanImpl(w http.ResponseWriter, r *http.Request) string {
 		return "Invalid tos"
 	}
 
+	// A shadow ban isn't shown to the player, they're only left out of matchmaking
+	shadow := false
+	if shadowStr := query.Get("shadow"); shadowStr != "" {
+		shadow, err = strconv.ParseBool(shadowStr)
+		if err != nil {
+			return "Invalid shadow"
+		}
+	}
+
+	permanent := false
+	if permanentStr := query.Get("permanent"); permanentStr != "" {
+		permanent, err = strconv.ParseBool(permanentStr)
+		if err != nil {
+			return "Invalid permanent"
+		}
+	}
+
 	minutes := uint64(0)
 	if query.Get("minutes") != "" {
 		minutesStr := query.Get("minutes")
@@ -107,17 +123,35 @@ func handleBanImpl(w http.ResponseWriter, r *http.Request) string {
 	}
 
 	minutes = days*24*60 + hours*60 + minutes
-	if minutes == 0 {
+	if minutes == 0 && !permanent {
 		return "Missing ban length"
 	}
+	if minutes != 0 && permanent {
+		return "A permanent ban can't have a length"
+	}
 
 	length := time.Duration(minutes) * time.Minute
 
-	if !database.BanUser(pool, ctx, uint32(pid), tos, length, reason, reasonHidden, moderator) {
+	if !store.BanUser(ctx, uint32(pid), tos, shadow, length, reason, reasonHidden, moderator) {
 		return "Failed to ban user"
 	}
 
-	if tos {
+	logging.Audit(logging.AuditEvent{
+		Event:     logging.AuditBan,
+		ProfileID: uint32(pid),
+		Reason:    reason,
+		Moderator: moderator,
+		Details: map[string]string{
+			"tos":           strconv.FormatBool(tos),
+			"shadow":        strconv.FormatBool(shadow),
+			"length":        length.String(),
+			"reason_hidden": reasonHidden,
+		},
+	})
+
+	if shadow {
+		gpcm.ShadowBanPlayer(uint32(pid))
+	} else if tos {
 		gpcm.KickPlayer(uint32(pid), "banned")
 	} else {
 		gpcm.KickPlayer(uint32(pid), "restricted")
@@ -186,7 +220,7 @@ func handleAddRemoveTrusted(w http.ResponseWriter, r *http.Request) interface{}
 
 		pid32 = uint32(pid)
 
-		trusted, err = database.DoesUserTrusted(pool, ctx, pid32)
+		trusted, err = store.DoesUserTrusted(ctx, pid32)
 		if err != nil {
 			return "An error occured"
 		}
@@ -195,7 +229,7 @@ func handleAddRemoveTrusted(w http.ResponseWriter, r *http.Request) interface{}
 
 	switch request {
 	case "FETCH":
-		trustedIDs, err := database.FetchTrusted(pool, ctx)
+		trustedIDs, err := store.FetchTrusted(ctx)
 		if err != nil {
 			return map[string]string{"error": "Error fetching trusted IDs"}
 		}
@@ -218,7 +252,7 @@ func handleAddRemoveTrusted(w http.ResponseWriter, r *http.Request) interface{}
 		return string(friendCodesJSON)
 	case "Add":
 		if !trusted {
-			_, err = database.AddTrusted(pool, ctx, pid32)
+			_, err = store.AddTrusted(ctx, pid32)
 			if err != nil {
 				return map[string]string{"error": "couldn't add user"}
 			}
@@ -232,7 +266,7 @@ func handleAddRemoveTrusted(w http.ResponseWriter, r *http.Request) interface{}
 
 	case "Remove":
 		if trusted {
-			database.RemoveTrusted(pool, ctx, pid32)
+			store.RemoveTrusted(ctx, pid32)
 			return map[string]string{"success": "User Removed"}
 		}
 
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"wwfc/common"
+	"wwfc/gpcm"
+)
+
+type connectionEntry struct {
+	Index     uint64 `json:"index"`
+	Address   string `json:"address"`
+	ProfileID uint32 `json:"profile_id,omitempty"`
+}
+
+type serverConnections struct {
+	Count       int               `json:"count"`
+	Connections []connectionEntry `json:"connections"`
+}
+
+func HandleConnections(w http.ResponseWriter, r *http.Request) {
+	result, errorString := handleConnectionsImpl(r)
+
+	var jsonData []byte
+	if errorString != "" {
+		jsonData, _ = json.Marshal(map[string]string{"error": errorString})
+	} else {
+		jsonData, _ = json.Marshal(result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Length", strconv.Itoa(len(jsonData)))
+	w.Write(jsonData)
+}
+
+func handleConnectionsImpl(r *http.Request) (map[string]serverConnections, string) {
+
+	if r.Method != http.MethodGet {
+		return nil, "Method not allowed"
+	}
+
+	u, err := url.Parse(r.URL.String())
+	if err != nil {
+		return nil, "Bad request"
+	}
+
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, "Bad request"
+	}
+
+	if !checkAPISecret(query) {
+		return nil, "Invalid API secret"
+	}
+
+	connections, err := common.GetConnections()
+	if err != nil {
+		return nil, "Failed to get connections from the frontend"
+	}
+
+	profileIDs := gpcm.GetProfileIDsByConnIndex()
+
+	result := map[string]serverConnections{}
+	for server, infos := range connections {
+		entries := make([]connectionEntry, 0, len(infos))
+		for _, info := range infos {
+			entry := connectionEntry{
+				Index:   info.Index,
+				Address: info.Address,
+			}
+
+			if server == gpcm.ServerName {
+				entry.ProfileID = profileIDs[info.Index]
+			}
+
+			entries = append(entries, entry)
+		}
+
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Index < entries[j].Index
+		})
+
+		result[server] = serverConnections{
+			Count:       len(entries),
+			Connections: entries,
+		}
+	}
+
+	return result, ""
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"wwfc/common"
+)
+
+// Set once every backend server has started and the backend accepts RPC,
+// cleared again when the backend starts shutting down
+var backendReady atomic.Bool
+
+func SetBackendReady(ready bool) {
+	backendReady.Store(ready)
+}
+
+func IsBackendReady() bool {
+	return backendReady.Load()
+}
+
+// WriteHealth writes a health check response, 200 if the status is "ok" and 503 otherwise
+func WriteHealth(w http.ResponseWriter, status string) {
+	jsonData, _ := json.Marshal(map[string]string{"status": status})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Length", strconv.Itoa(len(jsonData)))
+	if status == "ok" {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(jsonData)
+}
+
+func HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	if IsBackendReady() {
+		WriteHealth(w, "ok")
+	} else {
+		WriteHealth(w, "starting")
+	}
+}
+
+// HandleVersion returns the build of the running process and when it started
+func HandleVersion(w http.ResponseWriter, r *http.Request) {
+	jsonData, _ := json.Marshal(common.GetVersionInfo())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Length", strconv.Itoa(len(jsonData)))
+	w.Write(jsonData)
+}
@@ -26,7 +26,6 @@ func HandleKick(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleKickImpl(w http.ResponseWriter, r *http.Request) string {
-	// TODO: Actual authentication rather than a fixed secret
 	// TODO: Use POST instead of GET
 
 	u, err := url.Parse(r.URL.String())
@@ -39,7 +38,7 @@ func handleKickImpl(w http.ResponseWriter, r *http.Request) string {
 		return "Bad request"
 	}
 
-	if apiSecret == "" || query.Get("secret") != apiSecret {
+	if !checkAPISecret(query) {
 		return "Invalid API secret"
 	}
 
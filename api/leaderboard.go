@@ -0,0 +1,239 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+	"wwfc/database"
+	"wwfc/gamestats"
+	"wwfc/logging"
+)
+
+const (
+	defaultLeaderboardLimit     = 20
+	maxLeaderboardLimit         = 100
+	defaultLeaderboardNeighbors = 5
+	maxLeaderboardNeighbors     = 25
+	// Above this many entries, expired ones are removed before adding another
+	maxLeaderboardCacheEntries = 1024
+)
+
+type LeaderboardResponse struct {
+	Game    string                      `json:"game"`
+	Board   string                      `json:"board"`
+	Entries []database.LeaderboardEntry `json:"entries"`
+}
+
+type LeaderboardPlayerResponse struct {
+	Game      string                      `json:"game"`
+	Board     string                      `json:"board"`
+	Player    database.LeaderboardEntry   `json:"player"`
+	Neighbors []database.LeaderboardEntry `json:"neighbors"`
+}
+
+type leaderboardCacheEntry struct {
+	status  int
+	data    []byte
+	expires time.Time
+}
+
+var (
+	leaderboardCache      = map[string]leaderboardCacheEntry{}
+	leaderboardCacheMutex sync.Mutex
+	leaderboardCacheTTL   time.Duration
+
+	// Replaced in tests
+	getLeaderboard = func(gameName string, board string, ascending bool, offset int, limit int) ([]database.LeaderboardEntry, error) {
+		return store.GetLeaderboard(ctx, gameName, board, ascending, offset, limit)
+	}
+	getLeaderboardRank = func(gameName string, board string, ascending bool, profileId uint32) (int, error) {
+		return store.GetLeaderboardRank(ctx, gameName, board, ascending, profileId)
+	}
+)
+
+// HandleLeaderboard returns one page of a leaderboard:
+// /api/leaderboard?game=mariokartwii&board=tt0&offset=0&limit=20
+func HandleLeaderboard(w http.ResponseWriter, r *http.Request) {
+	serveLeaderboard(w, r, leaderboardPage)
+}
+
+// HandleLeaderboardPlayer returns a player's rank and the players around them:
+// /api/leaderboard/player?game=mariokartwii&board=tt0&pid=600000001&neighbors=5
+func HandleLeaderboardPlayer(w http.ResponseWriter, r *http.Request) {
+	serveLeaderboard(w, r, leaderboardPlayer)
+}
+
+// serveLeaderboard replies with the handler's result as JSON, reusing the reply to an identical
+// request while it's younger than the cache TTL
+func serveLeaderboard(w http.ResponseWriter, r *http.Request, handler func(query url.Values) (any, int)) {
+	query := r.URL.Query()
+	// Encode sorts the parameters, so the order they're given in doesn't matter
+	key := r.URL.Path + "?" + query.Encode()
+	now := time.Now()
+
+	leaderboardCacheMutex.Lock()
+	entry, cached := leaderboardCache[key]
+	leaderboardCacheMutex.Unlock()
+
+	if !cached || !now.Before(entry.expires) {
+		result, status := handler(query)
+		data, err := json.Marshal(result)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		entry = leaderboardCacheEntry{status: status, data: data, expires: now.Add(leaderboardCacheTTL)}
+
+		// Don't keep serving a database error once the database is back
+		if leaderboardCacheTTL > 0 && status != http.StatusInternalServerError {
+			cacheLeaderboard(key, entry, now)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry.data)))
+	w.WriteHeader(entry.status)
+	w.Write(entry.data)
+}
+
+func cacheLeaderboard(key string, entry leaderboardCacheEntry, now time.Time) {
+	leaderboardCacheMutex.Lock()
+	defer leaderboardCacheMutex.Unlock()
+
+	if len(leaderboardCache) >= maxLeaderboardCacheEntries {
+		for key, entry := range leaderboardCache {
+			if !now.Before(entry.expires) {
+				delete(leaderboardCache, key)
+			}
+		}
+	}
+
+	if len(leaderboardCache) < maxLeaderboardCacheEntries {
+		leaderboardCache[key] = entry
+	}
+}
+
+// clearLeaderboardCache drops every cached page, so a deleted profile isn't served until they expire
+func clearLeaderboardCache() {
+	leaderboardCacheMutex.Lock()
+	defer leaderboardCacheMutex.Unlock()
+
+	clear(leaderboardCache)
+}
+
+func leaderboardError(message string) map[string]string {
+	return map[string]string{"error": message}
+}
+
+// leaderboardBoard checks the game and board parameters name a leaderboard
+func leaderboardBoard(query url.Values) (string, string, bool, map[string]string, int) {
+	gameName := query.Get("game")
+	board := query.Get("board")
+	if gameName == "" || board == "" {
+		return "", "", false, leaderboardError("Missing game or board in request"), http.StatusBadRequest
+	}
+
+	ascending, ok := gamestats.LeaderboardOrder(gameName, board)
+	if !ok {
+		return "", "", false, leaderboardError("Unknown leaderboard"), http.StatusNotFound
+	}
+
+	return gameName, board, ascending, nil, http.StatusOK
+}
+
+// queryInt parses an optional integer parameter within the bounds
+func queryInt(query url.Values, name string, defaultValue int, minValue int, maxValue int) (int, bool) {
+	if query.Get(name) == "" {
+		return defaultValue, true
+	}
+
+	value, err := strconv.Atoi(query.Get(name))
+	if err != nil || value < minValue || value > maxValue {
+		return 0, false
+	}
+
+	return value, true
+}
+
+func leaderboardPage(query url.Values) (any, int) {
+	gameName, board, ascending, errorReply, status := leaderboardBoard(query)
+	if errorReply != nil {
+		return errorReply, status
+	}
+
+	offset, ok := queryInt(query, "offset", 0, 0, math.MaxInt32)
+	if !ok {
+		return leaderboardError("Invalid offset"), http.StatusBadRequest
+	}
+
+	limit, ok := queryInt(query, "limit", defaultLeaderboardLimit, 1, maxLeaderboardLimit)
+	if !ok {
+		return leaderboardError("Invalid limit"), http.StatusBadRequest
+	}
+
+	entries, err := getLeaderboard(gameName, board, ascending, offset, limit)
+	if err != nil {
+		logging.Error("API", "Failed to get leaderboard:", err)
+		return leaderboardError("Database error"), http.StatusInternalServerError
+	}
+
+	return LeaderboardResponse{Game: gameName, Board: board, Entries: entries}, http.StatusOK
+}
+
+func leaderboardPlayer(query url.Values) (any, int) {
+	gameName, board, ascending, errorReply, status := leaderboardBoard(query)
+	if errorReply != nil {
+		return errorReply, status
+	}
+
+	pid, err := strconv.ParseUint(query.Get("pid"), 10, 32)
+	if err != nil {
+		return leaderboardError("Invalid pid"), http.StatusBadRequest
+	}
+
+	neighbors, ok := queryInt(query, "neighbors", defaultLeaderboardNeighbors, 0, maxLeaderboardNeighbors)
+	if !ok {
+		return leaderboardError("Invalid neighbors"), http.StatusBadRequest
+	}
+
+	rank, err := getLeaderboardRank(gameName, board, ascending, uint32(pid))
+	if errors.Is(err, database.ErrNotFound) {
+		return leaderboardError("No score on this leaderboard"), http.StatusNotFound
+	} else if err != nil {
+		logging.Error("API", "Failed to get leaderboard rank:", err)
+		return leaderboardError("Database error"), http.StatusInternalServerError
+	}
+
+	offset := max(0, rank-1-neighbors)
+	entries, err := getLeaderboard(gameName, board, ascending, offset, rank-offset+neighbors)
+	if err != nil {
+		logging.Error("API", "Failed to get leaderboard:", err)
+		return leaderboardError("Database error"), http.StatusInternalServerError
+	}
+
+	response := LeaderboardPlayerResponse{
+		Game:      gameName,
+		Board:     board,
+		Player:    database.LeaderboardEntry{Rank: rank, ProfileID: uint32(pid)},
+		Neighbors: []database.LeaderboardEntry{},
+	}
+
+	for _, entry := range entries {
+		if entry.ProfileID == uint32(pid) {
+			// The score may have changed between the two queries, the page has the current one
+			response.Player = entry
+			continue
+		}
+
+		response.Neighbors = append(response.Neighbors, entry)
+	}
+
+	return response, http.StatusOK
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"wwfc/common"
+	"wwfc/database"
+	"wwfc/sake"
+)
+
+// fakeLeaderboard serves a board where profile i+1 has rank i+1
+func fakeLeaderboard(t *testing.T, players int) *int {
+	queries := 0
+
+	oldGet, oldRank, oldTTL := getLeaderboard, getLeaderboardRank, leaderboardCacheTTL
+	getLeaderboard = func(gameName string, board string, ascending bool, offset int, limit int) ([]database.LeaderboardEntry, error) {
+		queries++
+		entries := []database.LeaderboardEntry{}
+		for i := offset; i < min(players, offset+limit); i++ {
+			entries = append(entries, database.LeaderboardEntry{Rank: i + 1, ProfileID: uint32(i + 1), Score: int64(60000 + i)})
+		}
+		return entries, nil
+	}
+	getLeaderboardRank = func(gameName string, board string, ascending bool, profileId uint32) (int, error) {
+		if int(profileId) > players {
+			return 0, database.ErrNotFound
+		}
+		return int(profileId), nil
+	}
+	leaderboardCacheTTL = time.Minute
+	leaderboardCache = map[string]leaderboardCacheEntry{}
+
+	t.Cleanup(func() {
+		getLeaderboard, getLeaderboardRank, leaderboardCacheTTL = oldGet, oldRank, oldTTL
+		leaderboardCache = map[string]leaderboardCacheEntry{}
+	})
+
+	return &queries
+}
+
+func requestLeaderboard(t *testing.T, handler http.HandlerFunc, target string, reply any) int {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", target, nil))
+	if err := json.Unmarshal(recorder.Body.Bytes(), reply); err != nil {
+		t.Fatal(err)
+	}
+	return recorder.Code
+}
+
+func TestLeaderboardPage(t *testing.T) {
+	queries := fakeLeaderboard(t, 50)
+
+	var page LeaderboardResponse
+	if status := requestLeaderboard(t, HandleLeaderboard, "/api/leaderboard?game=mariokartwii&board=tt0&offset=10&limit=5", &page); status != http.StatusOK {
+		t.Fatal(status)
+	}
+	if len(page.Entries) != 5 || page.Entries[0].Rank != 11 || page.Entries[4].ProfileID != 15 {
+		t.Errorf("got %+v", page)
+	}
+
+	// The same query in another order is answered from the cache
+	requestLeaderboard(t, HandleLeaderboard, "/api/leaderboard?limit=5&offset=10&board=tt0&game=mariokartwii", &page)
+	if *queries != 1 {
+		t.Errorf("queried %d times", *queries)
+	}
+
+	var errorReply map[string]string
+	for target, expected := range map[string]int{
+		"/api/leaderboard?game=mariokartwii":                     http.StatusBadRequest,
+		"/api/leaderboard?game=mariokartwii&board=vr":            http.StatusNotFound,
+		"/api/leaderboard?game=mariokartwii&board=tt0&limit=101": http.StatusBadRequest,
+		"/api/leaderboard?game=mariokartwii&board=tt0&offset=-1": http.StatusBadRequest,
+	} {
+		if status := requestLeaderboard(t, HandleLeaderboard, target, &errorReply); status != expected || errorReply["error"] == "" {
+			t.Errorf("%s: got %d %v", target, status, errorReply)
+		}
+	}
+}
+
+func TestLeaderboardPlayer(t *testing.T) {
+	fakeLeaderboard(t, 50)
+
+	var reply LeaderboardPlayerResponse
+	requestLeaderboard(t, HandleLeaderboardPlayer, "/api/leaderboard/player?game=mariokartwii&board=tt0&pid=20&neighbors=2", &reply)
+	if reply.Player.Rank != 20 || reply.Player.Score != 60019 || len(reply.Neighbors) != 4 || reply.Neighbors[0].Rank != 18 || reply.Neighbors[3].Rank != 22 {
+		t.Errorf("got %+v", reply)
+	}
+
+	// Nobody ahead of the leader
+	requestLeaderboard(t, HandleLeaderboardPlayer, "/api/leaderboard/player?game=mariokartwii&board=tt0&pid=1&neighbors=2", &reply)
+	if reply.Player.Rank != 1 || len(reply.Neighbors) != 2 || reply.Neighbors[0].Rank != 2 {
+		t.Errorf("got %+v", reply)
+	}
+
+	var errorReply map[string]string
+	if status := requestLeaderboard(t, HandleLeaderboardPlayer, "/api/leaderboard/player?game=mariokartwii&board=tt0&pid=51", &errorReply); status != http.StatusNotFound {
+		t.Errorf("got %d %v", status, errorReply)
+	}
+}
+
+// uploadGhost uploads a ghost to SAKE for the profile and returns the Sake-File-Result
+func uploadGhost(t *testing.T, profileId uint32, ghost []byte) string {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "ghost.rkg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(ghost)
+	writer.Close()
+
+	target := "/SakeFileServer/upload.aspx?gameid=1687&loginticket=" + url.QueryEscape(common.MarshalGPCMLoginTicket(profileId))
+	request := httptest.NewRequest("POST", target, body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	recorder := httptest.NewRecorder()
+	sake.HandleRequest(recorder, request)
+	return recorder.Header().Get("Sake-File-Result")
+}
+
+func TestLeaderboardUploadedGhost(t *testing.T) {
+	gameList, err := os.ReadFile("../game_list.tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SAKE reads its config and the game list from the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	config := "<Config><databaseDriver>file</databaseDriver><databaseFile>" + filepath.Join(dir, "database.gob") + "</databaseFile></Config>"
+	if err := os.WriteFile("config.xml", []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("game_list.tsv", gameList, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sake.StartServer(false)
+
+	// The file is shared with SAKE, which never closes it, so it's closed for both
+	oldStore, oldTTL := store, leaderboardCacheTTL
+	store, err = database.Connect(ctx, common.GetConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaderboardCacheTTL = 0
+	t.Cleanup(func() {
+		store.Close()
+		store.Close()
+		store, leaderboardCacheTTL = oldStore, oldTTL
+	})
+
+	if _, err := store.LoginUserToGPCM(ctx, 1, "RMCJ", 600000001, 0, "192.0.2.1", "Mario"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1:23.456 on course 8
+	ghost := append([]byte("RKGD"), make([]byte, 0x400)...)
+	packed := 1<<17 | 23<<10 | 456
+	ghost[4], ghost[5], ghost[6], ghost[7] = byte(packed>>16), byte(packed>>8), byte(packed), 8<<2
+	if result := uploadGhost(t, 600000001, ghost); result != "0" {
+		t.Fatalf("upload got result %q", result)
+	}
+
+	var page LeaderboardResponse
+	if status := requestLeaderboard(t, HandleLeaderboard, "/api/leaderboard?game=mariokartwii&board=tt8", &page); status != http.StatusOK {
+		t.Fatal(status)
+	}
+	if len(page.Entries) != 1 || page.Entries[0].ProfileID != 600000001 || page.Entries[0].Name != "Mario" || page.Entries[0].Score != 83456 {
+		t.Errorf("got leaderboard %+v", page.Entries)
+	}
+}
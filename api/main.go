@@ -2,34 +2,38 @@ package api
 
 import (
 	"context"
-	"fmt"
+	"crypto/subtle"
+	"net/url"
+	"time"
 	"wwfc/common"
-
-	"github.com/jackc/pgx/v4/pgxpool"
+	"wwfc/database"
 )
 
 var (
 	ctx        = context.Background()
-	pool       *pgxpool.Pool
+	store      database.Store
 	apiSecret  string
 	apiTrusted string
 )
 
+// checkAPISecret checks the secret the moderation endpoints are called with. No secret in the
+// config disables them.
+// TODO: Actual authentication rather than a fixed secret
+func checkAPISecret(query url.Values) bool {
+	return apiSecret != "" && subtle.ConstantTimeCompare([]byte(query.Get("secret")), []byte(apiSecret)) == 1
+}
+
 func StartServer(reload bool) {
 	// Get config
 	config := common.GetConfig()
 
 	apiSecret = config.APISecret
 	apiTrusted = config.TrustedKey
+	leaderboardCacheTTL = time.Duration(*config.LeaderboardCacheTTL) * time.Second
 
 	// Start SQL
-	dbString := fmt.Sprintf("postgres://%s:%s@%s/%s", config.Username, config.Password, config.DatabaseAddress, config.DatabaseName)
-	dbConf, err := pgxpool.ParseConfig(dbString)
-	if err != nil {
-		panic(err)
-	}
-
-	pool, err = pgxpool.ConnectConfig(ctx, dbConf)
+	var err error
+	store, err = database.Connect(ctx, config)
 	if err != nil {
 		panic(err)
 	}
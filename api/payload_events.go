@@ -0,0 +1,38 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"wwfc/inspect"
+)
+
+type PayloadEventsResponse struct {
+	Events []inspect.Event `json:"events"`
+}
+
+// HandlePayloadEvents lists the most recent payloads that matched a signature, newest first:
+// /api/payload_events?secret=...
+func HandlePayloadEvents(w http.ResponseWriter, r *http.Request) {
+	var jsonData []byte
+	response, errorString := handlePayloadEventsImpl(r)
+	if errorString != "" {
+		jsonData, _ = json.Marshal(map[string]string{"error": errorString})
+	} else {
+		jsonData, _ = json.Marshal(response)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Length", strconv.Itoa(len(jsonData)))
+	w.Write(jsonData)
+}
+
+func handlePayloadEventsImpl(r *http.Request) (PayloadEventsResponse, string) {
+	query := r.URL.Query()
+	if !checkAPISecret(query) {
+		return PayloadEventsResponse{}, "Invalid API secret"
+	}
+
+	return PayloadEventsResponse{Events: inspect.Events()}, ""
+}
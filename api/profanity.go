@@ -0,0 +1,59 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"wwfc/profanity"
+)
+
+type ProfanityResponse struct {
+	Text     string `json:"text"`
+	Language int    `json:"lang"`
+	Profane  bool   `json:"profane"`
+}
+
+// HandleProfanity tests a string against the word lists currently in use, the same check NAS and
+// GPCM make: /api/profanity?secret=...&text=...&lang=1
+func HandleProfanity(w http.ResponseWriter, r *http.Request) {
+	var jsonData []byte
+	response, errorString := handleProfanityImpl(r)
+	if errorString != "" {
+		jsonData, _ = json.Marshal(map[string]string{"error": errorString})
+	} else {
+		jsonData, _ = json.Marshal(response)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Length", strconv.Itoa(len(jsonData)))
+	w.Write(jsonData)
+}
+
+func handleProfanityImpl(r *http.Request) (ProfanityResponse, string) {
+	query := r.URL.Query()
+	if !checkAPISecret(query) {
+		return ProfanityResponse{}, "Invalid API secret"
+	}
+
+	text := query.Get("text")
+	if text == "" {
+		return ProfanityResponse{}, "Missing text in request"
+	}
+
+	// Without a language only the shared list applies
+	language := profanity.AnyLanguage
+	if lang := query.Get("lang"); lang != "" {
+		value, err := strconv.Atoi(lang)
+		if err != nil || value < 0 || value > 255 {
+			return ProfanityResponse{}, "Invalid lang"
+		}
+		language = value
+	}
+
+	if !profanity.IsLoaded() {
+		return ProfanityResponse{}, "The word list isn't loaded"
+	}
+
+	return ProfanityResponse{Text: text, Language: language, Profane: profanity.Check(text, language)}, ""
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"wwfc/database"
+	"wwfc/gamestats"
+	"wwfc/gpcm"
+	"wwfc/logging"
+	"wwfc/qr2"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+type ProfileExportResponse struct {
+	database.ProfileExport
+	// Friend lists are only known while the player is online
+	Online            bool     `json:"online"`
+	Friends           []uint32 `json:"friends"`
+	AuthorizedFriends []uint32 `json:"authorized_friends"`
+}
+
+type ProfileDeleteResponse struct {
+	Success bool `json:"success"`
+	// Rows removed from each table
+	Removed map[string]int64 `json:"removed"`
+}
+
+var (
+	// Replaced in tests
+	exportProfile = func(profileId uint32) (database.ProfileExport, error) {
+		return store.ExportProfile(ctx, profileId)
+	}
+	deleteProfile = func(profileId uint32) (map[string]int64, error) {
+		return store.DeleteProfile(ctx, profileId)
+	}
+	forgetProfile = func(profileId uint32) {
+		gpcm.KickPlayer(profileId, "deleted")
+		qr2.Logout(profileId)
+		gamestats.ForgetProfile(profileId)
+	}
+)
+
+// HandleProfile serves data protection requests for a profile:
+// GET /api/profile/600000001/export?secret=... returns everything stored about it
+// DELETE /api/profile/600000001?secret=...&moderator=... deletes it
+func HandleProfile(w http.ResponseWriter, r *http.Request) {
+	var jsonData []byte
+	response, errorString := handleProfileImpl(r)
+	if errorString != "" {
+		jsonData, _ = json.Marshal(map[string]string{"error": errorString})
+	} else {
+		jsonData, _ = json.Marshal(response)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Length", strconv.Itoa(len(jsonData)))
+	w.Write(jsonData)
+}
+
+func handleProfileImpl(r *http.Request) (any, string) {
+	query := r.URL.Query()
+	if !checkAPISecret(query) {
+		return nil, "Invalid API secret"
+	}
+
+	pidStr, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/profile/"), "/")
+	profileId, err := strconv.ParseUint(pidStr, 10, 32)
+	if err != nil || profileId == 0 {
+		return nil, "Invalid pid"
+	}
+
+	moderator := query.Get("moderator")
+	if moderator == "" {
+		moderator = "admin"
+	}
+
+	switch {
+	case action == "export" && r.Method == http.MethodGet:
+		return handleProfileExport(uint32(profileId), moderator)
+
+	case action == "" && r.Method == http.MethodDelete:
+		return handleProfileDelete(uint32(profileId), moderator)
+	}
+
+	return nil, "Unknown request"
+}
+
+func handleProfileExport(profileId uint32, moderator string) (any, string) {
+	export, err := exportProfile(profileId)
+	if errors.Is(err, database.ErrNotFound) {
+		return nil, "Profile not found"
+	} else if err != nil {
+		logging.Error("API", "Failed to export profile", aurora.Cyan(profileId).String()+":", err)
+		return nil, "Database error"
+	}
+
+	response := ProfileExportResponse{ProfileExport: export}
+	response.Friends, response.AuthorizedFriends, response.Online = gpcm.GetFriendLists(profileId)
+
+	logging.Audit(logging.AuditEvent{
+		Event:     logging.AuditProfileExport,
+		ProfileID: profileId,
+		Moderator: moderator,
+	})
+
+	return response, ""
+}
+
+func handleProfileDelete(profileId uint32, moderator string) (any, string) {
+	removed, err := deleteProfile(profileId)
+	if errors.Is(err, database.ErrNotFound) {
+		return nil, "Profile not found"
+	} else if err != nil {
+		logging.Error("API", "Failed to delete profile", aurora.Cyan(profileId).String()+":", err)
+		return nil, "Database error"
+	}
+
+	// Disconnect the player once the profile is gone from the database, a session that logged in
+	// again before the deletion would otherwise be left running with the deleted profile
+	forgetProfile(profileId)
+	clearLeaderboardCache()
+
+	details := map[string]string{}
+	for table, count := range removed {
+		details[table] = strconv.FormatInt(count, 10)
+	}
+	logging.Audit(logging.AuditEvent{
+		Event:     logging.AuditProfileDelete,
+		ProfileID: profileId,
+		Moderator: moderator,
+		Details:   details,
+	})
+
+	logging.Notice("API", "Deleted profile", aurora.Cyan(profileId), "for", aurora.BrightCyan(moderator))
+	return ProfileDeleteResponse{Success: true, Removed: removed}, ""
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"wwfc/database"
+)
+
+// fakeProfiles stubs the database with one profile, 600000001, and records which profiles were
+// deleted from it and then forgotten
+func fakeProfiles(t *testing.T) (deleted *[]uint32, forgotten *[]uint32) {
+	deleted, forgotten = &[]uint32{}, &[]uint32{}
+
+	oldExport, oldDelete, oldForget, oldSecret := exportProfile, deleteProfile, forgetProfile, apiSecret
+	exportProfile = func(profileId uint32) (database.ProfileExport, error) {
+		if profileId != 600000001 {
+			return database.ProfileExport{}, database.ErrNotFound
+		}
+		return database.ProfileExport{Profile: database.ProfileRecord{ProfileID: profileId}, PlayerData: []database.PlayerDataRecord{{GameName: "mariokartwii", Data: []byte{1, 2, 3}}}}, nil
+	}
+	deleteProfile = func(profileId uint32) (map[string]int64, error) {
+		if profileId != 600000001 {
+			return nil, database.ErrNotFound
+		}
+		*deleted = append(*deleted, profileId)
+		return map[string]int64{"sake_files": 2}, nil
+	}
+	forgetProfile = func(profileId uint32) {
+		*forgotten = append(*forgotten, profileId)
+	}
+	apiSecret = "secret"
+
+	t.Cleanup(func() {
+		exportProfile, deleteProfile, forgetProfile, apiSecret = oldExport, oldDelete, oldForget, oldSecret
+	})
+	return deleted, forgotten
+}
+
+func TestProfileExport(t *testing.T) {
+	deleted, forgotten := fakeProfiles(t)
+
+	response, errorString := handleProfileImpl(httptest.NewRequest("GET", "/api/profile/600000001/export?secret=secret", nil))
+	if errorString != "" {
+		t.Fatal(errorString)
+	}
+
+	export, ok := response.(ProfileExportResponse)
+	if !ok || export.Profile.ProfileID != 600000001 || len(export.PlayerData) != 1 {
+		t.Errorf("unexpected export: %+v", response)
+	}
+	if export.Online {
+		t.Error("profile that isn't logged in is online")
+	}
+	if len(*deleted) != 0 || len(*forgotten) != 0 {
+		t.Error("export deleted the profile")
+	}
+
+	if _, errorString := handleProfileImpl(httptest.NewRequest("GET", "/api/profile/600000002/export?secret=secret", nil)); errorString != "Profile not found" {
+		t.Errorf("missing profile gave %q", errorString)
+	}
+}
+
+func TestProfileDelete(t *testing.T) {
+	deleted, forgotten := fakeProfiles(t)
+
+	leaderboardCache = map[string]leaderboardCacheEntry{"/api/leaderboard?board=tt0": {}}
+	t.Cleanup(func() { leaderboardCache = map[string]leaderboardCacheEntry{} })
+
+	response, errorString := handleProfileImpl(httptest.NewRequest("DELETE", "/api/profile/600000001?secret=secret&moderator=mod", nil))
+	if errorString != "" {
+		t.Fatal(errorString)
+	}
+
+	if result, ok := response.(ProfileDeleteResponse); !ok || !result.Success || result.Removed["sake_files"] != 2 {
+		t.Errorf("unexpected response: %+v", response)
+	}
+	if len(*deleted) != 1 || len(*forgotten) != 1 || (*forgotten)[0] != 600000001 {
+		t.Errorf("deleted %v and forgot %v, expected 600000001 once", *deleted, *forgotten)
+	}
+	if len(leaderboardCache) != 0 {
+		t.Error("leaderboard cache wasn't cleared")
+	}
+
+	// Nothing is forgotten unless the database deletion went through
+	deleteProfile = func(uint32) (map[string]int64, error) { return nil, errors.New("connection refused") }
+	if _, errorString := handleProfileImpl(httptest.NewRequest("DELETE", "/api/profile/600000001?secret=secret", nil)); errorString != "Database error" {
+		t.Errorf("failed deletion gave %q", errorString)
+	}
+	if len(*forgotten) != 1 {
+		t.Error("profile was forgotten after the deletion failed")
+	}
+}
+
+func TestProfileRequestRejected(t *testing.T) {
+	deleted, forgotten := fakeProfiles(t)
+
+	for _, request := range []struct{ method, target string }{
+		{"DELETE", "/api/profile/600000001"},
+		{"DELETE", "/api/profile/600000001?secret=wrong"},
+		{"DELETE", "/api/profile/abc?secret=secret"},
+		{"DELETE", "/api/profile/0?secret=secret"},
+		{"GET", "/api/profile/600000001?secret=secret"},
+		{"DELETE", "/api/profile/600000001/export?secret=secret"},
+		{"GET", "/api/profile/600000001/other?secret=secret"},
+	} {
+		if _, errorString := handleProfileImpl(httptest.NewRequest(request.method, request.target, nil)); errorString == "" {
+			t.Errorf("%s %s was accepted", request.method, request.target)
+		}
+	}
+
+	if len(*deleted) != 0 || len(*forgotten) != 0 {
+		t.Error("rejected request deleted the profile")
+	}
+}
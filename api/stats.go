@@ -7,8 +7,14 @@ import (
 	"net/url"
 	"strconv"
 	"wwfc/common"
+	"wwfc/database"
+	"wwfc/gamestats"
+	"wwfc/gpcm"
+	"wwfc/logging"
+	"wwfc/natneg"
 	"wwfc/qr2"
-	//"wwfc/gpcm"
+	"wwfc/sake"
+	"wwfc/serverbrowser"
 )
 
 var usedGameNames = []string{"mariokartwii"} // Initialize with "mariokartwii"
@@ -17,6 +23,16 @@ type Stats struct {
 	OnlinePlayerCount int `json:"online"`
 	ActivePlayerCount int `json:"active"`
 	GroupCount        int `json:"groups"`
+	// Only set for the global stats
+	ReapedSessions uint64                        `json:"reaped_sessions,omitempty"`
+	Relays         *natneg.RelayStats            `json:"natneg_relays,omitempty"`
+	Reports        *natneg.ReportStats           `json:"natneg_reports,omitempty"`
+	NATTypes       []database.NATTypeStats       `json:"nat_types,omitempty"`
+	SakeFiles      *sake.FileStats               `json:"sake_files,omitempty"`
+	ListCache      *serverbrowser.ListCacheStats `json:"sb_list_cache,omitempty"`
+	AuthFailures   uint64                        `json:"gstats_auth_failures,omitempty"`
+	// Sessions disconnected by a newer login of the same profile
+	DuplicateLoginKicks uint64 `json:"gpcm_duplicate_login_kicks,omitempty"`
 }
 
 func HandleStats(w http.ResponseWriter, r *http.Request) {
@@ -36,6 +52,7 @@ func HandleStats(w http.ResponseWriter, r *http.Request) {
 
 	stats := map[string]Stats{}
 
+	// Both leave out shadow banned players, like the other public listings
 	servers := qr2.GetSessionServers()
 	groups := qr2.GetGroups([]string{}, []string{}, false)
 
@@ -43,6 +60,31 @@ func HandleStats(w http.ResponseWriter, r *http.Request) {
 		OnlinePlayerCount: len(servers),
 		ActivePlayerCount: 0,
 		GroupCount:        len(groups),
+		ReapedSessions:    qr2.GetReapedSessionCount(),
+	}
+
+	relayStats := natneg.GetRelayStats()
+	if relayStats.Created != 0 {
+		globalStats.Relays = &relayStats
+	}
+
+	reportStats := natneg.GetReportStats()
+	globalStats.Reports = &reportStats
+
+	fileStats := sake.GetFileStats()
+	globalStats.SakeFiles = &fileStats
+
+	listCacheStats := serverbrowser.GetListCacheStats()
+	globalStats.ListCache = &listCacheStats
+
+	globalStats.AuthFailures, _ = gamestats.GetAuthFailures()
+	globalStats.DuplicateLoginKicks = gpcm.GetDuplicateLoginKickCount()
+
+	// All-time outcomes by NAT type, to see which NATs fail to negotiate
+	if natTypes, err := store.GetNATStats(ctx); err != nil {
+		logging.Error("API", "Failed to get NAT stats:", err)
+	} else {
+		globalStats.NATTypes = natTypes
 	}
 
 	for _, server := range servers {
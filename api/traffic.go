@@ -0,0 +1,106 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+	"wwfc/database"
+	"wwfc/logging"
+)
+
+const (
+	// Days returned when the request has no date range
+	defaultTrafficDays = 7
+	maxTrafficEntries  = 1000
+)
+
+type TrafficResponse struct {
+	From    string                  `json:"from"`
+	To      string                  `json:"to"`
+	Entries []database.TrafficEntry `json:"entries"`
+}
+
+var (
+	// Replaced in tests
+	getTraffic = func(filter database.TrafficFilter) ([]database.TrafficEntry, error) {
+		return store.GetTraffic(ctx, filter)
+	}
+)
+
+// HandleTraffic returns the daily traffic of each profile and IP address, filtered by either or both:
+// /api/traffic?secret=...&pid=600000001&ip=1.2.3.4&from=2024-01-01&to=2024-01-07
+// Dates are in UTC and inclusive, the range defaults to the last seven days.
+func HandleTraffic(w http.ResponseWriter, r *http.Request) {
+	var jsonData []byte
+	response, errorString := handleTrafficImpl(r)
+	if errorString != "" {
+		jsonData, _ = json.Marshal(map[string]string{"error": errorString})
+	} else {
+		jsonData, _ = json.Marshal(response)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Length", strconv.Itoa(len(jsonData)))
+	w.Write(jsonData)
+}
+
+func handleTrafficImpl(r *http.Request) (TrafficResponse, string) {
+	query := r.URL.Query()
+	if !checkAPISecret(query) {
+		return TrafficResponse{}, "Invalid API secret"
+	}
+
+	filter := database.TrafficFilter{Limit: maxTrafficEntries}
+
+	if pid := query.Get("pid"); pid != "" {
+		profileId, err := strconv.ParseUint(pid, 10, 32)
+		if err != nil || profileId == 0 {
+			return TrafficResponse{}, "Invalid pid"
+		}
+		filter.ProfileID = uint32(profileId)
+	}
+
+	if ip := query.Get("ip"); ip != "" {
+		if net.ParseIP(ip) == nil {
+			return TrafficResponse{}, "Invalid ip"
+		}
+		filter.IPAddress = ip
+	}
+
+	filter.To = time.Now().UTC().Truncate(24 * time.Hour)
+	if to := query.Get("to"); to != "" {
+		day, err := time.Parse(time.DateOnly, to)
+		if err != nil {
+			return TrafficResponse{}, "Invalid to date"
+		}
+		filter.To = day
+	}
+
+	filter.From = filter.To.AddDate(0, 0, 1-defaultTrafficDays)
+	if from := query.Get("from"); from != "" {
+		day, err := time.Parse(time.DateOnly, from)
+		if err != nil {
+			return TrafficResponse{}, "Invalid from date"
+		}
+		filter.From = day
+	}
+
+	if filter.From.After(filter.To) {
+		return TrafficResponse{}, "from is after to"
+	}
+
+	entries, err := getTraffic(filter)
+	if err != nil {
+		logging.Error("API", "Failed to get traffic:", err)
+		return TrafficResponse{}, "Database error"
+	}
+
+	return TrafficResponse{
+		From:    filter.From.Format(time.DateOnly),
+		To:      filter.To.Format(time.DateOnly),
+		Entries: entries,
+	}, ""
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+	"wwfc/database"
+)
+
+func TestTrafficFilter(t *testing.T) {
+	var filter database.TrafficFilter
+	oldGet, oldSecret := getTraffic, apiSecret
+	getTraffic = func(f database.TrafficFilter) ([]database.TrafficEntry, error) {
+		filter = f
+		return []database.TrafficEntry{}, nil
+	}
+	apiSecret = "secret"
+	t.Cleanup(func() { getTraffic, apiSecret = oldGet, oldSecret })
+
+	response, errorString := handleTrafficImpl(httptest.NewRequest("GET", "/api/traffic?secret=secret&pid=600000001&ip=1.2.3.4&from=2024-01-01&to=2024-01-07", nil))
+	if errorString != "" {
+		t.Fatal(errorString)
+	}
+	if filter.ProfileID != 600000001 || filter.IPAddress != "1.2.3.4" || filter.From.Format(time.DateOnly) != "2024-01-01" || filter.To.Format(time.DateOnly) != "2024-01-07" {
+		t.Errorf("unexpected filter: %+v", filter)
+	}
+	if response.From != "2024-01-01" || response.To != "2024-01-07" {
+		t.Errorf("unexpected range in response: %+v", response)
+	}
+
+	// The default range is the last seven days including today
+	if _, errorString := handleTrafficImpl(httptest.NewRequest("GET", "/api/traffic?secret=secret&pid=600000001", nil)); errorString != "" {
+		t.Fatal(errorString)
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	if !filter.To.Equal(today) || !filter.From.Equal(today.AddDate(0, 0, -6)) || filter.IPAddress != "" {
+		t.Errorf("unexpected default filter: %+v", filter)
+	}
+
+	for _, target := range []string{
+		"/api/traffic?pid=600000001",
+		"/api/traffic?secret=secret&pid=abc",
+		"/api/traffic?secret=secret&ip=1.2.3",
+		"/api/traffic?secret=secret&from=yesterday",
+		"/api/traffic?secret=secret&from=2024-01-08&to=2024-01-07",
+	} {
+		if _, errorString := handleTrafficImpl(httptest.NewRequest("GET", target, nil)); errorString == "" {
+			t.Errorf("%s was accepted", target)
+		}
+	}
+}
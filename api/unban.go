@@ -5,7 +5,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
-	"wwfc/database"
+	"wwfc/logging"
 )
 
 func HandleUnban(w http.ResponseWriter, r *http.Request) {
@@ -26,7 +26,6 @@ func HandleUnban(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleUnbanImpl(w http.ResponseWriter, r *http.Request) string {
-	// TODO: Actual authentication rather than a fixed secret
 	// TODO: Use POST instead of GET
 
 	u, err := url.Parse(r.URL.String())
@@ -39,7 +38,7 @@ func handleUnbanImpl(w http.ResponseWriter, r *http.Request) string {
 		return "Bad request"
 	}
 
-	if apiSecret == "" || query.Get("secret") != apiSecret {
+	if !checkAPISecret(query) {
 		return "Invalid API secret"
 	}
 
@@ -53,6 +52,7 @@ func handleUnbanImpl(w http.ResponseWriter, r *http.Request) string {
 		return "Invalid pid"
 	}
 
-	database.UnbanUser(pool, ctx, uint32(pid))
+	store.UnbanUser(ctx, uint32(pid))
+	logging.Audit(logging.AuditEvent{Event: logging.AuditUnban, ProfileID: uint32(pid)})
 	return ""
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wwfc/common"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+var (
+	// Calls to the backend that haven't returned yet, a deep queue means the backend is falling behind
+	rpcInFlight atomic.Int64
+
+	backpressureThreshold atomic.Int64
+	backpressureReject    atomic.Bool
+
+	// How often a paused accept loop checks whether the backend has caught up
+	backpressurePollInterval = 50 * time.Millisecond
+)
+
+func applyBackpressureConfig(config common.Config) {
+	backpressureThreshold.Store(int64(config.BackpressureThreshold))
+	backpressureReject.Store(config.BackpressureMode == common.BackpressureReject)
+}
+
+// beginRPC marks a call to the backend as in flight. The call must be finished with endRPC.
+func beginRPC() {
+	rpcMutex.RLock()
+	rpcBusyCount.Add(1)
+	rpcInFlight.Add(1)
+	rpcMutex.RUnlock()
+}
+
+func endRPC() {
+	rpcInFlight.Add(-1)
+	rpcBusyCount.Done()
+}
+
+func isBackendOverloaded() bool {
+	threshold := backpressureThreshold.Load()
+	return threshold > 0 && rpcInFlight.Load() >= threshold
+}
+
+// backpressure tracks the overload state seen by one listener, so the change is logged once
+// rather than for every connection. The WebSocket listener checks connections concurrently.
+type backpressure struct {
+	server     string
+	mutex      sync.Mutex
+	overloaded bool
+	since      time.Time
+	rejected   uint64
+}
+
+// waitBeforeAccept blocks while the backend is overloaded in pause mode
+func (b *backpressure) waitBeforeAccept() {
+	paused := false
+	for !backpressureReject.Load() && isBackendOverloaded() {
+		b.update(true)
+		paused = true
+		time.Sleep(backpressurePollInterval)
+	}
+
+	if paused {
+		b.update(false)
+	}
+}
+
+// shouldReject checks an accepted connection in reject mode
+func (b *backpressure) shouldReject(addr net.Addr) bool {
+	if !backpressureReject.Load() || !isBackendOverloaded() {
+		b.update(false)
+		return false
+	}
+
+	b.update(true)
+	b.mutex.Lock()
+	b.rejected++
+	b.mutex.Unlock()
+	logging.Info("FRONTEND", "Rejected connection from", aurora.BrightCyan(addr.String()), "to", aurora.BrightCyan(b.server), "while the backend is overloaded")
+	return true
+}
+
+func (b *backpressure) update(overloaded bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if overloaded == b.overloaded {
+		return
+	}
+	b.overloaded = overloaded
+
+	if overloaded {
+		b.since = time.Now()
+		b.rejected = 0
+
+		action := "pausing"
+		if backpressureReject.Load() {
+			action = "rejecting"
+		}
+		logging.Warn("FRONTEND", "Backend has", aurora.Cyan(rpcInFlight.Load()), "calls in flight,", action, "new connections to", aurora.BrightCyan(b.server))
+		return
+	}
+
+	logging.Notice("FRONTEND", "Backend caught up, accepting connections to", aurora.BrightCyan(b.server), "again after", aurora.Cyan(time.Since(b.since).Round(time.Millisecond)), "with", aurora.Cyan(b.rejected), "rejected")
+}
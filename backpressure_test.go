@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+	"wwfc/common"
+)
+
+func testBackpressure(t *testing.T, threshold int, mode string) {
+	applyBackpressureConfig(common.Config{BackpressureThreshold: threshold, BackpressureMode: mode})
+	oldInterval := backpressurePollInterval
+	backpressurePollInterval = time.Millisecond
+	t.Cleanup(func() {
+		applyBackpressureConfig(common.Config{})
+		backpressurePollInterval = oldInterval
+		rpcInFlight.Store(0)
+	})
+}
+
+func TestBackpressureReject(t *testing.T) {
+	testBackpressure(t, 2, common.BackpressureReject)
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	pressure := &backpressure{server: "gpcm"}
+	rpcInFlight.Store(1)
+	if pressure.shouldReject(server.RemoteAddr()) {
+		t.Error("rejected below the threshold")
+	}
+
+	rpcInFlight.Store(2)
+	if !pressure.shouldReject(server.RemoteAddr()) || !pressure.shouldReject(server.RemoteAddr()) || pressure.rejected != 2 {
+		t.Errorf("didn't reject at the threshold, rejected %d", pressure.rejected)
+	}
+
+	rpcInFlight.Store(1)
+	if pressure.shouldReject(server.RemoteAddr()) || pressure.overloaded {
+		t.Error("still rejecting after the backend caught up")
+	}
+
+	// Pause mode doesn't wait in reject mode
+	rpcInFlight.Store(5)
+	pressure.waitBeforeAccept()
+}
+
+func TestBackpressurePause(t *testing.T) {
+	testBackpressure(t, 2, common.BackpressurePause)
+
+	pressure := &backpressure{server: "gpcm"}
+	rpcInFlight.Store(3)
+
+	done := make(chan struct{})
+	go func() {
+		pressure.waitBeforeAccept()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("accepted while overloaded")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	rpcInFlight.Store(1)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("still paused after the backend caught up")
+	}
+
+	if pressure.overloaded {
+		t.Error("still marked as overloaded")
+	}
+}
+
+func TestBackpressureDisabled(t *testing.T) {
+	testBackpressure(t, 0, common.BackpressureReject)
+	rpcInFlight.Store(1000)
+
+	if isBackendOverloaded() {
+		t.Error("overloaded with the check disabled")
+	}
+}
+
+func TestAdmitConnection(t *testing.T) {
+	testBackpressure(t, 2, common.BackpressureReject)
+	list, err := loadAllowList(common.Config{AllowList: "192.0.2.0/24"}, []serverInfo{{rpcName: "gpcm"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowListState.Store(list)
+	defer allowListState.Store(nil)
+
+	pressure := &backpressure{server: "gpcm"}
+	allowed := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	if !admitConnection("gpcm", allowed, pressure) {
+		t.Error("rejected an allowed address")
+	}
+	if admitConnection("gpcm", &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 1234}, pressure) {
+		t.Error("admitted an address not in the allow list")
+	}
+
+	rpcInFlight.Store(2)
+	if admitConnection("gpcm", allowed, pressure) {
+		t.Error("admitted a connection while the backend is overloaded")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"wwfc/gpcm"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+var (
+	ErrEmptyBroadcast   = errors.New("broadcast message is empty")
+	ErrBackendReloading = errors.New("backend is reloading")
+	ErrNoBackend        = errors.New("backend is not connected")
+)
+
+// RPCFrontendPacket.Broadcast is called by the command interface to send a message to every player
+// online, through the backend. Returns how many players it was sent to.
+func (r *RPCFrontendPacket) Broadcast(text string, result *gpcm.BroadcastResult) error {
+	if text == "" {
+		return ErrEmptyBroadcast
+	}
+
+	// Not worth holding up a reload for, the broadcast can be sent again once it's done
+	if !rpcMutex.TryRLock() {
+		return ErrBackendReloading
+	}
+	defer rpcMutex.RUnlock()
+
+	if rpcClient == nil {
+		return ErrNoBackend
+	}
+
+	logging.Notice("FRONTEND", "Broadcasting:", aurora.Cyan(text))
+	return rpcClient.Call("RPCPacket.Broadcast", text, result)
+}
+
+// RPCPacket.Broadcast is called by the frontend to send a message to every logged in player
+func (r *RPCPacket) Broadcast(text string, result *gpcm.BroadcastResult) error {
+	*result = gpcm.BroadcastMessage(text)
+	return nil
+}
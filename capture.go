@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+	"wwfc/common"
+	"wwfc/gpcm"
+	"wwfc/logging"
+	"wwfc/nas"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// Replayed connections get an index with the top bit set, which the frontend never hands out
+const replayIndexBase = uint64(1) << 63
+
+var replayCount atomic.Uint64
+
+// CaptureArgs picks the connection to capture. For GPCM the ID can be the profile ID of a player
+// logged in, otherwise it's the connection index.
+type CaptureArgs struct {
+	Server string
+	ID     uint64
+}
+
+// ReplayResult compares the packets a replay sent with the ones in the capture
+type ReplayResult struct {
+	Server   string
+	Inbound  int
+	Recorded int
+	Sent     int
+	Matched  int
+	// Position of the first sent packet that differs from the capture, -1 if none does
+	FirstDifference int
+	// Set if the server panicked during the replay
+	Error string
+}
+
+var (
+	errCaptureUnknownServer = errors.New("unknown or disabled server")
+	errReplayServer         = errors.New("the server can't be replayed without side effects")
+	errReplayPath           = errors.New("captures can only be replayed from the capture directory")
+)
+
+// RPCPacket.StartCapture is called by the command interface to record a connection's packets
+func (r *RPCPacket) StartCapture(args CaptureArgs, path *string) error {
+	if !isCapturableServer(args.Server) {
+		return errCaptureUnknownServer
+	}
+
+	index := resolveCaptureIndex(args)
+	var err error
+	*path, err = common.StartCapture(args.Server, index, config.CaptureDir, int64(*config.CaptureMaxBytes), time.Duration(*config.CaptureMaxDuration)*time.Second)
+	return err
+}
+
+// RPCPacket.StopCapture is called by the command interface to end a capture before it expires
+func (r *RPCPacket) StopCapture(args CaptureArgs, info *common.CaptureInfo) error {
+	if !isCapturableServer(args.Server) {
+		return errCaptureUnknownServer
+	}
+
+	var err error
+	*info, err = common.StopCapture(args.Server, resolveCaptureIndex(args))
+	return err
+}
+
+// RPCPacket.Replay is called by the command interface to feed a capture's inbound packets to its
+// server on a new connection, and compare what the server sends back with the capture. The replay
+// is a dry run: nothing reaches a client or the database, so only the servers that can skip their
+// side effects are replayed. The path is a file in the capture directory.
+func (r *RPCPacket) Replay(path string, result *ReplayResult) (err error) {
+	path, err = resolveReplayPath(path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	server, _, records, err := common.ReadCapture(file)
+	if err != nil {
+		return err
+	}
+
+	if !isCapturableServer(server) {
+		return errCaptureUnknownServer
+	}
+	if !isReplayableServer(server) {
+		return errReplayServer
+	}
+
+	index := replayIndexBase | replayCount.Add(1)
+	traceID := logging.NewTraceID(server, index)
+	logging.Notice("BACKEND", "Replaying", aurora.Cyan(len(records)), "packets from", aurora.BrightCyan(path), "on", aurora.BrightCyan(server), aurora.Cyan(index), "trace="+traceID)
+
+	var recorded [][]byte
+	for _, record := range records {
+		if record.Direction == common.CaptureOutbound {
+			recorded = append(recorded, record.Data)
+		}
+	}
+
+	common.BeginReplay(server, index)
+	result.Error = replayRecords(server, index, traceID, records)
+	sent := common.EndReplay(server, index)
+
+	result.Server = server
+	result.Inbound = len(records) - len(recorded)
+	result.Recorded = len(recorded)
+	result.Sent = len(sent)
+	result.FirstDifference = -1
+	for i := 0; i < max(len(sent), len(recorded)); i++ {
+		if i < len(sent) && i < len(recorded) && bytes.Equal(sent[i], recorded[i]) {
+			result.Matched++
+		} else if result.FirstDifference == -1 {
+			result.FirstDifference = i
+		}
+	}
+
+	return nil
+}
+
+// replayRecords opens the connection, passes it the inbound packets and closes it. Returns the
+// panic if the server had one.
+func replayRecords(server string, index uint64, traceID string, records []common.CaptureRecord) (panicked string) {
+	args := RPCPacket{Server: server, Index: index, TraceID: traceID}
+	var err error
+	defer func() {
+		if err != nil {
+			panicked = err.Error()
+		}
+	}()
+	defer recoverRPCPanic(args, &err)
+	defer closeServerConnection(server, index)
+
+	newServerConnection(server, index, "127.0.0.1:0", traceID)
+	for _, record := range records {
+		if record.Direction == common.CaptureInbound {
+			handleServerPacket(server, index, record.Data, "127.0.0.1:0")
+		}
+	}
+
+	return ""
+}
+
+func isCapturableServer(server string) bool {
+	switch server {
+	case "serverbrowser", "gpcm", "gpsp", "gamestats", nas.ServerName:
+		return config.IsServerEnabled(server)
+	}
+
+	return false
+}
+
+// isReplayableServer checks if the server skips every side effect of a replayed connection. GPCM
+// and NAS log players in and write to the database, so their captures can't be replayed.
+func isReplayableServer(server string) bool {
+	switch server {
+	case "serverbrowser", "gpsp", "gamestats":
+		return true
+	}
+
+	return false
+}
+
+// resolveReplayPath returns the path of the capture file, which must be in the capture directory.
+// A bare file name is looked up in the directory.
+func resolveReplayPath(path string) (string, error) {
+	dir, err := filepath.Abs(config.CaptureDir)
+	if err != nil {
+		return "", err
+	}
+
+	if filepath.Base(path) == path {
+		path = filepath.Join(dir, path)
+	}
+
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	// Symlinks could point out of the directory
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errReplayPath
+	}
+
+	return path, nil
+}
+
+func resolveCaptureIndex(args CaptureArgs) uint64 {
+	if args.Server == "gpcm" && args.ID <= 0xffffffff {
+		if index, ok := gpcm.GetConnIndexByProfileID(uint32(args.ID)); ok {
+			return index
+		}
+	}
+
+	return args.ID
+}
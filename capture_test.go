@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"wwfc/common"
+)
+
+func TestReplayRestrictions(t *testing.T) {
+	oldDir := config.CaptureDir
+	config.CaptureDir = t.TempDir()
+	t.Cleanup(func() { config.CaptureDir = oldDir })
+
+	path, err := common.StartCapture("gpcm", 5, config.CaptureDir, 1024, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	common.CapturePacket("gpcm", 5, common.CaptureInbound, []byte(`\login\\final\`))
+	if _, err := common.StopCapture("gpcm", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	var result ReplayResult
+	if err := (&RPCPacket{}).Replay(filepath.Base(path), &result); !errors.Is(err, errReplayServer) {
+		t.Errorf("replayed a GPCM capture: %v", err)
+	}
+
+	outside := filepath.Join(t.TempDir(), filepath.Base(path))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(outside, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{outside, filepath.Join(config.CaptureDir, "..", filepath.Base(outside)), config.CaptureDir} {
+		if err := (&RPCPacket{}).Replay(path, &result); !errors.Is(err, errReplayPath) {
+			t.Errorf("%s: got %v", path, err)
+		}
+	}
+
+	link := filepath.Join(config.CaptureDir, "link.cap")
+	if err := os.Symlink(outside, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&RPCPacket{}).Replay(link, &result); !errors.Is(err, errReplayPath) {
+		t.Errorf("followed a symlink out of the capture directory: %v", err)
+	}
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"wwfc/api"
+	"wwfc/common"
+	"wwfc/database"
+	"wwfc/gpcm"
+	"wwfc/logging"
+	"wwfc/selftest"
+)
+
+// handleCommand sends a command to the running frontend ("f") or backend ("b") over RPC
+func handleCommand(args []string) {
+	if len(args) < 2 {
+		commandUsage("Usage: cmd <f|b> <command> [args...]")
+	}
+
+	switch args[0] {
+	case "f", "frontend":
+		handleFrontendCommand(args[1:])
+	case "b", "backend":
+		handleBackendCommand(args[1:])
+	default:
+		commandUsage("Unknown command target: " + args[0])
+	}
+}
+
+// Exit codes of "cmd", so scripts can tell why a command failed
+const (
+	// The frontend or backend returned an error, or didn't confirm the operation
+	exitCommandFailed = 1
+	// Invalid arguments, or a server or game that doesn't exist
+	exitCommandUsage = 2
+	// The frontend or backend couldn't be reached
+	exitCommandUnreachable = 3
+)
+
+// Errors returned for invalid arguments rather than a failed operation
+var commandUsageErrors = []error{ErrUnknownServer, ErrUnknownGameID, ErrInvalidIP, api.ErrAllowlistTarget}
+
+// remoteCommandError turns an error returned over RPC, which only carries the message, back into
+// the sentinel error it was created from so it can be checked with errors.Is
+func remoteCommandError(err error) error {
+	var serverErr rpc.ServerError
+	if !errors.As(err, &serverErr) {
+		return err
+	}
+
+	for _, usageErr := range commandUsageErrors {
+		if string(serverErr) == usageErr.Error() {
+			return usageErr
+		}
+	}
+	return err
+}
+
+func dialCommand(address string) *rpc.Client {
+	client, err := rpc.Dial("tcp", address)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to connect to", address+":", err)
+		os.Exit(exitCommandUnreachable)
+	}
+
+	return client
+}
+
+// How long to wait for the backend to go down after "cmd f backend shutdown"
+var commandConfirmTimeout = 30 * time.Second
+
+// backendVersion asks the backend directly, without going through the frontend
+func backendVersion() (common.VersionInfo, error) {
+	var version common.VersionInfo
+
+	client, err := rpc.Dial("tcp", config.FrontendBackendAddress)
+	if err != nil {
+		return version, err
+	}
+	defer client.Close()
+
+	err = client.Call("RPCPacket.Version", struct{}{}, &version)
+	return version, err
+}
+
+// waitBackendDown waits until nothing accepts connections on the backend's address
+func waitBackendDown(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", config.FrontendBackendAddress, time.Second)
+		if err != nil {
+			return nil
+		}
+		conn.Close()
+
+		if time.Now().After(deadline) {
+			return errors.New("the backend still accepts connections after " + timeout.String())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// commandUsage prints the lines to stderr and exits
+func commandUsage(lines ...string) {
+	for _, line := range lines {
+		fmt.Fprintln(os.Stderr, line)
+	}
+	os.Exit(exitCommandUsage)
+}
+
+// commandFailed prints the error of a call to stderr and exits
+func commandFailed(action string, err error) {
+	fmt.Fprintln(os.Stderr, "Failed to "+action+":", err)
+	os.Exit(commandExitCode(err))
+}
+
+// commandExitCode picks the exit code for the error of a call
+func commandExitCode(err error) int {
+	err = remoteCommandError(err)
+	for _, usageErr := range commandUsageErrors {
+		if errors.Is(err, usageErr) {
+			return exitCommandUsage
+		}
+	}
+
+	// The connection was lost during the call
+	if errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return exitCommandUnreachable
+	}
+	return exitCommandFailed
+}
+
+func handleFrontendCommand(args []string) {
+	client := dialCommand(config.BackendFrontendAddress)
+	defer client.Close()
+
+	switch args[0] {
+	case "backend":
+		if len(args) < 2 || (args[1] != "reload" && args[1] != "shutdown") {
+			commandUsage("Usage: cmd f backend <reload|shutdown>")
+		}
+
+		if args[1] == "shutdown" {
+			err := client.Call("RPCFrontendPacket.StopBackend", struct{}{}, nil)
+			if err != nil {
+				commandFailed("shut down backend", err)
+			}
+
+			if err := waitBackendDown(commandConfirmTimeout); err != nil {
+				commandFailed("confirm the backend is down", err)
+			}
+
+			fmt.Println("Backend is down, connections are held until a backend starts")
+			return
+		}
+
+		start := time.Now()
+		err := client.Call("RPCFrontendPacket.ReloadBackend", struct{}{}, nil)
+		if err != nil {
+			commandFailed("reload backend", err)
+		}
+
+		// The frontend returns once it's connected to the new backend, make sure it's the new one
+		version, err := backendVersion()
+		if err == nil && version.StartTime.Before(start) {
+			err = errors.New("the backend was started at " + version.StartTime.Format(time.RFC3339) + ", before the reload")
+		}
+		if err != nil {
+			commandFailed("confirm the backend reloaded", err)
+		}
+
+		fmt.Println("Backend reloaded")
+
+	case "config":
+		if len(args) < 2 || args[1] != "reload" {
+			commandUsage("Usage: cmd f config reload")
+		}
+
+		err := client.Call("RPCFrontendPacket.ReloadConfig", struct{}{}, nil)
+		if err != nil {
+			commandFailed("reload config", err)
+		}
+
+		fmt.Println("Config reloaded")
+
+	case "drain":
+		if len(args) < 2 || (len(args) > 2 && args[2] != "--close") {
+			commandUsage("Usage: cmd f drain <server> [--close]")
+		}
+
+		var closed int
+		err := client.Call("RPCFrontendPacket.DrainServer", DrainArgs{Server: args[1], CloseConnections: len(args) > 2}, &closed)
+		if err != nil {
+			commandFailed("drain "+args[1], err)
+		}
+
+		fmt.Println("Drained", args[1]+", closed", closed, "connections")
+
+	case "undrain":
+		if len(args) < 2 {
+			commandUsage("Usage: cmd f undrain <server>")
+		}
+
+		err := client.Call("RPCFrontendPacket.UndrainServer", args[1], nil)
+		if err != nil {
+			commandFailed("undrain "+args[1], err)
+		}
+
+		fmt.Println("Undrained", args[1])
+
+	case "recycle":
+		if len(args) < 2 {
+			commandUsage("Usage: cmd f recycle <server>")
+		}
+
+		var recycled int
+		err := client.Call("RPCFrontendPacket.RecycleServer", args[1], &recycled)
+		if err != nil {
+			commandFailed("recycle "+args[1], err)
+		}
+
+		fmt.Println("Recycled", recycled, "connections to", args[1])
+
+	case "version":
+		var version FrontendVersion
+		err := client.Call("RPCFrontendPacket.Version", struct{}{}, &version)
+		if err != nil {
+			commandFailed("get frontend version", err)
+		}
+
+		fmt.Println("Frontend:")
+		printVersion(version.Frontend)
+		fmt.Println("Backend:")
+		if version.BackendError != "" {
+			fmt.Println("  Unavailable:", version.BackendError)
+		} else {
+			printVersion(version.Backend)
+		}
+
+	case "geoip":
+		var blocked map[string]uint64
+		err := client.Call("RPCFrontendPacket.GeoIPBlocked", struct{}{}, &blocked)
+		if err != nil {
+			commandFailed("get GeoIP stats", err)
+		}
+
+		servers := make([]string, 0, len(blocked))
+		for server := range blocked {
+			servers = append(servers, server)
+		}
+		slices.Sort(servers)
+
+		fmt.Println("Blocked connections:")
+		for _, server := range servers {
+			fmt.Printf("  %-14s %d\n", server, blocked[server])
+		}
+
+	case "ban":
+		if len(args) < 2 {
+			commandUsage("Usage: cmd f ban <ip> [duration] [reason...]")
+		}
+
+		ban := IPBan{IP: args[1]}
+		if len(args) > 2 {
+			duration, err := time.ParseDuration(args[2])
+			if err != nil {
+				// No duration given, the rest is the reason
+				ban.Reason = strings.Join(args[2:], " ")
+			} else {
+				ban.Expires = time.Now().Add(duration)
+				ban.Reason = strings.Join(args[3:], " ")
+			}
+		}
+
+		err := client.Call("RPCFrontendPacket.BanIP", ban, nil)
+		if err != nil {
+			commandFailed("ban IP", err)
+		}
+
+		fmt.Println("Banned", ban.IP)
+
+	case "unban":
+		if len(args) < 2 {
+			commandUsage("Usage: cmd f unban <ip>")
+		}
+
+		var removed bool
+		err := client.Call("RPCFrontendPacket.UnbanIP", args[1], &removed)
+		if err != nil {
+			commandFailed("unban IP", err)
+		}
+
+		if !removed {
+			fmt.Println(args[1], "was not banned")
+			return
+		}
+
+		fmt.Println("Unbanned", args[1])
+
+	case "broadcast":
+		if len(args) < 2 {
+			commandUsage("Usage: cmd f broadcast <message...>")
+		}
+
+		var result gpcm.BroadcastResult
+		err := client.Call("RPCFrontendPacket.Broadcast", strings.Join(args[1:], " "), &result)
+		if err != nil {
+			commandFailed("broadcast", err)
+		}
+
+		fmt.Println("Sent to", result.Sent, "players")
+		if result.Failed != 0 {
+			fmt.Println("Failed to send to", result.Failed, "players")
+		}
+
+	case "bans":
+		var bans []IPBan
+		err := client.Call("RPCFrontendPacket.ListIPBans", struct{}{}, &bans)
+		if err != nil {
+			commandFailed("list IP bans", err)
+		}
+
+		slices.SortFunc(bans, func(a, b IPBan) int { return strings.Compare(a.IP, b.IP) })
+		for _, ban := range bans {
+			expires := "never"
+			if !ban.Expires.IsZero() {
+				expires = ban.Expires.Format(time.RFC3339)
+			}
+			fmt.Printf("  %-40s expires %-25s %s\n", ban.IP, expires, ban.Reason)
+		}
+
+	default:
+		commandUsage("Unknown frontend command: " + strings.Join(args, " "))
+	}
+}
+
+func handleBackendCommand(args []string) {
+	// Talks to the servers like a console instead of to the backend over RPC
+	if args[0] == "selftest" {
+		os.Exit(runSelftest(args[1:]))
+	}
+
+	client := dialCommand(config.FrontendBackendAddress)
+	defer client.Close()
+
+	switch args[0] {
+	case "status":
+		var status BackendStatus
+		err := client.Call("RPCPacket.Status", struct{}{}, &status)
+		if err != nil {
+			commandFailed("get backend status", err)
+		}
+
+		printBackendStatus(status)
+
+	case "version":
+		var version common.VersionInfo
+		err := client.Call("RPCPacket.Version", struct{}{}, &version)
+		if err != nil {
+			commandFailed("get backend version", err)
+		}
+
+		printVersion(version)
+
+	case "loglevel":
+		if len(args) < 2 {
+			commandUsage("Usage: cmd b loglevel <0-4|none|notice|error|warn|info>")
+		}
+
+		level, err := logging.ParseLevel(args[1])
+		if err != nil {
+			commandUsage(err.Error())
+		}
+
+		var previous int
+		err = client.Call("RPCPacket.SetLogLevel", level, &previous)
+		if err != nil {
+			commandFailed("set log level", err)
+		}
+
+		fmt.Println("Log level changed from", previous, "to", level, "until the config is reloaded")
+
+	case "trace":
+		if len(args) < 2 {
+			commandUsage("Usage: cmd b trace <id>")
+		}
+
+		var lines []string
+		err := client.Call("RPCPacket.Trace", args[1], &lines)
+		if err != nil {
+			commandFailed("get trace", err)
+		}
+
+		if len(lines) == 0 {
+			fmt.Println("No recent log lines for trace", args[1])
+		}
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+
+	case "capture":
+		handleCaptureCommand(client, args)
+
+	case "replay":
+		if len(args) < 2 {
+			commandUsage("Usage: cmd b replay <file>")
+		}
+
+		var result ReplayResult
+		err := client.Call("RPCPacket.Replay", args[1], &result)
+		if err != nil {
+			commandFailed("replay capture", err)
+		}
+
+		fmt.Println("Replayed", result.Inbound, "packets to", result.Server)
+		fmt.Println("Sent", result.Sent, "packets,", result.Matched, "of the", result.Recorded, "captured ones matched")
+		if result.FirstDifference != -1 {
+			fmt.Println("First difference at sent packet", result.FirstDifference)
+		}
+		if result.Error != "" {
+			fmt.Println("Server failed during the replay:", result.Error)
+		}
+
+	case "gc":
+		var result GCResult
+		err := client.Call("RPCPacket.GC", struct{}{}, &result)
+		if err != nil {
+			commandFailed("run GC", err)
+		}
+
+		fmt.Printf("Heap:     %.1f MiB -> %.1f MiB\n", float64(result.HeapBefore)/(1<<20), float64(result.HeapAfter)/(1<<20))
+		fmt.Printf("Freed:    %.1f MiB\n", float64(result.HeapBefore-min(result.HeapBefore, result.HeapAfter))/(1<<20))
+		fmt.Printf("Released: %.1f MiB to the OS\n", float64(result.Released)/(1<<20))
+		fmt.Println("Took:    ", result.Duration)
+
+	case "game":
+		handleGameCommand(client, args)
+
+	case "allow":
+		handleAllowCommand(client, args)
+
+	default:
+		lines := []string{"Unknown backend command: " + strings.Join(args, " "), "Available commands:"}
+		for _, usage := range backendCommands {
+			lines = append(lines, "  cmd b "+usage)
+		}
+		commandUsage(lines...)
+	}
+}
+
+// backendCommands is the usage of every backend command, listed for an unknown one
+var backendCommands = []string{
+	"status",
+	"version",
+	"loglevel <0-4|none|notice|error|warn|info>",
+	"gc",
+	"trace <id>",
+	"capture <start|stop> <server> <profileid|index>",
+	"replay <file>",
+	"game <enable|disable> <gameid>",
+	"game list",
+	"allow <add|remove> <pid|fc|cfc> <value>",
+	"allow list",
+	"selftest [host]",
+}
+
+// handleCaptureCommand starts or stops recording a connection's packets on the backend
+func handleCaptureCommand(client *rpc.Client, args []string) {
+	if len(args) < 4 || (args[1] != "start" && args[1] != "stop") {
+		commandUsage("Usage: cmd b capture <start|stop> <server> <profileid|index>")
+	}
+
+	id, err := strconv.ParseUint(args[3], 10, 64)
+	if err != nil {
+		commandUsage("Invalid profile ID or index: " + args[3])
+	}
+
+	captureArgs := CaptureArgs{Server: args[2], ID: id}
+	if args[1] == "start" {
+		var path string
+		err := client.Call("RPCPacket.StartCapture", captureArgs, &path)
+		if err != nil {
+			commandFailed("start capture", err)
+		}
+
+		fmt.Println("Capturing to", path)
+		return
+	}
+
+	var info common.CaptureInfo
+	err = client.Call("RPCPacket.StopCapture", captureArgs, &info)
+	if err != nil {
+		commandFailed("stop capture", err)
+	}
+
+	fmt.Println("Captured", info.Records, "packets,", info.Bytes, "bytes to", info.Path)
+}
+
+// handleAllowCommand adds a profile or console to the allowlist, removes it or lists the allowlist,
+// through the backend like /api/allowlist
+func handleAllowCommand(client *rpc.Client, args []string) {
+	change := api.AllowlistChange{Moderator: "cmd"}
+	if len(args) == 2 && args[1] == "list" {
+		change.Action = "list"
+	} else if len(args) == 4 && (args[1] == "add" || args[1] == "remove") {
+		change.Action = args[1]
+		if err := api.ParseAllowlistTarget(args[2], args[3], &change); err != nil {
+			commandUsage(err.Error())
+		}
+	} else {
+		commandUsage("Usage: cmd b allow <add|remove> <pid|fc|cfc> <value>", "       cmd b allow list")
+	}
+
+	var entries []database.AllowlistEntry
+	err := client.Call("RPCPacket.Allowlist", change, &entries)
+	if err != nil {
+		commandFailed(change.Action+" allowlist", err)
+	}
+
+	switch change.Action {
+	case "list":
+		fmt.Println(len(entries), "allowlist entries")
+		for _, entry := range entries {
+			if entry.ConsoleFC != 0 {
+				fmt.Printf("  console %016d\n", entry.ConsoleFC)
+			} else {
+				fmt.Printf("  profile %d\n", entry.ProfileID)
+			}
+		}
+	case "add":
+		fmt.Println("Added", args[2], args[3], "to the allowlist")
+	default:
+		fmt.Println("Removed", args[2], args[3], "from the allowlist")
+	}
+}
+
+// handleGameCommand enables, disables or lists games on the backend
+func handleGameCommand(client *rpc.Client, args []string) {
+	if len(args) == 2 && args[1] == "list" {
+		var games []common.GameInfo
+		err := client.Call("RPCPacket.DisabledGames", struct{}{}, &games)
+		if err != nil {
+			commandFailed("list disabled games", err)
+		}
+
+		fmt.Println(len(games), "disabled games")
+		for _, game := range games {
+			fmt.Printf("  %-6d %s\n", game.GameID, game.Name)
+		}
+		return
+	}
+
+	if len(args) != 3 || (args[1] != "enable" && args[1] != "disable") {
+		commandUsage("Usage: cmd b game <enable|disable> <gameid>", "       cmd b game list")
+	}
+
+	gameId, err := strconv.Atoi(args[2])
+	if err != nil {
+		commandUsage("Invalid game ID: " + args[2])
+	}
+
+	var game common.GameInfo
+	err = client.Call("RPCPacket.SetGameEnabled", GameOverride{GameID: gameId, Enabled: args[1] == "enable"}, &game)
+	if err != nil {
+		commandFailed(args[1]+" game", err)
+	}
+
+	fmt.Println("Game", game.Name, "is now", args[1]+"d")
+	if !game.Disabled || len(game.GameCodes) != 0 {
+		return
+	}
+
+	fmt.Println("The game has no <gameCodes> in the config, so NAS can't tell its logins apart and still")
+	fmt.Println("accepts them. Its players are rejected when they log in to GPCM or send a heartbeat.")
+}
+
+// runSelftest runs the end to end checks against the servers on the host, returns the exit code
+func runSelftest(args []string) int {
+	host := "127.0.0.1"
+	if len(args) > 0 {
+		host = args[0]
+	}
+
+	target := selftest.NewTarget(config, host)
+
+	common.ReadGameList()
+	common.ApplyGameConfig(config)
+	if game := common.GetGameInfoByName(target.GameName); game != nil {
+		target.SecretKey = game.SecretKey
+	}
+
+	failed := 0
+	for _, result := range selftest.Run(target) {
+		switch {
+		case errors.Is(result.Err, selftest.ErrSkipped):
+			fmt.Printf("  %-22s skipped\n", result.Name)
+		case result.Err != nil:
+			fmt.Printf("  %-22s FAILED: %v\n", result.Name, result.Err)
+			failed++
+		default:
+			fmt.Printf("  %-22s ok (%s)\n", result.Name, result.Duration.Round(time.Millisecond))
+		}
+	}
+
+	if failed != 0 {
+		fmt.Println(failed, "checks failed")
+		return 1
+	}
+
+	fmt.Println("All checks passed")
+	return 0
+}
+
+func printVersion(version common.VersionInfo) {
+	commit := version.Commit
+	if commit == "" {
+		commit = "unknown"
+	} else if version.Modified {
+		commit += " (modified)"
+	}
+
+	fmt.Println("  Version:", version.Version)
+	fmt.Println("  Commit: ", commit)
+	fmt.Println("  Go:     ", version.GoVersion)
+	fmt.Println("  Started:", version.StartTime.Format(time.RFC3339))
+	fmt.Println("  Uptime: ", time.Since(version.StartTime).Round(time.Second))
+}
+
+func printBackendStatus(status BackendStatus) {
+	fmt.Println("Started:", status.StartTime.Format(time.RFC3339))
+	fmt.Println("Uptime: ", status.Uptime.Round(time.Second))
+	fmt.Println("Reload: ", status.Reload)
+
+	fmt.Println("Servers:")
+	for _, server := range status.Servers {
+		state := "starting"
+		if server.Started {
+			state = "ok"
+		} else if server.Error != "" {
+			state = "failed: " + server.Error
+		}
+		fmt.Printf("  %-14s %s\n", server.Name, state)
+	}
+
+	fmt.Println("Memory:")
+	fmt.Printf("  Alloc:        %.1f MiB\n", float64(status.Memory.Alloc)/(1<<20))
+	fmt.Printf("  Sys:          %.1f MiB\n", float64(status.Memory.Sys)/(1<<20))
+	fmt.Printf("  Heap objects: %d\n", status.Memory.HeapObjects)
+	fmt.Printf("  GC cycles:    %d\n", status.Memory.NumGC)
+	fmt.Printf("  Goroutines:   %d\n", status.Memory.Goroutines)
+}
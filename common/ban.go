@@ -0,0 +1,140 @@
+package common
+
+import (
+	"strings"
+	"time"
+)
+
+// BanPresentation is what a banned player is shown
+type BanPresentation int
+
+const (
+	// Not banned
+	BanPresentationNone BanPresentation = iota
+	// Logs in as usual but is left out of matchmaking, and is never told about the ban
+	BanPresentationShadow
+	// Logs in, but can only join private rooms
+	BanPresentationRestricted
+	// Can't log in until the ban expires, shown the reason and the expiry date
+	BanPresentationSuspended
+	// Can't log in, shown the reason
+	BanPresentationPermanent
+)
+
+const (
+	// Longest ban reason sent to a client, longer reasons are cut with "..."
+	MaxBanReasonLength = 90
+	// Size of the ban reason in the Mario Kart Wii error message box
+	BanReasonColumns = 30
+	BanReasonLines   = 3
+)
+
+// BanInfo is an active ban matching a login
+type BanInfo struct {
+	TOS    bool
+	Shadow bool
+	Reason string
+	// Zero if the ban is permanent
+	Expires time.Time
+	// The device ID of the banned profile, shown to the player as support info
+	DeviceID uint32
+}
+
+// Presentation returns how the ban is shown to the player. A shadow ban is never shown, even if
+// it's also a TOS ban.
+func (b *BanInfo) Presentation() BanPresentation {
+	switch {
+	case b == nil:
+		return BanPresentationNone
+	case b.Shadow:
+		return BanPresentationShadow
+	case !b.TOS:
+		return BanPresentationRestricted
+	case b.Expires.IsZero():
+		return BanPresentationPermanent
+	default:
+		return BanPresentationSuspended
+	}
+}
+
+// FormatBanExpiry formats the end of a suspension for the client
+func FormatBanExpiry(expires time.Time) string {
+	return expires.UTC().Format("2006-01-02 15:04") + " UTC"
+}
+
+// CleanBanReason makes a ban reason safe to send to a client. The reason ends up in a GameSpy
+// message, a NAS response and a console message box, and printable ASCII is the only thing all of
+// them show: backslashes would break the GameSpy message, anything else outside printable ASCII is
+// replaced with '?' and whitespace is collapsed to single spaces.
+func CleanBanReason(reason string) string {
+	var builder strings.Builder
+	for _, field := range strings.Fields(reason) {
+		if builder.Len() != 0 {
+			builder.WriteByte(' ')
+		}
+
+		for _, r := range field {
+			switch {
+			case r == '\\':
+				builder.WriteByte('/')
+			case r < 0x20 || r > 0x7e:
+				builder.WriteByte('?')
+			default:
+				builder.WriteRune(r)
+			}
+		}
+	}
+
+	return truncateBanReason(builder.String(), MaxBanReasonLength)
+}
+
+// WrapBanReason wraps a cleaned ban reason at word boundaries to fit the columns, and cuts it to
+// the number of lines with "..."
+func WrapBanReason(reason string, columns int, lines int) string {
+	var wrapped []string
+	line := ""
+	for _, word := range strings.Fields(reason) {
+		// Split words that don't fit on a line of their own
+		for len(word) > columns {
+			if line != "" {
+				wrapped = append(wrapped, line)
+				line = ""
+			}
+			wrapped = append(wrapped, word[:columns])
+			word = word[columns:]
+		}
+
+		switch {
+		case word == "":
+		case line == "":
+			line = word
+		case len(line)+1+len(word) <= columns:
+			line += " " + word
+		default:
+			wrapped = append(wrapped, line)
+			line = word
+		}
+	}
+	if line != "" {
+		wrapped = append(wrapped, line)
+	}
+
+	if len(wrapped) > lines {
+		wrapped = wrapped[:lines]
+		last := wrapped[lines-1]
+		if len(last)+3 > columns {
+			last = strings.TrimRight(last[:columns-3], " ")
+		}
+		wrapped[lines-1] = last + "..."
+	}
+
+	return strings.Join(wrapped, "\n")
+}
+
+func truncateBanReason(reason string, length int) string {
+	if len(reason) <= length {
+		return reason
+	}
+
+	return strings.TrimRight(reason[:length-3], " ") + "..."
+}
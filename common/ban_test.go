@@ -0,0 +1,53 @@
+package common
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBanPresentation(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	for i, test := range []struct {
+		ban          *BanInfo
+		presentation BanPresentation
+	}{
+		{nil, BanPresentationNone},
+		{&BanInfo{}, BanPresentationRestricted},
+		{&BanInfo{TOS: true}, BanPresentationPermanent},
+		{&BanInfo{TOS: true, Expires: expires}, BanPresentationSuspended},
+		{&BanInfo{Shadow: true}, BanPresentationShadow},
+		{&BanInfo{TOS: true, Shadow: true}, BanPresentationShadow},
+	} {
+		if presentation := test.ban.Presentation(); presentation != test.presentation {
+			t.Errorf("%d: got presentation %d, expected %d", i, presentation, test.presentation)
+		}
+	}
+}
+
+func TestCleanBanReason(t *testing.T) {
+	if reason := CleanBanReason("  Cheating\\hacking\n\tin  ßpublic\x00 "); reason != "Cheating/hacking in ?public?" {
+		t.Errorf("unexpected reason %q", reason)
+	}
+
+	reason := CleanBanReason(strings.Repeat("a", MaxBanReasonLength+1))
+	if len(reason) != MaxBanReasonLength || !strings.HasSuffix(reason, "...") {
+		t.Errorf("long reason wasn't cut: %q", reason)
+	}
+}
+
+func TestWrapBanReason(t *testing.T) {
+	for i, test := range []struct {
+		reason  string
+		wrapped string
+	}{
+		{"", ""},
+		{"No cheats in public rooms", "No cheats\nin public\nrooms"},
+		{"abcdefghijklmnopqrstuvwxyz ab", "abcdefghij\nklmnopqrst\nuvwxyz ab"},
+		{"one two three four five six seven eight", "one two\nthree four\nfive si..."},
+	} {
+		if wrapped := WrapBanReason(test.reason, 10, 3); wrapped != test.wrapped {
+			t.Errorf("%d: got %q, expected %q", i, wrapped, test.wrapped)
+		}
+	}
+}
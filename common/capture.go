@@ -0,0 +1,303 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// A capture file starts with captureMagic, then the server name (one length byte) and the
+// connection index (8 bytes). Each record after is the time in Unix nanoseconds (8 bytes), the
+// direction (1 byte), the payload length (4 bytes) and the payload, all little endian.
+const captureMagic = "WWFCCAP1"
+
+const (
+	CaptureInbound  byte = 0
+	CaptureOutbound byte = 1
+)
+
+var (
+	ErrCaptureActive   = errors.New("the connection is already being captured")
+	ErrCaptureNotFound = errors.New("the connection isn't being captured")
+)
+
+type CaptureRecord struct {
+	Time      time.Time
+	Direction byte
+	Data      []byte
+}
+
+// CaptureInfo describes a capture that ended
+type CaptureInfo struct {
+	Path    string
+	Records int
+	Bytes   int64
+	Reason  string
+}
+
+type capture struct {
+	mutex   sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	timer   *time.Timer
+	maxSize int64
+	info    CaptureInfo
+	stopped bool
+}
+
+var (
+	// Number of captures and replays, the packet hooks return straight away while it's 0
+	captureHooks atomic.Int32
+
+	captures      = map[connectionKey]*capture{}
+	capturesMutex sync.Mutex
+
+	// Connections being replayed, whose packets are collected instead of sent to the frontend
+	replays = map[connectionKey]*[][]byte{}
+)
+
+// StartCapture records every packet to and from the connection into a file in dir, until
+// StopCapture is called, the connection closes, maxBytes are written or maxDuration passes
+func StartCapture(server string, index uint64, dir string, maxBytes int64, maxDuration time.Duration) (string, error) {
+	key := connectionKey{server, index}
+
+	capturesMutex.Lock()
+	defer capturesMutex.Unlock()
+
+	if captures[key] != nil {
+		return "", ErrCaptureActive
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%s-%d-%s.cap", server, index, time.Now().Format("20060102-150405")))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	c := &capture{file: file, writer: bufio.NewWriter(file), maxSize: maxBytes, info: CaptureInfo{Path: path}}
+	c.writer.WriteString(captureMagic)
+	c.writer.WriteByte(byte(len(server)))
+	c.writer.WriteString(server)
+	binary.Write(c.writer, binary.LittleEndian, index)
+
+	c.timer = time.AfterFunc(maxDuration, func() {
+		stopCapture(key, c, "time limit reached")
+	})
+	captures[key] = c
+	captureHooks.Add(1)
+
+	logging.Notice(logging.ConnectionModule(server, index, ""), "Capturing packets to", aurora.BrightCyan(path))
+	return path, nil
+}
+
+// StopCapture ends the connection's capture and returns what it recorded
+func StopCapture(server string, index uint64) (CaptureInfo, error) {
+	key := connectionKey{server, index}
+
+	capturesMutex.Lock()
+	c := captures[key]
+	capturesMutex.Unlock()
+
+	if c == nil {
+		return CaptureInfo{}, ErrCaptureNotFound
+	}
+
+	return stopCapture(key, c, "stopped"), nil
+}
+
+// StopCaptureOnClose ends the connection's capture if it has one, for a connection that closed
+func StopCaptureOnClose(server string, index uint64) {
+	if captureHooks.Load() == 0 {
+		return
+	}
+
+	StopCapture(server, index)
+}
+
+func stopCapture(key connectionKey, c *capture, reason string) CaptureInfo {
+	capturesMutex.Lock()
+	if captures[key] == c {
+		delete(captures, key)
+		captureHooks.Add(-1)
+	}
+	capturesMutex.Unlock()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.stopped {
+		return c.info
+	}
+
+	c.stopped = true
+	c.timer.Stop()
+	c.info.Reason = reason
+	c.writer.Flush()
+	c.file.Close()
+
+	logging.Notice(logging.ConnectionModule(key.server, key.index, ""), "Capture ended,", reason+":", aurora.Cyan(c.info.Records), "packets in", aurora.BrightCyan(c.info.Path))
+	return c.info
+}
+
+// CapturePacket is called with every packet to or from a connection. It does nothing unless a
+// capture or replay is running.
+func CapturePacket(server string, index uint64, direction byte, data []byte) {
+	if captureHooks.Load() == 0 {
+		return
+	}
+
+	key := connectionKey{server, index}
+
+	capturesMutex.Lock()
+	c := captures[key]
+	capturesMutex.Unlock()
+
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	if c.stopped {
+		c.mutex.Unlock()
+		return
+	}
+
+	var header [13]byte
+	binary.LittleEndian.PutUint64(header[0:], uint64(time.Now().UnixNano()))
+	header[8] = direction
+	binary.LittleEndian.PutUint32(header[9:], uint32(len(data)))
+	c.writer.Write(header[:])
+	c.writer.Write(data)
+
+	c.info.Records++
+	c.info.Bytes += int64(len(header) + len(data))
+	full := c.info.Bytes >= c.maxSize
+	c.mutex.Unlock()
+
+	if full {
+		stopCapture(key, c, "size limit reached")
+	}
+}
+
+// ReadCapture reads a capture file written by StartCapture
+func ReadCapture(r io.Reader) (server string, index uint64, records []CaptureRecord, err error) {
+	reader := bufio.NewReader(r)
+
+	header := make([]byte, len(captureMagic)+1)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return
+	}
+	if string(header[:len(captureMagic)]) != captureMagic {
+		err = errors.New("not a capture file")
+		return
+	}
+
+	name := make([]byte, header[len(captureMagic)])
+	if _, err = io.ReadFull(reader, name); err != nil {
+		return
+	}
+	server = string(name)
+
+	if err = binary.Read(reader, binary.LittleEndian, &index); err != nil {
+		return
+	}
+
+	for {
+		var recordHeader [13]byte
+		if _, err = io.ReadFull(reader, recordHeader[:]); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+
+		length := binary.LittleEndian.Uint32(recordHeader[9:])
+		if length > 1024*1024 {
+			err = errors.New("capture record too large")
+			return
+		}
+
+		record := CaptureRecord{
+			Time:      time.Unix(0, int64(binary.LittleEndian.Uint64(recordHeader[0:]))),
+			Direction: recordHeader[8],
+			Data:      make([]byte, length),
+		}
+		if _, err = io.ReadFull(reader, record.Data); err != nil {
+			return
+		}
+
+		records = append(records, record)
+	}
+}
+
+// BeginReplay makes SendPacket and CloseConnection for the connection collect its packets instead
+// of reaching the frontend. EndReplay returns the packets collected.
+func BeginReplay(server string, index uint64) {
+	capturesMutex.Lock()
+	defer capturesMutex.Unlock()
+
+	replays[connectionKey{server, index}] = &[][]byte{}
+	captureHooks.Add(1)
+}
+
+func EndReplay(server string, index uint64) [][]byte {
+	capturesMutex.Lock()
+	defer capturesMutex.Unlock()
+
+	key := connectionKey{server, index}
+	sent := replays[key]
+	if sent == nil {
+		return nil
+	}
+
+	delete(replays, key)
+	captureHooks.Add(-1)
+	return *sent
+}
+
+// IsReplaying checks if the connection is being replayed, servers skip their side effects for it
+// such as database writes and packets forwarded to other clients
+func IsReplaying(server string, index uint64) bool {
+	if captureHooks.Load() == 0 {
+		return false
+	}
+
+	capturesMutex.Lock()
+	defer capturesMutex.Unlock()
+
+	return replays[connectionKey{server, index}] != nil
+}
+
+// replayPacket collects a packet sent to a connection being replayed, returns false if it isn't one
+func replayPacket(server string, index uint64, data []byte) bool {
+	if captureHooks.Load() == 0 {
+		return false
+	}
+
+	capturesMutex.Lock()
+	defer capturesMutex.Unlock()
+
+	sent := replays[connectionKey{server, index}]
+	if sent == nil {
+		return false
+	}
+
+	if data != nil {
+		*sent = append(*sent, append([]byte(nil), data...))
+	}
+	return true
+}
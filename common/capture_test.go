@@ -0,0 +1,109 @@
+package common
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCapture(t *testing.T) {
+	dir := t.TempDir()
+
+	path, err := StartCapture("gpcm", 5, dir, 1024, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := StartCapture("gpcm", 5, dir, 1024, time.Minute); err != ErrCaptureActive {
+		t.Errorf("second capture returned %v, expected ErrCaptureActive", err)
+	}
+
+	CapturePacket("gpcm", 5, CaptureInbound, []byte("login"))
+	CapturePacket("gpcm", 6, CaptureInbound, []byte("other connection"))
+	CapturePacket("gpcm", 5, CaptureOutbound, []byte("lc"))
+
+	info, err := StopCapture("gpcm", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Path != path || info.Records != 2 {
+		t.Errorf("capture info is %+v", info)
+	}
+
+	if _, err := StopCapture("gpcm", 5); err != ErrCaptureNotFound {
+		t.Errorf("stopping twice returned %v, expected ErrCaptureNotFound", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	server, index, records, err := ReadCapture(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server != "gpcm" || index != 5 || len(records) != 2 {
+		t.Fatalf("read %s %d with %d records", server, index, len(records))
+	}
+	if records[0].Direction != CaptureInbound || !bytes.Equal(records[0].Data, []byte("login")) {
+		t.Errorf("first record is %+v", records[0])
+	}
+	if records[1].Direction != CaptureOutbound || !bytes.Equal(records[1].Data, []byte("lc")) {
+		t.Errorf("second record is %+v", records[1])
+	}
+
+	if captureHooks.Load() != 0 {
+		t.Errorf("%d capture hooks left active", captureHooks.Load())
+	}
+}
+
+func TestCaptureLimits(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := StartCapture("gpsp", 1, dir, 32, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	CapturePacket("gpsp", 1, CaptureInbound, make([]byte, 32))
+	if _, err := StopCapture("gpsp", 1); err != ErrCaptureNotFound {
+		t.Errorf("capture over the size limit is still running")
+	}
+
+	if _, err := StartCapture("gpsp", 2, dir, 1024, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for captureHooks.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := StopCapture("gpsp", 2); err != ErrCaptureNotFound {
+		t.Errorf("capture over the time limit is still running")
+	}
+}
+
+func TestReplayCollectsPackets(t *testing.T) {
+	BeginReplay("gamestats", 7)
+	if !IsReplaying("gamestats", 7) || IsReplaying("gamestats", 8) {
+		t.Error("wrong connection reported as replaying")
+	}
+
+	if err := SendPacket("gamestats", 7, []byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	if err := CloseConnection("gamestats", 7); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := EndReplay("gamestats", 7)
+	if len(sent) != 1 || !bytes.Equal(sent[0], []byte("reply")) {
+		t.Errorf("replay collected %q", sent)
+	}
+
+	if replayPacket("gamestats", 7, []byte("after")) || IsReplaying("gamestats", 7) {
+		t.Error("packet collected after the replay ended")
+	}
+}
@@ -0,0 +1,94 @@
+package common
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// Largest payload accepted when decompressing, well above anything a GameSpy server sends
+	maxDecompressedSize = 16 * 1024 * 1024
+)
+
+var (
+	ErrDecompressedTooLarge = errors.New("decompressed RPC payload is too large")
+
+	// Negotiated during the RPC handshake, 0 disables compression
+	rpcCompressionThreshold atomic.Int64
+
+	flateWriters = sync.Pool{
+		New: func() any {
+			w, _ := flate.NewWriter(nil, flate.BestSpeed)
+			return w
+		},
+	}
+)
+
+// NegotiateCompression returns the threshold both sides of the RPC connection agree on.
+// Compression is only used if both sides enable it, and then only above the larger threshold.
+func NegotiateCompression(local, remote int) int {
+	if local <= 0 || remote <= 0 {
+		return 0
+	}
+
+	return max(local, remote)
+}
+
+// SetRPCCompressionThreshold sets the threshold used by SendPacket, 0 disables compression
+func SetRPCCompressionThreshold(threshold int) {
+	rpcCompressionThreshold.Store(int64(threshold))
+}
+
+// CompressData compresses the data if it is longer than the threshold. The data is returned
+// unchanged along with false if it is too short, the threshold is 0, or compressing it
+// didn't make it any smaller.
+func CompressData(data []byte, threshold int) ([]byte, bool) {
+	if threshold <= 0 || len(data) <= threshold {
+		return data, false
+	}
+
+	var buffer bytes.Buffer
+	buffer.Grow(len(data) / 2)
+
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buffer)
+
+	if _, err := w.Write(data); err != nil {
+		return data, false
+	}
+	if err := w.Close(); err != nil {
+		return data, false
+	}
+
+	if buffer.Len() >= len(data) {
+		return data, false
+	}
+
+	return buffer.Bytes(), true
+}
+
+// DecompressData reverses CompressData. Uncompressed data is returned as is.
+func DecompressData(data []byte, compressed bool) ([]byte, error) {
+	if !compressed {
+		return data, nil
+	}
+
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	result, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result) > maxDecompressedSize {
+		return nil, ErrDecompressedTooLarge
+	}
+
+	return result, nil
+}
@@ -0,0 +1,111 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// serverListPayload builds something resembling a server browser response, the largest
+// packets the backend sends
+func serverListPayload(servers int) []byte {
+	rng := rand.New(rand.NewSource(1))
+
+	var buffer bytes.Buffer
+	for i := 0; i < servers; i++ {
+		fmt.Fprintf(&buffer, "\\hostname\\%d\\gamename\\mariokartwii\\numplayers\\%d\\maxplayers\\12\\rk\\vs_%d\\ev\\%d\\localip0\\192.168.%d.%d\\",
+			rng.Intn(1<<30), rng.Intn(12), rng.Intn(3), rng.Intn(1000), rng.Intn(256), rng.Intn(256))
+	}
+	return buffer.Bytes()
+}
+
+func TestCompressDataRoundTrip(t *testing.T) {
+	payload := serverListPayload(100)
+
+	compressed, ok := CompressData(payload, 256)
+	if !ok {
+		t.Fatal("expected payload to be compressed")
+	}
+	if len(compressed) >= len(payload) {
+		t.Errorf("compressed size %d is not smaller than %d", len(compressed), len(payload))
+	}
+
+	decompressed, err := DecompressData(compressed, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, payload) {
+		t.Error("decompressed data does not match")
+	}
+}
+
+func TestCompressDataThreshold(t *testing.T) {
+	payload := serverListPayload(2)
+
+	if _, ok := CompressData(payload, len(payload)); ok {
+		t.Error("payload at the threshold was compressed")
+	}
+	if _, ok := CompressData(payload, 0); ok {
+		t.Error("payload was compressed with compression disabled")
+	}
+
+	// Random data doesn't shrink, so it should be sent as is
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(2)).Read(random)
+	if data, ok := CompressData(random, 256); ok || !bytes.Equal(data, random) {
+		t.Error("incompressible payload was compressed")
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	tests := []struct {
+		local, remote, expected int
+	}{
+		{0, 0, 0},
+		{512, 0, 0},
+		{0, 512, 0},
+		{512, 1024, 1024},
+		{2048, 1024, 2048},
+	}
+
+	for _, test := range tests {
+		if result := NegotiateCompression(test.local, test.remote); result != test.expected {
+			t.Errorf("NegotiateCompression(%d, %d) = %d, expected %d", test.local, test.remote, result, test.expected)
+		}
+	}
+}
+
+// Compares the CPU time spent per packet against the bytes saved at a few thresholds,
+// for a mix of small (matchmaking) and large (server list) packets
+func BenchmarkCompressData(b *testing.B) {
+	packets := [][]byte{
+		serverListPayload(1),
+		serverListPayload(4),
+		serverListPayload(20),
+		serverListPayload(100),
+	}
+
+	totalSize := 0
+	for _, packet := range packets {
+		totalSize += len(packet)
+	}
+
+	for _, threshold := range []int{0, 256, 1024, 4096} {
+		b.Run(fmt.Sprintf("threshold=%d", threshold), func(b *testing.B) {
+			sent := 0
+			for i := 0; i < b.N; i++ {
+				for _, packet := range packets {
+					data, compressed := CompressData(packet, threshold)
+					if _, err := DecompressData(data, compressed); err != nil {
+						b.Fatal(err)
+					}
+					sent += len(data)
+				}
+			}
+
+			b.SetBytes(int64(totalSize))
+			b.ReportMetric(float64(sent)/float64(b.N*totalSize), "sent/orig")
+		})
+	}
+}
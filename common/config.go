@@ -2,14 +2,148 @@ package common
 
 import (
 	"encoding/xml"
+	"fmt"
+	"net"
 	"os"
+	"strings"
+	"wwfc/logging"
+	"wwfc/profanity"
 )
 
+// ServerConfig overrides settings for a single GameSpy server
+type ServerConfig struct {
+	Name    string `xml:"name,attr"`
+	Address string `xml:"address,attr,omitempty"`
+	Port    int    `xml:"port,attr,omitempty"`
+
+	// Disabled servers don't listen and the backend drops packets for them, defaults to true
+	Enabled *bool `xml:"enabled,attr,omitempty"`
+
+	// Comma separated ISO country codes, only one of the two may be set
+	AllowCountries string `xml:"allowCountries,attr,omitempty"`
+	BlockCountries string `xml:"blockCountries,attr,omitempty"`
+
+	// Comma separated IPs and CIDR ranges, replaces the global allow list for this server
+	AllowList string `xml:"allowList,attr,omitempty"`
+
+	// Disables Nagle's algorithm on client connections, defaults to true
+	NoDelay *bool `xml:"noDelay,attr,omitempty"`
+
+	// Most bytes the frontend reads from a client connection at once, defaults to DefaultReadBufferSize
+	ReadBufferSize int `xml:"readBufferSize,attr,omitempty"`
+}
+
+const (
+	DefaultReadBufferSize = 1024
+	MaxReadBufferSize     = 1024 * 1024
+)
+
+// Values of duplicateLoginPolicy
+const (
+	DuplicateLoginKickOld   = "kickOld"
+	DuplicateLoginRejectNew = "rejectNew"
+)
+
+// Values of nasAuthWebhookFailure
+const (
+	AuthWebhookFailOpen   = "allow"
+	AuthWebhookFailClosed = "deny"
+)
+
+// Values of databaseDriver
+const (
+	DatabaseDriverPostgres = "postgres"
+	DatabaseDriverFile     = "file"
+)
+
+// Values of the leaderboardOrder game attribute
+const (
+	LeaderboardDescending = "descending"
+	LeaderboardAscending  = "ascending"
+)
+
+// Values of backpressureMode
+const (
+	BackpressurePause  = "pause"
+	BackpressureReject = "reject"
+)
+
+// Values of the services attribute of games>game
+const (
+	GameServiceGPCM          = "gpcm"
+	GameServiceQR2           = "qr2"
+	GameServiceServerBrowser = "serverbrowser"
+	GameServiceGameStats     = "gamestats"
+	GameServiceSake          = "sake"
+	GameServiceDownload      = "download"
+)
+
+var GameServices = []string{GameServiceGPCM, GameServiceQR2, GameServiceServerBrowser, GameServiceGameStats, GameServiceSake, GameServiceDownload}
+
+// GameConfig adds a game to the game list, or overrides its entry in game_list.tsv. Attributes
+// that aren't set keep the value from game_list.tsv.
+type GameConfig struct {
+	Name             string `xml:"name,attr"`
+	GameID           *int   `xml:"gameId,attr,omitempty"`
+	SecretKey        string `xml:"secretKey,attr,omitempty"`
+	GameStatsVersion *int   `xml:"gameStatsVersion,attr,omitempty"`
+	GameStatsKey     string `xml:"gameStatsKey,attr,omitempty"`
+	Description      string `xml:"description,attr,omitempty"`
+
+	// Comma separated lists
+	QR2Keys       string `xml:"qr2Keys,attr,omitempty"`
+	MatchVersions string `xml:"matchVersions,attr,omitempty"` // dwc_mver values
+	GameCodes     string `xml:"gameCodes,attr,omitempty"`     // NAS game codes, e.g. RMCE or RMC for every region
+	Services      string `xml:"services,attr,omitempty"`      // Empty for every service
+
+	// Defaults to true, a disabled game is rejected by every service
+	Enabled *bool `xml:"enabled,attr,omitempty"`
+
+	// Overrides for the global settings of the same name
+	SakeMaxFileSize         int  `xml:"sakeMaxFileSize,attr,omitempty"`
+	FriendRequestsPerMinute *int `xml:"friendRequestsPerMinute,attr,omitempty"`
+	// Defaults to true, false lets profane names through for the game
+	ProfanityFilter *bool `xml:"profanityFilter,attr,omitempty"`
+
+	// Comma separated keys of the game's key/value player data that are leaderboard scores, and
+	// whether the highest (the default) or lowest score ranks first
+	Leaderboards     string `xml:"leaderboards,attr,omitempty"`
+	LeaderboardOrder string `xml:"leaderboardOrder,attr,omitempty"`
+}
+
+// SakeFileLimit overrides the maximum SAKE file size for a single game
+type SakeFileLimit struct {
+	Name        string `xml:"name,attr"`
+	MaxFileSize int    `xml:"maxFileSize,attr"`
+}
+
+// LogLevelOverride sets the log level for one module, e.g. "NATNEG"
+type LogLevelOverride struct {
+	Module string `xml:"module,attr"`
+	Level  string `xml:"level,attr"`
+}
+
+// ProfanityList is a word list used for one language in addition to profanityFile
+type ProfanityList struct {
+	// The lang value sent to NAS, e.g. 1 for English
+	Language int    `xml:"lang,attr"`
+	Path     string `xml:",chardata"`
+}
+
 type Config struct {
 	Username        string `xml:"username"`
 	Password        string `xml:"password"`
 	DatabaseAddress string `xml:"databaseAddress"`
 	DatabaseName    string `xml:"databaseName"`
+	// Where the data is kept, and the path of the file for the file driver
+	DatabaseDriver string `xml:"databaseDriver,omitempty"`
+	DatabaseFile   string `xml:"databaseFile,omitempty"`
+
+	// Connection pool settings for each server, 0 keeps the driver's default
+	DatabaseMaxConns        int `xml:"databaseMaxConns,omitempty"`
+	DatabaseMinConns        int `xml:"databaseMinConns,omitempty"`
+	DatabaseMaxConnLifetime int `xml:"databaseMaxConnLifetime,omitempty"` // Seconds
+	DatabaseMaxConnIdleTime int `xml:"databaseMaxConnIdleTime,omitempty"` // Seconds
 
 	DefaultAddress  string  `xml:"address"`
 	GameSpyAddress  *string `xml:"gsAddress,omitempty"`
@@ -18,17 +152,73 @@ type Config struct {
 	NASAddressHTTPS *string `xml:"nasAddressHttps,omitempty"`
 	NASPortHTTPS    string  `xml:"nasPortHttps"`
 
+	Servers []ServerConfig `xml:"servers>server"`
+
+	GeoIPDatabase     string `xml:"geoIPDatabase,omitempty"`
+	GeoIPAllowUnknown *bool  `xml:"geoIPAllowUnknown,omitempty"`
+
+	// Comma separated IPs and CIDR ranges, when set only they can connect to the GameSpy servers
+	AllowList string `xml:"allowList,omitempty"`
+
+	IPBanFile string `xml:"ipBanFile,omitempty"`
+	// Games enabled or disabled with "cmd b game", read by the backend on start
+	GameOverrideFile string `xml:"gameOverrideFile,omitempty"`
+	// Directory "cmd b capture" writes to, and the bytes and seconds after which a capture stops
+	CaptureDir         string `xml:"captureDir,omitempty"`
+	CaptureMaxBytes    *int   `xml:"captureMaxBytes,omitempty"`
+	CaptureMaxDuration *int   `xml:"captureMaxDuration,omitempty"`
+
+	TCPKeepAlive       *bool `xml:"tcpKeepAlive,omitempty"`
+	TCPKeepAlivePeriod *int  `xml:"tcpKeepAlivePeriod,omitempty"`
+	ListenBacklog      int   `xml:"listenBacklog,omitempty"`
+
+	WebSocketPort   string `xml:"webSocketPort,omitempty"`
+	WebSocketServer string `xml:"webSocketServer,omitempty"`
+
 	FrontendAddress        string `xml:"frontendAddress"`
 	FrontendBackendAddress string `xml:"frontendBackendAddress"`
 	BackendAddress         string `xml:"backendAddress"`
 	BackendFrontendAddress string `xml:"backendFrontendAddress"`
+	FrontendHealthAddress  string `xml:"frontendHealthAddress,omitempty"`
+	FrontendPprofAddress   string `xml:"frontendPprofAddress,omitempty"`
+	BackendPprofAddress    string `xml:"backendPprofAddress,omitempty"`
+
+	RPCCompressionThreshold int `xml:"rpcCompressionThreshold,omitempty"`
+	// Largest packet in bytes the backend accepts from the frontend
+	RPCMaxPacketSize *int `xml:"rpcMaxPacketSize,omitempty"`
+
+	// Seconds the frontend waits for the backend to start, and how many times it starts it before giving up
+	BackendStartTimeout  *int `xml:"backendStartTimeout,omitempty"`
+	BackendStartAttempts *int `xml:"backendStartAttempts,omitempty"`
+	// Exit the backend if one of its servers fails to start, instead of running without it
+	ExitOnServerStartFailure *bool `xml:"exitOnServerStartFailure,omitempty"`
+
+	// Seconds the frontend waits for a packet to be written to a client, 0 to wait forever
+	SendTimeout *int `xml:"sendTimeout,omitempty"`
+	// Bytes that can wait to be written to one client before it's closed, 0 for no limit
+	SendQueueLimit *int `xml:"sendQueueLimit,omitempty"`
+
+	// Backend calls in flight above which the frontend stops taking new connections, 0 to disable
+	BackpressureThreshold int    `xml:"backpressureThreshold,omitempty"`
+	BackpressureMode      string `xml:"backpressureMode,omitempty"`
+
+	// Seconds a closed connection can stay in the frontend's map before it's reported, 0 to disable
+	StaleConnectionTimeout *int `xml:"staleConnectionTimeout,omitempty"`
+	CloseStaleConnections  bool `xml:"closeStaleConnections,omitempty"`
 
 	EnableHTTPS           bool  `xml:"enableHttps"`
 	EnableHTTPSExploitWii *bool `xml:"enableHttpsExploitWii,omitempty"`
 	EnableHTTPSExploitDS  *bool `xml:"enableHttpsExploitDS,omitempty"`
+	// Terminate TLS for the NAS HTTPS port in the frontend and forward the requests over RPC,
+	// instead of running the HTTPS proxy in the backend
+	FrontendHTTPS bool `xml:"frontendHttps,omitempty"`
 
 	LogLevel  *int   `xml:"logLevel"`
 	LogOutput string `xml:"logOutput"`
+	// Overrides logLevel for specific modules
+	LogLevels []LogLevelOverride `xml:"logLevels>override"`
+	// File logins, bans, kicks and hosted rooms are recorded to regardless of the log level
+	AuditLog string `xml:"auditLog,omitempty"`
 
 	CertPath      string `xml:"certPath"`
 	KeyPath       string `xml:"keyPath"`
@@ -40,12 +230,229 @@ type Config struct {
 
 	APISecret string `xml:"apiSecret"`
 
+	// Seconds leaderboard API responses are cached for, 0 to disable
+	LeaderboardCacheTTL *int `xml:"leaderboardCacheTTL,omitempty"`
+
+	// Days the daily traffic totals of each profile are kept, 0 to keep them forever
+	TrafficRetention *int `xml:"trafficRetention,omitempty"`
+
 	AllowDefaultDolphinKeys bool `xml:"allowDefaultDolphinKeys"`
 
+	AllowlistMode bool `xml:"allowlistMode"`
+
+	// Word lists for names and profanity check requests
+	ProfanityFile  string          `xml:"profanityFile,omitempty"`
+	ProfanityLists []ProfanityList `xml:"profanityLists>list"`
+
+	// Signatures of exploit payloads that hosts must not forward to other clients, empty to disable
+	PayloadSignatureFile string `xml:"payloadSignatureFile,omitempty"`
+
+	// Ranges and required keys of the key/value data games store through gamestats, empty to disable
+	GameStatsRuleFile string `xml:"gameStatsRuleFile,omitempty"`
+
+	NASAuthAttemptsPerMinute *int `xml:"nasAuthAttemptsPerMinute,omitempty"`
+
+	// External endpoint asked to accept or reject each NAS login, empty to disable. How many
+	// milliseconds to wait for it, and whether a login goes through when it can't be reached.
+	NASAuthWebhook        string `xml:"nasAuthWebhook,omitempty"`
+	NASAuthWebhookTimeout *int   `xml:"nasAuthWebhookTimeout,omitempty"`
+	NASAuthWebhookFailure string `xml:"nasAuthWebhookFailure,omitempty"`
+
+	// Content served by the NAS download server, and how many files can be downloaded at once
+	DLCDirectory    string `xml:"dlcDirectory,omitempty"`
+	DLCMaxDownloads *int   `xml:"dlcMaxDownloads,omitempty"`
+
+	QR2SessionTimeout *int `xml:"qr2SessionTimeout,omitempty"`
+	// Minimum milliseconds between two heartbeats processed for one host, 0 to disable
+	QR2HeartbeatInterval *int `xml:"qr2HeartbeatInterval,omitempty"`
+
+	// Milliseconds identical server browser list queries are answered from the cache, 0 to disable
+	ServerBrowserCacheTTL *int `xml:"serverBrowserCacheTTL,omitempty"`
+
+	// UDP ports the backend binds sockets to on demand, e.g. for the NATNEG relay
+	UDPPortStart int `xml:"udpPortStart,omitempty"`
+	UDPPortEnd   int `xml:"udpPortEnd,omitempty"`
+
+	NATNEGSecondaryAddress   string `xml:"natnegSecondaryAddress,omitempty"`
+	NATNEGRelayAddress       string `xml:"natnegRelayAddress,omitempty"`
+	NATNEGRelayPortStart     int    `xml:"natnegRelayPortStart,omitempty"` // Deprecated, fallback for udpPortStart
+	NATNEGRelayPortEnd       int    `xml:"natnegRelayPortEnd,omitempty"`   // Deprecated, fallback for udpPortEnd
+	NATNEGRelayAfterFailures *int   `xml:"natnegRelayAfterFailures,omitempty"`
+	NATNEGRelayRate          *int   `xml:"natnegRelayRate,omitempty"`
+	NATNEGRelayMaxBytes      *int   `xml:"natnegRelayMaxBytes,omitempty"`
+	NATNEGRelayBandwidth     int    `xml:"natnegRelayBandwidth,omitempty"`
+	NATNEGRelayTimeout       *int   `xml:"natnegRelayTimeout,omitempty"`
+	// Seconds a NATNEG pairing may take before the clients still waiting are told it failed
+	NATNEGPairingTimeout *int `xml:"natnegPairingTimeout,omitempty"`
+
+	// What GPCM does when a profile logs in while it already has a session
+	DuplicateLoginPolicy string `xml:"duplicateLoginPolicy,omitempty"`
+
+	MaxFriends              *int `xml:"maxFriends,omitempty"`
+	FriendRequestsPerMinute *int `xml:"friendRequestsPerMinute,omitempty"`
+
+	SakeFileDirectory   string          `xml:"sakeFileDirectory,omitempty"`
+	SakeMaxFileSize     *int            `xml:"sakeMaxFileSize,omitempty"`
+	SakeMaxProfileFiles *int            `xml:"sakeMaxProfileFiles,omitempty"`
+	SakeMaxProfileBytes *int            `xml:"sakeMaxProfileBytes,omitempty"`
+	SakeFileLimits      []SakeFileLimit `xml:"sakeFileLimits>game"`
+
+	Games         []GameConfig `xml:"games>game"`
+	RestrictGames bool         `xml:"restrictGames,omitempty"`
+
 	ServerName string `xml:"serverName,omitempty"`
 	TrustedKey string `xml:"TrustedKey,omitempty"`
 }
 
+// DefaultServerPorts are the ports the GameSpy servers listen on unless overridden in <servers>
+var DefaultServerPorts = map[string]int{
+	"serverbrowser": 28910,
+	"gpcm":          29900,
+	"gpsp":          29901,
+	"gamestats":     29920,
+	"qr2":           27900,
+	"natneg":        27901,
+}
+
+// IsKnownServer checks if the name can be used in <servers>. NAS can only be disabled there, it
+// listens on <nasAddress> and <nasPort>.
+func IsKnownServer(name string) bool {
+	_, ok := DefaultServerPorts[name]
+	return ok || name == "nas"
+}
+
+// GetServerConfig returns the overrides for the named server, if any
+func (config Config) GetServerConfig(name string) (ServerConfig, bool) {
+	for _, server := range config.Servers {
+		if server.Name == name {
+			return server, true
+		}
+	}
+
+	return ServerConfig{Name: name}, false
+}
+
+// GetServerAddress returns the address the named server should bind to,
+// falling back to the GameSpy address
+func (config Config) GetServerAddress(name string) string {
+	if server, ok := config.GetServerConfig(name); ok && server.Address != "" {
+		return server.Address
+	}
+
+	return *config.GameSpyAddress
+}
+
+// GetServerPort returns the port the named server should bind to
+func (config Config) GetServerPort(name string) int {
+	if server, ok := config.GetServerConfig(name); ok && server.Port != 0 {
+		return server.Port
+	}
+
+	return DefaultServerPorts[name]
+}
+
+// IsServerEnabled checks if the named server should run, servers are enabled unless set otherwise
+func (config Config) IsServerEnabled(name string) bool {
+	server, _ := config.GetServerConfig(name)
+	return server.Enabled == nil || *server.Enabled
+}
+
+// GetReadBufferSize returns the size of the buffer the frontend reads the named server's
+// connections into
+func (config Config) GetReadBufferSize(name string) int {
+	if server, ok := config.GetServerConfig(name); ok && server.ReadBufferSize != 0 {
+		return server.ReadBufferSize
+	}
+
+	return DefaultReadBufferSize
+}
+
+// GetAllowList returns the IPs and CIDR ranges allowed to connect to the named server, empty if
+// anyone can connect
+func (config Config) GetAllowList(name string) string {
+	if server, ok := config.GetServerConfig(name); ok && server.AllowList != "" {
+		return server.AllowList
+	}
+
+	return config.AllowList
+}
+
+// ParseAllowList parses a comma separated list of IPs and CIDR ranges, an IP on its own only
+// matches itself
+func ParseAllowList(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", entry)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// ModuleLogLevels parses the per-module log level overrides
+func (config Config) ModuleLogLevels() (map[string]int, error) {
+	levels := map[string]int{}
+	for _, override := range config.LogLevels {
+		if override.Module == "" {
+			return nil, fmt.Errorf("log level override is missing the module attribute")
+		}
+
+		level, err := logging.ParseLevel(override.Level)
+		if err != nil {
+			return nil, fmt.Errorf("module %s: %w", override.Module, err)
+		}
+
+		levels[override.Module] = level
+	}
+
+	return levels, nil
+}
+
+// ApplyLogLevels sets the global and per-module log levels from the config. Invalid overrides are
+// rejected by ValidateConfig at startup, on reload they are logged and the old overrides kept.
+func ApplyLogLevels(config Config) {
+	logging.SetLevel(*config.LogLevel)
+
+	levels, err := config.ModuleLogLevels()
+	if err != nil {
+		logging.Error("CONFIG", "Invalid <logLevels>:", err)
+		return
+	}
+
+	logging.SetModuleLevels(levels)
+}
+
+// ApplyProfanityLists loads the word lists from the config, replacing the ones in use
+func ApplyProfanityLists(config Config) {
+	languageFiles := map[int]string{}
+	for _, list := range config.ProfanityLists {
+		languageFiles[list.Language] = strings.TrimSpace(list.Path)
+	}
+
+	profanity.SetLists(config.ProfanityFile, languageFiles)
+}
+
 func GetConfig() Config {
 	data, err := os.ReadFile("config.xml")
 	if err != nil {
@@ -66,6 +473,211 @@ func GetConfig() Config {
 		config.GameSpyAddress = &config.DefaultAddress
 	}
 
+	if config.GeoIPAllowUnknown == nil {
+		allow := true
+		config.GeoIPAllowUnknown = &allow
+	}
+
+	if config.TCPKeepAlive == nil {
+		enable := true
+		config.TCPKeepAlive = &enable
+	}
+
+	if config.TCPKeepAlivePeriod == nil {
+		period := 60
+		config.TCPKeepAlivePeriod = &period
+	}
+
+	if config.IPBanFile == "" {
+		config.IPBanFile = "state/ip_bans.json"
+	}
+
+	if config.GameOverrideFile == "" {
+		config.GameOverrideFile = "state/game_overrides.json"
+	}
+
+	if config.CaptureDir == "" {
+		config.CaptureDir = "captures"
+	}
+
+	if config.CaptureMaxBytes == nil {
+		maxBytes := 16 * 1024 * 1024
+		config.CaptureMaxBytes = &maxBytes
+	}
+
+	if config.CaptureMaxDuration == nil {
+		duration := 600
+		config.CaptureMaxDuration = &duration
+	}
+
+	if config.WebSocketServer == "" {
+		config.WebSocketServer = "serverbrowser"
+	}
+
+	if config.NASAuthAttemptsPerMinute == nil {
+		attempts := 20
+		config.NASAuthAttemptsPerMinute = &attempts
+	}
+
+	if config.ProfanityFile == "" {
+		config.ProfanityFile = "profanity.txt"
+	}
+
+	if config.DLCDirectory == "" {
+		config.DLCDirectory = "dlc"
+	}
+
+	if config.DLCMaxDownloads == nil {
+		maxDownloads := 32
+		config.DLCMaxDownloads = &maxDownloads
+	}
+
+	if config.QR2SessionTimeout == nil {
+		// Three times the client's heartbeat interval
+		timeout := 180
+		config.QR2SessionTimeout = &timeout
+	}
+
+	if config.QR2HeartbeatInterval == nil {
+		interval := 500
+		config.QR2HeartbeatInterval = &interval
+	}
+
+	if config.ServerBrowserCacheTTL == nil {
+		ttl := 1000
+		config.ServerBrowserCacheTTL = &ttl
+	}
+
+	if config.RPCMaxPacketSize == nil {
+		size := 0x10000
+		config.RPCMaxPacketSize = &size
+	}
+
+	if config.StaleConnectionTimeout == nil {
+		timeout := 60
+		config.StaleConnectionTimeout = &timeout
+	}
+
+	if config.TrafficRetention == nil {
+		days := 90
+		config.TrafficRetention = &days
+	}
+
+	if config.LeaderboardCacheTTL == nil {
+		ttl := 60
+		config.LeaderboardCacheTTL = &ttl
+	}
+
+	if config.UDPPortStart == 0 && config.UDPPortEnd == 0 {
+		// Older configs only set a range for the relay
+		config.UDPPortStart = config.NATNEGRelayPortStart
+		config.UDPPortEnd = config.NATNEGRelayPortEnd
+	}
+
+	if config.NATNEGRelayAfterFailures == nil {
+		failures := 1
+		config.NATNEGRelayAfterFailures = &failures
+	}
+
+	if config.NATNEGRelayRate == nil {
+		rate := 64 * 1024
+		config.NATNEGRelayRate = &rate
+	}
+
+	if config.NATNEGRelayMaxBytes == nil {
+		maxBytes := 64 * 1024 * 1024
+		config.NATNEGRelayMaxBytes = &maxBytes
+	}
+
+	if config.NATNEGRelayTimeout == nil {
+		timeout := 30
+		config.NATNEGRelayTimeout = &timeout
+	}
+
+	if config.NATNEGPairingTimeout == nil {
+		timeout := 30
+		config.NATNEGPairingTimeout = &timeout
+	}
+
+	if config.DatabaseDriver == "" {
+		config.DatabaseDriver = DatabaseDriverPostgres
+	}
+
+	if config.DatabaseFile == "" {
+		config.DatabaseFile = "database.gob"
+	}
+
+	if config.BackpressureMode == "" {
+		config.BackpressureMode = BackpressurePause
+	}
+
+	if config.NASAuthWebhookTimeout == nil {
+		timeout := 2000
+		config.NASAuthWebhookTimeout = &timeout
+	}
+
+	if config.NASAuthWebhookFailure == "" {
+		config.NASAuthWebhookFailure = AuthWebhookFailClosed
+	}
+
+	if config.DuplicateLoginPolicy == "" {
+		config.DuplicateLoginPolicy = DuplicateLoginKickOld
+	}
+
+	if config.SakeFileDirectory == "" {
+		config.SakeFileDirectory = "sake_files"
+	}
+
+	if config.SakeMaxFileSize == nil {
+		maxFileSize := 1024 * 1024
+		config.SakeMaxFileSize = &maxFileSize
+	}
+
+	if config.SakeMaxProfileFiles == nil {
+		maxFiles := 100
+		config.SakeMaxProfileFiles = &maxFiles
+	}
+
+	if config.SakeMaxProfileBytes == nil {
+		maxBytes := 8 * 1024 * 1024
+		config.SakeMaxProfileBytes = &maxBytes
+	}
+
+	if config.MaxFriends == nil {
+		maxFriends := 64
+		config.MaxFriends = &maxFriends
+	}
+
+	if config.FriendRequestsPerMinute == nil {
+		requests := 20
+		config.FriendRequestsPerMinute = &requests
+	}
+
+	if config.SendTimeout == nil {
+		timeout := 10
+		config.SendTimeout = &timeout
+	}
+
+	if config.SendQueueLimit == nil {
+		limit := 65536
+		config.SendQueueLimit = &limit
+	}
+
+	if config.BackendStartTimeout == nil {
+		timeout := 60
+		config.BackendStartTimeout = &timeout
+	}
+
+	if config.BackendStartAttempts == nil {
+		attempts := 3
+		config.BackendStartAttempts = &attempts
+	}
+
+	if config.ExitOnServerStartFailure == nil {
+		exit := true
+		config.ExitOnServerStartFailure = &exit
+	}
+
 	if config.NASAddress == nil {
 		config.NASAddress = &config.DefaultAddress
 	}
@@ -97,6 +709,10 @@ func GetConfig() Config {
 		config.LogOutput = "StdOutAndFile"
 	}
 
+	if config.AuditLog == "" {
+		config.AuditLog = "logs/audit.log"
+	}
+
 	if config.FrontendAddress == "" {
 		config.FrontendAddress = "127.0.0.1:29998"
 	}
@@ -0,0 +1,416 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"wwfc/logging"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// ValidateConfig checks the config for mistakes that would otherwise fail deep inside one of
+// the servers, and returns one error per problem. The database connection and the word lists
+// are only checked for the backend, the frontend uses neither. A missing word list is logged as
+// a warning since the backend runs without it.
+func ValidateConfig(config Config, backend bool) []error {
+	var errs []error
+	addError := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if *config.GameSpyAddress == "" {
+		addError("<address> (or <gsAddress>) is required, use 0.0.0.0 to listen on all interfaces")
+	}
+
+	if err := validatePort(config.NASPort); err != nil {
+		addError("<nasPort>: %v", err)
+	}
+
+	if config.EnableHTTPS {
+		if err := validatePort(config.NASPortHTTPS); err != nil {
+			addError("<nasPortHttps>: %v", err)
+		}
+
+		paths := []struct {
+			name, value string
+			required    bool
+		}{
+			{"certPath", config.CertPath, true},
+			{"keyPath", config.KeyPath, true},
+			{"certDerPathWii", config.CertPathWii, *config.EnableHTTPSExploitWii},
+			{"keyPathWii", config.KeyPathWii, *config.EnableHTTPSExploitWii},
+			{"certDerPathDS", config.CertPathDS, *config.EnableHTTPSExploitDS},
+			{"wiiCertDerPathDS", config.WiiCertPathDS, *config.EnableHTTPSExploitDS},
+			{"keyPathDS", config.KeyPathDS, *config.EnableHTTPSExploitDS},
+		}
+
+		for _, path := range paths {
+			if !path.required {
+				continue
+			}
+
+			if err := validateFile(path.value); err != nil {
+				addError("<%s> is required when HTTPS is enabled: %v", path.name, err)
+			}
+		}
+	}
+
+	if config.FrontendHTTPS && !config.EnableHTTPS {
+		addError("<frontendHttps> needs <enableHttps>")
+	}
+
+	if config.WebSocketPort != "" {
+		if err := validatePort(config.WebSocketPort); err != nil {
+			addError("<webSocketPort>: %v", err)
+		}
+	}
+
+	for _, address := range []struct{ name, value string }{
+		{"frontendAddress", config.FrontendAddress},
+		{"frontendBackendAddress", config.FrontendBackendAddress},
+		{"backendAddress", config.BackendAddress},
+		{"backendFrontendAddress", config.BackendFrontendAddress},
+	} {
+		if err := validateHostPort(address.value); err != nil {
+			addError("<%s>: %v", address.name, err)
+		}
+	}
+
+	for _, address := range []struct{ name, value string }{
+		{"frontendHealthAddress", config.FrontendHealthAddress},
+		{"frontendPprofAddress", config.FrontendPprofAddress},
+		{"backendPprofAddress", config.BackendPprofAddress},
+	} {
+		if address.value == "" {
+			continue
+		}
+
+		if err := validateHostPort(address.value); err != nil {
+			addError("<%s>: %v", address.name, err)
+		}
+	}
+
+	for _, server := range config.Servers {
+		if server.Name == "" {
+			addError("<server> is missing the name attribute")
+		} else if !IsKnownServer(server.Name) {
+			addError("<server name=%q> is not a known server", server.Name)
+		}
+		if server.Name == "nas" && (server.Address != "" || server.Port != 0) {
+			addError("<server name=\"nas\"> can't set an address or port, use <nasAddress> and <nasPort>")
+		}
+		if server.Port < 0 || server.Port > 65535 {
+			addError("<server name=%q> port must be between 1 and 65535, or 0 for the default, got %d", server.Name, server.Port)
+		}
+		if server.AllowCountries != "" && server.BlockCountries != "" {
+			addError("<server name=%q> can't have both allowCountries and blockCountries", server.Name)
+		}
+		if server.ReadBufferSize < 0 || server.ReadBufferSize > MaxReadBufferSize {
+			addError("<server name=%q> readBufferSize must be between 1 and %d, or 0 for the default, got %d", server.Name, MaxReadBufferSize, server.ReadBufferSize)
+		}
+		if _, err := ParseAllowList(server.AllowList); err != nil {
+			addError("<server name=%q> allowList: %v", server.Name, err)
+		}
+	}
+
+	if _, err := ParseAllowList(config.AllowList); err != nil {
+		addError("<allowList>: %v", err)
+	}
+
+	switch config.LogOutput {
+	case "None", "StdOut", "StdOutAndFile":
+	default:
+		addError("<logOutput> must be None, StdOut or StdOutAndFile, got %q", config.LogOutput)
+	}
+
+	if *config.LogLevel < 0 || *config.LogLevel > 4 {
+		addError("<logLevel> must be between 0 and 4, got %d", *config.LogLevel)
+	}
+
+	if _, err := config.ModuleLogLevels(); err != nil {
+		addError("<logLevels>: %v", err)
+	}
+
+	if config.GeoIPDatabase != "" {
+		if err := validateFile(config.GeoIPDatabase); err != nil {
+			addError("<geoIPDatabase>: %v", err)
+		}
+	}
+
+	if config.NATNEGSecondaryAddress != "" {
+		if err := validateHostPort(config.NATNEGSecondaryAddress); err != nil {
+			addError("<natnegSecondaryAddress>: %v", err)
+		}
+	}
+
+	if *config.CaptureMaxBytes < 1 || *config.CaptureMaxDuration < 1 {
+		addError("<captureMaxBytes> and <captureMaxDuration> must be at least 1, got %d and %d", *config.CaptureMaxBytes, *config.CaptureMaxDuration)
+	}
+
+	if *config.NATNEGPairingTimeout < 1 {
+		addError("<natnegPairingTimeout> must be at least 1 second, got %d", *config.NATNEGPairingTimeout)
+	}
+
+	if config.NATNEGRelayAddress != "" {
+		if ip := net.ParseIP(config.NATNEGRelayAddress); ip == nil || ip.To4() == nil {
+			addError("<natnegRelayAddress> must be an IPv4 address, got %q", config.NATNEGRelayAddress)
+		}
+		if config.UDPPortEnd-config.UDPPortStart+1 < 2 {
+			addError("<natnegRelayAddress> needs at least two ports in <udpPortStart> to <udpPortEnd>")
+		}
+	}
+
+	if (config.UDPPortStart != 0 || config.UDPPortEnd != 0) && (config.UDPPortStart <= 0 || config.UDPPortEnd > 65535 || config.UDPPortEnd < config.UDPPortStart) {
+		addError("<udpPortStart> and <udpPortEnd> must be a range of ports from 1 to 65535, got %d to %d", config.UDPPortStart, config.UDPPortEnd)
+	}
+
+	for _, value := range []struct {
+		name  string
+		value int
+	}{
+		{"rpcCompressionThreshold", config.RPCCompressionThreshold},
+		{"backpressureThreshold", config.BackpressureThreshold},
+		{"databaseMaxConns", config.DatabaseMaxConns},
+		{"databaseMinConns", config.DatabaseMinConns},
+		{"databaseMaxConnLifetime", config.DatabaseMaxConnLifetime},
+		{"databaseMaxConnIdleTime", config.DatabaseMaxConnIdleTime},
+		{"sendTimeout", *config.SendTimeout},
+		{"sendQueueLimit", *config.SendQueueLimit},
+		{"serverBrowserCacheTTL", *config.ServerBrowserCacheTTL},
+		{"leaderboardCacheTTL", *config.LeaderboardCacheTTL},
+		{"trafficRetention", *config.TrafficRetention},
+		{"staleConnectionTimeout", *config.StaleConnectionTimeout},
+		{"nasAuthAttemptsPerMinute", *config.NASAuthAttemptsPerMinute},
+		{"dlcMaxDownloads", *config.DLCMaxDownloads},
+		{"maxFriends", *config.MaxFriends},
+		{"friendRequestsPerMinute", *config.FriendRequestsPerMinute},
+		{"sakeMaxProfileFiles", *config.SakeMaxProfileFiles},
+		{"sakeMaxProfileBytes", *config.SakeMaxProfileBytes},
+	} {
+		if value.value < 0 {
+			addError("<%s> can't be negative", value.name)
+		}
+	}
+
+	if config.DatabaseDriver != DatabaseDriverPostgres && config.DatabaseDriver != DatabaseDriverFile {
+		addError("<databaseDriver> must be %s or %s, got %q", DatabaseDriverPostgres, DatabaseDriverFile, config.DatabaseDriver)
+	}
+
+	if config.DatabaseMaxConns > 0 && config.DatabaseMinConns > config.DatabaseMaxConns {
+		addError("<databaseMinConns> can't be more than <databaseMaxConns>")
+	}
+
+	switch config.BackpressureMode {
+	case BackpressurePause, BackpressureReject:
+	default:
+		addError("<backpressureMode> must be %s or %s, got %q", BackpressurePause, BackpressureReject, config.BackpressureMode)
+	}
+
+	switch config.DuplicateLoginPolicy {
+	case DuplicateLoginKickOld, DuplicateLoginRejectNew:
+	default:
+		addError("<duplicateLoginPolicy> must be %s or %s, got %q", DuplicateLoginKickOld, DuplicateLoginRejectNew, config.DuplicateLoginPolicy)
+	}
+
+	if config.NASAuthWebhook != "" {
+		if webhook, err := url.Parse(config.NASAuthWebhook); err != nil || (webhook.Scheme != "http" && webhook.Scheme != "https") || webhook.Host == "" {
+			addError("<nasAuthWebhook> must be an http or https URL, got %q", config.NASAuthWebhook)
+		}
+
+		if *config.NASAuthWebhookTimeout <= 0 {
+			addError("<nasAuthWebhookTimeout> must be positive")
+		}
+
+		switch config.NASAuthWebhookFailure {
+		case AuthWebhookFailOpen, AuthWebhookFailClosed:
+		default:
+			addError("<nasAuthWebhookFailure> must be %s or %s, got %q", AuthWebhookFailOpen, AuthWebhookFailClosed, config.NASAuthWebhookFailure)
+		}
+	}
+
+	if *config.BackendStartTimeout <= 0 || *config.BackendStartAttempts <= 0 {
+		addError("<backendStartTimeout> and <backendStartAttempts> must be positive")
+	}
+
+	if *config.RPCMaxPacketSize <= 0 {
+		addError("<rpcMaxPacketSize> must be positive")
+	}
+
+	if *config.SakeMaxFileSize <= 0 {
+		addError("<sakeMaxFileSize> must be positive")
+	}
+
+	for _, limit := range config.SakeFileLimits {
+		if limit.Name == "" || limit.MaxFileSize <= 0 {
+			addError("<sakeFileLimits> entries need a name and a positive maxFileSize")
+		}
+	}
+
+	gameNames := map[string]bool{}
+	for _, game := range config.Games {
+		if game.Name == "" {
+			addError("<games> entries need a name")
+			continue
+		} else if gameNames[game.Name] {
+			addError("<games> has more than one entry for %s", game.Name)
+		}
+		gameNames[game.Name] = true
+
+		for _, service := range splitGameList(game.Services) {
+			if !slices.Contains(GameServices, service) {
+				addError("<games> service for %s must be one of %s, got %q", game.Name, strings.Join(GameServices, ", "), service)
+			}
+		}
+
+		for _, version := range splitGameList(game.MatchVersions) {
+			if _, err := strconv.Atoi(version); err != nil {
+				addError("<games> matchVersions for %s must be numbers, got %q", game.Name, version)
+			}
+		}
+
+		for _, code := range splitGameList(game.GameCodes) {
+			if len(code) != 3 && len(code) != 4 {
+				addError("<games> gameCodes for %s must be 3 or 4 characters, got %q", game.Name, code)
+			}
+		}
+
+		switch game.LeaderboardOrder {
+		case "", LeaderboardDescending, LeaderboardAscending:
+		default:
+			addError("<games> leaderboardOrder for %s must be %q or %q, got %q", game.Name, LeaderboardDescending, LeaderboardAscending, game.LeaderboardOrder)
+		}
+
+		for _, board := range splitGameList(game.Leaderboards) {
+			if strings.Contains(board, `\`) {
+				addError("<games> leaderboards for %s can't contain a backslash, got %q", game.Name, board)
+			}
+		}
+
+		if game.SakeMaxFileSize < 0 || (game.FriendRequestsPerMinute != nil && *game.FriendRequestsPerMinute < 0) {
+			addError("<games> limits for %s can't be negative", game.Name)
+		}
+	}
+
+	if *config.TCPKeepAlive && *config.TCPKeepAlivePeriod <= 0 {
+		addError("<tcpKeepAlivePeriod> must be positive when <tcpKeepAlive> is enabled")
+	}
+
+	if config.ListenBacklog < 0 {
+		addError("<listenBacklog> can't be negative")
+	}
+
+	if *config.QR2SessionTimeout <= 0 {
+		addError("<qr2SessionTimeout> must be positive")
+	}
+
+	if *config.QR2HeartbeatInterval < 0 {
+		addError("<qr2HeartbeatInterval> must not be negative")
+	}
+
+	languages := map[int]bool{}
+	for _, list := range config.ProfanityLists {
+		if list.Language < 0 || list.Language > 255 {
+			addError("<profanityLists> lang must be from 0 to 255, got %d", list.Language)
+		} else if languages[list.Language] {
+			addError("<profanityLists> has more than one list for lang %d", list.Language)
+		}
+		languages[list.Language] = true
+	}
+
+	if backend {
+		if err := validateFile(config.ProfanityFile); err != nil {
+			logging.Warn("CONFIG", "Profanity word list", config.ProfanityFile, "is unavailable, names won't be filtered:", err)
+		}
+
+		for _, list := range config.ProfanityLists {
+			if err := validateFile(strings.TrimSpace(list.Path)); err != nil {
+				logging.Warn("CONFIG", "Profanity word list for lang", list.Language, "is unavailable:", err)
+			}
+		}
+
+		if config.PayloadSignatureFile != "" {
+			if err := validateFile(config.PayloadSignatureFile); err != nil {
+				logging.Warn("CONFIG", "Payload signature file", config.PayloadSignatureFile, "is unavailable, payloads won't be inspected:", err)
+			}
+		}
+
+		if config.GameStatsRuleFile != "" {
+			if err := validateFile(config.GameStatsRuleFile); err != nil {
+				logging.Warn("CONFIG", "Gamestats rule file", config.GameStatsRuleFile, "is unavailable, player data won't be checked:", err)
+			}
+		}
+
+		if config.DatabaseDriver == DatabaseDriverPostgres {
+			if err := checkDatabaseConnection(config); err != nil {
+				addError("can't connect to the database at <databaseAddress> %q: %v", config.DatabaseAddress, err)
+			}
+		}
+	}
+
+	return errs
+}
+
+func validatePort(port string) error {
+	value, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("%q is not a port number", port)
+	}
+
+	if value < 1 || value > 65535 {
+		return fmt.Errorf("port %d is out of range", value)
+	}
+
+	return nil
+}
+
+func validateHostPort(address string) error {
+	if address == "" {
+		return errors.New("required")
+	}
+
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	return validatePort(port)
+}
+
+func validateFile(path string) error {
+	if path == "" {
+		return errors.New("no path set")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+
+	return nil
+}
+
+func checkDatabaseConnection(config Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dbString := fmt.Sprintf("postgres://%s:%s@%s/%s", config.Username, config.Password, config.DatabaseAddress, config.DatabaseName)
+	conn, err := pgx.Connect(ctx, dbString)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	return conn.Ping(ctx)
+}
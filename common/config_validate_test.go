@@ -0,0 +1,133 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func validTestConfig() Config {
+	address := "127.0.0.1"
+	logLevel := 4
+	enable := false
+	zero := 0
+	timeout := 180
+	keepAlive := true
+	keepAlivePeriod := 60
+	maxFileSize := 1024
+	attempts := 3
+
+	return Config{
+		DefaultAddress:           address,
+		GameSpyAddress:           &address,
+		NASPort:                  "80",
+		FrontendAddress:          "127.0.0.1:29999",
+		FrontendBackendAddress:   "127.0.0.1:29999",
+		BackendAddress:           "127.0.0.1:29998",
+		BackendFrontendAddress:   "127.0.0.1:29998",
+		LogLevel:                 &logLevel,
+		LogOutput:                "StdOut",
+		EnableHTTPSExploitWii:    &enable,
+		EnableHTTPSExploitDS:     &enable,
+		SendTimeout:              &zero,
+		SendQueueLimit:           &zero,
+		NASAuthAttemptsPerMinute: &zero,
+		NASAuthWebhookTimeout:    &timeout,
+		NASAuthWebhookFailure:    AuthWebhookFailClosed,
+		DLCMaxDownloads:          &zero,
+		MaxFriends:               &zero,
+		FriendRequestsPerMinute:  &zero,
+		QR2SessionTimeout:        &timeout,
+		QR2HeartbeatInterval:     &zero,
+		NATNEGPairingTimeout:     &timeout,
+		CaptureMaxBytes:          &timeout,
+		CaptureMaxDuration:       &timeout,
+		ServerBrowserCacheTTL:    &zero,
+		LeaderboardCacheTTL:      &zero,
+		TrafficRetention:         &zero,
+		StaleConnectionTimeout:   &zero,
+		RPCMaxPacketSize:         &maxFileSize,
+		TCPKeepAlive:             &keepAlive,
+		TCPKeepAlivePeriod:       &keepAlivePeriod,
+		DuplicateLoginPolicy:     DuplicateLoginKickOld,
+		BackpressureMode:         BackpressurePause,
+		DatabaseDriver:           DatabaseDriverPostgres,
+		BackendStartTimeout:      &timeout,
+		BackendStartAttempts:     &attempts,
+		SakeMaxFileSize:          &maxFileSize,
+		SakeMaxProfileFiles:      &zero,
+		SakeMaxProfileBytes:      &zero,
+	}
+}
+
+func TestValidateConfigValid(t *testing.T) {
+	if errs := ValidateConfig(validTestConfig(), false); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
+
+func TestValidateConfigErrors(t *testing.T) {
+	config := validTestConfig()
+	empty := ""
+	config.GameSpyAddress = &empty
+	config.NASPort = "80000"
+	config.BackendAddress = "127.0.0.1"
+	config.LogOutput = "File"
+	config.GeoIPDatabase = "does-not-exist.mmdb"
+	config.AllowList = "192.0.2.0/24, 10.0.0.0/33"
+	config.EnableHTTPS = true
+	config.NASPortHTTPS = "443"
+	config.LogLevels = []LogLevelOverride{{Module: "NATNEG", Level: "debug"}}
+	config.DuplicateLoginPolicy = "kickBoth"
+	config.NASAuthWebhook = "ftp://auth.example.com"
+	config.BackpressureMode = "drop"
+	config.DatabaseDriver = "sqlite"
+	config.DatabaseMaxConns = 4
+	config.DatabaseMinConns = 8
+	config.UDPPortStart = 27999
+	config.UDPPortEnd = 27950
+	config.ProfanityLists = []ProfanityList{{Language: 1, Path: "a.txt"}, {Language: 1, Path: "b.txt"}}
+	config.Games = []GameConfig{{Name: "mariokartwii", Services: "gpcm,matchmaking"}}
+
+	errs := ValidateConfig(config, false)
+
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	joined := strings.Join(messages, "\n")
+
+	for _, expected := range []string{"<address>", "<nasPort>", "<backendAddress>", "<logOutput>", "<geoIPDatabase>", "<allowList>", "<certPath>", "<keyPath>", "<logLevels>", "<duplicateLoginPolicy>", "<nasAuthWebhook>", "<backpressureMode>", "<databaseDriver>", "<databaseMinConns>", "<udpPortStart>", "<profanityLists>", "<games>"} {
+		if !strings.Contains(joined, expected) {
+			t.Errorf("missing error for %s in:\n%s", expected, joined)
+		}
+	}
+
+	if strings.Contains(joined, "<certDerPathWii>") {
+		t.Error("Wii certificate required with the exploit disabled")
+	}
+
+	config = validTestConfig()
+	config.FrontendHTTPS = true
+	if errs := ValidateConfig(config, false); len(errs) != 1 || !strings.Contains(errs[0].Error(), "<frontendHttps>") {
+		t.Errorf("unexpected errors for frontendHttps without HTTPS: %v", errs)
+	}
+
+	config = validTestConfig()
+	config.ListenBacklog = -1
+	if errs := ValidateConfig(config, false); len(errs) != 1 || !strings.Contains(errs[0].Error(), "<listenBacklog>") {
+		t.Errorf("unexpected errors for a negative listenBacklog: %v", errs)
+	}
+
+	config = validTestConfig()
+	config.Servers = []ServerConfig{{Name: "qr3"}, {Name: "nas", Port: 8080}, {Name: "gpcm", Port: 70000}, {Name: "gpsp", AllowList: "192.0.2.300"}, {Name: "gamestats", ReadBufferSize: -1}, {Name: "serverbrowser", ReadBufferSize: MaxReadBufferSize + 1}}
+	if errs := ValidateConfig(config, false); len(errs) != 6 {
+		t.Errorf("unexpected errors for bad servers: %v", errs)
+	}
+
+	// 0 keeps the default port and buffer size
+	config = validTestConfig()
+	config.Servers = []ServerConfig{{Name: "gpcm", Port: 0, ReadBufferSize: 0}}
+	if errs := ValidateConfig(config, false); len(errs) != 0 {
+		t.Errorf("unexpected errors for default server settings: %v", errs)
+	}
+}
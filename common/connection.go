@@ -1,17 +1,64 @@
 package common
 
 import (
+	"errors"
 	"net/rpc"
+	"strings"
+	"sync"
 	"time"
 	"wwfc/logging"
 )
 
 var rpcFrontend *rpc.Client
 
+// ErrIncompleteWrite is returned by SendPacket when the frontend couldn't write the whole packet
+// to the client, either because of an error or the send timeout. The client's view of the stream
+// is corrupt at that point so the connection has to be closed.
+var ErrIncompleteWrite = errors.New("packet was not fully written to the connection")
+
+// ErrRecentlyClosed is returned by SendPacket and CloseConnection when the connection closed a
+// short time before, normally because the client disconnected while the packet was on its way
+var ErrRecentlyClosed = errors.New("connection was recently closed")
+
+// ErrBadIndex is returned by SendPacket and CloseConnection when the frontend doesn't know of the
+// connection at all, which means the backend is holding an index it shouldn't
+var ErrBadIndex = errors.New("incorrect connection index")
+
+// Version of the RPC structs and methods shared by the frontend and backend. Bump this
+// whenever RPCPacket, RPCFrontendPacket or the methods on them change, so a stale binary
+// on one side is caught by the handshake instead of mis-decoding gob payloads.
+const RPCProtocolVersion = 19
+
+// RPCHandshake is exchanged by RPCPacket.Handshake when the frontend connects to the backend
+type RPCHandshake struct {
+	Version int
+	Methods []string
+
+	// Size above which the sender is willing to compress packets, 0 if disabled
+	CompressionThreshold int
+}
+
 type RPCFrontendPacket struct {
-	Server string
-	Index  uint64
-	Data   []byte
+	Server     string
+	Index      uint64
+	Data       []byte
+	Compressed bool
+}
+
+type ConnectionInfo struct {
+	Index   uint64
+	Address string
+}
+
+// ConnectionStats is the traffic of a connection, counted by the frontend and sent to the
+// backend when the connection is closed
+type ConnectionStats struct {
+	Opened     time.Time
+	Duration   time.Duration
+	BytesIn    uint64
+	BytesOut   uint64
+	PacketsIn  uint64
+	PacketsOut uint64
 }
 
 // ConnectFrontend connects to the frontend RPC server
@@ -32,29 +79,148 @@ func ConnectFrontend() {
 	}
 }
 
-// SendPacket is used by backend servers to send a packet to a connection
+type connectionKey struct {
+	server string
+	index  uint64
+}
+
+// sendQueue orders the calls to the frontend for one connection. Each call takes a ticket and
+// waits for its turn, so only one is in flight at a time and they reach the frontend in the order
+// they were made, even from different goroutines.
+type sendQueue struct {
+	next    uint64
+	serving uint64
+	turn    *sync.Cond
+}
+
+var (
+	sendQueues      = map[connectionKey]*sendQueue{}
+	sendQueuesMutex sync.Mutex
+)
+
+// waitForTurn blocks until every earlier call for the connection is done. The returned function
+// must be called once the call is finished.
+func waitForTurn(server string, index uint64) func() {
+	key := connectionKey{server, index}
+
+	sendQueuesMutex.Lock()
+	queue := sendQueues[key]
+	if queue == nil {
+		queue = &sendQueue{turn: sync.NewCond(&sendQueuesMutex)}
+		sendQueues[key] = queue
+	}
+
+	ticket := queue.next
+	queue.next++
+	for queue.serving != ticket {
+		queue.turn.Wait()
+	}
+	sendQueuesMutex.Unlock()
+
+	return func() {
+		sendQueuesMutex.Lock()
+		defer sendQueuesMutex.Unlock()
+
+		queue.serving++
+		if queue.serving == queue.next {
+			// Nobody is waiting, later calls start a new queue
+			delete(sendQueues, key)
+			return
+		}
+		queue.turn.Broadcast()
+	}
+}
+
+// SendPacket is used by backend servers to send a packet to a connection. Packets for the same
+// connection are delivered in the order SendPacket is called, different connections are sent in parallel.
 func SendPacket(server string, index uint64, data []byte) error {
+	if replayPacket(server, index, data) {
+		return nil
+	}
+	CapturePacket(server, index, CaptureOutbound, data)
+
 	if rpcFrontend == nil {
 		ConnectFrontend()
 	}
 
-	err := rpcFrontend.Call("RPCFrontendPacket.SendPacket", RPCFrontendPacket{Server: server, Index: index, Data: data}, nil)
+	done := waitForTurn(server, index)
+	defer done()
+
+	data, compressed := CompressData(data, int(rpcCompressionThreshold.Load()))
+	err := rpcFrontend.Call("RPCFrontendPacket.SendPacket", RPCFrontendPacket{Server: server, Index: index, Data: data, Compressed: compressed}, nil)
+	if IsIncompleteWrite(err) {
+		logging.Warn(logging.ConnectionModule(strings.ToUpper(server), index, ""), "Packet was not fully sent, closing connection")
+		closeConnection(server, index)
+		return ErrIncompleteWrite
+	}
+
+	if IsRecentlyClosed(err) {
+		logging.Info(logging.ConnectionModule(strings.ToUpper(server), index, ""), "Dropped packet for a connection that just closed")
+		return ErrRecentlyClosed
+	}
+
 	if err != nil {
 		logging.Error("COMMON", "Failed to send packet to frontend:", err)
 	}
+	if IsBadIndex(err) {
+		return ErrBadIndex
+	}
 	return err
 }
 
-// CloseConnection is used by backend servers to close a connection
+// isRPCError checks if an error returned over RPC is the target, net/rpc only carries the error string
+func isRPCError(err error, target error) bool {
+	if err == nil {
+		return false
+	}
+
+	return errors.Is(err, target) || err.Error() == target.Error()
+}
+
+// IsIncompleteWrite checks if an error returned over RPC is ErrIncompleteWrite
+func IsIncompleteWrite(err error) bool {
+	return isRPCError(err, ErrIncompleteWrite)
+}
+
+// IsRecentlyClosed checks if an error returned over RPC is ErrRecentlyClosed
+func IsRecentlyClosed(err error) bool {
+	return isRPCError(err, ErrRecentlyClosed)
+}
+
+// IsBadIndex checks if an error returned over RPC is ErrBadIndex
+func IsBadIndex(err error) bool {
+	return isRPCError(err, ErrBadIndex)
+}
+
+// CloseConnection is used by backend servers to close a connection, after any packet sent to it before
 func CloseConnection(server string, index uint64) error {
+	if replayPacket(server, index, nil) {
+		return nil
+	}
+
 	if rpcFrontend == nil {
 		ConnectFrontend()
 	}
 
+	done := waitForTurn(server, index)
+	defer done()
+
+	return closeConnection(server, index)
+}
+
+func closeConnection(server string, index uint64) error {
 	err := rpcFrontend.Call("RPCFrontendPacket.CloseConnection", RPCFrontendPacket{Server: server, Index: index}, nil)
+	if IsRecentlyClosed(err) {
+		// Already closed by the client
+		return ErrRecentlyClosed
+	}
+
 	if err != nil {
 		logging.Error("COMMON", "Failed to close connection:", err)
 	}
+	if IsBadIndex(err) {
+		return ErrBadIndex
+	}
 	return err
 }
 
@@ -99,3 +265,17 @@ func VerifyState(stateUuid string) (bool, error) {
 	}
 	return valid, err
 }
+
+// GetConnections gets the list of open connections for each server from the frontend
+func GetConnections() (map[string][]ConnectionInfo, error) {
+	if rpcFrontend == nil {
+		ConnectFrontend()
+	}
+
+	connections := map[string][]ConnectionInfo{}
+	err := rpcFrontend.Call("RPCFrontendPacket.GetConnections", struct{}{}, &connections)
+	if err != nil {
+		logging.Error("COMMON", "Failed to get connections from frontend:", err)
+	}
+	return connections, err
+}
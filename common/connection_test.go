@@ -0,0 +1,117 @@
+package common
+
+import (
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// orderingFrontend records the packets it receives and fails if two for one connection overlap.
+// The first packet of each connection is held until release is closed.
+type orderingFrontend struct {
+	t        *testing.T
+	release  chan struct{}
+	mutex    sync.Mutex
+	inFlight map[uint64]bool
+	received map[uint64][]byte
+}
+
+func (f *orderingFrontend) SendPacket(args RPCFrontendPacket, _ *struct{}) error {
+	f.mutex.Lock()
+	if f.inFlight[args.Index] {
+		f.t.Errorf("two packets in flight for connection %d", args.Index)
+	}
+	f.inFlight[args.Index] = true
+	f.mutex.Unlock()
+
+	if args.Data[0] == 0 {
+		<-f.release
+	}
+
+	f.mutex.Lock()
+	f.inFlight[args.Index] = false
+	f.received[args.Index] = append(f.received[args.Index], args.Data[0])
+	f.mutex.Unlock()
+	return nil
+}
+
+// waitForTickets waits until the connection's queue has handed out the number of tickets
+func waitForTickets(t *testing.T, key connectionKey, tickets uint64) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Microsecond) {
+		sendQueuesMutex.Lock()
+		queue := sendQueues[key]
+		taken := queue != nil && queue.next >= tickets
+		sendQueuesMutex.Unlock()
+		if taken {
+			return
+		}
+	}
+
+	t.Fatal("SendPacket never took a ticket")
+}
+
+func TestSendPacketOrder(t *testing.T) {
+	frontend := &orderingFrontend{t: t, release: make(chan struct{}), inFlight: map[uint64]bool{}, received: map[uint64][]byte{}}
+	server := rpc.NewServer()
+	if err := server.RegisterName("RPCFrontendPacket", frontend); err != nil {
+		t.Fatal(err)
+	}
+
+	backendSide, frontendSide := net.Pipe()
+	go server.ServeConn(frontendSide)
+	rpcFrontend = rpc.NewClient(backendSide)
+	t.Cleanup(func() {
+		rpcFrontend.Close()
+		rpcFrontend = nil
+	})
+
+	const packets = 20
+	wg := sync.WaitGroup{}
+	for index := uint64(1); index <= 3; index++ {
+		// Each packet is sent from its own goroutine, once the previous one is in line
+		for i := 0; i < packets; i++ {
+			wg.Add(1)
+			go func(index uint64, i int) {
+				defer wg.Done()
+				SendPacket("test", index, []byte{byte(i)})
+			}(index, i)
+
+			waitForTickets(t, connectionKey{"test", index}, uint64(i+1))
+		}
+	}
+
+	// The first packet of every connection is in flight at once
+	inFlight := 0
+	for deadline := time.Now().Add(5 * time.Second); inFlight != 3 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		frontend.mutex.Lock()
+		inFlight = len(frontend.inFlight)
+		frontend.mutex.Unlock()
+	}
+	if inFlight != 3 {
+		t.Errorf("%d connections sending in parallel", inFlight)
+	}
+
+	close(frontend.release)
+	wg.Wait()
+
+	for index := uint64(1); index <= 3; index++ {
+		received := frontend.received[index]
+		if len(received) != packets {
+			t.Fatalf("connection %d received %d packets", index, len(received))
+		}
+		for i, packet := range received {
+			if packet != byte(i) {
+				t.Errorf("connection %d received packets in order %v", index, received)
+				break
+			}
+		}
+	}
+
+	if len(sendQueues) != 0 {
+		t.Errorf("%d send queues left over", len(sendQueues))
+	}
+}
@@ -1,9 +1,13 @@
 package common
 
 import (
+	"errors"
 	"time"
 )
 
+// ErrInvalidTypeXHeader is returned by DecryptTypeX when the data is too short for its header
+var ErrInvalidTypeXHeader = errors.New("invalid enctypex header")
+
 func EncryptTypeX(key []byte, challenge []byte, data []byte) []byte {
 	returnData := make([]byte, 20)
 	returnData = append(returnData, data...)
@@ -29,6 +33,34 @@ func EncryptTypeX(key []byte, challenge []byte, data []byte) []byte {
 	return append(header, returnData...)
 }
 
+// DecryptTypeX decrypts data encrypted by EncryptTypeX, as the server browser client does with the
+// server list. The challenge isn't modified.
+func DecryptTypeX(key []byte, challenge []byte, data []byte) ([]byte, error) {
+	if len(data) < 1 {
+		return nil, ErrInvalidTypeXHeader
+	}
+
+	headerLen := int(data[0]^0xec) + 2
+	if len(data) < headerLen {
+		return nil, ErrInvalidTypeXHeader
+	}
+
+	dataStart := int(data[headerLen-1] ^ 0xea)
+	if len(data) < headerLen+dataStart {
+		return nil, ErrInvalidTypeXHeader
+	}
+
+	encxkey := make([]byte, 261)
+	body := initEncrypt(encxkey, key, append([]byte{}, challenge...), data)
+
+	decrypted := make([]byte, len(body))
+	for i, d := range body {
+		decrypted[i] = func7d(encxkey, d)
+	}
+
+	return decrypted, nil
+}
+
 func initEncrypt(encxkey, key, validate, data []byte) []byte {
 	// TODO: Bounds
 	headerLen := (data[0] ^ 0xec) + 2
@@ -168,3 +200,58 @@ func func7e(encxkey []byte, d byte) byte {
 
 	return c
 }
+
+// func7d is func7e for decrypting, the ciphertext is fed back instead of the plaintext
+func func7d(encxkey []byte, d byte) byte {
+	a := encxkey[256]
+	b := encxkey[257]
+	c := encxkey[a]
+	encxkey[256] = (a + 1) & 0xff
+	encxkey[257] = (b + c) & 0xff
+
+	a = encxkey[260]
+	b = encxkey[257]
+	b = encxkey[b]
+	c = encxkey[a]
+	encxkey[a] = b
+
+	a = encxkey[259]
+	b = encxkey[257]
+	a = encxkey[a]
+	encxkey[b] = a
+
+	a = encxkey[256]
+	b = encxkey[259]
+	a = encxkey[a]
+	encxkey[b] = a
+
+	a = encxkey[256]
+	encxkey[a] = c
+
+	b = encxkey[258]
+	a = encxkey[c]
+	c = encxkey[259]
+	b = (a + b) & 0xff
+	encxkey[258] = b
+
+	a = b
+	c = encxkey[c]
+	b = encxkey[257]
+	b = encxkey[b]
+	a = encxkey[a]
+	c = (b + c) & 0xff
+	b = encxkey[260]
+	b = encxkey[b]
+	c = (b + c) & 0xff
+	b = encxkey[c]
+	c = encxkey[256]
+	c = encxkey[c]
+	a = (a + c) & 0xff
+	c = encxkey[b]
+	b = encxkey[a]
+	c ^= b ^ d
+	encxkey[260] = d
+	encxkey[259] = c
+
+	return c
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
 )
@@ -12,3 +13,27 @@ func TestEncryption(t *testing.T) {
 	}
 	fmt.Printf("\n")
 }
+
+func TestDecryptTypeX(t *testing.T) {
+	key := []byte("9r3Rmy")
+	challenge := []byte("abcdefgh")
+	data := []byte("server list data that is longer than the 13 byte header key")
+
+	// EncryptTypeX modifies the challenge
+	encrypted := EncryptTypeX(key, append([]byte{}, challenge...), append([]byte{}, data...))
+
+	decrypted, err := DecryptTypeX(key, challenge, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Errorf("decrypted %q, expected %q", decrypted, data)
+	}
+	if string(challenge) != "abcdefgh" {
+		t.Errorf("challenge was modified: %q", challenge)
+	}
+
+	if _, err := DecryptTypeX(key, challenge, encrypted[:10]); err != ErrInvalidTypeXHeader {
+		t.Errorf("truncated header returned %v", err)
+	}
+}
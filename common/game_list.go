@@ -3,9 +3,13 @@ package common
 import (
 	"encoding/csv"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
 )
 
 type GameInfo struct {
@@ -15,6 +19,27 @@ type GameInfo struct {
 	GameStatsVersion int
 	GameStatsKey     string
 	Description      string
+	// Custom QR2 keys the game reports, if set any other non-standard key is dropped
+	QR2Keys []string
+
+	// The rest is only set from <games> in the config
+
+	Disabled bool
+	// Services the game can use, nil for every service
+	Services []string
+	// dwc_mver values the game can report, nil for any
+	MatchVersions []string
+	// Game codes the game sends to NAS, either the full code or the first three characters
+	GameCodes []string
+
+	// Overrides for the global settings, zero or nil for the global setting
+	SakeMaxFileSize         int
+	FriendRequestsPerMinute *int
+	NoProfanityFilter       bool
+
+	// Keys of the key/value player data stored through gamestats that are leaderboard scores
+	Leaderboards         []string
+	LeaderboardAscending bool
 }
 
 var (
@@ -22,9 +47,20 @@ var (
 	readGameList       = false
 	gameListIDLookup   = map[int]int{}
 	gameListNameLookup = map[string]int{}
+	gameListCodeLookup = map[string]int{}
 	mutex              = sync.RWMutex{}
+
+	// The game list as read from game_list.tsv, and the overrides from the config
+	baseGameList  []GameInfo
+	gameConfigs   []GameConfig
+	restrictGames bool
+	// Games enabled or disabled at runtime by ID, applied over the config and kept when it's reloaded
+	gameOverrides = map[int]bool{}
 )
 
+// GameUnavailableMessage is shown to the players of a disabled game by the services that can show one
+const GameUnavailableMessage = "This game is temporarily unavailable. Please try again later."
+
 func GetGameInfoByID(gameId int) *GameInfo {
 	mutex.Lock()
 	defer mutex.Unlock()
@@ -47,6 +83,148 @@ func GetGameInfoByName(name string) *GameInfo {
 	return nil
 }
 
+// GetGameInfoByCode finds the game a NAS game code belongs to, only games with gameCodes in the
+// config can be found
+func GetGameInfoByCode(gameCode string) *GameInfo {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, code := range []string{gameCode, gameCode[:min(3, len(gameCode))]} {
+		if index, ok := gameListCodeLookup[code]; ok && index < len(gameList) {
+			return &gameList[index]
+		}
+	}
+
+	return nil
+}
+
+// CheckGame returns the game if it's in the game list and can use the service. Otherwise the
+// request should be rejected, a warning has been logged and nil is returned.
+func CheckGame(moduleName string, gameName string, service string) *GameInfo {
+	game := GetGameInfoByName(gameName)
+	if !checkGameService(moduleName, game, aurora.Cyan(gameName).String(), service) {
+		return nil
+	}
+
+	return game
+}
+
+// CheckGameByID is CheckGame for the services that identify the game by its ID
+func CheckGameByID(moduleName string, gameId int, service string) *GameInfo {
+	game := GetGameInfoByID(gameId)
+	if !checkGameService(moduleName, game, "ID "+aurora.Cyan(gameId).String(), service) {
+		return nil
+	}
+
+	return game
+}
+
+// CheckGameCode checks a NAS game code can use the service. The game list only has codes for the
+// games in the config, so other codes are allowed unless restrictGames is enabled.
+func CheckGameCode(moduleName string, gameCode string, service string) bool {
+	game := GetGameInfoByCode(gameCode)
+	if game == nil {
+		mutex.RLock()
+		restricted := restrictGames
+		mutex.RUnlock()
+
+		if !restricted {
+			return true
+		}
+	}
+
+	return checkGameService(moduleName, game, "code "+aurora.Cyan(gameCode).String(), service)
+}
+
+// IsGameDisabled checks if the game is in the game list but disabled, to tell a disabled game apart
+// from an unknown one after CheckGame rejected it
+func IsGameDisabled(gameName string) bool {
+	game := GetGameInfoByName(gameName)
+	return game != nil && game.Disabled
+}
+
+func checkGameService(moduleName string, game *GameInfo, description string, service string) bool {
+	switch {
+	case game == nil:
+		logging.Warn(moduleName, "Rejected", service, "request for unknown game", description)
+	case game.Disabled:
+		logging.Warn(moduleName, "Rejected", service, "request for disabled game", aurora.Cyan(game.Name))
+	case game.Services != nil && !slices.Contains(game.Services, service):
+		logging.Warn(moduleName, "Rejected", service, "request for game", aurora.Cyan(game.Name).String()+", the service isn't enabled for it")
+	default:
+		return true
+	}
+
+	return false
+}
+
+// ApplyGameConfig applies the games from the config over game_list.tsv, replacing the previous
+// overrides. It can be called before or after the file is read.
+func ApplyGameConfig(config Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	gameConfigs = config.Games
+	restrictGames = config.RestrictGames
+	buildGameList()
+}
+
+// SetGameEnabled enables or disables the game with the ID over the config until it's changed again.
+// Returns the game, or nil if no game has the ID.
+func SetGameEnabled(gameId int, enabled bool) *GameInfo {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if _, ok := gameListIDLookup[gameId]; !ok {
+		return nil
+	}
+
+	gameOverrides[gameId] = enabled
+	buildGameList()
+	return &gameList[gameListIDLookup[gameId]]
+}
+
+// GetGameOverrides returns the games enabled or disabled at runtime by ID
+func GetGameOverrides() map[int]bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	overrides := make(map[int]bool, len(gameOverrides))
+	for gameId, enabled := range gameOverrides {
+		overrides[gameId] = enabled
+	}
+
+	return overrides
+}
+
+// SetGameOverrides replaces the games enabled or disabled at runtime, used when they're loaded from
+// the state file
+func SetGameOverrides(overrides map[int]bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	gameOverrides = map[int]bool{}
+	for gameId, enabled := range overrides {
+		gameOverrides[gameId] = enabled
+	}
+	buildGameList()
+}
+
+// GetDisabledGames returns the games that are disabled by the config or at runtime
+func GetDisabledGames() []GameInfo {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	var games []GameInfo
+	for _, game := range gameList {
+		if game.Disabled {
+			games = append(games, game)
+		}
+	}
+
+	return games
+}
+
 func ReadGameList() {
 	mutex.Lock()
 	defer mutex.Unlock()
@@ -62,16 +240,16 @@ func ReadGameList() {
 
 	reader := csv.NewReader(file)
 	reader.Comma = '\t'
+	// The QR2 keys column is optional
+	reader.FieldsPerRecord = -1
 	csvList, err := reader.ReadAll()
 	if err != nil {
 		panic(err)
 	}
 
-	gameList = []GameInfo{}
-	gameListIDLookup = map[int]int{}
-	gameListNameLookup = map[string]int{}
+	baseGameList = []GameInfo{}
 
-	for index, entry := range csvList {
+	for _, entry := range csvList {
 		gameId := -1
 
 		if entry[2] != "" {
@@ -90,23 +268,120 @@ func ReadGameList() {
 			}
 		}
 
-		gameList = append(gameList, GameInfo{
+		var qr2Keys []string
+		if len(entry) > 6 && entry[6] != "" {
+			qr2Keys = strings.Split(entry[6], ",")
+		}
+
+		baseGameList = append(baseGameList, GameInfo{
 			GameID:           gameId,
 			Name:             entry[1],
 			SecretKey:        entry[3],
 			GameStatsVersion: gameStatsVer,
 			GameStatsKey:     entry[5],
 			Description:      entry[0],
+			QR2Keys:          qr2Keys,
 		})
+	}
+
+	buildGameList()
+	readGameList = true
+}
 
-		// Create lookup tables
-		if gameId != -1 {
-			gameListIDLookup[gameId] = index
+// buildGameList merges the config into the game list and creates the lookup tables. Expects the
+// mutex to already be locked.
+func buildGameList() {
+	configs := map[string]GameConfig{}
+	for _, game := range gameConfigs {
+		configs[game.Name] = game
+	}
+
+	gameList = []GameInfo{}
+	for _, game := range baseGameList {
+		config, ok := configs[game.Name]
+		if !ok {
+			if !restrictGames {
+				gameList = append(gameList, game)
+			}
+			continue
 		}
-		gameListNameLookup[entry[1]] = index
+
+		gameList = append(gameList, applyGameConfig(game, config))
+		delete(configs, game.Name)
 	}
 
-	readGameList = true
+	// New games, in the order they're listed
+	for _, config := range gameConfigs {
+		if _, ok := configs[config.Name]; ok {
+			gameList = append(gameList, applyGameConfig(GameInfo{GameID: -1, Name: config.Name, GameStatsVersion: -1}, config))
+			delete(configs, config.Name)
+		}
+	}
+
+	gameListIDLookup = map[int]int{}
+	gameListNameLookup = map[string]int{}
+	gameListCodeLookup = map[string]int{}
+	for index, game := range gameList {
+		if enabled, ok := gameOverrides[game.GameID]; ok && game.GameID != -1 {
+			gameList[index].Disabled = !enabled
+		}
+
+		if game.GameID != -1 {
+			gameListIDLookup[game.GameID] = index
+		}
+		gameListNameLookup[game.Name] = index
+		for _, code := range game.GameCodes {
+			gameListCodeLookup[code] = index
+		}
+	}
+}
+
+func applyGameConfig(game GameInfo, config GameConfig) GameInfo {
+	if config.GameID != nil {
+		game.GameID = *config.GameID
+	}
+	if config.SecretKey != "" {
+		game.SecretKey = config.SecretKey
+	}
+	if config.GameStatsVersion != nil {
+		game.GameStatsVersion = *config.GameStatsVersion
+	}
+	if config.GameStatsKey != "" {
+		game.GameStatsKey = config.GameStatsKey
+	}
+	if config.Description != "" {
+		game.Description = config.Description
+	}
+	if config.QR2Keys != "" {
+		game.QR2Keys = splitGameList(config.QR2Keys)
+	}
+
+	game.Disabled = config.Enabled != nil && !*config.Enabled
+	game.Services = nil
+	if config.Services != "" {
+		game.Services = splitGameList(config.Services)
+	}
+	game.MatchVersions = splitGameList(config.MatchVersions)
+	game.GameCodes = splitGameList(config.GameCodes)
+
+	game.SakeMaxFileSize = config.SakeMaxFileSize
+	game.FriendRequestsPerMinute = config.FriendRequestsPerMinute
+	game.NoProfanityFilter = config.ProfanityFilter != nil && !*config.ProfanityFilter
+	game.Leaderboards = splitGameList(config.Leaderboards)
+	game.LeaderboardAscending = config.LeaderboardOrder == LeaderboardAscending
+	return game
+}
+
+// splitGameList splits a comma separated attribute, returning nil for an empty one
+func splitGameList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
 }
 
 func GetExpectedUnitCode(gameName string) byte {
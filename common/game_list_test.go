@@ -0,0 +1,138 @@
+package common
+
+import (
+	"slices"
+	"testing"
+)
+
+func setTestGameList(t *testing.T, games []GameConfig, restrict bool) {
+	mutex.Lock()
+	baseGameList = []GameInfo{
+		{GameID: 1687, Name: "mariokartwii", SecretKey: "9r3Rmy", GameStatsVersion: -1},
+		{GameID: 1540, Name: "mariokartds", SecretKey: "mxsyud"},
+	}
+	mutex.Unlock()
+
+	ApplyGameConfig(Config{Games: games, RestrictGames: restrict})
+
+	t.Cleanup(func() {
+		mutex.Lock()
+		baseGameList = nil
+		gameOverrides = map[int]bool{}
+		mutex.Unlock()
+		ApplyGameConfig(Config{})
+	})
+}
+
+func TestApplyGameConfig(t *testing.T) {
+	disabled := false
+	newGameId := 9999
+	setTestGameList(t, []GameConfig{
+		{Name: "mariokartwii", Services: "gpcm, qr2", MatchVersions: "90", GameCodes: "RMC"},
+		{Name: "mariokartds", Enabled: &disabled},
+		{Name: "newdsgame", GameID: &newGameId, SecretKey: "abcdef", GameCodes: "ABCE,ABCP"},
+	}, false)
+
+	game := GetGameInfoByName("mariokartwii")
+	if game == nil || game.SecretKey != "9r3Rmy" || game.GameID != 1687 {
+		t.Fatalf("game_list.tsv values weren't kept: %+v", game)
+	}
+	if !slices.Equal(game.Services, []string{"gpcm", "qr2"}) || !slices.Equal(game.MatchVersions, []string{"90"}) {
+		t.Errorf("overrides weren't applied: %+v", game)
+	}
+
+	if CheckGame("TEST", "mariokartwii", GameServiceQR2) == nil {
+		t.Error("enabled service was rejected")
+	}
+	if CheckGame("TEST", "mariokartwii", GameServiceSake) != nil {
+		t.Error("service that isn't enabled was accepted")
+	}
+	if CheckGame("TEST", "mariokartds", GameServiceGPCM) != nil {
+		t.Error("disabled game was accepted")
+	}
+	if CheckGame("TEST", "unknowngame", GameServiceGPCM) != nil {
+		t.Error("unknown game was accepted")
+	}
+
+	if game := CheckGameByID("TEST", 9999, GameServiceSake); game == nil || game.Name != "newdsgame" || game.SecretKey != "abcdef" {
+		t.Errorf("game added in the config wasn't found: %+v", game)
+	}
+
+	if game := GetGameInfoByCode("RMCP"); game == nil || game.Name != "mariokartwii" {
+		t.Errorf("three character game code didn't match: %+v", game)
+	}
+	if game := GetGameInfoByCode("ABCP"); game == nil || game.Name != "newdsgame" {
+		t.Errorf("full game code didn't match: %+v", game)
+	}
+
+	if !CheckGameCode("TEST", "XYZE", GameServiceDownload) {
+		t.Error("unlisted game code rejected without restrictGames")
+	}
+	if CheckGameCode("TEST", "RMCE", GameServiceDownload) {
+		t.Error("game code accepted for a service that isn't enabled")
+	}
+}
+
+func TestApplyGameConfigRestricted(t *testing.T) {
+	setTestGameList(t, []GameConfig{{Name: "mariokartds", GameCodes: "AMC"}}, true)
+
+	if GetGameInfoByName("mariokartwii") != nil {
+		t.Error("unlisted game kept with restrictGames")
+	}
+	if CheckGame("TEST", "mariokartds", GameServiceGameStats) == nil {
+		t.Error("listed game rejected with restrictGames")
+	}
+	if CheckGameCode("TEST", "XYZE", GameServiceDownload) {
+		t.Error("unlisted game code accepted with restrictGames")
+	}
+
+	// Reloading without the entry removes the override
+	ApplyGameConfig(Config{})
+	if game := GetGameInfoByName("mariokartwii"); game == nil || game.Services != nil {
+		t.Errorf("game list wasn't rebuilt: %+v", game)
+	}
+}
+
+func TestSetGameEnabled(t *testing.T) {
+	setTestGameList(t, []GameConfig{{Name: "mariokartwii", GameCodes: "RMC"}}, false)
+
+	if SetGameEnabled(1234, false) != nil {
+		t.Error("unknown game ID was disabled")
+	}
+
+	if game := SetGameEnabled(1687, false); game == nil || !game.Disabled {
+		t.Fatalf("game wasn't disabled: %+v", game)
+	}
+	if CheckGame("TEST", "mariokartwii", GameServiceQR2) != nil || !IsGameDisabled("mariokartwii") {
+		t.Error("disabled game was accepted")
+	}
+	if game := GetGameInfoByCode("RMCE"); game == nil || !game.Disabled {
+		t.Errorf("game isn't disabled by its game code: %+v", game)
+	}
+	if IsGameDisabled("mariokartds") || IsGameDisabled("unknowngame") {
+		t.Error("other games were disabled")
+	}
+
+	// Kept when the config is reloaded
+	ApplyGameConfig(Config{})
+	if !IsGameDisabled("mariokartwii") {
+		t.Error("game was enabled by a config reload")
+	}
+	if games := GetDisabledGames(); len(games) != 1 || games[0].GameID != 1687 {
+		t.Errorf("unexpected disabled games: %+v", games)
+	}
+
+	// Overrides the config both ways
+	disabled := false
+	ApplyGameConfig(Config{Games: []GameConfig{{Name: "mariokartds", Enabled: &disabled}}})
+	SetGameEnabled(1540, true)
+	SetGameEnabled(1687, true)
+	if CheckGame("TEST", "mariokartds", GameServiceGPCM) == nil || CheckGame("TEST", "mariokartwii", GameServiceGPCM) == nil {
+		t.Error("enabled game was rejected")
+	}
+
+	SetGameOverrides(nil)
+	if !IsGameDisabled("mariokartds") {
+		t.Error("config wasn't applied once the override was removed")
+	}
+}
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+var ErrPortRangeExhausted = errors.New("no free ports left in the UDP port range")
+
+// PortAllocator hands out UDP sockets bound to ports from a fixed range, so a firewall can be
+// configured for every port the backend may use
+type PortAllocator struct {
+	mutex sync.Mutex
+	start int
+	end   int
+	used  map[int]bool
+	// Allocation continues after the last port handed out, so a released port isn't reused
+	// straight away while a client may still be sending to it
+	next int
+}
+
+// UDPPorts is the range shared by every server in the backend, set from udpPortStart and udpPortEnd
+var UDPPorts = NewPortAllocator(0, -1)
+
+// NewPortAllocator creates an allocator for the ports from start to end inclusive
+func NewPortAllocator(start int, end int) *PortAllocator {
+	return &PortAllocator{start: start, end: end, used: map[int]bool{}, next: start}
+}
+
+// SetRange replaces the range. Ports already handed out stay in use until released.
+func (a *PortAllocator) SetRange(start int, end int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.start = start
+	a.end = end
+	a.next = start
+}
+
+// Size returns the number of ports in the range
+func (a *PortAllocator) Size() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return max(0, a.end-a.start+1)
+}
+
+// InUse returns the number of ports currently handed out
+func (a *PortAllocator) InUse() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return len(a.used)
+}
+
+// ListenUDP binds a UDP socket on the host to a free port in the range. Ports in use by
+// another process are skipped. The port must be given back with Release once the socket is closed.
+func (a *PortAllocator) ListenUDP(host string) (net.PacketConn, int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	size := a.end - a.start + 1
+	for i := 0; i < size; i++ {
+		port := a.start + (a.next-a.start+i)%size
+		if a.used[port] {
+			continue
+		}
+
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+
+		a.used[port] = true
+		a.next = port + 1
+		if a.next > a.end {
+			a.next = a.start
+		}
+		return conn, port, nil
+	}
+
+	logging.Error("UDP", "Port range", aurora.Cyan(a.start).String()+"-"+aurora.Cyan(a.end).String(), "is exhausted with", aurora.Cyan(len(a.used)), "ports in use")
+	return nil, 0, ErrPortRangeExhausted
+}
+
+// Release returns a port to the range
+func (a *PortAllocator) Release(port int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	delete(a.used, port)
+}
@@ -0,0 +1,69 @@
+package common
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestPortAllocator(t *testing.T) {
+	// Find a free range of ports
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := probe.LocalAddr().(*net.UDPAddr).Port + 1
+	probe.Close()
+
+	// Taken by another process, so skipped
+	taken, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(start+1)))
+	if err != nil {
+		t.Skip("port range not free:", err)
+	}
+	defer taken.Close()
+
+	allocator := NewPortAllocator(start, start+3)
+
+	var conns []net.PacketConn
+	var ports []int
+	for i := 0; i < 3; i++ {
+		conn, port, err := allocator.ListenUDP("127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if port == start+1 || port < start || port > start+3 {
+			t.Errorf("allocated port %d outside of the free ports", port)
+		}
+		conns = append(conns, conn)
+		ports = append(ports, port)
+	}
+
+	if _, _, err := allocator.ListenUDP("127.0.0.1"); err != ErrPortRangeExhausted {
+		t.Fatalf("got %v from a full range", err)
+	}
+
+	if allocator.InUse() != 3 {
+		t.Errorf("%d ports in use", allocator.InUse())
+	}
+
+	conns[1].Close()
+	allocator.Release(ports[1])
+
+	conn, port, err := allocator.ListenUDP("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if port != ports[1] {
+		t.Errorf("got port %d, expected the released port %d", port, ports[1])
+	}
+}
+
+func TestPortAllocatorEmptyRange(t *testing.T) {
+	if _, _, err := NewPortAllocator(0, -1).ListenUDP("127.0.0.1"); err != ErrPortRangeExhausted {
+		t.Errorf("got %v from an empty range", err)
+	}
+}
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Set at build time:
+// go build -ldflags "-X wwfc/common.Version=1.2.0 -X wwfc/common.Commit=$(git rev-parse HEAD)"
+var (
+	Version = "dev"
+	// Falls back to the commit Go records when building from a git checkout
+	Commit = ""
+)
+
+// Close enough to the process start for the uptime
+var processStartTime = time.Now()
+
+type VersionInfo struct {
+	Version   string    `json:"version"`
+	Commit    string    `json:"commit"`
+	Modified  bool      `json:"modified,omitempty"`
+	GoVersion string    `json:"go_version"`
+	StartTime time.Time `json:"start_time"`
+}
+
+// GetVersionInfo returns the build of the running process and when it started
+func GetVersionInfo() VersionInfo {
+	info := VersionInfo{
+		Version:   Version,
+		Commit:    Commit,
+		GoVersion: runtime.Version(),
+		StartTime: processStartTime,
+	}
+
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+
+	return info
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"wwfc/common"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// frontendConn is a connection held by the frontend on behalf of the backend
+type frontendConn struct {
+	net.Conn
+
+	// Cancelled when the connection is closed by the frontend or backend, with one of the close
+	// reasons as the cause. The goroutine running handleConnection owns the socket and is the only
+	// one to close it.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	// Packets from the backend waiting for writeLoop, which is the only one writing to the socket
+	send sendQueue
+
+	// Set once the backend has been told about the connection
+	announced atomic.Bool
+	// Sent to the backend with every packet so the logs of both can be matched
+	traceID string
+	// When the connection was cancelled in Unix nanoseconds, 0 while it's open
+	cancelled atomic.Int64
+
+	// Sent to the backend with the close
+	opened     time.Time
+	bytesIn    atomic.Uint64
+	bytesOut   atomic.Uint64
+	packetsIn  atomic.Uint64
+	packetsOut atomic.Uint64
+}
+
+func newFrontendConn(conn net.Conn) *frontendConn {
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	fConn := &frontendConn{Conn: conn, ctx: ctx, cancel: cancel, opened: time.Now()}
+	fConn.send.wake = make(chan struct{}, 1)
+
+	context.AfterFunc(ctx, func() {
+		fConn.cancelled.Store(time.Now().UnixNano())
+
+		// An immediate deadline fails any blocked read or write without closing the socket from under them
+		if err := conn.SetDeadline(time.Now()); err != nil {
+			conn.Close()
+		}
+	})
+
+	go fConn.writeLoop()
+	return fConn
+}
+
+func (c *frontendConn) stats() common.ConnectionStats {
+	return common.ConnectionStats{
+		Opened:     c.opened,
+		Duration:   time.Since(c.opened),
+		BytesIn:    c.bytesIn.Load(),
+		BytesOut:   c.bytesOut.Load(),
+		PacketsIn:  c.packetsIn.Load(),
+		PacketsOut: c.packetsOut.Load(),
+	}
+}
+
+// Why a connection closed, logged when it ends
+var (
+	closeReasonClientEOF    = errors.New("client_eof")
+	closeReasonClientError  = errors.New("client_error")
+	closeReasonIdleTimeout  = errors.New("idle_timeout")
+	closeReasonKicked       = errors.New("kicked")
+	closeReasonBackendError = errors.New("backend_error")
+	// The backend crashed and the server can't carry on with the connection
+	closeReasonBackendLost = errors.New("backend_lost")
+	closeReasonDrained     = errors.New("drained")
+	closeReasonRecycled    = errors.New("recycled")
+	// The client didn't read fast enough and too much data was waiting to be sent
+	closeReasonSendQueueFull = errors.New("send_queue_full")
+	closeReasonWriteError    = errors.New("write_error")
+)
+
+// readCloseReason tells why reading from the client failed while the connection was open
+func readCloseReason(err error) error {
+	switch {
+	case errors.Is(err, io.EOF):
+		return closeReasonClientEOF
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, syscall.ETIMEDOUT):
+		// Keepalive probes went unanswered
+		return closeReasonIdleTimeout
+	default:
+		return closeReasonClientError
+	}
+}
+
+// logConnectionClosed writes the one line summarizing a connection once it ended, in key=value
+// pairs so it can be parsed
+func logConnectionClosed(server string, index uint64, conn *frontendConn) {
+	stats := conn.stats()
+	logging.Info("FRONTEND", fmt.Sprintf("Connection closed: server=%s index=%d remote=%s duration_ms=%d bytes_in=%d bytes_out=%d packets_in=%d packets_out=%d reason=%s trace=%s",
+		server, index, conn.RemoteAddr(), stats.Duration.Milliseconds(), stats.BytesIn, stats.BytesOut, stats.PacketsIn, stats.PacketsOut, context.Cause(conn.ctx), conn.traceID))
+}
+
+// How long the index of a closed connection is remembered, so the backend can tell a packet that
+// raced with the close from an index that was never valid
+const recentlyClosedTTL = time.Minute
+
+// connectionMap is the set of open connections for a single server. Each server
+// has its own lock so traffic on one server doesn't contend with another.
+type connectionMap struct {
+	mutex sync.RWMutex
+	conns map[uint64]*frontendConn
+
+	// When each recently removed index was removed, pruned once per TTL
+	closed    map[uint64]time.Time
+	nextPrune time.Time
+}
+
+func newConnectionMap() *connectionMap {
+	return &connectionMap{conns: map[uint64]*frontendConn{}, closed: map[uint64]time.Time{}}
+}
+
+// markClosed remembers that the index was removed. Expects the mutex to be locked.
+func (m *connectionMap) markClosed(index uint64, now time.Time) {
+	if now.After(m.nextPrune) {
+		for closedIndex, closed := range m.closed {
+			if now.Sub(closed) >= recentlyClosedTTL {
+				delete(m.closed, closedIndex)
+			}
+		}
+		m.nextPrune = now.Add(recentlyClosedTTL)
+	}
+
+	m.closed[index] = now
+}
+
+// lookupError returns the error for an index that isn't in the map, ErrRecentlyClosed if it was
+// removed within the TTL and ErrBadIndex otherwise
+func (m *connectionMap) lookupError(index uint64, now time.Time) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if closed, ok := m.closed[index]; ok && now.Sub(closed) < recentlyClosedTTL {
+		return common.ErrRecentlyClosed
+	}
+
+	return common.ErrBadIndex
+}
+
+func (m *connectionMap) get(index uint64) *frontendConn {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.conns[index]
+}
+
+func (m *connectionMap) add(index uint64, conn *frontendConn) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.conns[index] = conn
+}
+
+// remove deletes the connection only if it is still the one stored at the index.
+// Returns false if it was already removed or replaced.
+func (m *connectionMap) remove(index uint64, conn *frontendConn) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.conns[index] != conn {
+		return false
+	}
+
+	delete(m.conns, index)
+	m.markClosed(index, time.Now())
+	return true
+}
+
+// announce marks the connection as known to the backend if it's still in the map. The lock orders it
+// with remove, so either whoever removes the connection sees it announced and tells the backend it
+// closed, or this returns false and the caller has to.
+func (m *connectionMap) announce(index uint64, conn *frontendConn) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.conns[index] != conn {
+		return false
+	}
+
+	conn.announced.Store(true)
+	return true
+}
+
+// closeAll cancels and removes every connection, returning how many were closed.
+// The backend isn't told about connections closed this way, it's only for connections the
+// backend doesn't know of. Use closeServerConnections otherwise.
+func (m *connectionMap) closeAll() int {
+	conns := m.removeAll()
+	for _, conn := range conns {
+		conn.cancel(closeReasonDrained)
+	}
+
+	return len(conns)
+}
+
+// all returns a copy of the connections in the map
+func (m *connectionMap) all() map[uint64]*frontendConn {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	conns := make(map[uint64]*frontendConn, len(m.conns))
+	for index, conn := range m.conns {
+		conns[index] = conn
+	}
+	return conns
+}
+
+// removeAll empties the map and returns the connections that were in it. The caller is then the one
+// to tell the backend about them closing.
+func (m *connectionMap) removeAll() map[uint64]*frontendConn {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	conns := m.conns
+	m.conns = map[uint64]*frontendConn{}
+
+	now := time.Now()
+	for index := range conns {
+		m.markClosed(index, now)
+	}
+	return conns
+}
+
+// getConnection looks up a connection by server name and index
+func getConnection(server string, index uint64) *frontendConn {
+	serverConnections := connections[server]
+	if serverConnections == nil {
+		return nil
+	}
+
+	return serverConnections.get(index)
+}
+
+// connectionError returns why a connection couldn't be found, for the backend to tell a race with
+// the client disconnecting from a bug
+func connectionError(server string, index uint64) error {
+	serverConnections := connections[server]
+	if serverConnections == nil {
+		return common.ErrBadIndex
+	}
+
+	return serverConnections.lookupError(index, time.Now())
+}
+
+// stale returns the connections that were cancelled at least timeout ago but are still in the map,
+// meaning the goroutine that owns them is stuck or missed its cleanup
+func (m *connectionMap) stale(timeout time.Duration, now time.Time) map[uint64]*frontendConn {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	stale := map[uint64]*frontendConn{}
+	for index, conn := range m.conns {
+		if cancelled := conn.cancelled.Load(); cancelled != 0 && now.Sub(time.Unix(0, cancelled)) >= timeout {
+			stale[index] = conn
+		}
+	}
+
+	return stale
+}
+
+// checkStaleConnections logs every stale connection, and with closeStale removes it, closes the
+// socket and tells the backend. Returns the number found.
+func checkStaleConnections(timeout time.Duration, closeStale bool) int {
+	found := 0
+	now := time.Now()
+
+	for server, serverConnections := range connections {
+		for index, conn := range serverConnections.stale(timeout, now) {
+			found++
+			closedFor := now.Sub(time.Unix(0, conn.cancelled.Load())).Round(time.Second)
+			logging.Warn("FRONTEND", "Connection", aurora.Cyan(index), "to", aurora.BrightCyan(server), "from", aurora.BrightCyan(conn.RemoteAddr().String()), "was closed", aurora.Cyan(closedFor), "ago but is still open")
+
+			if closeStale && serverConnections.remove(index, conn) {
+				conn.Close()
+				if conn.announced.Load() {
+					go closeBackendConnection(server, index, conn)
+				}
+			}
+		}
+	}
+
+	return found
+}
+
+func startStaleConnectionCheck(timeout time.Duration, closeStale bool) {
+	go func() {
+		for range time.Tick(timeout) {
+			checkStaleConnections(timeout, closeStale)
+		}
+	}()
+}
@@ -0,0 +1,77 @@
+package database
+
+import (
+	"context"
+)
+
+const (
+	IsProfileAllowlisted   = `SELECT EXISTS(SELECT 1 FROM allowlist WHERE profile_id = $1 OR (console_fc = $2 AND console_fc <> 0))`
+	IsNASLoginAllowlisted  = `SELECT EXISTS(SELECT 1 FROM allowlist WHERE (console_fc = $3 AND console_fc <> 0) OR profile_id = (SELECT profile_id FROM users WHERE user_id = $1 AND gsbrcd = $2))`
+	InsertAllowlistProfile = `INSERT INTO allowlist (profile_id, console_fc, added, moderator) SELECT $1, 0, now(), $2 WHERE NOT EXISTS(SELECT 1 FROM allowlist WHERE profile_id = $1)`
+	InsertAllowlistConsole = `INSERT INTO allowlist (profile_id, console_fc, added, moderator) SELECT 0, $1, now(), $2 WHERE NOT EXISTS(SELECT 1 FROM allowlist WHERE console_fc = $1)`
+	DeleteAllowlistProfile = `DELETE FROM allowlist WHERE profile_id = $1 AND profile_id <> 0`
+	DeleteAllowlistConsole = `DELETE FROM allowlist WHERE console_fc = $1 AND console_fc <> 0`
+	FetchAllowlistEntries  = `SELECT profile_id, console_fc FROM allowlist ORDER BY id`
+)
+
+type AllowlistEntry struct {
+	ProfileID uint32 `json:"profile_id,omitempty"`
+	ConsoleFC uint64 `json:"console_fc,omitempty"`
+}
+
+// IsProfileAllowed checks if the profile ID or console friend code is on the allowlist
+func (s *postgresStore) IsProfileAllowed(ctx context.Context, profileId uint32, consoleFc uint64) (bool, error) {
+	var allowed bool
+	err := s.pool.QueryRow(ctx, IsProfileAllowlisted, profileId, int64(consoleFc)).Scan(&allowed)
+	return allowed, err
+}
+
+// IsNASLoginAllowed checks if the account logging in to NAS is on the allowlist, either by
+// the console friend code or by the profile ID already registered to the account
+func (s *postgresStore) IsNASLoginAllowed(ctx context.Context, userId uint64, gsbrcd string, consoleFc uint64) (bool, error) {
+	var allowed bool
+	err := s.pool.QueryRow(ctx, IsNASLoginAllowlisted, userId, gsbrcd, int64(consoleFc)).Scan(&allowed)
+	return allowed, err
+}
+
+func (s *postgresStore) AllowProfile(ctx context.Context, profileId uint32, moderator string) error {
+	_, err := s.pool.Exec(ctx, InsertAllowlistProfile, profileId, moderator)
+	return err
+}
+
+func (s *postgresStore) AllowConsole(ctx context.Context, consoleFc uint64, moderator string) error {
+	_, err := s.pool.Exec(ctx, InsertAllowlistConsole, int64(consoleFc), moderator)
+	return err
+}
+
+// DisallowProfile removes the profile ID from the allowlist, returns false if it wasn't on it
+func (s *postgresStore) DisallowProfile(ctx context.Context, profileId uint32) (bool, error) {
+	tag, err := s.pool.Exec(ctx, DeleteAllowlistProfile, profileId)
+	return tag.RowsAffected() != 0, err
+}
+
+// DisallowConsole removes the console friend code from the allowlist, returns false if it wasn't on it
+func (s *postgresStore) DisallowConsole(ctx context.Context, consoleFc uint64) (bool, error) {
+	tag, err := s.pool.Exec(ctx, DeleteAllowlistConsole, int64(consoleFc))
+	return tag.RowsAffected() != 0, err
+}
+
+func (s *postgresStore) FetchAllowlist(ctx context.Context) ([]AllowlistEntry, error) {
+	rows, err := s.pool.Query(ctx, FetchAllowlistEntries)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AllowlistEntry{}
+	for rows.Next() {
+		var profileId, consoleFc int64
+		if err := rows.Scan(&profileId, &consoleFc); err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, AllowlistEntry{ProfileID: uint32(profileId), ConsoleFC: uint64(consoleFc)})
+	}
+
+	return entries, rows.Err()
+}
@@ -0,0 +1,49 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"wwfc/common"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Connect opens the store in the config. For PostgreSQL that's a connection pool of the caller's
+// own, pool settings left at 0 keep the driver's defaults. The file is shared by every server in
+// the process and saved when the last of them closes it.
+func Connect(ctx context.Context, config common.Config) (Store, error) {
+	switch config.DatabaseDriver {
+	case common.DatabaseDriverPostgres:
+	case common.DatabaseDriverFile:
+		return openFileStore(config.DatabaseFile)
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", config.DatabaseDriver)
+	}
+
+	dbString := fmt.Sprintf("postgres://%s:%s@%s/%s", config.Username, config.Password, config.DatabaseAddress, config.DatabaseName)
+	dbConf, err := pgxpool.ParseConfig(dbString)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.DatabaseMaxConns > 0 {
+		dbConf.MaxConns = int32(config.DatabaseMaxConns)
+	}
+	if config.DatabaseMinConns > 0 {
+		dbConf.MinConns = int32(config.DatabaseMinConns)
+	}
+	if config.DatabaseMaxConnLifetime > 0 {
+		dbConf.MaxConnLifetime = time.Duration(config.DatabaseMaxConnLifetime) * time.Second
+	}
+	if config.DatabaseMaxConnIdleTime > 0 {
+		dbConf.MaxConnIdleTime = time.Duration(config.DatabaseMaxConnIdleTime) * time.Second
+	}
+
+	pool, err := pgxpool.ConnectConfig(ctx, dbConf)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPostgresStore(pool), nil
+}
@@ -0,0 +1,865 @@
+package database
+
+import (
+	"cmp"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"wwfc/common"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+const (
+	// How often changes to the database file are written
+	fileStoreSaveInterval = 5 * time.Second
+)
+
+// fileData is everything the file driver keeps, the contents of the database file
+type fileData struct {
+	// Profiles by profile ID, deleted ones are kept anonymized like in the users table
+	Users         map[uint32]*ProfileRecord
+	LastProfileID uint32
+	Trusted       map[uint32]bool
+	// In the order the entries were added
+	Allowlist []fileAllowlistEntry
+
+	PlayerData map[filePlayerDataKey]PlayerDataRecord
+	Scores     map[fileScoreKey]ScoreRecord
+	NATStats   map[fileNATStatsKey]NATStatsRecord
+
+	SakeFiles      map[int32]SakeFile
+	LastSakeFileID int32
+
+	// Connections that haven't been rolled up into the daily totals yet
+	Connections []ConnectionRecord
+	Traffic     map[fileTrafficKey]TrafficEntry
+}
+
+type fileAllowlistEntry struct {
+	ProfileID uint32
+	ConsoleFC uint64
+	Added     time.Time
+	Moderator string
+}
+
+type filePlayerDataKey struct {
+	ProfileID uint32
+	GameName  string
+	PType     int
+	DIndex    int
+}
+
+type fileScoreKey struct {
+	ProfileID uint32
+	GameName  string
+	Board     string
+}
+
+type fileNATStatsKey struct {
+	ProfileID     uint32
+	NATType       byte
+	MappingScheme byte
+}
+
+type fileTrafficKey struct {
+	Day       string
+	ProfileID uint32
+	IPAddress string
+	Server    string
+}
+
+// fileStore keeps the data in memory and writes it to a single file, for servers too small to
+// need a database. Every server in the process shares one store per file.
+type fileStore struct {
+	path string
+	// Servers that opened the store and haven't closed it yet
+	refs int
+	stop chan struct{}
+	done chan struct{}
+
+	mutex sync.Mutex
+	data  fileData
+	dirty bool
+}
+
+var (
+	fileStoresMutex sync.Mutex
+	fileStores      = map[string]*fileStore{}
+)
+
+func openFileStore(path string) (Store, error) {
+	path = filepath.Clean(path)
+
+	fileStoresMutex.Lock()
+	defer fileStoresMutex.Unlock()
+
+	if s := fileStores[path]; s != nil {
+		s.refs++
+		return s, nil
+	}
+
+	s := &fileStore{path: path, refs: 1, stop: make(chan struct{}), done: make(chan struct{})}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	fileStores[path] = s
+	go s.saveLoop()
+	return s, nil
+}
+
+func (s *fileStore) load() error {
+	file, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		logging.Notice("DATABASE", "Creating database file", aurora.Cyan(s.path))
+	} else if err != nil {
+		return err
+	} else {
+		err := gob.NewDecoder(file).Decode(&s.data)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", s.path, err)
+		}
+	}
+
+	data := &s.data
+	if data.Users == nil {
+		data.Users = map[uint32]*ProfileRecord{}
+	}
+	if data.Trusted == nil {
+		data.Trusted = map[uint32]bool{}
+	}
+	if data.PlayerData == nil {
+		data.PlayerData = map[filePlayerDataKey]PlayerDataRecord{}
+	}
+	if data.Scores == nil {
+		data.Scores = map[fileScoreKey]ScoreRecord{}
+	}
+	if data.NATStats == nil {
+		data.NATStats = map[fileNATStatsKey]NATStatsRecord{}
+	}
+	if data.SakeFiles == nil {
+		data.SakeFiles = map[int32]SakeFile{}
+	}
+	if data.Traffic == nil {
+		data.Traffic = map[fileTrafficKey]TrafficEntry{}
+	}
+
+	return nil
+}
+
+// save writes the data if it changed since the last save. The file is replaced in one rename, so
+// a crash while writing leaves the previous one.
+func (s *fileStore) save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+
+	if dir := filepath.Dir(s.path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	temp := s.path + ".tmp"
+	file, err := os.OpenFile(temp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(file).Encode(s.data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp, s.path)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	s.dirty = false
+	return nil
+}
+
+func (s *fileStore) saveLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(fileStoreSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.save(); err != nil {
+				logging.Error("DATABASE", "Failed to save", aurora.Cyan(s.path).String()+":", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close saves the data once the last server using the store closes it
+func (s *fileStore) Close() {
+	fileStoresMutex.Lock()
+	defer fileStoresMutex.Unlock()
+
+	s.refs--
+	if s.refs > 0 {
+		return
+	}
+
+	delete(fileStores, s.path)
+	close(s.stop)
+	<-s.done
+
+	if err := s.save(); err != nil {
+		logging.Error("DATABASE", "Failed to save", aurora.Cyan(s.path).String()+":", err)
+	}
+}
+
+// SaveFiles writes the unsaved changes of every open database file, for a backend about to exit
+// without closing its stores
+func SaveFiles() {
+	fileStoresMutex.Lock()
+	defer fileStoresMutex.Unlock()
+
+	for _, s := range fileStores {
+		if err := s.save(); err != nil {
+			logging.Error("DATABASE", "Failed to save", aurora.Cyan(s.path).String()+":", err)
+		}
+	}
+}
+
+// The file has no schema to update
+func (s *fileStore) UpdateTables(ctx context.Context) {}
+
+// changed marks the data to be written on the next save, with the mutex held
+func (s *fileStore) changed() {
+	s.dirty = true
+}
+
+func (s *fileStore) findUser(userId uint64, gsbrcd string) *ProfileRecord {
+	for _, record := range s.data.Users {
+		if record.UserID == userId && record.GsbrCode == gsbrcd {
+			return record
+		}
+	}
+
+	return nil
+}
+
+func (record *ProfileRecord) user() User {
+	return User{
+		ProfileId:   record.ProfileID,
+		UserId:      record.UserID,
+		GsbrCode:    record.GsbrCode,
+		NgDeviceId:  record.NgDeviceID,
+		Email:       record.Email,
+		UniqueNick:  record.UniqueNick,
+		FirstName:   record.FirstName,
+		LastName:    record.LastName,
+		ZipCode:     record.ZipCode,
+		CountryCode: record.CountryCode,
+		Location:    record.Location,
+		OpenHost:    record.OpenHost,
+	}
+}
+
+func (s *fileStore) createUser(user *User) (*ProfileRecord, error) {
+	if user.ProfileId == 0 {
+		// Like a serial column, skipping IDs that were set by hand
+		for {
+			s.data.LastProfileID++
+			if s.data.Users[s.data.LastProfileID] == nil {
+				break
+			}
+		}
+		user.ProfileId = s.data.LastProfileID
+	} else if user.ProfileId >= 1000000000 {
+		return nil, ErrReservedProfileIDRange
+	} else if s.data.Users[user.ProfileId] != nil {
+		return nil, ErrProfileIDInUse
+	}
+
+	record := &ProfileRecord{
+		ProfileID:  user.ProfileId,
+		UserID:     user.UserId,
+		GsbrCode:   user.GsbrCode,
+		NgDeviceID: user.NgDeviceId,
+		Email:      user.Email,
+		UniqueNick: user.UniqueNick,
+	}
+	s.data.Users[record.ProfileID] = record
+	return record, nil
+}
+
+func (s *fileStore) LoginUserToGPCM(ctx context.Context, userId uint64, gsbrcd string, profileId uint32, ngDeviceId uint32, ipAddress string, ingamesn string) (User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user := User{
+		UserId:   userId,
+		GsbrCode: gsbrcd,
+	}
+
+	record := s.findUser(userId, gsbrcd)
+	if record == nil {
+		user.ProfileId = profileId
+		user.NgDeviceId = ngDeviceId
+		user.UniqueNick = common.Base32Encode(userId) + gsbrcd
+		user.Email = user.UniqueNick + "@nds"
+
+		var err error
+		record, err = s.createUser(&user)
+		if err != nil {
+			logging.Error("DATABASE", "Error creating user:", aurora.Cyan(userId), aurora.Cyan(gsbrcd), aurora.Cyan(user.ProfileId), "\nerror:", err.Error())
+			return User{}, err
+		}
+
+		logging.Notice("DATABASE", "Created new GPCM user:", aurora.Cyan(userId), aurora.Cyan(gsbrcd), aurora.Cyan(user.ProfileId))
+	} else {
+		user = record.user()
+
+		if user.NgDeviceId != 0 {
+			if ngDeviceId != 0 && user.NgDeviceId != ngDeviceId {
+				logging.Error("DATABASE", "NG device ID mismatch for profile", aurora.Cyan(user.ProfileId), "- expected", aurora.Cyan(fmt.Sprintf("%08x", user.NgDeviceId)), "but got", aurora.Cyan(fmt.Sprintf("%08x", ngDeviceId)))
+				return User{}, ErrDeviceIDMismatch
+			}
+		} else if ngDeviceId != 0 {
+			user.NgDeviceId = ngDeviceId
+			record.NgDeviceID = ngDeviceId
+		}
+
+		if profileId != 0 && user.ProfileId != profileId {
+			if profileId >= 1000000000 || s.data.Users[profileId] != nil {
+				logging.Warn("DATABASE", "Could not update", aurora.Cyan(userId), aurora.Cyan(gsbrcd), "profile ID from", aurora.Cyan(user.ProfileId), "to", aurora.Cyan(profileId))
+			} else {
+				delete(s.data.Users, record.ProfileID)
+				record.ProfileID = profileId
+				s.data.Users[profileId] = record
+				user.ProfileId = profileId
+				logging.Notice("DATABASE", "Updated GPCM user profile ID:", aurora.Cyan(userId), aurora.Cyan(gsbrcd), aurora.Cyan(user.ProfileId))
+			}
+		}
+
+		logging.Notice("DATABASE", "Log in GPCM user:", aurora.Cyan(userId), aurora.Cyan(user.GsbrCode), "-", aurora.Cyan(user.ProfileId))
+	}
+
+	// This should be set if the user already knows its own profile ID
+	if profileId != 0 && user.LastName == "" {
+		update := parseProfileUpdate(map[string]string{
+			"lastname": "000000000" + gsbrcd,
+		})
+		update.applyRecord(record)
+		update.apply(&user)
+	}
+
+	record.LastIPAddress = ipAddress
+	record.LastInGameName = ingamesn
+	s.changed()
+
+	user, err := applyLoginBan(user, s.findUserBan(user.ProfileId, user.NgDeviceId, ipAddress))
+	if err != nil {
+		return user, err
+	}
+
+	user.Trusted = s.data.Trusted[user.ProfileId]
+	return user, nil
+}
+
+func (s *fileStore) LoginUserToGameStats(ctx context.Context, userId uint64, gsbrcd string) (User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record := s.findUser(userId, gsbrcd)
+	if record == nil {
+		return User{}, ErrNotFound
+	}
+
+	return record.user(), nil
+}
+
+func (s *fileStore) GetProfile(ctx context.Context, profileId uint32) (User, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record := s.data.Users[profileId]
+	if record == nil {
+		return User{}, false
+	}
+
+	return record.user(), true
+}
+
+func (update profileUpdate) applyRecord(record *ProfileRecord) {
+	set := func(field *string, value *string) {
+		if value != nil {
+			*field = *value
+		}
+	}
+
+	set(&record.FirstName, update.firstName)
+	set(&record.LastName, update.lastName)
+	set(&record.ZipCode, update.zipCode)
+	set(&record.CountryCode, update.countryCode)
+	set(&record.Location, update.location)
+	set(&record.Email, update.email)
+	if update.openHost != nil {
+		record.OpenHost = *update.openHost
+	}
+}
+
+func (s *fileStore) UpdateUserProfile(ctx context.Context, profileId uint32, data map[string]string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if record := s.data.Users[profileId]; record != nil {
+		parseProfileUpdate(data).applyRecord(record)
+		s.changed()
+	}
+
+	return nil
+}
+
+func (s *fileStore) SearchProfiles(ctx context.Context, search ProfileSearch, skip int, limit int) ([]ProfileSearchResult, int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	nick := strings.ToLower(search.Nick)
+	var matches []ProfileSearchResult
+	for _, record := range s.data.Users {
+		if (search.UniqueNick != "" && record.UniqueNick != search.UniqueNick) ||
+			(search.Email != "" && record.Email != search.Email) ||
+			(search.FirstName != "" && record.FirstName != search.FirstName) ||
+			(search.LastName != "" && record.LastName != search.LastName) ||
+			(nick != "" && !strings.Contains(strings.ToLower(record.LastInGameName), nick)) {
+			continue
+		}
+
+		matches = append(matches, ProfileSearchResult{
+			ProfileId:  record.ProfileID,
+			GsbrCode:   record.GsbrCode,
+			FirstName:  record.FirstName,
+			InGameName: record.LastInGameName,
+		})
+	}
+
+	slices.SortFunc(matches, func(a, b ProfileSearchResult) int {
+		return cmp.Compare(a.ProfileId, b.ProfileId)
+	})
+
+	return page(matches, skip, limit), len(matches), nil
+}
+
+func (s *fileStore) GetMKWFriendInfo(ctx context.Context, profileId uint32) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if record := s.data.Users[profileId]; record != nil {
+		return record.MKWFriendInfo
+	}
+
+	return ""
+}
+
+func (s *fileStore) UpdateMKWFriendInfo(ctx context.Context, profileId uint32, info string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if record := s.data.Users[profileId]; record != nil {
+		record.MKWFriendInfo = info
+		s.changed()
+	}
+}
+
+func (s *fileStore) BanUser(ctx context.Context, profileId uint32, tos bool, shadow bool, length time.Duration, reason string, reasonHidden string, moderator string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record := s.data.Users[profileId]
+	if record == nil {
+		return true
+	}
+
+	issued := time.Now()
+	ban := &ProfileBan{Issued: &issued, Reason: reason, ReasonHidden: reasonHidden, Moderator: moderator, TOS: tos, Shadow: shadow}
+	if length > 0 {
+		expires := issued.Add(length)
+		ban.Expires = &expires
+	}
+
+	record.Ban = ban
+	s.changed()
+	return true
+}
+
+func (s *fileStore) UnbanUser(ctx context.Context, profileId uint32) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if record := s.data.Users[profileId]; record != nil {
+		record.Ban = nil
+		s.changed()
+	}
+
+	return true
+}
+
+func activeBan(record *ProfileRecord, now time.Time) bool {
+	return record.Ban != nil && (record.Ban.Expires == nil || record.Ban.Expires.After(now))
+}
+
+func (record *ProfileRecord) banInfo() *common.BanInfo {
+	ban := &common.BanInfo{
+		TOS:      record.Ban.TOS,
+		Shadow:   record.Ban.Shadow,
+		Reason:   record.Ban.Reason,
+		DeviceID: record.NgDeviceID,
+	}
+	if record.Ban.Expires != nil {
+		ban.Expires = *record.Ban.Expires
+	}
+
+	return ban
+}
+
+// findUserBan picks the ban the same way as SearchUserBan: a visible ban first, then a shadow
+// ban, then the one that lasts longest
+func (s *fileStore) findUserBan(profileId uint32, ngDeviceId uint32, ipAddress string) *common.BanInfo {
+	now := time.Now()
+	var found *ProfileRecord
+	for _, record := range s.data.Users {
+		if !activeBan(record, now) || (record.ProfileID != profileId && record.NgDeviceID != ngDeviceId && record.LastIPAddress != ipAddress) {
+			continue
+		}
+
+		if found == nil || banPrecedes(record.Ban, found.Ban) {
+			found = record
+		}
+	}
+
+	if found == nil {
+		return nil
+	}
+	return found.banInfo()
+}
+
+func banPrecedes(a *ProfileBan, b *ProfileBan) bool {
+	if visibleA, visibleB := a.TOS && !a.Shadow, b.TOS && !b.Shadow; visibleA != visibleB {
+		return visibleA
+	}
+	if a.Shadow != b.Shadow {
+		return a.Shadow
+	}
+	if a.Expires == nil || b.Expires == nil {
+		return a.Expires == nil && b.Expires != nil
+	}
+	return a.Expires.After(*b.Expires)
+}
+
+func (s *fileStore) FindNASBan(ctx context.Context, userId uint64, gsbrcd string) (*common.BanInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for _, record := range s.data.Users {
+		if record.UserID == userId && record.GsbrCode == gsbrcd && activeBan(record, now) {
+			return record.banInfo(), nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *fileStore) DoesUserTrusted(ctx context.Context, profileID uint32) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.data.Trusted[profileID], nil
+}
+
+func (s *fileStore) AddTrusted(ctx context.Context, profileID uint32) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.data.Trusted[profileID] = true
+	s.changed()
+	return true, nil
+}
+
+func (s *fileStore) FetchTrusted(ctx context.Context) ([]uint32, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var trustedIDs []uint32
+	for profileID := range s.data.Trusted {
+		trustedIDs = append(trustedIDs, profileID)
+	}
+
+	slices.Sort(trustedIDs)
+	return trustedIDs, nil
+}
+
+func (s *fileStore) RemoveTrusted(ctx context.Context, profileId uint32) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.data.Trusted, profileId)
+	s.changed()
+	return true
+}
+
+func (s *fileStore) IsProfileAllowed(ctx context.Context, profileId uint32, consoleFc uint64) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.allowlisted(profileId, true, consoleFc), nil
+}
+
+func (s *fileStore) IsNASLoginAllowed(ctx context.Context, userId uint64, gsbrcd string, consoleFc uint64) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if record := s.findUser(userId, gsbrcd); record != nil {
+		return s.allowlisted(record.ProfileID, true, consoleFc), nil
+	}
+	return s.allowlisted(0, false, consoleFc), nil
+}
+
+// allowlisted checks for an entry with the profile ID, if hasProfile is set, or the console
+// friend code
+func (s *fileStore) allowlisted(profileId uint32, hasProfile bool, consoleFc uint64) bool {
+	for _, entry := range s.data.Allowlist {
+		if (hasProfile && entry.ProfileID == profileId) || (entry.ConsoleFC == consoleFc && entry.ConsoleFC != 0) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *fileStore) allow(entry fileAllowlistEntry, exists func(entry fileAllowlistEntry) bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if slices.IndexFunc(s.data.Allowlist, exists) != -1 {
+		return
+	}
+
+	entry.Added = time.Now()
+	s.data.Allowlist = append(s.data.Allowlist, entry)
+	s.changed()
+}
+
+func (s *fileStore) AllowProfile(ctx context.Context, profileId uint32, moderator string) error {
+	s.allow(fileAllowlistEntry{ProfileID: profileId, Moderator: moderator}, func(entry fileAllowlistEntry) bool {
+		return entry.ProfileID == profileId
+	})
+	return nil
+}
+
+func (s *fileStore) AllowConsole(ctx context.Context, consoleFc uint64, moderator string) error {
+	s.allow(fileAllowlistEntry{ConsoleFC: consoleFc, Moderator: moderator}, func(entry fileAllowlistEntry) bool {
+		return entry.ConsoleFC == consoleFc
+	})
+	return nil
+}
+
+// disallow removes the matching allowlist entries and returns how many there were
+func (s *fileStore) disallow(matches func(entry fileAllowlistEntry) bool) int {
+	count := len(s.data.Allowlist)
+	s.data.Allowlist = slices.DeleteFunc(s.data.Allowlist, matches)
+	if removed := count - len(s.data.Allowlist); removed != 0 {
+		s.changed()
+		return removed
+	}
+
+	return 0
+}
+
+func (s *fileStore) DisallowProfile(ctx context.Context, profileId uint32) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.disallow(func(entry fileAllowlistEntry) bool {
+		return entry.ProfileID == profileId && profileId != 0
+	}) != 0, nil
+}
+
+func (s *fileStore) DisallowConsole(ctx context.Context, consoleFc uint64) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.disallow(func(entry fileAllowlistEntry) bool {
+		return entry.ConsoleFC == consoleFc && consoleFc != 0
+	}) != 0, nil
+}
+
+func (s *fileStore) FetchAllowlist(ctx context.Context) ([]AllowlistEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries := []AllowlistEntry{}
+	for _, entry := range s.data.Allowlist {
+		entries = append(entries, AllowlistEntry{ProfileID: entry.ProfileID, ConsoleFC: entry.ConsoleFC})
+	}
+
+	return entries, nil
+}
+
+func (s *fileStore) ExportProfile(ctx context.Context, profileId uint32) (ProfileExport, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record := s.data.Users[profileId]
+	if record == nil {
+		return ProfileExport{}, ErrNotFound
+	}
+
+	export := ProfileExport{
+		Profile:     *record,
+		Trusted:     s.data.Trusted[profileId],
+		Allowlisted: profileId != 0 && s.allowlisted(profileId, true, 0),
+		SakeFiles:   []SakeFile{},
+		PlayerData:  []PlayerDataRecord{},
+		Scores:      []ScoreRecord{},
+		NATStats:    []NATStatsRecord{},
+	}
+
+	for _, file := range s.data.SakeFiles {
+		if file.ProfileID == profileId {
+			export.SakeFiles = append(export.SakeFiles, file)
+		}
+	}
+	slices.SortFunc(export.SakeFiles, func(a, b SakeFile) int {
+		return cmp.Compare(a.FileID, b.FileID)
+	})
+
+	for key, data := range s.data.PlayerData {
+		if key.ProfileID == profileId {
+			export.PlayerData = append(export.PlayerData, data)
+		}
+	}
+	slices.SortFunc(export.PlayerData, func(a, b PlayerDataRecord) int {
+		return compareKeys(cmp.Compare(a.GameName, b.GameName), cmp.Compare(a.PType, b.PType), cmp.Compare(a.DIndex, b.DIndex))
+	})
+
+	for key, score := range s.data.Scores {
+		if key.ProfileID == profileId {
+			export.Scores = append(export.Scores, score)
+		}
+	}
+	slices.SortFunc(export.Scores, func(a, b ScoreRecord) int {
+		return compareKeys(cmp.Compare(a.GameName, b.GameName), cmp.Compare(a.Board, b.Board))
+	})
+
+	for key, stats := range s.data.NATStats {
+		if key.ProfileID == profileId {
+			export.NATStats = append(export.NATStats, stats)
+		}
+	}
+	slices.SortFunc(export.NATStats, func(a, b NATStatsRecord) int {
+		return compareKeys(cmp.Compare(a.NATType, b.NATType), cmp.Compare(a.MappingScheme, b.MappingScheme))
+	})
+
+	// Every day still kept, both rolled up and not
+	export.Traffic = s.traffic(TrafficFilter{ProfileID: profileId, From: time.Unix(0, 0), To: time.Now().AddDate(0, 0, 1), Limit: -1})
+	return export, nil
+}
+
+func (s *fileStore) DeleteProfile(ctx context.Context, profileId uint32) (map[string]int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record := s.data.Users[profileId]
+	if record == nil {
+		return nil, ErrNotFound
+	}
+
+	// Anonymized the same way as AnonymizeProfileUser
+	deleted := record.Deleted
+	if deleted == nil {
+		now := time.Now()
+		deleted = &now
+	}
+	anonymized := &ProfileRecord{ProfileID: profileId, Deleted: deleted}
+	if record.Ban != nil {
+		anonymized.NgDeviceID = record.NgDeviceID
+		anonymized.Ban = record.Ban
+	}
+	s.data.Users[profileId] = anonymized
+
+	removed := map[string]int64{}
+	removed["sake_files"] = deleteFunc(s.data.SakeFiles, func(_ int32, file SakeFile) bool { return file.ProfileID == profileId })
+	removed["gamestats_player_data"] = deleteFunc(s.data.PlayerData, func(key filePlayerDataKey, _ PlayerDataRecord) bool { return key.ProfileID == profileId })
+	removed["gamestats_scores"] = deleteFunc(s.data.Scores, func(key fileScoreKey, _ ScoreRecord) bool { return key.ProfileID == profileId })
+	removed["nat_stats"] = deleteFunc(s.data.NATStats, func(key fileNATStatsKey, _ NATStatsRecord) bool { return key.ProfileID == profileId })
+
+	count := len(s.data.Connections)
+	s.data.Connections = slices.DeleteFunc(s.data.Connections, func(connection ConnectionRecord) bool { return connection.ProfileID == profileId })
+	removed["connection_log"] = int64(count - len(s.data.Connections))
+
+	removed["connection_stats_daily"] = deleteFunc(s.data.Traffic, func(key fileTrafficKey, _ TrafficEntry) bool { return key.ProfileID == profileId })
+	removed["allowlist"] = int64(s.disallow(func(entry fileAllowlistEntry) bool { return entry.ProfileID == profileId }))
+
+	removed["trusted"] = 0
+	if s.data.Trusted[profileId] {
+		delete(s.data.Trusted, profileId)
+		removed["trusted"] = 1
+	}
+
+	s.changed()
+	return removed, nil
+}
+
+// deleteFunc deletes the entries of the map that match and returns how many there were
+func deleteFunc[K comparable, V any](m map[K]V, matches func(key K, value V) bool) int64 {
+	removed := int64(0)
+	for key, value := range m {
+		if matches(key, value) {
+			delete(m, key)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// page returns the items from the offset, up to the limit if it isn't negative
+func page[T any](items []T, offset int, limit int) []T {
+	if offset >= len(items) {
+		return items[len(items):]
+	}
+
+	items = items[max(offset, 0):]
+	if limit >= 0 && limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
+
+// compareKeys returns the first comparison that isn't equal
+func compareKeys(comparisons ...int) int {
+	for _, comparison := range comparisons {
+		if comparison != 0 {
+			return comparison
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,385 @@
+package database
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+func (s *fileStore) InsertSakeFileRecord(ctx context.Context, gameId int, profileId uint32, size int64, maxFiles int, maxBytes int64) (int32, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.data.Users[profileId] == nil {
+		return 0, ErrSakeUnknownOwner
+	}
+
+	files, bytes := 0, int64(0)
+	for _, file := range s.data.SakeFiles {
+		if file.ProfileID == profileId {
+			files++
+			bytes += file.Size
+		}
+	}
+
+	if (maxFiles != 0 && files >= maxFiles) || (maxBytes != 0 && bytes+size > maxBytes) {
+		return 0, ErrSakeQuotaExceeded
+	}
+
+	s.data.LastSakeFileID++
+	file := SakeFile{FileID: s.data.LastSakeFileID, GameID: int32(gameId), ProfileID: profileId, Size: size, Created: time.Now()}
+	s.data.SakeFiles[file.FileID] = file
+	s.changed()
+	return file.FileID, nil
+}
+
+func (s *fileStore) GetSakeFile(ctx context.Context, fileId int32) (SakeFile, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	file, ok := s.data.SakeFiles[fileId]
+	if !ok {
+		return SakeFile{FileID: fileId}, ErrNotFound
+	}
+
+	return file, nil
+}
+
+func (s *fileStore) DeleteSakeFile(ctx context.Context, fileId int32) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.data.SakeFiles, fileId)
+	s.changed()
+	return nil
+}
+
+func (s *fileStore) GetAllSakeFileIDs(ctx context.Context) (map[int32]bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ids := map[int32]bool{}
+	for fileId := range s.data.SakeFiles {
+		ids[fileId] = true
+	}
+
+	return ids, nil
+}
+
+func (s *fileStore) DeleteOrphanedSakeFileRecords(ctx context.Context) (map[int32]bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ids := map[int32]bool{}
+	for fileId, file := range s.data.SakeFiles {
+		if s.data.Users[file.ProfileID] == nil {
+			ids[fileId] = true
+			delete(s.data.SakeFiles, fileId)
+		}
+	}
+
+	if len(ids) != 0 {
+		s.changed()
+	}
+	return ids, nil
+}
+
+// sakeRow is a record SAKE can search, by column. A missing column is NULL.
+type sakeRow map[string]any
+
+// sakeRows returns the rows of the tables SAKE searches, with values of the types the PostgreSQL
+// driver scans them as
+func (s *fileStore) sakeRows(table string) ([]sakeRow, error) {
+	var rows []sakeRow
+	switch table {
+	case "users":
+		for _, record := range s.data.Users {
+			row := sakeRow{"profile_id": int64(record.ProfileID)}
+			if record.MKWFriendInfo != "" {
+				row["mariokartwii_friend_info"] = record.MKWFriendInfo
+			}
+			rows = append(rows, row)
+		}
+
+	case "sake_files":
+		for _, file := range s.data.SakeFiles {
+			rows = append(rows, sakeRow{"file_id": file.FileID, "game_id": file.GameID, "profile_id": int64(file.ProfileID), "size": file.Size})
+		}
+
+	default:
+		return nil, fmt.Errorf("the database file has no table %s", table)
+	}
+
+	// In the order of the primary key, so records that sort the same come out the same every time
+	slices.SortFunc(rows, func(a, b sakeRow) int {
+		return compareKeys(compareSakeValues(a["file_id"], b["file_id"]), compareSakeValues(a["profile_id"], b["profile_id"]))
+	})
+	return rows, nil
+}
+
+func (s *fileStore) SearchSakeRecords(ctx context.Context, search SakeSearch) ([][]any, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	rows, err := s.sakeRows(search.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	if search.Condition != nil {
+		rows = slices.DeleteFunc(rows, func(row sakeRow) bool {
+			return search.Condition.match(row) != sakeTrue
+		})
+	}
+
+	slices.SortStableFunc(rows, func(a, b sakeRow) int {
+		for _, order := range search.Order {
+			// NULLs sort as larger than every value, as in PostgreSQL
+			comparison := compareSakeValues(a[order.Column], b[order.Column])
+			if order.Descending {
+				comparison = -comparison
+			}
+			if comparison != 0 {
+				return comparison
+			}
+		}
+		return 0
+	})
+
+	if surrounding := search.Surrounding; surrounding != nil {
+		first, last := -1, -1
+		for i, row := range rows {
+			if owner, ok := sakeInt(row[surrounding.OwnerColumn]); ok && slices.Contains(surrounding.Owners, int32(owner)) {
+				if first == -1 {
+					first = i
+				}
+				last = i
+			}
+		}
+
+		if first == -1 {
+			return nil, nil
+		}
+		rows = rows[max(first-surrounding.Count, 0):min(last+surrounding.Count+1, len(rows))]
+		rows = page(rows, 0, search.Limit)
+	} else {
+		rows = page(rows, search.Offset, search.Limit)
+	}
+
+	var records [][]any
+	for _, row := range rows {
+		values := make([]any, len(search.Columns))
+		for i, column := range search.Columns {
+			values[i] = row[column]
+		}
+		records = append(records, values)
+	}
+
+	return records, nil
+}
+
+// sakeTruth is the result of a condition in SQL's three valued logic
+type sakeTruth int
+
+const (
+	sakeFalse sakeTruth = iota
+	sakeTrue
+	sakeUnknown
+)
+
+func (c SakeAnd) match(row sakeRow) sakeTruth {
+	left, right := c.Left.match(row), c.Right.match(row)
+	switch {
+	case left == sakeFalse || right == sakeFalse:
+		return sakeFalse
+	case left == sakeUnknown || right == sakeUnknown:
+		return sakeUnknown
+	default:
+		return sakeTrue
+	}
+}
+
+func (c SakeOr) match(row sakeRow) sakeTruth {
+	left, right := c.Left.match(row), c.Right.match(row)
+	switch {
+	case left == sakeTrue || right == sakeTrue:
+		return sakeTrue
+	case left == sakeUnknown || right == sakeUnknown:
+		return sakeUnknown
+	default:
+		return sakeFalse
+	}
+}
+
+func (c SakeNot) match(row sakeRow) sakeTruth {
+	switch c.Inner.match(row) {
+	case sakeTrue:
+		return sakeFalse
+	case sakeFalse:
+		return sakeTrue
+	default:
+		return sakeUnknown
+	}
+}
+
+func (c SakeCompare) match(row sakeRow) sakeTruth {
+	value := row[c.Column]
+	if value == nil || c.Value == nil {
+		return sakeUnknown
+	}
+
+	if c.Op == "LIKE" {
+		text, ok := value.(string)
+		pattern, patternOk := c.Value.(string)
+		if !ok || !patternOk {
+			return sakeUnknown
+		}
+		return truth(matchLike(text, pattern))
+	}
+
+	comparison, ok := 0, true
+	switch expected := c.Value.(type) {
+	case bool:
+		actual, isBool := value.(bool)
+		ok = isBool && (c.Op == "=" || c.Op == "<>")
+		if actual != expected {
+			comparison = 1
+		}
+	case string:
+		actual, isString := value.(string)
+		ok = isString
+		comparison = strings.Compare(actual, expected)
+	default:
+		actual, isInt := sakeInt(value)
+		number, isNumber := sakeInt(expected)
+		ok = isInt && isNumber
+		comparison = cmp.Compare(actual, number)
+	}
+	if !ok {
+		return sakeUnknown
+	}
+
+	switch c.Op {
+	case "=":
+		return truth(comparison == 0)
+	case "<>":
+		return truth(comparison != 0)
+	case "<":
+		return truth(comparison < 0)
+	case "<=":
+		return truth(comparison <= 0)
+	case ">":
+		return truth(comparison > 0)
+	case ">=":
+		return truth(comparison >= 0)
+	default:
+		return sakeUnknown
+	}
+}
+
+func (c SakeIn) match(row sakeRow) sakeTruth {
+	value, ok := sakeInt(row[c.Column])
+	if !ok {
+		return sakeUnknown
+	}
+
+	return truth(slices.Contains(c.Values, int32(value)))
+}
+
+func truth(value bool) sakeTruth {
+	if value {
+		return sakeTrue
+	}
+	return sakeFalse
+}
+
+func sakeInt(value any) (int64, bool) {
+	switch value := value.(type) {
+	case int64:
+		return value, true
+	case int32:
+		return int64(value), true
+	default:
+		return 0, false
+	}
+}
+
+// compareSakeValues orders two values of a column, NULL after everything else
+func compareSakeValues(a any, b any) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+
+	if numberA, ok := sakeInt(a); ok {
+		numberB, _ := sakeInt(b)
+		return cmp.Compare(numberA, numberB)
+	}
+
+	switch a := a.(type) {
+	case string:
+		text, _ := b.(string)
+		return strings.Compare(a, text)
+	case bool:
+		flag, _ := b.(bool)
+		if a == flag {
+			return 0
+		} else if !a {
+			return -1
+		}
+		return 1
+	}
+
+	return 0
+}
+
+// matchLike matches text against an SQL LIKE pattern, where % is any run of characters, _ is one
+// character and a backslash escapes the next one
+func matchLike(text string, pattern string) bool {
+	textRunes, patternRunes := []rune(text), []rune(pattern)
+
+	var match func(t int, p int) bool
+	match = func(t int, p int) bool {
+		for p < len(patternRunes) {
+			switch patternRunes[p] {
+			case '%':
+				for i := t; i <= len(textRunes); i++ {
+					if match(i, p+1) {
+						return true
+					}
+				}
+				return false
+
+			case '_':
+				if t >= len(textRunes) {
+					return false
+				}
+
+			case '\\':
+				if p+1 < len(patternRunes) {
+					p++
+				}
+				fallthrough
+
+			default:
+				if t >= len(textRunes) || textRunes[t] != patternRunes[p] {
+					return false
+				}
+			}
+
+			t++
+			p++
+		}
+
+		return t == len(textRunes)
+	}
+
+	return match(0, 0)
+}
@@ -0,0 +1,235 @@
+package database
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"time"
+)
+
+func (s *fileStore) GetPlayerData(ctx context.Context, profileId uint32, gameName string, ptype int, dindex int) ([]byte, time.Time, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, ok := s.data.PlayerData[filePlayerDataKey{profileId, gameName, ptype, dindex}]
+	if !ok {
+		return nil, time.Time{}, ErrNotFound
+	}
+
+	return slices.Clone(record.Data), record.Modified, nil
+}
+
+func (s *fileStore) SetPlayerData(ctx context.Context, profileId uint32, gameName string, ptype int, dindex int, data []byte, modified time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.data.PlayerData[filePlayerDataKey{profileId, gameName, ptype, dindex}] = PlayerDataRecord{
+		GameName: gameName,
+		PType:    ptype,
+		DIndex:   dindex,
+		Data:     slices.Clone(data),
+		Modified: modified,
+	}
+	s.changed()
+	return nil
+}
+
+func (s *fileStore) SetGamestatsScore(ctx context.Context, profileId uint32, gameName string, board string, ascending bool, score int64, recorded time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := fileScoreKey{profileId, gameName, board}
+	if best, ok := s.data.Scores[key]; ok && (score == best.Score || (score > best.Score) == ascending) {
+		return nil
+	}
+
+	s.data.Scores[key] = ScoreRecord{GameName: gameName, Board: board, Score: score, Recorded: recorded}
+	s.changed()
+	return nil
+}
+
+// rankedScores returns the profiles with a score on the leaderboard, best first. Ties go to whoever
+// got the score first.
+func (s *fileStore) rankedScores(gameName string, board string, ascending bool) []fileScoreKey {
+	var keys []fileScoreKey
+	for key := range s.data.Scores {
+		if key.GameName == gameName && key.Board == board {
+			keys = append(keys, key)
+		}
+	}
+
+	slices.SortFunc(keys, func(a, b fileScoreKey) int {
+		scoreA, scoreB := s.data.Scores[a], s.data.Scores[b]
+		byScore := cmp.Compare(scoreB.Score, scoreA.Score)
+		if ascending {
+			byScore = -byScore
+		}
+		return compareKeys(byScore, scoreA.Recorded.Compare(scoreB.Recorded), cmp.Compare(a.ProfileID, b.ProfileID))
+	})
+
+	return keys
+}
+
+func (s *fileStore) GetLeaderboard(ctx context.Context, gameName string, board string, ascending bool, offset int, limit int) ([]LeaderboardEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries := []LeaderboardEntry{}
+	for _, key := range page(s.rankedScores(gameName, board, ascending), offset, limit) {
+		score := s.data.Scores[key]
+		entry := LeaderboardEntry{Rank: offset + len(entries) + 1, ProfileID: key.ProfileID, Score: score.Score, Recorded: score.Recorded}
+		if record := s.data.Users[key.ProfileID]; record != nil {
+			entry.Name = record.LastInGameName
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (s *fileStore) GetLeaderboardRank(ctx context.Context, gameName string, board string, ascending bool, profileId uint32) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	rank := slices.Index(s.rankedScores(gameName, board, ascending), fileScoreKey{profileId, gameName, board})
+	if rank == -1 {
+		return 0, ErrNotFound
+	}
+
+	return rank + 1, nil
+}
+
+func (s *fileStore) RecordNATReport(ctx context.Context, profileId uint32, natType byte, mappingScheme byte, success bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := fileNATStatsKey{profileId, natType, mappingScheme}
+	stats := s.data.NATStats[key]
+	stats.NATType = natType
+	stats.MappingScheme = mappingScheme
+	if success {
+		stats.Successes++
+	} else {
+		stats.Failures++
+	}
+	stats.Updated = time.Now()
+
+	s.data.NATStats[key] = stats
+	s.changed()
+	return nil
+}
+
+func (s *fileStore) GetNATStats(ctx context.Context) ([]NATTypeStats, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	byType := map[byte]*NATTypeStats{}
+	stats := []NATTypeStats{}
+	for key, record := range s.data.NATStats {
+		if byType[key.NATType] == nil {
+			byType[key.NATType] = &NATTypeStats{NATType: key.NATType}
+		}
+		byType[key.NATType].Successes += record.Successes
+		byType[key.NATType].Failures += record.Failures
+	}
+
+	for _, stat := range byType {
+		stats = append(stats, *stat)
+	}
+	slices.SortFunc(stats, func(a, b NATTypeStats) int {
+		return cmp.Compare(a.NATType, b.NATType)
+	})
+
+	return stats, nil
+}
+
+func (s *fileStore) InsertConnection(ctx context.Context, record ConnectionRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record.Opened = record.Opened.UTC()
+	s.data.Connections = append(s.data.Connections, record)
+	s.changed()
+	return nil
+}
+
+// addTraffic adds a connection to the entry of its day
+func addTraffic(entries map[fileTrafficKey]TrafficEntry, record ConnectionRecord) fileTrafficKey {
+	key := fileTrafficKey{record.Opened.UTC().Format(time.DateOnly), record.ProfileID, record.IPAddress, record.Server}
+	entry := entries[key]
+	entry.Day, entry.ProfileID, entry.IPAddress, entry.Server = key.Day, key.ProfileID, key.IPAddress, key.Server
+	entry.Connections++
+	entry.DurationMs += record.Duration.Milliseconds()
+	entry.BytesIn += int64(record.BytesIn)
+	entry.BytesOut += int64(record.BytesOut)
+	entry.PacketsIn += int64(record.PacketsIn)
+	entry.PacketsOut += int64(record.PacketsOut)
+	entries[key] = entry
+	return key
+}
+
+func (s *fileStore) RollupTraffic(ctx context.Context, cutoff time.Time, retentionCutoff time.Time) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	updated := map[fileTrafficKey]bool{}
+	s.data.Connections = slices.DeleteFunc(s.data.Connections, func(record ConnectionRecord) bool {
+		if !record.Opened.Before(cutoff) {
+			return false
+		}
+
+		updated[addTraffic(s.data.Traffic, record)] = true
+		return true
+	})
+
+	if !retentionCutoff.IsZero() {
+		deleteFunc(s.data.Traffic, func(key fileTrafficKey, _ TrafficEntry) bool {
+			day, _ := time.Parse(time.DateOnly, key.Day)
+			return day.Before(retentionCutoff)
+		})
+	}
+
+	s.changed()
+	return int64(len(updated)), nil
+}
+
+// traffic totals the daily traffic and the connections not rolled up yet the same way as
+// GetTrafficQuery. A negative limit returns every entry.
+func (s *fileStore) traffic(filter TrafficFilter) []TrafficEntry {
+	from := filter.From.UTC().Format(time.DateOnly)
+	to := filter.To.UTC().Format(time.DateOnly)
+	matches := func(key fileTrafficKey) bool {
+		return (filter.ProfileID == 0 || key.ProfileID == filter.ProfileID) && (filter.IPAddress == "" || key.IPAddress == filter.IPAddress) && key.Day >= from && key.Day <= to
+	}
+
+	totals := map[fileTrafficKey]TrafficEntry{}
+	for key, entry := range s.data.Traffic {
+		if matches(key) {
+			totals[key] = entry
+		}
+	}
+
+	for _, record := range s.data.Connections {
+		key := fileTrafficKey{record.Opened.UTC().Format(time.DateOnly), record.ProfileID, record.IPAddress, record.Server}
+		if matches(key) {
+			addTraffic(totals, record)
+		}
+	}
+
+	entries := []TrafficEntry{}
+	for _, entry := range totals {
+		entries = append(entries, entry)
+	}
+	slices.SortFunc(entries, func(a, b TrafficEntry) int {
+		return compareKeys(cmp.Compare(a.Day, b.Day), cmp.Compare(a.ProfileID, b.ProfileID), cmp.Compare(a.IPAddress, b.IPAddress), cmp.Compare(a.Server, b.Server))
+	})
+
+	return page(entries, 0, filter.Limit)
+}
+
+func (s *fileStore) GetTraffic(ctx context.Context, filter TrafficFilter) ([]TrafficEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.traffic(filter), nil
+}
@@ -0,0 +1,122 @@
+package database
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileStoreReload(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "database.gob")
+
+	store, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := store.LoginUserToGPCM(ctx, 1, "RMCJ", 100, 0, "127.0.0.1", "Mario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	store.SetGamestatsScore(ctx, user.ProfileId, "mariokartwii", "tt_00", true, 90000, recorded)
+	// Not an improvement on a board where lower is better
+	store.SetGamestatsScore(ctx, user.ProfileId, "mariokartwii", "tt_00", true, 95000, recorded.Add(time.Hour))
+	store.Close()
+
+	store, err = openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if profile, ok := store.GetProfile(ctx, 100); !ok || profile.UserId != 1 || profile.GsbrCode != "RMCJ" {
+		t.Errorf("got profile %+v %v after reloading", profile, ok)
+	}
+
+	entries, err := store.GetLeaderboard(ctx, "mariokartwii", "tt_00", true, 0, 10)
+	expected := []LeaderboardEntry{{Rank: 1, ProfileID: 100, Name: "Mario", Score: 90000, Recorded: recorded}}
+	if err != nil || !reflect.DeepEqual(entries, expected) {
+		t.Errorf("got leaderboard %+v %v, expected %+v", entries, err, expected)
+	}
+
+	if _, err := store.GetLeaderboardRank(ctx, "mariokartwii", "tt_00", true, 200); err != ErrNotFound {
+		t.Errorf("got error %v for a profile without a score", err)
+	}
+}
+
+func TestFileStoreShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.gob")
+
+	first, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first != second {
+		t.Error("opening the same file twice gave two stores")
+	}
+
+	first.Close()
+	second.Close()
+}
+
+func TestMatchLike(t *testing.T) {
+	tests := []struct {
+		text    string
+		pattern string
+		matches bool
+	}{
+		{"Mario", "Mario", true},
+		{"Mario", "M%", true},
+		{"Mario", "%io", true},
+		{"Mario", "M_rio", true},
+		{"Mario", "M_io", false},
+		{"Mario", "mario", false},
+		{"100%", "100\\%", true},
+		{"1000", "100\\%", false},
+		{"", "%", true},
+	}
+
+	for _, test := range tests {
+		if matches := matchLike(test.text, test.pattern); matches != test.matches {
+			t.Errorf("%q LIKE %q: got %v", test.text, test.pattern, matches)
+		}
+	}
+}
+
+func TestSakeSearchSQL(t *testing.T) {
+	search := SakeSearch{
+		Table:     "records",
+		Columns:   []string{"record_id", "score"},
+		Condition: SakeAll(SakeCompare{"score", ">", int64(100)}, SakeNot{SakeIn{"owner_id", []int32{1, 2}}}),
+		Order:     []SakeOrder{{Column: "score", Descending: true}, {Column: "record_id"}},
+		Limit:     10,
+		Offset:    20,
+	}
+
+	query, args := sakeSearchSQL(search)
+	expected := "SELECT record_id, score FROM records WHERE (score > $1 AND (NOT owner_id = ANY($2))) ORDER BY score DESC, record_id ASC LIMIT $3 OFFSET $4"
+	if query != expected || !reflect.DeepEqual(args, []any{int64(100), []int32{1, 2}, 10, 20}) {
+		t.Errorf("got %q %v", query, args)
+	}
+
+	search.Condition = nil
+	search.Columns = []string{"score", "score"}
+	search.Surrounding = &SakeSurrounding{OwnerColumn: "owner_id", Owners: []int32{3}, Count: 1}
+	query, args = sakeSearchSQL(search)
+	expected = "WITH ranked AS (SELECT score AS column1, score AS column2, owner_id AS sake_owner, row_number() OVER (ORDER BY score DESC, record_id ASC) AS sake_rank FROM records WHERE TRUE)" +
+		" SELECT column1, column2 FROM ranked" +
+		" WHERE sake_rank BETWEEN (SELECT min(sake_rank) FROM ranked WHERE sake_owner = ANY($1)) - $2 AND (SELECT max(sake_rank) FROM ranked WHERE sake_owner = ANY($1)) + $2" +
+		" ORDER BY sake_rank LIMIT $3"
+	if query != expected || !reflect.DeepEqual(args, []any{[]int32{3}, 1, 10}) {
+		t.Errorf("got %q %v", query, args)
+	}
+}
@@ -0,0 +1,29 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	GetPlayerDataQuery = `SELECT data, modified FROM gamestats_player_data WHERE profile_id = $1 AND game_name = $2 AND ptype = $3 AND dindex = $4`
+	SetPlayerDataQuery = `INSERT INTO gamestats_player_data (profile_id, game_name, ptype, dindex, data, modified)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (profile_id, game_name, ptype, dindex) DO UPDATE
+	SET data = EXCLUDED.data, modified = EXCLUDED.modified`
+)
+
+// GetPlayerData returns a profile's gamestats persistent data and when it was last modified,
+// or pgx.ErrNoRows if the game never stored any at that index
+func (s *postgresStore) GetPlayerData(ctx context.Context, profileId uint32, gameName string, ptype int, dindex int) ([]byte, time.Time, error) {
+	var data []byte
+	var modified time.Time
+	err := s.pool.QueryRow(ctx, GetPlayerDataQuery, int64(profileId), gameName, ptype, dindex).Scan(&data, &modified)
+	return data, modified, err
+}
+
+// SetPlayerData replaces a profile's gamestats persistent data
+func (s *postgresStore) SetPlayerData(ctx context.Context, profileId uint32, gameName string, ptype int, dindex int, data []byte, modified time.Time) error {
+	_, err := s.pool.Exec(ctx, SetPlayerDataQuery, int64(profileId), gameName, ptype, dindex, data, modified)
+	return err
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// Only a better score replaces the one kept, an equal one keeps the time it was first recorded
+	SetGamestatsScoreAscending = `INSERT INTO gamestats_scores (profile_id, game_name, board, score, recorded)
+	VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (profile_id, game_name, board) DO UPDATE
+	SET score = LEAST(gamestats_scores.score, EXCLUDED.score), recorded = EXCLUDED.recorded
+	WHERE EXCLUDED.score < gamestats_scores.score`
+	SetGamestatsScoreDescending = `INSERT INTO gamestats_scores (profile_id, game_name, board, score, recorded)
+	VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (profile_id, game_name, board) DO UPDATE
+	SET score = GREATEST(gamestats_scores.score, EXCLUDED.score), recorded = EXCLUDED.recorded
+	WHERE EXCLUDED.score > gamestats_scores.score`
+	GetGamestatsScoreQuery = `SELECT score, recorded FROM gamestats_scores WHERE profile_id = $1 AND game_name = $2 AND board = $3`
+
+	// Ties go to whoever got the score first
+	GetLeaderboardAscending = `SELECT s.profile_id, COALESCE(u.last_ingamesn, ''), s.score, s.recorded FROM gamestats_scores s
+	LEFT JOIN users u ON u.profile_id = s.profile_id
+	WHERE s.game_name = $1 AND s.board = $2 ORDER BY s.score, s.recorded, s.profile_id LIMIT $3 OFFSET $4`
+	GetLeaderboardDescending = `SELECT s.profile_id, COALESCE(u.last_ingamesn, ''), s.score, s.recorded FROM gamestats_scores s
+	LEFT JOIN users u ON u.profile_id = s.profile_id
+	WHERE s.game_name = $1 AND s.board = $2 ORDER BY s.score DESC, s.recorded, s.profile_id LIMIT $3 OFFSET $4`
+	CountScoresAheadAscending = `SELECT count(*) FROM gamestats_scores WHERE game_name = $1 AND board = $2
+	AND (score < $3 OR (score = $3 AND (recorded < $4 OR (recorded = $4 AND profile_id < $5))))`
+	CountScoresAheadDescending = `SELECT count(*) FROM gamestats_scores WHERE game_name = $1 AND board = $2
+	AND (score > $3 OR (score = $3 AND (recorded < $4 OR (recorded = $4 AND profile_id < $5))))`
+)
+
+type LeaderboardEntry struct {
+	Rank      int       `json:"rank"`
+	ProfileID uint32    `json:"profile_id"`
+	Name      string    `json:"name"`
+	Score     int64     `json:"score"`
+	Recorded  time.Time `json:"timestamp"`
+}
+
+// SetGamestatsScore records a profile's score on a leaderboard, if it beats the profile's best.
+// Lower scores are better if ascending is set.
+func (s *postgresStore) SetGamestatsScore(ctx context.Context, profileId uint32, gameName string, board string, ascending bool, score int64, recorded time.Time) error {
+	query := SetGamestatsScoreDescending
+	if ascending {
+		query = SetGamestatsScoreAscending
+	}
+
+	_, err := s.pool.Exec(ctx, query, int64(profileId), gameName, board, score, recorded)
+	return err
+}
+
+// GetLeaderboard returns one page of a leaderboard, best score first. Lower scores are better
+// if ascending is set.
+func (s *postgresStore) GetLeaderboard(ctx context.Context, gameName string, board string, ascending bool, offset int, limit int) ([]LeaderboardEntry, error) {
+	query := GetLeaderboardDescending
+	if ascending {
+		query = GetLeaderboardAscending
+	}
+
+	rows, err := s.pool.Query(ctx, query, gameName, board, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []LeaderboardEntry{}
+	for rows.Next() {
+		entry := LeaderboardEntry{Rank: offset + len(entries) + 1}
+		var profileId int64
+		if err := rows.Scan(&profileId, &entry.Name, &entry.Score, &entry.Recorded); err != nil {
+			return nil, err
+		}
+
+		entry.ProfileID = uint32(profileId)
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// GetLeaderboardRank returns the profile's rank on a leaderboard, starting at 1, or pgx.ErrNoRows
+// if it has no score there
+func (s *postgresStore) GetLeaderboardRank(ctx context.Context, gameName string, board string, ascending bool, profileId uint32) (int, error) {
+	var score int64
+	var recorded time.Time
+	err := s.pool.QueryRow(ctx, GetGamestatsScoreQuery, int64(profileId), gameName, board).Scan(&score, &recorded)
+	if err != nil {
+		return 0, err
+	}
+
+	query := CountScoresAheadDescending
+	if ascending {
+		query = CountScoresAheadAscending
+	}
+
+	var ahead int
+	err = s.pool.QueryRow(ctx, query, gameName, board, score, recorded, int64(profileId)).Scan(&ahead)
+	return ahead + 1, err
+}
@@ -4,12 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"time"
 	"wwfc/common"
 	"wwfc/logging"
 
-	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/logrusorgru/aurora/v3"
 )
 
@@ -18,9 +15,9 @@ var (
 	ErrProfileBannedTOS = errors.New("profile is banned for violating the Terms of Service")
 )
 
-func LoginUserToGPCM(pool *pgxpool.Pool, ctx context.Context, userId uint64, gsbrcd string, profileId uint32, ngDeviceId uint32, ipAddress string, ingamesn string) (User, error) {
+func (s *postgresStore) LoginUserToGPCM(ctx context.Context, userId uint64, gsbrcd string, profileId uint32, ngDeviceId uint32, ipAddress string, ingamesn string) (User, error) {
 	var exists bool
-	err := pool.QueryRow(ctx, DoesUserExist, userId, gsbrcd).Scan(&exists)
+	err := s.pool.QueryRow(ctx, DoesUserExist, userId, gsbrcd).Scan(&exists)
 	if err != nil {
 		return User{}, err
 	}
@@ -37,7 +34,7 @@ func LoginUserToGPCM(pool *pgxpool.Pool, ctx context.Context, userId uint64, gsb
 		user.Email = user.UniqueNick + "@nds"
 
 		// Create the GPCM account
-		err := user.CreateUser(pool, ctx)
+		err := s.createUser(ctx, &user)
 		if err != nil {
 			logging.Error("DATABASE", "Error creating user:", aurora.Cyan(userId), aurora.Cyan(gsbrcd), aurora.Cyan(user.ProfileId), "\nerror:", err.Error())
 			return User{}, err
@@ -46,20 +43,13 @@ func LoginUserToGPCM(pool *pgxpool.Pool, ctx context.Context, userId uint64, gsb
 		logging.Notice("DATABASE", "Created new GPCM user:", aurora.Cyan(userId), aurora.Cyan(gsbrcd), aurora.Cyan(user.ProfileId))
 	} else {
 		var expectedNgId *uint32
-		var firstName *string
-		var lastName *string
-		err := pool.QueryRow(ctx, GetUserProfileID, userId, gsbrcd).Scan(&user.ProfileId, &expectedNgId, &user.Email, &user.UniqueNick, &firstName, &lastName, &user.OpenHost)
+		var firstName, lastName, zipCode, countryCode, location *string
+		err := s.pool.QueryRow(ctx, GetUserProfileID, userId, gsbrcd).Scan(&user.ProfileId, &expectedNgId, &user.Email, &user.UniqueNick, &firstName, &lastName, &user.OpenHost, &zipCode, &countryCode, &location)
 		if err != nil {
 			return User{}, err
 		}
 
-		if firstName != nil {
-			user.FirstName = *firstName
-		}
-
-		if lastName != nil {
-			user.LastName = *lastName
-		}
+		user.setOptionalFields(firstName, lastName, zipCode, countryCode, location)
 
 		if expectedNgId != nil && *expectedNgId != 0 {
 			user.NgDeviceId = *expectedNgId
@@ -69,14 +59,14 @@ func LoginUserToGPCM(pool *pgxpool.Pool, ctx context.Context, userId uint64, gsb
 			}
 		} else if ngDeviceId != 0 {
 			user.NgDeviceId = ngDeviceId
-			_, err := pool.Exec(ctx, UpdateUserNGDeviceID, user.ProfileId, ngDeviceId)
+			_, err := s.pool.Exec(ctx, UpdateUserNGDeviceID, user.ProfileId, ngDeviceId)
 			if err != nil {
 				return User{}, err
 			}
 		}
 
 		if profileId != 0 && user.ProfileId != profileId {
-			err := user.UpdateProfileID(pool, ctx, profileId)
+			err := s.updateProfileID(ctx, &user, profileId)
 			if err != nil {
 				logging.Warn("DATABASE", "Could not update", aurora.Cyan(userId), aurora.Cyan(gsbrcd), "profile ID from", aurora.Cyan(user.ProfileId), "to", aurora.Cyan(profileId))
 			} else {
@@ -89,44 +79,30 @@ func LoginUserToGPCM(pool *pgxpool.Pool, ctx context.Context, userId uint64, gsb
 
 	// This should be set if the user already knows its own profile ID
 	if profileId != 0 && user.LastName == "" {
-		user.UpdateProfile(pool, ctx, map[string]string{
+		user.UpdateProfile(s, ctx, map[string]string{
 			"lastname": "000000000" + gsbrcd,
 		})
 	}
 
 	// Update the user's last IP address and ingamesn
-	_, err = pool.Exec(ctx, UpdateUserLastIPAddress, user.ProfileId, ipAddress, ingamesn)
+	_, err = s.pool.Exec(ctx, UpdateUserLastIPAddress, user.ProfileId, ipAddress, ingamesn)
 	if err != nil {
 		return User{}, err
 	}
 
 	// Find ban from device ID or IP address
-	var banExists bool
-	var banTOS bool
-	var bannedDeviceId uint32
-	timeNow := time.Now()
-	err = pool.QueryRow(ctx, SearchUserBan, user.ProfileId, user.NgDeviceId, ipAddress, timeNow).Scan(&banExists, &banTOS, &bannedDeviceId)
+	ban, err := s.findUserBan(ctx, user.ProfileId, user.NgDeviceId, ipAddress)
 	if err != nil {
-		if err != pgx.ErrNoRows {
-			return User{}, err
-		}
-
-		banExists = false
+		return User{}, err
 	}
 
-	if banExists {
-		if banTOS {
-			logging.Warn("DATABASE", "Profile", aurora.Cyan(user.ProfileId), "is banned")
-			return User{RestrictedDeviceId: bannedDeviceId}, ErrProfileBannedTOS
-		}
-
-		logging.Warn("DATABASE", "Profile", aurora.Cyan(user.ProfileId), "is restricted")
-		user.Restricted = true
-		user.RestrictedDeviceId = bannedDeviceId
+	user, err = applyLoginBan(user, ban)
+	if err != nil {
+		return user, err
 	}
 
 	var Trusted bool
-	err = pool.QueryRow(ctx, DoesUserExistTrusted, user.ProfileId).Scan(&Trusted)
+	err = s.pool.QueryRow(ctx, DoesUserExistTrusted, user.ProfileId).Scan(&Trusted)
 	if err != nil {
 		return User{}, err // Handle error
 	}
@@ -138,26 +114,41 @@ func LoginUserToGPCM(pool *pgxpool.Pool, ctx context.Context, userId uint64, gsb
 	return user, nil
 }
 
-func LoginUserToGameStats(pool *pgxpool.Pool, ctx context.Context, userId uint64, gsbrcd string) (User, error) {
+func (s *postgresStore) LoginUserToGameStats(ctx context.Context, userId uint64, gsbrcd string) (User, error) {
 	user := User{
 		UserId:   userId,
 		GsbrCode: gsbrcd,
 	}
 
 	var expectedNgId *uint32
-	var firstName *string
-	var lastName *string
-	err := pool.QueryRow(ctx, GetUserProfileID, userId, gsbrcd).Scan(&user.ProfileId, &expectedNgId, &user.Email, &user.UniqueNick, &firstName, &lastName, &user.OpenHost)
+	var firstName, lastName, zipCode, countryCode, location *string
+	err := s.pool.QueryRow(ctx, GetUserProfileID, userId, gsbrcd).Scan(&user.ProfileId, &expectedNgId, &user.Email, &user.UniqueNick, &firstName, &lastName, &user.OpenHost, &zipCode, &countryCode, &location)
 	if err != nil {
 		return User{}, err
 	}
 
-	if firstName != nil {
-		user.FirstName = *firstName
-	}
+	user.setOptionalFields(firstName, lastName, zipCode, countryCode, location)
+
+	return user, nil
+}
+
+// applyLoginBan applies the ban found when the user logged in to GPCM. A ban that keeps it from
+// logging in returns ErrProfileBannedTOS, with the user holding only the ban.
+func applyLoginBan(user User, ban *common.BanInfo) (User, error) {
+	switch ban.Presentation() {
+	case common.BanPresentationPermanent, common.BanPresentationSuspended:
+		logging.Warn("DATABASE", "Profile", aurora.Cyan(user.ProfileId), "is banned")
+		return User{RestrictedDeviceId: ban.DeviceID, Ban: ban}, ErrProfileBannedTOS
+
+	case common.BanPresentationRestricted:
+		logging.Warn("DATABASE", "Profile", aurora.Cyan(user.ProfileId), "is restricted")
+		user.Restricted = true
+		user.RestrictedDeviceId = ban.DeviceID
 
-	if lastName != nil {
-		user.LastName = *lastName
+	case common.BanPresentationShadow:
+		// The player isn't told, so the device ID isn't shown anywhere
+		logging.Warn("DATABASE", "Profile", aurora.Cyan(user.ProfileId), "is shadow banned")
+		user.ShadowBanned = true
 	}
 
 	return user, nil
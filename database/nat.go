@@ -0,0 +1,53 @@
+package database
+
+import (
+	"context"
+)
+
+const (
+	InsertNATReport = `INSERT INTO nat_stats (profile_id, nat_type, mapping_scheme, successes, failures, updated)
+	VALUES ($1, $2, $3, $4, $5, now())
+	ON CONFLICT (profile_id, nat_type, mapping_scheme) DO UPDATE
+	SET successes = nat_stats.successes + EXCLUDED.successes, failures = nat_stats.failures + EXCLUDED.failures, updated = now()`
+	GetNATTypeStats = `SELECT nat_type, sum(successes), sum(failures) FROM nat_stats GROUP BY nat_type ORDER BY nat_type`
+)
+
+type NATTypeStats struct {
+	NATType   byte  `json:"nat_type"`
+	Successes int64 `json:"successes"`
+	Failures  int64 `json:"failures"`
+}
+
+// RecordNATReport adds a NATNEG outcome reported by a client to the profile's NAT statistics
+func (s *postgresStore) RecordNATReport(ctx context.Context, profileId uint32, natType byte, mappingScheme byte, success bool) error {
+	successes, failures := 0, 1
+	if success {
+		successes, failures = 1, 0
+	}
+
+	_, err := s.pool.Exec(ctx, InsertNATReport, profileId, natType, mappingScheme, successes, failures)
+	return err
+}
+
+// GetNATStats returns the NATNEG outcomes of every profile totalled by NAT type
+func (s *postgresStore) GetNATStats(ctx context.Context) ([]NATTypeStats, error) {
+	rows, err := s.pool.Query(ctx, GetNATTypeStats)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []NATTypeStats{}
+	for rows.Next() {
+		var natType int16
+		var stat NATTypeStats
+		if err := rows.Scan(&natType, &stat.Successes, &stat.Failures); err != nil {
+			return nil, err
+		}
+
+		stat.NATType = byte(natType)
+		stats = append(stats, stat)
+	}
+
+	return stats, rows.Err()
+}
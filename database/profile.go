@@ -0,0 +1,253 @@
+package database
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	ExportProfileUser = `SELECT user_id, gsbrcd, coalesce(ng_device_id, 0), email, unique_nick, coalesce(firstname, ''), coalesce(lastname, ''), coalesce(zipcode, ''), coalesce(countrycode, ''), coalesce(location, ''), coalesce(mariokartwii_friend_info, ''), coalesce(last_ip_address, ''), coalesce(last_ingamesn, ''), coalesce(open_host, false),
+	coalesce(has_ban, false), ban_issued, ban_expires, coalesce(ban_reason, ''), coalesce(ban_reason_hidden, ''), coalesce(ban_moderator, ''), coalesce(ban_tos, false), coalesce(ban_shadow, false), deleted
+	FROM users WHERE profile_id = $1`
+	ExportProfileAllowlisted = `SELECT EXISTS(SELECT 1 FROM allowlist WHERE profile_id = $1 AND profile_id <> 0)`
+	ExportProfileSakeFiles   = `SELECT file_id, game_id, size, coalesce(created, 'epoch') FROM sake_files WHERE profile_id = $1 ORDER BY file_id`
+	ExportProfilePlayerData  = `SELECT game_name, ptype, dindex, data, modified FROM gamestats_player_data WHERE profile_id = $1 ORDER BY game_name, ptype, dindex`
+	ExportProfileScores      = `SELECT game_name, board, score, recorded FROM gamestats_scores WHERE profile_id = $1 ORDER BY game_name, board`
+	ExportProfileNATStats    = `SELECT nat_type, mapping_scheme, coalesce(successes, 0), coalesce(failures, 0), coalesce(updated, 'epoch') FROM nat_stats WHERE profile_id = $1 ORDER BY nat_type, mapping_scheme`
+
+	// The row is kept with the profile ID so the friend code can't be registered again. It no
+	// longer matches any console, which gets a new profile the next time it logs in. An active
+	// ban is kept with the device ID it applies to, so deleting a profile doesn't lift it.
+	AnonymizeProfileUser = `UPDATE users SET user_id = 0, gsbrcd = '', password = '', email = '', unique_nick = '',
+	firstname = NULL, lastname = NULL, zipcode = NULL, countrycode = NULL, location = NULL, mariokartwii_friend_info = NULL,
+	last_ip_address = '', last_ingamesn = '', open_host = false,
+	ng_device_id = CASE WHEN coalesce(has_ban, false) THEN ng_device_id END,
+	ban_issued = CASE WHEN coalesce(has_ban, false) THEN ban_issued END,
+	ban_expires = CASE WHEN coalesce(has_ban, false) THEN ban_expires END,
+	ban_reason = CASE WHEN coalesce(has_ban, false) THEN ban_reason END,
+	ban_reason_hidden = CASE WHEN coalesce(has_ban, false) THEN ban_reason_hidden END,
+	ban_moderator = CASE WHEN coalesce(has_ban, false) THEN ban_moderator END,
+	ban_tos = CASE WHEN coalesce(has_ban, false) THEN ban_tos END,
+	ban_shadow = CASE WHEN coalesce(has_ban, false) THEN ban_shadow ELSE false END,
+	deleted = coalesce(deleted, now())
+	WHERE profile_id = $1`
+)
+
+// Tables holding rows of a deleted profile, the SAKE files themselves are removed from disk by
+// SAKE's cleanup once their records are gone
+var profileDataTables = []string{
+	"sake_files",
+	"gamestats_player_data",
+	"gamestats_scores",
+	"nat_stats",
+	"connection_log",
+	"connection_stats_daily",
+	"allowlist",
+	"trusted",
+}
+
+type ProfileBan struct {
+	Issued       *time.Time `json:"issued"`
+	Expires      *time.Time `json:"expires"`
+	Reason       string     `json:"reason"`
+	ReasonHidden string     `json:"reason_hidden"`
+	Moderator    string     `json:"moderator"`
+	TOS          bool       `json:"tos"`
+	Shadow       bool       `json:"shadow"`
+}
+
+// ProfileRecord is everything the users table holds about a profile
+type ProfileRecord struct {
+	ProfileID      uint32      `json:"profile_id"`
+	UserID         uint64      `json:"user_id"`
+	GsbrCode       string      `json:"gsbrcd"`
+	NgDeviceID     uint32      `json:"ng_device_id"`
+	Email          string      `json:"email"`
+	UniqueNick     string      `json:"unique_nick"`
+	FirstName      string      `json:"firstname"`
+	LastName       string      `json:"lastname"`
+	ZipCode        string      `json:"zipcode"`
+	CountryCode    string      `json:"countrycode"`
+	Location       string      `json:"location"`
+	MKWFriendInfo  string      `json:"mariokartwii_friend_info"`
+	LastIPAddress  string      `json:"last_ip_address"`
+	LastInGameName string      `json:"last_ingamesn"`
+	OpenHost       bool        `json:"open_host"`
+	Ban            *ProfileBan `json:"ban,omitempty"`
+	// Set once the profile was deleted
+	Deleted *time.Time `json:"deleted,omitempty"`
+}
+
+type PlayerDataRecord struct {
+	GameName string    `json:"game_name"`
+	PType    int       `json:"ptype"`
+	DIndex   int       `json:"dindex"`
+	Data     []byte    `json:"data"`
+	Modified time.Time `json:"modified"`
+}
+
+type ScoreRecord struct {
+	GameName string    `json:"game_name"`
+	Board    string    `json:"board"`
+	Score    int64     `json:"score"`
+	Recorded time.Time `json:"recorded"`
+}
+
+type NATStatsRecord struct {
+	NATType       byte      `json:"nat_type"`
+	MappingScheme byte      `json:"mapping_scheme"`
+	Successes     int64     `json:"successes"`
+	Failures      int64     `json:"failures"`
+	Updated       time.Time `json:"updated"`
+}
+
+// ProfileExport is everything stored about a profile. Player data is base64 encoded in JSON.
+type ProfileExport struct {
+	Profile     ProfileRecord      `json:"profile"`
+	Trusted     bool               `json:"trusted"`
+	Allowlisted bool               `json:"allowlisted"`
+	SakeFiles   []SakeFile         `json:"sake_files"`
+	PlayerData  []PlayerDataRecord `json:"gamestats_player_data"`
+	Scores      []ScoreRecord      `json:"gamestats_scores"`
+	NATStats    []NATStatsRecord   `json:"nat_stats"`
+	Traffic     []TrafficEntry     `json:"traffic"`
+}
+
+// ExportProfile returns everything stored about the profile as of one point in time, or
+// pgx.ErrNoRows if it doesn't exist
+func (s *postgresStore) ExportProfile(ctx context.Context, profileId uint32) (ProfileExport, error) {
+	export := ProfileExport{
+		SakeFiles:  []SakeFile{},
+		PlayerData: []PlayerDataRecord{},
+		Scores:     []ScoreRecord{},
+		NATStats:   []NATStatsRecord{},
+		Traffic:    []TrafficEntry{},
+	}
+
+	err := s.pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+		profile := &export.Profile
+		profile.ProfileID = profileId
+
+		var userId, deviceId int64
+		var hasBan bool
+		var ban ProfileBan
+		err := tx.QueryRow(ctx, ExportProfileUser, int64(profileId)).Scan(&userId, &profile.GsbrCode, &deviceId, &profile.Email, &profile.UniqueNick, &profile.FirstName, &profile.LastName, &profile.ZipCode, &profile.CountryCode, &profile.Location, &profile.MKWFriendInfo, &profile.LastIPAddress, &profile.LastInGameName, &profile.OpenHost,
+			&hasBan, &ban.Issued, &ban.Expires, &ban.Reason, &ban.ReasonHidden, &ban.Moderator, &ban.TOS, &ban.Shadow, &profile.Deleted)
+		if err != nil {
+			return err
+		}
+		profile.UserID = uint64(userId)
+		profile.NgDeviceID = uint32(deviceId)
+		if hasBan {
+			profile.Ban = &ban
+		}
+
+		if err := tx.QueryRow(ctx, DoesUserExistTrusted, int64(profileId)).Scan(&export.Trusted); err != nil {
+			return err
+		}
+		if err := tx.QueryRow(ctx, ExportProfileAllowlisted, int64(profileId)).Scan(&export.Allowlisted); err != nil {
+			return err
+		}
+
+		err = queryProfileRows(tx, ctx, ExportProfileSakeFiles, profileId, func(rows pgx.Rows) error {
+			file := SakeFile{ProfileID: profileId}
+			err := rows.Scan(&file.FileID, &file.GameID, &file.Size, &file.Created)
+			export.SakeFiles = append(export.SakeFiles, file)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = queryProfileRows(tx, ctx, ExportProfilePlayerData, profileId, func(rows pgx.Rows) error {
+			var record PlayerDataRecord
+			err := rows.Scan(&record.GameName, &record.PType, &record.DIndex, &record.Data, &record.Modified)
+			export.PlayerData = append(export.PlayerData, record)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = queryProfileRows(tx, ctx, ExportProfileScores, profileId, func(rows pgx.Rows) error {
+			var record ScoreRecord
+			err := rows.Scan(&record.GameName, &record.Board, &record.Score, &record.Recorded)
+			export.Scores = append(export.Scores, record)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = queryProfileRows(tx, ctx, ExportProfileNATStats, profileId, func(rows pgx.Rows) error {
+			var natType, mappingScheme int16
+			var record NATStatsRecord
+			err := rows.Scan(&natType, &mappingScheme, &record.Successes, &record.Failures, &record.Updated)
+			record.NATType = byte(natType)
+			record.MappingScheme = byte(mappingScheme)
+			export.NATStats = append(export.NATStats, record)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		// Every day still kept, both rolled up and not
+		rows, err := tx.Query(ctx, GetTrafficQuery, int64(profileId), "", time.Unix(0, 0).UTC(), time.Now().UTC().AddDate(0, 0, 1), math.MaxInt32)
+		if err != nil {
+			return err
+		}
+		export.Traffic, err = scanTraffic(rows)
+		return err
+	})
+
+	return export, err
+}
+
+// DeleteProfile removes everything stored about the profile in one transaction, leaving only the
+// anonymized users row. Returns the number of rows removed from each table, or pgx.ErrNoRows if
+// the profile doesn't exist.
+func (s *postgresStore) DeleteProfile(ctx context.Context, profileId uint32) (map[string]int64, error) {
+	removed := map[string]int64{}
+
+	err := s.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, AnonymizeProfileUser, int64(profileId))
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return pgx.ErrNoRows
+		}
+
+		for _, table := range profileDataTables {
+			tag, err := tx.Exec(ctx, "DELETE FROM "+table+" WHERE profile_id = $1", int64(profileId))
+			if err != nil {
+				return err
+			}
+			removed[table] = tag.RowsAffected()
+		}
+
+		return nil
+	})
+
+	return removed, err
+}
+
+func queryProfileRows(tx pgx.Tx, ctx context.Context, query string, profileId uint32, scan func(rows pgx.Rows) error) error {
+	rows, err := tx.Query(ctx, query, int64(profileId))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,107 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	// Holds the owner's row until the insert commits, so uploads by one profile are counted one at
+	// a time and can't all fit in the quota together
+	LockSakeFileOwner = `SELECT 1 FROM users WHERE profile_id = $1 FOR UPDATE`
+	// Only inserts if the profile stays within its quota, a limit of 0 disables that check
+	InsertSakeFile = `INSERT INTO sake_files (game_id, profile_id, size, created)
+	SELECT $1, $2, $3, now()
+	WHERE ($4 = 0 OR (SELECT count(*) FROM sake_files WHERE profile_id = $2) < $4)
+	AND ($5 = 0 OR (SELECT coalesce(sum(size), 0) FROM sake_files WHERE profile_id = $2) + $3 <= $5)
+	RETURNING file_id`
+	GetSakeFileQuery        = `SELECT game_id, profile_id, size, coalesce(created, 'epoch') FROM sake_files WHERE file_id = $1`
+	DeleteSakeFileQuery     = `DELETE FROM sake_files WHERE file_id = $1`
+	GetSakeFileIDs          = `SELECT file_id FROM sake_files`
+	DeleteOrphanedSakeFiles = `DELETE FROM sake_files f WHERE NOT EXISTS (SELECT 1 FROM users u WHERE u.profile_id = f.profile_id) RETURNING file_id`
+)
+
+var (
+	ErrSakeQuotaExceeded = errors.New("profile SAKE file quota exceeded")
+	ErrSakeUnknownOwner  = errors.New("SAKE file owner doesn't exist")
+)
+
+type SakeFile struct {
+	FileID    int32     `json:"file_id"`
+	GameID    int32     `json:"game_id"`
+	ProfileID uint32    `json:"profile_id"`
+	Size      int64     `json:"size"`
+	Created   time.Time `json:"created"`
+}
+
+// InsertSakeFileRecord records a new file and returns its ID, or ErrSakeQuotaExceeded if the
+// profile already has maxFiles files or the file would take it over maxBytes. The quota is checked
+// with the profile locked, so parallel uploads can't exceed it.
+func (s *postgresStore) InsertSakeFileRecord(ctx context.Context, gameId int, profileId uint32, size int64, maxFiles int, maxBytes int64) (int32, error) {
+	var fileId int32
+	err := s.pool.BeginTxFunc(ctx, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		var locked int
+		err := tx.QueryRow(ctx, LockSakeFileOwner, int64(profileId)).Scan(&locked)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrSakeUnknownOwner
+		}
+		if err != nil {
+			return err
+		}
+
+		err = tx.QueryRow(ctx, InsertSakeFile, gameId, int64(profileId), size, int64(maxFiles), maxBytes).Scan(&fileId)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrSakeQuotaExceeded
+		}
+		return err
+	})
+
+	return fileId, err
+}
+
+// GetSakeFile returns the file's record, or pgx.ErrNoRows if it doesn't exist
+func (s *postgresStore) GetSakeFile(ctx context.Context, fileId int32) (SakeFile, error) {
+	file := SakeFile{FileID: fileId}
+	var profileId int64
+	err := s.pool.QueryRow(ctx, GetSakeFileQuery, fileId).Scan(&file.GameID, &profileId, &file.Size, &file.Created)
+	file.ProfileID = uint32(profileId)
+	return file, err
+}
+
+func (s *postgresStore) DeleteSakeFile(ctx context.Context, fileId int32) error {
+	_, err := s.pool.Exec(ctx, DeleteSakeFileQuery, fileId)
+	return err
+}
+
+// GetAllSakeFileIDs returns the ID of every recorded file
+func (s *postgresStore) GetAllSakeFileIDs(ctx context.Context) (map[int32]bool, error) {
+	return s.querySakeFileIDs(ctx, GetSakeFileIDs)
+}
+
+// DeleteOrphanedSakeFileRecords removes the records of files whose owner's profile no longer
+// exists, and returns their IDs so the files can be deleted
+func (s *postgresStore) DeleteOrphanedSakeFileRecords(ctx context.Context) (map[int32]bool, error) {
+	return s.querySakeFileIDs(ctx, DeleteOrphanedSakeFiles)
+}
+
+func (s *postgresStore) querySakeFileIDs(ctx context.Context, query string) (map[int32]bool, error) {
+	rows, err := s.pool.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := map[int32]bool{}
+	for rows.Next() {
+		var fileId int32
+		if err := rows.Scan(&fileId); err != nil {
+			return nil, err
+		}
+		ids[fileId] = true
+	}
+
+	return ids, rows.Err()
+}
@@ -0,0 +1,200 @@
+package database
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// SakeCondition is a SAKE search filter, or a part of one, parsed into the columns of a table
+type SakeCondition interface {
+	// sql returns the condition in SQL, numbering its parameters after the existing args
+	sql(args []any) (string, []any)
+	// match evaluates the condition on a row, SQL style: a comparison with a missing value is
+	// unknown, and so is a NOT of an unknown
+	match(row sakeRow) sakeTruth
+}
+
+// SakeAnd matches the rows both conditions match
+type SakeAnd struct {
+	Left  SakeCondition
+	Right SakeCondition
+}
+
+// SakeOr matches the rows either condition matches
+type SakeOr struct {
+	Left  SakeCondition
+	Right SakeCondition
+}
+
+// SakeNot matches the rows the condition doesn't
+type SakeNot struct {
+	Inner SakeCondition
+}
+
+// SakeCompare compares a column to a value with =, <>, <, <=, >, >= or LIKE. Values are int64,
+// string or bool.
+type SakeCompare struct {
+	Column string
+	Op     string
+	Value  any
+}
+
+// SakeIn matches the rows with the column set to one of the values
+type SakeIn struct {
+	Column string
+	Values []int32
+}
+
+// SakeOrder is one column of a search's sort
+type SakeOrder struct {
+	Column     string
+	Descending bool
+}
+
+// SakeSurrounding asks for the records ranked around the ones owned by any of the owners, up to
+// Count either side of them. Used for leaderboards.
+type SakeSurrounding struct {
+	OwnerColumn string
+	Owners      []int32
+	Count       int
+}
+
+// SakeSearch is a SearchForRecords on one table. The columns are returned in order for each
+// record, the same column may be asked for more than once.
+type SakeSearch struct {
+	Table   string
+	Columns []string
+	// Nil matches every record
+	Condition   SakeCondition
+	Order       []SakeOrder
+	Surrounding *SakeSurrounding
+	Limit       int
+	Offset      int
+}
+
+// SakeAll ands the conditions, leaving out the nil ones. Returns nil if they're all nil.
+func SakeAll(conditions ...SakeCondition) SakeCondition {
+	var result SakeCondition
+	for _, condition := range conditions {
+		if condition == nil {
+			continue
+		}
+		if result == nil {
+			result = condition
+		} else {
+			result = SakeAnd{result, condition}
+		}
+	}
+
+	return result
+}
+
+func (c SakeAnd) sql(args []any) (string, []any) {
+	left, args := c.Left.sql(args)
+	right, args := c.Right.sql(args)
+	return "(" + left + " AND " + right + ")", args
+}
+
+func (c SakeOr) sql(args []any) (string, []any) {
+	left, args := c.Left.sql(args)
+	right, args := c.Right.sql(args)
+	return "(" + left + " OR " + right + ")", args
+}
+
+func (c SakeNot) sql(args []any) (string, []any) {
+	inner, args := c.Inner.sql(args)
+	return "(NOT " + inner + ")", args
+}
+
+func (c SakeCompare) sql(args []any) (string, []any) {
+	args = append(args, c.Value)
+	return c.Column + " " + c.Op + " $" + strconv.Itoa(len(args)), args
+}
+
+func (c SakeIn) sql(args []any) (string, []any) {
+	args = append(args, c.Values)
+	return c.Column + " = ANY($" + strconv.Itoa(len(args)) + ")", args
+}
+
+// sakeConditionSQL returns the SQL of a condition, "TRUE" for nil
+func sakeConditionSQL(condition SakeCondition, args []any) (string, []any) {
+	if condition == nil {
+		return "TRUE", args
+	}
+
+	return condition.sql(args)
+}
+
+// sakeOrderSQL returns the ORDER BY list of a sort
+func sakeOrderSQL(order []SakeOrder) string {
+	columns := make([]string, len(order))
+	for i, column := range order {
+		columns[i] = column.Column + " ASC"
+		if column.Descending {
+			columns[i] = column.Column + " DESC"
+		}
+	}
+
+	return strings.Join(columns, ", ")
+}
+
+// sakeSearchSQL builds the query for a search
+func sakeSearchSQL(search SakeSearch) (string, []any) {
+	condition, args := sakeConditionSQL(search.Condition, nil)
+	order := sakeOrderSQL(search.Order)
+
+	if surrounding := search.Surrounding; surrounding != nil {
+		args = append(args, surrounding.Owners)
+		ownersArg := "$" + strconv.Itoa(len(args))
+		args = append(args, surrounding.Count)
+		countArg := "$" + strconv.Itoa(len(args))
+		args = append(args, search.Limit)
+		limitArg := "$" + strconv.Itoa(len(args))
+
+		// The same column can be selected twice, so name them by position
+		ranked := make([]string, len(search.Columns))
+		aliased := make([]string, len(search.Columns))
+		for i, column := range search.Columns {
+			ranked[i] = "column" + strconv.Itoa(i+1)
+			aliased[i] = column + " AS " + ranked[i]
+		}
+
+		query := "WITH ranked AS (SELECT " + strings.Join(aliased, ", ") + ", " + surrounding.OwnerColumn + " AS sake_owner, row_number() OVER (ORDER BY " + order + ") AS sake_rank" +
+			" FROM " + search.Table + " WHERE " + condition + ")" +
+			" SELECT " + strings.Join(ranked, ", ") + " FROM ranked" +
+			" WHERE sake_rank BETWEEN (SELECT min(sake_rank) FROM ranked WHERE sake_owner = ANY(" + ownersArg + ")) - " + countArg +
+			" AND (SELECT max(sake_rank) FROM ranked WHERE sake_owner = ANY(" + ownersArg + ")) + " + countArg +
+			" ORDER BY sake_rank LIMIT " + limitArg
+		return query, args
+	}
+
+	args = append(args, search.Limit)
+	limitArg := "$" + strconv.Itoa(len(args))
+	args = append(args, search.Offset)
+	offsetArg := "$" + strconv.Itoa(len(args))
+
+	query := "SELECT " + strings.Join(search.Columns, ", ") + " FROM " + search.Table + " WHERE " + condition + " ORDER BY " + order + " LIMIT " + limitArg + " OFFSET " + offsetArg
+	return query, args
+}
+
+// SearchSakeRecords returns the values of each record found, as the driver scanned them
+func (s *postgresStore) SearchSakeRecords(ctx context.Context, search SakeSearch) ([][]any, error) {
+	query, args := sakeSearchSQL(search)
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records [][]any
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, values)
+	}
+
+	return records, rows.Err()
+}
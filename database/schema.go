@@ -2,12 +2,10 @@ package database
 
 import (
 	"context"
-
-	"github.com/jackc/pgx/v4/pgxpool"
 )
 
-func UpdateTables(pool *pgxpool.Pool, ctx context.Context) {
-	pool.Exec(ctx, `
+func (s *postgresStore) UpdateTables(ctx context.Context) {
+	s.pool.Exec(ctx, `
 ALTER TABLE ONLY public.users
 	ADD IF NOT EXISTS last_ip_address character varying DEFAULT ''::character varying,
 	ADD IF NOT EXISTS last_ingamesn character varying DEFAULT ''::character varying,
@@ -18,6 +16,108 @@ ALTER TABLE ONLY public.users
 	ADD IF NOT EXISTS ban_reason_hidden character varying,
 	ADD IF NOT EXISTS ban_moderator character varying,
 	ADD IF NOT EXISTS ban_tos boolean,
-	ADD IF NOT EXISTS open_host boolean DEFAULT false
+	ADD IF NOT EXISTS ban_shadow boolean DEFAULT false,
+	ADD IF NOT EXISTS open_host boolean DEFAULT false,
+	ADD IF NOT EXISTS zipcode character varying,
+	ADD IF NOT EXISTS countrycode character varying,
+	ADD IF NOT EXISTS location character varying,
+	ADD IF NOT EXISTS deleted timestamp without time zone
+`)
+
+	s.pool.Exec(ctx, `
+CREATE TABLE IF NOT EXISTS public.allowlist (
+	id serial PRIMARY KEY,
+	profile_id bigint DEFAULT 0,
+	console_fc bigint DEFAULT 0,
+	added timestamp without time zone,
+	moderator character varying
+)
+`)
+
+	s.pool.Exec(ctx, `
+CREATE TABLE IF NOT EXISTS public.nat_stats (
+	profile_id bigint NOT NULL,
+	nat_type smallint NOT NULL,
+	mapping_scheme smallint NOT NULL,
+	successes integer DEFAULT 0,
+	failures integer DEFAULT 0,
+	updated timestamp without time zone,
+	PRIMARY KEY (profile_id, nat_type, mapping_scheme)
+)
+`)
+
+	s.pool.Exec(ctx, `
+CREATE TABLE IF NOT EXISTS public.sake_files (
+	file_id serial PRIMARY KEY,
+	game_id integer NOT NULL,
+	profile_id bigint NOT NULL,
+	size bigint NOT NULL,
+	created timestamp without time zone
+)
+`)
+
+	s.pool.Exec(ctx, `CREATE INDEX IF NOT EXISTS sake_files_profile_id ON public.sake_files (profile_id)`)
+
+	s.pool.Exec(ctx, `
+CREATE TABLE IF NOT EXISTS public.gamestats_player_data (
+	profile_id bigint NOT NULL,
+	game_name character varying NOT NULL,
+	ptype smallint NOT NULL,
+	dindex integer NOT NULL,
+	data bytea NOT NULL,
+	modified timestamp without time zone NOT NULL,
+	PRIMARY KEY (profile_id, game_name, ptype, dindex)
+)
+`)
+
+	s.pool.Exec(ctx, `
+CREATE TABLE IF NOT EXISTS public.gamestats_scores (
+	profile_id bigint NOT NULL,
+	game_name character varying NOT NULL,
+	board character varying NOT NULL,
+	score bigint NOT NULL,
+	recorded timestamp without time zone NOT NULL,
+	PRIMARY KEY (profile_id, game_name, board)
+)
 `)
+
+	// One index per rank order so pages and ranks are read from the index rather than sorted
+	s.pool.Exec(ctx, `CREATE INDEX IF NOT EXISTS gamestats_scores_ascending ON public.gamestats_scores (game_name, board, score, recorded, profile_id)`)
+	s.pool.Exec(ctx, `CREATE INDEX IF NOT EXISTS gamestats_scores_descending ON public.gamestats_scores (game_name, board, score DESC, recorded, profile_id)`)
+
+	s.pool.Exec(ctx, `
+CREATE TABLE IF NOT EXISTS public.connection_log (
+	id bigserial PRIMARY KEY,
+	profile_id bigint NOT NULL,
+	ip_address character varying NOT NULL,
+	server character varying NOT NULL,
+	opened timestamp without time zone NOT NULL,
+	duration_ms bigint NOT NULL,
+	bytes_in bigint NOT NULL,
+	bytes_out bigint NOT NULL,
+	packets_in bigint NOT NULL,
+	packets_out bigint NOT NULL
+)
+`)
+
+	s.pool.Exec(ctx, `CREATE INDEX IF NOT EXISTS connection_log_opened ON public.connection_log (opened)`)
+
+	s.pool.Exec(ctx, `
+CREATE TABLE IF NOT EXISTS public.connection_stats_daily (
+	day date NOT NULL,
+	profile_id bigint NOT NULL,
+	ip_address character varying NOT NULL,
+	server character varying NOT NULL,
+	connections integer NOT NULL,
+	duration_ms bigint NOT NULL,
+	bytes_in bigint NOT NULL,
+	bytes_out bigint NOT NULL,
+	packets_in bigint NOT NULL,
+	packets_out bigint NOT NULL,
+	PRIMARY KEY (day, profile_id, ip_address, server)
+)
+`)
+
+	s.pool.Exec(ctx, `CREATE INDEX IF NOT EXISTS connection_stats_daily_profile_id ON public.connection_stats_daily (profile_id, day)`)
+	s.pool.Exec(ctx, `CREATE INDEX IF NOT EXISTS connection_stats_daily_ip_address ON public.connection_stats_daily (ip_address, day)`)
 }
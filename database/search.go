@@ -0,0 +1,56 @@
+package database
+
+import (
+	"context"
+	"strings"
+)
+
+const (
+	SearchUserProfiles = `SELECT profile_id, gsbrcd, COALESCE(firstname, ''), COALESCE(last_ingamesn, ''), count(*) OVER() FROM users WHERE ($1 = '' OR unique_nick = $1) AND ($2 = '' OR email = $2) AND ($3 = '' OR firstname = $3) AND ($4 = '' OR lastname = $4) AND ($5 = '' OR last_ingamesn ILIKE '%' || $5 || '%' ESCAPE '\') ORDER BY profile_id LIMIT $6 OFFSET $7`
+)
+
+type ProfileSearch struct {
+	// Case-insensitive substring of the last in-game name
+	Nick       string
+	UniqueNick string
+	Email      string
+	FirstName  string
+	LastName   string
+}
+
+type ProfileSearchResult struct {
+	ProfileId  uint32
+	GsbrCode   string
+	FirstName  string
+	InGameName string
+}
+
+// Escape the LIKE wildcards so a nick is matched literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchProfiles finds profiles matching all of the non-empty search fields.
+// Returns one page of results and the total number of matches.
+func (s *postgresStore) SearchProfiles(ctx context.Context, search ProfileSearch, skip int, limit int) ([]ProfileSearchResult, int, error) {
+	rows, err := s.pool.Query(ctx, SearchUserProfiles, search.UniqueNick, search.Email, search.FirstName, search.LastName, likeEscaper.Replace(search.Nick), limit, skip)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var results []ProfileSearchResult
+	total := 0
+	for rows.Next() {
+		var result ProfileSearchResult
+		var profileId int64
+		var count int64
+		if err := rows.Scan(&profileId, &result.GsbrCode, &result.FirstName, &result.InGameName, &count); err != nil {
+			return nil, 0, err
+		}
+
+		result.ProfileId = uint32(profileId)
+		results = append(results, result)
+		total = int(count)
+	}
+
+	return results, total, rows.Err()
+}
@@ -0,0 +1,86 @@
+package database
+
+import (
+	"context"
+	"time"
+	"wwfc/common"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// ErrNotFound is returned by the lookups of a Store when there is nothing stored under the key
+var ErrNotFound = pgx.ErrNoRows
+
+// Store is where the servers keep their persistent data. The driver is picked by <databaseDriver>:
+// PostgreSQL for public servers, or a single file for small servers without a database.
+type Store interface {
+	// Create the tables and columns missing from an older database
+	UpdateTables(ctx context.Context)
+	Close()
+
+	// Profiles
+	LoginUserToGPCM(ctx context.Context, userId uint64, gsbrcd string, profileId uint32, ngDeviceId uint32, ipAddress string, ingamesn string) (User, error)
+	LoginUserToGameStats(ctx context.Context, userId uint64, gsbrcd string) (User, error)
+	GetProfile(ctx context.Context, profileId uint32) (User, bool)
+	UpdateUserProfile(ctx context.Context, profileId uint32, data map[string]string) error
+	SearchProfiles(ctx context.Context, search ProfileSearch, skip int, limit int) ([]ProfileSearchResult, int, error)
+	GetMKWFriendInfo(ctx context.Context, profileId uint32) string
+	UpdateMKWFriendInfo(ctx context.Context, profileId uint32, info string)
+	ExportProfile(ctx context.Context, profileId uint32) (ProfileExport, error)
+	DeleteProfile(ctx context.Context, profileId uint32) (map[string]int64, error)
+
+	// Bans and moderation
+	BanUser(ctx context.Context, profileId uint32, tos bool, shadow bool, length time.Duration, reason string, reasonHidden string, moderator string) bool
+	UnbanUser(ctx context.Context, profileId uint32) bool
+	FindNASBan(ctx context.Context, userId uint64, gsbrcd string) (*common.BanInfo, error)
+	DoesUserTrusted(ctx context.Context, profileID uint32) (bool, error)
+	AddTrusted(ctx context.Context, profileID uint32) (bool, error)
+	FetchTrusted(ctx context.Context) ([]uint32, error)
+	RemoveTrusted(ctx context.Context, profileId uint32) bool
+
+	// Allowlist
+	IsProfileAllowed(ctx context.Context, profileId uint32, consoleFc uint64) (bool, error)
+	IsNASLoginAllowed(ctx context.Context, userId uint64, gsbrcd string, consoleFc uint64) (bool, error)
+	AllowProfile(ctx context.Context, profileId uint32, moderator string) error
+	AllowConsole(ctx context.Context, consoleFc uint64, moderator string) error
+	DisallowProfile(ctx context.Context, profileId uint32) (bool, error)
+	DisallowConsole(ctx context.Context, consoleFc uint64) (bool, error)
+	FetchAllowlist(ctx context.Context) ([]AllowlistEntry, error)
+
+	// Gamestats
+	GetPlayerData(ctx context.Context, profileId uint32, gameName string, ptype int, dindex int) ([]byte, time.Time, error)
+	SetPlayerData(ctx context.Context, profileId uint32, gameName string, ptype int, dindex int, data []byte, modified time.Time) error
+	SetGamestatsScore(ctx context.Context, profileId uint32, gameName string, board string, ascending bool, score int64, recorded time.Time) error
+	GetLeaderboard(ctx context.Context, gameName string, board string, ascending bool, offset int, limit int) ([]LeaderboardEntry, error)
+	GetLeaderboardRank(ctx context.Context, gameName string, board string, ascending bool, profileId uint32) (int, error)
+
+	// SAKE
+	InsertSakeFileRecord(ctx context.Context, gameId int, profileId uint32, size int64, maxFiles int, maxBytes int64) (int32, error)
+	GetSakeFile(ctx context.Context, fileId int32) (SakeFile, error)
+	DeleteSakeFile(ctx context.Context, fileId int32) error
+	GetAllSakeFileIDs(ctx context.Context) (map[int32]bool, error)
+	DeleteOrphanedSakeFileRecords(ctx context.Context) (map[int32]bool, error)
+	SearchSakeRecords(ctx context.Context, search SakeSearch) ([][]any, error)
+
+	// NATNEG and traffic statistics
+	RecordNATReport(ctx context.Context, profileId uint32, natType byte, mappingScheme byte, success bool) error
+	GetNATStats(ctx context.Context) ([]NATTypeStats, error)
+	InsertConnection(ctx context.Context, record ConnectionRecord) error
+	RollupTraffic(ctx context.Context, cutoff time.Time, retentionCutoff time.Time) (int64, error)
+	GetTraffic(ctx context.Context, filter TrafficFilter) ([]TrafficEntry, error)
+}
+
+// postgresStore keeps the data in PostgreSQL, each server with a connection pool of its own
+type postgresStore struct {
+	pool *pgxpool.Pool
+}
+
+// NewPostgresStore returns a Store using a connection pool opened by the caller
+func NewPostgresStore(pool *pgxpool.Pool) Store {
+	return &postgresStore{pool: pool}
+}
+
+func (s *postgresStore) Close() {
+	s.pool.Close()
+}
@@ -0,0 +1,125 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	InsertConnectionQuery = `INSERT INTO connection_log (profile_id, ip_address, server, opened, duration_ms, bytes_in, bytes_out, packets_in, packets_out)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	// Moves the connections opened before the cutoff into the daily totals in one statement, so
+	// none are counted twice or lost if it fails
+	RollupConnectionsQuery = `WITH moved AS (DELETE FROM connection_log WHERE opened < $1 RETURNING *)
+	INSERT INTO connection_stats_daily (day, profile_id, ip_address, server, connections, duration_ms, bytes_in, bytes_out, packets_in, packets_out)
+	SELECT opened::date, profile_id, ip_address, server, count(*), sum(duration_ms), sum(bytes_in), sum(bytes_out), sum(packets_in), sum(packets_out)
+	FROM moved GROUP BY opened::date, profile_id, ip_address, server
+	ON CONFLICT (day, profile_id, ip_address, server) DO UPDATE
+	SET connections = connection_stats_daily.connections + EXCLUDED.connections,
+		duration_ms = connection_stats_daily.duration_ms + EXCLUDED.duration_ms,
+		bytes_in = connection_stats_daily.bytes_in + EXCLUDED.bytes_in,
+		bytes_out = connection_stats_daily.bytes_out + EXCLUDED.bytes_out,
+		packets_in = connection_stats_daily.packets_in + EXCLUDED.packets_in,
+		packets_out = connection_stats_daily.packets_out + EXCLUDED.packets_out`
+	DeleteDailyTrafficQuery = `DELETE FROM connection_stats_daily WHERE day < $1`
+
+	// Connections that haven't been rolled up yet are totalled the same way
+	GetTrafficQuery = `SELECT day, profile_id, ip_address, server, sum(connections)::bigint, sum(duration_ms)::bigint, sum(bytes_in)::bigint, sum(bytes_out)::bigint, sum(packets_in)::bigint, sum(packets_out)::bigint FROM (
+		SELECT day, profile_id, ip_address, server, connections, duration_ms, bytes_in, bytes_out, packets_in, packets_out FROM connection_stats_daily
+		UNION ALL
+		SELECT opened::date, profile_id, ip_address, server, 1, duration_ms, bytes_in, bytes_out, packets_in, packets_out FROM connection_log
+	) traffic
+	WHERE ($1::bigint = 0 OR profile_id = $1) AND ($2::varchar = '' OR ip_address = $2) AND day >= $3::date AND day <= $4::date
+	GROUP BY day, profile_id, ip_address, server ORDER BY day, profile_id, ip_address, server LIMIT $5`
+)
+
+// ConnectionRecord is the traffic of one closed connection
+type ConnectionRecord struct {
+	ProfileID  uint32
+	IPAddress  string
+	Server     string
+	Opened     time.Time
+	Duration   time.Duration
+	BytesIn    uint64
+	BytesOut   uint64
+	PacketsIn  uint64
+	PacketsOut uint64
+}
+
+// TrafficEntry is the traffic of a profile from one IP to one server over a day
+type TrafficEntry struct {
+	Day         string `json:"day"`
+	ProfileID   uint32 `json:"profile_id"`
+	IPAddress   string `json:"ip_address"`
+	Server      string `json:"server"`
+	Connections int64  `json:"connections"`
+	DurationMs  int64  `json:"duration_ms"`
+	BytesIn     int64  `json:"bytes_in"`
+	BytesOut    int64  `json:"bytes_out"`
+	PacketsIn   int64  `json:"packets_in"`
+	PacketsOut  int64  `json:"packets_out"`
+}
+
+// TrafficFilter selects traffic entries, a zero profile ID or empty IP address matches any
+type TrafficFilter struct {
+	ProfileID uint32
+	IPAddress string
+	From      time.Time
+	To        time.Time
+	Limit     int
+}
+
+func (s *postgresStore) InsertConnection(ctx context.Context, record ConnectionRecord) error {
+	_, err := s.pool.Exec(ctx, InsertConnectionQuery, int64(record.ProfileID), record.IPAddress, record.Server, record.Opened.UTC(), record.Duration.Milliseconds(), int64(record.BytesIn), int64(record.BytesOut), int64(record.PacketsIn), int64(record.PacketsOut))
+	return err
+}
+
+// RollupTraffic totals the connections opened before the cutoff by day, and deletes the daily
+// totals before the retention cutoff unless it's zero. Days are in UTC. Returns the number of
+// daily totals that were added to.
+func (s *postgresStore) RollupTraffic(ctx context.Context, cutoff time.Time, retentionCutoff time.Time) (int64, error) {
+	result, err := s.pool.Exec(ctx, RollupConnectionsQuery, cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	if !retentionCutoff.IsZero() {
+		if _, err := s.pool.Exec(ctx, DeleteDailyTrafficQuery, retentionCutoff.UTC()); err != nil {
+			return 0, err
+		}
+	}
+
+	return result.RowsAffected(), nil
+}
+
+func (s *postgresStore) GetTraffic(ctx context.Context, filter TrafficFilter) ([]TrafficEntry, error) {
+	rows, err := s.pool.Query(ctx, GetTrafficQuery, int64(filter.ProfileID), filter.IPAddress, filter.From.UTC(), filter.To.UTC(), filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanTraffic(rows)
+}
+
+func scanTraffic(rows pgx.Rows) ([]TrafficEntry, error) {
+	defer rows.Close()
+
+	entries := []TrafficEntry{}
+	for rows.Next() {
+		var entry TrafficEntry
+		var day time.Time
+		var profileId int64
+		if err := rows.Scan(&day, &profileId, &entry.IPAddress, &entry.Server, &entry.Connections, &entry.DurationMs, &entry.BytesIn, &entry.BytesOut, &entry.PacketsIn, &entry.PacketsOut); err != nil {
+			return nil, err
+		}
+
+		entry.Day = day.Format(time.DateOnly)
+		entry.ProfileID = uint32(profileId)
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
@@ -6,24 +6,26 @@ import (
 	"fmt"
 	"math/rand"
 	"time"
+	"wwfc/common"
 
-	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/pgx/v4"
 )
 
 const (
 	InsertUser              = `INSERT INTO users (user_id, gsbrcd, password, ng_device_id, email, unique_nick) VALUES ($1, $2, $3, $4, $5, $6) RETURNING profile_id`
 	InsertUserWithProfileID = `INSERT INTO users (profile_id, user_id, gsbrcd, password, ng_device_id, email, unique_nick) VALUES ($1, $2, $3, $4, $5, $6, $7)`
-	UpdateUserTable         = `UPDATE users SET firstname = CASE WHEN $3 THEN $2 ELSE firstname END, lastname = CASE WHEN $5 THEN $4 ELSE lastname END, open_host = CASE WHEN $7 THEN $6 ELSE open_host END WHERE profile_id = $1`
+	UpdateUserTable         = `UPDATE users SET firstname = CASE WHEN $3 THEN $2 ELSE firstname END, lastname = CASE WHEN $5 THEN $4 ELSE lastname END, open_host = CASE WHEN $7 THEN $6 ELSE open_host END, zipcode = CASE WHEN $9 THEN $8 ELSE zipcode END, countrycode = CASE WHEN $11 THEN $10 ELSE countrycode END, location = CASE WHEN $13 THEN $12 ELSE location END, email = CASE WHEN $15 THEN $14 ELSE email END WHERE profile_id = $1`
 	UpdateUserProfileID     = `UPDATE users SET profile_id = $3 WHERE user_id = $1 AND gsbrcd = $2`
 	UpdateUserNGDeviceID    = `UPDATE users SET ng_device_id = $2 WHERE profile_id = $1`
-	GetUser                 = `SELECT user_id, gsbrcd, email, unique_nick, firstname, lastname, open_host FROM users WHERE profile_id = $1`
+	GetUser                 = `SELECT user_id, gsbrcd, email, unique_nick, firstname, lastname, open_host, zipcode, countrycode, location FROM users WHERE profile_id = $1`
 	DoesUserExist           = `SELECT EXISTS(SELECT 1 FROM users WHERE user_id = $1 AND gsbrcd = $2)`
 	IsProfileIDInUse        = `SELECT EXISTS(SELECT 1 FROM users WHERE profile_id = $1)`
 	DeleteUserSession       = `DELETE FROM sessions WHERE profile_id = $1`
-	GetUserProfileID        = `SELECT profile_id, ng_device_id, email, unique_nick, firstname, lastname, open_host FROM users WHERE user_id = $1 AND gsbrcd = $2`
+	GetUserProfileID        = `SELECT profile_id, ng_device_id, email, unique_nick, firstname, lastname, open_host, zipcode, countrycode, location FROM users WHERE user_id = $1 AND gsbrcd = $2`
 	UpdateUserLastIPAddress = `UPDATE users SET last_ip_address = $2, last_ingamesn = $3 WHERE profile_id = $1`
-	UpdateUserBan           = `UPDATE users SET has_ban = true, ban_issued = $2, ban_expires = $3, ban_reason = $4, ban_reason_hidden = $5, ban_moderator = $6, ban_tos = $7 WHERE profile_id = $1`
-	SearchUserBan           = `SELECT has_ban, ban_tos, ng_device_id FROM users WHERE has_ban = true AND (profile_id = $1 OR ng_device_id = $2 OR last_ip_address = $3) AND (ban_expires IS NULL OR ban_expires > $4) ORDER BY ban_tos DESC LIMIT 1`
+	UpdateUserBan           = `UPDATE users SET has_ban = true, ban_issued = $2, ban_expires = $3, ban_reason = $4, ban_reason_hidden = $5, ban_moderator = $6, ban_tos = $7, ban_shadow = $8 WHERE profile_id = $1`
+	SearchUserBan           = `SELECT COALESCE(ban_tos, false), COALESCE(ban_shadow, false), COALESCE(ban_reason, ''), ban_expires, COALESCE(ng_device_id, 0) FROM users WHERE has_ban = true AND (profile_id = $1 OR ng_device_id = $2 OR last_ip_address = $3) AND (ban_expires IS NULL OR ban_expires > $4) ORDER BY (COALESCE(ban_tos, false) AND NOT COALESCE(ban_shadow, false)) DESC, COALESCE(ban_shadow, false) DESC, ban_expires DESC NULLS FIRST LIMIT 1`
+	SearchNASBan            = `SELECT COALESCE(ban_tos, false), COALESCE(ban_shadow, false), COALESCE(ban_reason, ''), ban_expires, COALESCE(ng_device_id, 0) FROM users WHERE has_ban = true AND user_id = $1 AND gsbrcd = $2 AND (ban_expires IS NULL OR ban_expires > $3) LIMIT 1`
 	DisableUserBan          = `UPDATE users SET has_ban = false WHERE profile_id = $1`
 
 	GetMKWFriendInfoQuery    = `SELECT mariokartwii_friend_info FROM users WHERE profile_id = $1`
@@ -45,11 +47,17 @@ type User struct {
 	UniqueNick         string
 	FirstName          string
 	LastName           string
+	ZipCode            string
+	CountryCode        string
+	Location           string
 	Restricted         bool
 	RestrictedDeviceId uint32
+	ShadowBanned       bool
 	OpenHost           bool
 	Trusted            bool
 	CTGPVER            string
+	// Set with ErrProfileBannedTOS
+	Ban *common.BanInfo
 }
 
 var (
@@ -57,9 +65,9 @@ var (
 	ErrReservedProfileIDRange = errors.New("profile ID is in reserved range")
 )
 
-func (user *User) CreateUser(pool *pgxpool.Pool, ctx context.Context) error {
+func (s *postgresStore) createUser(ctx context.Context, user *User) error {
 	if user.ProfileId == 0 {
-		return pool.QueryRow(ctx, InsertUser, user.UserId, user.GsbrCode, "", user.NgDeviceId, user.Email, user.UniqueNick).Scan(&user.ProfileId)
+		return s.pool.QueryRow(ctx, InsertUser, user.UserId, user.GsbrCode, "", user.NgDeviceId, user.Email, user.UniqueNick).Scan(&user.ProfileId)
 	}
 
 	if user.ProfileId >= 1000000000 {
@@ -67,7 +75,7 @@ func (user *User) CreateUser(pool *pgxpool.Pool, ctx context.Context) error {
 	}
 
 	var exists bool
-	err := pool.QueryRow(ctx, IsProfileIDInUse, user.ProfileId).Scan(&exists)
+	err := s.pool.QueryRow(ctx, IsProfileIDInUse, user.ProfileId).Scan(&exists)
 	if err != nil {
 		return err
 	}
@@ -76,17 +84,17 @@ func (user *User) CreateUser(pool *pgxpool.Pool, ctx context.Context) error {
 		return ErrProfileIDInUse
 	}
 
-	_, err = pool.Exec(ctx, InsertUserWithProfileID, user.ProfileId, user.UserId, user.GsbrCode, "", user.NgDeviceId, user.Email, user.UniqueNick)
+	_, err = s.pool.Exec(ctx, InsertUserWithProfileID, user.ProfileId, user.UserId, user.GsbrCode, "", user.NgDeviceId, user.Email, user.UniqueNick)
 	return err
 }
 
-func (user *User) UpdateProfileID(pool *pgxpool.Pool, ctx context.Context, newProfileId uint32) error {
+func (s *postgresStore) updateProfileID(ctx context.Context, user *User, newProfileId uint32) error {
 	if newProfileId >= 1000000000 {
 		return ErrReservedProfileIDRange
 	}
 
 	var exists bool
-	err := pool.QueryRow(ctx, IsProfileIDInUse, newProfileId).Scan(&exists)
+	err := s.pool.QueryRow(ctx, IsProfileIDInUse, newProfileId).Scan(&exists)
 	if err != nil {
 		return err
 	}
@@ -95,7 +103,7 @@ func (user *User) UpdateProfileID(pool *pgxpool.Pool, ctx context.Context, newPr
 		return ErrProfileIDInUse
 	}
 
-	_, err = pool.Exec(ctx, UpdateUserProfileID, user.UserId, user.GsbrCode, newProfileId)
+	_, err = s.pool.Exec(ctx, UpdateUserProfileID, user.UserId, user.GsbrCode, newProfileId)
 	if err == nil {
 		user.ProfileId = newProfileId
 	}
@@ -103,84 +111,179 @@ func (user *User) UpdateProfileID(pool *pgxpool.Pool, ctx context.Context, newPr
 	return err
 }
 
-func (user *User) UpdateDeviceID(pool *pgxpool.Pool, ctx context.Context, newDeviceId uint32) error {
-	_, err := pool.Exec(ctx, UpdateUserNGDeviceID, user.ProfileId, newDeviceId)
-	if err == nil {
-		user.NgDeviceId = newDeviceId
-	}
-
-	return err
-}
-
 func GetUniqueUserID() uint64 {
 	// Not guaranteed unique but doesn't matter in practice if multiple people have the same user ID.
 	return uint64(rand.Int63n(0x80000000000))
 }
 
-func (user *User) UpdateProfile(pool *pgxpool.Pool, ctx context.Context, data map[string]string) {
-	firstName, firstNameExists := data["firstname"]
-	lastName, lastNameExists := data["lastname"]
-	openHost, openHostExists := data["wwfc_openhost"]
-	openHostBool := false
-	if openHostExists && openHost != "0" {
-		openHostBool = true
+// profileUpdate holds the profile fields a client sent, nil for the ones it left alone
+type profileUpdate struct {
+	firstName   *string
+	lastName    *string
+	openHost    *bool
+	zipCode     *string
+	countryCode *string
+	location    *string
+	email       *string
+}
+
+func parseProfileUpdate(data map[string]string) profileUpdate {
+	field := func(key string) *string {
+		if value, exists := data[key]; exists {
+			return &value
+		}
+		return nil
 	}
 
-	_, err := pool.Exec(ctx, UpdateUserTable, user.ProfileId, firstName, firstNameExists, lastName, lastNameExists, openHostBool, openHostExists)
-	if err != nil {
-		panic(err)
+	update := profileUpdate{
+		firstName:   field("firstname"),
+		lastName:    field("lastname"),
+		zipCode:     field("zipcode"),
+		countryCode: field("countrycode"),
+		location:    field("loc"),
+		email:       field("email"),
 	}
 
-	if firstNameExists {
-		user.FirstName = firstName
+	if openHost, exists := data["wwfc_openhost"]; exists {
+		openHostBool := openHost != "0"
+		update.openHost = &openHostBool
 	}
 
-	if lastNameExists {
-		user.LastName = lastName
+	return update
+}
+
+func (update profileUpdate) apply(user *User) {
+	user.setOptionalFields(update.firstName, update.lastName, update.zipCode, update.countryCode, update.location)
+
+	if update.email != nil {
+		user.Email = *update.email
+	}
+
+	if update.openHost != nil {
+		user.OpenHost = *update.openHost
+	}
+}
+
+// UpdateProfile writes the profile fields in the data to the store and to the user
+func (user *User) UpdateProfile(store Store, ctx context.Context, data map[string]string) {
+	err := store.UpdateUserProfile(ctx, user.ProfileId, data)
+	if err != nil {
+		panic(err)
 	}
 
-	if openHostExists {
-		user.OpenHost = openHostBool
+	parseProfileUpdate(data).apply(user)
+}
+
+func (s *postgresStore) UpdateUserProfile(ctx context.Context, profileId uint32, data map[string]string) error {
+	update := parseProfileUpdate(data)
+	value := func(field *string) string {
+		if field == nil {
+			return ""
+		}
+		return *field
 	}
+
+	openHost := update.openHost != nil && *update.openHost
+	_, err := s.pool.Exec(ctx, UpdateUserTable, profileId, value(update.firstName), update.firstName != nil, value(update.lastName), update.lastName != nil, openHost, update.openHost != nil, value(update.zipCode), update.zipCode != nil, value(update.countryCode), update.countryCode != nil, value(update.location), update.location != nil, value(update.email), update.email != nil)
+	return err
 }
 
-func GetProfile(pool *pgxpool.Pool, ctx context.Context, profileId uint32) (User, bool) {
+func (s *postgresStore) GetProfile(ctx context.Context, profileId uint32) (User, bool) {
 	user := User{}
-	row := pool.QueryRow(ctx, GetUser, profileId)
-	err := row.Scan(&user.UserId, &user.GsbrCode, &user.Email, &user.UniqueNick, &user.FirstName, &user.LastName, &user.OpenHost)
+	row := s.pool.QueryRow(ctx, GetUser, profileId)
+	var firstName, lastName, zipCode, countryCode, location *string
+	err := row.Scan(&user.UserId, &user.GsbrCode, &user.Email, &user.UniqueNick, &firstName, &lastName, &user.OpenHost, &zipCode, &countryCode, &location)
 	if err != nil {
 		return User{}, false
 	}
 
+	user.setOptionalFields(firstName, lastName, zipCode, countryCode, location)
+
 	user.ProfileId = profileId
 	return user, true
 }
 
-func BanUser(pool *pgxpool.Pool, ctx context.Context, profileId uint32, tos bool, length time.Duration, reason string, reasonHidden string, moderator string) bool {
-	_, err := pool.Exec(ctx, UpdateUserBan, profileId, time.Now(), time.Now().Add(length), reason, reasonHidden, moderator, tos)
+func (user *User) setOptionalFields(firstName, lastName, zipCode, countryCode, location *string) {
+	if firstName != nil {
+		user.FirstName = *firstName
+	}
+
+	if lastName != nil {
+		user.LastName = *lastName
+	}
+
+	if zipCode != nil {
+		user.ZipCode = *zipCode
+	}
+
+	if countryCode != nil {
+		user.CountryCode = *countryCode
+	}
+
+	if location != nil {
+		user.Location = *location
+	}
+}
+
+// BanUser bans the profile for the length, or permanently if the length is 0
+func (s *postgresStore) BanUser(ctx context.Context, profileId uint32, tos bool, shadow bool, length time.Duration, reason string, reasonHidden string, moderator string) bool {
+	var expires *time.Time
+	if length > 0 {
+		expiresTime := time.Now().Add(length)
+		expires = &expiresTime
+	}
+
+	_, err := s.pool.Exec(ctx, UpdateUserBan, profileId, time.Now(), expires, reason, reasonHidden, moderator, tos, shadow)
 	return err == nil
 }
-func DoesUserTrusted(pool *pgxpool.Pool, ctx context.Context, profileID uint32) (bool, error) {
+
+// findUserBan returns the active ban on the profile, device ID or IP address, or nil if there is none
+func (s *postgresStore) findUserBan(ctx context.Context, profileId uint32, ngDeviceId uint32, ipAddress string) (*common.BanInfo, error) {
+	return scanBan(s.pool.QueryRow(ctx, SearchUserBan, profileId, ngDeviceId, ipAddress, time.Now()))
+}
+
+// FindNASBan returns the active ban on the user ID and gsbr code, or nil if there is none. Bans on
+// the device ID or IP address are only known once the console logs in to GPCM.
+func (s *postgresStore) FindNASBan(ctx context.Context, userId uint64, gsbrcd string) (*common.BanInfo, error) {
+	return scanBan(s.pool.QueryRow(ctx, SearchNASBan, userId, gsbrcd, time.Now()))
+}
+
+func scanBan(row pgx.Row) (*common.BanInfo, error) {
+	var ban common.BanInfo
+	var expires *time.Time
+	err := row.Scan(&ban.TOS, &ban.Shadow, &ban.Reason, &expires, &ban.DeviceID)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if expires != nil {
+		ban.Expires = *expires
+	}
+	return &ban, nil
+}
+func (s *postgresStore) DoesUserTrusted(ctx context.Context, profileID uint32) (bool, error) {
 	var trusted bool
-	err := pool.QueryRow(ctx, DoesUserExistTrusted, profileID).Scan(&trusted)
+	err := s.pool.QueryRow(ctx, DoesUserExistTrusted, profileID).Scan(&trusted)
 	if err != nil {
 		return false, err // Return false and the error
 	}
 	return trusted, nil // Return the trusted value and no error
 }
 
-func AddTrusted(pool *pgxpool.Pool, ctx context.Context, profileID uint32) (bool, error) {
-	_, err := pool.Exec(ctx, AddUserTrusted, profileID)
+func (s *postgresStore) AddTrusted(ctx context.Context, profileID uint32) (bool, error) {
+	_, err := s.pool.Exec(ctx, AddUserTrusted, profileID)
 	if err != nil {
 		return false, err
 	}
 	return true, nil
 }
 
-func FetchTrusted(pool *pgxpool.Pool, ctx context.Context) ([]uint32, error) {
+func (s *postgresStore) FetchTrusted(ctx context.Context) ([]uint32, error) {
 	var trustedIDs []uint32
 
-	rows, err := pool.Query(ctx, FetchTrustedList)
+	rows, err := s.pool.Query(ctx, FetchTrustedList)
 	if err != nil {
 		return nil, err
 	}
@@ -203,19 +306,19 @@ func FetchTrusted(pool *pgxpool.Pool, ctx context.Context) ([]uint32, error) {
 	return trustedIDs, nil
 }
 
-func RemoveTrusted(pool *pgxpool.Pool, ctx context.Context, profileId uint32) bool {
-	_, err := pool.Exec(ctx, RemoveUserTrusted, profileId)
+func (s *postgresStore) RemoveTrusted(ctx context.Context, profileId uint32) bool {
+	_, err := s.pool.Exec(ctx, RemoveUserTrusted, profileId)
 	return err == nil
 }
 
-func UnbanUser(pool *pgxpool.Pool, ctx context.Context, profileId uint32) bool {
-	_, err := pool.Exec(ctx, DisableUserBan, profileId)
+func (s *postgresStore) UnbanUser(ctx context.Context, profileId uint32) bool {
+	_, err := s.pool.Exec(ctx, DisableUserBan, profileId)
 	return err == nil
 }
 
-func GetMKWFriendInfo(pool *pgxpool.Pool, ctx context.Context, profileId uint32) string {
+func (s *postgresStore) GetMKWFriendInfo(ctx context.Context, profileId uint32) string {
 	var info string
-	err := pool.QueryRow(ctx, GetMKWFriendInfoQuery, profileId).Scan(&info)
+	err := s.pool.QueryRow(ctx, GetMKWFriendInfoQuery, profileId).Scan(&info)
 	if err != nil {
 		return ""
 	}
@@ -223,8 +326,8 @@ func GetMKWFriendInfo(pool *pgxpool.Pool, ctx context.Context, profileId uint32)
 	return info
 }
 
-func UpdateMKWFriendInfo(pool *pgxpool.Pool, ctx context.Context, profileId uint32, info string) {
-	_, err := pool.Exec(ctx, UpdateMKWFriendInfoQuery, profileId, info)
+func (s *postgresStore) UpdateMKWFriendInfo(ctx context.Context, profileId uint32, info string) {
+	_, err := s.pool.Exec(ctx, UpdateMKWFriendInfoQuery, profileId, info)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// serverListener is the listener a server currently accepts connections on, nil while drained
+type serverListener struct {
+	server   serverInfo
+	listener net.Listener
+}
+
+// DrainArgs selects the server to drain and whether to close its existing connections
+type DrainArgs struct {
+	Server           string
+	CloseConnections bool
+}
+
+var (
+	serverListeners      = map[string]*serverListener{}
+	serverListenersMutex sync.Mutex
+
+	ErrUnknownServer  = errors.New("unknown server")
+	ErrAlreadyDrained = errors.New("server is already drained")
+	ErrNotDrained     = errors.New("server is not drained")
+)
+
+// startServerListener starts accepting connections on the server's listener
+func startServerListener(server serverInfo, l net.Listener) {
+	serverListenersMutex.Lock()
+	serverListeners[server.rpcName] = &serverListener{server: server, listener: l}
+	serverListenersMutex.Unlock()
+
+	go frontendListen(server, l)
+}
+
+// isServerDrained checks if the server has stopped accepting new connections
+func isServerDrained(name string) bool {
+	serverListenersMutex.Lock()
+	defer serverListenersMutex.Unlock()
+
+	state := serverListeners[name]
+	return state != nil && state.listener == nil
+}
+
+// RPCFrontendPacket.DrainServer is called by an external program to stop a server accepting new
+// connections, optionally closing its existing ones. Returns the number of connections closed.
+func (r *RPCFrontendPacket) DrainServer(args DrainArgs, closed *int) error {
+	serverListenersMutex.Lock()
+
+	state := serverListeners[args.Server]
+	if state == nil {
+		serverListenersMutex.Unlock()
+		return ErrUnknownServer
+	}
+
+	if state.listener == nil {
+		serverListenersMutex.Unlock()
+		return ErrAlreadyDrained
+	}
+
+	// Ends the accept loop in frontendListen
+	if err := state.listener.Close(); err != nil {
+		serverListenersMutex.Unlock()
+		logging.Error("FRONTEND", "Failed to close listener for", aurora.BrightCyan(args.Server).String()+":", err)
+		return err
+	}
+	state.listener = nil
+	serverListenersMutex.Unlock()
+
+	*closed = 0
+	if args.CloseConnections {
+		*closed = closeServerConnections(args.Server, closeReasonDrained)
+	}
+
+	logging.Notice("FRONTEND", "Drained", aurora.BrightCyan(args.Server), "closed", aurora.Cyan(*closed), "connections")
+	return nil
+}
+
+// RPCFrontendPacket.RecycleServer is called by an external program to close every connection to a
+// server while it keeps accepting, so the clients reconnect. Returns the number of connections closed.
+func (r *RPCFrontendPacket) RecycleServer(name string, recycled *int) error {
+	if connections[name] == nil {
+		return ErrUnknownServer
+	}
+
+	*recycled = closeServerConnections(name, closeReasonRecycled)
+	logging.Notice("FRONTEND", "Recycled", aurora.Cyan(*recycled), "connections to", aurora.BrightCyan(name))
+	return nil
+}
+
+// closeServerConnections closes every connection to the server and tells the backend about the ones
+// it knows of, so their sessions are cleaned up. Returns the number of connections closed.
+func closeServerConnections(name string, reason error) int {
+	conns := connections[name].removeAll()
+
+	var wg sync.WaitGroup
+	for index, conn := range conns {
+		// The goroutine running handleConnection closes the socket, and doesn't tell the backend since
+		// the connection is no longer in the map
+		conn.cancel(reason)
+
+		if conn.announced.Load() {
+			wg.Add(1)
+			go func(index uint64, conn *frontendConn) {
+				defer wg.Done()
+				closeBackendConnection(name, index, conn)
+			}(index, conn)
+		}
+	}
+	wg.Wait()
+
+	return len(conns)
+}
+
+// RPCFrontendPacket.UndrainServer is called by an external program to make a drained server accept connections again
+func (r *RPCFrontendPacket) UndrainServer(name string, _ *struct{}) error {
+	serverListenersMutex.Lock()
+	defer serverListenersMutex.Unlock()
+
+	state := serverListeners[name]
+	if state == nil {
+		return ErrUnknownServer
+	}
+
+	if state.listener != nil {
+		return ErrNotDrained
+	}
+
+	l, err := listenServer(state.server)
+	if err != nil {
+		address := net.JoinHostPort(state.server.address, strconv.Itoa(state.server.port))
+		logging.Error("FRONTEND", "Failed to listen on", aurora.BrightCyan(address), "for", aurora.BrightCyan(name).String()+":", err)
+		return err
+	}
+
+	state.listener = l
+	go frontendListen(state.server, l)
+
+	logging.Notice("FRONTEND", "Undrained", aurora.BrightCyan(name))
+	return nil
+}
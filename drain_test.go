@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func TestDrainServer(t *testing.T) {
+	server := serverInfo{rpcName: "draintest", protocol: "tcp", address: "127.0.0.1", port: 0}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &failingBackend{}
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.RegisterName("RPCPacket", backend); err != nil {
+		t.Fatal(err)
+	}
+	frontendSide, backendSide := net.Pipe()
+	go rpcServer.ServeConn(backendSide)
+	rpcClient = rpc.NewClient(frontendSide)
+
+	client, remote := net.Pipe()
+	defer client.Close()
+
+	// Only the connection the backend knows of is closed on the backend
+	connections[server.rpcName] = newConnectionMap()
+	announced := newFrontendConn(remote)
+	announced.announced.Store(true)
+	connections[server.rpcName].add(1, announced)
+	_, unannounced := net.Pipe()
+	connections[server.rpcName].add(2, newFrontendConn(unannounced))
+	startServerListener(server, l)
+
+	t.Cleanup(func() {
+		rpcClient.Close()
+		rpcClient = nil
+		serverListenersMutex.Lock()
+		if state := serverListeners[server.rpcName]; state.listener != nil {
+			state.listener.Close()
+		}
+		delete(serverListeners, server.rpcName)
+		serverListenersMutex.Unlock()
+		delete(connections, server.rpcName)
+	})
+
+	var closed int
+	if err := (&RPCFrontendPacket{}).DrainServer(DrainArgs{Server: server.rpcName, CloseConnections: true}, &closed); err != nil {
+		t.Fatal(err)
+	}
+
+	if closed != 2 || connections[server.rpcName].get(1) != nil {
+		t.Errorf("closed %d connections, expected 2", closed)
+	}
+
+	if closes := backend.closed.Load(); closes != 1 {
+		t.Errorf("backend told about %d closes, expected 1", closes)
+	}
+
+	if !isServerDrained(server.rpcName) {
+		t.Error("server not drained")
+	}
+
+	if conn, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("drained listener still accepting")
+	}
+
+	if err := (&RPCFrontendPacket{}).DrainServer(DrainArgs{Server: server.rpcName}, &closed); err != ErrAlreadyDrained {
+		t.Errorf("draining twice returned %v", err)
+	}
+
+	if err := (&RPCFrontendPacket{}).UndrainServer(server.rpcName, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if isServerDrained(server.rpcName) {
+		t.Error("server still drained")
+	}
+
+	if err := (&RPCFrontendPacket{}).UndrainServer(server.rpcName, nil); err != ErrNotDrained {
+		t.Errorf("undraining twice returned %v", err)
+	}
+
+	if err := (&RPCFrontendPacket{}).UndrainServer("unknown", nil); err != ErrUnknownServer {
+		t.Errorf("undraining an unknown server returned %v", err)
+	}
+}
+
+func TestRecycleServer(t *testing.T) {
+	backend := &failingBackend{}
+	server := rpc.NewServer()
+	if err := server.RegisterName("RPCPacket", backend); err != nil {
+		t.Fatal(err)
+	}
+
+	frontendSide, backendSide := net.Pipe()
+	go server.ServeConn(backendSide)
+	rpcClient = rpc.NewClient(frontendSide)
+
+	info := serverInfo{rpcName: "recycletest"}
+	connections[info.rpcName] = newConnectionMap()
+
+	t.Cleanup(func() {
+		rpcClient.Close()
+		rpcClient = nil
+		delete(connections, info.rpcName)
+	})
+
+	client, remote := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		handleConnection(info, remote, 1)
+		close(done)
+	}()
+
+	// Not yet known to the backend, so it isn't told about the close
+	_, unannounced := net.Pipe()
+	connections[info.rpcName].add(2, newFrontendConn(unannounced))
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if conn := connections[info.rpcName].get(1); conn != nil && conn.announced.Load() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connection wasn't announced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var recycled int
+	if err := (&RPCFrontendPacket{}).RecycleServer(info.rpcName, &recycled); err != nil {
+		t.Fatal(err)
+	}
+
+	if recycled != 2 {
+		t.Errorf("recycled %d connections, expected 2", recycled)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection goroutine didn't exit")
+	}
+
+	if closed := backend.closed.Load(); closed != 1 {
+		t.Errorf("backend told about %d closes, expected 1", closed)
+	}
+
+	if err := (&RPCFrontendPacket{}).RecycleServer("unknown", &recycled); err != ErrUnknownServer {
+		t.Errorf("recycling an unknown server returned %v", err)
+	}
+}
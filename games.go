@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"wwfc/common"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// GameOverride is a game enabled or disabled with "cmd b game", it's kept over config reloads and
+// restarts until changed again
+type GameOverride struct {
+	GameID  int  `json:"gameId"`
+	Enabled bool `json:"enabled"`
+}
+
+var (
+	gameOverridesPath string
+	// Guards the file
+	gameOverridesMutex sync.Mutex
+
+	ErrUnknownGameID = errors.New("no game has the ID")
+)
+
+// loadGameOverrides reads the games enabled or disabled at runtime from the file. A missing or
+// corrupt file is logged and the config applies as is, so a bad file never stops the backend.
+func loadGameOverrides(path string) {
+	gameOverridesMutex.Lock()
+	defer gameOverridesMutex.Unlock()
+
+	gameOverridesPath = path
+	common.SetGameOverrides(nil)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logging.Warn("BACKEND", "Failed to read game overrides", aurora.BrightCyan(path).String()+":", err)
+		}
+		return
+	}
+
+	var list []GameOverride
+	if err := json.Unmarshal(data, &list); err != nil {
+		logging.Warn("BACKEND", "Game overrides", aurora.BrightCyan(path), "are corrupt, ignoring them:", err)
+		return
+	}
+
+	overrides := map[int]bool{}
+	for _, override := range list {
+		overrides[override.GameID] = override.Enabled
+		if !override.Enabled {
+			logging.Notice("BACKEND", "Game ID", aurora.Cyan(override.GameID), "is disabled by", aurora.BrightCyan(path))
+		}
+	}
+	common.SetGameOverrides(overrides)
+}
+
+// saveGameOverrides writes the games enabled or disabled at runtime to the file. Expects the mutex
+// to be locked.
+func saveGameOverrides() error {
+	if gameOverridesPath == "" {
+		return nil
+	}
+
+	list := []GameOverride{}
+	for gameId, enabled := range common.GetGameOverrides() {
+		list = append(list, GameOverride{GameID: gameId, Enabled: enabled})
+	}
+	slices.SortFunc(list, func(a, b GameOverride) int { return a.GameID - b.GameID })
+
+	data, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(gameOverridesPath, data)
+}
+
+// RPCPacket.SetGameEnabled is called by the command interface to enable or disable a game by its
+// ID. Players of a disabled game are rejected the next time they log in or send a heartbeat. NAS
+// only knows the game code of a login, so it rejects the game only if it has <gameCodes> in the
+// config, otherwise its players are rejected by GPCM instead.
+func (r *RPCPacket) SetGameEnabled(args GameOverride, game *common.GameInfo) error {
+	gameOverridesMutex.Lock()
+	defer gameOverridesMutex.Unlock()
+
+	info := common.SetGameEnabled(args.GameID, args.Enabled)
+	if info == nil {
+		return ErrUnknownGameID
+	}
+	*game = *info
+
+	if err := saveGameOverrides(); err != nil {
+		logging.Error("BACKEND", "Failed to save game overrides:", err)
+		return err
+	}
+
+	if args.Enabled {
+		logging.Notice("BACKEND", "Enabled game", aurora.Cyan(game.Name), "ID", aurora.Cyan(game.GameID))
+	} else {
+		logging.Notice("BACKEND", "Disabled game", aurora.Cyan(game.Name), "ID", aurora.Cyan(game.GameID))
+	}
+	return nil
+}
+
+// RPCPacket.DisabledGames is called by the command interface to list the games disabled by the
+// config or at runtime
+func (r *RPCPacket) DisabledGames(_ struct{}, games *[]common.GameInfo) error {
+	*games = common.GetDisabledGames()
+	return nil
+}
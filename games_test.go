@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"wwfc/common"
+)
+
+func TestGameOverridePersistence(t *testing.T) {
+	gameId := 9999
+	common.ApplyGameConfig(common.Config{Games: []common.GameConfig{{Name: "testgame", GameID: &gameId, SecretKey: "abcdef"}}})
+	defer common.ApplyGameConfig(common.Config{})
+
+	path := filepath.Join(t.TempDir(), "game_overrides.json")
+	loadGameOverrides(path)
+	defer loadGameOverrides("")
+
+	backend := &RPCPacket{}
+	var game common.GameInfo
+	if err := backend.SetGameEnabled(GameOverride{GameID: 9999, Enabled: false}, &game); err != nil {
+		t.Fatal(err)
+	}
+	if game.Name != "testgame" || !game.Disabled {
+		t.Errorf("unexpected game: %+v", game)
+	}
+	if err := backend.SetGameEnabled(GameOverride{GameID: 1234}, &game); err != ErrUnknownGameID {
+		t.Errorf("got error %v for an unknown game", err)
+	}
+
+	// Restarting the backend reads the file again
+	common.SetGameOverrides(nil)
+	loadGameOverrides(path)
+
+	var disabled []common.GameInfo
+	if err := backend.DisabledGames(struct{}{}, &disabled); err != nil {
+		t.Fatal(err)
+	}
+	if len(disabled) != 1 || disabled[0].GameID != 9999 {
+		t.Errorf("disabled game wasn't loaded: %+v", disabled)
+	}
+
+	if err := backend.SetGameEnabled(GameOverride{GameID: 9999, Enabled: true}, &game); err != nil {
+		t.Fatal(err)
+	}
+	loadGameOverrides(path)
+	if common.IsGameDisabled("testgame") {
+		t.Error("enabled game is still disabled after reload")
+	}
+}
+
+func TestGameOverrideCorruptFile(t *testing.T) {
+	gameId := 9999
+	disabled := false
+	common.ApplyGameConfig(common.Config{Games: []common.GameConfig{{Name: "testgame", GameID: &gameId, SecretKey: "abcdef", Enabled: &disabled}}})
+	defer common.ApplyGameConfig(common.Config{})
+
+	path := filepath.Join(t.TempDir(), "game_overrides.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loadGameOverrides(path)
+	defer loadGameOverrides("")
+
+	if !common.IsGameDisabled("testgame") {
+		t.Error("config wasn't applied with a corrupt file")
+	}
+}
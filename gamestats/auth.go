@@ -1,25 +1,101 @@
 package gamestats
 
 import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
 	"math/rand"
+	"net"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 	"wwfc/common"
-	"wwfc/database"
 	"wwfc/gpcm"
 	"wwfc/logging"
 
 	"github.com/logrusorgru/aurora/v3"
 )
 
+// Failed challenge responses per IP address, only this many addresses are tracked
+const maxAuthFailureAddresses = 4096
+
+var (
+	authFailures      = map[string]uint64{}
+	authFailureCount  uint64
+	authFailuresMutex sync.Mutex
+)
+
+// authResponse computes the response to the server challenge the game sends in its auth command
+func authResponse(challenge string, secretKey string) string {
+	hash := md5.Sum([]byte(challenge + secretKey))
+	return hex.EncodeToString(hash[:])
+}
+
+// verifyAuthResponse checks the response against the game's secret key. Games without a secret key
+// can't prove anything, so they are rejected.
+func verifyAuthResponse(game *common.GameInfo, challenge string, response string) bool {
+	if game.SecretKey == "" || challenge == "" {
+		return false
+	}
+
+	expected := authResponse(challenge, game.SecretKey)
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(response))) == 1
+}
+
+// recordAuthFailure counts a failed challenge response from the address and returns the count for its IP
+func recordAuthFailure(address string) uint64 {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	authFailuresMutex.Lock()
+	defer authFailuresMutex.Unlock()
+
+	authFailureCount++
+	if _, ok := authFailures[host]; !ok && len(authFailures) >= maxAuthFailureAddresses {
+		return 0
+	}
+
+	authFailures[host]++
+	return authFailures[host]
+}
+
+// GetAuthFailures returns the number of failed challenge responses, in total and per IP address
+func GetAuthFailures() (uint64, map[string]uint64) {
+	authFailuresMutex.Lock()
+	defer authFailuresMutex.Unlock()
+
+	result := map[string]uint64{}
+	for host, count := range authFailures {
+		result[host] = count
+	}
+
+	return authFailureCount, result
+}
+
 func (g *GameStatsSession) auth(command common.GameSpyCommand) {
-	game := common.GetGameInfoByName(command.OtherValues["gamename"])
+	if g.gameInfo != nil {
+		// The game can't be switched after its data is accessible
+		logging.Error(g.ModuleName, "Attempt to authenticate twice")
+		g.replyError(gpcm.ErrLoginBadPreAuth)
+		return
+	}
+
+	game := common.CheckGame(g.ModuleName, command.OtherValues["gamename"], common.GameServiceGameStats)
 	if game == nil {
 		g.replyError(gpcm.ErrDatabase)
 		return
 	}
 
-	// TODO: Validate "response"
+	if !verifyAuthResponse(game, g.Challenge, command.OtherValues["response"]) {
+		count := recordAuthFailure(g.RemoteAddr)
+		logging.Error(g.ModuleName, "Invalid challenge response for game", aurora.Cyan(game.Name).String()+",", aurora.Cyan(count), "failures from this IP")
+		g.replyError(gpcm.ErrLoginBadPreAuth)
+		return
+	}
+
 	g.SessionKey = rand.Int31n(290000000) + 10000000
 	g.GameName = command.OtherValues["gamename"]
 	g.gameInfo = game
@@ -36,6 +112,12 @@ func (g *GameStatsSession) auth(command common.GameSpyCommand) {
 }
 
 func (g *GameStatsSession) authp(command common.GameSpyCommand) {
+	if g.gameInfo == nil {
+		logging.Error(g.ModuleName, "Attempt to log in before the challenge response")
+		g.replyError(gpcm.ErrNotLoggedIn)
+		return
+	}
+
 	lid := command.OtherValues["lid"]
 	errorCmd := common.GameSpyCommand{
 		Command:      "pauthr",
@@ -77,14 +159,22 @@ func (g *GameStatsSession) authp(command common.GameSpyCommand) {
 		return
 	}
 
-	g.User, err = database.LoginUserToGameStats(pool, ctx, userId, gsbrcd)
+	user, err := store.LoginUserToGameStats(ctx, userId, gsbrcd)
 	if err != nil {
 		logging.Error(g.ModuleName, "Error logging in user:", err.Error())
 		g.Write(errorCmd)
 		return
 	}
 
-	g.ModuleName = "GSTATS:" + strconv.FormatInt(int64(g.User.ProfileId), 10)
+	// Player data commands are bound to the first profile, it can't be switched afterwards
+	if g.Authenticated && user.ProfileId != g.User.ProfileId {
+		logging.Error(g.ModuleName, "Attempt to switch to profile", aurora.Cyan(user.ProfileId))
+		g.Write(errorCmd)
+		return
+	}
+	g.User = user
+
+	g.ModuleName = logging.ConnectionModule("GSTATS", g.ConnIndex, strconv.FormatInt(int64(g.User.ProfileId), 10))
 	g.Authenticated = true
 
 	logging.Notice(g.ModuleName, "Authenticated, game name:", aurora.Cyan(g.gameInfo.Name))
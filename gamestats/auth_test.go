@@ -0,0 +1,61 @@
+package gamestats
+
+import (
+	"testing"
+	"wwfc/common"
+)
+
+func TestAuthResponse(t *testing.T) {
+	// MD5 of the challenge followed by the game's secret key
+	vectors := []struct {
+		challenge string
+		secretKey string
+		response  string
+	}{
+		{"ABCDEFGHIJ", "9r3Rmy", "589911580f5542093ecb738298251d9c"},
+		{"xQ3pLm0aZk", "9r3Rmy", "685828188477c33f7360b2eaf9469f3a"},
+		{"ABCDEFGHIJ", "d4q9GZ", "926296f65ae5d71742b2bb9548bf223e"},
+	}
+
+	for _, vector := range vectors {
+		if response := authResponse(vector.challenge, vector.secretKey); response != vector.response {
+			t.Errorf("%q/%q: got %s, expected %s", vector.challenge, vector.secretKey, response, vector.response)
+		}
+	}
+
+	game := &common.GameInfo{Name: "mariokartwii", SecretKey: "9r3Rmy"}
+	if !verifyAuthResponse(game, "ABCDEFGHIJ", "589911580F5542093ECB738298251D9C") {
+		t.Error("valid response was rejected")
+	}
+
+	for _, response := range []string{"", "685828188477c33f7360b2eaf9469f3a", "589911580f5542093ecb738298251d9"} {
+		if verifyAuthResponse(game, "ABCDEFGHIJ", response) {
+			t.Errorf("accepted %q", response)
+		}
+	}
+
+	// No secret key to check against
+	if verifyAuthResponse(&common.GameInfo{Name: "unknown"}, "ABCDEFGHIJ", authResponse("ABCDEFGHIJ", "")) {
+		t.Error("accepted a response for a game without a secret key")
+	}
+}
+
+func TestAuthFailureCount(t *testing.T) {
+	authFailures = map[string]uint64{}
+	authFailureCount = 0
+	t.Cleanup(func() {
+		authFailures = map[string]uint64{}
+		authFailureCount = 0
+	})
+
+	recordAuthFailure("10.0.0.1:1000")
+	if count := recordAuthFailure("10.0.0.1:2000"); count != 2 {
+		t.Errorf("got %d failures from the same IP", count)
+	}
+	recordAuthFailure("10.0.0.2:1000")
+
+	total, perIP := GetAuthFailures()
+	if total != 3 || len(perIP) != 2 || perIP["10.0.0.1"] != 2 || perIP["10.0.0.2"] != 1 {
+		t.Errorf("got %d failures: %v", total, perIP)
+	}
+}
@@ -4,18 +4,52 @@ import (
 	"strconv"
 	"time"
 	"wwfc/common"
+	"wwfc/database"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
 )
 
 func (g *GameStatsSession) getpd(command common.GameSpyCommand) {
-	g.Write(common.GameSpyCommand{
+	reply := common.GameSpyCommand{
 		Command:      "getpdr",
-		CommandValue: "1",
+		CommandValue: "0",
 		OtherValues: map[string]string{
-			"lid":    strconv.Itoa(g.LoginID),
-			"pid":    command.OtherValues["pid"],
-			"mod":    strconv.Itoa(int(time.Now().Unix())),
-			"length": "0",
-			"data":   `\\`,
+			"lid": strconv.Itoa(g.LoginID),
+			"pid": command.OtherValues["pid"],
+			"mod": strconv.Itoa(int(time.Now().Unix())),
 		},
-	})
+	}
+
+	pid, err1 := strconv.ParseUint(command.OtherValues["pid"], 10, 32)
+	ptype, err2 := strconv.Atoi(command.OtherValues["ptype"])
+	dindex, err3 := strconv.Atoi(command.OtherValues["dindex"])
+	if err1 != nil || err2 != nil || err3 != nil {
+		logging.Error(g.ModuleName, "Invalid player data request:", aurora.Cyan(command.OtherValues["pid"]), aurora.Cyan(command.OtherValues["ptype"]), aurora.Cyan(command.OtherValues["dindex"]))
+		g.writePlayerData(reply, nil)
+		return
+	}
+
+	if (ptype == pdPrivateReadOnly || ptype == pdPrivateReadWrite) && uint32(pid) != g.User.ProfileId {
+		logging.Error(g.ModuleName, "Attempt to get private player data of profile", aurora.Cyan(pid))
+		g.writePlayerData(reply, nil)
+		return
+	}
+
+	key := playerDataKey{profileId: uint32(pid), gameName: g.GameName, ptype: ptype, dindex: dindex}
+	data, modified, err := getPlayerData(key)
+	if err == database.ErrNotFound {
+		// Nothing stored yet isn't an error to the game
+		reply.CommandValue = "1"
+		g.writePlayerData(reply, nil)
+		return
+	} else if err != nil {
+		logging.Error(g.ModuleName, "Failed to read player data:", err)
+		g.writePlayerData(reply, nil)
+		return
+	}
+
+	reply.CommandValue = "1"
+	reply.OtherValues["mod"] = strconv.FormatInt(modified.Unix(), 10)
+	g.writePlayerData(reply, filterKeyValues(data, command.OtherValues["keys"]))
 }
@@ -3,15 +3,14 @@ package gamestats
 import (
 	"context"
 	"encoding/gob"
-	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"wwfc/common"
 	"wwfc/database"
 	"wwfc/gpcm"
 	"wwfc/logging"
 
-	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/logrusorgru/aurora/v3"
 	"github.com/sasha-s/go-deadlock"
 )
@@ -22,6 +21,7 @@ type GameStatsSession struct {
 	ConnIndex  uint64
 	RemoteAddr string
 	ModuleName string
+	TraceID    string
 	Challenge  string
 
 	SessionKey int32
@@ -37,8 +37,8 @@ type GameStatsSession struct {
 }
 
 var (
-	ctx  = context.Background()
-	pool *pgxpool.Pool
+	ctx   = context.Background()
+	store database.Store
 
 	serverName string
 	webSalt    string
@@ -57,13 +57,8 @@ func StartServer(reload bool) {
 	common.ReadGameList()
 
 	// Start SQL
-	dbString := fmt.Sprintf("postgres://%s:%s@%s/%s", config.Username, config.Password, config.DatabaseAddress, config.DatabaseName)
-	dbConf, err := pgxpool.ParseConfig(dbString)
-	if err != nil {
-		panic(err)
-	}
-
-	pool, err = pgxpool.ConnectConfig(ctx, dbConf)
+	var err error
+	store, err = database.Connect(ctx, config)
 	if err != nil {
 		panic(err)
 	}
@@ -85,6 +80,7 @@ func StartServer(reload bool) {
 		}
 
 		for _, session := range sessionsByConnIndex {
+			logging.SetConnectionTrace("GSTATS", session.ConnIndex, session.TraceID)
 			session.gameInfo = common.GetGameInfoByName(session.GameName)
 			if session.gameInfo == nil {
 				logging.Error(session.ModuleName, "Unknown game from reload:", aurora.Cyan(session.GameName))
@@ -114,16 +110,19 @@ func Shutdown() {
 		panic(err)
 	}
 
-	pool.Close()
+	store.Close()
 
 	logging.Notice("GSTATS", "Saved", aurora.Cyan(len(sessionsByConnIndex)), "sessions")
 }
 
-func NewConnection(index uint64, address string) {
+func NewConnection(index uint64, address string, traceID string) {
+	logging.SetConnectionTrace("GSTATS", index, traceID)
+
 	session := &GameStatsSession{
 		ConnIndex:  index,
 		RemoteAddr: address,
-		ModuleName: "GSTATS:" + address,
+		ModuleName: logging.ConnectionModule("GSTATS", index, address),
+		TraceID:    traceID,
 		Challenge:  common.RandomString(10),
 
 		SessionKey: 0,
@@ -156,12 +155,14 @@ func NewConnection(index uint64, address string) {
 }
 
 func CloseConnection(index uint64) {
+	defer logging.ClearConnectionTrace("GSTATS", index)
+
 	mutex.RLock()
 	session := sessionsByConnIndex[index]
 	mutex.RUnlock()
 
 	if session == nil {
-		logging.Error("GSTATS", "Cannot find session for this connection index:", aurora.Cyan(index))
+		logging.Error(logging.ConnectionModule("GSTATS", index, ""), "Cannot find session for this connection index")
 		return
 	}
 
@@ -172,13 +173,27 @@ func CloseConnection(index uint64) {
 	mutex.Unlock()
 }
 
+// ForgetProfile closes the profile's sessions and drops its cached player data, for a profile
+// that was deleted
+func ForgetProfile(profileId uint32) {
+	mutex.RLock()
+	for index, session := range sessionsByConnIndex {
+		if session.Authenticated && session.User.ProfileId == profileId {
+			common.CloseConnection(ServerName, index)
+		}
+	}
+	mutex.RUnlock()
+
+	forgetPlayerData(profileId)
+}
+
 func HandlePacket(index uint64, data []byte) {
 	mutex.RLock()
 	session := sessionsByConnIndex[index]
 	mutex.RUnlock()
 
 	if session == nil {
-		logging.Error("GSTATS", "Cannot find session for this connection index:", aurora.Cyan(index))
+		logging.Error(logging.ConnectionModule("GSTATS", index, ""), "Cannot find session for this connection index")
 		return
 	}
 
@@ -202,27 +217,9 @@ func HandlePacket(index uint64, data []byte) {
 		return
 	}
 
-	// Decrypt the data, can decrypt multiple packets
-	decrypted := strings.Builder{}
-	decrypted.Grow(length)
-	p := 0
-	for i := 0; i < length; i++ {
-		if string(session.ReadBuffer[i:i+7]) == `\final\` {
-			decrypted.WriteString(`\final\`)
-
-			i += 6
-			p = 0
-			continue
-		}
-
-		decrypted.WriteRune(rune(session.ReadBuffer[i] ^ "GameSpy3D"[p]))
-		p = (p + 1) % 9
-	}
-
-	message := decrypted.String()
+	commands, message, err := parseMessage(session.ReadBuffer)
 	session.ReadBuffer = []byte{}
 
-	commands, err := common.ParseGameSpyMessage(message)
 	if err != nil {
 		logging.Error(session.ModuleName, "Error parsing message:", err.Error())
 		logging.Error(session.ModuleName, "Raw data:", message)
@@ -259,6 +256,44 @@ func HandlePacket(index uint64, data []byte) {
 	}
 }
 
+// parseMessage decrypts and parses the commands in a buffer ending in \final\
+func parseMessage(buffer []byte) ([]common.GameSpyCommand, string, error) {
+	// Decrypt the data, can decrypt multiple packets
+	decrypted := strings.Builder{}
+	decrypted.Grow(len(buffer))
+	p := 0
+	for i := 0; i < len(buffer); i++ {
+		if string(buffer[i:min(i+7, len(buffer))]) == `\final\` {
+			decrypted.WriteString(`\final\`)
+
+			i += 6
+			p = 0
+			continue
+		}
+
+		// Binary player data must come through byte for byte
+		decrypted.WriteByte(buffer[i] ^ "GameSpy3D"[p])
+		p = (p + 1) % 9
+	}
+
+	message, playerData := cutPlayerData(decrypted.String())
+
+	commands, err := common.ParseGameSpyMessage(message)
+	if err != nil {
+		return nil, message, err
+	}
+
+	// Put back the data cut from setpd commands before parsing
+	for _, command := range commands {
+		if command.Command == "setpd" && len(playerData) > 0 {
+			command.OtherValues["data"] = playerData[0]
+			playerData = playerData[1:]
+		}
+	}
+
+	return commands, message, nil
+}
+
 func (g *GameStatsSession) handleCommand(name string, commands []common.GameSpyCommand, handler func(command common.GameSpyCommand)) []common.GameSpyCommand {
 	var unhandled []common.GameSpyCommand
 
@@ -289,7 +324,20 @@ func (g *GameStatsSession) ignoreCommand(name string, commands []common.GameSpyC
 
 func (g *GameStatsSession) Write(command common.GameSpyCommand) {
 	// Encrypt the data and append it to be sent
-	payload := []byte(common.CreateGameSpyMessage(command))
+	g.writeEncrypted([]byte(common.CreateGameSpyMessage(command)))
+}
+
+// writePlayerData writes the command with raw player data appended, which CreateGameSpyMessage
+// would otherwise strip the backslashes from
+func (g *GameStatsSession) writePlayerData(command common.GameSpyCommand, data []byte) {
+	command.OtherValues["length"] = strconv.Itoa(len(data))
+	message := strings.TrimSuffix(common.CreateGameSpyMessage(command), `\final\`)
+
+	payload := append([]byte(message+`\data\`), data...)
+	g.writeEncrypted(append(payload, `\final\`...))
+}
+
+func (g *GameStatsSession) writeEncrypted(payload []byte) {
 	// Exclude trailing \final\
 	for i := 0; i < len(payload)-7; i++ {
 		payload[i] ^= "GameSpy3D"[i%9]
@@ -0,0 +1,284 @@
+package gamestats
+
+import (
+	"container/list"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sasha-s/go-deadlock"
+)
+
+const (
+	// Largest persistent data blob a game may store at one index
+	maxPlayerDataSize = 0x2000
+	// Number of blobs kept in memory, the least recently used are evicted first
+	playerDataCacheSize = 4096
+)
+
+// Persistent data types, games may only write the read/write types
+const (
+	pdPrivateReadOnly  = 0
+	pdPrivateReadWrite = 1
+	pdPublicReadOnly   = 2
+	pdPublicReadWrite  = 3
+)
+
+var (
+	errPlayerDataTooLarge = errors.New("player data is too large")
+	errPlayerDataInvalid  = errors.New("malformed key/value player data")
+)
+
+type playerDataKey struct {
+	profileId uint32
+	gameName  string
+	ptype     int
+	dindex    int
+}
+
+type playerDataEntry struct {
+	key      playerDataKey
+	data     []byte
+	modified time.Time
+}
+
+var (
+	playerDataCache      = map[playerDataKey]*list.Element{}
+	playerDataCacheOrder = list.New()
+	playerDataMutex      = deadlock.Mutex{}
+
+	// Replaced in tests
+	loadPlayerData = func(key playerDataKey) ([]byte, time.Time, error) {
+		return store.GetPlayerData(ctx, key.profileId, key.gameName, key.ptype, key.dindex)
+	}
+	storePlayerData = func(key playerDataKey, data []byte, modified time.Time) error {
+		return store.SetPlayerData(ctx, key.profileId, key.gameName, key.ptype, key.dindex, data, modified)
+	}
+)
+
+// getPlayerData returns the blob stored at the key, reading it from the database if it isn't cached
+func getPlayerData(key playerDataKey) ([]byte, time.Time, error) {
+	playerDataMutex.Lock()
+	if element := playerDataCache[key]; element != nil {
+		playerDataCacheOrder.MoveToFront(element)
+		entry := element.Value.(*playerDataEntry)
+		playerDataMutex.Unlock()
+		return entry.data, entry.modified, nil
+	}
+	playerDataMutex.Unlock()
+
+	data, modified, err := loadPlayerData(key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	cachePlayerData(key, data, modified)
+	return data, modified, nil
+}
+
+// setPlayerData writes the blob to the database, then to the cache once it is stored
+func setPlayerData(key playerDataKey, data []byte, modified time.Time) error {
+	if err := storePlayerData(key, data, modified); err != nil {
+		return err
+	}
+
+	cachePlayerData(key, data, modified)
+	return nil
+}
+
+func cachePlayerData(key playerDataKey, data []byte, modified time.Time) {
+	playerDataMutex.Lock()
+	defer playerDataMutex.Unlock()
+
+	if element := playerDataCache[key]; element != nil {
+		// Keep whichever copy is newer, another session may have raced us from the database
+		entry := element.Value.(*playerDataEntry)
+		if !modified.Before(entry.modified) {
+			entry.data = data
+			entry.modified = modified
+		}
+		playerDataCacheOrder.MoveToFront(element)
+		return
+	}
+
+	playerDataCache[key] = playerDataCacheOrder.PushFront(&playerDataEntry{key: key, data: data, modified: modified})
+
+	for playerDataCacheOrder.Len() > playerDataCacheSize {
+		oldest := playerDataCacheOrder.Back()
+		playerDataCacheOrder.Remove(oldest)
+		delete(playerDataCache, oldest.Value.(*playerDataEntry).key)
+	}
+}
+
+// forgetPlayerData drops every cached blob of the profile
+func forgetPlayerData(profileId uint32) {
+	playerDataMutex.Lock()
+	defer playerDataMutex.Unlock()
+
+	for key, element := range playerDataCache {
+		if key.profileId == profileId {
+			playerDataCacheOrder.Remove(element)
+			delete(playerDataCache, key)
+		}
+	}
+}
+
+// cutPlayerData removes the raw data of every setpd command from a decrypted message, as it can
+// contain backslashes (key/value data) or arbitrary bytes (binary data) that would break parsing.
+// Returns the remaining message and the data of each setpd command in order.
+func cutPlayerData(message string) (string, []string) {
+	var data []string
+
+	for start := 0; ; {
+		index := strings.Index(message[start:], `\setpd\`)
+		if index == -1 {
+			return message, data
+		}
+		start += index
+
+		dataIndex := strings.Index(message[start:], `\data\`)
+		if dataIndex == -1 {
+			return message, data
+		}
+		dataIndex += start
+		dataStart := dataIndex + len(`\data\`)
+
+		// The length is authoritative for binary data that may itself contain "\final\". Some SDK
+		// revisions don't count the data the same way as others, so fall back to the next
+		// "\final\" if the length doesn't end there.
+		dataEnd := -1
+		if length, ok := playerDataLength(message[start:dataIndex]); ok && dataStart+length <= len(message) && strings.HasPrefix(message[dataStart+length:], `\final\`) {
+			dataEnd = dataStart + length
+		} else if finalIndex := strings.Index(message[dataStart:], `\final\`); finalIndex != -1 {
+			dataEnd = dataStart + finalIndex
+		} else {
+			return message, data
+		}
+
+		data = append(data, message[dataStart:dataEnd])
+		message = message[:dataIndex] + message[dataEnd:]
+		start = dataIndex
+	}
+}
+
+// playerDataLength finds the length field in the header of a setpd command
+func playerDataLength(header string) (int, bool) {
+	index := strings.Index(header, `\length\`)
+	if index == -1 {
+		return 0, false
+	}
+
+	value := header[index+len(`\length\`):]
+	if end := strings.Index(value, `\`); end != -1 {
+		value = value[:end]
+	}
+
+	length, err := strconv.Atoi(value)
+	if err != nil || length < 0 {
+		return 0, false
+	}
+
+	return length, true
+}
+
+// parseKeyValues splits key/value player data in the form \key1\value1\key2\value2
+func parseKeyValues(data string) ([][2]string, error) {
+	if data == "" {
+		return nil, nil
+	}
+
+	if data[0] != '\\' {
+		return nil, errPlayerDataInvalid
+	}
+
+	fields := strings.Split(data[1:], `\`)
+	if len(fields)%2 != 0 {
+		return nil, errPlayerDataInvalid
+	}
+
+	pairs := make([][2]string, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		if fields[i] == "" {
+			return nil, errPlayerDataInvalid
+		}
+
+		pairs = append(pairs, [2]string{fields[i], fields[i+1]})
+	}
+
+	return pairs, nil
+}
+
+func joinKeyValues(pairs [][2]string) string {
+	builder := strings.Builder{}
+	for _, pair := range pairs {
+		builder.WriteString(`\` + pair[0] + `\` + pair[1])
+	}
+
+	return builder.String()
+}
+
+// mergeKeyValues updates the stored key/value data with the keys the game sent, keeping the
+// order of existing keys. Games only send the keys that changed.
+func mergeKeyValues(stored []byte, update string) ([]byte, error) {
+	// The SDK counts the null terminator in the length of key/value data
+	update = strings.TrimSuffix(update, "\x00")
+
+	updatePairs, err := parseKeyValues(update)
+	if err != nil {
+		return nil, err
+	}
+
+	// Data stored as binary before can't be merged, replace it instead
+	pairs, err := parseKeyValues(string(stored))
+	if err != nil {
+		pairs = nil
+	}
+
+	for _, update := range updatePairs {
+		found := false
+		for i := range pairs {
+			if pairs[i][0] == update[0] {
+				pairs[i][1] = update[1]
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			pairs = append(pairs, update)
+		}
+	}
+
+	merged := joinKeyValues(pairs)
+	if len(merged) > maxPlayerDataSize {
+		return nil, errPlayerDataTooLarge
+	}
+
+	return []byte(merged), nil
+}
+
+// filterKeyValues returns only the requested keys from key/value data, in the order they were
+// requested. Returns the data unchanged if no keys were requested or it isn't key/value data.
+func filterKeyValues(data []byte, keys string) []byte {
+	if keys == "" {
+		return data
+	}
+
+	pairs, err := parseKeyValues(string(data))
+	if err != nil {
+		return data
+	}
+
+	var filtered [][2]string
+	for _, key := range strings.Split(keys, "\x01") {
+		for _, pair := range pairs {
+			if pair[0] == key {
+				filtered = append(filtered, pair)
+				break
+			}
+		}
+	}
+
+	return []byte(joinKeyValues(filtered))
+}
@@ -0,0 +1,241 @@
+package gamestats
+
+import (
+	"bytes"
+	"container/list"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"wwfc/common"
+	"wwfc/database"
+)
+
+// encryptMessage encrypts a single command the way the client does
+func encryptMessage(message string) []byte {
+	payload := []byte(message)
+	for i := 0; i < len(payload)-7; i++ {
+		payload[i] ^= "GameSpy3D"[i%9]
+	}
+	return payload
+}
+
+// fakePlayerDataStore replaces the database for the duration of a test
+func fakePlayerDataStore(t *testing.T) (map[playerDataKey][]byte, *int) {
+	stored := map[playerDataKey][]byte{}
+	loads := 0
+
+	oldLoad, oldStore := loadPlayerData, storePlayerData
+	loadPlayerData = func(key playerDataKey) ([]byte, time.Time, error) {
+		loads++
+		data, ok := stored[key]
+		if !ok {
+			return nil, time.Time{}, database.ErrNotFound
+		}
+		return data, time.Unix(1700000000, 0), nil
+	}
+	storePlayerData = func(key playerDataKey, data []byte, modified time.Time) error {
+		stored[key] = data
+		return nil
+	}
+
+	oldStoreScore := storeScore
+	storeScore = func(key playerDataKey, score Score, ascending bool, recorded time.Time) error {
+		return nil
+	}
+
+	playerDataCache = map[playerDataKey]*list.Element{}
+	playerDataCacheOrder = list.New()
+
+	t.Cleanup(func() {
+		loadPlayerData, storePlayerData, storeScore = oldLoad, oldStore, oldStoreScore
+		playerDataCache = map[playerDataKey]*list.Element{}
+		playerDataCacheOrder = list.New()
+	})
+
+	return stored, &loads
+}
+
+func newTestSession() *GameStatsSession {
+	return &GameStatsSession{
+		ModuleName:    "GSTATS:test",
+		GameName:      "mariokartwii",
+		Authenticated: true,
+		User:          database.User{ProfileId: 600000001},
+	}
+}
+
+// send runs an encrypted client message through the session and returns the decrypted reply
+func send(t *testing.T, g *GameStatsSession, message string) string {
+	t.Helper()
+
+	commands, _, err := parseMessage(encryptMessage(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g.WriteBuffer = []byte{}
+	commands = g.handleCommand("getpd", commands, g.getpd)
+	commands = g.handleCommand("setpd", commands, g.setpd)
+	if len(commands) != 0 {
+		t.Fatal("unhandled commands", commands)
+	}
+
+	reply := g.WriteBuffer
+	for i := 0; i < len(reply)-7; i++ {
+		reply[i] ^= "GameSpy3D"[i%9]
+	}
+	return string(reply)
+}
+
+func setpdMessage(ptype int, dindex int, kv int, length int, data string) string {
+	return `\setpd\\pid\600000001\ptype\` + strconv.Itoa(ptype) + `\dindex\` + strconv.Itoa(dindex) + `\kv\` + strconv.Itoa(kv) +
+		`\lid\0\length\` + strconv.Itoa(length) + `\data\` + data + `\final\`
+}
+
+// replyData returns the data of a getpdr reply, checking it matches the length field
+func replyData(t *testing.T, reply string) string {
+	t.Helper()
+
+	if !strings.HasPrefix(reply, `\getpdr\1`) {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+
+	index := strings.Index(reply, `\data\`)
+	data := strings.TrimSuffix(reply[index+len(`\data\`):], `\final\`)
+	if !strings.Contains(reply[:index], `\length\`+strconv.Itoa(len(data))) {
+		t.Errorf("length doesn't match %d bytes of data in %q", len(data), reply)
+	}
+	return data
+}
+
+func TestPlayerDataKeyValueRoundTrip(t *testing.T) {
+	stored, _ := fakePlayerDataStore(t)
+	g := newTestSession()
+
+	// The SDK sends key/value data with its null terminator and counts it in the length
+	data := `\wins\12\losses\3\rank\A` + "\x00"
+	reply := send(t, g, setpdMessage(3, 0, 1, len(data), data))
+	if !strings.HasPrefix(reply, `\setpdr\1`) {
+		t.Fatalf("setpd failed: %q", reply)
+	}
+
+	data = `\losses\4\streak\2` + "\x00"
+	send(t, g, setpdMessage(3, 0, 1, len(data), data))
+
+	key := playerDataKey{profileId: 600000001, gameName: "mariokartwii", ptype: 3, dindex: 0}
+	if expected := `\wins\12\losses\4\rank\A\streak\2`; string(stored[key]) != expected {
+		t.Errorf("stored %q, expected %q", stored[key], expected)
+	}
+
+	reply = send(t, g, `\getpd\\pid\600000001\ptype\3\dindex\0\keys\\lid\0\final\`)
+	if data := replyData(t, reply); data != `\wins\12\losses\4\rank\A\streak\2` {
+		t.Errorf("got %q", data)
+	}
+
+	reply = send(t, g, `\getpd\\pid\600000001\ptype\3\dindex\0\keys\streak`+"\x01"+`wins`+"\x01"+`missing\lid\0\final\`)
+	if data := replyData(t, reply); data != `\streak\2\wins\12` {
+		t.Errorf("got filtered %q", data)
+	}
+}
+
+func TestPlayerDataBinaryRoundTrip(t *testing.T) {
+	fakePlayerDataStore(t)
+	g := newTestSession()
+
+	// Binary data may contain anything, including bytes that look like the end of the message
+	data := "\x00\x01\\final\\\x80\xff\\\xfe"
+	reply := send(t, g, setpdMessage(1, 2, 0, len(data), data))
+	if !strings.HasPrefix(reply, `\setpdr\1`) {
+		t.Fatalf("setpd failed: %q", reply)
+	}
+
+	reply = send(t, g, `\getpd\\pid\600000001\ptype\1\dindex\2\keys\\lid\0\final\`)
+	if got := replyData(t, reply); got != data {
+		t.Errorf("got %q, expected %q", got, data)
+	}
+}
+
+func TestPlayerDataLengthMismatch(t *testing.T) {
+	stored, _ := fakePlayerDataStore(t)
+	g := newTestSession()
+
+	// Counts a null terminator that isn't sent
+	data := `\name\Mario`
+	send(t, g, setpdMessage(3, 1, 1, len(data)+1, data))
+
+	key := playerDataKey{profileId: 600000001, gameName: "mariokartwii", ptype: 3, dindex: 1}
+	if string(stored[key]) != data {
+		t.Errorf("stored %q, expected %q", stored[key], data)
+	}
+}
+
+func TestPlayerDataRejected(t *testing.T) {
+	stored, _ := fakePlayerDataStore(t)
+	g := newTestSession()
+
+	messages := []string{
+		strings.Replace(setpdMessage(3, 0, 1, 8, `\a\b`+"\x00"), `600000001`, `600000002`, 1),
+		setpdMessage(pdPublicReadOnly, 0, 1, 5, `\a\b`+"\x00"),
+		setpdMessage(3, 0, 0, maxPlayerDataSize+1, strings.Repeat("x", maxPlayerDataSize+1)),
+		setpdMessage(3, 0, 1, 7, `\a\b\c`+"\x00"),
+	}
+
+	for _, message := range messages {
+		if reply := send(t, g, message); !strings.HasPrefix(reply, `\setpdr\0`) {
+			t.Errorf("%.40q: got %q", message, reply)
+		}
+	}
+
+	if len(stored) != 0 {
+		t.Errorf("stored %v", stored)
+	}
+
+	// Private data of another profile can't be read
+	stored[playerDataKey{profileId: 600000002, gameName: "mariokartwii", ptype: 1, dindex: 0}] = []byte("secret")
+	reply := send(t, g, `\getpd\\pid\600000002\ptype\1\dindex\0\keys\\lid\0\final\`)
+	if !strings.HasPrefix(reply, `\getpdr\0`) || strings.Contains(reply, "secret") {
+		t.Errorf("got %q", reply)
+	}
+}
+
+func TestPlayerDataCacheEviction(t *testing.T) {
+	stored, loads := fakePlayerDataStore(t)
+
+	for i := 0; i <= playerDataCacheSize; i++ {
+		key := playerDataKey{profileId: uint32(i), gameName: "mariokartwii", ptype: 3}
+		if err := setPlayerData(key, []byte{byte(i)}, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if playerDataCacheOrder.Len() != playerDataCacheSize {
+		t.Errorf("cache holds %d entries", playerDataCacheOrder.Len())
+	}
+
+	// The newest entry is served from memory, the evicted one from the database
+	if data, _, _ := getPlayerData(playerDataKey{profileId: playerDataCacheSize, gameName: "mariokartwii", ptype: 3}); *loads != 0 || !bytes.Equal(data, []byte{byte(playerDataCacheSize % 256)}) {
+		t.Errorf("got %v after %d loads", data, *loads)
+	}
+
+	evicted := playerDataKey{profileId: 0, gameName: "mariokartwii", ptype: 3}
+	if data, _, _ := getPlayerData(evicted); *loads != 1 || !bytes.Equal(data, stored[evicted]) {
+		t.Errorf("got %v after %d loads", data, *loads)
+	}
+}
+
+func TestPlayerDataReplayNotStored(t *testing.T) {
+	stored, _ := fakePlayerDataStore(t)
+	g := newTestSession()
+
+	common.BeginReplay(ServerName, g.ConnIndex)
+	t.Cleanup(func() { common.EndReplay(ServerName, g.ConnIndex) })
+
+	data := `\wins\12` + "\x00"
+	if reply := send(t, g, setpdMessage(3, 0, 1, len(data), data)); !strings.HasPrefix(reply, `\setpdr\1`) {
+		t.Fatalf("setpd failed: %q", reply)
+	}
+	if len(stored) != 0 {
+		t.Errorf("replay stored %v", stored)
+	}
+}
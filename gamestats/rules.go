@@ -0,0 +1,173 @@
+package gamestats
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// StatRule limits the value a game may store under one key of its key/value player data. Min and
+// max are inclusive and a value outside them is rejected, as is a value that isn't a number.
+// A required key must be in the stored data after the update is merged.
+type StatRule struct {
+	Game     string `xml:"game,attr"`
+	Key      string `xml:"key,attr"`
+	Min      *int64 `xml:"min,attr"`
+	Max      *int64 `xml:"max,attr"`
+	Required bool   `xml:"required,attr,omitempty"`
+}
+
+type statRuleFile struct {
+	Rules []StatRule `xml:"rule"`
+}
+
+var (
+	statRulesMutex sync.RWMutex
+	statRulesPath  string
+	// Rules by game, then by key
+	statRules = map[string]map[string]StatRule{}
+)
+
+// SetRuleFile replaces the stat rules with the ones in the file at the path. An empty path removes
+// the rules. A file that can't be read or parsed keeps the rules loaded before, so a mistake made
+// while editing it doesn't drop every rule on reload.
+func SetRuleFile(path string) {
+	statRulesMutex.Lock()
+	defer statRulesMutex.Unlock()
+
+	if path == "" {
+		if statRulesPath != "" {
+			logging.Notice("GSTATS", "Stat rules disabled")
+		}
+		statRulesPath = ""
+		statRules = map[string]map[string]StatRule{}
+		return
+	}
+
+	if path != statRulesPath {
+		statRules = map[string]map[string]StatRule{}
+	}
+	statRulesPath = path
+
+	rules, count, err := readStatRules(path)
+	if err != nil {
+		logging.Error("GSTATS", "Failed to load stat rules from", aurora.Cyan(path).String()+":", err)
+		return
+	}
+
+	statRules = rules
+	logging.Info("GSTATS", "Loaded", aurora.Cyan(count), "stat rules from", aurora.Cyan(path))
+}
+
+func readStatRules(path string) (map[string]map[string]StatRule, int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var file statRuleFile
+	if err := xml.Unmarshal(data, &file); err != nil {
+		return nil, 0, err
+	}
+
+	count := 0
+	rules := map[string]map[string]StatRule{}
+	for _, rule := range file.Rules {
+		err := rule.validate()
+		if err == nil && rules[rule.Game][rule.Key].Key != "" {
+			err = errors.New("duplicate key")
+		}
+		if err != nil {
+			logging.Error("GSTATS", "Skipping stat rule for", aurora.Cyan(rule.Game+"/"+rule.Key).String()+":", err)
+			continue
+		}
+
+		if rules[rule.Game] == nil {
+			rules[rule.Game] = map[string]StatRule{}
+		}
+		rules[rule.Game][rule.Key] = rule
+		count++
+	}
+
+	return rules, count, nil
+}
+
+func (r StatRule) validate() error {
+	if r.Game == "" || r.Key == "" {
+		return errors.New("game and key are required")
+	}
+	if strings.Contains(r.Key, `\`) {
+		return errors.New("key contains a backslash")
+	}
+	if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+		return errors.New("min is greater than max")
+	}
+	if r.Min == nil && r.Max == nil && !r.Required {
+		return errors.New("rule has no effect")
+	}
+
+	return nil
+}
+
+// checkStatRules checks key/value data a game sent against its rules. The ranges are checked on
+// the keys in the update, the required keys on the data after it's merged with the stored data.
+func checkStatRules(gameName string, update string, merged []byte) error {
+	statRulesMutex.RLock()
+	defer statRulesMutex.RUnlock()
+
+	rules := statRules[gameName]
+	if len(rules) == 0 {
+		return nil
+	}
+
+	updatePairs, err := parseKeyValues(strings.TrimSuffix(update, "\x00"))
+	if err != nil {
+		return err
+	}
+
+	for _, pair := range updatePairs {
+		rule, exists := rules[pair[0]]
+		if !exists || (rule.Min == nil && rule.Max == nil) {
+			continue
+		}
+
+		value, err := strconv.ParseInt(pair[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("value %q of key %s is not a number", pair[1], pair[0])
+		}
+		if (rule.Min != nil && value < *rule.Min) || (rule.Max != nil && value > *rule.Max) {
+			return fmt.Errorf("value %d of key %s is out of range", value, pair[0])
+		}
+	}
+
+	mergedPairs, err := parseKeyValues(string(merged))
+	if err != nil {
+		return err
+	}
+
+	for key, rule := range rules {
+		if !rule.Required {
+			continue
+		}
+
+		found := false
+		for _, pair := range mergedPairs {
+			if pair[0] == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("required key %s is missing", key)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package gamestats
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStatRules(t *testing.T) {
+	stored, _ := fakePlayerDataStore(t)
+	g := newTestSession()
+
+	path := filepath.Join(t.TempDir(), "rules.xml")
+	rules := `<statRules>
+		<rule game="mariokartwii" key="vr" min="1" max="30000" required="true" />
+		<rule game="mariokartwii" key="time" min="0" />
+		<rule game="mariokartwii" key="skipped" />
+		<rule game="otherGame" key="vr" max="5" />
+	</statRules>`
+	if err := os.WriteFile(path, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	SetRuleFile(path)
+	t.Cleanup(func() { SetRuleFile("") })
+
+	if len(statRules["mariokartwii"]) != 2 {
+		t.Fatalf("loaded rules %v", statRules)
+	}
+
+	key := playerDataKey{profileId: 600000001, gameName: "mariokartwii", ptype: 3, dindex: 0}
+	rejected := []string{
+		// Missing the required key
+		`\time\5`,
+		`\vr\0`,
+		`\vr\30001`,
+		`\vr\5000\time\-1`,
+		`\vr\abc`,
+	}
+	for _, data := range rejected {
+		data += "\x00"
+		if reply := send(t, g, setpdMessage(3, 0, 1, len(data), data)); !strings.HasPrefix(reply, `\setpdr\0`) {
+			t.Errorf("%q: got %q", data, reply)
+		}
+	}
+	if len(stored) != 0 {
+		t.Fatalf("stored %v", stored)
+	}
+
+	data := `\vr\5000\name\Mario` + "\x00"
+	if reply := send(t, g, setpdMessage(3, 0, 1, len(data), data)); !strings.HasPrefix(reply, `\setpdr\1`) {
+		t.Fatalf("setpd failed: %q", reply)
+	}
+
+	// The required key is already stored
+	data = `\time\100` + "\x00"
+	if reply := send(t, g, setpdMessage(3, 0, 1, len(data), data)); !strings.HasPrefix(reply, `\setpdr\1`) {
+		t.Fatalf("setpd failed: %q", reply)
+	}
+	if expected := `\vr\5000\name\Mario\time\100`; string(stored[key]) != expected {
+		t.Errorf("stored %q, expected %q", stored[key], expected)
+	}
+
+	// A file that fails to parse on reload keeps the rules
+	if err := os.WriteFile(path, []byte("<statRules><rule"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	SetRuleFile(path)
+	data = `\vr\0` + "\x00"
+	if reply := send(t, g, setpdMessage(3, 0, 1, len(data), data)); !strings.HasPrefix(reply, `\setpdr\0`) {
+		t.Errorf("rules dropped after a failed reload: %q", reply)
+	}
+
+	SetRuleFile("")
+	if reply := send(t, g, setpdMessage(3, 0, 1, len(data), data)); !strings.HasPrefix(reply, `\setpdr\1`) {
+		t.Errorf("rules still applied after being disabled: %q", reply)
+	}
+}
@@ -0,0 +1,169 @@
+package gamestats
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"wwfc/common"
+)
+
+// Score is a leaderboard score decoded from a game's persistent data
+type Score struct {
+	Board string
+	Value int64
+}
+
+// scoreDecoder extracts the leaderboard scores of one game from the data it stores with setpd
+type scoreDecoder struct {
+	// Lower scores rank first, e.g. race times
+	ascending bool
+	// The game uploads the data as files to SAKE too, like Mario Kart Wii's ghosts
+	files   bool
+	isBoard func(board string) bool
+	decode  func(ptype int, dindex int, data []byte) []Score
+}
+
+var (
+	// Games whose scores are in binary player data. Games storing key/value data have their
+	// leaderboards set in the config instead.
+	scoreDecoders = map[string]scoreDecoder{
+		"mariokartwii": {ascending: true, files: true, isBoard: isMKWTimeTrialBoard, decode: decodeMKWTimeTrial},
+	}
+
+	// Replaced in tests
+	storeScore = func(key playerDataKey, score Score, ascending bool, recorded time.Time) error {
+		return store.SetGamestatsScore(ctx, key.profileId, key.gameName, score.Board, ascending, score.Value, recorded)
+	}
+)
+
+// getScoreDecoder returns the decoder of the game's scores, either built in or for the key/value
+// leaderboards set in the config
+func getScoreDecoder(gameName string) (scoreDecoder, bool) {
+	if decoder, exists := scoreDecoders[gameName]; exists {
+		return decoder, true
+	}
+
+	game := common.GetGameInfoByName(gameName)
+	if game == nil || len(game.Leaderboards) == 0 {
+		return scoreDecoder{}, false
+	}
+
+	boards := game.Leaderboards
+	return scoreDecoder{
+		ascending: game.LeaderboardAscending,
+		isBoard: func(board string) bool {
+			return slices.Contains(boards, board)
+		},
+		decode: func(_ int, _ int, data []byte) []Score {
+			return decodeKeyValueScores(boards, data)
+		},
+	}, true
+}
+
+// decodeKeyValueScores reads the scores of the boards from key/value player data, a value that
+// isn't a number is skipped
+func decodeKeyValueScores(boards []string, data []byte) []Score {
+	pairs, err := parseKeyValues(string(data))
+	if err != nil {
+		return nil
+	}
+
+	var scores []Score
+	for _, pair := range pairs {
+		if !slices.Contains(boards, pair[0]) {
+			continue
+		}
+
+		value, err := strconv.ParseInt(pair[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		scores = append(scores, Score{Board: pair[0], Value: value})
+	}
+
+	return scores
+}
+
+// LeaderboardOrder returns whether lower scores rank first on the game's board. ok is false if
+// the game has no such board.
+func LeaderboardOrder(gameName string, board string) (ascending bool, ok bool) {
+	decoder, exists := getScoreDecoder(gameName)
+	if !exists || !decoder.isBoard(board) {
+		return false, false
+	}
+
+	return decoder.ascending, true
+}
+
+// recordScores updates the leaderboards with the scores in newly stored player data, so
+// rankings are read from the scores table rather than decoded on every request
+func recordScores(key playerDataKey, data []byte, recorded time.Time) error {
+	decoder, exists := getScoreDecoder(key.gameName)
+	if !exists {
+		return nil
+	}
+
+	for _, score := range decoder.decode(key.ptype, key.dindex, data) {
+		if err := storeScore(key, score, decoder.ascending, recorded); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FileScores returns the leaderboard scores in a file the game uploaded to SAKE, and whether
+// lower scores rank first. Mario Kart Wii uploads its time trial ghosts this way rather than
+// with setpd.
+func FileScores(gameName string, data []byte) ([]Score, bool) {
+	decoder, exists := scoreDecoders[gameName]
+	if !exists || !decoder.files {
+		return nil, false
+	}
+
+	return decoder.decode(0, 0, data), decoder.ascending
+}
+
+// Mario Kart Wii ghosts start with an RKG header, boards are named "tt" followed by the
+// course's internal ID
+const (
+	mkwGhostMagic      = "RKGD"
+	mkwGhostHeaderSize = 0x88
+	mkwCourseCount     = 32
+)
+
+func isMKWTimeTrialBoard(board string) bool {
+	if !strings.HasPrefix(board, "tt") {
+		return false
+	}
+
+	course, err := strconv.Atoi(board[2:])
+	return err == nil && course >= 0 && course < mkwCourseCount && board[2:] == strconv.Itoa(course)
+}
+
+// decodeMKWTimeTrial reads the finishing time in milliseconds and the course from a ghost header
+func decodeMKWTimeTrial(ptype int, dindex int, data []byte) []Score {
+	if len(data) < mkwGhostHeaderSize || string(data[:4]) != mkwGhostMagic {
+		return nil
+	}
+
+	// 7 bits minutes, 7 bits seconds, 10 bits milliseconds
+	packed := uint32(data[4])<<16 | uint32(data[5])<<8 | uint32(data[6])
+	minutes := int64(packed >> 17)
+	seconds := int64(packed>>10) & 0x7f
+	milliseconds := int64(packed) & 0x3ff
+	if seconds >= 60 || milliseconds >= 1000 {
+		return nil
+	}
+
+	course := int(data[7] >> 2)
+	if course >= mkwCourseCount {
+		return nil
+	}
+
+	return []Score{{
+		Board: "tt" + strconv.Itoa(course),
+		Value: (minutes*60+seconds)*1000 + milliseconds,
+	}}
+}
@@ -0,0 +1,104 @@
+package gamestats
+
+import (
+	"testing"
+	"time"
+	"wwfc/common"
+)
+
+// mkwGhost builds a ghost with the finishing time and course set in its RKG header
+func mkwGhost(minutes int, seconds int, milliseconds int, course int) []byte {
+	ghost := make([]byte, mkwGhostHeaderSize+0x100)
+	copy(ghost, mkwGhostMagic)
+	packed := uint32(minutes)<<17 | uint32(seconds)<<10 | uint32(milliseconds)
+	ghost[4], ghost[5], ghost[6] = byte(packed>>16), byte(packed>>8), byte(packed)
+	ghost[7] = byte(course<<2) | 0x01
+	return ghost
+}
+
+func TestDecodeMKWTimeTrial(t *testing.T) {
+	scores := decodeMKWTimeTrial(pdPublicReadWrite, 0, mkwGhost(1, 8, 733, 8))
+	if len(scores) != 1 || scores[0].Board != "tt8" || scores[0].Value != 68733 {
+		t.Errorf("got %+v", scores)
+	}
+
+	for _, data := range [][]byte{
+		mkwGhost(1, 60, 0, 8),
+		mkwGhost(1, 0, 1000, 8),
+		mkwGhost(1, 0, 0, 40),
+		mkwGhost(1, 0, 0, 8)[:mkwGhostHeaderSize-1],
+		append([]byte("RKGX"), mkwGhost(1, 0, 0, 8)[4:]...),
+	} {
+		if scores := decodeMKWTimeTrial(pdPublicReadWrite, 0, data); len(scores) != 0 {
+			t.Errorf("decoded %+v from invalid ghost", scores)
+		}
+	}
+}
+
+func TestLeaderboardOrder(t *testing.T) {
+	if ascending, ok := LeaderboardOrder("mariokartwii", "tt31"); !ascending || !ok {
+		t.Error("tt31 should rank lowest times first")
+	}
+
+	for _, board := range []string{"tt32", "tt-1", "tt01", "tt", "vr"} {
+		if _, ok := LeaderboardOrder("mariokartwii", board); ok {
+			t.Errorf("accepted board %q", board)
+		}
+	}
+
+	if _, ok := LeaderboardOrder("unknown", "tt0"); ok {
+		t.Error("accepted a game without leaderboards")
+	}
+}
+
+func TestSetpdRecordsScore(t *testing.T) {
+	fakePlayerDataStore(t)
+
+	var recorded []Score
+	storeScore = func(key playerDataKey, score Score, _ bool, _ time.Time) error {
+		if key.profileId != 600000001 || key.gameName != "mariokartwii" {
+			t.Errorf("score recorded for %+v", key)
+		}
+		recorded = append(recorded, score)
+		return nil
+	}
+
+	g := newTestSession()
+	ghost := string(mkwGhost(0, 58, 12, 3))
+	send(t, g, setpdMessage(pdPublicReadWrite, 4, 0, len(ghost), ghost))
+
+	if len(recorded) != 1 || recorded[0] != (Score{Board: "tt3", Value: 58012}) {
+		t.Errorf("recorded %+v", recorded)
+	}
+}
+
+func TestKeyValueLeaderboards(t *testing.T) {
+	fakePlayerDataStore(t)
+	common.ApplyGameConfig(common.Config{Games: []common.GameConfig{{Name: "tetrisds", Leaderboards: "lines, time", LeaderboardOrder: common.LeaderboardAscending}}})
+	t.Cleanup(func() { common.ApplyGameConfig(common.Config{}) })
+
+	if ascending, ok := LeaderboardOrder("tetrisds", "lines"); !ascending || !ok {
+		t.Error("lines should be a board ranking the lowest first")
+	}
+	if _, ok := LeaderboardOrder("tetrisds", "name"); ok {
+		t.Error("accepted a key that isn't a board")
+	}
+
+	var recorded []Score
+	storeScore = func(key playerDataKey, score Score, ascending bool, _ time.Time) error {
+		if !ascending {
+			t.Error("score recorded as descending")
+		}
+		recorded = append(recorded, score)
+		return nil
+	}
+
+	g := newTestSession()
+	g.GameName = "tetrisds"
+	data := `\name\Mario\lines\120\time\abc` + "\x00"
+	send(t, g, setpdMessage(pdPublicReadWrite, 0, 1, len(data), data))
+
+	if len(recorded) != 1 || recorded[0] != (Score{Board: "lines", Value: 120}) {
+		t.Errorf("recorded %+v", recorded)
+	}
+}
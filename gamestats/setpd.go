@@ -4,12 +4,16 @@ import (
 	"strconv"
 	"time"
 	"wwfc/common"
+	"wwfc/database"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
 )
 
 func (g *GameStatsSession) setpd(command common.GameSpyCommand) {
-	g.Write(common.GameSpyCommand{
+	reply := common.GameSpyCommand{
 		Command:      "setpdr",
-		CommandValue: "1",
+		CommandValue: "0",
 		OtherValues: map[string]string{
 			"lid":    strconv.Itoa(g.LoginID),
 			"pid":    command.OtherValues["pid"],
@@ -17,5 +21,81 @@ func (g *GameStatsSession) setpd(command common.GameSpyCommand) {
 			"length": "0",
 			"data":   `\\`,
 		},
-	})
+	}
+
+	pid, err := strconv.ParseUint(command.OtherValues["pid"], 10, 32)
+	if err != nil || uint32(pid) != g.User.ProfileId {
+		logging.Error(g.ModuleName, "Attempt to set player data of another profile:", aurora.Cyan(command.OtherValues["pid"]))
+		g.Write(reply)
+		return
+	}
+
+	ptype, err1 := strconv.Atoi(command.OtherValues["ptype"])
+	dindex, err2 := strconv.Atoi(command.OtherValues["dindex"])
+	if err1 != nil || err2 != nil || dindex < 0 {
+		logging.Error(g.ModuleName, "Invalid player data type or index:", aurora.Cyan(command.OtherValues["ptype"]), aurora.Cyan(command.OtherValues["dindex"]))
+		g.Write(reply)
+		return
+	}
+
+	if ptype != pdPrivateReadWrite && ptype != pdPublicReadWrite {
+		logging.Error(g.ModuleName, "Attempt to set read-only player data type", aurora.Cyan(ptype))
+		g.Write(reply)
+		return
+	}
+
+	key := playerDataKey{profileId: g.User.ProfileId, gameName: g.GameName, ptype: ptype, dindex: dindex}
+	data := []byte(command.OtherValues["data"])
+
+	if command.OtherValues["kv"] == "1" {
+		stored, _, err := getPlayerData(key)
+		if err != nil && err != database.ErrNotFound {
+			logging.Error(g.ModuleName, "Failed to read player data:", err)
+			g.Write(reply)
+			return
+		}
+
+		data, err = mergeKeyValues(stored, command.OtherValues["data"])
+		if err != nil {
+			logging.Error(g.ModuleName, "Rejected player data for index", aurora.Cyan(dindex).String()+":", err)
+			g.Write(reply)
+			return
+		}
+
+		if err := checkStatRules(g.GameName, command.OtherValues["data"], data); err != nil {
+			logging.Warn(g.ModuleName, "Rejected player data from profile", aurora.Cyan(g.User.ProfileId), "for index", aurora.Cyan(dindex).String()+":", err)
+			g.Write(reply)
+			return
+		}
+	} else if len(data) > maxPlayerDataSize {
+		logging.Error(g.ModuleName, "Rejected player data for index", aurora.Cyan(dindex).String()+":", errPlayerDataTooLarge)
+		g.Write(reply)
+		return
+	}
+
+	modified := time.Now().Truncate(time.Second)
+	if common.IsReplaying(ServerName, g.ConnIndex) {
+		logging.Info(g.ModuleName, "Not storing", aurora.Cyan(len(data)), "bytes of player data from a replay")
+		reply.CommandValue = "1"
+		reply.OtherValues["mod"] = strconv.FormatInt(modified.Unix(), 10)
+		g.Write(reply)
+		return
+	}
+
+	if err := setPlayerData(key, data, modified); err != nil {
+		logging.Error(g.ModuleName, "Failed to store player data:", err)
+		g.Write(reply)
+		return
+	}
+
+	logging.Info(g.ModuleName, "Stored", aurora.Cyan(len(data)), "bytes of player data at type", aurora.Cyan(ptype), "index", aurora.Cyan(dindex))
+
+	// The data is stored either way, a missing score only affects the leaderboards
+	if err := recordScores(key, data, modified); err != nil {
+		logging.Error(g.ModuleName, "Failed to record leaderboard score:", err)
+	}
+
+	reply.CommandValue = "1"
+	reply.OtherValues["mod"] = strconv.FormatInt(modified.Unix(), 10)
+	g.Write(reply)
 }
@@ -45,7 +45,7 @@ func HandleWebRequest(w http.ResponseWriter, r *http.Request) {
 		subPath = path[slashIndex:]
 	}
 
-	game := common.GetGameInfoByName(gameName)
+	game := common.CheckGame(moduleName, gameName, common.GameServiceGameStats)
 	if game == nil {
 		replyHTTPError(w, http.StatusNotFound, "404 Not Found")
 		return
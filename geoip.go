@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wwfc/common"
+	"wwfc/geoip"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+type geoIPRule struct {
+	allow map[string]bool
+	block map[string]bool
+}
+
+type geoIPFilter struct {
+	reader       *geoip.Reader
+	allowUnknown bool
+	rules        map[string]geoIPRule
+}
+
+var (
+	// nil when no server has country rules
+	geoIPFilterState atomic.Pointer[geoIPFilter]
+
+	geoIPBlocked      = map[string]uint64{}
+	geoIPBlockedMutex sync.Mutex
+)
+
+func parseCountryList(list string) map[string]bool {
+	countries := map[string]bool{}
+	for _, country := range strings.Split(list, ",") {
+		country = strings.ToUpper(strings.TrimSpace(country))
+		if country != "" {
+			countries[country] = true
+		}
+	}
+
+	return countries
+}
+
+// loadGeoIPFilter opens the GeoIP database and builds the per-server country rules from the config
+func loadGeoIPFilter(config common.Config) (*geoIPFilter, error) {
+	rules := map[string]geoIPRule{}
+	for _, server := range config.Servers {
+		if server.AllowCountries == "" && server.BlockCountries == "" {
+			continue
+		}
+
+		if server.AllowCountries != "" && server.BlockCountries != "" {
+			return nil, errors.New("server " + server.Name + " has both allowCountries and blockCountries")
+		}
+
+		rules[server.Name] = geoIPRule{
+			allow: parseCountryList(server.AllowCountries),
+			block: parseCountryList(server.BlockCountries),
+		}
+	}
+
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	if config.GeoIPDatabase == "" {
+		return nil, errors.New("country rules are set but geoIPDatabase is not")
+	}
+
+	reader, err := geoip.Open(config.GeoIPDatabase)
+	if err != nil {
+		return nil, errors.New("failed to open GeoIP database " + config.GeoIPDatabase + ": " + err.Error())
+	}
+
+	logging.Notice("FRONTEND", "Loaded GeoIP database", aurora.BrightCyan(config.GeoIPDatabase), "type", aurora.Cyan(reader.DatabaseType))
+
+	return &geoIPFilter{
+		reader:       reader,
+		allowUnknown: *config.GeoIPAllowUnknown,
+		rules:        rules,
+	}, nil
+}
+
+// checkGeoIP returns false if connections from the address to the server are blocked by its country rules
+func checkGeoIP(server string, addr net.Addr) bool {
+	filter := geoIPFilterState.Load()
+	if filter == nil {
+		return true
+	}
+
+	rule, ok := filter.rules[server]
+	if !ok {
+		return true
+	}
+
+	var country string
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		var err error
+		country, err = filter.reader.Country(tcpAddr.IP)
+		if err != nil {
+			logging.Warn("FRONTEND", "GeoIP lookup failed for", aurora.BrightCyan(addr.String()), err)
+		}
+	}
+
+	var allowed bool
+	switch {
+	case country == "":
+		allowed = filter.allowUnknown
+	case len(rule.allow) != 0:
+		allowed = rule.allow[country]
+	default:
+		allowed = !rule.block[country]
+	}
+
+	if !allowed {
+		if country == "" {
+			country = "unknown"
+		}
+
+		logging.Info("FRONTEND", "Blocked connection from", aurora.BrightCyan(addr.String()), "("+country+") to", aurora.BrightCyan(server))
+
+		geoIPBlockedMutex.Lock()
+		geoIPBlocked[server]++
+		geoIPBlockedMutex.Unlock()
+	}
+
+	return allowed
+}
+
+// RPCFrontendPacket.GeoIPBlocked is called by an external program to get the number of blocked connections per server
+func (r *RPCFrontendPacket) GeoIPBlocked(_ struct{}, reply *map[string]uint64) error {
+	geoIPBlockedMutex.Lock()
+	defer geoIPBlockedMutex.Unlock()
+
+	result := map[string]uint64{}
+	for server, count := range geoIPBlocked {
+		result[server] = count
+	}
+
+	*reply = result
+	return nil
+}
+
+// RPCFrontendPacket.ReloadConfig is called by an external program to reload the frontend's
+// runtime settings from the config file: the GeoIP filter, the allow list, the send timeout,
+// backpressure and the log levels.
+// The backend is told to reload its log levels too.
+func (r *RPCFrontendPacket) ReloadConfig(_ struct{}, _ *struct{}) (err error) {
+	defer func() {
+		// GetConfig panics on a bad config file, don't take the frontend down with it
+		if r := recover(); r != nil {
+			logging.Error("FRONTEND", "Failed to reload config:", r)
+			err = errors.New("failed to read config")
+		}
+	}()
+
+	newConfig := common.GetConfig()
+	filter, err := loadGeoIPFilter(newConfig)
+	if err != nil {
+		logging.Error("FRONTEND", "Failed to reload config:", err)
+		return err
+	}
+
+	allowed, err := loadAllowList(newConfig, gameSpyServers(newConfig))
+	if err != nil {
+		logging.Error("FRONTEND", "Failed to reload config:", err)
+		return err
+	}
+
+	geoIPFilterState.Store(filter)
+	allowListState.Store(allowed)
+	sendTimeout.Store(int64(time.Duration(*newConfig.SendTimeout) * time.Second))
+	sendQueueLimit.Store(int64(*newConfig.SendQueueLimit))
+	applyBackpressureConfig(newConfig)
+	common.ApplyLogLevels(newConfig)
+	logging.Notice("FRONTEND", "Reloaded config")
+
+	reloadBackendConfig()
+	return nil
+}
+
+// reloadBackendConfig forwards a config reload to the backend. A backend that is restarting
+// reads the config when it starts, so it's skipped rather than waiting for it.
+func reloadBackendConfig() {
+	if !rpcMutex.TryRLock() {
+		logging.Warn("FRONTEND", "Backend is restarting, not reloading its config")
+		return
+	}
+	defer rpcMutex.RUnlock()
+
+	if rpcClient == nil {
+		return
+	}
+
+	if err := rpcClient.Call("RPCPacket.ReloadConfig", struct{}{}, nil); err != nil {
+		logging.Error("FRONTEND", "Failed to reload backend config:", err)
+	}
+}
@@ -0,0 +1,398 @@
+// Minimal reader for MaxMind DB (mmdb) files, only what's needed to look up countries.
+// Format specification: https://maxmind.github.io/MaxMind-DB/
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"os"
+)
+
+var (
+	ErrInvalidDatabase = errors.New("invalid mmdb database")
+	ErrIPv6Lookup      = errors.New("cannot look up an IPv6 address in an IPv4 database")
+
+	metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+)
+
+const (
+	dataSeparatorSize = 16
+
+	// Largest metadata section searched for the marker
+	maxMetadataSize = 128 * 1024
+)
+
+const (
+	typeExtended  = 0
+	typePointer   = 1
+	typeString    = 2
+	typeDouble    = 3
+	typeBytes     = 4
+	typeUint16    = 5
+	typeUint32    = 6
+	typeMap       = 7
+	typeInt32     = 8
+	typeUint64    = 9
+	typeUint128   = 10
+	typeArray     = 11
+	typeContainer = 12
+	typeEndMarker = 13
+	typeBool      = 14
+	typeFloat     = 15
+)
+
+type Reader struct {
+	buffer     []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+
+	DatabaseType string
+	BuildEpoch   uint64
+}
+
+// Open reads the whole database into memory
+func Open(path string) (*Reader, error) {
+	buffer, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return FromBytes(buffer)
+}
+
+func FromBytes(buffer []byte) (*Reader, error) {
+	searchStart := max(0, len(buffer)-maxMetadataSize)
+	markerIndex := bytes.LastIndex(buffer[searchStart:], metadataMarker)
+	if markerIndex < 0 {
+		return nil, ErrInvalidDatabase
+	}
+
+	metadataStart := searchStart + markerIndex + len(metadataMarker)
+	metadata, _, err := decoder{buffer[metadataStart:]}.decode(0)
+	if err != nil {
+		return nil, err
+	}
+
+	metadataMap, ok := metadata.(map[string]any)
+	if !ok {
+		return nil, ErrInvalidDatabase
+	}
+
+	r := &Reader{buffer: buffer}
+	r.nodeCount = uint(toUint64(metadataMap["node_count"]))
+	r.recordSize = uint(toUint64(metadataMap["record_size"]))
+	r.ipVersion = uint(toUint64(metadataMap["ip_version"]))
+	r.DatabaseType, _ = metadataMap["database_type"].(string)
+	r.BuildEpoch = toUint64(metadataMap["build_epoch"])
+
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, ErrInvalidDatabase
+	}
+
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, ErrInvalidDatabase
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+dataSeparatorSize > uint(searchStart+markerIndex) {
+		return nil, ErrInvalidDatabase
+	}
+
+	r.data = buffer[treeSize+dataSeparatorSize : searchStart+markerIndex]
+
+	// IPv4 addresses in an IPv6 database live under ::/96
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.readNode(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// Lookup returns the record for the IP, or nil if the IP isn't in the database
+func (r *Reader) Lookup(ip net.IP) (any, error) {
+	node := uint(0)
+	bitCount := 128
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bitCount = 32
+		node = r.ipv4Start
+	} else if r.ipVersion == 4 {
+		return nil, ErrIPv6Lookup
+	}
+
+	for i := 0; i < bitCount && node < r.nodeCount; i++ {
+		bit := (ip[i>>3] >> (7 - (i & 7))) & 1
+		node = r.readNode(node, uint(bit))
+	}
+
+	if node == r.nodeCount {
+		// Not found
+		return nil, nil
+	}
+
+	if node < r.nodeCount {
+		return nil, ErrInvalidDatabase
+	}
+
+	offset := node - r.nodeCount - dataSeparatorSize
+	if offset >= uint(len(r.data)) {
+		return nil, ErrInvalidDatabase
+	}
+
+	value, _, err := decoder{r.data}.decode(offset)
+	return value, err
+}
+
+// Country returns the ISO 3166-1 country code for the IP, or an empty string if it isn't known
+func (r *Reader) Country(ip net.IP) (string, error) {
+	record, err := r.Lookup(ip)
+	if err != nil || record == nil {
+		return "", err
+	}
+
+	recordMap, ok := record.(map[string]any)
+	if !ok {
+		return "", nil
+	}
+
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := recordMap[key].(map[string]any); ok {
+			if isoCode, ok := country["iso_code"].(string); ok && isoCode != "" {
+				return isoCode, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+func (r *Reader) readNode(node uint, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		offset := node*6 + bit*3
+		b := r.buffer[offset : offset+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+
+	case 28:
+		offset := node * 7
+		b := r.buffer[offset : offset+7]
+		if bit == 0 {
+			return uint(b[3]>>4)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+
+	default:
+		offset := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(r.buffer[offset : offset+4]))
+	}
+}
+
+type decoder struct {
+	buffer []byte
+}
+
+func (d decoder) bytes(offset uint, size uint) ([]byte, error) {
+	if offset+size > uint(len(d.buffer)) || offset+size < offset {
+		return nil, ErrInvalidDatabase
+	}
+
+	return d.buffer[offset : offset+size], nil
+}
+
+// decode decodes the value at the offset, returning the value and the offset after it
+func (d decoder) decode(offset uint) (any, uint, error) {
+	return d.decodeDepth(offset, 0)
+}
+
+func (d decoder) decodeDepth(offset uint, depth int) (any, uint, error) {
+	if depth > 32 {
+		return nil, 0, ErrInvalidDatabase
+	}
+
+	ctrl, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+
+	dataType := uint(ctrl[0] >> 5)
+	if dataType == typePointer {
+		pointer, next, err := d.decodePointer(ctrl[0], offset)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// Pointers to pointers are not allowed, but the value is decoded at the target
+		value, _, err := d.decodeDepth(pointer, depth+1)
+		return value, next, err
+	}
+
+	if dataType == typeExtended {
+		extended, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset++
+		dataType = 7 + uint(extended[0])
+	}
+
+	size := uint(ctrl[0] & 0x1f)
+	if size >= 29 {
+		extraLength := size - 28
+		extra, err := d.bytes(offset, extraLength)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += extraLength
+
+		switch size {
+		case 29:
+			size = 29 + uint(extra[0])
+		case 30:
+			size = 285 + (uint(extra[0])<<8 | uint(extra[1]))
+		default:
+			size = 65821 + (uint(extra[0])<<16 | uint(extra[1])<<8 | uint(extra[2]))
+		}
+	}
+
+	switch dataType {
+	case typeMap:
+		result := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decodeDepth(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, 0, ErrInvalidDatabase
+			}
+
+			value, next, err := d.decodeDepth(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			result[keyString] = value
+			offset = next
+		}
+		return result, offset, nil
+
+	case typeArray:
+		result := make([]any, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decodeDepth(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			result = append(result, value)
+			offset = next
+		}
+		return result, offset, nil
+
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	payload, err := d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+
+	switch dataType {
+	case typeString:
+		return string(payload), offset, nil
+
+	case typeBytes:
+		return append([]byte{}, payload...), offset, nil
+
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, ErrInvalidDatabase
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(payload)), offset, nil
+
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, ErrInvalidDatabase
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(payload)), offset, nil
+
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, ErrInvalidDatabase
+		}
+
+		var value uint64
+		for _, b := range payload {
+			value = value<<8 | uint64(b)
+		}
+		return value, offset, nil
+
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, ErrInvalidDatabase
+		}
+
+		var value uint32
+		for _, b := range payload {
+			value = value<<8 | uint32(b)
+		}
+		return int32(value), offset, nil
+
+	case typeUint128:
+		// Not needed for country lookups, keep the raw bytes
+		return append([]byte{}, payload...), offset, nil
+
+	default:
+		return nil, 0, ErrInvalidDatabase
+	}
+}
+
+func (d decoder) decodePointer(ctrl byte, offset uint) (uint, uint, error) {
+	pointerSize := uint((ctrl>>3)&0x3) + 1
+	b, err := d.bytes(offset, pointerSize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	value := uint(ctrl & 0x7)
+	var pointer uint
+	switch pointerSize {
+	case 1:
+		pointer = value<<8 | uint(b[0])
+	case 2:
+		pointer = (value<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+	case 3:
+		pointer = (value<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+	default:
+		pointer = uint(binary.BigEndian.Uint32(b))
+	}
+
+	return pointer, offset + pointerSize, nil
+}
+
+func toUint64(value any) uint64 {
+	switch v := value.(type) {
+	case uint64:
+		return v
+	case int32:
+		return uint64(v)
+	default:
+		return 0
+	}
+}
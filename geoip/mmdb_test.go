@@ -0,0 +1,257 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// Just enough of an mmdb writer to build test databases
+
+func encodeControl(buffer *bytes.Buffer, dataType int, size int) {
+	var ctrl byte
+	if dataType > 7 {
+		ctrl = 0
+	} else {
+		ctrl = byte(dataType << 5)
+	}
+
+	switch {
+	case size < 29:
+		ctrl |= byte(size)
+	case size < 285:
+		ctrl |= 29
+	default:
+		ctrl |= 30
+	}
+
+	buffer.WriteByte(ctrl)
+	if dataType > 7 {
+		buffer.WriteByte(byte(dataType - 7))
+	}
+
+	switch {
+	case size < 29:
+	case size < 285:
+		buffer.WriteByte(byte(size - 29))
+	default:
+		buffer.WriteByte(byte((size - 285) >> 8))
+		buffer.WriteByte(byte(size - 285))
+	}
+}
+
+func encodeValue(buffer *bytes.Buffer, value any) {
+	switch v := value.(type) {
+	case string:
+		encodeControl(buffer, typeString, len(v))
+		buffer.WriteString(v)
+	case uint16:
+		encodeControl(buffer, typeUint16, 2)
+		binary.Write(buffer, binary.BigEndian, v)
+	case uint32:
+		encodeControl(buffer, typeUint32, 4)
+		binary.Write(buffer, binary.BigEndian, v)
+	case uint64:
+		encodeControl(buffer, typeUint64, 8)
+		binary.Write(buffer, binary.BigEndian, v)
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		encodeControl(buffer, typeBool, size)
+	case []any:
+		encodeControl(buffer, typeArray, len(v))
+		for _, item := range v {
+			encodeValue(buffer, item)
+		}
+	case map[string]any:
+		encodeControl(buffer, typeMap, len(v))
+		for key, item := range v {
+			encodeValue(buffer, key)
+			encodeValue(buffer, item)
+		}
+	default:
+		panic("unsupported type")
+	}
+}
+
+type testNetwork struct {
+	network string
+	record  any
+}
+
+func buildDatabase(t *testing.T, ipVersion int, recordSize int, networks []testNetwork) []byte {
+	const (
+		empty = -1
+	)
+
+	// Records are node indices, empty, or -2-n for data entry n
+	nodes := [][2]int{{empty, empty}}
+	data := &bytes.Buffer{}
+	var dataOffsets []int
+
+	for i, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network.network)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ip := ipNet.IP
+		ones, _ := ipNet.Mask.Size()
+		if ipVersion == 6 && ip.To4() != nil {
+			// IPv4 networks go under ::/96, not the ::ffff:0:0/96 mapped range
+			ip = append(make(net.IP, 12), ip.To4()...)
+			ones += 96
+		}
+
+		dataOffsets = append(dataOffsets, data.Len())
+		encodeValue(data, network.record)
+
+		node := 0
+		for bitIndex := 0; bitIndex < ones; bitIndex++ {
+			bit := (ip[bitIndex>>3] >> (7 - (bitIndex & 7))) & 1
+			if bitIndex == ones-1 {
+				nodes[node][bit] = -2 - i
+				break
+			}
+
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	nodeCount := len(nodes)
+	resolve := func(record int) uint32 {
+		switch {
+		case record == empty:
+			return uint32(nodeCount)
+		case record < empty:
+			return uint32(nodeCount + dataSeparatorSize + dataOffsets[-2-record])
+		default:
+			return uint32(record)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	for _, node := range nodes {
+		left, right := resolve(node[0]), resolve(node[1])
+		switch recordSize {
+		case 24:
+			out.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)})
+		case 28:
+			out.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte((left>>24)<<4 | (right>>24)&0xf), byte(right >> 16), byte(right >> 8), byte(right)})
+		case 32:
+			binary.Write(out, binary.BigEndian, left)
+			binary.Write(out, binary.BigEndian, right)
+		}
+	}
+
+	out.Write(make([]byte, dataSeparatorSize))
+	out.Write(data.Bytes())
+	out.Write(metadataMarker)
+	encodeValue(out, map[string]any{
+		"node_count":    uint32(nodeCount),
+		"record_size":   uint16(recordSize),
+		"ip_version":    uint16(ipVersion),
+		"database_type": "Test-Country",
+		"build_epoch":   uint64(1700000000),
+		"languages":     []any{"en"},
+	})
+
+	return out.Bytes()
+}
+
+func country(code string) map[string]any {
+	return map[string]any{
+		"country": map[string]any{"iso_code": code, "is_in_european_union": code == "DE"},
+	}
+}
+
+func TestCountryLookup(t *testing.T) {
+	networks := []testNetwork{
+		{"1.2.3.0/24", country("US")},
+		{"5.6.0.0/16", country("DE")},
+		{"9.9.9.9/32", map[string]any{"registered_country": map[string]any{"iso_code": "JP"}}},
+		{"2001:db8::/32", country("CA")},
+	}
+
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{"1.2.3.4", "US"},
+		{"1.2.3.255", "US"},
+		{"1.2.4.1", ""},
+		{"5.6.200.1", "DE"},
+		{"9.9.9.9", "JP"},
+		{"9.9.9.8", ""},
+		{"127.0.0.1", ""},
+	}
+
+	for _, ipVersion := range []int{4, 6} {
+		for _, recordSize := range []int{24, 28, 32} {
+			dbNetworks := networks
+			if ipVersion == 4 {
+				dbNetworks = networks[:3]
+			}
+
+			reader, err := FromBytes(buildDatabase(t, ipVersion, recordSize, dbNetworks))
+			if err != nil {
+				t.Fatalf("v%d/%d: %s", ipVersion, recordSize, err)
+			}
+
+			if reader.DatabaseType != "Test-Country" || reader.BuildEpoch != 1700000000 {
+				t.Errorf("v%d/%d: bad metadata %q %d", ipVersion, recordSize, reader.DatabaseType, reader.BuildEpoch)
+			}
+
+			for _, test := range tests {
+				code, err := reader.Country(net.ParseIP(test.ip))
+				if err != nil {
+					t.Errorf("v%d/%d %s: %s", ipVersion, recordSize, test.ip, err)
+				} else if code != test.expected {
+					t.Errorf("v%d/%d %s: got %q, expected %q", ipVersion, recordSize, test.ip, code, test.expected)
+				}
+			}
+
+			if ipVersion == 6 {
+				code, err := reader.Country(net.ParseIP("2001:db8::1"))
+				if err != nil || code != "CA" {
+					t.Errorf("v6/%d: IPv6 lookup got %q, %v", recordSize, code, err)
+				}
+			} else if _, err := reader.Country(net.ParseIP("2001:db8::1")); err != ErrIPv6Lookup {
+				t.Errorf("v4/%d: expected ErrIPv6Lookup, got %v", recordSize, err)
+			}
+		}
+	}
+}
+
+func TestPointers(t *testing.T) {
+	// Two records sharing a string through a pointer
+	data := &bytes.Buffer{}
+	encodeValue(data, "shared")
+	pointerTarget := 0
+	mapOffset := data.Len()
+	encodeControl(data, typeMap, 1)
+	encodeValue(data, "name")
+	data.Write([]byte{typePointer << 5, byte(pointerTarget)})
+
+	value, _, err := decoder{data.Bytes()}.decode(uint(mapOffset))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value.(map[string]any)["name"] != "shared" {
+		t.Errorf("pointer decoded to %v", value)
+	}
+}
+
+func TestInvalidDatabase(t *testing.T) {
+	if _, err := FromBytes([]byte("not a database")); err != ErrInvalidDatabase {
+		t.Errorf("expected ErrInvalidDatabase, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package gpcm
+
+import (
+	"wwfc/common"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// BroadcastResult is how many logged in players a broadcast was sent to
+type BroadcastResult struct {
+	Sent   int
+	Failed int
+}
+
+// BroadcastMessage sends a message to every logged in player, encoded like the message of the day.
+// A send failing to one player is logged and doesn't stop the others.
+func BroadcastMessage(text string) BroadcastResult {
+	payload := []byte(common.CreateGameSpyMessage(common.GameSpyCommand{
+		Command:      "wwfc_msg",
+		CommandValue: encodeMessage(text),
+	}))
+
+	// Sending waits on the frontend, so the sessions aren't locked for it
+	type recipient struct {
+		profileId  uint32
+		connIndex  uint64
+		moduleName string
+	}
+
+	mutex.Lock()
+	recipients := make([]recipient, 0, len(sessions))
+	for profileId, session := range sessions {
+		if session.LoggedIn {
+			recipients = append(recipients, recipient{profileId, session.ConnIndex, session.ModuleName})
+		}
+	}
+	mutex.Unlock()
+
+	var result BroadcastResult
+	for _, recipient := range recipients {
+		if err := sendPacket(ServerName, recipient.connIndex, payload); err != nil {
+			logging.Error(recipient.moduleName, "Failed to send broadcast:", err)
+			result.Failed++
+			continue
+		}
+		result.Sent++
+	}
+
+	logging.Notice("GPCM", "Broadcast sent to", aurora.Cyan(result.Sent), "players,", aurora.Cyan(result.Failed), "failed:", aurora.Cyan(text))
+	return result
+}
@@ -35,6 +35,8 @@ type GPError struct {
 	ErrorString string
 	Fatal       bool
 	WWFCMessage WWFCErrorMessage
+	// Formatted into the message after the error code and device ID, starting at %[3]
+	WWFCMessageArgs []interface{}
 }
 
 func MakeGPError(errorCode int, errorString string, fatal bool) GPError {
@@ -73,6 +75,8 @@ var (
 	ErrLoginBadPreAuth         = MakeGPError(0x010A, "There was an error validating the pre-authentication.", true)
 	ErrLoginLoginTicketInvalid = MakeGPError(0x010B, "The login ticket was unable to be validated.", true)
 	ErrLoginLoginTicketExpired = MakeGPError(0x010C, "The login ticket had expired and could not be used.", true)
+	// Sent to the players of a disabled game, before there's enough login info for a translated message
+	ErrLoginGameUnavailable = MakeGPError(0x0100, common.GameUnavailableMessage, true)
 
 	// New user errors
 	ErrNewUser                  = MakeGPError(0x0200, "There was an error creating a new user.", true)
@@ -191,14 +195,14 @@ var (
 		},
 	}
 
+	// %[3]s is the reason wrapped with common.WrapBanReason
 	WWFCMsgProfileBannedTOS = WWFCErrorMessage{
 		ErrorCode: 22002,
 		MessageRMC: map[byte]string{
 			LangEnglish: "" +
-				"You are banned from WiiLink WFC\n" +
-				"due to a violation of the\n" +
-				"Terms of Service.\n" +
-				"Visit newwfc.xyz/tos\n" +
+				"You are permanently banned\n" +
+				"from NewWFC. Reason:\n" +
+				"%[3]s\n" +
 				"\n" +
 				"Error Code: %[1]d\n" +
 				"Support Info: NG%08[2]x",
@@ -247,6 +251,20 @@ var (
 		},
 	}
 
+	// %[3]s is the reason wrapped with common.WrapBanReason, %[4]s is the end of the suspension
+	WWFCMsgProfileSuspended = WWFCErrorMessage{
+		ErrorCode: 22013,
+		MessageRMC: map[byte]string{
+			LangEnglish: "" +
+				"You are suspended from NewWFC\n" +
+				"until %[4]s.\n" +
+				"%[3]s\n" +
+				"\n" +
+				"Error Code: %[1]d\n" +
+				"Support Info: NG%08[2]x",
+		},
+	}
+
 	WWFCMsgKickedGeneric = WWFCErrorMessage{
 		ErrorCode: 22004,
 		MessageRMC: map[byte]string{
@@ -351,6 +369,42 @@ var (
 				"Error Code: %[1]d",
 		},
 	}
+
+	WWFCMsgNotAllowlisted = WWFCErrorMessage{
+		ErrorCode: 22010,
+		MessageRMC: map[byte]string{
+			LangEnglish: "" +
+				"This server is currently only\n" +
+				"open to approved players.\n" +
+				"\n" +
+				"Error Code: %[1]d\n" +
+				"Support Info: NG%08[2]x",
+		},
+	}
+
+	WWFCMsgLoggedInElsewhere = WWFCErrorMessage{
+		ErrorCode: 22011,
+		MessageRMC: map[byte]string{
+			LangEnglish: "" +
+				"You were disconnected because\n" +
+				"your profile logged in to\n" +
+				"NewWFC somewhere else.\n" +
+				"\n" +
+				"Error Code: %[1]d",
+		},
+	}
+
+	WWFCMsgAlreadyLoggedIn = WWFCErrorMessage{
+		ErrorCode: 22012,
+		MessageRMC: map[byte]string{
+			LangEnglish: "" +
+				"Your profile is already\n" +
+				"logged in to NewWFC\n" +
+				"somewhere else.\n" +
+				"\n" +
+				"Error Code: %[1]d",
+		},
+	}
 )
 
 func (err GPError) GetMessage() string {
@@ -392,7 +446,8 @@ func (err GPError) GetMessageTranslate(gameName string, region byte, lang byte,
 				errMsg = err.WWFCMessage.MessageRMC[LangEnglish]
 			}
 
-			errMsg = fmt.Sprintf(errMsg, err.WWFCMessage.ErrorCode, ngid)
+			args := append([]interface{}{err.WWFCMessage.ErrorCode, ngid}, err.WWFCMessageArgs...)
+			errMsg = fmt.Sprintf(errMsg, args...)
 			errMsgUTF16 := utf16.Encode([]rune(errMsg))
 			errMsgByteArray := common.UTF16ToByteArray(errMsgUTF16)
 
@@ -404,6 +459,35 @@ func (err GPError) GetMessageTranslate(gameName string, region byte, lang byte,
 	return common.CreateGameSpyMessage(command)
 }
 
+// banError is the login error for a banned profile. The GameSpy error string has the reason on one
+// line for other games, Mario Kart Wii gets it wrapped to fit its message box.
+func banError(ban *common.BanInfo) GPError {
+	reason := common.CleanBanReason(ban.Reason)
+	if reason == "" {
+		reason = "Visit newwfc.xyz/tos"
+	}
+	wrapped := common.WrapBanReason(reason, common.BanReasonColumns, common.BanReasonLines)
+
+	if ban.Presentation() == common.BanPresentationSuspended {
+		until := common.FormatBanExpiry(ban.Expires)
+		return GPError{
+			ErrorCode:       ErrLogin.ErrorCode,
+			ErrorString:     "The profile is suspended from the service until " + until + ". Reason: " + reason,
+			Fatal:           true,
+			WWFCMessage:     WWFCMsgProfileSuspended,
+			WWFCMessageArgs: []interface{}{wrapped, until},
+		}
+	}
+
+	return GPError{
+		ErrorCode:       ErrLogin.ErrorCode,
+		ErrorString:     "The profile is banned from the service. Reason: " + reason,
+		Fatal:           true,
+		WWFCMessage:     WWFCMsgProfileBannedTOS,
+		WWFCMessageArgs: []interface{}{wrapped},
+	}
+}
+
 func (g *GameSpySession) replyError(err GPError) {
 	logging.Error(g.ModuleName, "Reply error:", err.ErrorString)
 	if !g.LoginInfoSet {
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"strconv"
 	"strings"
+	"time"
 	"wwfc/common"
 	"wwfc/logging"
 	"wwfc/qr2"
@@ -71,6 +72,91 @@ const (
 	logOutMessage = "|s|0|ss|Offline|ls||ip|0|p|0|qm|0"
 )
 
+var (
+	// How long to hold back the offline status after a disconnect, so a quick
+	// reconnect (e.g. switching games) doesn't flap the status for friends.
+	// Replaced in tests.
+	logoutStatusDelay = 5 * time.Second
+
+	// Offline status pushes waiting for logoutStatusDelay, keyed by profile ID
+	pendingLogouts = map[uint32]*pendingLogout{}
+)
+
+// Token bucket for adding new friends, kept per profile so reconnecting doesn't refill it
+type friendRequestBucket struct {
+	tokens  float64
+	updated time.Time
+	// When the bucket is full again, from then on it's the same as having no bucket
+	full time.Time
+}
+
+var (
+	friendRequestBuckets = map[uint32]*friendRequestBucket{}
+	// Full buckets are removed at most once a minute
+	friendRequestBucketsPruned time.Time
+)
+
+type pendingLogout struct {
+	session *GameSpySession
+	timer   *time.Timer
+}
+
+// Take a token for adding a new friend. The bucket holds maxFriends tokens so
+// re-adding the whole list on login is never limited, and refills at
+// friendRequestsPerMinute, or the game's override. Without a friend limit it holds a
+// minute's worth of requests. Expects the global mutex to already be locked.
+func (g *GameSpySession) takeFriendRequestToken() bool {
+	rate := friendRequestsPerMinute
+	if game := common.GetGameInfoByName(g.GameName); game != nil && game.FriendRequestsPerMinute != nil {
+		rate = *game.FriendRequestsPerMinute
+	}
+
+	if rate <= 0 {
+		return true
+	}
+
+	capacity := float64(maxFriends)
+	if maxFriends <= 0 {
+		capacity = float64(rate)
+	}
+
+	now := time.Now()
+	pruneFriendRequestBuckets(now)
+
+	bucket := friendRequestBuckets[g.User.ProfileId]
+	if bucket == nil {
+		bucket = &friendRequestBucket{tokens: capacity}
+		friendRequestBuckets[g.User.ProfileId] = bucket
+	} else {
+		elapsed := now.Sub(bucket.updated).Minutes()
+		bucket.tokens = min(capacity, bucket.tokens+elapsed*float64(rate))
+	}
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+	bucket.full = now.Add(time.Duration((capacity - bucket.tokens) / float64(rate) * float64(time.Minute)))
+	return true
+}
+
+// Remove the buckets that have refilled, so profiles that stopped adding friends don't stay in
+// memory. Expects the global mutex to already be locked.
+func pruneFriendRequestBuckets(now time.Time) {
+	if now.Sub(friendRequestBucketsPruned) < time.Minute {
+		return
+	}
+	friendRequestBucketsPruned = now
+
+	for profileId, bucket := range friendRequestBuckets {
+		if now.After(bucket.full) {
+			delete(friendRequestBuckets, profileId)
+		}
+	}
+}
+
 func (g *GameSpySession) isBm1AuthMessageNeeded() bool {
 	return g.UnitCode == UnitCodeDS || g.UnitCode == UnitCodeDSAndWii || g.GameName == "jissenpachwii" || g.GameName == "drmariowii" || g.GameName == "pokebattlewii"
 }
@@ -104,8 +190,19 @@ func (g *GameSpySession) addFriend(command common.GameSpyCommand) {
 		return
 	}
 
-	// TODO: Add a limit
 	if !g.isFriendAdded(uint32(newProfileId)) {
+		if maxFriends > 0 && len(g.FriendList) >= maxFriends {
+			logging.Warn(g.ModuleName, "Friend list is full, rejected", aurora.Cyan(strNewProfileId))
+			g.replyError(ErrAddFriend)
+			return
+		}
+
+		if !g.takeFriendRequestToken() {
+			logging.Warn(g.ModuleName, "Friend request rate limit exceeded, rejected", aurora.Cyan(strNewProfileId))
+			g.replyError(ErrAddFriend)
+			return
+		}
+
 		g.FriendList = append(g.FriendList, uint32(newProfileId))
 	}
 
@@ -129,9 +226,11 @@ func (g *GameSpySession) addFriend(command common.GameSpyCommand) {
 	}
 
 	// Friends are now mutual!
-	// TODO: Add a limit
 	if !authorized {
 		g.AuthFriendList = append(g.AuthFriendList, uint32(newProfileId))
+	}
+	// Still there if the profile reconnected before its offline status was sent
+	if !newSession.isFriendAuthorized(g.User.ProfileId) {
 		newSession.AuthFriendList = append(newSession.AuthFriendList, g.User.ProfileId)
 	}
 
@@ -233,6 +332,11 @@ func (g *GameSpySession) setStatus(command common.GameSpyCommand) {
 	mutex.Lock()
 	defer mutex.Unlock()
 
+	if !g.LoggedIn {
+		// The connection was closed while this was in flight
+		return
+	}
+
 	if status == "3" && g.User.Restricted {
 		logging.Warn(g.ModuleName, "Restricted user searching for public rooms")
 		kickPlayer(g.User.ProfileId, "restricted_join")
@@ -295,7 +399,7 @@ func (g *GameSpySession) sendFriendStatus(profileId uint32) {
 	if session, ok := sessions[profileId]; ok && session.LoggedIn && session.isFriendAdded(g.User.ProfileId) {
 		// Prevent players abusing a stack overflow exploit with the locstring in Mario Kart Wii
 		if session.NeedsExploit && strings.HasPrefix(session.GameCode, "RMC") && len(g.LocString) > 0x14 {
-			logging.Warn("GPCM", "Blocked message from", aurora.Cyan(g.User.ProfileId), "to", aurora.Cyan(session.User.ProfileId), "due to a stack overflow exploit")
+			logging.Warn(g.ModuleName, "Blocked message from", aurora.Cyan(g.User.ProfileId), "to", aurora.Cyan(session.User.ProfileId), "due to a stack overflow exploit")
 			return
 		}
 
@@ -308,7 +412,7 @@ func (g *GameSpySession) exchangeFriendStatus(profileId uint32) {
 	if session, ok := sessions[profileId]; ok && session.LoggedIn {
 		if session.isFriendAdded(g.User.ProfileId) && session.isFriendAuthorized(g.User.ProfileId) {
 			if session.NeedsExploit && strings.HasPrefix(session.GameCode, "RMC") && len(g.LocString) > 0x14 {
-				logging.Warn("GPCM", "Blocked message from", aurora.Cyan(g.User.ProfileId), "to", aurora.Cyan(session.User.ProfileId), "due to a stack overflow exploit")
+				logging.Warn(g.ModuleName, "Blocked message from", aurora.Cyan(g.User.ProfileId), "to", aurora.Cyan(session.User.ProfileId), "due to a stack overflow exploit")
 				return
 			}
 
@@ -318,7 +422,7 @@ func (g *GameSpySession) exchangeFriendStatus(profileId uint32) {
 
 		if g.isFriendAdded(profileId) && g.isFriendAuthorized(profileId) {
 			if g.NeedsExploit && strings.HasPrefix(g.GameCode, "RMC") && len(session.LocString) > 0x14 {
-				logging.Warn("GPCM", "Blocked message from", aurora.Cyan(session.User.ProfileId), "to", aurora.Cyan(g.User.ProfileId), "due to a stack overflow exploit")
+				logging.Warn(g.ModuleName, "Blocked message from", aurora.Cyan(session.User.ProfileId), "to", aurora.Cyan(g.User.ProfileId), "due to a stack overflow exploit")
 				return
 			}
 
@@ -338,15 +442,118 @@ func (g *GameSpySession) recordStatusSent(sender uint32) {
 	g.RecvStatusFromList = append(g.RecvStatusFromList, sender)
 }
 
+// Send the offline status to every friend that still has the profile
+// authorized, which includes relationships kept over a quick reconnect.
+// Expects the global mutex to already be locked.
 func (g *GameSpySession) sendLogoutStatus() {
-	mutex.Lock()
-	defer mutex.Unlock()
+	for _, session := range getSessionsWithFriend(g.User.ProfileId) {
+		delProfileIDIndex := session.getAuthorizedFriendIndex(g.User.ProfileId)
+		removeFromUint32Array(&session.AuthFriendList, delProfileIDIndex)
+		sendMessageToSession("100", g.User.ProfileId, session, logOutMessage)
+	}
+}
 
-	for _, storedPid := range g.AuthFriendList {
-		if session, ok := sessions[storedPid]; ok && session.LoggedIn && session.isFriendAuthorized(g.User.ProfileId) {
-			delProfileIDIndex := session.getAuthorizedFriendIndex(g.User.ProfileId)
-			removeFromUint32Array(&session.AuthFriendList, delProfileIDIndex)
-			sendMessageToSession("100", g.User.ProfileId, session, logOutMessage)
+// Schedule the offline status for a closed session. If the same profile logs
+// back in before the delay expires, the offline status is never sent and its
+// friends keep the profile authorized for the new session.
+// Expects the global mutex to already be locked.
+func (g *GameSpySession) scheduleLogoutStatus() {
+	profileId := g.User.ProfileId
+
+	if pending, exists := pendingLogouts[profileId]; exists {
+		// An older session for this profile is still waiting, send its status now
+		pending.timer.Stop()
+		delete(pendingLogouts, profileId)
+		pending.session.sendLogoutStatus()
+	}
+
+	pending := &pendingLogout{session: g}
+	pending.timer = time.AfterFunc(logoutStatusDelay, func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if pendingLogouts[profileId] != pending {
+			return
+		}
+
+		delete(pendingLogouts, profileId)
+
+		if newSession, ok := sessions[profileId]; ok && newSession.LoggedIn {
+			// Reconnected in the meantime
+			return
+		}
+
+		g.sendLogoutStatus()
+	})
+
+	pendingLogouts[profileId] = pending
+}
+
+// Send all the pending offline statuses immediately, used before saving state.
+// Expects the global mutex to already be locked.
+func flushPendingLogouts() {
+	for profileId, pending := range pendingLogouts {
+		pending.timer.Stop()
+		delete(pendingLogouts, profileId)
+
+		if newSession, ok := sessions[profileId]; ok && newSession.LoggedIn {
+			continue
+		}
+
+		pending.session.sendLogoutStatus()
+	}
+}
+
+// Get all online sessions that have authorized the profile ID as a friend.
+// Expects the global mutex to already be locked.
+func getSessionsWithFriend(profileId uint32) []*GameSpySession {
+	var friends []*GameSpySession
+	for _, session := range sessions {
+		if session.LoggedIn && session.User.ProfileId != profileId && session.isFriendAuthorized(profileId) {
+			friends = append(friends, session)
+		}
+	}
+
+	return friends
+}
+
+// Exchange statuses between a session that just logged in and its online
+// friends, limited to the friends the session has added or authorized. A
+// pending offline status for the profile is cancelled, unless the previous
+// session was in another game.
+// Expects the global mutex to already be locked.
+func (g *GameSpySession) sendLoginStatus() {
+	if pending, exists := pendingLogouts[g.User.ProfileId]; exists {
+		pending.timer.Stop()
+		delete(pendingLogouts, g.User.ProfileId)
+
+		if pending.session.GameName != g.GameName {
+			// Different game, the old friend relationships don't apply
+			pending.session.sendLogoutStatus()
+		}
+	}
+
+	for _, session := range sessions {
+		profileId := session.User.ProfileId
+		if session == g || !session.LoggedIn || session.GameName != g.GameName {
+			continue
+		}
+
+		if !g.isFriendAdded(profileId) && !g.isFriendAuthorized(profileId) {
+			continue
+		}
+
+		if session.StatusSet && g.isFriendAdded(profileId) && session.isFriendAuthorized(g.User.ProfileId) {
+			if g.NeedsExploit && strings.HasPrefix(g.GameCode, "RMC") && len(session.LocString) > 0x14 {
+				logging.Warn(g.ModuleName, "Blocked message from", aurora.Cyan(profileId), "to", aurora.Cyan(g.User.ProfileId), "due to a stack overflow exploit")
+			} else {
+				g.recordStatusSent(profileId)
+				sendMessageToSessionBuffer("100", profileId, g, session.Status)
+			}
+		}
+
+		if g.StatusSet {
+			g.sendFriendStatus(profileId)
 		}
 	}
 }
@@ -0,0 +1,227 @@
+package gpcm
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"wwfc/common"
+	"wwfc/database"
+)
+
+// setFriendLimits sets the friend limits for the test and forgets every bucket afterwards
+func setFriendLimits(t *testing.T, friends int, perMinute int) {
+	oldMaxFriends, oldPerMinute := maxFriends, friendRequestsPerMinute
+	maxFriends, friendRequestsPerMinute = friends, perMinute
+	t.Cleanup(func() {
+		maxFriends, friendRequestsPerMinute = oldMaxFriends, oldPerMinute
+		friendRequestBuckets = map[uint32]*friendRequestBucket{}
+		friendRequestBucketsPruned = time.Time{}
+	})
+}
+
+func TestFriendRequestRateLimit(t *testing.T) {
+	setFriendLimits(t, 5, 2)
+
+	g := &GameSpySession{User: database.User{ProfileId: 1000}}
+
+	for i := 0; i < maxFriends; i++ {
+		if !g.takeFriendRequestToken() {
+			t.Fatalf("request %d was limited within the burst", i)
+		}
+	}
+
+	if g.takeFriendRequestToken() {
+		t.Fatal("request over the burst was allowed")
+	}
+
+	// A new session for the same profile doesn't get a fresh bucket
+	if (&GameSpySession{User: database.User{ProfileId: 1000}}).takeFriendRequestToken() {
+		t.Fatal("reconnecting refilled the bucket")
+	}
+
+	// Half a minute refills one request
+	friendRequestBuckets[1000].updated = time.Now().Add(-30 * time.Second)
+	if !g.takeFriendRequestToken() {
+		t.Fatal("bucket did not refill")
+	}
+
+	if g.takeFriendRequestToken() {
+		t.Fatal("bucket refilled too much")
+	}
+}
+
+func TestFriendRequestBucketsPruned(t *testing.T) {
+	setFriendLimits(t, 5, 2)
+
+	idle := &GameSpySession{User: database.User{ProfileId: 1000}}
+	active := &GameSpySession{User: database.User{ProfileId: 1001}}
+	idle.takeFriendRequestToken()
+	active.takeFriendRequestToken()
+
+	// The idle profile's bucket has refilled, the active one has just been used
+	friendRequestBuckets[1000].full = time.Now().Add(-time.Second)
+	friendRequestBucketsPruned = time.Now().Add(-time.Minute)
+	active.takeFriendRequestToken()
+
+	if _, exists := friendRequestBuckets[1000]; exists {
+		t.Error("full bucket was kept")
+	}
+	if _, exists := friendRequestBuckets[1001]; !exists {
+		t.Error("bucket in use was removed")
+	}
+}
+
+func TestFriendRequestNoFriendLimit(t *testing.T) {
+	setFriendLimits(t, 0, 3)
+
+	// A minute's worth of requests
+	g := &GameSpySession{User: database.User{ProfileId: 1000}}
+	for i := 0; i < 3; i++ {
+		if !g.takeFriendRequestToken() {
+			t.Fatalf("request %d was limited", i)
+		}
+	}
+	if g.takeFriendRequestToken() {
+		t.Error("request over a minute's worth was allowed")
+	}
+}
+
+// setLogoutStatusDelay shortens the offline status delay for the test and drops anything still
+// pending afterwards
+func setLogoutStatusDelay(t *testing.T, delay time.Duration) {
+	oldDelay := logoutStatusDelay
+	logoutStatusDelay = delay
+	t.Cleanup(func() {
+		logoutStatusDelay = oldDelay
+		for _, pending := range pendingLogouts {
+			pending.timer.Stop()
+		}
+		pendingLogouts = map[uint32]*pendingLogout{}
+	})
+}
+
+// addFriendSessions logs in two mutual friends playing the same game
+func addFriendSessions() (*GameSpySession, *GameSpySession) {
+	g := &GameSpySession{ConnIndex: 1, LoggedIn: true, GameName: "mariokartwii", User: database.User{ProfileId: 1001}, FriendList: []uint32{1002}, AuthFriendList: []uint32{1002}}
+	friend := &GameSpySession{ConnIndex: 2, LoggedIn: true, GameName: "mariokartwii", User: database.User{ProfileId: 1002}, FriendList: []uint32{1001}, AuthFriendList: []uint32{1001}}
+	sessions[1001], sessionsByConnIndex[1] = g, g
+	sessions[1002], sessionsByConnIndex[2] = friend, friend
+	return g, friend
+}
+
+func TestLogoutStatusDelayed(t *testing.T) {
+	testReload(t)
+	setLogoutStatusDelay(t, 20*time.Millisecond)
+	_, friend := addFriendSessions()
+
+	common.BeginReplay(ServerName, 2)
+	CloseConnection(1)
+
+	mutex.Lock()
+	authorized := friend.isFriendAuthorized(1001)
+	mutex.Unlock()
+	if !authorized {
+		t.Fatal("the offline status was sent before the delay")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		mutex.Lock()
+		pending := len(pendingLogouts)
+		mutex.Unlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the offline status was never sent")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if friend.isFriendAuthorized(1001) {
+		t.Error("the friend still has the closed session authorized")
+	}
+
+	sent := common.EndReplay(ServerName, 2)
+	if len(sent) != 1 || !strings.Contains(string(sent[0]), logOutMessage) {
+		t.Errorf("the friend was sent %q", sent)
+	}
+}
+
+func TestLogoutStatusReconnect(t *testing.T) {
+	testReload(t)
+	setLogoutStatusDelay(t, time.Hour)
+	_, friend := addFriendSessions()
+
+	common.BeginReplay(ServerName, 2)
+	CloseConnection(1)
+
+	reconnected := &GameSpySession{ConnIndex: 3, LoggedIn: true, GameName: "mariokartwii", User: database.User{ProfileId: 1001}}
+	mutex.Lock()
+	sessions[1001], sessionsByConnIndex[3] = reconnected, reconnected
+	reconnected.sendLoginStatus()
+	mutex.Unlock()
+
+	if len(pendingLogouts) != 0 {
+		t.Error("the offline status is still pending after the reconnect")
+	}
+	if !friend.isFriendAuthorized(1001) {
+		t.Error("the friend lost the reconnected profile")
+	}
+	if len(reconnected.FriendList) != 0 || len(reconnected.AuthFriendList) != 0 {
+		t.Errorf("the new session got friends it didn't add: %v %v", reconnected.FriendList, reconnected.AuthFriendList)
+	}
+	if sent := common.EndReplay(ServerName, 2); len(sent) != 0 {
+		t.Errorf("the friend was sent %q", sent)
+	}
+
+	// The relationship kept over the reconnect ends with the new session
+	common.BeginReplay(ServerName, 2)
+	mutex.Lock()
+	delete(sessions, 1001)
+	reconnected.sendLogoutStatus()
+	mutex.Unlock()
+
+	if friend.isFriendAuthorized(1001) {
+		t.Error("the friend still has the profile authorized after logging out")
+	}
+	sent := common.EndReplay(ServerName, 2)
+	if len(sent) != 1 || !strings.Contains(string(sent[0]), logOutMessage) {
+		t.Errorf("the friend was sent %q", sent)
+	}
+}
+
+func TestLoginStatusPush(t *testing.T) {
+	testReload(t)
+	g, friend := addFriendSessions()
+	friend.StatusSet, friend.Status = true, "|s|1|ss|Online|ls||ip|0|p|0|qm|0"
+	g.StatusSet, g.Status = true, "|s|2|ss|Racing|ls||ip|0|p|0|qm|0"
+
+	// Has the new session authorized, but the new session hasn't added them
+	stranger := &GameSpySession{ConnIndex: 3, LoggedIn: true, GameName: "mariokartwii", User: database.User{ProfileId: 1003}, StatusSet: true, Status: "|s|3|ss|Stranger|ls||ip|0|p|0|qm|0", FriendList: []uint32{1001}, AuthFriendList: []uint32{1001}}
+	sessions[1003], sessionsByConnIndex[3] = stranger, stranger
+
+	common.BeginReplay(ServerName, 2)
+	common.BeginReplay(ServerName, 3)
+	mutex.Lock()
+	g.sendLoginStatus()
+	mutex.Unlock()
+
+	if !strings.Contains(g.WriteBuffer, friend.Status) {
+		t.Errorf("the new session wasn't sent the friend's status: %q", g.WriteBuffer)
+	}
+	if strings.Contains(g.WriteBuffer, stranger.Status) {
+		t.Error("the new session was sent the status of a profile it didn't add")
+	}
+	if len(g.FriendList) != 1 || len(g.AuthFriendList) != 1 {
+		t.Errorf("the new session's friends changed: %v %v", g.FriendList, g.AuthFriendList)
+	}
+
+	friendSent := common.EndReplay(ServerName, 2)
+	if len(friendSent) != 1 || !strings.Contains(string(friendSent[0]), g.Status) {
+		t.Errorf("the friend was sent %q", friendSent)
+	}
+	if strangerSent := common.EndReplay(ServerName, 3); len(strangerSent) != 0 {
+		t.Errorf("the profile the new session didn't add was sent %q", strangerSent)
+	}
+}
@@ -1,9 +1,21 @@
 package gpcm
 
-import "wwfc/common"
+import (
+	"sync/atomic"
+	"time"
+	"wwfc/common"
+	"wwfc/logging"
+	"wwfc/qr2"
+
+	"github.com/logrusorgru/aurora/v3"
+)
 
 func kickPlayer(profileID uint32, reason string) {
 	if session, exists := sessions[profileID]; exists {
+		event := session.auditEvent(logging.AuditKick)
+		event.Reason = reason
+		logging.Audit(event)
+
 		errorMessage := WWFCMsgKickedGeneric
 
 		switch reason {
@@ -41,9 +53,134 @@ func kickPlayer(profileID uint32, reason string) {
 	}
 }
 
+var (
+	// Number of sessions disconnected by a newer login of the same profile since the backend started
+	duplicateLoginKicks atomic.Uint64
+
+	// Profiles whose QR2 logout is running, keyed by profile ID
+	qr2Logouts = map[uint32]chan struct{}{}
+)
+
+// GetDuplicateLoginKickCount returns the number of sessions disconnected by a newer login
+func GetDuplicateLoginKickCount() uint64 {
+	return duplicateLoginKicks.Load()
+}
+
+// kickDuplicate logs the session out for a newer login of the same profile. Its friends are sent
+// the offline status right away, so they see it go offline before the new session comes online.
+// The caller has to close the connection and call finishLogout after unlocking the mutex.
+// Expects the global mutex to already be locked.
+func (g *GameSpySession) kickDuplicate() chan struct{} {
+	event := g.auditEvent(logging.AuditKick)
+	event.Reason = "logged_in_elsewhere"
+	logging.Audit(event)
+	duplicateLoginKicks.Add(1)
+
+	g.replyError(GPError{
+		ErrorCode:   ErrForcedDisconnect.ErrorCode,
+		ErrorString: ErrForcedDisconnect.ErrorString,
+		Fatal:       true,
+		WWFCMessage: WWFCMsgLoggedInElsewhere,
+	})
+
+	// CloseConnection skips the logout of a session that isn't logged in anymore
+	done := g.beginLogout()
+	if sessions[g.User.ProfileId] == g {
+		delete(sessions, g.User.ProfileId)
+	}
+	g.sendLogoutStatus()
+	return done
+}
+
+// beginLogout marks the session as logged out. Until finishLogout is called with the returned
+// channel, a new login for the profile waits, so it can't be undone by the old session's QR2
+// logout. Expects the global mutex to already be locked.
+func (g *GameSpySession) beginLogout() chan struct{} {
+	g.LoggedIn = false
+
+	done := make(chan struct{})
+	qr2Logouts[g.User.ProfileId] = done
+	return done
+}
+
+// finishLogout removes the session's QR2 login, its server and any reservation to or from it.
+// Expects the global mutex to be unlocked.
+func (g *GameSpySession) finishLogout(done chan struct{}) {
+	qr2.Logout(g.User.ProfileId)
+	if g.QR2IP != 0 {
+		qr2.ProcessGPStatusUpdate(g.User.ProfileId, g.QR2IP, "0")
+	}
+
+	mutex.Lock()
+	if qr2Logouts[g.User.ProfileId] == done {
+		delete(qr2Logouts, g.User.ProfileId)
+	}
+	mutex.Unlock()
+	close(done)
+}
+
+// waitForLogout returns once no logout of the profile is running. Expects the global mutex to
+// already be locked, and unlocks it while waiting.
+func waitForLogout(profileID uint32) {
+	for {
+		done, exists := qr2Logouts[profileID]
+		if !exists {
+			return
+		}
+
+		mutex.Unlock()
+		<-done
+		mutex.Lock()
+	}
+}
+
 func KickPlayer(profileID uint32, reason string) {
 	mutex.Lock()
 	defer mutex.Unlock()
 
 	kickPlayer(profileID, reason)
 }
+
+// ShadowBanPlayer leaves a logged in player out of matchmaking without disconnecting them
+func ShadowBanPlayer(profileID uint32) {
+	mutex.Lock()
+	if session, exists := sessions[profileID]; exists {
+		session.User.ShadowBanned = true
+	}
+	mutex.Unlock()
+
+	qr2.SetShadowBanned(profileID)
+}
+
+// Called by QR2 when a host keeps sending invalid heartbeats
+func reportQR2Violation(profileID uint32, address string, reason string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	fc := ""
+	if session, exists := sessions[profileID]; exists && session.LoggedIn {
+		fc = common.CalcFriendCodeString(profileID, session.User.GsbrCode[:4])
+	}
+
+	logging.Notice("GPCM", "QR2 violation by profile", aurora.Cyan(profileID), aurora.Cyan(fc), "from", aurora.BrightCyan(address).String()+":", reason)
+
+	kickPlayer(profileID, "invalid_data")
+}
+
+// Called by the payload inspection when a signature bans the sender
+func banPayloadSender(profileID uint32, length time.Duration, reason string) {
+	if !store.BanUser(ctx, profileID, true, false, length, "Sent a malicious payload", reason, "payload inspection") {
+		logging.Error("GPCM", "Failed to ban profile", aurora.Cyan(profileID), "for a malicious payload")
+		return
+	}
+
+	logging.Audit(logging.AuditEvent{
+		Event:     logging.AuditBan,
+		ProfileID: profileID,
+		Reason:    "Sent a malicious payload: " + reason,
+		Moderator: "payload inspection",
+		Details:   map[string]string{"length": length.String()},
+	})
+
+	KickPlayer(profileID, "banned")
+}
@@ -10,7 +10,6 @@ import (
 	"strconv"
 	"strings"
 	"time"
-	"unicode/utf16"
 	"wwfc/common"
 	"wwfc/database"
 	"wwfc/logging"
@@ -172,10 +171,25 @@ func (g *GameSpySession) login(command common.GameSpyCommand) {
 
 	g.GameName = command.OtherValues["gamename"]
 	logging.Info(g.ModuleName, "Game name:", aurora.Cyan(g.GameName))
+	if common.CheckGame(g.ModuleName, g.GameName, common.GameServiceGPCM) == nil {
+		if common.IsGameDisabled(g.GameName) {
+			g.replyError(ErrLoginGameUnavailable)
+		} else {
+			g.replyError(ErrLogin)
+		}
+		return
+	}
+
 	g.GameCode = gamecd
 	g.Region = region
 	g.Language = lang
 	g.ConsoleFriendCode = cfc
+
+	// NAS already told the game the name is profane, keep it out of the database and room lists
+	if ingamesn != "" && g.isProfane(ingamesn) {
+		logging.Notice(g.ModuleName, "Hiding profane in-game name", aurora.Red(ingamesn))
+		ingamesn = ""
+	}
 	g.InGameName = ingamesn
 	g.UnitCode = unitcd
 	//ctgpver = bytes.Trim(ctgpver, "\x00")
@@ -265,32 +279,41 @@ func (g *GameSpySession) login(command common.GameSpyCommand) {
 		return
 	}
 
-	g.ModuleName = "GPCM:" + strconv.FormatInt(int64(g.User.ProfileId), 10) + "*"
+	g.ModuleName = logging.ConnectionModule("GPCM", g.ConnIndex, strconv.FormatInt(int64(g.User.ProfileId), 10)+"*")
 	g.ModuleName += "/" + common.CalcFriendCodeString(g.User.ProfileId, g.User.GsbrCode[:4]) + "*"
 
 	// Check to see if a session is already open with this profile ID
 	mutex.Lock() //PP take a look for openhost
+	waitForLogout(g.User.ProfileId)
 	otherSession, exists := sessions[g.User.ProfileId]
+	if exists && duplicateLoginPolicy == common.DuplicateLoginRejectNew {
+		mutex.Unlock()
+		logging.Notice(g.ModuleName, "Rejected login, the profile is already logged in on connection", aurora.Cyan(otherSession.ConnIndex))
+		g.replyError(GPError{
+			ErrorCode:   ErrLogin.ErrorCode,
+			ErrorString: "The profile is already logged in elsewhere.",
+			Fatal:       true,
+			WWFCMessage: WWFCMsgAlreadyLoggedIn,
+		})
+		return
+	}
+
 	if exists {
-		otherSession.replyError(ErrForcedDisconnect)
+		logging.Notice(g.ModuleName, "Disconnecting the profile's other session on connection", aurora.Cyan(otherSession.ConnIndex))
+		done := otherSession.kickDuplicate()
+		mutex.Unlock()
+
 		common.CloseConnection(ServerName, otherSession.ConnIndex)
+		otherSession.finishLogout(done)
 
-		for i := 0; ; i++ {
+		mutex.Lock()
+		waitForLogout(g.User.ProfileId)
+		if _, exists = sessions[g.User.ProfileId]; exists {
+			// Another login for the profile got in while the old session was cleaned up
 			mutex.Unlock()
-			time.Sleep(300 * time.Millisecond)
-			mutex.Lock()
-
-			if _, exists = sessions[g.User.ProfileId]; !exists {
-				break
-			}
-
-			// Give up after 6 seconds
-			if i >= 20 {
-				mutex.Unlock()
-				logging.Error(g.ModuleName, "Failed to disconnect other session")
-				g.replyError(ErrForcedDisconnect)
-				return
-			}
+			logging.Error(g.ModuleName, "Rejected login, another login for the profile took over")
+			g.replyError(ErrForcedDisconnect)
+			return
 		}
 	}
 	sessions[g.User.ProfileId] = g
@@ -302,11 +325,19 @@ func (g *GameSpySession) login(command common.GameSpyCommand) {
 
 	g.DeviceAuthenticated = deviceAuth
 	g.LoggedIn = true
-	g.ModuleName = "GPCM:" + strconv.FormatInt(int64(g.User.ProfileId), 10)
+	g.ModuleName = logging.ConnectionModule("GPCM", g.ConnIndex, strconv.FormatInt(int64(g.User.ProfileId), 10))
 	g.ModuleName += "/" + common.CalcFriendCodeString(g.User.ProfileId, g.User.GsbrCode[:4])
 
+	mutex.Lock()
+	g.sendLoginStatus()
+	mutex.Unlock()
+
+	event := g.auditEvent(logging.AuditLogin)
+	event.Details = map[string]string{"gsbrcd": g.User.GsbrCode, "gamecd": gamecd, "device": strconv.FormatUint(uint64(g.User.NgDeviceId), 10)}
+	logging.Audit(event)
+
 	// Notify QR2 of the login //PP
-	qr2.Login(g.User.ProfileId, gamecd, ingamesn, cfc, g.User.GsbrCode[:4], g.RemoteAddr, g.NeedsExploit, g.DeviceAuthenticated, g.User.Restricted, g.User.Trusted, g.User.OpenHost, ctgpver)
+	qr2.Login(g.User.ProfileId, gamecd, ingamesn, cfc, g.User.GsbrCode[:4], g.RemoteAddr, g.NeedsExploit, g.DeviceAuthenticated, g.User.Restricted, g.User.ShadowBanned, g.User.Trusted, g.User.OpenHost, ctgpver)
 
 	replyUserId := g.User.UserId
 	if g.UnitCode == UnitCodeDS {
@@ -328,9 +359,7 @@ func (g *GameSpySession) login(command common.GameSpyCommand) {
 		if motd, err := GetMessageOfTheDay(); err != nil {
 			logging.Info(g.ModuleName, err)
 		} else {
-			motdUTF16 := utf16.Encode([]rune(motd))
-			motdByteArray := common.UTF16ToByteArray(motdUTF16)
-			otherValues["wwfc_motd"] = common.Base64DwcEncoding.EncodeToString(motdByteArray)
+			otherValues["wwfc_motd"] = encodeMessage(motd)
 		}
 	}
 
@@ -436,7 +465,7 @@ func (g *GameSpySession) performLoginWithDatabase(userId uint64, gsbrCode string
 		ipAddress = ipAddress[:strings.Index(ipAddress, ":")]
 	}
 
-	user, err := database.LoginUserToGPCM(pool, ctx, userId, gsbrCode, profileId, deviceId, ipAddress, g.InGameName)
+	user, err := store.LoginUserToGPCM(ctx, userId, gsbrCode, profileId, deviceId, ipAddress, g.InGameName)
 	g.User = user
 
 	if err != nil {
@@ -471,12 +500,7 @@ func (g *GameSpySession) performLoginWithDatabase(userId uint64, gsbrCode string
 				})
 			}
 		} else if err == database.ErrProfileBannedTOS {
-			g.replyError(GPError{
-				ErrorCode:   ErrLogin.ErrorCode,
-				ErrorString: "The profile is banned from the service.",
-				Fatal:       true,
-				WWFCMessage: WWFCMsgProfileBannedTOS,
-			})
+			g.replyError(banError(user.Ban))
 		} else {
 			g.replyError(GPError{
 				ErrorCode:   ErrLogin.ErrorCode,
@@ -489,9 +513,66 @@ func (g *GameSpySession) performLoginWithDatabase(userId uint64, gsbrCode string
 		return false
 	}
 
+	if allowlistMode {
+		allowed, err := store.IsProfileAllowed(ctx, g.User.ProfileId, g.ConsoleFriendCode)
+		if err != nil {
+			logging.Error(g.ModuleName, "Failed to check allowlist:", err)
+		}
+
+		if !allowed {
+			logging.Warn(g.ModuleName, "Profile", aurora.Cyan(g.User.ProfileId), "is not on the allowlist")
+			g.replyError(GPError{
+				ErrorCode:   ErrLogin.ErrorCode,
+				ErrorString: "The profile is not allowed to use this server.",
+				Fatal:       true,
+				WWFCMessage: WWFCMsgNotAllowlisted,
+			})
+			return false
+		}
+	}
+
 	return true
 }
 
+// GetProfileIDsByConnIndex returns the profile ID of each logged in connection
+func GetProfileIDsByConnIndex() map[uint64]uint32 {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	profileIDs := map[uint64]uint32{}
+	for index, session := range sessionsByConnIndex {
+		if session.LoggedIn {
+			profileIDs[index] = session.User.ProfileId
+		}
+	}
+
+	return profileIDs
+}
+
+// GetProfileIDByConnIndex returns the profile ID logged in on the connection, or 0 if there is none
+func GetProfileIDByConnIndex(index uint64) uint32 {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if session, ok := sessionsByConnIndex[index]; ok && session.LoggedIn {
+		return session.User.ProfileId
+	}
+
+	return 0
+}
+
+// GetConnIndexByProfileID returns the connection the profile is logged in on
+func GetConnIndexByProfileID(profileID uint32) (uint64, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if session, ok := sessions[profileID]; ok && session.LoggedIn {
+		return session.ConnIndex, true
+	}
+
+	return 0, false
+}
+
 func IsLoggedIn(profileID uint32) bool {
 	mutex.Lock()
 	defer mutex.Unlock()
@@ -3,15 +3,15 @@ package gpcm
 import (
 	"context"
 	"encoding/gob"
-	"fmt"
+	"net"
 	"os"
 	"strings"
 	"wwfc/common"
 	"wwfc/database"
+	"wwfc/inspect"
 	"wwfc/logging"
 	"wwfc/qr2"
 
-	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/logrusorgru/aurora/v3"
 	"github.com/sasha-s/go-deadlock"
 )
@@ -23,6 +23,7 @@ type GameSpySession struct {
 	RemoteAddr          string
 	User                database.User
 	ModuleName          string
+	TraceID             string
 	LoggedIn            bool
 	DeviceAuthenticated bool
 	Challenge           string
@@ -60,46 +61,65 @@ type GameSpySession struct {
 }
 
 var (
-	ctx  = context.Background()
-	pool *pgxpool.Pool
+	ctx   = context.Background()
+	store database.Store
 	// I would use a sync.Map instead of the map mutex combo, but this performs better.
 	sessions            = map[uint32]*GameSpySession{}
 	sessionsByConnIndex = map[uint64]*GameSpySession{}
 	mutex               = deadlock.Mutex{}
 
 	allowDefaultDolphinKeys bool
+	allowlistMode           bool
+	maxFriends              int
+	friendRequestsPerMinute int
+	duplicateLoginPolicy    string
+
+	// Highest connection index the frontend has announced
+	lastConnIndex uint64
+
+	// Replaced in tests
+	stateFile       = "state/gpcm_sessions.gob"
+	getConnections  = common.GetConnections
+	closeConnection = common.CloseConnection
+	sendPacket      = common.SendPacket
 )
 
+// savedState is the session state carried over a backend reload
+type savedState struct {
+	// Every connection's session, including ones that haven't logged in yet
+	Sessions      []*GameSpySession
+	LastConnIndex uint64
+}
+
 func StartServer(reload bool) {
 	qr2.SetGPErrorCallback(KickPlayer)
+	qr2.SetViolationCallback(reportQR2Violation)
+	inspect.SetBanCallback(banPayloadSender)
 
 	// Get config
 	config := common.GetConfig()
 
 	// Start SQL
-	dbString := fmt.Sprintf("postgres://%s:%s@%s/%s", config.Username, config.Password, config.DatabaseAddress, config.DatabaseName)
-	dbConf, err := pgxpool.ParseConfig(dbString)
-	if err != nil {
-		panic(err)
-	}
-
-	pool, err = pgxpool.ConnectConfig(ctx, dbConf)
+	var err error
+	store, err = database.Connect(ctx, config)
 	if err != nil {
 		panic(err)
 	}
 
-	database.UpdateTables(pool, ctx)
-
 	allowDefaultDolphinKeys = config.AllowDefaultDolphinKeys
+	allowlistMode = config.AllowlistMode
+	maxFriends = *config.MaxFriends
+	friendRequestsPerMinute = *config.FriendRequestsPerMinute
+	duplicateLoginPolicy = config.DuplicateLoginPolicy
 
 	if reload {
 		err := loadState()
 		if err != nil {
-			logging.Error("GPCM", "Failed to load state:", err)
-			os.Exit(1)
+			logging.Error("GPCM", "Failed to load state, disconnecting clients:", err)
 		}
 
-		logging.Notice("GPCM", "Loaded", aurora.Cyan(len(sessions)), "sessions")
+		closeUnrestoredConnections(err == nil)
+		logging.Notice("GPCM", "Loaded", aurora.Cyan(len(sessionsByConnIndex)), "sessions,", aurora.Cyan(len(sessions)), "logged in")
 	}
 }
 
@@ -108,44 +128,74 @@ func Shutdown() {
 	if err != nil {
 		logging.Error("GPCM", "Failed to save state:", err)
 	}
-	logging.Notice("GPCM", "Saved", aurora.Cyan(len(sessions)), "sessions")
+	logging.Notice("GPCM", "Saved", aurora.Cyan(len(sessionsByConnIndex)), "sessions")
+}
+
+// closeUnrestoredConnections disconnects the clients the frontend kept connected over the reload
+// that have no session to continue with, instead of leaving them unable to log in. Without the
+// saved state every connection is closed, as there's no telling which were announced.
+func closeUnrestoredConnections(restored bool) {
+	connections, err := getConnections()
+	if err != nil {
+		return
+	}
+
+	mutex.Lock()
+	var unrestored []uint64
+	for _, connection := range connections[ServerName] {
+		// Later connections are still waiting to be announced
+		if (!restored || connection.Index <= lastConnIndex) && sessionsByConnIndex[connection.Index] == nil {
+			unrestored = append(unrestored, connection.Index)
+		}
+	}
+	mutex.Unlock()
+
+	for _, index := range unrestored {
+		logging.Warn(logging.ConnectionModule("GPCM", index, ""), "No session to restore, closing connection")
+		closeConnection(ServerName, index)
+	}
 }
 
 func CloseConnection(index uint64) {
+	defer logging.ClearConnectionTrace("GPCM", index)
+
 	mutex.Lock()
 	session := sessionsByConnIndex[index]
 	mutex.Unlock()
 
 	if session == nil {
-		logging.Error("GPCM", "Cannot find session for this connection index:", aurora.Cyan(index))
+		logging.Error(logging.ConnectionModule("GPCM", index, ""), "Cannot find session for this connection index")
 		return
 	}
 
 	logging.Notice(session.ModuleName, "Connection closed")
 
+	mutex.Lock()
+	var done chan struct{}
 	if session.LoggedIn {
-		qr2.Logout(session.User.ProfileId)
-		if session.QR2IP != 0 {
-			qr2.ProcessGPStatusUpdate(session.User.ProfileId, session.QR2IP, "0")
+		done = session.beginLogout()
+		if sessions[session.User.ProfileId] == session {
+			delete(sessions, session.User.ProfileId)
+			session.scheduleLogoutStatus()
 		}
-		session.sendLogoutStatus()
 	}
+	mutex.Unlock()
 
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	if session.LoggedIn {
-		session.LoggedIn = false
-		delete(sessions, session.User.ProfileId)
+	if done != nil {
+		logging.Audit(session.auditEvent(logging.AuditLogout))
+		session.finishLogout(done)
 	}
 }
 
-func NewConnection(index uint64, address string) {
+func NewConnection(index uint64, address string, traceID string) {
+	logging.SetConnectionTrace("GPCM", index, traceID)
+
 	session := &GameSpySession{
 		ConnIndex:      index,
 		RemoteAddr:     address,
 		User:           database.User{},
-		ModuleName:     "GPCM:" + address,
+		ModuleName:     logging.ConnectionModule("GPCM", index, address),
+		TraceID:        traceID,
 		LoggedIn:       false,
 		Challenge:      common.RandomString(10),
 		StatusSet:      false,
@@ -169,6 +219,7 @@ func NewConnection(index uint64, address string) {
 
 	mutex.Lock()
 	sessionsByConnIndex[index] = session
+	lastConnIndex = max(lastConnIndex, index)
 	mutex.Unlock()
 }
 
@@ -178,7 +229,7 @@ func HandlePacket(index uint64, data []byte) {
 	mutex.Unlock()
 
 	if session == nil {
-		logging.Error("GPCM", "Cannot find session for this connection index:", aurora.Cyan(index))
+		logging.Error(logging.ConnectionModule("GPCM", index, ""), "Cannot find session for this connection index")
 		return
 	}
 
@@ -246,6 +297,7 @@ func HandlePacket(index uint64, data []byte) {
 
 	commands = session.handleCommand("wwfc_report", commands, session.handleWWFCReport)
 	commands = session.handleCommand("updatepro", commands, session.updateProfile)
+	commands = session.handleCommand("updateui", commands, session.updateUserInfo)
 	commands = session.handleCommand("status", commands, session.setStatus)
 	commands = session.handleCommand("addbuddy", commands, session.addFriend)
 	commands = session.handleCommand("delbuddy", commands, session.removeFriend)
@@ -277,6 +329,22 @@ func HandlePacket(index uint64, data []byte) {
 	}
 }
 
+// auditEvent fills in the session's profile, address and game for an audit event
+func (g *GameSpySession) auditEvent(event string) logging.AuditEvent {
+	ip, _, err := net.SplitHostPort(g.RemoteAddr)
+	if err != nil {
+		ip = g.RemoteAddr
+	}
+
+	return logging.AuditEvent{
+		Event:     event,
+		ProfileID: g.User.ProfileId,
+		IP:        ip,
+		CFC:       g.ConsoleFriendCode,
+		Game:      g.GameName,
+	}
+}
+
 func (g *GameSpySession) handleCommand(name string, commands []common.GameSpyCommand, handler func(command common.GameSpyCommand)) []common.GameSpyCommand {
 	var unhandled []common.GameSpyCommand
 
@@ -306,7 +374,7 @@ func (g *GameSpySession) ignoreCommand(name string, commands []common.GameSpyCom
 }
 
 func saveState() error {
-	file, err := os.OpenFile("state/gpcm_sessions.gob", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	file, err := os.OpenFile(stateFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
@@ -316,30 +384,45 @@ func saveState() error {
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	err = encoder.Encode(sessions)
+	flushPendingLogouts()
+
+	state := savedState{LastConnIndex: lastConnIndex}
+	for _, session := range sessionsByConnIndex {
+		state.Sessions = append(state.Sessions, session)
+	}
+
+	err = encoder.Encode(state)
 	file.Close()
 	return err
 }
 
+// loadState restores the sessions saved before the reload. The logged in ones are keyed by profile
+// ID again, so friends' status updates reach them without the client doing anything.
 func loadState() error {
-	file, err := os.Open("state/gpcm_sessions.gob")
+	file, err := os.Open(stateFile)
 	if err != nil {
 		return err
 	}
 
 	decoder := gob.NewDecoder(file)
 
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	err = decoder.Decode(&sessions)
+	var state savedState
+	err = decoder.Decode(&state)
 	file.Close()
 	if err != nil {
 		return err
 	}
 
-	for _, session := range sessions {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	lastConnIndex = max(lastConnIndex, state.LastConnIndex)
+	for _, session := range state.Sessions {
 		sessionsByConnIndex[session.ConnIndex] = session
+		logging.SetConnectionTrace("GPCM", session.ConnIndex, session.TraceID)
+		if session.LoggedIn {
+			sessions[session.User.ProfileId] = session
+		}
 	}
 
 	return nil
@@ -0,0 +1,245 @@
+package gpcm
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"wwfc/common"
+	"wwfc/database"
+)
+
+// testReload replaces the frontend with one holding connections with the indexes, and returns the
+// indexes the backend closes
+func testReload(t *testing.T, indexes ...uint64) *[]uint64 {
+	oldStateFile, oldGetConnections, oldCloseConnection := stateFile, getConnections, closeConnection
+	stateFile = filepath.Join(t.TempDir(), "gpcm_sessions.gob")
+
+	var closed []uint64
+	getConnections = func() (map[string][]common.ConnectionInfo, error) {
+		var connections []common.ConnectionInfo
+		for _, index := range indexes {
+			connections = append(connections, common.ConnectionInfo{Index: index})
+		}
+		return map[string][]common.ConnectionInfo{ServerName: connections}, nil
+	}
+	closeConnection = func(server string, index uint64) error {
+		closed = append(closed, index)
+		return nil
+	}
+
+	t.Cleanup(func() {
+		stateFile, getConnections, closeConnection = oldStateFile, oldGetConnections, oldCloseConnection
+		resetSessions()
+	})
+
+	resetSessions()
+	return &closed
+}
+
+func resetSessions() {
+	sessions = map[uint32]*GameSpySession{}
+	sessionsByConnIndex = map[uint64]*GameSpySession{}
+	lastConnIndex = 0
+}
+
+func TestStateReload(t *testing.T) {
+	closed := testReload(t, 1, 2, 3, 4)
+
+	loggedIn := &GameSpySession{ConnIndex: 1, LoggedIn: true, User: database.User{ProfileId: 1000}, FriendList: []uint32{1001}}
+	loggingIn := &GameSpySession{ConnIndex: 2, Challenge: "ABCDEFGHIJ"}
+	sessions[1000] = loggedIn
+	sessionsByConnIndex[1] = loggedIn
+	sessionsByConnIndex[2] = loggingIn
+	// Connection 3 closed before the reload
+	lastConnIndex = 3
+
+	if err := saveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	resetSessions()
+	if err := loadState(); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored := sessions[1000]; restored == nil || restored.ConnIndex != 1 || !slices.Equal(restored.FriendList, []uint32{1001}) {
+		t.Errorf("logged in session restored as %+v", restored)
+	}
+	if restored := sessionsByConnIndex[2]; restored == nil || restored.Challenge != "ABCDEFGHIJ" || restored.LoggedIn {
+		t.Errorf("session logging in restored as %+v", restored)
+	}
+
+	// Connection 3 has no session, 4 hasn't been announced yet
+	closeUnrestoredConnections(true)
+	if !slices.Equal(*closed, []uint64{3}) {
+		t.Errorf("closed connections %v", *closed)
+	}
+}
+
+func TestStateReloadFailed(t *testing.T) {
+	closed := testReload(t, 1, 2)
+
+	if err := loadState(); err == nil {
+		t.Fatal("loaded a missing state file")
+	}
+
+	closeUnrestoredConnections(false)
+	if !slices.Equal(*closed, []uint64{1, 2}) {
+		t.Errorf("closed connections %v", *closed)
+	}
+}
+
+func TestStateReloadFrontendUnavailable(t *testing.T) {
+	closed := testReload(t)
+	getConnections = func() (map[string][]common.ConnectionInfo, error) {
+		return nil, errors.New("unavailable")
+	}
+
+	closeUnrestoredConnections(false)
+	if len(*closed) != 0 {
+		t.Errorf("closed connections %v", *closed)
+	}
+}
+
+func TestBroadcastMessage(t *testing.T) {
+	testReload(t)
+
+	oldSendPacket := sendPacket
+	var sent []uint64
+	sendPacket = func(server string, index uint64, data []byte) error {
+		if index == 2 {
+			return errors.New("connection closed")
+		}
+		sent = append(sent, index)
+		return nil
+	}
+	t.Cleanup(func() { sendPacket = oldSendPacket })
+
+	for i := uint32(1); i <= 3; i++ {
+		session := &GameSpySession{ConnIndex: uint64(i), LoggedIn: true, User: database.User{ProfileId: 1000 + i}}
+		sessions[1000+i] = session
+		sessionsByConnIndex[uint64(i)] = session
+	}
+	// Not logged in yet
+	sessionsByConnIndex[4] = &GameSpySession{ConnIndex: 4}
+
+	result := BroadcastMessage("Rebooting in 5 minutes")
+	if result.Sent != 2 || result.Failed != 1 {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	slices.Sort(sent)
+	if !slices.Equal(sent, []uint64{1, 3}) {
+		t.Errorf("sent to %v", sent)
+	}
+}
+
+func TestBanError(t *testing.T) {
+	expires := time.Date(2030, 1, 2, 3, 4, 0, 0, time.UTC)
+	gpErr := banError(&common.BanInfo{TOS: true, Reason: "Cheating\\in public", Expires: expires})
+	if gpErr.WWFCMessage.ErrorCode != WWFCMsgProfileSuspended.ErrorCode {
+		t.Fatalf("got error code %d for a suspension", gpErr.WWFCMessage.ErrorCode)
+	}
+
+	commands, err := common.ParseGameSpyMessage(gpErr.GetMessageTranslate("mariokartwii", 0, LangEnglish, 0, 0x12345678))
+	if err != nil || len(commands) != 1 {
+		t.Fatal("invalid error message:", err)
+	}
+	if commands[0].OtherValues["errmsg"] != "The profile is suspended from the service until 2030-01-02 03:04 UTC. Reason: Cheating/in public" {
+		t.Errorf("unexpected errmsg %q", commands[0].OtherValues["errmsg"])
+	}
+
+	data, err := common.Base64DwcEncoding.DecodeString(commands[0].OtherValues["wwfc_errmsg"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message []rune
+	for i := 0; i+1 < len(data); i += 2 {
+		message = append(message, rune(data[i])<<8|rune(data[i+1]))
+	}
+	if !strings.Contains(string(message), "until 2030-01-02 03:04 UTC.\nCheating/in public\n") || !strings.Contains(string(message), "NG12345678") {
+		t.Errorf("unexpected message %q", string(message))
+	}
+
+	if gpErr := banError(&common.BanInfo{TOS: true}); gpErr.WWFCMessage.ErrorCode != WWFCMsgProfileBannedTOS.ErrorCode || gpErr.ErrorString != "The profile is banned from the service. Reason: Visit newwfc.xyz/tos" {
+		t.Errorf("unexpected permanent ban error %+v", gpErr)
+	}
+}
+
+func TestDuplicateLoginKick(t *testing.T) {
+	testReload(t)
+	t.Cleanup(func() { pendingLogouts = map[uint32]*pendingLogout{} })
+
+	old := &GameSpySession{ConnIndex: 1, LoggedIn: true, User: database.User{ProfileId: 1001}, AuthFriendList: []uint32{1002}}
+	friend := &GameSpySession{ConnIndex: 2, LoggedIn: true, User: database.User{ProfileId: 1002}, FriendList: []uint32{1001}, AuthFriendList: []uint32{1001}}
+	sessions[1001], sessionsByConnIndex[1] = old, old
+	sessions[1002], sessionsByConnIndex[2] = friend, friend
+
+	common.BeginReplay(ServerName, 1)
+	common.BeginReplay(ServerName, 2)
+	kicks := GetDuplicateLoginKickCount()
+
+	mutex.Lock()
+	done := old.kickDuplicate()
+	mutex.Unlock()
+
+	if sessions[1001] != nil || old.LoggedIn {
+		t.Error("the kicked session is still logged in")
+	}
+	if friend.isFriendAuthorized(1001) {
+		t.Error("the friend wasn't sent the offline status")
+	}
+	if GetDuplicateLoginKickCount() != kicks+1 {
+		t.Error("the kick wasn't counted")
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		mutex.Lock()
+		waitForLogout(1001)
+		mutex.Unlock()
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+		t.Fatal("a new login didn't wait for the logout")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	old.finishLogout(done)
+	<-waited
+
+	// The connection closing afterwards must not log the profile out again
+	CloseConnection(1)
+	if len(pendingLogouts) != 0 || len(qr2Logouts) != 0 {
+		t.Error("the closed connection started another logout")
+	}
+
+	oldSent := common.EndReplay(ServerName, 1)
+	if len(oldSent) != 1 || !strings.Contains(string(oldSent[0]), `\err\`+strconv.Itoa(ErrForcedDisconnect.ErrorCode)+`\`) {
+		t.Errorf("the kicked session was sent %q", oldSent)
+	}
+
+	friendSent := common.EndReplay(ServerName, 2)
+	if len(friendSent) != 1 || !strings.Contains(string(friendSent[0]), logOutMessage) {
+		t.Errorf("the friend was sent %q", friendSent)
+	}
+}
+
+func TestAuditEventIP(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"192.0.2.1:29900":     "192.0.2.1",
+		"[2001:db8::1]:29900": "2001:db8::1",
+		"192.0.2.1":           "192.0.2.1",
+	} {
+		g := &GameSpySession{RemoteAddr: addr}
+		if ip := g.auditEvent("login").IP; ip != expected {
+			t.Errorf("%s: got %q, expected %q", addr, ip, expected)
+		}
+	}
+}
@@ -213,7 +213,7 @@ func (g *GameSpySession) bestieMessage(command common.GameSpyCommand) {
 			return
 		}
 
-		if g.User.Restricted || toSession.User.Restricted {
+		if g.User.Restricted || toSession.User.Restricted || g.User.ShadowBanned || toSession.User.ShadowBanned {
 			// Check with QR2 if the room is public or private
 			resvError := qr2.CheckGPReservationAllowed(g.QR2IP, g.User.ProfileId, uint32(toProfileId), msgMatchData.Reservation.MatchType)
 			if resvError != "ok" {
@@ -235,6 +235,13 @@ func (g *GameSpySession) bestieMessage(command common.GameSpyCommand) {
 			}
 		}
 
+		// Hold a slot in the destination's room so it can't over-fill while this player connects
+		if !qr2.ReserveGroupSlot(g.User.ProfileId, uint32(toProfileId), msgMatchData.Reservation.LocalPlayerCount) {
+			logging.Warn(g.ModuleName, "RESERVATION: Room of", aurora.Cyan(toProfileId), "is full")
+			sendMessageToSessionBuffer("1", uint32(toProfileId), g, resvDenyMsg)
+			return
+		}
+
 		if !sameAddress {
 			searchId := qr2.GetSearchID(g.QR2IP)
 			msgMatchData.Reservation.PublicIP = uint32(searchId & 0xffffffff)
@@ -277,8 +284,13 @@ func (g *GameSpySession) bestieMessage(command common.GameSpyCommand) {
 				msgMatchData.ResvOK.PublicIP = uint32(searchId & 0xffffffff)
 				msgMatchData.ResvOK.PublicPort = uint16(searchId >> 32)
 			}
-		} else if toSession.ReservationPID == g.User.ProfileId {
-			toSession.ReservationPID = 0
+		} else {
+			// The host turned the player away, free their slot
+			qr2.ReleaseGroupSlot(uint32(toProfileId))
+
+			if toSession.ReservationPID == g.User.ProfileId {
+				toSession.ReservationPID = 0
+			}
 		}
 	} else if cmd == common.MatchTellAddr {
 		if g.QR2IP == 0 || toSession.QR2IP == 0 {
@@ -2,6 +2,8 @@ package gpcm
 
 import (
 	"os"
+	"unicode/utf16"
+	"wwfc/common"
 )
 
 var motdFilepath = "./motd.txt"
@@ -14,3 +16,8 @@ func GetMessageOfTheDay() (string, error) {
 
 	return string(contents), nil
 }
+
+// encodeMessage encodes text shown by the client the way it expects, as UTF-16 in DWC's base64
+func encodeMessage(text string) string {
+	return common.Base64DwcEncoding.EncodeToString(common.UTF16ToByteArray(utf16.Encode([]rune(text))))
+}
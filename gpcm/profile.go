@@ -1,10 +1,12 @@
 package gpcm
 
 import (
+	"slices"
 	"strconv"
 	"wwfc/common"
 	"wwfc/database"
 	"wwfc/logging"
+	"wwfc/profanity"
 
 	"github.com/logrusorgru/aurora/v3"
 )
@@ -30,7 +32,7 @@ func (g *GameSpySession) getProfile(command common.GameSpyCommand) {
 		mutex.Unlock()
 	} else {
 		mutex.Unlock()
-		user, ok = database.GetProfile(pool, ctx, uint32(profileId))
+		user, ok = store.GetProfile(ctx, uint32(profileId))
 		if !ok {
 			// The profile info was requested on is invalid.
 			g.replyError(ErrGetProfileBadProfile)
@@ -38,24 +40,30 @@ func (g *GameSpySession) getProfile(command common.GameSpyCommand) {
 		}
 	}
 
+	if locstring == "" {
+		locstring = user.Location
+	}
+
 	if user.ProfileId == g.User.ProfileId {
 		g.WriteBuffer += common.CreateGameSpyMessage(common.GameSpyCommand{
 			Command:      "pi",
 			CommandValue: "",
 			OtherValues: map[string]string{
-				"profileid":  command.OtherValues["profileid"],
-				"nick":       user.UniqueNick,
-				"userid":     strconv.FormatUint(uint64(user.UserId), 10),
-				"email":      user.Email,
-				"sig":        common.RandomHexString(32),
-				"uniquenick": user.UniqueNick,
-				"firstname":  user.FirstName,
-				"lastname":   user.LastName,
-				"pid":        "11",
-				"lon":        "0.000000",
-				"lat":        "0.000000",
-				"loc":        locstring,
-				"id":         command.OtherValues["id"],
+				"profileid":   command.OtherValues["profileid"],
+				"nick":        user.UniqueNick,
+				"userid":      strconv.FormatUint(uint64(user.UserId), 10),
+				"email":       user.Email,
+				"sig":         common.RandomHexString(32),
+				"uniquenick":  user.UniqueNick,
+				"firstname":   user.FirstName,
+				"lastname":    user.LastName,
+				"zipcode":     user.ZipCode,
+				"countrycode": user.CountryCode,
+				"pid":         "11",
+				"lon":         "0.000000",
+				"lat":         "0.000000",
+				"loc":         locstring,
+				"id":          command.OtherValues["id"],
 			},
 		})
 	} else {
@@ -63,26 +71,102 @@ func (g *GameSpySession) getProfile(command common.GameSpyCommand) {
 			Command:      "pi",
 			CommandValue: "",
 			OtherValues: map[string]string{
-				"profileid":  command.OtherValues["profileid"],
-				"nick":       "000000000" + user.GsbrCode[:4] + "0000000",
-				"userid":     "0",
-				"email":      "000000000" + user.GsbrCode[:4] + "0000000" + "@nds",
-				"sig":        common.RandomHexString(32),
-				"uniquenick": "000000000" + user.GsbrCode[:4] + "0000000",
-				"firstname":  user.FirstName,
-				"lastname":   "000000000" + user.GsbrCode[:4] + "0000000",
-				"pid":        "11",
-				"lon":        "0.000000",
-				"lat":        "0.000000",
-				"loc":        locstring,
-				"id":         command.OtherValues["id"],
+				"profileid":   command.OtherValues["profileid"],
+				"nick":        "000000000" + user.GsbrCode[:4] + "0000000",
+				"userid":      "0",
+				"email":       "000000000" + user.GsbrCode[:4] + "0000000" + "@nds",
+				"sig":         common.RandomHexString(32),
+				"uniquenick":  "000000000" + user.GsbrCode[:4] + "0000000",
+				"firstname":   user.FirstName,
+				"lastname":    "000000000" + user.GsbrCode[:4] + "0000000",
+				"countrycode": user.CountryCode,
+				"pid":         "11",
+				"lon":         "0.000000",
+				"lat":         "0.000000",
+				"loc":         locstring,
+				"id":          command.OtherValues["id"],
 			},
 		})
 	}
 }
 
+// Maximum lengths of the profile fields that can be changed by the client, from the GP SDK limits
+var (
+	updateProfileFields = map[string]int{
+		"firstname":     30,
+		"lastname":      30,
+		"zipcode":       10,
+		"countrycode":   2,
+		"loc":           127,
+		"wwfc_openhost": 1,
+	}
+
+	updateUserInfoFields = map[string]int{
+		"email": 50,
+	}
+
+	// Profile fields other players can see, checked against the word list
+	profanityCheckedFields = []string{"firstname", "lastname"}
+)
+
+// Pick out the fields that can be changed from the command and validate them.
+// Returns the name of the first invalid field, or an empty string if everything is valid.
+func validateProfileUpdate(values map[string]string, allowedFields map[string]int) (map[string]string, string) {
+	update := map[string]string{}
+
+	for key, value := range values {
+		maxLength, ok := allowedFields[key]
+		if !ok {
+			continue
+		}
+
+		if len(value) > maxLength {
+			return nil, key
+		}
+
+		for _, c := range []byte(value) {
+			// Control characters and the status string separator could break other clients' parsers
+			if c < 0x20 || c >= 0x7f || c == '|' {
+				return nil, key
+			}
+		}
+
+		update[key] = value
+	}
+
+	return update, ""
+}
+
+// isProfane checks text against the word lists, unless the game has the filter turned off
+func (g *GameSpySession) isProfane(text string) bool {
+	if game := common.GetGameInfoByName(g.GameName); game != nil && game.NoProfanityFilter {
+		return false
+	}
+
+	return profanity.Check(text, int(g.Language))
+}
+
 func (g *GameSpySession) updateProfile(command common.GameSpyCommand) {
-	if openHost, ok := command.OtherValues["wwfc_openhost"]; ok {
+	update, invalidField := validateProfileUpdate(command.OtherValues, updateProfileFields)
+	if invalidField != "" {
+		logging.Error(g.ModuleName, "Invalid profile field:", aurora.Cyan(invalidField), aurora.Cyan(command.OtherValues[invalidField]))
+		g.replyError(ErrUpdateProfile)
+		return
+	}
+
+	for _, field := range profanityCheckedFields {
+		if value, ok := update[field]; ok && g.isProfane(value) {
+			logging.Notice(g.ModuleName, "Rejected profane profile field:", aurora.Cyan(field), aurora.Red(value))
+			g.replyError(ErrUpdateProfile)
+			return
+		}
+	}
+
+	if len(update) == 0 {
+		return
+	}
+
+	if openHost, ok := update["wwfc_openhost"]; ok {
 		enabled := openHost != "0"
 		if !g.User.OpenHost && enabled { //PP openhost
 			g.openHostEnabled(true, true)
@@ -91,7 +175,60 @@ func (g *GameSpySession) updateProfile(command common.GameSpyCommand) {
 		}
 	}
 
-	g.User.UpdateProfile(pool, ctx, command.OtherValues)
+	g.applyProfileUpdate(update)
+}
+
+func (g *GameSpySession) updateUserInfo(command common.GameSpyCommand) {
+	update, invalidField := validateProfileUpdate(command.OtherValues, updateUserInfoFields)
+	if invalidField != "" {
+		logging.Error(g.ModuleName, "Invalid user info field:", aurora.Cyan(invalidField), aurora.Cyan(command.OtherValues[invalidField]))
+		g.replyError(ErrUpdateUserInfo)
+		return
+	}
+
+	if len(update) == 0 {
+		return
+	}
+
+	g.applyProfileUpdate(update)
+}
+
+// VerifySessionKey checks that the profile is logged in with the session key
+func VerifySessionKey(profileId uint32, sessionKey int32) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	session, ok := sessions[profileId]
+	return ok && session.LoggedIn && session.SessionKey == sessionKey
+}
+
+// GetProfilesWithFriend returns the online profiles that have the profile ID on their friend list
+func GetProfilesWithFriend(profileId uint32) []uint32 {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var profileIds []uint32
+	for _, session := range sessions {
+		if session.LoggedIn && session.User.ProfileId != profileId && session.isFriendAdded(profileId) {
+			profileIds = append(profileIds, session.User.ProfileId)
+		}
+	}
+
+	return profileIds
+}
+
+// GetFriendLists returns the friend lists the profile sent when it logged in, which aren't stored
+// anywhere else. Returns false if the profile isn't logged in.
+func GetFriendLists(profileId uint32) (friends []uint32, authorized []uint32, online bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	session, ok := sessions[profileId]
+	if !ok || !session.LoggedIn {
+		return nil, nil, false
+	}
+
+	return slices.Clone(session.FriendList), slices.Clone(session.AuthFriendList), true
 }
 
 func VerifyPlayerSearch(profileId uint32, sessionKey int32, gameName string) (string, bool) {
@@ -104,3 +241,15 @@ func VerifyPlayerSearch(profileId uint32, sessionKey int32, gameName string) (st
 
 	return "", false
 }
+
+// Write the update to the database, then apply it to the session so getprofile sees it right away
+func (g *GameSpySession) applyProfileUpdate(update map[string]string) {
+	user := g.User
+	user.UpdateProfile(store, ctx, update)
+
+	mutex.Lock()
+	g.User = user
+	mutex.Unlock()
+
+	logging.Info(g.ModuleName, "Updated profile fields:", aurora.Cyan(len(update)))
+}
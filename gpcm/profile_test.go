@@ -0,0 +1,47 @@
+package gpcm
+
+import (
+	"testing"
+	"wwfc/common"
+)
+
+func TestValidateProfileUpdate(t *testing.T) {
+	commands, err := common.ParseGameSpyMessage(`\updatepro\\sesskey\199714190\firstname\Player\zipcode\12345\partnerid\11\id\4\final\`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update, invalid := validateProfileUpdate(commands[0].OtherValues, updateProfileFields)
+	if invalid != "" {
+		t.Fatal("unexpected invalid field", invalid)
+	}
+
+	// Only the fields that were sent should be updated
+	if len(update) != 2 || update["firstname"] != "Player" || update["zipcode"] != "12345" {
+		t.Error("unexpected update", update)
+	}
+}
+
+func TestValidateProfileUpdateInvalid(t *testing.T) {
+	tests := []map[string]string{
+		{"firstname": "Player\x01"},
+		{"loc": "|s|2|ss|Online"},
+		{"countrycode": "USA"},
+		{"lastname": "0123456789012345678901234567890"},
+	}
+
+	for _, values := range tests {
+		if _, invalid := validateProfileUpdate(values, updateProfileFields); invalid == "" {
+			t.Error("expected invalid field in", values)
+		}
+	}
+
+	commands, err := common.ParseGameSpyMessage(`\updateui\\sesskey\199714190\email\player@example.com\id\5\final\`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if update, invalid := validateProfileUpdate(commands[0].OtherValues, updateUserInfoFields); invalid != "" || update["email"] != "player@example.com" {
+		t.Error("unexpected result", update, invalid)
+	}
+}
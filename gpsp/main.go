@@ -1,27 +1,122 @@
 package gpsp
 
 import (
+	"context"
+	"encoding/gob"
+	"os"
+	"time"
 	"wwfc/common"
+	"wwfc/database"
 	"wwfc/gpcm"
 	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+	"github.com/sasha-s/go-deadlock"
 )
 
 var ServerName = "gpsp"
 
+type GameSpySession struct {
+	ConnIndex     uint64
+	RemoteAddr    string
+	TraceID       string
+	SearchHistory []time.Time
+}
+
+var (
+	ctx   = context.Background()
+	store database.Store
+
+	sessions = map[uint64]*GameSpySession{}
+	mutex    = deadlock.Mutex{}
+)
+
 func StartServer(reload bool) {
+	// Get config
+	config := common.GetConfig()
+
+	// Start SQL
+	var err error
+	store, err = database.Connect(ctx, config)
+	if err != nil {
+		panic(err)
+	}
+
+	if reload {
+		// The connections carry on with this backend, their searches are still rate limited
+		if err := loadSessions(); err != nil {
+			panic(err)
+		}
+
+		for _, session := range sessions {
+			logging.SetConnectionTrace("GPSP", session.ConnIndex, session.TraceID)
+		}
+
+		logging.Notice("GPSP", "Loaded", aurora.Cyan(len(sessions)), "sessions")
+	}
 }
 
 func Shutdown() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if err := saveSessions(); err != nil {
+		panic(err)
+	}
+
+	logging.Notice("GPSP", "Saved", aurora.Cyan(len(sessions)), "sessions")
 }
 
-func NewConnection(index uint64, address string) {
+// Save the sessions for the backend that replaces this one. Expects the mutex to already be locked.
+func saveSessions() error {
+	file, err := os.OpenFile("state/gpsp_sessions.gob", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(file).Encode(sessions)
+	file.Close()
+	return err
+}
+
+func loadSessions() error {
+	file, err := os.Open("state/gpsp_sessions.gob")
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	err = gob.NewDecoder(file).Decode(&sessions)
+	file.Close()
+	return err
+}
+
+func NewConnection(index uint64, address string, traceID string) {
+	logging.SetConnectionTrace("GPSP", index, traceID)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	sessions[index] = &GameSpySession{
+		ConnIndex:  index,
+		RemoteAddr: address,
+		TraceID:    traceID,
+	}
 }
 
 func CloseConnection(index uint64) {
+	logging.ClearConnectionTrace("GPSP", index)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	delete(sessions, index)
 }
 
 func HandlePacket(index uint64, data []byte) {
-	moduleName := "GPSP"
+	moduleName := logging.ConnectionModule("GPSP", index, "")
 
 	// TODO: Handle split packets
 	message := ""
@@ -48,10 +143,19 @@ func HandlePacket(index uint64, data []byte) {
 			common.SendPacket(ServerName, index, []byte(`\ka\\final\`))
 
 		case "otherslist":
-			common.SendPacket(ServerName, index, []byte(handleOthersList(command)))
+			common.SendPacket(ServerName, index, []byte(handleOthersList(index, command)))
+
+		case "others":
+			common.SendPacket(ServerName, index, []byte(handleOthers(index, command)))
 
 		case "search":
-			common.SendPacket(ServerName, index, []byte(handleSearch(command)))
+			if !checkSearchRateLimit(index) {
+				logging.Warn(moduleName, "Search rate limit exceeded")
+				common.SendPacket(ServerName, index, []byte(gpcm.ErrSearch.GetMessage()))
+				continue
+			}
+
+			common.SendPacket(ServerName, index, []byte(handleSearch(index, command)))
 		}
 	}
 }
@@ -0,0 +1,50 @@
+package gpsp
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSessionsKeptOverReload(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		sessions = map[uint64]*GameSpySession{}
+	})
+	if err := os.Mkdir("state", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	NewConnection(3, "192.0.2.1:29901", "gpsp-3-abcd")
+	for i := 0; i < searchRateLimit; i++ {
+		if !checkSearchRateLimit(3) {
+			t.Fatalf("search %d was limited", i)
+		}
+	}
+
+	Shutdown()
+	sessions = map[uint64]*GameSpySession{}
+	if err := loadSessions(); err != nil {
+		t.Fatal(err)
+	}
+
+	session := sessions[3]
+	if session == nil || session.RemoteAddr != "192.0.2.1:29901" || session.TraceID != "gpsp-3-abcd" {
+		t.Fatalf("got session %+v", session)
+	}
+	if len(session.SearchHistory) != searchRateLimit || time.Since(session.SearchHistory[0]) > time.Minute {
+		t.Errorf("got search history %v", session.SearchHistory)
+	}
+
+	// Still limited by the searches made before the reload
+	if checkSearchRateLimit(3) {
+		t.Error("reload reset the search rate limit")
+	}
+}
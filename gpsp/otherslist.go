@@ -10,8 +10,8 @@ import (
 	"github.com/logrusorgru/aurora/v3"
 )
 
-func handleOthersList(command common.GameSpyCommand) string {
-	moduleName := "GPSP"
+func handleOthersList(index uint64, command common.GameSpyCommand) string {
+	moduleName := logging.ConnectionModule("GPSP", index, "")
 
 	strProfileId, ok := command.OtherValues["profileid"]
 	if !ok {
@@ -25,7 +25,7 @@ func handleOthersList(command common.GameSpyCommand) string {
 		return gpcm.ErrSearch.GetMessage()
 	}
 
-	moduleName = "GPSP:" + strconv.FormatUint(profileId, 10)
+	moduleName = logging.ConnectionModule("GPSP", index, strconv.FormatUint(profileId, 10))
 	logging.Info(moduleName, "Lookup otherslist for", aurora.Cyan(profileId))
 
 	strSessionKey, ok := command.OtherValues["sesskey"]
@@ -2,29 +2,109 @@ package gpsp
 
 import (
 	"strconv"
+	"strings"
+	"time"
 	"wwfc/common"
+	"wwfc/database"
 	"wwfc/gpcm"
 	"wwfc/logging"
 
 	"github.com/logrusorgru/aurora/v3"
 )
 
-func handleSearch(command common.GameSpyCommand) string {
-	moduleName := "GPSP"
+const (
+	// Results returned per search request, the client asks for the next page with "skip"
+	searchPageSize = 20
 
+	// Maximum number of searches allowed per connection within searchRateWindow
+	searchRateLimit  = 5
+	searchRateWindow = 10 * time.Second
+
+	maxSearchFieldLength = 64
+
+	// Shortest nick accepted for a substring search, shorter ones would match most of the table
+	minNickSearchLength = 3
+)
+
+// Returns false if the connection has made too many searches recently
+func checkSearchRateLimit(index uint64) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	session := sessions[index]
+	if session == nil {
+		return false
+	}
+
+	now := time.Now()
+	history := session.SearchHistory[:0]
+	for _, searchTime := range session.SearchHistory {
+		if now.Sub(searchTime) < searchRateWindow {
+			history = append(history, searchTime)
+		}
+	}
+
+	if len(history) >= searchRateLimit {
+		session.SearchHistory = history
+		return false
+	}
+
+	session.SearchHistory = append(history, now)
+	return true
+}
+
+// Verify the profile ID and session key sent with a search request
+func verifySearcher(moduleName string, command common.GameSpyCommand) (uint32, bool) {
 	strProfileId, ok := command.OtherValues["profileid"]
 	if !ok {
-		logging.Error(moduleName, "Missing profileid in search")
-		return gpcm.ErrSearch.GetMessage()
+		logging.Error(moduleName, "Missing profileid in", command.Command)
+		return 0, false
 	}
 
 	profileId, err := strconv.ParseUint(strProfileId, 10, 32)
 	if err != nil {
 		logging.Error(moduleName, "Invalid profileid:", strProfileId)
+		return 0, false
+	}
+
+	strSessionKey, ok := command.OtherValues["sesskey"]
+	if !ok {
+		logging.Error(moduleName, "Missing sesskey in", command.Command)
+		return 0, false
+	}
+
+	sessionKey, err := strconv.ParseInt(strSessionKey, 10, 32)
+	if err != nil {
+		logging.Error(moduleName, "Invalid sesskey:", strSessionKey)
+		return 0, false
+	}
+
+	if !gpcm.VerifySessionKey(uint32(profileId), int32(sessionKey)) {
+		logging.Error(moduleName, "Session key verify failed for", aurora.Cyan(profileId))
+		return 0, false
+	}
+
+	return uint32(profileId), true
+}
+
+// The nick and uniquenick of other players are never exposed, the same as in GPCM getprofile
+func anonymousNick(gsbrCode string) string {
+	if len(gsbrCode) < 4 {
+		gsbrCode += "0000"
+	}
+
+	return "000000000" + gsbrCode[:4] + "0000000"
+}
+
+func handleSearch(index uint64, command common.GameSpyCommand) string {
+	moduleName := logging.ConnectionModule("GPSP", index, "")
+
+	profileId, ok := verifySearcher(moduleName, command)
+	if !ok {
 		return gpcm.ErrSearch.GetMessage()
 	}
 
-	moduleName = "GPSP:" + strconv.FormatUint(profileId, 10)
+	moduleName = logging.ConnectionModule("GPSP", index, strconv.FormatUint(uint64(profileId), 10))
 
 	logInfo := ""
 	for _, field := range []string{
@@ -41,7 +121,101 @@ func handleSearch(command common.GameSpyCommand) string {
 		logging.Info(moduleName, "Search"+logInfo)
 	}
 
-	return common.CreateGameSpyMessage(common.GameSpyCommand{
-		Command: "bsrdone",
-	})
+	search := database.ProfileSearch{
+		Nick:       command.OtherValues["nick"],
+		UniqueNick: command.OtherValues["uniquenick"],
+		Email:      command.OtherValues["email"],
+		FirstName:  command.OtherValues["firstname"],
+		LastName:   command.OtherValues["lastname"],
+	}
+
+	if search.Nick != "" && len([]rune(search.Nick)) < minNickSearchLength {
+		logging.Error(moduleName, "Nick search is too short")
+		return gpcm.ErrSearch.GetMessage()
+	}
+
+	for _, value := range []string{search.Nick, search.UniqueNick, search.Email, search.FirstName, search.LastName} {
+		if len(value) > maxSearchFieldLength {
+			logging.Error(moduleName, "Search field is too long")
+			return gpcm.ErrSearch.GetMessage()
+		}
+	}
+
+	if search == (database.ProfileSearch{}) {
+		// Nothing to search for
+		return `\bsrdone\\more\0\final\`
+	}
+
+	skip := 0
+	if strSkip, ok := command.OtherValues["skip"]; ok {
+		var err error
+		skip, err = strconv.Atoi(strSkip)
+		if err != nil || skip < 0 {
+			logging.Error(moduleName, "Invalid skip:", aurora.Cyan(strSkip))
+			return gpcm.ErrSearch.GetMessage()
+		}
+	}
+
+	results, total, err := store.SearchProfiles(ctx, search, skip, searchPageSize)
+	if err != nil {
+		logging.Error(moduleName, "Search failed:", err)
+		return gpcm.ErrSearch.GetMessage()
+	}
+
+	namespaceId := command.OtherValues["namespaceid"]
+	if namespaceId == "" {
+		namespaceId = "16"
+	}
+
+	payload := ""
+	for _, result := range results {
+		nick := anonymousNick(result.GsbrCode)
+		payload += `\bsr\` + strconv.FormatUint(uint64(result.ProfileId), 10)
+		if result.InGameName != "" {
+			// Backslashes would break the message framing
+			payload += `\nick\` + strings.ReplaceAll(result.InGameName, `\`, "")
+		} else {
+			payload += `\nick\` + nick
+		}
+		payload += `\firstname\` + result.FirstName
+		payload += `\lastname\` + nick
+		payload += `\email\` + nick + "@nds"
+		payload += `\uniquenick\` + nick
+		payload += `\namespaceid\` + namespaceId
+	}
+
+	more := max(0, total-skip-len(results))
+	logging.Info(moduleName, "Search returned", aurora.Cyan(len(results)), "results,", aurora.Cyan(more), "more")
+
+	return payload + `\bsrdone\\more\` + strconv.Itoa(more) + `\final\`
+}
+
+func handleOthers(index uint64, command common.GameSpyCommand) string {
+	moduleName := logging.ConnectionModule("GPSP", index, "")
+
+	profileId, ok := verifySearcher(moduleName, command)
+	if !ok {
+		return gpcm.ErrSearch.GetMessage()
+	}
+
+	moduleName = logging.ConnectionModule("GPSP", index, strconv.FormatUint(uint64(profileId), 10))
+	logging.Info(moduleName, "Lookup others for", aurora.Cyan(profileId))
+
+	payload := `\others\`
+	for _, otherId := range gpcm.GetProfilesWithFriend(profileId) {
+		user, ok := store.GetProfile(ctx, otherId)
+		if !ok {
+			continue
+		}
+
+		nick := anonymousNick(user.GsbrCode)
+		payload += `\o\` + strconv.FormatUint(uint64(otherId), 10)
+		payload += `\nick\` + nick
+		payload += `\uniquenick\` + nick
+		payload += `\first\` + user.FirstName
+		payload += `\last\` + nick
+		payload += `\email\` + nick + "@nds"
+	}
+
+	return payload + `\odone\\final\`
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"time"
+	"wwfc/api"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+var healthCheckTimeout = 2 * time.Second
+
+// startHealthServer serves /healthz from the frontend, so the health check keeps
+// answering (with "reloading") while the backend is restarting
+func startHealthServer(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		api.WriteHealth(w, frontendHealth())
+	})
+	mux.HandleFunc("/version", api.HandleVersion)
+
+	go func() {
+		logging.Notice("FRONTEND", "Serving health check on", aurora.BrightCyan(address))
+		err := serveHTTP("health check", address, mux)
+		if err != nil {
+			logging.Error("FRONTEND", "Health check server failed:", err)
+		}
+	}()
+}
+
+func frontendHealth() string {
+	if backendWaiting.Load() {
+		return "waiting"
+	}
+
+	// The RPC mutex is held for writing while the backend is starting or reloading
+	if !rpcMutex.TryRLock() {
+		return "reloading"
+	}
+	client := rpcClient
+	rpcMutex.RUnlock()
+
+	if client == nil {
+		return "starting"
+	}
+
+	var status BackendStatus
+	call := client.Go("RPCPacket.Status", struct{}{}, &status, nil)
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return "unavailable"
+		}
+
+	case <-time.After(healthCheckTimeout):
+		return "timeout"
+	}
+
+	if !status.Ready {
+		return "starting"
+	}
+
+	// A backend server failed to start and the backend runs without it
+	if failedBackendServers.Load() != nil {
+		return "failed"
+	}
+
+	if !isReady() {
+		return "starting"
+	}
+
+	return "ok"
+}
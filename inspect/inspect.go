@@ -0,0 +1,418 @@
+// Signatures of known exploit payloads, checked against data hosts send that is forwarded to
+// other clients. The signatures are read from a file which is reread when it changes on disk, so
+// a new exploit can be blocked without a release.
+package inspect
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// Values of Signature.Target
+const (
+	// A match command sent through the server browser, the data is the command body
+	TargetMatch = "match"
+	// A heartbeat value, stored in the session and sent to clients listing servers
+	TargetHeartbeat = "heartbeat"
+	// A datagram passed through a NATNEG relay
+	TargetRelay = "relay"
+)
+
+// Values of Signature.Action
+const (
+	// Drop the payload, and count it against the sender
+	ActionDrop = "drop"
+	// Only log and report the match, for signatures that may have false positives
+	ActionFlag = "flag"
+)
+
+// Signature is one entry of the signature file. A payload matches when every condition that is set
+// holds: the game, target, command or key select which payloads are checked, and at least one of
+// maxLength and pattern must be set.
+type Signature struct {
+	Name   string `xml:"name,attr"`
+	Game   string `xml:"game,attr,omitempty"`
+	Target string `xml:"target,attr"`
+	// Match command type, as a number ("0x02" or "2")
+	Command string `xml:"command,attr,omitempty"`
+	// Heartbeat key
+	Key string `xml:"key,attr,omitempty"`
+	// Matches data longer than this
+	MaxLength int `xml:"maxLength,attr,omitempty"`
+	// Hex bytes with ?? for any byte, found anywhere in the data unless offset is set
+	Pattern string `xml:"pattern,attr,omitempty"`
+	Offset  *int   `xml:"offset,attr"`
+	// ActionDrop if empty
+	Action string `xml:"action,attr,omitempty"`
+	// Bans the sender for this many hours if set, only when its profile is known
+	BanHours int `xml:"banHours,attr,omitempty"`
+}
+
+type signatureFile struct {
+	Signatures []Signature `xml:"signature"`
+}
+
+// compiled is a signature ready to be matched
+type compiled struct {
+	Signature
+	command int
+	// -1 for a wildcard
+	pattern []int
+}
+
+// Payload is data from a client about to be forwarded to another
+type Payload struct {
+	Target string
+	Game   string
+	// Match command type, -1 if not a match command
+	Command int
+	Key     string
+	Data    []byte
+
+	// The sender, the profile ID is 0 if it's unknown
+	ProfileID uint32
+	Address   string
+}
+
+// Event is a payload that matched a signature
+type Event struct {
+	Time      time.Time `json:"time"`
+	Signature string    `json:"signature"`
+	Action    string    `json:"action"`
+	Banned    bool      `json:"banned"`
+	Target    string    `json:"target"`
+	Game      string    `json:"game"`
+	Command   int       `json:"command,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	ProfileID uint32    `json:"profile_id"`
+	Address   string    `json:"address"`
+	Length    int       `json:"length"`
+	// The start of the data, hex encoded
+	Data string `json:"data"`
+}
+
+const (
+	// Events kept for operators
+	maxEvents = 256
+	// Bytes of a payload kept in an event
+	maxEventData = 64
+)
+
+var (
+	mutex      sync.Mutex
+	path       string
+	modTime    time.Time
+	size       int64
+	loaded     bool
+	signatures = map[string][]*compiled{}
+	lastCheck  time.Time
+
+	events []Event
+
+	// How often the file is checked for changes
+	reloadInterval = time.Second
+
+	// Called to ban the sender of a payload matching a signature with banHours set
+	banCallback func(profileId uint32, length time.Duration, reason string)
+)
+
+// SetBanCallback sets the function that bans a profile
+func SetBanCallback(callback func(profileId uint32, length time.Duration, reason string)) {
+	banCallback = callback
+}
+
+// SetFile replaces the signatures with the ones in the file at the path, which is loaded straight
+// away. An empty path disables inspection, and a missing file is logged and treated as empty
+// until it's created.
+func SetFile(filePath string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	path = filePath
+	loaded = false
+	signatures = map[string][]*compiled{}
+	if path != "" {
+		reload()
+	}
+
+	lastCheck = time.Now()
+}
+
+// Inspect checks the payload against the signatures for its target, and logs and reports every
+// match. Returns false if the payload must be dropped.
+func Inspect(moduleName string, payload Payload) bool {
+	mutex.Lock()
+
+	if path != "" && time.Since(lastCheck) >= reloadInterval {
+		lastCheck = time.Now()
+		reloadIfChanged()
+	}
+
+	var matches []*compiled
+	for _, signature := range signatures[payload.Target] {
+		if signature.matches(payload) {
+			matches = append(matches, signature)
+		}
+	}
+
+	if len(matches) == 0 {
+		mutex.Unlock()
+		return true
+	}
+
+	allow := true
+	var ban *compiled
+	for _, signature := range matches {
+		if signature.Action != ActionFlag {
+			allow = false
+		}
+		if signature.BanHours > 0 && payload.ProfileID != 0 && banCallback != nil && (ban == nil || signature.BanHours > ban.BanHours) {
+			ban = signature
+		}
+	}
+
+	for _, signature := range matches {
+		addEvent(payload, signature, signature == ban)
+	}
+	mutex.Unlock()
+
+	for _, signature := range matches {
+		logging.Warn(moduleName, "Payload from profile", aurora.Cyan(payload.ProfileID), "IP", aurora.BrightCyan(payload.Address), "matches signature", aurora.Cyan(signature.Name).String()+",", signature.Action)
+	}
+
+	if ban != nil {
+		logging.Notice(moduleName, "Banning profile", aurora.Cyan(payload.ProfileID), "for", aurora.Cyan(ban.BanHours), "hours")
+		go banCallback(payload.ProfileID, time.Duration(ban.BanHours)*time.Hour, "Sent a payload matching signature "+ban.Name)
+	}
+
+	return allow
+}
+
+// Events returns the most recent events, newest first
+func Events() []Event {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	recent := make([]Event, len(events))
+	for i, event := range events {
+		recent[len(events)-1-i] = event
+	}
+	return recent
+}
+
+func addEvent(payload Payload, signature *compiled, banned bool) {
+	event := Event{
+		Time:      time.Now().UTC(),
+		Signature: signature.Name,
+		Action:    signature.Action,
+		Banned:    banned,
+		Target:    payload.Target,
+		Game:      payload.Game,
+		Key:       payload.Key,
+		ProfileID: payload.ProfileID,
+		Address:   payload.Address,
+		Length:    len(payload.Data),
+		Data:      hex.EncodeToString(payload.Data[:min(len(payload.Data), maxEventData)]),
+	}
+	if payload.Command >= 0 {
+		event.Command = payload.Command
+	}
+
+	if len(events) >= maxEvents {
+		events = events[1:]
+	}
+	events = append(events, event)
+}
+
+func (s *compiled) matches(payload Payload) bool {
+	if s.Game != "" && s.Game != payload.Game {
+		return false
+	}
+	if s.command >= 0 && s.command != payload.Command {
+		return false
+	}
+	if s.Key != "" && s.Key != payload.Key {
+		return false
+	}
+
+	if s.MaxLength > 0 && len(payload.Data) <= s.MaxLength {
+		return false
+	}
+
+	if s.pattern != nil {
+		if s.Offset != nil {
+			return matchAt(payload.Data, *s.Offset, s.pattern)
+		}
+
+		for i := 0; i+len(s.pattern) <= len(payload.Data); i++ {
+			if matchAt(payload.Data, i, s.pattern) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func matchAt(data []byte, offset int, pattern []int) bool {
+	if offset+len(pattern) > len(data) {
+		return false
+	}
+
+	for i, b := range pattern {
+		if b >= 0 && data[offset+i] != byte(b) {
+			return false
+		}
+	}
+	return true
+}
+
+// compile checks the signature and parses its command and pattern
+func compile(signature Signature) (*compiled, error) {
+	s := &compiled{Signature: signature, command: -1}
+
+	if s.Name == "" {
+		return nil, errors.New("missing name")
+	}
+
+	switch s.Target {
+	case TargetMatch, TargetHeartbeat, TargetRelay:
+	default:
+		return nil, errors.New("unknown target " + strconv.Quote(s.Target))
+	}
+
+	switch s.Action {
+	case "":
+		s.Action = ActionDrop
+	case ActionDrop, ActionFlag:
+	default:
+		return nil, errors.New("unknown action " + strconv.Quote(s.Action))
+	}
+
+	if s.Command != "" {
+		if s.Target != TargetMatch {
+			return nil, errors.New("command is only used with target " + TargetMatch)
+		}
+
+		command, err := strconv.ParseUint(s.Command, 0, 8)
+		if err != nil {
+			return nil, errors.New("invalid command " + strconv.Quote(s.Command))
+		}
+		s.command = int(command)
+	}
+
+	if s.Key != "" && s.Target != TargetHeartbeat {
+		return nil, errors.New("key is only used with target " + TargetHeartbeat)
+	}
+
+	if s.MaxLength < 0 || s.BanHours < 0 || (s.Offset != nil && *s.Offset < 0) {
+		return nil, errors.New("maxLength, offset and banHours can't be negative")
+	}
+
+	if s.Pattern != "" {
+		for _, field := range strings.Fields(s.Pattern) {
+			for len(field) != 0 {
+				if len(field) == 1 {
+					return nil, errors.New("odd number of digits in pattern")
+				}
+
+				if field[:2] == "??" {
+					s.pattern = append(s.pattern, -1)
+				} else {
+					b, err := strconv.ParseUint(field[:2], 16, 8)
+					if err != nil {
+						return nil, errors.New("invalid byte " + strconv.Quote(field[:2]) + " in pattern")
+					}
+					s.pattern = append(s.pattern, int(b))
+				}
+				field = field[2:]
+			}
+		}
+	}
+
+	if s.MaxLength == 0 && len(s.pattern) == 0 {
+		return nil, errors.New("needs a maxLength or pattern, it would match every payload")
+	}
+	if s.Offset != nil && len(s.pattern) == 0 {
+		return nil, errors.New("offset is only used with a pattern")
+	}
+
+	return s, nil
+}
+
+func reloadIfChanged() {
+	info, err := os.Stat(path)
+	if err != nil {
+		if loaded && errors.Is(err, os.ErrNotExist) {
+			logging.Warn("INSPECT", "Signature file", aurora.Cyan(path), "was removed, keeping the last loaded signatures")
+			loaded = false
+		}
+		return
+	}
+
+	if !loaded || !info.ModTime().Equal(modTime) || info.Size() != size {
+		reload()
+	}
+}
+
+// reload reads the file. A signature with an error is skipped, the file failing to parse keeps the
+// signatures loaded before.
+func reload() {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logging.Warn("INSPECT", "Failed to read signature file", aurora.Cyan(path).String()+":", err)
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		logging.Error("INSPECT", "Failed to read signature file", aurora.Cyan(path).String()+":", err)
+		return
+	}
+	modTime = info.ModTime()
+	size = info.Size()
+
+	var file signatureFile
+	if err := xml.Unmarshal(data, &file); err != nil {
+		logging.Error("INSPECT", "Failed to parse signature file", aurora.Cyan(path).String()+":", err)
+		// Not retried until the file changes again
+		loaded = true
+		return
+	}
+
+	count := 0
+	names := map[string]bool{}
+	loadedSignatures := map[string][]*compiled{}
+	for _, signature := range file.Signatures {
+		s, err := compile(signature)
+		if err == nil && names[s.Name] {
+			err = errors.New("duplicate name")
+		}
+		if err != nil {
+			logging.Error("INSPECT", "Skipping signature", aurora.Cyan(signature.Name).String()+":", err)
+			continue
+		}
+
+		names[s.Name] = true
+		loadedSignatures[s.Target] = append(loadedSignatures[s.Target], s)
+		count++
+	}
+
+	signatures = loadedSignatures
+	if loaded {
+		logging.Notice("INSPECT", "Reloaded", aurora.Cyan(count), "signatures from", aurora.Cyan(path))
+	} else {
+		logging.Info("INSPECT", "Loaded", aurora.Cyan(count), "signatures from", aurora.Cyan(path))
+	}
+	loaded = true
+}
@@ -0,0 +1,137 @@
+package inspect
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeSignatures(t *testing.T, path string, data string) {
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func setSignatures(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "signatures.xml")
+	writeSignatures(t, path, data)
+	SetFile(path)
+	t.Cleanup(func() {
+		SetFile("")
+		events = nil
+	})
+	return path
+}
+
+func TestInspect(t *testing.T) {
+	setSignatures(t, `<payloadSignatures>
+	<signature name="long-resv" game="mariokartwii" target="match" command="0x01" maxLength="8" />
+	<signature name="magic" target="match" pattern="de ad ??ef" />
+	<signature name="magic-at-2" target="relay" pattern="dead" offset="2" />
+	<signature name="suspect-key" target="heartbeat" key="p0" pattern="41" action="flag" />
+	<signature name="no-condition" target="match" command="2" />
+	<signature name="bad-target" target="gpcm" maxLength="1" />
+	<signature name="bad-pattern" target="match" pattern="d" />
+	<signature name="magic" target="relay" maxLength="1" />
+</payloadSignatures>`)
+
+	match := func(game string, command int, data []byte) Payload {
+		return Payload{Target: TargetMatch, Game: game, Command: command, Data: data, Address: "1.2.3.4:5678"}
+	}
+
+	for i, test := range []struct {
+		payload Payload
+		allow   bool
+	}{
+		{match("mariokartwii", 1, make([]byte, 8)), true},
+		{match("mariokartwii", 1, make([]byte, 9)), false},
+		{match("mariokartwii", 2, make([]byte, 9)), true},
+		{match("ssbbwii", 1, make([]byte, 9)), true},
+		{match("ssbbwii", 2, []byte{0, 0xde, 0xad, 0x00, 0xef}), false},
+		{match("ssbbwii", 2, []byte{0, 0xde, 0xad, 0x00, 0xee}), true},
+		{Payload{Target: TargetRelay, Command: -1, Data: []byte{0, 0, 0xde, 0xad}}, false},
+		{Payload{Target: TargetRelay, Command: -1, Data: []byte{0, 0xde, 0xad, 0}}, true},
+		// Flagged but still forwarded
+		{Payload{Target: TargetHeartbeat, Command: -1, Key: "p0", Data: []byte("AAA")}, true},
+		{Payload{Target: TargetHeartbeat, Command: -1, Key: "p1", Data: []byte("AAA")}, true},
+	} {
+		if Inspect("TEST", test.payload) != test.allow {
+			t.Errorf("%d: expected allow %v", i, test.allow)
+		}
+	}
+
+	recent := Events()
+	if len(recent) != 4 {
+		t.Fatalf("got %d events, expected 4", len(recent))
+	}
+	if recent[0].Signature != "suspect-key" || recent[0].Action != ActionFlag || recent[0].Key != "p0" || recent[0].Data != "414141" {
+		t.Errorf("unexpected event %+v", recent[0])
+	}
+	if recent[3].Signature != "long-resv" || recent[3].Action != ActionDrop || recent[3].Command != 1 || recent[3].Length != 9 || recent[3].Address != "1.2.3.4:5678" {
+		t.Errorf("unexpected event %+v", recent[3])
+	}
+}
+
+func TestInspectBan(t *testing.T) {
+	setSignatures(t, `<payloadSignatures>
+	<signature name="short-ban" target="match" pattern="ff" banHours="1" />
+	<signature name="long-ban" target="match" pattern="ff ff" banHours="24" />
+</payloadSignatures>`)
+
+	banned := make(chan time.Duration, 1)
+	SetBanCallback(func(profileId uint32, length time.Duration, reason string) {
+		if profileId != 600000001 || reason != "Sent a payload matching signature long-ban" {
+			t.Errorf("unexpected ban of %d: %s", profileId, reason)
+		}
+		banned <- length
+	})
+	t.Cleanup(func() { SetBanCallback(nil) })
+
+	// Nobody to ban without a profile
+	if Inspect("TEST", Payload{Target: TargetMatch, Command: 1, Data: []byte{0xff, 0xff}}) {
+		t.Error("payload was allowed")
+	}
+
+	Inspect("TEST", Payload{Target: TargetMatch, Command: 1, Data: []byte{0xff, 0xff}, ProfileID: 600000001})
+	select {
+	case length := <-banned:
+		if length != 24*time.Hour {
+			t.Errorf("banned for %s, expected the longest ban", length)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("profile wasn't banned")
+	}
+
+	recent := Events()
+	if len(recent) != 4 || !recent[0].Banned || recent[1].Banned || recent[2].Banned {
+		t.Errorf("unexpected events %+v", recent)
+	}
+}
+
+func TestInspectReload(t *testing.T) {
+	path := setSignatures(t, `<payloadSignatures><signature name="a" target="relay" pattern="aa" /></payloadSignatures>`)
+
+	oldInterval := reloadInterval
+	reloadInterval = 0
+	t.Cleanup(func() { reloadInterval = oldInterval })
+
+	payload := Payload{Target: TargetRelay, Command: -1, Data: []byte{0xaa, 0xbb}}
+	if Inspect("TEST", payload) {
+		t.Fatal("signature not loaded")
+	}
+
+	writeSignatures(t, path, `<payloadSignatures><signature name="b" target="relay" pattern="bb" action="flag" /></payloadSignatures>`)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if !Inspect("TEST", payload) {
+		t.Error("signature not reloaded")
+	}
+
+	// A broken file keeps the loaded signatures
+	writeSignatures(t, path, `<payloadSignatures><signature`)
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+	Inspect("TEST", payload)
+	if recent := Events(); recent[0].Signature != "b" {
+		t.Errorf("signatures lost, last event %+v", recent[0])
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+const (
+	ipBanPruneInterval = time.Minute
+)
+
+// IPBan blocks every connection from an IP address at the frontend
+type IPBan struct {
+	IP     string `json:"ip"`
+	Reason string `json:"reason,omitempty"`
+	// Zero for a permanent ban
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func (ban IPBan) expired(now time.Time) bool {
+	return !ban.Expires.IsZero() && !now.Before(ban.Expires)
+}
+
+var (
+	ipBans     = map[string]IPBan{}
+	ipBansPath string
+	// Guards ipBans and the file. Accepting connections only takes the read lock.
+	ipBansMutex sync.RWMutex
+
+	ErrInvalidIP = errors.New("invalid IP address")
+)
+
+// loadIPBans reads the ban list from the file, dropping expired bans. A missing or corrupt
+// file is logged and the list starts empty, so a bad file never stops the frontend.
+func loadIPBans(path string) {
+	ipBansMutex.Lock()
+	defer ipBansMutex.Unlock()
+
+	ipBansPath = path
+	ipBans = map[string]IPBan{}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logging.Warn("FRONTEND", "Failed to read IP ban list", aurora.BrightCyan(path), "starting empty:", err)
+		}
+		return
+	}
+
+	var bans []IPBan
+	if err := json.Unmarshal(data, &bans); err != nil {
+		logging.Warn("FRONTEND", "IP ban list", aurora.BrightCyan(path), "is corrupt, starting empty:", err)
+		return
+	}
+
+	now := time.Now()
+	for _, ban := range bans {
+		ip := net.ParseIP(ban.IP)
+		if ip == nil || ban.expired(now) {
+			continue
+		}
+
+		ban.IP = ip.String()
+		ipBans[ban.IP] = ban
+	}
+
+	logging.Notice("FRONTEND", "Loaded", aurora.Cyan(len(ipBans)), "IP bans")
+
+	if len(ipBans) != len(bans) {
+		saveIPBans()
+	}
+}
+
+// saveIPBans writes the ban list to the file. Expects the mutex to be locked.
+func saveIPBans() error {
+	if ipBansPath == "" {
+		return nil
+	}
+
+	bans := make([]IPBan, 0, len(ipBans))
+	for _, ban := range ipBans {
+		bans = append(bans, ban)
+	}
+
+	data, err := json.MarshalIndent(bans, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(ipBansPath, data)
+}
+
+// writeFileAtomic writes the data to a temporary file and renames it over the old one, so a crash
+// mid-write never leaves a truncated file
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// isIPBanned checks if connections from the address are banned
+func isIPBanned(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return false
+	}
+
+	ipBansMutex.RLock()
+	ban, ok := ipBans[ip.String()]
+	ipBansMutex.RUnlock()
+
+	return ok && !ban.expired(time.Now())
+}
+
+// pruneIPBans removes expired bans and returns how many were removed
+func pruneIPBans(now time.Time) int {
+	ipBansMutex.Lock()
+	defer ipBansMutex.Unlock()
+
+	pruned := 0
+	for ip, ban := range ipBans {
+		if ban.expired(now) {
+			delete(ipBans, ip)
+			pruned++
+		}
+	}
+
+	if pruned != 0 {
+		if err := saveIPBans(); err != nil {
+			logging.Error("FRONTEND", "Failed to save IP ban list:", err)
+		}
+	}
+
+	return pruned
+}
+
+func startIPBanPruner() {
+	go func() {
+		for range time.Tick(ipBanPruneInterval) {
+			if pruned := pruneIPBans(time.Now()); pruned != 0 {
+				logging.Info("FRONTEND", "Removed", aurora.Cyan(pruned), "expired IP bans")
+			}
+		}
+	}()
+}
+
+// RPCFrontendPacket.BanIP is called by an external program to ban an IP address. Existing
+// connections from the address are left open.
+func (r *RPCFrontendPacket) BanIP(args IPBan, _ *struct{}) error {
+	ip := net.ParseIP(args.IP)
+	if ip == nil {
+		return ErrInvalidIP
+	}
+	args.IP = ip.String()
+
+	ipBansMutex.Lock()
+	defer ipBansMutex.Unlock()
+
+	ipBans[args.IP] = args
+	if err := saveIPBans(); err != nil {
+		logging.Error("FRONTEND", "Failed to save IP ban list:", err)
+		return err
+	}
+
+	logging.Notice("FRONTEND", "Banned IP", aurora.BrightCyan(args.IP), "reason:", args.Reason)
+
+	event := logging.AuditEvent{Event: logging.AuditIPBan, IP: args.IP, Reason: args.Reason}
+	if !args.Expires.IsZero() {
+		event.Details = map[string]string{"expires": args.Expires.UTC().Format(time.RFC3339)}
+	}
+	logging.Audit(event)
+	return nil
+}
+
+// RPCFrontendPacket.UnbanIP is called by an external program to lift an IP ban, returns whether the IP was banned
+func (r *RPCFrontendPacket) UnbanIP(address string, removed *bool) error {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return ErrInvalidIP
+	}
+
+	ipBansMutex.Lock()
+	defer ipBansMutex.Unlock()
+
+	_, *removed = ipBans[ip.String()]
+	if !*removed {
+		return nil
+	}
+
+	delete(ipBans, ip.String())
+	if err := saveIPBans(); err != nil {
+		logging.Error("FRONTEND", "Failed to save IP ban list:", err)
+		return err
+	}
+
+	logging.Notice("FRONTEND", "Unbanned IP", aurora.BrightCyan(ip.String()))
+	logging.Audit(logging.AuditEvent{Event: logging.AuditIPUnban, IP: ip.String()})
+	return nil
+}
+
+// RPCFrontendPacket.ListIPBans is called by an external program to list the active IP bans
+func (r *RPCFrontendPacket) ListIPBans(_ struct{}, reply *[]IPBan) error {
+	ipBansMutex.RLock()
+	defer ipBansMutex.RUnlock()
+
+	now := time.Now()
+	bans := []IPBan{}
+	for _, ban := range ipBans {
+		if !ban.expired(now) {
+			bans = append(bans, ban)
+		}
+	}
+
+	*reply = bans
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIPBanPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip_bans.json")
+	loadIPBans(path)
+	defer loadIPBans("")
+
+	frontend := &RPCFrontendPacket{}
+	if err := frontend.BanIP(IPBan{IP: "192.0.2.1", Reason: "test"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := frontend.BanIP(IPBan{IP: "192.0.2.2", Expires: time.Now().Add(time.Hour)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := frontend.BanIP(IPBan{IP: "not an ip"}, nil); err != ErrInvalidIP {
+		t.Errorf("got error %v for an invalid IP", err)
+	}
+
+	// Expire the second ban behind the frontend's back, it should be dropped on load
+	ipBansMutex.Lock()
+	ban := ipBans["192.0.2.2"]
+	ban.Expires = time.Now().Add(-time.Minute)
+	ipBans["192.0.2.2"] = ban
+	saveIPBans()
+	ipBansMutex.Unlock()
+
+	loadIPBans(path)
+
+	if !isIPBanned(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}) {
+		t.Error("permanent ban was not loaded")
+	}
+	if isIPBanned(&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234}) {
+		t.Error("expired ban was loaded")
+	}
+
+	var removed bool
+	if err := frontend.UnbanIP("192.0.2.1", &removed); err != nil || !removed {
+		t.Fatalf("unban failed: %v %v", removed, err)
+	}
+
+	loadIPBans(path)
+	if isIPBanned(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}) {
+		t.Error("unbanned IP is still banned after reload")
+	}
+}
+
+func TestIPBanCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip_bans.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loadIPBans(path)
+	defer loadIPBans("")
+
+	if len(ipBans) != 0 {
+		t.Error("corrupt file produced bans")
+	}
+}
+
+func TestPruneIPBans(t *testing.T) {
+	loadIPBans("")
+
+	now := time.Now()
+	ipBans["192.0.2.3"] = IPBan{IP: "192.0.2.3", Expires: now.Add(-time.Second)}
+	ipBans["192.0.2.4"] = IPBan{IP: "192.0.2.4"}
+
+	if pruned := pruneIPBans(now); pruned != 1 {
+		t.Errorf("pruned %d bans, expected 1", pruned)
+	}
+	if _, ok := ipBans["192.0.2.4"]; !ok {
+		t.Error("permanent ban was pruned")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+const (
+	// Delays between retries after Accept fails, doubled on each error in a row like net/http does
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+var (
+	// Replaced in tests
+	acceptSleep = time.Sleep
+	// Errors in a row after which the listener is closed and opened again, about 10 seconds of failing
+	acceptErrorsBeforeRelisten = 16
+
+	// Listeners still open, closed by closeListeners on shutdown
+	openListeners      = map[*trackedListener]bool{}
+	openListenersMutex sync.Mutex
+)
+
+// trackedListener is a listener closeListeners knows about. Closing it any other way, e.g. draining
+// the server, forgets it.
+type trackedListener struct {
+	net.Listener
+	name string
+}
+
+func (l *trackedListener) Close() error {
+	openListenersMutex.Lock()
+	delete(openListeners, l)
+	openListenersMutex.Unlock()
+
+	return l.Listener.Close()
+}
+
+// openListener listens with SO_REUSEADDR set where the platform supports it, so a restart can bind
+// the port again while connections from before are still in TIME_WAIT
+func openListener(network string, address string) (net.Listener, error) {
+	listenConfig := net.ListenConfig{Control: setReuseAddr}
+	return listenConfig.Listen(context.Background(), network, address)
+}
+
+// trackListener makes closeListeners close the listener on shutdown
+func trackListener(name string, l net.Listener) net.Listener {
+	tracked := &trackedListener{Listener: l, name: name}
+
+	openListenersMutex.Lock()
+	openListeners[tracked] = true
+	openListenersMutex.Unlock()
+
+	return tracked
+}
+
+// listen opens a listener that is closed on shutdown
+func listen(name string, network string, address string) (net.Listener, error) {
+	l, err := openListener(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return trackListener(name, l), nil
+}
+
+// serveHTTP serves the handler on a listener closed on shutdown. Returns nil once it's closed.
+func serveHTTP(name string, address string, handler http.Handler) error {
+	l, err := listen(name, "tcp", address)
+	if err != nil {
+		return err
+	}
+
+	err = http.Serve(l, handler)
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// closeListeners closes every listener still open, so the ports are free for the next process as
+// soon as this one stops accepting
+func closeListeners(process string) {
+	openListenersMutex.Lock()
+	listeners := make([]*trackedListener, 0, len(openListeners))
+	for l := range openListeners {
+		listeners = append(listeners, l)
+	}
+	openListenersMutex.Unlock()
+
+	for _, l := range listeners {
+		if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			logging.Error(process, "Failed to close the listener for", aurora.BrightCyan(l.name).String()+":", err)
+		}
+	}
+
+	logging.Notice(process, "Closed", aurora.Cyan(len(listeners)), "listeners")
+}
+
+// acceptBackoff spaces out the retries after Accept fails, so a listener that keeps failing (out of
+// file descriptors for example) doesn't spin and flood the log
+type acceptBackoff struct {
+	delay  time.Duration
+	errors int
+}
+
+// wait sleeps before the next Accept after an error, and returns how many errors there were in a row
+func (b *acceptBackoff) wait() int {
+	if b.delay == 0 {
+		b.delay = minAcceptDelay
+	} else {
+		b.delay = min(b.delay*2, maxAcceptDelay)
+	}
+	b.errors++
+
+	acceptSleep(b.delay)
+	return b.errors
+}
+
+func (b *acceptBackoff) reset() {
+	*b = acceptBackoff{}
+}
+
+// listenServer opens the listener for a server, with the configured backlog
+func listenServer(server serverInfo) (net.Listener, error) {
+	address := net.JoinHostPort(server.address, strconv.Itoa(server.port))
+	l, err := openListener(server.protocol, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ListenBacklog > 0 {
+		if err := setListenBacklog(l, config.ListenBacklog); err != nil {
+			logging.Warn("FRONTEND", "Unable to set the listen backlog for", aurora.BrightCyan(server.rpcName).String()+":", err)
+		}
+	}
+
+	return trackListener(server.rpcName, l), nil
+}
+
+// relistenServer replaces a listener that keeps failing to accept. Returns nil if the server was drained
+// meanwhile, or if listening again failed, which leaves the server drained so it can be undrained later.
+func relistenServer(server serverInfo, old net.Listener) net.Listener {
+	serverListenersMutex.Lock()
+	defer serverListenersMutex.Unlock()
+
+	old.Close()
+
+	state := serverListeners[server.rpcName]
+	if state == nil || state.listener != old {
+		return nil
+	}
+
+	l, err := listenServer(state.server)
+	if err != nil {
+		logging.Error("FRONTEND", "Failed to listen again for", aurora.BrightCyan(server.rpcName).String()+", draining it:", err)
+		state.listener = nil
+		return nil
+	}
+
+	logging.Notice("FRONTEND", "Listening again for", aurora.BrightCyan(server.rpcName), "after repeated accept errors")
+	state.listener = l
+	return l
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// setReuseAddr is the Control function of the listeners
+func setReuseAddr(network string, address string, c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	}); err != nil {
+		return err
+	}
+
+	return sockErr
+}
+
+// setListenBacklog changes the backlog of a listening TCP socket. Linux applies a second listen() call
+// to a socket that's already listening.
+func setListenBacklog(l net.Listener, backlog int) error {
+	tcpListener, ok := l.(*net.TCPListener)
+	if !ok {
+		return errors.New("not a TCP listener")
+	}
+
+	rawConn, err := tcpListener.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var listenErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), backlog)
+	}); err != nil {
+		return err
+	}
+
+	return listenErr
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// SO_REUSEADDR is only set on Linux. On Windows it lets another process take over the port.
+func setReuseAddr(network string, address string, c syscall.RawConn) error {
+	return nil
+}
+
+func setListenBacklog(l net.Listener, backlog int) error {
+	return errors.New("changing the listen backlog isn't supported on this platform")
+}
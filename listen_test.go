@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingListener fails every Accept until it's closed, like a listener out of file descriptors
+type failingListener struct {
+	accepts atomic.Int32
+	closed  atomic.Bool
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.accepts.Add(1)
+	if l.closed.Load() {
+		return nil, net.ErrClosed
+	}
+	return nil, errors.New("too many open files")
+}
+
+func (l *failingListener) Close() error {
+	l.closed.Store(true)
+	return nil
+}
+
+func (l *failingListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	var delays []time.Duration
+	oldSleep := acceptSleep
+	acceptSleep = func(delay time.Duration) {
+		delays = append(delays, delay)
+	}
+	t.Cleanup(func() {
+		acceptSleep = oldSleep
+	})
+
+	// Not a registered server, so it isn't listened on again and the loop ends at the threshold
+	l := &failingListener{}
+	frontendListen(serverInfo{rpcName: "backofftest"}, l)
+
+	if accepts := int(l.accepts.Load()); accepts != acceptErrorsBeforeRelisten {
+		t.Errorf("accepted %d times, expected %d", accepts, acceptErrorsBeforeRelisten)
+	}
+	if len(delays) != acceptErrorsBeforeRelisten {
+		t.Fatalf("slept %d times, expected %d", len(delays), acceptErrorsBeforeRelisten)
+	}
+
+	expected := minAcceptDelay
+	for i, delay := range delays {
+		if delay != expected {
+			t.Errorf("delay %d was %v, expected %v", i, delay, expected)
+		}
+		expected = min(expected*2, maxAcceptDelay)
+	}
+	if delays[len(delays)-1] != maxAcceptDelay {
+		t.Errorf("delay never reached %v", maxAcceptDelay)
+	}
+
+	if !l.closed.Load() {
+		t.Error("failing listener wasn't closed")
+	}
+}
+
+func TestAcceptRelisten(t *testing.T) {
+	oldSleep, oldThreshold := acceptSleep, acceptErrorsBeforeRelisten
+	acceptSleep = func(time.Duration) {}
+	acceptErrorsBeforeRelisten = 3
+
+	server := serverInfo{rpcName: "relistentest", protocol: "tcp", address: "127.0.0.1", port: 0}
+	failing := &failingListener{}
+	serverListenersMutex.Lock()
+	serverListeners[server.rpcName] = &serverListener{server: server, listener: failing}
+	serverListenersMutex.Unlock()
+
+	t.Cleanup(func() {
+		serverListenersMutex.Lock()
+		delete(serverListeners, server.rpcName)
+		serverListenersMutex.Unlock()
+		acceptSleep, acceptErrorsBeforeRelisten = oldSleep, oldThreshold
+	})
+
+	done := make(chan struct{})
+	go func() {
+		frontendListen(server, failing)
+		close(done)
+	}()
+
+	var l net.Listener
+	for deadline := time.Now().Add(5 * time.Second); l == nil; {
+		serverListenersMutex.Lock()
+		if state := serverListeners[server.rpcName]; state.listener != failing {
+			l = state.listener
+		}
+		serverListenersMutex.Unlock()
+
+		if time.Now().After(deadline) {
+			t.Fatal("listener wasn't replaced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if tracked, ok := l.(*trackedListener); !ok {
+		t.Fatalf("replaced with %T", l)
+	} else if _, ok := tracked.Listener.(*net.TCPListener); !ok {
+		t.Fatalf("replaced with %T", tracked.Listener)
+	}
+	if accepts := failing.accepts.Load(); accepts != 3 {
+		t.Errorf("failing listener accepted %d times, expected 3", accepts)
+	}
+
+	if err := (&RPCFrontendPacket{}).DrainServer(DrainArgs{Server: server.rpcName}, new(int)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept loop didn't stop after draining")
+	}
+}
+
+func TestFrontendListenerRestart(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	server := serverInfo{rpcName: "restarttest", protocol: "tcp", address: "127.0.0.1", port: port}
+	t.Cleanup(func() {
+		serverListenersMutex.Lock()
+		delete(serverListeners, server.rpcName)
+		serverListenersMutex.Unlock()
+	})
+
+	// Closing a connection on the server's side first leaves the port in TIME_WAIT
+	listeners, err := listenAll([]serverInfo{server})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.Dial("tcp", listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := listeners[0].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	client.Read(make([]byte, 1))
+	client.Close()
+
+	for i := 0; i < 3; i++ {
+		if i != 0 {
+			if listeners, err = listenAll([]serverInfo{server}); err != nil {
+				t.Fatalf("restart %d failed: %v", i, err)
+			}
+		}
+
+		done := make(chan struct{})
+		go func(l net.Listener) {
+			frontendListen(server, l)
+			close(done)
+		}(listeners[0])
+
+		closeListeners("TEST")
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("accept loop didn't stop after closing the listeners")
+		}
+
+		openListenersMutex.Lock()
+		open := len(openListeners)
+		openListenersMutex.Unlock()
+		if open != 0 {
+			t.Fatalf("%d listeners left open", open)
+		}
+	}
+}
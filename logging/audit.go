@@ -0,0 +1,111 @@
+package logging
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit event types
+const (
+	AuditLogin   = "login"
+	AuditLogout  = "logout"
+	AuditBan     = "ban"
+	AuditUnban   = "unban"
+	AuditKick    = "kick"
+	AuditHost    = "host"
+	AuditIPBan   = "ip_ban"
+	AuditIPUnban = "ip_unban"
+	// Data protection requests made through the API
+	AuditProfileExport = "profile_export"
+	AuditProfileDelete = "profile_delete"
+)
+
+// AuditEvent is one record of the audit log, the security relevant events kept apart from the
+// operational log for moderation. Empty fields are left out of the record.
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	ProfileID uint32    `json:"profileId,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	// Console friend code
+	CFC    uint64 `json:"cfc,omitempty"`
+	Game   string `json:"game,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Who made the change, for bans
+	Moderator string            `json:"moderator,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+var (
+	auditMutex  sync.Mutex
+	auditOutput io.Writer
+	auditFile   *os.File
+	// Only the first failed write is logged until a write succeeds again
+	auditFailed bool
+)
+
+// SetAuditOutput opens the file audit events are appended to, one JSON object per line. "none"
+// or an empty path discards them.
+func SetAuditOutput(path string) error {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	if auditFile != nil {
+		auditFile.Close()
+		auditFile = nil
+	}
+	auditOutput = nil
+
+	if path == "" || strings.EqualFold(path, "none") {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	auditFile = file
+	auditOutput = file
+	return nil
+}
+
+// Audit records the event. Unlike the other log functions it isn't affected by the log level.
+func Audit(event AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.Time = event.Time.UTC()
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	if auditOutput == nil {
+		return
+	}
+
+	// Both processes append to the same file, a single write keeps the lines whole
+	if _, err := auditOutput.Write(data); err != nil {
+		if !auditFailed {
+			Error("AUDIT", "Failed to write audit event:", err)
+		}
+		auditFailed = true
+		return
+	}
+	auditFailed = false
+}
@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	defer SetLevel(int(logLevel.Load()))
+	defer SetAuditOutput("")
+
+	path := filepath.Join(t.TempDir(), "logs", "audit.log")
+	if err := SetAuditOutput(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recorded even with logging turned off
+	SetLevel(0)
+	Audit(AuditEvent{Event: AuditLogin, ProfileID: 600000001, IP: "192.0.2.1", CFC: 1234, Game: "mariokartwii"})
+	Audit(AuditEvent{Event: AuditBan, ProfileID: 600000001, Reason: "cheating", Moderator: "admin"})
+
+	// Reopening appends
+	if err := SetAuditOutput(path); err != nil {
+		t.Fatal(err)
+	}
+	Audit(AuditEvent{Event: AuditLogout, ProfileID: 600000001})
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var events []AuditEvent
+	var raw []map[string]any
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event AuditEvent
+		var fields map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("invalid record %q: %v", scanner.Text(), err)
+		}
+		json.Unmarshal(scanner.Bytes(), &fields)
+		events = append(events, event)
+		raw = append(raw, fields)
+	}
+
+	if len(events) != 3 || events[0].Event != AuditLogin || events[1].Moderator != "admin" || events[2].Event != AuditLogout {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	if events[0].Time.IsZero() || events[0].IP != "192.0.2.1" || events[0].CFC != 1234 {
+		t.Errorf("login wasn't recorded: %+v", events[0])
+	}
+	if _, ok := raw[2]["ip"]; ok {
+		t.Errorf("empty field was recorded: %v", raw[2])
+	}
+
+	// Discarded without an output
+	SetAuditOutput("none")
+	Audit(AuditEvent{Event: AuditKick})
+	if data, _ := os.ReadFile(path); bytes.Count(data, []byte("\n")) != 3 {
+		t.Errorf("event was written after the output was removed")
+	}
+}
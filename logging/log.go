@@ -6,6 +6,9 @@ import (
 	"io"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/logrusorgru/aurora/v3"
@@ -13,11 +16,68 @@ import (
 
 var (
 	logDir   = "./logs"
-	logLevel = 0
+	logLevel atomic.Int32
+
+	// Levels for specific modules, keyed by the upper case module tag
+	moduleLevels atomic.Pointer[map[string]int]
+
+	levelNames = map[string]int{
+		"none":   0,
+		"notice": 1,
+		"error":  2,
+		"warn":   3,
+		"info":   4,
+	}
 )
 
+// SetLevel sets the level for modules without an override
 func SetLevel(level int) {
-	logLevel = level
+	logLevel.Store(int32(level))
+}
+
+// GetLevel returns the level for modules without an override
+func GetLevel() int {
+	return int(logLevel.Load())
+}
+
+// SetModuleLevels replaces the per-module level overrides. A module is matched by its tag, the part
+// of the module name before the first ':' or ' ', so "NATNEG" also covers "NATNEG:1.2.3.4:5678".
+func SetModuleLevels(levels map[string]int) {
+	upper := make(map[string]int, len(levels))
+	for module, level := range levels {
+		upper[strings.ToUpper(module)] = level
+	}
+	moduleLevels.Store(&upper)
+}
+
+// ParseLevel parses a level number (0-4) or name (none, notice, error, warn, info)
+func ParseLevel(level string) (int, error) {
+	if value, ok := levelNames[strings.ToLower(strings.TrimSpace(level))]; ok {
+		return value, nil
+	}
+
+	value, err := strconv.Atoi(strings.TrimSpace(level))
+	if err != nil || value < 0 || value > 4 {
+		return 0, errors.New("invalid log level " + strconv.Quote(level) + ", must be 0-4 or none, notice, error, warn or info")
+	}
+
+	return value, nil
+}
+
+// levelFor returns the level that applies to the module
+func levelFor(module string) int {
+	if levels := moduleLevels.Load(); levels != nil && len(*levels) != 0 {
+		tag := module
+		if i := strings.IndexAny(tag, ": "); i != -1 {
+			tag = tag[:i]
+		}
+
+		if level, ok := (*levels)[strings.ToUpper(tag)]; ok {
+			return level
+		}
+	}
+
+	return int(logLevel.Load())
 }
 
 func SetOutput(output string) error {
@@ -48,35 +108,30 @@ func SetOutput(output string) error {
 }
 
 func Notice(module string, arguments ...any) {
-	if logLevel < 1 {
-		return
-	}
-
-	var finalStr string
-	for _, argument := range arguments {
-		finalStr += fmt.Sprint(argument)
-		finalStr += " "
-	}
-
-	log.Printf(aurora.BrightGreen("N[%s]").String()+": %s", module, finalStr)
+	output(1, aurora.BrightGreen("N[%s]").String(), module, arguments)
 }
 
 func Error(module string, arguments ...any) {
-	if logLevel < 2 {
-		return
-	}
+	output(2, aurora.BrightRed("E[%s]").String(), module, arguments)
+}
 
-	var finalStr string
-	for _, argument := range arguments {
-		finalStr += fmt.Sprint(argument)
-		finalStr += " "
-	}
+func Warn(module string, arguments ...any) {
+	output(3, aurora.BrightYellow("W[%s]").String(), module, arguments)
+}
 
-	log.Printf(aurora.BrightRed("E[%s]").String()+": %s", module, finalStr)
+func Info(module string, arguments ...any) {
+	output(4, aurora.BrightCyan("I[%s]").String(), module, arguments)
 }
 
-func Warn(module string, arguments ...any) {
-	if logLevel < 3 {
+// output logs the line if the module's level allows it, and keeps it for the module's trace ID if
+// it has one. A line the level hides is only kept if the trace was requested.
+func output(level int, prefix string, module string, arguments []any) {
+	enabled := levelFor(module) >= level
+	var traceID string
+	if enabled || watchedTracesCount.Load() != 0 {
+		traceID = moduleTraceID(module)
+	}
+	if !enabled && (traceID == "" || !isTraceWatched(traceID)) {
 		return
 	}
 
@@ -86,19 +141,23 @@ func Warn(module string, arguments ...any) {
 		finalStr += " "
 	}
 
-	log.Printf(aurora.BrightYellow("W[%s]").String()+": %s", module, finalStr)
-}
-
-func Info(module string, arguments ...any) {
-	if logLevel < 4 {
-		return
+	line := fmt.Sprintf(prefix+": %s", module, finalStr)
+	if traceID != "" {
+		recordTrace(traceID, line)
 	}
+	if enabled {
+		log.Print(line)
+	}
+}
 
-	var finalStr string
-	for _, argument := range arguments {
-		finalStr += fmt.Sprint(argument)
-		finalStr += " "
+// ConnectionModule builds a module name that identifies a single frontend
+// connection, e.g. "GPCM #1234:1.2.3.4:5678", so one player's flow can be
+// followed across services. The connection's trace ID is added if it has one.
+func ConnectionModule(server string, index uint64, detail string) string {
+	module := server + " #" + strconv.FormatUint(index, 10)
+	if detail != "" {
+		module += ":" + detail
 	}
 
-	log.Printf(aurora.BrightCyan("I[%s]").String()+": %s", module, finalStr)
+	return TraceModule(module, connectionTraceID(server, index))
 }
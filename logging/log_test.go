@@ -0,0 +1,110 @@
+package logging
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestModuleLevels(t *testing.T) {
+	defer SetModuleLevels(nil)
+	defer SetLevel(int(logLevel.Load()))
+
+	SetLevel(1)
+	SetModuleLevels(map[string]int{"natneg": 4, "GPCM": 0})
+
+	tests := []struct {
+		module string
+		level  int
+	}{
+		{"NATNEG", 4},
+		{"NATNEG:1.2.3.4:5678", 4},
+		{"GPCM #12:1.2.3.4", 0},
+		{ConnectionModule("GPCM", 12, ""), 0},
+		{"QR2:1.2.3.4:5678", 1},
+		{"NATNEGX", 1},
+	}
+
+	for _, test := range tests {
+		if level := levelFor(test.module); level != test.level {
+			t.Errorf("%q: got level %d, expected %d", test.module, level, test.level)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for input, expected := range map[string]int{"0": 0, "4": 4, "notice": 1, "Warn": 3, " info ": 4} {
+		if level, err := ParseLevel(input); err != nil || level != expected {
+			t.Errorf("%q: got %d %v, expected %d", input, level, err, expected)
+		}
+	}
+
+	for _, input := range []string{"", "5", "-1", "debug"} {
+		if _, err := ParseLevel(input); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+	defer SetLevel(int(logLevel.Load()))
+	SetLevel(0)
+
+	traceID := NewTraceID("GPCM", 12)
+	if !strings.HasPrefix(traceID, "gpcm-12-") {
+		t.Errorf("unexpected trace ID %q", traceID)
+	}
+
+	SetConnectionTrace("GPCM", 12, traceID)
+	module := ConnectionModule("GPCM", 12, "1.2.3.4")
+	ClearConnectionTrace("GPCM", 12)
+
+	// Hidden by the level until the trace is requested
+	Info(module, "hidden")
+	if lines := GetTrace(traceID); len(lines) != 0 {
+		t.Errorf("kept lines the level hides: %q", lines)
+	}
+
+	Info(module, "first")
+	Error(ConnectionModule("GPCM", 12, ""), "untraced")
+	Notice(module, "second")
+
+	lines := GetTrace(traceID)
+	if len(lines) != 2 || !strings.Contains(lines[0], "first") || !strings.Contains(lines[1], "second") {
+		t.Errorf("unexpected trace lines: %q", lines)
+	}
+
+	if levelFor(module) != 0 {
+		t.Error("trace ID changed the module's level")
+	}
+}
+
+func TestTraceMemoryLimit(t *testing.T) {
+	traceMutex.Lock()
+	oldLines, oldOrder, oldBytes := traceLines, traceOrder, traceBytes
+	traceLines, traceOrder, traceBytes = map[string][]string{}, nil, 0
+	traceMutex.Unlock()
+	t.Cleanup(func() {
+		traceMutex.Lock()
+		traceLines, traceOrder, traceBytes = oldLines, oldOrder, oldBytes
+		traceMutex.Unlock()
+	})
+
+	line := strings.Repeat("x", 64<<10)
+	for i := 0; i < maxTraceBytes/len(line)*2; i++ {
+		recordTrace("trace-"+strconv.Itoa(i), line)
+	}
+
+	total := 0
+	for _, lines := range traceLines {
+		for _, line := range lines {
+			total += len(line)
+		}
+	}
+	if total != traceBytes || traceBytes > maxTraceBytes {
+		t.Errorf("traces hold %d bytes, counted %d", total, traceBytes)
+	}
+	if _, ok := traceLines["trace-0"]; ok {
+		t.Error("the oldest trace wasn't dropped")
+	}
+}
@@ -0,0 +1,185 @@
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Recent lines are kept for this many trace IDs, the oldest ID is dropped first. Lines past the
+// total size are dropped the same way, so a few chatty traces can't use more.
+const (
+	maxTraces        = 4096
+	maxLinesPerTrace = 200
+	maxTraceBytes    = 8 << 20
+)
+
+// Once a trace is requested, its lines hidden by the log level are kept too for this long. At most
+// maxWatchedTraces are watched at once, the one requested first is dropped for a new one.
+const (
+	traceWatchDuration = 10 * time.Minute
+	maxWatchedTraces   = 64
+)
+
+// Put between a module name and its trace ID
+const traceSeparator = " trace="
+
+type connectionKey struct {
+	server string
+	index  uint64
+}
+
+var (
+	// Trace ID of each open connection, added to its module name by ConnectionModule
+	connectionTraces sync.Map
+
+	traceMutex sync.Mutex
+	traceLines = map[string][]string{}
+	// Trace IDs in the order their first line was logged
+	traceOrder []string
+	// Size of the lines in traceLines
+	traceBytes int
+
+	// Expiry of the traces requested with GetTrace. The count lets output skip the lookup while
+	// nothing is watched.
+	watchedTraces      = map[string]time.Time{}
+	watchedTracesCount atomic.Int32
+)
+
+// NewTraceID returns an ID to follow one connection or request through the logs of every process,
+// e.g. "gpcm-1234-9f3a2b1c". The random part keeps it unique when the index is reused.
+func NewTraceID(server string, index uint64) string {
+	random := make([]byte, 4)
+	rand.Read(random)
+	return strings.ToLower(server) + "-" + strconv.FormatUint(index, 10) + "-" + hex.EncodeToString(random)
+}
+
+// TraceModule adds the trace ID to a module name. Lines logged with the module that the log level
+// allows are kept for GetTrace, and every line once the trace was requested.
+func TraceModule(module string, traceID string) string {
+	if traceID == "" {
+		return module
+	}
+
+	return module + traceSeparator + traceID
+}
+
+// SetConnectionTrace sets the trace ID ConnectionModule adds for a connection, until it's cleared
+func SetConnectionTrace(server string, index uint64, traceID string) {
+	if traceID == "" {
+		ClearConnectionTrace(server, index)
+		return
+	}
+
+	connectionTraces.Store(connectionKey{server, index}, traceID)
+}
+
+func ClearConnectionTrace(server string, index uint64) {
+	connectionTraces.Delete(connectionKey{server, index})
+}
+
+func connectionTraceID(server string, index uint64) string {
+	if traceID, ok := connectionTraces.Load(connectionKey{server, index}); ok {
+		return traceID.(string)
+	}
+
+	return ""
+}
+
+// moduleTraceID returns the trace ID added to a module name by TraceModule
+func moduleTraceID(module string) string {
+	if index := strings.LastIndex(module, traceSeparator); index != -1 {
+		return module[index+len(traceSeparator):]
+	}
+
+	return ""
+}
+
+// isTraceWatched checks if the trace was requested recently, so lines the level hides are kept
+func isTraceWatched(traceID string) bool {
+	if watchedTracesCount.Load() == 0 {
+		return false
+	}
+
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+
+	expires, ok := watchedTraces[traceID]
+	if ok && time.Now().After(expires) {
+		delete(watchedTraces, traceID)
+		watchedTracesCount.Add(-1)
+		return false
+	}
+
+	return ok
+}
+
+// watchTrace keeps every line of the trace for a while. Expects the mutex to be locked.
+func watchTrace(traceID string) {
+	now := time.Now()
+	if _, ok := watchedTraces[traceID]; !ok {
+		if len(watchedTraces) >= maxWatchedTraces {
+			oldest := ""
+			for id, expires := range watchedTraces {
+				if oldest == "" || expires.Before(watchedTraces[oldest]) {
+					oldest = id
+				}
+			}
+			delete(watchedTraces, oldest)
+			watchedTracesCount.Add(-1)
+		}
+		watchedTracesCount.Add(1)
+	}
+
+	watchedTraces[traceID] = now.Add(traceWatchDuration)
+}
+
+func recordTrace(traceID string, line string) {
+	line = time.Now().Format("2006/01/02 15:04:05.000 ") + line
+
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+
+	lines, exists := traceLines[traceID]
+	if !exists {
+		if len(traceOrder) >= maxTraces {
+			dropOldestTrace()
+		}
+		traceOrder = append(traceOrder, traceID)
+	}
+
+	if len(lines) >= maxLinesPerTrace {
+		traceBytes -= len(lines[0])
+		lines = lines[1:]
+	}
+	traceLines[traceID] = append(lines, line)
+	traceBytes += len(line)
+
+	// The trace just logged to is the newest, so it's dropped last
+	for traceBytes > maxTraceBytes && len(traceOrder) > 1 {
+		dropOldestTrace()
+	}
+}
+
+// dropOldestTrace removes the lines of the trace that first logged. Expects the mutex to be locked.
+func dropOldestTrace() {
+	for _, line := range traceLines[traceOrder[0]] {
+		traceBytes -= len(line)
+	}
+	delete(traceLines, traceOrder[0])
+	traceOrder = traceOrder[1:]
+}
+
+// GetTrace returns the recent lines logged for the trace ID, oldest first. From then on the lines
+// the log level hides are kept for the trace too, so asking again shows them.
+func GetTrace(traceID string) []string {
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+
+	watchTrace(traceID)
+	return append([]string(nil), traceLines[traceID]...)
+}
@@ -1,23 +1,32 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/rpc"
 	"os"
 	"os/exec"
 	"os/signal"
+	"reflect"
+	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"wwfc/accounting"
 	"wwfc/api"
 	"wwfc/common"
+	"wwfc/database"
 	"wwfc/gamestats"
 	"wwfc/gpcm"
 	"wwfc/gpsp"
+	"wwfc/inspect"
 	"wwfc/logging"
 	"wwfc/nas"
 	"wwfc/natneg"
@@ -29,11 +38,27 @@ import (
 )
 
 var (
-	config = common.GetConfig()
+	// Loaded in main rather than on init so the package can be tested without a config file
+	config common.Config
+
+	// Largest packet the backend passes to a service, set from rpcMaxPacketSize
+	maxRPCPacketSize = 0x10000
+)
+
+// Longest connection address the backend accepts from the frontend
+const maxRPCAddressLength = 128
+
+var (
+	errRPCUnknownServer  = errors.New("unknown server")
+	errRPCDisabledServer = errors.New("server is disabled")
+	errRPCBadAddress     = errors.New("connection address is too long")
+	errRPCPacketTooLarge = errors.New("packet is too large")
+	errRPCPanic          = errors.New("service failed to handle the packet")
 )
 
 func main() {
-	logging.SetLevel(*config.LogLevel)
+	config = common.GetConfig()
+	common.ApplyLogLevels(config)
 
 	args := os.Args[1:]
 
@@ -53,6 +78,17 @@ func main() {
 		}
 	}
 
+	// Check the config and everything it references, then exit without starting any server
+	if len(args) > 0 && args[0] == "validate" {
+		os.Exit(validateMain())
+	}
+
+	// Send a command to a running frontend or backend
+	if len(args) > 0 && args[0] == "cmd" {
+		handleCommand(args[1:])
+		return
+	}
+
 	// Start the backend instead of the frontend if the first argument is "backend"
 	if len(args) > 0 && args[0] == "backend" {
 		backendMain(noSignal, noReload)
@@ -62,14 +98,76 @@ func main() {
 }
 
 type RPCPacket struct {
-	Server  string
-	Index   uint64
-	Address string
-	Data    []byte
+	Server     string
+	Index      uint64
+	Address    string
+	Data       []byte
+	Compressed bool
+
+	// Only set by CloseConnection
+	Stats *common.ConnectionStats
+
+	// Set by NewConnection for a connection that was open before the backend crashed
+	Recovered bool
+
+	// Generated by the frontend for each connection, added to every log line about it
+	TraceID string
+}
+
+type backendServer struct {
+	name  string
+	phase startupPhase
+	// Set if the server connects to the database, which is migrated before any server starts
+	database bool
+	start    func(bool)
+	shutdown func()
+}
+
+var backendServers = []backendServer{
+	{"nas", phaseListeners, true, nas.StartServer, nas.Shutdown},
+	{"gpcm", phaseServices, true, gpcm.StartServer, gpcm.Shutdown},
+	{"qr2", phaseMatchmaking, false, qr2.StartServer, qr2.Shutdown},
+	{"gpsp", phaseServices, true, gpsp.StartServer, gpsp.Shutdown},
+	{"serverbrowser", phaseMatchmaking, false, serverbrowser.StartServer, serverbrowser.Shutdown},
+	{"sake", phaseServices, true, sake.StartServer, sake.Shutdown},
+	{"natneg", phaseListeners, true, natneg.StartServer, natneg.Shutdown},
+	{"api", phaseListeners, true, api.StartServer, api.Shutdown},
+	{"gamestats", phaseServices, true, gamestats.StartServer, gamestats.Shutdown},
+	{"accounting", phaseServices, true, accounting.StartServer, accounting.Shutdown},
+}
+
+// enabledBackendServers returns the servers the backend runs, without the ones disabled in <servers>
+func enabledBackendServers() []backendServer {
+	var servers []backendServer
+	for _, server := range backendServers {
+		if config.IsServerEnabled(server.name) {
+			servers = append(servers, server)
+		}
+	}
+
+	return servers
+}
+
+// exitOnInvalidConfig prints every problem with the config and exits before any server starts.
+// Printed directly so the errors show up whatever the log level is set to.
+func exitOnInvalidConfig(process string, backend bool) {
+	errs := common.ValidateConfig(config, backend)
+	errs = append(errs, checkListenerCollisions(config)...)
+	if len(errs) == 0 {
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, "Invalid config.xml, the", process, "can't start:")
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, "  -", err)
+	}
+	os.Exit(1)
 }
 
 // backendMain starts all the servers and creates an RPC server to communicate with the frontend
 func backendMain(noSignal, noReload bool) {
+	exitOnInvalidConfig("backend", true)
+
 	sigExit := make(chan os.Signal, 1)
 	signal.Notify(sigExit, syscall.SIGINT, syscall.SIGTERM)
 
@@ -77,12 +175,29 @@ func backendMain(noSignal, noReload bool) {
 		logging.Error("BACKEND", err)
 	}
 
+	if err := logging.SetAuditOutput(config.AuditLog); err != nil {
+		logging.Error("BACKEND", "Failed to open the audit log:", err)
+	}
+
+	common.UDPPorts.SetRange(config.UDPPortStart, config.UDPPortEnd)
+	common.ApplyProfanityLists(config)
+	common.ReadGameList()
+	common.ApplyGameConfig(config)
+	loadGameOverrides(config.GameOverrideFile)
+	inspect.SetFile(config.PayloadSignatureFile)
+	gamestats.SetRuleFile(config.GameStatsRuleFile)
+	maxRPCPacketSize = *config.RPCMaxPacketSize
+
+	if config.BackendPprofAddress != "" {
+		startPprofServer("BACKEND", config.BackendPprofAddress)
+	}
+
 	rpc.Register(&RPCPacket{})
 	address := config.BackendAddress
 
-	l, err := net.Listen("tcp", address)
+	l, err := listen("backend RPC", "tcp", address)
 	if err != nil {
-		logging.Error("BACKEND", "Failed to listen on", aurora.BrightCyan(address))
+		logging.Error("BACKEND", "Failed to listen on", aurora.BrightCyan(address).String()+":", err)
 		os.Exit(1)
 	}
 
@@ -98,22 +213,21 @@ func backendMain(noSignal, noReload bool) {
 		panic(err)
 	}
 
-	wg := &sync.WaitGroup{}
-	actions := []func(bool){nas.StartServer, gpcm.StartServer, qr2.StartServer, gpsp.StartServer, serverbrowser.StartServer, sake.StartServer, natneg.StartServer, api.StartServer, gamestats.StartServer}
-	wg.Add(len(actions))
-	for _, action := range actions {
-		go func(ac func(bool)) {
-			defer wg.Done()
-			ac(reload)
-		}(action)
-	}
+	backendStartTime = time.Now()
+	backendReload = reload
 
-	// Wait for all servers to start
-	wg.Wait()
+	failed := startBackendServers(enabledBackendServers(), reload, *config.ExitOnServerStartFailure)
+	if len(failed) != 0 && *config.ExitOnServerStartFailure {
+		logging.Error("BACKEND", "FATAL: Servers failed to start:", aurora.Cyan(strings.Join(failedServerNames(failed), ", ")))
+		os.Exit(1)
+	}
 
 	go func() {
 		for {
 			conn, err := l.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			if err != nil {
 				logging.Error("BACKEND", "Failed to accept connection on", aurora.BrightCyan(address))
 				continue
@@ -126,6 +240,7 @@ func backendMain(noSignal, noReload bool) {
 	logging.Notice("BACKEND", "Listening on", aurora.BrightCyan(address))
 
 	common.Ready()
+	api.SetBackendReady(true)
 
 	// Wait for a signal to shutdown
 	<-sigExit
@@ -159,69 +274,238 @@ func loadUuidFile() string {
 	return string(uuid)
 }
 
+// RPCPacket.Handshake is called by the frontend after connecting to check that both sides speak the same protocol
+func (r *RPCPacket) Handshake(args common.RPCHandshake, reply *common.RPCHandshake) error {
+	if args.Version != common.RPCProtocolVersion {
+		logging.Error("BACKEND", "Frontend RPC protocol version", aurora.Cyan(args.Version), "does not match backend version", aurora.Cyan(common.RPCProtocolVersion))
+	}
+
+	threshold := common.NegotiateCompression(config.RPCCompressionThreshold, args.CompressionThreshold)
+	common.SetRPCCompressionThreshold(threshold)
+
+	*reply = common.RPCHandshake{
+		Version:              common.RPCProtocolVersion,
+		Methods:              rpcMethods(&RPCPacket{}),
+		CompressionThreshold: config.RPCCompressionThreshold,
+	}
+	return nil
+}
+
+// rpcMethods lists the exported methods of an RPC receiver
+func rpcMethods(receiver any) []string {
+	receiverType := reflect.TypeOf(receiver)
+
+	var methods []string
+	for i := 0; i < receiverType.NumMethod(); i++ {
+		methods = append(methods, receiverType.Method(i).Name)
+	}
+	return methods
+}
+
 // RPCPacket.NewConnection is called by the frontend to notify the backend of a new connection
-func (r *RPCPacket) NewConnection(args RPCPacket, _ *struct{}) error {
-	switch args.Server {
-	case "serverbrowser":
-		serverbrowser.NewConnection(args.Index, args.Address)
-	case "gpcm":
-		gpcm.NewConnection(args.Index, args.Address)
-	case "gpsp":
-		gpsp.NewConnection(args.Index, args.Address)
-	case "gamestats":
-		gamestats.NewConnection(args.Index, args.Address)
+func (r *RPCPacket) NewConnection(args RPCPacket, _ *struct{}) (err error) {
+	if err := checkRPCPacket(args); err != nil {
+		return err
+	}
+
+	if args.Recovered && !recoverableServers[args.Server] {
+		return errNotRecoverable
 	}
 
+	// The frontend never closes a connection the backend failed to accept, so whatever the server
+	// set up before failing has to be undone here
+	defer func() {
+		if err != nil {
+			discardServerConnection(args)
+		}
+	}()
+	defer recoverRPCPanic(args, &err)
+
+	newServerConnection(args.Server, args.Index, args.Address, args.TraceID)
 	return nil
 }
 
+// Pass a connection opening or closing to its server. Replaced in tests.
+var (
+	newServerConnection = func(server string, index uint64, address string, traceID string) {
+		switch server {
+		case "serverbrowser":
+			serverbrowser.NewConnection(index, address, traceID)
+		case "gpcm":
+			gpcm.NewConnection(index, address, traceID)
+		case "gpsp":
+			gpsp.NewConnection(index, address, traceID)
+		case "gamestats":
+			gamestats.NewConnection(index, address, traceID)
+		case nas.ServerName:
+			nas.NewConnection(index, address, traceID)
+		}
+	}
+	closeServerConnection = func(server string, index uint64) {
+		switch server {
+		case "serverbrowser":
+			serverbrowser.CloseConnection(index)
+		case "gpcm":
+			gpcm.CloseConnection(index)
+		case "gpsp":
+			gpsp.CloseConnection(index)
+		case "gamestats":
+			gamestats.CloseConnection(index)
+		case nas.ServerName:
+			nas.CloseConnection(index)
+		}
+	}
+)
+
+// discardServerConnection removes the state of a connection that failed to open
+func discardServerConnection(args RPCPacket) {
+	var err error
+	defer recoverRPCPanic(args, &err)
+
+	closeServerConnection(args.Server, args.Index)
+}
+
 // RPCPacket.HandlePacket is called by the frontend to forward a packet to the backend
-func (r *RPCPacket) HandlePacket(args RPCPacket, _ *struct{}) error {
-	switch args.Server {
+func (r *RPCPacket) HandlePacket(args RPCPacket, _ *struct{}) (err error) {
+	if err := checkRPCPacket(args); err != nil {
+		return err
+	}
+
+	data, err := common.DecompressData(args.Data, args.Compressed)
+	if err != nil {
+		logging.Error("BACKEND", "Failed to decompress packet from", aurora.BrightCyan(args.Server), aurora.Cyan(args.Index), "-", err)
+		return err
+	}
+	args.Data = data
+
+	if len(args.Data) > maxRPCPacketSize {
+		logging.Error("BACKEND", "Dropping", aurora.Cyan(len(args.Data)), "byte packet from", aurora.BrightCyan(args.Server), aurora.Cyan(args.Index), "after decompression")
+		return errRPCPacketTooLarge
+	}
+
+	defer recoverRPCPanic(args, &err)
+
+	common.CapturePacket(args.Server, args.Index, common.CaptureInbound, args.Data)
+	handleServerPacket(args.Server, args.Index, args.Data, args.Address)
+	return nil
+}
+
+// Pass a packet to its server. Replaced in tests.
+var handleServerPacket = func(server string, index uint64, data []byte, address string) {
+	switch server {
 	case "serverbrowser":
-		serverbrowser.HandlePacket(args.Index, args.Data, args.Address)
+		serverbrowser.HandlePacket(index, data, address)
 	case "gpcm":
-		gpcm.HandlePacket(args.Index, args.Data)
+		gpcm.HandlePacket(index, data)
 	case "gpsp":
-		gpsp.HandlePacket(args.Index, args.Data)
+		gpsp.HandlePacket(index, data)
 	case "gamestats":
-		gamestats.HandlePacket(args.Index, args.Data)
+		gamestats.HandlePacket(index, data)
+	case nas.ServerName:
+		nas.HandlePacket(index, data)
+	}
+}
+
+// RPCPacket.closeConnection is called by the frontend to notify the backend of a closed connection
+func (r *RPCPacket) CloseConnection(args RPCPacket, _ *struct{}) (err error) {
+	if err := checkRPCPacket(args); err != nil {
+		return err
 	}
+	defer recoverRPCPanic(args, &err)
 
+	// The profile has to be looked up before gpcm forgets the connection
+	if args.Stats != nil {
+		profileId := uint32(0)
+		if args.Server == "gpcm" {
+			profileId = gpcm.GetProfileIDByConnIndex(args.Index)
+		}
+		accounting.RecordConnection(args.Server, args.Address, profileId, *args.Stats)
+	}
+
+	common.StopCaptureOnClose(args.Server, args.Index)
+	closeServerConnection(args.Server, args.Index)
 	return nil
 }
 
-// RPCPacket.closeConnection is called by the frontend to notify the backend of a closed connection
-func (r *RPCPacket) CloseConnection(args RPCPacket, _ *struct{}) error {
+// checkRPCPacket rejects a packet from the frontend that no service should have to parse: one for an
+// unknown server, with an implausible address, or larger than rpcMaxPacketSize
+func checkRPCPacket(args RPCPacket) error {
 	switch args.Server {
-	case "serverbrowser":
-		serverbrowser.CloseConnection(args.Index)
-	case "gpcm":
-		gpcm.CloseConnection(args.Index)
-	case "gpsp":
-		gpsp.CloseConnection(args.Index)
-	case "gamestats":
-		gamestats.CloseConnection(args.Index)
+	case "serverbrowser", "gpcm", "gpsp", "gamestats", nas.ServerName:
+	default:
+		logging.Error("BACKEND", "Dropping packet for unknown server", aurora.BrightCyan(args.Server))
+		return errRPCUnknownServer
+	}
+
+	if !config.IsServerEnabled(args.Server) {
+		logging.Error("BACKEND", "Dropping packet for disabled server", aurora.BrightCyan(args.Server))
+		return errRPCDisabledServer
+	}
+
+	if len(args.Address) > maxRPCAddressLength {
+		logging.Error("BACKEND", "Dropping packet from", aurora.BrightCyan(args.Server), aurora.Cyan(args.Index), "with a", aurora.Cyan(len(args.Address)), "byte address")
+		return errRPCBadAddress
+	}
+
+	if len(args.Data) > maxRPCPacketSize {
+		logging.Error("BACKEND", "Dropping", aurora.Cyan(len(args.Data)), "byte packet from", aurora.BrightCyan(args.Server), aurora.Cyan(args.Index))
+		return errRPCPacketTooLarge
+	}
+
+	return nil
+}
+
+// recoverRPCPanic stops a panic in a service's handler from taking down the backend. The error
+// makes the frontend drop the connection, as the service's state for it can't be trusted anymore.
+func recoverRPCPanic(args RPCPacket, err *error) {
+	if r := recover(); r != nil {
+		logging.Error("BACKEND", "Panic in", aurora.BrightCyan(args.Server), aurora.Cyan(args.Index), "-", r, "\n"+string(debug.Stack()))
+		*err = errRPCPanic
 	}
+}
 
+// RPCPacket.ReloadConfig is called by the frontend when its config is reloaded, to apply the
+// backend's runtime settings from the config file: the log levels, the word lists, the games and the
+// payload signatures.
+func (r *RPCPacket) ReloadConfig(_ struct{}, _ *struct{}) (err error) {
+	defer func() {
+		// GetConfig panics on a bad config file, don't take the backend down with it
+		if r := recover(); r != nil {
+			logging.Error("BACKEND", "Failed to reload config:", r)
+			err = errors.New("failed to read config")
+		}
+	}()
+
+	config := common.GetConfig()
+	common.ApplyLogLevels(config)
+	common.ApplyProfanityLists(config)
+	common.ApplyGameConfig(config)
+	inspect.SetFile(config.PayloadSignatureFile)
+	gamestats.SetRuleFile(config.GameStatsRuleFile)
+	logging.Notice("BACKEND", "Reloaded config")
 	return nil
 }
 
 // RPCPacket.Shutdown is called by the frontend to shutdown the backend
 func (r *RPCPacket) Shutdown(stateUuid string, _ *struct{}) error {
+	api.SetBackendReady(false)
+	// Frees the RPC port for the next backend, the frontend's connection stays open
+	closeListeners("BACKEND")
+
 	if stateUuid == "" {
+		database.SaveFiles()
 		os.Exit(0)
 		return nil
 	}
 
+	servers := enabledBackendServers()
 	wg := &sync.WaitGroup{}
-	actions := []func(){nas.Shutdown, gpcm.Shutdown, qr2.Shutdown, gpsp.Shutdown, serverbrowser.Shutdown, sake.Shutdown, natneg.Shutdown, api.Shutdown, gamestats.Shutdown}
-	wg.Add(len(actions))
-	for _, action := range actions {
-		go func(ac func()) {
+	wg.Add(len(servers))
+	for _, server := range servers {
+		go func(server backendServer) {
 			defer wg.Done()
-			ac()
-		}(action)
+			server.shutdown()
+		}(server)
 	}
 
 	wg.Wait()
@@ -241,6 +525,7 @@ func (r *RPCPacket) Shutdown(stateUuid string, _ *struct{}) error {
 		panic(err)
 	}
 
+	database.SaveFiles()
 	os.Exit(0)
 	return nil
 }
@@ -248,32 +533,91 @@ func (r *RPCPacket) Shutdown(stateUuid string, _ *struct{}) error {
 type serverInfo struct {
 	rpcName  string
 	protocol string
+	address  string
 	port     int
+	noDelay  bool
+	// The frontend terminates TLS before forwarding the connection
+	tls bool
+	// Most bytes read from a connection at once
+	readBufferSize int
+}
+
+// gameSpyServers returns the TCP servers the frontend accepts clients on, with the addresses from the config
+func gameSpyServers(config common.Config) []serverInfo {
+	var servers []serverInfo
+	for _, name := range []string{"serverbrowser", "gpcm", "gpsp", "gamestats"} {
+		if !config.IsServerEnabled(name) {
+			continue
+		}
+
+		serverConfig, _ := config.GetServerConfig(name)
+		servers = append(servers, serverInfo{
+			rpcName:  name,
+			protocol: "tcp",
+			address:  config.GetServerAddress(name),
+			port:     config.GetServerPort(name),
+			noDelay:  serverConfig.NoDelay == nil || *serverConfig.NoDelay,
+
+			readBufferSize: config.GetReadBufferSize(name),
+		})
+	}
+
+	if config.EnableHTTPS && config.FrontendHTTPS && config.IsServerEnabled(nas.ServerName) {
+		port, _ := strconv.Atoi(config.NASPortHTTPS)
+		servers = append(servers, serverInfo{rpcName: nas.ServerName, protocol: "tcp", address: *config.NASAddressHTTPS, port: port, noDelay: true, tls: true, readBufferSize: config.GetReadBufferSize(nas.ServerName)})
+	}
+
+	return servers
+}
+
+type backendProcessState struct {
+	cmd *exec.Cmd
+	// Receives the result of cmd.Wait once the process exits
+	exited chan error
 }
 
 type RPCFrontendPacket struct {
-	Server string
-	Index  uint64
-	Data   []byte
+	Server     string
+	Index      uint64
+	Data       []byte
+	Compressed bool
 }
 
 var (
 	rpcClient *rpc.Client
 
+	// Guards rpcClient and coordinates rpcBusyCount. Forwarding only takes the read lock,
+	// reloading the backend takes the write lock to quiesce in-flight calls.
 	// This mutex could be locked for a very long time, don't use deadlock detection
-	rpcMutex sync.Mutex
+	rpcMutex sync.RWMutex
 
 	rpcBusyCount sync.WaitGroup
 	backendReady = make(chan struct{})
-	frontendUuid string
+	// The backend process started by the frontend, nil if the backend is run separately
+	backendProcess *backendProcessState
+	frontendUuid   string
 
-	connections = map[string]map[uint64]*net.Conn{}
+	// Populated once before any listener starts and never modified afterwards,
+	// each server's map has its own lock
+	connections = map[string]*connectionMap{}
+
+	// Increment by 1 for each connection, never decrement. Unlikely to overflow but it doesn't matter if it does.
+	// Shared by all listeners so connections to the same server from different listeners never collide.
+	connectionCount atomic.Uint64
+
+	// Negotiated with the backend during the handshake, 0 disables compression
+	rpcCompressionThreshold atomic.Int64
+
+	// Maximum time a single packet is allowed to take to be written to a connection, in nanoseconds
+	sendTimeout atomic.Int64
 
 	integrated = false
 )
 
 // frontendMain starts the backend process and communicates with it using RPC
 func frontendMain(noSignal, noBackend bool) {
+	exitOnInvalidConfig("frontend", false)
+
 	integrated = !noBackend
 
 	sigExit := make(chan os.Signal, 1)
@@ -289,6 +633,11 @@ func frontendMain(noSignal, noBackend bool) {
 		logging.Error("FRONTEND", err)
 	}
 
+	// Records the IP bans, appending to the same file as the backend
+	if err := logging.SetAuditOutput(config.AuditLog); err != nil {
+		logging.Error("FRONTEND", "Failed to open the audit log:", err)
+	}
+
 	rpcMutex.Lock()
 
 	startFrontendServer()
@@ -299,16 +648,66 @@ func frontendMain(noSignal, noBackend bool) {
 		go waitForBackend()
 	}
 
-	servers := []serverInfo{
-		{rpcName: "serverbrowser", protocol: "tcp", port: 28910},
-		{rpcName: "gpcm", protocol: "tcp", port: 29900},
-		{rpcName: "gpsp", protocol: "tcp", port: 29901},
-		{rpcName: "gamestats", protocol: "tcp", port: 29920},
+	servers := gameSpyServers(config)
+	for _, server := range servers {
+		connections[server.rpcName] = newConnectionMap()
 	}
 
-	for _, server := range servers {
-		connections[server.rpcName] = map[uint64]*net.Conn{}
-		go frontendListen(server)
+	if config.EnableHTTPS && config.FrontendHTTPS {
+		var err error
+		tlsTerminator, err = nas.NewTLSTerminator(config)
+		if err != nil {
+			logging.Error("FRONTEND", "Failed to load the HTTPS certs:", err)
+			os.Exit(1)
+		}
+	}
+
+	filter, err := loadGeoIPFilter(config)
+	if err != nil {
+		logging.Error("FRONTEND", err)
+		os.Exit(1)
+	}
+	geoIPFilterState.Store(filter)
+
+	allowed, err := loadAllowList(config, servers)
+	if err != nil {
+		logging.Error("FRONTEND", err)
+		os.Exit(1)
+	}
+	allowListState.Store(allowed)
+
+	loadIPBans(config.IPBanFile)
+	startIPBanPruner()
+
+	sendTimeout.Store(int64(time.Duration(*config.SendTimeout) * time.Second))
+	sendQueueLimit.Store(int64(*config.SendQueueLimit))
+	applyBackpressureConfig(config)
+
+	if *config.StaleConnectionTimeout > 0 {
+		startStaleConnectionCheck(time.Duration(*config.StaleConnectionTimeout)*time.Second, config.CloseStaleConnections)
+	}
+
+	listeners, err := listenAll(servers)
+	if err != nil {
+		logging.Error("FRONTEND", err)
+		os.Exit(1)
+	}
+
+	for i, server := range servers {
+		startServerListener(server, listeners[i])
+	}
+
+	if config.WebSocketPort != "" {
+		startWebSocketListener(servers)
+	}
+	setListenersReady()
+
+	if config.FrontendHealthAddress != "" {
+		startHealthServer(config.FrontendHealthAddress)
+	}
+
+	if config.FrontendPprofAddress != "" {
+		startPprofServer("FRONTEND", config.FrontendPprofAddress)
 	}
 
 	// Wait for a signal to shutdown
@@ -318,10 +717,14 @@ func frontendMain(noSignal, noBackend bool) {
 		select {}
 	}
 
+	closeListeners("FRONTEND")
+
 	if rpcClient == nil {
 		return
 	}
 
+	// The backend exiting now isn't a crash
+	frontendStopping.Store(true)
 	rpcClient.Call("RPCPacket.Shutdown", "", nil)
 	rpcClient.Close()
 }
@@ -331,9 +734,9 @@ func startFrontendServer() {
 	rpc.Register(&RPCFrontendPacket{})
 	address := config.FrontendAddress
 
-	l, err := net.Listen("tcp", address)
+	l, err := listen("frontend RPC", "tcp", address)
 	if err != nil {
-		logging.Error("FRONTEND", "Failed to listen on", aurora.BrightCyan(address))
+		logging.Error("FRONTEND", "Failed to listen on", aurora.BrightCyan(address).String()+":", err)
 		os.Exit(1)
 	}
 
@@ -342,6 +745,9 @@ func startFrontendServer() {
 	go func() {
 		for {
 			conn, err := l.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			if err != nil {
 				logging.Error("FRONTEND", "Failed to accept connection on", aurora.BrightCyan(address))
 				continue
@@ -378,171 +784,499 @@ func startBackendProcess(reload bool, wait bool) {
 		os.Exit(1)
 	}
 
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	backendProcess = &backendProcessState{cmd: cmd, exited: exited}
+
 	if wait {
 		waitForBackend()
 	}
 }
 
-// waitForBackend waits for the backend to start.
-// Expects the RPC mutex to be locked.
+// waitForBackend waits for the backend to start, for at most backendStartTimeout per attempt.
+// A backend started by the frontend is restarted if it exits or times out, and the frontend
+// exits after backendStartAttempts failures rather than holding every connection forever.
+// A backend run separately is waited on indefinitely, logging each time the timeout passes.
+// The health check reports "waiting" until it returns. Expects the RPC mutex to be locked.
 func waitForBackend() {
-	<-backendReady
-	backendReady = make(chan struct{})
+	timeout := time.Duration(*config.BackendStartTimeout) * time.Second
+
+	backendWaiting.Store(true)
+	defer backendWaiting.Store(false)
+	resetReadiness()
+
+	for attempt := 1; ; attempt++ {
+		process := backendProcess
+		var exited <-chan error
+		if process != nil {
+			exited = process.exited
+		}
+
+		err := connectBackend(timeout, exited)
+		if err == nil {
+			if process != nil {
+				go watchBackendProcess(process, rpcClient)
+			}
+			checkBackendReadiness()
+			return
+		}
 
+		if errors.Is(err, errBackendHandshake) {
+			// Leave the RPC mutex locked so nothing is forwarded to the mismatched backend
+			logging.Error("FRONTEND", "FATAL: Backend handshake failed, refusing to forward traffic:", err)
+			return
+		}
+
+		if process == nil {
+			logging.Error("FRONTEND", "Backend is still not ready after", aurora.Cyan(timeout), "connections are waiting:", err)
+			continue
+		}
+
+		if attempt >= *config.BackendStartAttempts {
+			logging.Error("FRONTEND", "FATAL: Backend failed to start after", aurora.Cyan(attempt), "attempts:", err)
+			os.Exit(1)
+		}
+
+		logging.Error("FRONTEND", "Backend failed to start, restarting it:", err)
+		process.cmd.Process.Kill()
+
+		// Start from a clean state in case the saved state is what broke it
+		startBackendProcess(false, false)
+	}
+}
+
+const (
+	// Delay between attempts to dial the backend once it reports ready, doubled after every failure
+	backendDialMinDelay = 50 * time.Millisecond
+	backendDialMaxDelay = time.Second
+)
+
+var (
+	// Set while waitForBackend is running, reported by the health check
+	backendWaiting atomic.Bool
+
+	errBackendHandshake  = errors.New("backend handshake failed")
+	errBackendTimeout    = errors.New("timed out waiting for the backend")
+	errBackendNotStarted = errors.New("backend process exited")
+	errBackendIntegrated = errors.New("the backend is run by the frontend, use backend reload")
+	errBackendNotRunning = errors.New("the frontend is waiting for a backend")
+)
+
+// connectBackend waits for the backend to report that it's ready and connects to it, giving up
+// after the timeout or when the process exits. Unlocks the RPC mutex on success.
+func connectBackend(timeout time.Duration, exited <-chan error) error {
+	deadline := time.After(timeout)
+
+	select {
+	case <-backendReady:
+		backendReady = make(chan struct{})
+	case err := <-exited:
+		return fmt.Errorf("%w: %v", errBackendNotStarted, err)
+	case <-deadline:
+		return errBackendTimeout
+	}
+
+	delay := backendDialMinDelay
 	for {
 		client, err := rpc.Dial("tcp", config.FrontendBackendAddress)
 		if err == nil {
+			if err := backendHandshake(client); err != nil {
+				client.Close()
+				return fmt.Errorf("%w: %v", errBackendHandshake, err)
+			}
+
 			rpcClient = client
+			if backendRecovering.Swap(false) {
+				recoverConnections()
+			}
 			rpcMutex.Unlock()
 
 			logging.Notice("FRONTEND", "Connected to backend")
+			return nil
+		}
 
-			return
+		select {
+		case err := <-exited:
+			return fmt.Errorf("%w: %v", errBackendNotStarted, err)
+		case <-deadline:
+			return errBackendTimeout
+		case <-time.After(delay):
 		}
 
-		<-time.After(50 * time.Millisecond)
+		delay = nextBackendDialDelay(delay)
 	}
 }
 
-// frontendListen listens on the specified port and forwards each packet to the backend
-func frontendListen(server serverInfo) {
-	address := *config.GameSpyAddress + ":" + strconv.Itoa(server.port)
-	l, err := net.Listen(server.protocol, address)
+func nextBackendDialDelay(delay time.Duration) time.Duration {
+	return min(delay*2, backendDialMaxDelay)
+}
+
+// listenAll binds every server before any of them start accepting, so a bad
+// address fails at startup. The error lists each server that could not bind.
+func listenAll(servers []serverInfo) ([]net.Listener, error) {
+	var listeners []net.Listener
+	var failed []string
+	for _, server := range servers {
+		l, err := listenServer(server)
+		if err != nil {
+			address := net.JoinHostPort(server.address, strconv.Itoa(server.port))
+			failed = append(failed, server.rpcName+" on "+address+": "+err.Error())
+			continue
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	if len(failed) != 0 {
+		for _, l := range listeners {
+			l.Close()
+		}
+
+		return nil, errors.New("failed to bind servers:\n\t" + strings.Join(failed, "\n\t"))
+	}
+
+	return listeners, nil
+}
+
+// Backend methods the frontend calls
+var requiredBackendMethods = []string{"NewConnection", "HandlePacket", "CloseConnection", "Shutdown", "Readiness"}
+
+// backendHandshake checks that the backend uses the same RPC protocol version as the frontend
+// and has every method the frontend needs
+func backendHandshake(client *rpc.Client) error {
+	var reply common.RPCHandshake
+	err := client.Call("RPCPacket.Handshake", common.RPCHandshake{
+		Version:              common.RPCProtocolVersion,
+		Methods:              rpcMethods(&RPCFrontendPacket{}),
+		CompressionThreshold: config.RPCCompressionThreshold,
+	}, &reply)
 	if err != nil {
-		logging.Error("FRONTEND", "Failed to listen on", aurora.BrightCyan(address))
-		return
+		// Backends from before the handshake was added don't have the method
+		return fmt.Errorf("handshake call failed: %w", err)
 	}
 
-	logging.Notice("FRONTEND", "Listening on", aurora.BrightCyan(address), "for", aurora.BrightCyan(server.rpcName))
+	if err := checkHandshake(reply); err != nil {
+		return err
+	}
 
-	// Increment by 1 for each connection, never decrement. Unlikely to overflow but it doesn't matter if it does.
-	count := uint64(0)
+	threshold := common.NegotiateCompression(config.RPCCompressionThreshold, reply.CompressionThreshold)
+	rpcCompressionThreshold.Store(int64(threshold))
+	if threshold != 0 {
+		logging.Info("FRONTEND", "Compressing backend packets larger than", aurora.Cyan(threshold), "bytes")
+	}
+
+	return nil
+}
+
+func checkHandshake(reply common.RPCHandshake) error {
+	if reply.Version != common.RPCProtocolVersion {
+		return fmt.Errorf("backend RPC protocol version %d does not match frontend version %d", reply.Version, common.RPCProtocolVersion)
+	}
+
+	var missing []string
+	for _, method := range requiredBackendMethods {
+		if !slices.Contains(reply.Methods, method) {
+			missing = append(missing, method)
+		}
+	}
 
+	if len(missing) != 0 {
+		return errors.New("backend is missing RPC methods: " + strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// admitConnection runs the checks every new connection goes through, whichever listener accepted
+// it. Returns false if the connection must be closed.
+func admitConnection(server string, addr net.Addr, pressure *backpressure) bool {
+	if !checkAllowList(server, addr) {
+		return false
+	}
+
+	if isIPBanned(addr) {
+		logging.Info("FRONTEND", "Rejected connection from banned IP", aurora.BrightCyan(addr.String()), "to", aurora.BrightCyan(server))
+		return false
+	}
+
+	if !checkGeoIP(server, addr) {
+		return false
+	}
+
+	return !pressure.shouldReject(addr)
+}
+
+// frontendListen accepts connections on the listener and forwards each packet to the backend
+func frontendListen(server serverInfo, l net.Listener) {
+	address := l.Addr().String()
+
+	logging.Notice("FRONTEND", "Listening on", aurora.BrightCyan(address), "for", aurora.BrightCyan(server.rpcName))
+
+	pressure := &backpressure{server: server.rpcName}
+	var backoff acceptBackoff
 	for {
+		pressure.waitBeforeAccept()
+
 		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			// The server was drained, or the frontend is shutting down
+			logging.Notice("FRONTEND", "Stopped listening on", aurora.BrightCyan(address), "for", aurora.BrightCyan(server.rpcName))
+			return
+		}
 		if err != nil {
-			logging.Error("FRONTEND", "Failed to accept connection on", aurora.BrightCyan(address))
+			logging.Error("FRONTEND", "Failed to accept connection on", aurora.BrightCyan(address).String()+":", err)
+			if backoff.wait() < acceptErrorsBeforeRelisten {
+				continue
+			}
+
+			if l = relistenServer(server, l); l == nil {
+				return
+			}
+			address = l.Addr().String()
+			backoff.reset()
 			continue
 		}
+		backoff.reset()
 
-		if server.protocol == "tcp" {
-			err := conn.(*net.TCPConn).SetKeepAlive(true)
-			if err != nil {
+		if !admitConnection(server.rpcName, conn.RemoteAddr(), pressure) {
+			conn.Close()
+			continue
+		}
+
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			if err := setKeepAlive(tcpConn); err != nil {
 				logging.Warn("FRONTEND", "Unable to set keepalive", err.Error())
 			}
+
+			// Small request/response exchanges shouldn't wait for the kernel to coalesce them
+			if err := tcpConn.SetNoDelay(server.noDelay); err != nil {
+				logging.Warn("FRONTEND", "Unable to set TCP_NODELAY", err.Error())
+			}
 		}
 
-		count++
+		if server.tls {
+			go handleTLSConnection(server, conn, nextConnectionIndex())
+		} else {
+			go handleConnection(server, conn, nextConnectionIndex())
+		}
+	}
+}
 
-		go handleConnection(server, conn, count)
+// setKeepAlive applies the configured TCP keepalive settings to a client connection
+func setKeepAlive(conn *net.TCPConn) error {
+	if !*config.TCPKeepAlive {
+		return conn.SetKeepAlive(false)
 	}
+
+	if err := conn.SetKeepAlive(true); err != nil {
+		return err
+	}
+
+	return conn.SetKeepAlivePeriod(time.Duration(*config.TCPKeepAlivePeriod) * time.Second)
+}
+
+func nextConnectionIndex() uint64 {
+	return connectionCount.Add(1)
 }
 
 // handleConnection forwards packets between the frontend and backend
 func handleConnection(server serverInfo, conn net.Conn, index uint64) {
-	defer conn.Close()
+	serverConnections := connections[server.rpcName]
+	fConn := newFrontendConn(conn)
+	fConn.traceID = logging.NewTraceID(server.rpcName, index)
+	serverConnections.add(index, fConn)
+
+	// The one cleanup path, whichever way the connection ends. The backend is only told about the
+	// close if it was told about the connection, and not if the entry was already removed by
+	// whoever closed it (a drain or the stale connection check). The reason is only used if nothing
+	// else closed the connection first.
+	reason := closeReasonClientError
+	defer func() {
+		fConn.cancel(reason)
+		if serverConnections.remove(index, fConn) && fConn.announced.Load() {
+			closeBackendConnection(server.rpcName, index, fConn)
+		}
+		conn.Close()
+		logConnectionClosed(server.rpcName, index, fConn)
+	}()
 
-	rpcMutex.Lock()
-	rpcBusyCount.Add(1)
-	pConn := &conn
-	connections[server.rpcName][index] = pConn
-	rpcMutex.Unlock()
+	beginRPC()
 
-	err := rpcClient.Call("RPCPacket.NewConnection", RPCPacket{Server: server.rpcName, Index: index, Address: conn.RemoteAddr().String(), Data: []byte{}}, nil)
+	client := rpcClient
+	err := client.Call("RPCPacket.NewConnection", RPCPacket{Server: server.rpcName, Index: index, Address: conn.RemoteAddr().String(), Data: []byte{}, TraceID: fConn.traceID}, nil)
 
-	rpcBusyCount.Done()
+	endRPC()
 
 	if err != nil {
 		logging.Error("FRONTEND", "Failed to forward new connection to backend:", err)
+		if isBackendLost(err) {
+			go backendLost(client)
+		}
+		reason = closeReasonBackendError
+		return
+	}
 
-		rpcMutex.Lock()
-		delete(connections[server.rpcName], index)
-		rpcMutex.Unlock()
+	if !serverConnections.announce(index, fConn) {
+		// Removed while the backend was accepting it, by a drain or the stale connection check,
+		// which didn't tell the backend since it didn't know about the connection yet
+		closeBackendConnection(server.rpcName, index, fConn)
 		return
 	}
 
-	for {
-		buffer := make([]byte, 1024)
+	// Reused for every read, the packet is encoded by the time the call to the backend returns
+	buffer := getReadBuffer(server.readBufferSize)
+	defer putReadBuffer(buffer)
+
+	for fConn.ctx.Err() == nil {
 		n, err := conn.Read(buffer)
 		if err != nil {
-			break
+			reason = readCloseReason(err)
+			return
 		}
 
 		if n == 0 {
 			continue
 		}
 
-		rpcMutex.Lock()
-		rpcBusyCount.Add(1)
-		rpcMutex.Unlock()
+		fConn.bytesIn.Add(uint64(n))
+		fConn.packetsIn.Add(1)
+
+		beginRPC()
 
 		// Forward the packet to the backend
-		err = rpcClient.Call("RPCPacket.HandlePacket", RPCPacket{Server: server.rpcName, Index: index, Address: conn.RemoteAddr().String(), Data: buffer[:n]}, nil)
+		client := rpcClient
+		data, compressed := common.CompressData(buffer[:n], int(rpcCompressionThreshold.Load()))
+		err = client.Call("RPCPacket.HandlePacket", RPCPacket{Server: server.rpcName, Index: index, Address: conn.RemoteAddr().String(), Data: data, Compressed: compressed, TraceID: fConn.traceID}, nil)
 
-		rpcBusyCount.Done()
+		endRPC()
 
 		if err != nil {
 			logging.Error("FRONTEND", "Failed to forward packet to backend:", err)
-			if err == rpc.ErrShutdown {
-				os.Exit(1)
+			if isBackendLost(err) {
+				// The packet is lost with the backend, and the backend that replaces it never
+				// hears about this connection
+				fConn.announced.Store(false)
+				go backendLost(client)
+				reason = closeReasonBackendLost
+				return
 			}
-			break
+			reason = closeReasonBackendError
+			return
 		}
 	}
+}
 
-	rpcMutex.Lock()
-	if connections[server.rpcName][index] != pConn {
-		rpcMutex.Unlock()
-		return
-	}
+// closeBackendConnection tells the backend a connection it knows about has closed. The caller must
+// have removed the connection from the map, so this happens once per connection.
+func closeBackendConnection(server string, index uint64, fConn *frontendConn) {
+	stats := fConn.stats()
 
-	rpcBusyCount.Add(1)
-	delete(connections[server.rpcName], index)
-	rpcMutex.Unlock()
+	beginRPC()
 
-	err = rpcClient.Call("RPCPacket.CloseConnection", RPCPacket{Server: server.rpcName, Index: index, Address: conn.RemoteAddr().String(), Data: []byte{}}, nil)
+	client := rpcClient
+	err := client.Call("RPCPacket.CloseConnection", RPCPacket{Server: server, Index: index, Address: fConn.RemoteAddr().String(), Data: []byte{}, Stats: &stats, TraceID: fConn.traceID}, nil)
 
-	rpcBusyCount.Done()
+	endRPC()
 
 	if err != nil {
 		logging.Error("FRONTEND", "Failed to forward close connection to backend:", err)
-		if err == rpc.ErrShutdown {
-			os.Exit(1)
+		if isBackendLost(err) {
+			go backendLost(client)
 		}
 	}
 }
 
-var (
-	ErrBadIndex = errors.New("incorrect connection index")
-	ErrorBusy   = errors.New("backend is busy")
-)
+var ErrorBusy = errors.New("backend is busy")
 
 // RPCFrontendPacket.SendPacket is called by the backend to send a packet to a connection
 func (r *RPCFrontendPacket) SendPacket(args RPCFrontendPacket, _ *struct{}) error {
-	rpcMutex.Lock()
-	defer rpcMutex.Unlock()
-
-	conn := connections[args.Server][args.Index]
+	conn := getConnection(args.Server, args.Index)
 	if conn == nil {
-		return ErrBadIndex
+		return connectionError(args.Server, args.Index)
+	}
+	if conn.ctx.Err() != nil {
+		// Closing but not removed yet
+		return common.ErrRecentlyClosed
+	}
+
+	data, err := common.DecompressData(args.Data, args.Compressed)
+	if err != nil {
+		logging.Error("FRONTEND", "Failed to decompress packet for", aurora.BrightCyan(args.Server), aurora.Cyan(args.Index), "-", err)
+		return err
+	}
+	// Written by the connection's writer so a slow client doesn't hold up the backend
+	if !conn.queuePacket(data) {
+		return common.ErrIncompleteWrite
 	}
 
-	_, err := (*conn).Write(args.Data)
+	return nil
+}
 
-	return err
+// writeFull writes all of the data to the connection, retrying on short writes until
+// everything is sent or an error occurs. Returns the number of bytes actually written.
+func writeFull(ctx context.Context, conn net.Conn, data []byte, timeout time.Duration) (int, error) {
+	if timeout != 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			return 0, err
+		}
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+
+	// Checked after setting the deadline, which would otherwise override the immediate
+	// deadline set when the connection was cancelled
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for written < len(data) {
+		n, err := conn.Write(data[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		if n == 0 {
+			// No progress and no error, don't spin forever
+			return written, io.ErrShortWrite
+		}
+	}
+
+	return written, nil
 }
 
 // RPCFrontendPacket.CloseConnection is called by the backend to close a connection
 func (r *RPCFrontendPacket) CloseConnection(args RPCFrontendPacket, _ *struct{}) error {
-	rpcMutex.Lock()
-	defer rpcMutex.Unlock()
-
-	conn := connections[args.Server][args.Index]
+	conn := getConnection(args.Server, args.Index)
 	if conn == nil {
-		return ErrBadIndex
+		return connectionError(args.Server, args.Index)
+	}
+
+	// Once the packets sent before are written, the writer cancels the connection, which unblocks
+	// its read loop to close the socket and remove it
+	conn.closeAfterSend(closeReasonKicked)
+	return nil
+}
+
+// RPCFrontendPacket.GetConnections is called by the backend to list the open connections of each server
+func (r *RPCFrontendPacket) GetConnections(_ struct{}, reply *map[string][]common.ConnectionInfo) error {
+	result := map[string][]common.ConnectionInfo{}
+	for server, serverConnections := range connections {
+		serverConnections.mutex.RLock()
+		result[server] = make([]common.ConnectionInfo, 0, len(serverConnections.conns))
+		for index, conn := range serverConnections.conns {
+			result[server] = append(result[server], common.ConnectionInfo{
+				Index:   index,
+				Address: conn.RemoteAddr().String(),
+			})
+		}
+		serverConnections.mutex.RUnlock()
 	}
 
-	return (*conn).Close()
+	*reply = result
+	return nil
 }
 
 // RPCFrontendPacket.ReloadBackend is called by an external program to reload the backend
@@ -566,6 +1300,29 @@ func (r *RPCFrontendPacket) ReloadBackend(_ struct{}, _ *struct{}) error {
 	return nil
 }
 
+// RPCFrontendPacket.StopBackend is called by an external program to stop a backend that's run
+// separately, e.g. to replace its binary. The backend saves its state and connections are held
+// until the next backend starts.
+func (r *RPCFrontendPacket) StopBackend(_ struct{}, _ *struct{}) error {
+	if integrated {
+		return errBackendIntegrated
+	}
+	if backendWaiting.Load() {
+		return errBackendNotRunning
+	}
+
+	var stateUid string
+	r.ShutdownBackend(struct{}{}, &stateUid)
+
+	// The call fails once the backend exits
+	rpcClient.Call("RPCPacket.Shutdown", stateUid, nil)
+	if err := rpcClient.Close(); err != nil {
+		logging.Error("FRONTEND", "Failed to close RPC client:", err)
+	}
+
+	return nil
+}
+
 // RPCFrontendPacket.ShutdownBackend is called by the backend to prepare for shutdown
 func (r *RPCFrontendPacket) ShutdownBackend(_ struct{}, uuid *string) error {
 	logging.Notice("FRONTEND", "Shutting down backend")
@@ -596,15 +1353,20 @@ func (r *RPCFrontendPacket) VerifyState(uuid string, reload *bool) error {
 		return ErrorBusy
 	}
 
+	if backendRecovering.Load() {
+		// Any saved state is older than the connections that were kept, they're recovered once
+		// the backend is ready
+		logging.Notice("FRONTEND", "VerifyState: Recovering connections after losing the backend")
+		*reload = false
+		return nil
+	}
+
 	if uuid != frontendUuid {
 		logging.Notice("FRONTEND", "VerifyState: Resetting all connections")
 
 		// Close all connections
-		for _, server := range connections {
-			for index, conn := range server {
-				(*conn).Close()
-				delete(server, index)
-			}
+		for _, serverConnections := range connections {
+			serverConnections.closeAll()
 		}
 
 		*reload = false
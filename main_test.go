@@ -0,0 +1,1074 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"wwfc/api"
+	"wwfc/common"
+	"wwfc/logging"
+)
+
+// throttledConn accepts at most chunk bytes per Write call
+type throttledConn struct {
+	net.Conn
+	chunk    int
+	limit    int
+	written  bytes.Buffer
+	deadline time.Time
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	if c.limit >= 0 && c.written.Len() >= c.limit {
+		return 0, errors.New("connection reset")
+	}
+
+	n := min(len(b), c.chunk)
+	if c.limit >= 0 {
+		n = min(n, c.limit-c.written.Len())
+	}
+
+	c.written.Write(b[:n])
+	return n, nil
+}
+
+func (c *throttledConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *throttledConn) SetDeadline(t time.Time) error {
+	return c.SetWriteDeadline(t)
+}
+
+func (c *throttledConn) RemoteAddr() net.Addr {
+	return testRemoteAddr
+}
+
+var testRemoteAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+
+func TestWriteFullShortWrites(t *testing.T) {
+	data := bytes.Repeat([]byte(`\bm\100\f\1\msg\|s|1|ss|Online\final\`), 50)
+	conn := &throttledConn{chunk: 3, limit: -1}
+
+	n, err := writeFull(context.Background(), conn, data, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != len(data) {
+		t.Errorf("wrote %d bytes, expected %d", n, len(data))
+	}
+
+	if !bytes.Equal(conn.written.Bytes(), data) {
+		t.Error("written data does not match")
+	}
+
+	if !conn.deadline.IsZero() {
+		t.Error("write deadline was not cleared")
+	}
+}
+
+func TestWriteFullPartialError(t *testing.T) {
+	data := bytes.Repeat([]byte{0xAB}, 100)
+	conn := &throttledConn{chunk: 7, limit: 40}
+
+	n, err := writeFull(context.Background(), conn, data, time.Second)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if n != 40 {
+		t.Errorf("reported %d bytes sent, expected 40", n)
+	}
+}
+
+func TestSendPacketWriteError(t *testing.T) {
+	conn := newFrontendConn(&throttledConn{chunk: 7, limit: 40})
+	serverConnections := newConnectionMap()
+	serverConnections.add(1, conn)
+
+	connections = map[string]*connectionMap{"test": serverConnections}
+	defer func() { connections = map[string]*connectionMap{} }()
+
+	// The write fails after SendPacket returned, the connection is closed instead
+	err := (&RPCFrontendPacket{}).SendPacket(RPCFrontendPacket{Server: "test", Index: 1, Data: make([]byte, 100)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-conn.ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("connection wasn't closed after the write failed")
+	}
+
+	if cause := context.Cause(conn.ctx); cause != closeReasonWriteError {
+		t.Errorf("closed with %v, expected %v", cause, closeReasonWriteError)
+	}
+	if conn.bytesOut.Load() != 40 {
+		t.Errorf("counted %d bytes sent, expected 40", conn.bytesOut.Load())
+	}
+}
+
+func TestSendPacketQueueFull(t *testing.T) {
+	sendQueueLimit.Store(150)
+	defer sendQueueLimit.Store(0)
+
+	// Nothing reads from the other end, the first write never finishes
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := newFrontendConn(server)
+	defer conn.cancel(nil)
+
+	serverConnections := newConnectionMap()
+	serverConnections.add(1, conn)
+
+	connections = map[string]*connectionMap{"test": serverConnections}
+	defer func() { connections = map[string]*connectionMap{} }()
+
+	frontend := &RPCFrontendPacket{}
+	for i := 0; i < 3; i++ {
+		if err := frontend.SendPacket(RPCFrontendPacket{Server: "test", Index: 1, Data: make([]byte, 50)}, nil); err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+	}
+
+	err := frontend.SendPacket(RPCFrontendPacket{Server: "test", Index: 1, Data: make([]byte, 50)}, nil)
+	if err != common.ErrIncompleteWrite {
+		t.Fatalf("got error %v, expected ErrIncompleteWrite", err)
+	}
+
+	// The backend only sees the error string
+	if !common.IsIncompleteWrite(rpc.ServerError(err.Error())) {
+		t.Error("IsIncompleteWrite didn't match the error returned over RPC")
+	}
+
+	if cause := context.Cause(conn.ctx); cause != closeReasonSendQueueFull {
+		t.Errorf("closed with %v, expected %v", cause, closeReasonSendQueueFull)
+	}
+}
+
+func TestCloseConnectionAfterSend(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := newFrontendConn(server)
+
+	serverConnections := newConnectionMap()
+	serverConnections.add(1, conn)
+
+	connections = map[string]*connectionMap{"test": serverConnections}
+	defer func() { connections = map[string]*connectionMap{} }()
+
+	frontend := &RPCFrontendPacket{}
+	packets := []string{`\lc\1\final\`, `\error\\err\256\fatal\final\`}
+	for _, packet := range packets {
+		if err := frontend.SendPacket(RPCFrontendPacket{Server: "test", Index: 1, Data: []byte(packet)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := frontend.CloseConnection(RPCFrontendPacket{Server: "test", Index: 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The packets sent before closing still arrive
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	expected := strings.Join(packets, "")
+	data, _ := io.ReadAll(io.LimitReader(client, int64(len(expected))))
+	if string(data) != expected {
+		t.Errorf("received %q", data)
+	}
+
+	select {
+	case <-conn.ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("connection wasn't closed after sending")
+	}
+
+	if cause := context.Cause(conn.ctx); cause != closeReasonKicked {
+		t.Errorf("closed with %v, expected %v", cause, closeReasonKicked)
+	}
+}
+
+// TestSlowConnectionLatency checks a client that stops reading doesn't hold up packets to the
+// others
+func TestSlowConnectionLatency(t *testing.T) {
+	const fastCount = 8
+
+	serverConnections := newConnectionMap()
+	connections = map[string]*connectionMap{"test": serverConnections}
+	defer func() { connections = map[string]*connectionMap{} }()
+
+	slowClient, slowServer := net.Pipe()
+	defer slowClient.Close()
+	slow := newFrontendConn(slowServer)
+	defer slow.cancel(nil)
+	serverConnections.add(0, slow)
+
+	fastClients := make([]net.Conn, fastCount)
+	for i := range fastClients {
+		client, server := net.Pipe()
+		defer client.Close()
+		conn := newFrontendConn(server)
+		defer conn.cancel(nil)
+		serverConnections.add(uint64(i+1), conn)
+		fastClients[i] = client
+	}
+
+	frontend := &RPCFrontendPacket{}
+	data := []byte(`\bm\100\f\1\msg\|s|1|ss|Online\final\`)
+
+	roundTrip := func() time.Duration {
+		start := time.Now()
+
+		var wg sync.WaitGroup
+		for i, client := range fastClients {
+			if err := frontend.SendPacket(RPCFrontendPacket{Server: "test", Index: uint64(i + 1), Data: data}, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			wg.Add(1)
+			go func(client net.Conn) {
+				defer wg.Done()
+				client.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := io.ReadFull(client, make([]byte, len(data))); err != nil {
+					t.Error(err)
+				}
+			}(client)
+		}
+		wg.Wait()
+
+		return time.Since(start)
+	}
+
+	baseline := roundTrip()
+
+	// Fills the pipe to the slow client, its writer is now blocked
+	for i := 0; i < 100; i++ {
+		start := time.Now()
+		if err := frontend.SendPacket(RPCFrontendPacket{Server: "test", Index: 0, Data: data}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Fatalf("sending to the slow client blocked for %s", elapsed)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		if latency := roundTrip(); latency > baseline+100*time.Millisecond {
+			t.Errorf("round trip took %s with a slow client, %s without", latency, baseline)
+		}
+	}
+}
+
+// discardConn simulates the cost of a socket write without doing any I/O
+type discardConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (c *discardConn) Write(b []byte) (int, error) {
+	time.Sleep(c.delay)
+	return len(b), nil
+}
+
+func (c *discardConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (c *discardConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *discardConn) RemoteAddr() net.Addr {
+	return testRemoteAddr
+}
+
+func TestConnectionMapRemoveReplaced(t *testing.T) {
+	m := newConnectionMap()
+	first := newFrontendConn(&discardConn{})
+	second := newFrontendConn(&discardConn{})
+
+	m.add(1, first)
+	m.add(1, second)
+
+	if m.remove(1, first) {
+		t.Error("removed a connection that was replaced")
+	}
+
+	if m.get(1) != second {
+		t.Fatal("replacement connection is missing")
+	}
+
+	if !m.remove(1, second) {
+		t.Error("failed to remove the current connection")
+	}
+
+	if m.get(1) != nil {
+		t.Error("connection still present after removal")
+	}
+}
+
+func TestSendPacketClosedIndex(t *testing.T) {
+	serverConnections := newConnectionMap()
+	conn := newFrontendConn(&discardConn{})
+	serverConnections.add(1, conn)
+	serverConnections.remove(1, conn)
+
+	connections = map[string]*connectionMap{"test": serverConnections}
+	defer func() { connections = map[string]*connectionMap{} }()
+
+	frontend := &RPCFrontendPacket{}
+	if err := frontend.SendPacket(RPCFrontendPacket{Server: "test", Index: 1, Data: []byte{1}}, nil); err != common.ErrRecentlyClosed {
+		t.Errorf("send to a closed connection returned %v", err)
+	}
+	if err := frontend.CloseConnection(RPCFrontendPacket{Server: "test", Index: 1}, nil); err != common.ErrRecentlyClosed {
+		t.Errorf("close of a closed connection returned %v", err)
+	}
+	if err := frontend.SendPacket(RPCFrontendPacket{Server: "test", Index: 2, Data: []byte{1}}, nil); err != common.ErrBadIndex {
+		t.Errorf("send to an unknown index returned %v", err)
+	}
+
+	// Forgotten once the TTL passes
+	if err := serverConnections.lookupError(1, time.Now().Add(recentlyClosedTTL)); err != common.ErrBadIndex {
+		t.Errorf("index closed a TTL ago returned %v", err)
+	}
+	serverConnections.mutex.Lock()
+	serverConnections.markClosed(3, time.Now().Add(2*recentlyClosedTTL))
+	_, kept := serverConnections.closed[1]
+	serverConnections.mutex.Unlock()
+	if kept {
+		t.Error("expired index was not pruned")
+	}
+}
+
+// BenchmarkSendPacket sends packets to many connections concurrently. The
+// "global" case serializes every send through one mutex like the frontend used
+// to, "perserver" uses the per-server and per-connection locks.
+func BenchmarkSendPacket(b *testing.B) {
+	const connectionCount = 1000
+
+	serverConnections := newConnectionMap()
+	for i := uint64(0); i < connectionCount; i++ {
+		serverConnections.add(i, newFrontendConn(&discardConn{delay: time.Microsecond}))
+	}
+
+	connections = map[string]*connectionMap{"bench": serverConnections}
+	defer func() { connections = map[string]*connectionMap{} }()
+
+	data := []byte(`\bm\100\f\1\msg\|s|1|ss|Online\final\`)
+	frontend := &RPCFrontendPacket{}
+
+	run := func(b *testing.B, globalMutex *sync.Mutex) {
+		var next atomic.Uint64
+		b.SetParallelism(64)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			index := next.Add(1) % connectionCount
+			for pb.Next() {
+				if globalMutex != nil {
+					globalMutex.Lock()
+				}
+
+				err := frontend.SendPacket(RPCFrontendPacket{Server: "bench", Index: index, Data: data}, nil)
+
+				if globalMutex != nil {
+					globalMutex.Unlock()
+				}
+
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	}
+
+	b.Run("global", func(b *testing.B) {
+		run(b, &sync.Mutex{})
+	})
+
+	b.Run("perserver", func(b *testing.B) {
+		run(b, nil)
+	})
+}
+
+func TestListenAllReportsFailedServer(t *testing.T) {
+	servers := []serverInfo{
+		{rpcName: "gpcm", protocol: "tcp", address: "127.0.0.1", port: 0},
+		{rpcName: "gpsp", protocol: "tcp", address: "256.0.0.1", port: 0},
+	}
+
+	listeners, err := listenAll(servers)
+	if err == nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		t.Fatal("expected an error")
+	}
+
+	if !strings.Contains(err.Error(), "gpsp on 256.0.0.1:0") || strings.Contains(err.Error(), "gpcm") {
+		t.Errorf("error does not name the failed server: %s", err)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	var reply common.RPCHandshake
+	if err := (&RPCPacket{}).Handshake(common.RPCHandshake{Version: common.RPCProtocolVersion}, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkHandshake(reply); err != nil {
+		t.Errorf("handshake with the current backend failed: %s", err)
+	}
+
+	stale := reply
+	stale.Version--
+	if err := checkHandshake(stale); err == nil {
+		t.Error("version mismatch was not detected")
+	}
+
+	missing := common.RPCHandshake{Version: common.RPCProtocolVersion, Methods: []string{"NewConnection", "Shutdown"}}
+	if err := checkHandshake(missing); err == nil || !strings.Contains(err.Error(), "HandlePacket, CloseConnection, Readiness") {
+		t.Errorf("missing methods not reported: %v", err)
+	}
+}
+
+func TestBackendDialDelay(t *testing.T) {
+	delay := backendDialMinDelay
+	for i := 0; i < 3; i++ {
+		delay = nextBackendDialDelay(delay)
+	}
+	if delay != 8*backendDialMinDelay {
+		t.Errorf("delay after three failures is %s", delay)
+	}
+
+	for i := 0; i < 100; i++ {
+		delay = nextBackendDialDelay(delay)
+	}
+	if delay != backendDialMaxDelay {
+		t.Errorf("delay grew past the cap to %s", delay)
+	}
+}
+
+func TestFrontendHealthWaiting(t *testing.T) {
+	backendWaiting.Store(true)
+	defer backendWaiting.Store(false)
+
+	if status := frontendHealth(); status != "waiting" {
+		t.Errorf("got %q while waiting for the backend", status)
+	}
+}
+
+func TestConnectBackendGivesUp(t *testing.T) {
+	exited := make(chan error, 1)
+	exited <- errors.New("exit status 1")
+
+	start := time.Now()
+	if err := connectBackend(time.Minute, exited); !errors.Is(err, errBackendNotStarted) {
+		t.Errorf("exited backend: got %v", err)
+	}
+
+	if err := connectBackend(20*time.Millisecond, nil); !errors.Is(err, errBackendTimeout) {
+		t.Errorf("unresponsive backend: got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s to give up", elapsed)
+	}
+}
+
+// recordingBackend counts the connection events forwarded by the frontend
+type recordingBackend struct {
+	opened chan uint64
+	closed atomic.Int32
+}
+
+func (b *recordingBackend) NewConnection(args RPCPacket, _ *struct{}) error {
+	b.opened <- args.Index
+	return nil
+}
+
+func (b *recordingBackend) HandlePacket(args RPCPacket, _ *struct{}) error {
+	return nil
+}
+
+func (b *recordingBackend) CloseConnection(args RPCPacket, _ *struct{}) error {
+	b.closed.Add(1)
+	return nil
+}
+
+func TestCloseConnectionRace(t *testing.T) {
+	backend := &recordingBackend{opened: make(chan uint64, 1)}
+	server := rpc.NewServer()
+	if err := server.RegisterName("RPCPacket", backend); err != nil {
+		t.Fatal(err)
+	}
+
+	frontendSide, backendSide := net.Pipe()
+	go server.ServeConn(backendSide)
+	rpcClient = rpc.NewClient(frontendSide)
+
+	info := serverInfo{rpcName: "closetest"}
+	connections[info.rpcName] = newConnectionMap()
+
+	t.Cleanup(func() {
+		rpcClient.Close()
+		rpcClient = nil
+		delete(connections, info.rpcName)
+	})
+
+	const iterations = 50
+	for i := uint64(1); i <= iterations; i++ {
+		client, remote := net.Pipe()
+
+		done := make(chan struct{})
+		go func() {
+			handleConnection(info, remote, i)
+			close(done)
+		}()
+		<-backend.opened
+
+		// The client disconnects while the backend kicks it
+		kicked := make(chan struct{})
+		go client.Close()
+		go func() {
+			(&RPCFrontendPacket{}).CloseConnection(RPCFrontendPacket{Server: info.rpcName, Index: i}, nil)
+			close(kicked)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection goroutine didn't exit")
+		}
+		<-kicked
+
+		if connections[info.rpcName].get(i) != nil {
+			t.Fatal("connection still in the map")
+		}
+	}
+
+	if closed := backend.closed.Load(); closed != iterations {
+		t.Errorf("backend told about %d closed connections, expected %d", closed, iterations)
+	}
+}
+
+// failingBackend fails the calls it's told to, and counts the closes
+type failingBackend struct {
+	failNew    bool
+	failPacket bool
+	closed     atomic.Int32
+}
+
+func (b *failingBackend) NewConnection(args RPCPacket, _ *struct{}) error {
+	if b.failNew {
+		return errors.New("new connection failed")
+	}
+	return nil
+}
+
+func (b *failingBackend) HandlePacket(args RPCPacket, _ *struct{}) error {
+	if b.failPacket {
+		return errors.New("packet failed")
+	}
+	return nil
+}
+
+func (b *failingBackend) CloseConnection(args RPCPacket, _ *struct{}) error {
+	b.closed.Add(1)
+	return nil
+}
+
+func TestHandleConnectionCleanup(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		backend    *failingBackend
+		sendPacket bool
+		closes     int32
+	}{
+		{"new connection fails", &failingBackend{failNew: true}, false, 0},
+		{"client disconnects", &failingBackend{}, false, 1},
+		{"packet fails", &failingBackend{failPacket: true}, true, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server := rpc.NewServer()
+			if err := server.RegisterName("RPCPacket", test.backend); err != nil {
+				t.Fatal(err)
+			}
+
+			frontendSide, backendSide := net.Pipe()
+			go server.ServeConn(backendSide)
+			rpcClient = rpc.NewClient(frontendSide)
+
+			info := serverInfo{rpcName: "cleanuptest"}
+			connections[info.rpcName] = newConnectionMap()
+
+			t.Cleanup(func() {
+				rpcClient.Close()
+				rpcClient = nil
+				delete(connections, info.rpcName)
+			})
+
+			client, remote := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				handleConnection(info, remote, 1)
+				close(done)
+			}()
+
+			if test.sendPacket {
+				client.Write([]byte("\\ka\\\\final\\"))
+			} else if !test.backend.failNew {
+				client.Close()
+			}
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("connection goroutine didn't exit")
+			}
+			client.Close()
+
+			if connections[info.rpcName].get(1) != nil {
+				t.Error("connection still in the map")
+			}
+			if closed := test.backend.closed.Load(); closed != test.closes {
+				t.Errorf("backend told about %d closes, expected %d", closed, test.closes)
+			}
+		})
+	}
+}
+
+func TestConnectionCloseLog(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("RPCPacket", &failingBackend{}); err != nil {
+		t.Fatal(err)
+	}
+
+	frontendSide, backendSide := net.Pipe()
+	go server.ServeConn(backendSide)
+	rpcClient = rpc.NewClient(frontendSide)
+
+	info := serverInfo{rpcName: "closelogtest"}
+	connections[info.rpcName] = newConnectionMap()
+
+	var output bytes.Buffer
+	oldLevel := logging.GetLevel()
+	logging.SetLevel(4)
+	log.SetOutput(&output)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		logging.SetLevel(oldLevel)
+		rpcClient.Close()
+		rpcClient = nil
+		delete(connections, info.rpcName)
+	})
+
+	for _, test := range []struct {
+		index  uint64
+		close  func(client net.Conn)
+		reason string
+	}{
+		{1, func(client net.Conn) { client.Close() }, "reason=client_eof"},
+		{2, func(net.Conn) {
+			for connections[info.rpcName].get(2) == nil || !connections[info.rpcName].get(2).announced.Load() {
+				time.Sleep(time.Millisecond)
+			}
+			(&RPCFrontendPacket{}).CloseConnection(RPCFrontendPacket{Server: info.rpcName, Index: 2}, nil)
+		}, "reason=kicked"},
+	} {
+		output.Reset()
+		client, remote := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			handleConnection(info, remote, test.index)
+			close(done)
+		}()
+
+		client.Write([]byte("\\ka\\\\final\\"))
+		test.close(client)
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection goroutine didn't exit")
+		}
+		client.Close()
+
+		line := output.String()
+		if !strings.Contains(line, "server=closelogtest index="+strconv.FormatUint(test.index, 10)) || !strings.Contains(line, "bytes_in=11 ") || !strings.Contains(line, test.reason) {
+			t.Errorf("unexpected close log: %q", line)
+		}
+	}
+}
+
+// fakeServerSessions serves the real backend RPCs to handleConnection, with a session table standing
+// in for the servers. Opening a connection adds it to the table and then calls open.
+func fakeServerSessions(t *testing.T, server string, open func(index uint64)) (map[uint64]bool, *sync.Mutex) {
+	sessions := map[uint64]bool{}
+	var mutex sync.Mutex
+
+	oldNew, oldClose := newServerConnection, closeServerConnection
+	newServerConnection = func(_ string, index uint64, _ string, _ string) {
+		mutex.Lock()
+		sessions[index] = true
+		mutex.Unlock()
+		open(index)
+	}
+	closeServerConnection = func(_ string, index uint64) {
+		mutex.Lock()
+		delete(sessions, index)
+		mutex.Unlock()
+	}
+
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.RegisterName("RPCPacket", &RPCPacket{}); err != nil {
+		t.Fatal(err)
+	}
+
+	frontendSide, backendSide := net.Pipe()
+	go rpcServer.ServeConn(backendSide)
+	rpcClient = rpc.NewClient(frontendSide)
+
+	connections[server] = newConnectionMap()
+
+	t.Cleanup(func() {
+		rpcClient.Close()
+		rpcClient = nil
+		delete(connections, server)
+		newServerConnection, closeServerConnection = oldNew, oldClose
+	})
+
+	return sessions, &mutex
+}
+
+func TestNewConnectionFailure(t *testing.T) {
+	info := serverInfo{rpcName: "gpsp"}
+	sessions, mutex := fakeServerSessions(t, info.rpcName, func(uint64) {
+		panic("failed to set up the session")
+	})
+
+	client, remote := net.Pipe()
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		handleConnection(info, remote, 1)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection goroutine didn't exit")
+	}
+
+	if connections[info.rpcName].get(1) != nil {
+		t.Error("connection still in the map")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(sessions) != 0 {
+		t.Errorf("backend kept sessions %v", sessions)
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("connection wasn't closed")
+	}
+}
+
+func TestNewConnectionRemovedWhileOpening(t *testing.T) {
+	info := serverInfo{rpcName: "gpsp"}
+	opening := make(chan struct{})
+	proceed := make(chan struct{})
+	sessions, mutex := fakeServerSessions(t, info.rpcName, func(uint64) {
+		close(opening)
+		<-proceed
+	})
+
+	client, remote := net.Pipe()
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		handleConnection(info, remote, 1)
+		close(done)
+	}()
+
+	// The stale connection check removes it before the backend has accepted it
+	<-opening
+	conn := connections[info.rpcName].get(1)
+	conn.cancel(closeReasonDrained)
+	if !connections[info.rpcName].remove(1, conn) || conn.announced.Load() {
+		t.Fatal("connection announced before the backend accepted it")
+	}
+	close(proceed)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection goroutine didn't exit")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(sessions) != 0 {
+		t.Errorf("backend kept sessions %v", sessions)
+	}
+}
+
+func TestCheckStaleConnections(t *testing.T) {
+	server := "staletest"
+	connections[server] = newConnectionMap()
+	t.Cleanup(func() { delete(connections, server) })
+
+	client, remote := net.Pipe()
+	defer client.Close()
+
+	open := newFrontendConn(remote)
+	connections[server].add(1, open)
+
+	closed := newFrontendConn(remote)
+	closed.cancel(closeReasonKicked)
+	closed.cancelled.Store(time.Now().Add(-time.Hour).UnixNano())
+	connections[server].add(2, closed)
+
+	if found := checkStaleConnections(time.Minute, false); found != 1 {
+		t.Errorf("found %d stale connections, expected 1", found)
+	}
+	if connections[server].get(2) == nil {
+		t.Error("stale connection removed without closeStaleConnections")
+	}
+
+	if found := checkStaleConnections(time.Minute, true); found != 1 {
+		t.Errorf("found %d stale connections, expected 1", found)
+	}
+	if connections[server].get(2) != nil || connections[server].get(1) == nil {
+		t.Error("wrong connection removed")
+	}
+}
+
+func TestCancelUnblocksRead(t *testing.T) {
+	client, remote := net.Pipe()
+	defer client.Close()
+
+	conn := newFrontendConn(remote)
+	result := make(chan error)
+	go func() {
+		_, err := conn.Read(make([]byte, 16))
+		result <- err
+	}()
+
+	conn.cancel(closeReasonKicked)
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read still blocked")
+	}
+
+	if _, err := writeFull(conn.ctx, conn, []byte("late"), time.Second); !errors.Is(err, context.Canceled) {
+		t.Errorf("write after cancel: got %v", err)
+	}
+}
+
+func TestRPCPacketRejected(t *testing.T) {
+	r := &RPCPacket{}
+
+	oversized := RPCPacket{Server: "gpcm", Index: 1, Address: "127.0.0.1:1234", Data: make([]byte, maxRPCPacketSize+1)}
+	if err := r.HandlePacket(oversized, nil); err != errRPCPacketTooLarge {
+		t.Errorf("oversized packet: got %v", err)
+	}
+
+	// Small enough to send, too large once decompressed
+	data, compressed := common.CompressData(make([]byte, maxRPCPacketSize+1), 1)
+	if err := r.HandlePacket(RPCPacket{Server: "gpcm", Index: 1, Data: data, Compressed: compressed}, nil); err != errRPCPacketTooLarge {
+		t.Errorf("oversized decompressed packet: got %v", err)
+	}
+
+	if err := r.NewConnection(RPCPacket{Server: "natneg", Index: 1}, nil); err != errRPCUnknownServer {
+		t.Errorf("unknown server: got %v", err)
+	}
+
+	disabled := false
+	oldServers := config.Servers
+	config.Servers = []common.ServerConfig{{Name: "gpsp", Enabled: &disabled}}
+	err := r.HandlePacket(RPCPacket{Server: "gpsp", Index: 1, Data: []byte{}}, nil)
+	config.Servers = oldServers
+	if err != errRPCDisabledServer {
+		t.Errorf("disabled server: got %v", err)
+	}
+
+	if err := r.NewConnection(RPCPacket{Server: "gpcm", Index: 1, Address: strings.Repeat("1", maxRPCAddressLength+1)}, nil); err != errRPCBadAddress {
+		t.Errorf("long address: got %v", err)
+	}
+}
+
+func TestRecoverRPCPanic(t *testing.T) {
+	handle := func() (err error) {
+		defer recoverRPCPanic(RPCPacket{Server: "gpsp", Index: 1}, &err)
+		var session *struct{ buffer []byte }
+		session.buffer = nil
+		return nil
+	}
+
+	if err := handle(); err != errRPCPanic {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestFrontendVersion(t *testing.T) {
+	var reply FrontendVersion
+	if err := (&RPCFrontendPacket{}).Version(struct{}{}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Frontend.Version != common.Version || reply.BackendError != "starting" {
+		t.Errorf("got %+v without a backend", reply)
+	}
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("RPCPacket", &RPCPacket{}); err != nil {
+		t.Fatal(err)
+	}
+
+	frontendSide, backendSide := net.Pipe()
+	go server.ServeConn(backendSide)
+	rpcClient = rpc.NewClient(frontendSide)
+	t.Cleanup(func() {
+		rpcClient.Close()
+		rpcClient = nil
+	})
+
+	reply = FrontendVersion{}
+	if err := (&RPCFrontendPacket{}).Version(struct{}{}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.BackendError != "" || reply.Backend.GoVersion == "" || reply.Backend.StartTime.IsZero() {
+		t.Errorf("got %+v", reply)
+	}
+}
+
+// slowBackend answers Version once it's released
+type slowBackend struct {
+	release chan struct{}
+}
+
+func (b *slowBackend) Version(_ struct{}, reply *common.VersionInfo) error {
+	<-b.release
+	*reply = common.GetVersionInfo()
+	return nil
+}
+
+func (b *slowBackend) Status(_ struct{}, status *BackendStatus) error {
+	return nil
+}
+
+func TestFrontendVersionTimeout(t *testing.T) {
+	oldTimeout := healthCheckTimeout
+	healthCheckTimeout = 50 * time.Millisecond
+
+	backend := &slowBackend{release: make(chan struct{})}
+	server := rpc.NewServer()
+	if err := server.RegisterName("RPCPacket", backend); err != nil {
+		t.Fatal(err)
+	}
+
+	frontendSide, backendSide := net.Pipe()
+	go server.ServeConn(backendSide)
+	rpcClient = rpc.NewClient(frontendSide)
+	t.Cleanup(func() {
+		rpcClient.Close()
+		rpcClient = nil
+		healthCheckTimeout = oldTimeout
+	})
+
+	var reply FrontendVersion
+	if err := (&RPCFrontendPacket{}).Version(struct{}{}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.BackendError != "timeout" {
+		t.Fatalf("got %+v", reply)
+	}
+
+	close(backend.release)
+	if err := rpcClient.Call("RPCPacket.Status", struct{}{}, &BackendStatus{}); err != nil {
+		t.Fatal(err)
+	}
+	// Time for the late reply to be read
+	time.Sleep(100 * time.Millisecond)
+	if !reply.Backend.StartTime.IsZero() {
+		t.Error("late reply was written into the reply that timed out")
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	old := logging.GetLevel()
+	t.Cleanup(func() { logging.SetLevel(old) })
+
+	logging.SetLevel(2)
+
+	var previous int
+	if err := (&RPCPacket{}).SetLogLevel(4, &previous); err != nil || previous != 2 || logging.GetLevel() != 4 {
+		t.Errorf("got previous %d, level %d, error %v", previous, logging.GetLevel(), err)
+	}
+
+	if err := (&RPCPacket{}).SetLogLevel(5, &previous); err == nil || logging.GetLevel() != 4 {
+		t.Errorf("invalid level accepted, level %d", logging.GetLevel())
+	}
+}
+
+func TestCommandExitCode(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		code int
+	}{
+		{rpc.ServerError(ErrUnknownServer.Error()), exitCommandUsage},
+		{rpc.ServerError(ErrInvalidIP.Error()), exitCommandUsage},
+		{rpc.ServerError(api.ErrAllowlistTarget.Error()), exitCommandUsage},
+		{rpc.ServerError(api.ErrAllowlistNotFound.Error()), exitCommandFailed},
+		{fmt.Errorf("enable game: %w", ErrUnknownGameID), exitCommandUsage},
+		{rpc.ServerError("unknown server: qr3"), exitCommandFailed},
+		{rpc.ServerError("failed to read config"), exitCommandFailed},
+		{rpc.ErrShutdown, exitCommandUnreachable},
+		{io.ErrUnexpectedEOF, exitCommandUnreachable},
+	} {
+		if code := commandExitCode(test.err); code != test.code {
+			t.Errorf("%v: got exit code %d, expected %d", test.err, code, test.code)
+		}
+	}
+}
+
+func TestWaitBackendDown(t *testing.T) {
+	old := config.FrontendBackendAddress
+	t.Cleanup(func() { config.FrontendBackendAddress = old })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.FrontendBackendAddress = l.Addr().String()
+
+	if err := waitBackendDown(200 * time.Millisecond); err == nil {
+		t.Error("backend reported down while listening")
+	}
+
+	time.AfterFunc(100*time.Millisecond, func() { l.Close() })
+	if err := waitBackendDown(5 * time.Second); err != nil {
+		t.Error(err)
+	}
+}
@@ -6,8 +6,6 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -15,12 +13,14 @@ import (
 	"wwfc/common"
 	"wwfc/database"
 	"wwfc/logging"
+	"wwfc/profanity"
 
 	"github.com/logrusorgru/aurora/v3"
 )
 
-var (
-	dlcDir = "./dlc"
+const (
+	// Return code for a console that isn't allowed to log in
+	returnCodeBanned = "3913"
 )
 
 func handleAuthRequest(moduleName string, w http.ResponseWriter, r *http.Request) {
@@ -86,7 +86,6 @@ func handleAuthRequest(moduleName string, w http.ResponseWriter, r *http.Request
 	}
 
 	reply := map[string]string{}
-	var response []byte
 
 	if r.URL.String() == "/ac" {
 		action, ok := fields["action"]
@@ -96,13 +95,41 @@ func handleAuthRequest(moduleName string, w http.ResponseWriter, r *http.Request
 			return
 		}
 
+		var limitKeys []string
+		// Key of the console logging in, reset after a successful login
+		consoleKey := ""
+		if authLimiter != nil && strings.ToLower(action) == "login" {
+			if ipKey := getRateLimitIP(clientAddr(r)); ipKey != "" {
+				limitKeys = append(limitKeys, ipKey)
+			}
+
+			if cfc := fields["cfc"]; cfc != "" {
+				consoleKey = "cfc:" + cfc
+			} else if fields["userid"] != "" {
+				consoleKey = "user:" + fields["userid"] + fields["gsbrcd"]
+			}
+			if consoleKey != "" {
+				limitKeys = append(limitKeys, consoleKey)
+			}
+
+			for _, key := range limitKeys {
+				if allowed, retryAfter := authLimiter.allow(key); !allowed {
+					logging.Warn(moduleName, "Login rate limit exceeded for", aurora.Cyan(key), "- retry after", aurora.Cyan(retryAfter.Round(time.Second)))
+					w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds()+0.5)))
+					replyHTTPError(w, http.StatusTooManyRequests, "429 Too Many Requests")
+					return
+				}
+			}
+		}
+
 		switch strings.ToLower(action) {
 		case "acctcreate":
 			reply = acctcreate()
 			break
 
 		case "login":
-			isLocalhost := strings.HasPrefix(r.RemoteAddr, "127.0.0.1:") || strings.HasPrefix(r.RemoteAddr, "[::1]:")
+			// Requests through the HTTPS proxy come from localhost, or from the frontend if it terminates TLS
+			isLocalhost := strings.HasPrefix(r.RemoteAddr, "127.0.0.1:") || strings.HasPrefix(r.RemoteAddr, "[::1]:") || viaFrontendTLS(r.Context())
 			ctgpver := string("")
 
 			//if _, exists := fields["_ctgpver"]; exists {
@@ -119,6 +146,25 @@ func handleAuthRequest(moduleName string, w http.ResponseWriter, r *http.Request
 				fmt.Println("CTGP FOUND: ", ctgpver) //PP CTGP PP
 			}
 			reply = login(moduleName, fields, isLocalhost, ctgpver)
+
+			if reply["returncd"] == "001" || reply["returncd"] == "040" {
+				if allowed, reason := checkAuthWebhook(r, moduleName, fields); !allowed {
+					reply = map[string]string{
+						"retry":    "0",
+						"datetime": getDateTime(),
+						"locator":  "gamespy.com",
+						"returncd": returnCodeBanned,
+						"reason":   reason,
+					}
+					break
+				}
+
+				// The address keeps its attempts, so logging in to one's own account doesn't clear
+				// the lockout of a brute force made from the same address
+				if consoleKey != "" {
+					authLimiter.reset(consoleKey)
+				}
+			}
 			break
 
 		case "svcloc":
@@ -157,31 +203,15 @@ func handleAuthRequest(moduleName string, w http.ResponseWriter, r *http.Request
 			return
 		}
 
-		switch strings.ToLower(action) {
-		case "count":
-			response = []byte(dlsCount(fields))
-			break
-
-		default:
-			logging.Error(moduleName, "Unknown action:", aurora.Cyan(action))
-			reply = map[string]string{
-				"retry":    "0",
-				"returncd": "109",
-			}
-			break
-		}
-
-		w.Header().Set("X-DLS-Host", "http://127.0.0.1/")
+		handleDownloadRequest(moduleName, w, r, fields)
+		return
 	}
 
-	if len(response) == 0 {
-		param := url.Values{}
-		for key, value := range reply {
-			param.Set(key, common.Base64DwcEncoding.EncodeToString([]byte(value)))
-		}
-		response = []byte(param.Encode())
-		response = []byte(strings.Replace(string(response), "%2A", "*", -1))
+	param := url.Values{}
+	for key, value := range reply {
+		param.Set(key, common.Base64DwcEncoding.EncodeToString([]byte(value)))
 	}
+	response := []byte(strings.Replace(param.Encode(), "%2A", "*", -1))
 
 	// DWC treats the response like a null terminated string
 	response = append(response, 0x00)
@@ -278,14 +308,59 @@ func login(moduleName string, fields map[string]string, isLocalhost bool, ctgpve
 		return param
 	}
 
+	// Only games with gameCodes in the config can be found here, NAS logins don't carry the game
+	// name. A disabled game without codes is rejected by GPCM instead.
+	game := common.GetGameInfoByCode(gamecd)
+	if game != nil && game.Disabled {
+		logging.Warn(moduleName, "Rejected login for disabled game", aurora.Cyan(game.Name))
+		param["returncd"] = returnCodeBanned
+		param["reason"] = common.GameUnavailableMessage
+		return param
+	}
+
 	hasProfaneName := false
 	ingamesn, ok := fields["ingamesn"]
-	if ok {
-		if hasProfaneName, _ = IsBadWord(ingamesn); hasProfaneName {
+	if ok && (game == nil || !game.NoProfanityFilter) {
+		if hasProfaneName = profanity.Check(ingamesn, int(langByte[0])); hasProfaneName {
 			logging.Info(moduleName, aurora.Cyan(strconv.FormatUint(userId, 10)), "has a profane name ("+aurora.Red(ingamesn).String()+")")
 		}
 	}
 
+	if allowlistMode {
+		cfcInt, _ := strconv.ParseUint(fields["cfc"], 10, 64)
+		allowed, err := store.IsNASLoginAllowed(ctx, userId, gsbrcd, cfcInt)
+		if err != nil {
+			logging.Error(moduleName, "Failed to check allowlist:", err)
+		}
+
+		if !allowed {
+			logging.Warn(moduleName, aurora.Cyan(strconv.FormatUint(userId, 10)), aurora.Cyan(gsbrcd), "is not on the allowlist")
+			param["returncd"] = returnCodeBanned
+			param["reason"] = "This server is only open to approved players."
+			return param
+		}
+	}
+
+	// Restricted and shadow banned players log in as usual
+	ban, err := store.FindNASBan(ctx, userId, gsbrcd)
+	if err != nil {
+		logging.Error(moduleName, "Failed to check ban:", err)
+	}
+
+	switch ban.Presentation() {
+	case common.BanPresentationPermanent:
+		logging.Warn(moduleName, aurora.Cyan(strconv.FormatUint(userId, 10)), aurora.Cyan(gsbrcd), "is banned")
+		param["returncd"] = returnCodeBanned
+		param["reason"] = "Banned from NewWFC: " + common.CleanBanReason(ban.Reason)
+		return param
+
+	case common.BanPresentationSuspended:
+		logging.Warn(moduleName, aurora.Cyan(strconv.FormatUint(userId, 10)), aurora.Cyan(gsbrcd), "is suspended")
+		param["returncd"] = returnCodeBanned
+		param["reason"] = "Suspended from NewWFC until " + common.FormatBanExpiry(ban.Expires) + ": " + common.CleanBanReason(ban.Reason)
+		return param
+	}
+
 	var authToken, challenge string
 	switch unitcdInt {
 	// ds
@@ -381,10 +456,16 @@ func svcloc(fields map[string]string) map[string]string {
 	return param
 }
 
+// handleProfanity checks each of the tab separated words, prwords has a 1 for every profane one
 func handleProfanity(fields map[string]string) map[string]string {
+	language := profanity.AnyLanguage
+	if lang, err := strconv.ParseUint(fields["lang"], 16, 8); err == nil {
+		language = int(lang)
+	}
+
 	var prwords string
 	for _, word := range strings.Split(fields["words"], "\t") {
-		if isBadWord, _ := IsBadWord(word); isBadWord {
+		if profanity.Check(word, language) {
 			prwords += "1"
 		} else {
 			prwords += "0"
@@ -404,17 +485,6 @@ func handleProfanity(fields map[string]string) map[string]string {
 	}
 }
 
-func dlsCount(fields map[string]string) string {
-	dlcFolder := filepath.Join(dlcDir, fields["rhgamecd"])
-
-	dir, ok := os.ReadDir(dlcFolder)
-	if ok != nil {
-		return "0"
-	}
-
-	return strconv.Itoa(len(dir))
-}
-
 func isValidRhgamecd(rhgamecd string) bool {
 	if len(rhgamecd) != 4 {
 		return false
@@ -0,0 +1,254 @@
+package nas
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"wwfc/common"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// dlsListFile optionally sets the order, titles and attributes of a game's content
+const dlsListFile = "_list.txt"
+
+var (
+	dlcDir = "dlc"
+	// Holds a value for every file being sent, nil for no limit
+	downloadSlots chan struct{}
+)
+
+// dlsEntry is a file offered to a game, as listed by the download server
+type dlsEntry struct {
+	name  string
+	title string
+	attr  [3]string
+	size  int64
+}
+
+func setupDownloads(directory string, maxDownloads int) {
+	dlcDir = directory
+
+	downloadSlots = nil
+	if maxDownloads > 0 {
+		downloadSlots = make(chan struct{}, maxDownloads)
+	}
+}
+
+// handleDownloadRequest answers the DLS1 actions: count and list describe the files available to
+// the game, contents sends one of them. A game without content has an empty list rather than an error.
+func handleDownloadRequest(moduleName string, w http.ResponseWriter, r *http.Request, fields map[string]string) {
+	rhgamecd := fields["rhgamecd"]
+
+	// Real servers send these with every download response, and some games check for them
+	w.Header().Set("X-DLS-Host", "http://127.0.0.1/")
+	w.Header().Set("NODE", "wifiappe1")
+	w.Header().Set("Server", "Nintendo")
+
+	if !common.CheckGameCode(moduleName, rhgamecd, common.GameServiceDownload) {
+		replyHTTPError(w, http.StatusForbidden, "403 Forbidden")
+		return
+	}
+
+	switch strings.ToLower(fields["action"]) {
+	case "count":
+		entries := filterDLSEntries(readDLSEntries(moduleName, rhgamecd), fields)
+		replyDownloadText(w, strconv.Itoa(len(entries)))
+
+	case "list":
+		entries := filterDLSEntries(readDLSEntries(moduleName, rhgamecd), fields)
+
+		offset, _ := strconv.Atoi(fields["offset"])
+		if offset > 0 {
+			entries = entries[min(offset, len(entries)):]
+		}
+		if num, err := strconv.Atoi(fields["num"]); err == nil && num >= 0 && num < len(entries) {
+			entries = entries[:num]
+		}
+
+		var list strings.Builder
+		for _, entry := range entries {
+			list.WriteString(entry.name + "\t" + entry.title + "\t" + strings.Join(entry.attr[:], "\t") + "\t" + strconv.FormatInt(entry.size, 10) + "\r\n")
+		}
+
+		// Some games (e.g. Pokémon Black and White) error on an empty body
+		if len(entries) == 0 {
+			list.WriteString("\r\n")
+		}
+
+		replyDownloadText(w, list.String())
+
+	case "contents":
+		sendDLSFile(moduleName, w, r, rhgamecd, fields["contents"])
+
+	default:
+		logging.Error(moduleName, "Unknown download action:", aurora.Cyan(fields["action"]))
+		replyHTTPError(w, 400, "400 Bad Request")
+	}
+}
+
+func replyDownloadText(w http.ResponseWriter, response string) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", strconv.Itoa(len(response)))
+	w.Write([]byte(response))
+}
+
+// dlsGameDirectory returns the folder with the game's content. The game code ends in the region, a
+// folder named after the first three characters holds content shared by every region.
+func dlsGameDirectory(rhgamecd string) string {
+	for _, name := range []string{rhgamecd, rhgamecd[:3]} {
+		directory := filepath.Join(dlcDir, name)
+		if info, err := os.Stat(directory); err == nil && info.IsDir() {
+			return directory
+		}
+	}
+
+	return ""
+}
+
+// isDLSFileName checks the name is a file that can be offered, and not a path or the list itself
+func isDLSFileName(name string) bool {
+	return name != "" && filepath.Base(name) == name && !strings.HasPrefix(name, ".") && !strings.HasPrefix(name, "_")
+}
+
+// readDLSEntries returns the files available to the game. Without a list file every file in the
+// folder is offered with no attributes. Sizes always come from the files themselves.
+func readDLSEntries(moduleName string, rhgamecd string) []dlsEntry {
+	directory := dlsGameDirectory(rhgamecd)
+	if directory == "" {
+		return nil
+	}
+
+	var entries []dlsEntry
+
+	file, err := os.Open(filepath.Join(directory, dlsListFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		files, err := os.ReadDir(directory)
+		if err != nil {
+			logging.Error(moduleName, "Failed to read", aurora.Cyan(directory).String()+":", err)
+			return nil
+		}
+
+		for _, file := range files {
+			if isDLSFileName(file.Name()) && file.Type().IsRegular() {
+				entries = append(entries, dlsEntry{name: file.Name()})
+			}
+		}
+	} else if err != nil {
+		logging.Error(moduleName, "Failed to open", aurora.Cyan(dlsListFile).String()+":", err)
+		return nil
+	} else {
+		defer file.Close()
+
+		// Lines are name, title, attr1, attr2 and attr3 separated by tabs, the same as a list
+		// response. A size column is allowed but ignored.
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			columns := strings.Split(strings.TrimRight(scanner.Text(), "\r"), "\t")
+			if columns[0] == "" {
+				continue
+			}
+
+			if !isDLSFileName(columns[0]) {
+				logging.Warn(moduleName, "Ignoring invalid file name in", aurora.Cyan(filepath.Join(directory, dlsListFile)).String()+":", aurora.Cyan(columns[0]))
+				continue
+			}
+
+			entry := dlsEntry{name: columns[0]}
+			if len(columns) > 1 {
+				entry.title = columns[1]
+			}
+			for i := 0; i < 3 && i+2 < len(columns); i++ {
+				entry.attr[i] = columns[i+2]
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	available := entries[:0]
+	for _, entry := range entries {
+		info, err := os.Stat(filepath.Join(directory, entry.name))
+		if err != nil || !info.Mode().IsRegular() {
+			logging.Warn(moduleName, "Listed file", aurora.Cyan(entry.name), "is missing from", aurora.Cyan(directory))
+			continue
+		}
+
+		entry.size = info.Size()
+		available = append(available, entry)
+	}
+
+	return available
+}
+
+// filterDLSEntries keeps the entries matching every attribute the game asked for
+func filterDLSEntries(entries []dlsEntry, fields map[string]string) []dlsEntry {
+	var filtered []dlsEntry
+	for _, entry := range entries {
+		matches := true
+		for i, name := range []string{"attr1", "attr2", "attr3"} {
+			if value := fields[name]; value != "" && entry.attr[i] != value {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			filtered = append(filtered, entry)
+		}
+	}
+
+	return filtered
+}
+
+func sendDLSFile(moduleName string, w http.ResponseWriter, r *http.Request, rhgamecd string, name string) {
+	if !isDLSFileName(name) {
+		logging.Error(moduleName, "Invalid download file name:", aurora.Cyan(name))
+		replyHTTPError(w, 400, "400 Bad Request")
+		return
+	}
+
+	directory := dlsGameDirectory(rhgamecd)
+	if directory == "" {
+		logging.Warn(moduleName, "No downloadable content for", aurora.Cyan(rhgamecd))
+		replyHTTPError(w, 404, "404 Not Found")
+		return
+	}
+
+	file, err := os.Open(filepath.Join(directory, name))
+	if err != nil {
+		logging.Warn(moduleName, "Downloadable content", aurora.Cyan(name), "not found for", aurora.Cyan(rhgamecd))
+		replyHTTPError(w, 404, "404 Not Found")
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		replyHTTPError(w, 404, "404 Not Found")
+		return
+	}
+
+	if downloadSlots != nil {
+		select {
+		case downloadSlots <- struct{}{}:
+			defer func() { <-downloadSlots }()
+		default:
+			logging.Warn(moduleName, "Too many downloads in progress, refusing", aurora.Cyan(name))
+			w.Header().Set("Retry-After", "10")
+			replyHTTPError(w, http.StatusServiceUnavailable, "503 Service Unavailable")
+			return
+		}
+	}
+
+	logging.Notice(moduleName, "Sending", aurora.Cyan(name), "to", aurora.Cyan(rhgamecd), "-", aurora.Cyan(info.Size()), "bytes")
+
+	w.Header().Set("Content-Type", "application/x-dsdl")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	http.ServeContent(w, r, name, info.ModTime(), file)
+}
@@ -0,0 +1,123 @@
+package nas
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testDownloads(t *testing.T, maxDownloads int) {
+	directory := t.TempDir()
+	oldDirectory, oldSlots := dlcDir, downloadSlots
+	setupDownloads(directory, maxDownloads)
+	t.Cleanup(func() {
+		dlcDir, downloadSlots = oldDirectory, oldSlots
+	})
+
+	for path, data := range map[string]string{
+		"IRBO/_list.txt":  "event.bin\tEvent\tA\t\t\t1\r\nmissing.bin\t\tA\r\nextra.bin\t\tB\r\n",
+		"IRBO/event.bin":  "12345",
+		"IRBO/extra.bin":  "123",
+		"IRB/shared.bin":  "1234567",
+		"IRB/.partial":    "1",
+		"RMCJ/README.txt": "",
+	} {
+		if err := os.MkdirAll(filepath.Join(directory, filepath.Dir(path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(directory, path), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func download(fields map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handleDownloadRequest("NAS", w, httptest.NewRequest(http.MethodPost, "/download", nil), fields)
+	return w
+}
+
+func TestDownloadList(t *testing.T) {
+	testDownloads(t, 0)
+
+	for _, test := range []struct {
+		fields map[string]string
+		body   string
+	}{
+		// Listed order and attributes, with the real size
+		{map[string]string{"action": "list", "rhgamecd": "IRBO"}, "event.bin\tEvent\tA\t\t\t5\r\nextra.bin\t\tB\t\t\t3\r\n"},
+		{map[string]string{"action": "list", "rhgamecd": "IRBO", "attr1": "B"}, "extra.bin\t\tB\t\t\t3\r\n"},
+		{map[string]string{"action": "list", "rhgamecd": "IRBO", "offset": "1"}, "extra.bin\t\tB\t\t\t3\r\n"},
+		{map[string]string{"action": "list", "rhgamecd": "IRBO", "num": "1"}, "event.bin\tEvent\tA\t\t\t5\r\n"},
+		{map[string]string{"action": "count", "rhgamecd": "IRBO", "attr1": "A"}, "1"},
+		// Shared by every region
+		{map[string]string{"action": "list", "rhgamecd": "IRBE"}, "shared.bin\t\t\t\t\t7\r\n"},
+		{map[string]string{"action": "list", "rhgamecd": "RMCJ"}, "README.txt\t\t\t\t\t0\r\n"},
+		// No content
+		{map[string]string{"action": "list", "rhgamecd": "RMCP"}, "\r\n"},
+		{map[string]string{"action": "count", "rhgamecd": "RMCP"}, "0"},
+	} {
+		w := download(test.fields)
+		if w.Code != http.StatusOK || w.Body.String() != test.body {
+			t.Errorf("%v: got %d %q, expected %q", test.fields, w.Code, w.Body.String(), test.body)
+		}
+		if w.Header().Get("X-DLS-Host") == "" {
+			t.Errorf("%v: no X-DLS-Host header", test.fields)
+		}
+	}
+}
+
+func TestDownloadContents(t *testing.T) {
+	testDownloads(t, 1)
+
+	w := download(map[string]string{"action": "contents", "rhgamecd": "IRBP", "contents": "shared.bin"})
+	if w.Code != http.StatusOK || w.Body.String() != "1234567" {
+		t.Errorf("got %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Length") != "7" || w.Header().Get("Content-Type") != "application/x-dsdl" {
+		t.Errorf("got headers %v", w.Header())
+	}
+
+	for name, status := range map[string]int{
+		"missing.bin":   http.StatusNotFound,
+		"../IRBO/x.bin": http.StatusBadRequest,
+		"_list.txt":     http.StatusBadRequest,
+		".partial":      http.StatusBadRequest,
+	} {
+		if w := download(map[string]string{"action": "contents", "rhgamecd": "IRBO", "contents": name}); w.Code != status {
+			t.Errorf("%s: got %d, expected %d", name, w.Code, status)
+		}
+	}
+
+	if w := download(map[string]string{"action": "contents", "rhgamecd": "RMCP", "contents": "event.bin"}); w.Code != http.StatusNotFound {
+		t.Errorf("no content: got %d", w.Code)
+	}
+
+	// The only download slot is taken
+	downloadSlots <- struct{}{}
+	if w := download(map[string]string{"action": "contents", "rhgamecd": "IRBO", "contents": "event.bin"}); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("download over the limit: got %d", w.Code)
+	}
+	<-downloadSlots
+}
+
+func TestDownloadHotAdd(t *testing.T) {
+	testDownloads(t, 0)
+
+	if w := download(map[string]string{"action": "count", "rhgamecd": "RMCE"}); w.Body.String() != "0" {
+		t.Fatalf("got %q", w.Body.String())
+	}
+
+	if err := os.MkdirAll(filepath.Join(dlcDir, "RMCE"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dlcDir, "RMCE", "new.bin"), []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := download(map[string]string{"action": "list", "rhgamecd": "RMCE"}); w.Body.String() != "new.bin\t\t\t\t\t1\r\n" {
+		t.Errorf("got %q", w.Body.String())
+	}
+}
@@ -0,0 +1,207 @@
+package nas
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+	"wwfc/common"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// ServerName is the name of the HTTPS connections the frontend terminates TLS for and forwards here
+const ServerName = "nas"
+
+// How long HandlePacket waits for the HTTP server to take the data
+const frontendWriteTimeout = 10 * time.Second
+
+// Marks the requests on connections from the frontend, which arrived over TLS
+type frontendTLSKey struct{}
+
+var (
+	// Replaced in tests
+	sendPacket      = common.SendPacket
+	closeConnection = common.CloseConnection
+
+	frontendListener *pipeListener
+
+	frontendMutex sync.Mutex
+	// The end of each connection's pipe the frontend's packets are written to
+	frontendConns = map[uint64]net.Conn{}
+)
+
+// pipeConn is the HTTP server's end of the pipe for a connection from the frontend
+type pipeConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// pipeListener hands the connections from the frontend to the HTTP server
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// push passes a connection to the HTTP server, returns false if the listener is closed
+func (l *pipeListener) push(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "frontend" }
+
+// viaFrontendTLS returns true if the request came from a connection the frontend terminated TLS for
+func viaFrontendTLS(ctx context.Context) bool {
+	return ctx.Value(frontendTLSKey{}) != nil
+}
+
+// NewConnection is called by the frontend when a client finished the TLS handshake
+func NewConnection(index uint64, address string, traceID string) {
+	logging.SetConnectionTrace("NAS-TLS", index, traceID)
+	moduleName := logging.ConnectionModule("NAS-TLS", index, address)
+
+	remoteAddr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		logging.Error(moduleName, "Invalid remote address")
+		closeConnection(ServerName, index)
+		return
+	}
+
+	serverEnd, frontendEnd := net.Pipe()
+
+	frontendMutex.Lock()
+	frontendConns[index] = frontendEnd
+	frontendMutex.Unlock()
+
+	if frontendListener == nil || !frontendListener.push(&pipeConn{Conn: serverEnd, remoteAddr: remoteAddr}) {
+		logging.Error(moduleName, "The HTTP server isn't accepting connections from the frontend")
+		removeFrontendConn(index, frontendEnd)
+		serverEnd.Close()
+		closeConnection(ServerName, index)
+		return
+	}
+
+	go forwardResponses(moduleName, index, frontendEnd)
+}
+
+// forwardResponses sends what the HTTP server writes to the client, until either side closes
+func forwardResponses(moduleName string, index uint64, conn net.Conn) {
+	buffer := make([]byte, 0x1000)
+	for {
+		n, err := conn.Read(buffer)
+		if n > 0 {
+			if sendErr := sendPacket(ServerName, index, buffer[:n]); sendErr != nil {
+				logging.Error(moduleName, "Failed to send response:", sendErr)
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// The HTTP server closed the connection, the frontend has to close it too unless it already did
+	if removeFrontendConn(index, conn) {
+		closeConnection(ServerName, index)
+	}
+}
+
+// HandlePacket passes decrypted data from the client to the HTTP server
+func HandlePacket(index uint64, data []byte) {
+	frontendMutex.Lock()
+	conn := frontendConns[index]
+	frontendMutex.Unlock()
+
+	if conn == nil {
+		// Opened before the backend was reloaded, HTTP doesn't need the connection to survive
+		logging.Warn(logging.ConnectionModule("NAS-TLS", index, ""), "Cannot find connection for this index, closing it")
+		closeConnection(ServerName, index)
+		return
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(frontendWriteTimeout))
+	if _, err := conn.Write(data); err != nil {
+		logging.Error(logging.ConnectionModule("NAS-TLS", index, ""), "Failed to pass request to the HTTP server:", err)
+		if removeFrontendConn(index, conn) {
+			closeConnection(ServerName, index)
+		}
+	}
+}
+
+// CloseConnection is called by the frontend when the client's connection closed
+func CloseConnection(index uint64) {
+	logging.ClearConnectionTrace("NAS-TLS", index)
+
+	frontendMutex.Lock()
+	conn := frontendConns[index]
+	frontendMutex.Unlock()
+
+	if conn != nil {
+		removeFrontendConn(index, conn)
+	}
+}
+
+// removeFrontendConn closes the pipe, returns false if it was already removed
+func removeFrontendConn(index uint64, conn net.Conn) bool {
+	frontendMutex.Lock()
+	removed := frontendConns[index] == conn
+	if removed {
+		delete(frontendConns, index)
+	}
+	frontendMutex.Unlock()
+
+	conn.Close()
+	return removed
+}
+
+// closeFrontendConns closes the pipes of every connection from the frontend, on shutdown
+func closeFrontendConns() {
+	frontendMutex.Lock()
+	conns := frontendConns
+	frontendConns = map[uint64]net.Conn{}
+	frontendMutex.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	if len(conns) != 0 {
+		logging.Info("NAS", "Closed", aurora.Cyan(len(conns)), "connections from the frontend")
+	}
+}
@@ -0,0 +1,97 @@
+package nas
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"wwfc/nhttp"
+)
+
+func TestFrontendConnection(t *testing.T) {
+	responses := make(chan []byte, 16)
+	closed := make(chan uint64, 1)
+	oldSend, oldClose, oldListener := sendPacket, closeConnection, frontendListener
+	sendPacket = func(server string, index uint64, data []byte) error {
+		responses <- append([]byte{}, data...)
+		return nil
+	}
+	closeConnection = func(server string, index uint64) error {
+		closed <- index
+		return nil
+	}
+	frontendListener = newPipeListener()
+	t.Cleanup(func() {
+		frontendListener.Close()
+		sendPacket, closeConnection, frontendListener = oldSend, oldClose, oldListener
+	})
+
+	viaTLS := make(chan bool, 1)
+	remoteAddr := make(chan string, 1)
+	server := &nhttp.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			viaTLS <- viaFrontendTLS(r.Context())
+			remoteAddr <- r.RemoteAddr
+			w.Write([]byte("ok"))
+		}),
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), frontendTLSKey{}, true)
+		},
+	}
+	go server.Serve(frontendListener)
+
+	NewConnection(7, "192.0.2.1:1234", "")
+	HandlePacket(7, []byte("GET / HTTP/1.1\r\nHost: naswii.nintendowifi.net\r\nConnection: close\r\n\r\n"))
+
+	var response strings.Builder
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case data := <-responses:
+			response.Write(data)
+			continue
+		case index := <-closed:
+			if index != 7 {
+				t.Errorf("closed connection %d", index)
+			}
+		case <-timeout:
+			t.Fatal("the connection wasn't closed")
+		}
+		break
+	}
+
+	if !strings.HasPrefix(response.String(), "HTTP/1.1 200") || !strings.HasSuffix(response.String(), "ok") {
+		t.Errorf("unexpected response %q", response.String())
+	}
+	if !<-viaTLS {
+		t.Error("request wasn't marked as coming over TLS")
+	}
+	if addr := <-remoteAddr; addr != "192.0.2.1:1234" {
+		t.Errorf("request came from %q", addr)
+	}
+
+	frontendMutex.Lock()
+	defer frontendMutex.Unlock()
+	if len(frontendConns) != 0 {
+		t.Errorf("%d connections left after close", len(frontendConns))
+	}
+}
+
+func TestFrontendConnectionUnknown(t *testing.T) {
+	closed := make(chan uint64, 1)
+	oldClose := closeConnection
+	closeConnection = func(server string, index uint64) error {
+		closed <- index
+		return nil
+	}
+	t.Cleanup(func() {
+		closeConnection = oldClose
+	})
+
+	HandlePacket(8, []byte("GET / HTTP/1.1\r\n"))
+	if index := <-closed; index != 8 {
+		t.Errorf("closed connection %d", index)
+	}
+}
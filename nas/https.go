@@ -18,8 +18,10 @@ import (
 	"hash"
 	"io"
 	"net"
+	"net/http"
 	"os"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"wwfc/common"
 	"wwfc/logging"
@@ -52,187 +54,194 @@ func (b bufferedConn) Read(p []byte) (int, error) {
 
 // Don't use this for anything else, it's not secure
 
-func startHTTPSProxy(config common.Config) {
-	address := *config.NASAddressHTTPS + ":" + config.NASPortHTTPS
-	nasAddr := *config.NASAddress + ":" + config.NASPort
-	privKeyPath := config.KeyPath
-	certsPath := config.CertPath
-	exploitWii := *config.EnableHTTPSExploitWii
-	exploitDS := *config.EnableHTTPSExploitDS
+// TLSTerminator decrypts HTTPS connections from consoles and from regular TLS clients. It's used by
+// the backend's HTTPS proxy, or by the frontend when it terminates TLS itself.
+type TLSTerminator struct {
+	privKeyPath string
+	certsPath   string
+
+	rsaKeyWii            *rsa.PrivateKey
+	serverCertsRecordWii []byte
+	rsaKeyDS             *rsa.PrivateKey
+	serverCertsRecordDS  []byte
+
+	// Replaced when the certs are reread, nil if they couldn't be loaded
+	realTLSConfig atomic.Pointer[tls.Config]
+	// Kept across rereads so session tickets issued before still resume
+	sessionTicketKey [32]byte
+}
 
-	logging.Notice("NAS-TLS", "Starting HTTPS server on", aurora.BrightCyan(address))
-	l, err := net.Listen("tcp", address)
-	if err != nil {
-		panic(err)
+// NewTLSTerminator loads the keys and certs from the config. The regular TLS certs are reread every
+// day, the console certs are only read once.
+func NewTLSTerminator(config common.Config) (*TLSTerminator, error) {
+	t := &TLSTerminator{
+		privKeyPath: config.KeyPath,
+		certsPath:   config.CertPath,
 	}
 
-	setupRealTLS(privKeyPath, certsPath)
-	// Reread the private key and certs on a regular interval
-	go func() {
-		for {
-			time.Sleep(24 * time.Hour)
-			setupRealTLS(privKeyPath, certsPath)
-		}
-	}()
-
-	if !(exploitWii || exploitDS) {
-		// Only handle real TLS requests
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				panic(err)
-			}
-
-			go func() {
-				moduleName := "NAS-TLS:" + conn.RemoteAddr().String()
-
-				conn.SetDeadline(time.Now().Add(25 * time.Second))
-
-				handleRealTLS(moduleName, conn, nasAddr)
-			}()
-		}
+	if _, err := rand.Read(t.sessionTicketKey[:]); err != nil {
+		return nil, err
 	}
 
-	// Handle requests from Wii, DS and regular TLS
-	var rsaKeyWii *rsa.PrivateKey
-	var serverCertsRecordWii []byte
-	if exploitWii {
+	if *config.EnableHTTPSExploitWii {
 		certWii, err := os.ReadFile(config.CertPathWii)
 		if err != nil {
-			panic(err)
-		}
-
-		rsaDataWii, err := os.ReadFile(config.KeyPathWii)
-		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
-		rsaBlockWii, _ := pem.Decode(rsaDataWii)
-		parsedKeyWii, err := x509.ParsePKCS8PrivateKey(rsaBlockWii.Bytes)
+		t.rsaKeyWii, err = readRSAKey(config.KeyPathWii)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
-		var ok bool
-		rsaKeyWii, ok = parsedKeyWii.(*rsa.PrivateKey)
-		if !ok {
-			panic("unexpected key type")
-		}
-
-		serverCertsRecordWii = []byte{0x16, 0x03, 0x01}
+		t.serverCertsRecordWii = []byte{0x16, 0x03, 0x01}
 
 		// Length of the record
 		certLenWii := uint32(len(certWii))
-		serverCertsRecordWii = append(serverCertsRecordWii, []byte{
+		t.serverCertsRecordWii = append(t.serverCertsRecordWii, []byte{
 			byte((certLenWii + 10) >> 8),
 			byte(certLenWii + 10),
 		}...)
 
-		serverCertsRecordWii = append(serverCertsRecordWii, 0xB)
+		t.serverCertsRecordWii = append(t.serverCertsRecordWii, 0xB)
 
-		serverCertsRecordWii = append(serverCertsRecordWii, []byte{
+		t.serverCertsRecordWii = append(t.serverCertsRecordWii, []byte{
 			byte((certLenWii + 6) >> 16),
 			byte((certLenWii + 6) >> 8),
 			byte(certLenWii + 6),
 		}...)
 
-		serverCertsRecordWii = append(serverCertsRecordWii, []byte{
+		t.serverCertsRecordWii = append(t.serverCertsRecordWii, []byte{
 			byte((certLenWii + 3) >> 16),
 			byte((certLenWii + 3) >> 8),
 			byte(certLenWii + 3),
 		}...)
 
-		serverCertsRecordWii = append(serverCertsRecordWii, []byte{
+		t.serverCertsRecordWii = append(t.serverCertsRecordWii, []byte{
 			byte(certLenWii >> 16),
 			byte(certLenWii >> 8),
 			byte(certLenWii),
 		}...)
 
-		serverCertsRecordWii = append(serverCertsRecordWii, certWii...)
+		t.serverCertsRecordWii = append(t.serverCertsRecordWii, certWii...)
 
-		serverCertsRecordWii = append(serverCertsRecordWii, []byte{
+		t.serverCertsRecordWii = append(t.serverCertsRecordWii, []byte{
 			0x16, 0x03, 0x01, 0x00, 0x04, 0x0E, 0x00, 0x00, 0x00,
 		}...)
 	}
 
-	var rsaKeyDS *rsa.PrivateKey
-	var serverCertsRecordDS []byte
-	if exploitDS {
+	if *config.EnableHTTPSExploitDS {
 		certDS, err := os.ReadFile(config.CertPathDS)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
-		rsaDataDS, err := os.ReadFile(config.KeyPathDS)
-		//fmt.Println(rsaDataDS) //pp
+		t.rsaKeyDS, err = readRSAKey(config.KeyPathDS)
 		if err != nil {
-			panic(err)
-		}
-
-		rsaBlockDS, _ := pem.Decode(rsaDataDS)
-		//fmt.Println(rsaBlockDS) //pp
-		//parsedKeyDS, err := x509.ParsePKCS8PrivateKey(rsaBlockDS.Bytes)
-		parsedKeyDS, err := x509.ParsePKCS8PrivateKey(rsaBlockDS.Bytes)
-		if err != nil {
-			panic(err)
-		}
-
-		var ok bool
-		rsaKeyDS, ok = parsedKeyDS.(*rsa.PrivateKey)
-		if !ok {
-			panic("unexpected key type")
+			return nil, err
 		}
 
 		wiiCertDS, err := os.ReadFile(config.WiiCertPathDS)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
-		serverCertsRecordDS = []byte{0x16, 0x03, 0x00}
+		t.serverCertsRecordDS = []byte{0x16, 0x03, 0x00}
 
 		// Length of the record
 		certLenDS := uint32(len(certDS))
 		wiiCertLenDS := uint32(len(wiiCertDS))
-		serverCertsRecordDS = append(serverCertsRecordDS, []byte{
+		t.serverCertsRecordDS = append(t.serverCertsRecordDS, []byte{
 			byte((certLenDS + wiiCertLenDS + 13) >> 8),
 			byte(certLenDS + wiiCertLenDS + 13),
 		}...)
 
-		serverCertsRecordDS = append(serverCertsRecordDS, 0xB)
+		t.serverCertsRecordDS = append(t.serverCertsRecordDS, 0xB)
 
-		serverCertsRecordDS = append(serverCertsRecordDS, []byte{
+		t.serverCertsRecordDS = append(t.serverCertsRecordDS, []byte{
 			byte((certLenDS + wiiCertLenDS + 9) >> 16),
 			byte((certLenDS + wiiCertLenDS + 9) >> 8),
 			byte(certLenDS + wiiCertLenDS + 9),
 		}...)
 
-		serverCertsRecordDS = append(serverCertsRecordDS, []byte{
+		t.serverCertsRecordDS = append(t.serverCertsRecordDS, []byte{
 			byte((certLenDS + wiiCertLenDS + 6) >> 16),
 			byte((certLenDS + wiiCertLenDS + 6) >> 8),
 			byte(certLenDS + wiiCertLenDS + 6),
 		}...)
 
-		serverCertsRecordDS = append(serverCertsRecordDS, []byte{
+		t.serverCertsRecordDS = append(t.serverCertsRecordDS, []byte{
 			byte(certLenDS >> 16),
 			byte(certLenDS >> 8),
 			byte(certLenDS),
 		}...)
 
-		serverCertsRecordDS = append(serverCertsRecordDS, certDS...)
+		t.serverCertsRecordDS = append(t.serverCertsRecordDS, certDS...)
 
-		serverCertsRecordDS = append(serverCertsRecordDS, []byte{
+		t.serverCertsRecordDS = append(t.serverCertsRecordDS, []byte{
 			byte(wiiCertLenDS >> 16),
 			byte(wiiCertLenDS >> 8),
 			byte(wiiCertLenDS),
 		}...)
 
-		serverCertsRecordDS = append(serverCertsRecordDS, wiiCertDS...)
+		t.serverCertsRecordDS = append(t.serverCertsRecordDS, wiiCertDS...)
 
-		serverCertsRecordDS = append(serverCertsRecordDS, []byte{
+		t.serverCertsRecordDS = append(t.serverCertsRecordDS, []byte{
 			0x16, 0x03, 0x00, 0x00, 0x04, 0x0E, 0x00, 0x00, 0x00,
 		}...)
 	}
 
+	t.setupRealTLS()
+	// Reread the private key and certs on a regular interval
+	go func() {
+		for {
+			time.Sleep(24 * time.Hour)
+			t.setupRealTLS()
+		}
+	}()
+
+	return t, nil
+}
+
+func readRSAKey(path string) (*rsa.PrivateKey, error) {
+	rsaData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaBlock, _ := pem.Decode(rsaData)
+	if rsaBlock == nil {
+		return nil, errors.New("no PEM data in " + path)
+	}
+
+	parsedKey, err := x509.ParsePKCS8PrivateKey(rsaBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := parsedKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("unexpected key type in " + path)
+	}
+
+	return rsaKey, nil
+}
+
+func startHTTPSProxy(config common.Config) {
+	address := *config.NASAddressHTTPS + ":" + config.NASPortHTTPS
+	nasAddr := *config.NASAddress + ":" + config.NASPort
+
+	terminator, err := NewTLSTerminator(config)
+	if err != nil {
+		panic(err)
+	}
+
+	logging.Notice("NAS-TLS", "Starting HTTPS server on", aurora.BrightCyan(address))
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		panic(err)
+	}
+
 	for {
 		conn, err := l.Accept()
 		if err != nil {
@@ -244,37 +253,50 @@ func startHTTPSProxy(config common.Config) {
 
 			moduleName := "NAS-TLS:" + conn.RemoteAddr().String()
 
-			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			// The handshake deadline is kept for the whole connection
+			tlsConn, err := terminator.Handshake(moduleName, conn)
+			if err != nil {
+				conn.Close()
+				return
+			}
 
-			handleTLS(moduleName, conn, nasAddr, serverCertsRecordWii, rsaKeyWii, serverCertsRecordDS, rsaKeyDS)
+			proxyHTTP(moduleName, tlsConn, nasAddr)
 		}()
 	}
 }
 
-// handleTLS handles the TLS request from the Wii or the DS. It may call handleRealTLS if the request is from a modern web browser.
-func handleTLS(moduleName string, rawConn net.Conn, nasAddr string, serverCertsRecordWii []byte, rsaKeyWii *rsa.PrivateKey, serverCertsRecordDS []byte, rsaKeyDS *rsa.PrivateKey) {
+// Handshake handles the TLS handshake from the Wii or the DS, or from a modern web browser using
+// crypto/tls, and returns the connection carrying the decrypted data. It sets a deadline on the
+// connection for the handshake, which the caller has to clear to keep using the connection after.
+func (t *TLSTerminator) Handshake(moduleName string, rawConn net.Conn) (tlsConn net.Conn, err error) {
 	// Recover from panics
 	defer func() {
 		if r := recover(); r != nil {
 			logging.Error(moduleName, "Panic:", r)
+			err = fmt.Errorf("panic in handshake: %v", r)
 		}
 	}()
 
 	conn := newBufferedConn(rawConn)
 
-	defer conn.Close()
+	if t.rsaKeyWii == nil && t.rsaKeyDS == nil {
+		// Only handle real TLS requests
+		conn.SetDeadline(time.Now().Add(25 * time.Second))
+		return t.handshakeRealTLS(conn)
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
 
 	// Read client hello
 	// fmt.Printf("Client Hello:\n")
 	var helloBytes []byte
-	if rsaKeyWii != nil {
+	if t.rsaKeyWii != nil {
 		index := 0
 		for index = 0; index < 0x1D; index++ {
-			var err error
 			helloBytes, err = conn.Peek(index + 1)
 			if err != nil {
 				logging.Error(moduleName, "Failed to peek from client:", err)
-				return
+				return nil, err
 			}
 
 			if helloBytes[index] != []byte{
@@ -286,22 +308,21 @@ func handleTLS(moduleName string, rawConn net.Conn, nasAddr string, serverCertsR
 			}
 		}
 		if index == 0x1D {
-			macFn, cipher, clientCipher, err := handleWiiTLSHandshake(moduleName, conn, serverCertsRecordWii, rsaKeyWii)
-			if err == nil && macFn != nil && cipher != nil && clientCipher != nil {
-				proxyConsoleTLS(moduleName, conn, nasAddr, VersionTLS10, macFn, cipher, clientCipher)
+			macFn, cipher, clientCipher, err := handleWiiTLSHandshake(moduleName, conn, t.serverCertsRecordWii, t.rsaKeyWii)
+			if err != nil || macFn == nil || cipher == nil || clientCipher == nil {
+				return nil, errors.Join(errHandshakeFailed, err)
 			}
-			return
+			return newConsoleConn(moduleName, conn, VersionTLS10, macFn, cipher, clientCipher), nil
 		}
 	}
 
-	if rsaKeyDS != nil {
+	if t.rsaKeyDS != nil {
 		index := 0
 		for index = 0; index < 0x0B; index++ {
-			var err error
 			helloBytes, err = conn.Peek(index + 1)
 			if err != nil {
 				logging.Error(moduleName, "Failed to peek from client:", err)
-				return
+				return nil, err
 			}
 
 			if helloBytes[index] != []byte{
@@ -311,20 +332,22 @@ func handleTLS(moduleName string, rawConn net.Conn, nasAddr string, serverCertsR
 			}
 		}
 		if index == 0x0B {
-			macFn, cipher, clientCipher, err := handleDSSSLHandshake(moduleName, conn, serverCertsRecordDS, rsaKeyDS)
-			if err == nil && macFn != nil && cipher != nil && clientCipher != nil {
-				proxyConsoleTLS(moduleName, conn, nasAddr, VersionSSL30, macFn, cipher, clientCipher)
+			macFn, cipher, clientCipher, err := handleDSSSLHandshake(moduleName, conn, t.serverCertsRecordDS, t.rsaKeyDS)
+			if err != nil || macFn == nil || cipher == nil || clientCipher == nil {
+				return nil, errors.Join(errHandshakeFailed, err)
 			}
-			return
+			return newConsoleConn(moduleName, conn, VersionSSL30, macFn, cipher, clientCipher), nil
 		}
 	}
 
 	conn.SetDeadline(time.Now().Add(25 * time.Second))
 
 	// logging.Info(moduleName, "Forwarding client hello:", aurora.Cyan(fmt.Sprintf("% X ", helloBytes)))
-	handleRealTLS(moduleName, conn, nasAddr)
+	return t.handshakeRealTLS(conn)
 }
 
+var errHandshakeFailed = errors.New("console handshake failed")
+
 func handleWiiTLSHandshake(moduleName string, conn bufferedConn, serverCertsRecord []byte, rsaKey *rsa.PrivateKey) (macFn macFunction, cipher *rc4.Cipher, clientCipher *rc4.Cipher, err error) {
 	// fmt.Printf("\n")
 
@@ -680,128 +703,176 @@ func handleDSSSLHandshake(moduleName string, conn bufferedConn, serverCertsRecor
 	return
 }
 
-func proxyConsoleTLS(moduleName string, conn bufferedConn, nasAddr string, version uint16, macFn macFunction, cipher *rc4.Cipher, clientCipher *rc4.Cipher) {
-	// Open a connection to NAS
-	newConn, err := net.Dial("tcp", nasAddr)
-	if err != nil {
-		panic(err)
-	}
-
-	defer newConn.Close()
+const (
+	// Largest record the consoles are sent, the proxy always forwarded the HTTP response in chunks of
+	// this size and the consoles' SSL buffers are small
+	maxConsoleRecordPayload = 0x100
+	// Largest record accepted from a console, including the header
+	maxConsoleRecordLength = 0x1000
+)
 
-	// Read bytes from the HTTP server and forward them through the TLS connection
-	go func() {
-		recvBuf := make([]byte, 0x100)
+// consoleConn carries the application data of a console's connection after the handshake
+type consoleConn struct {
+	bufferedConn
+	moduleName string
 
-		seq := uint64(1)
-		for {
-			n, err := newConn.Read(recvBuf)
-			if err != nil {
-				if errors.Is(err, io.EOF) || strings.Contains(err.Error(), "use of closed network connection") {
-					return
-				}
+	version      uint16
+	macFn        macFunction
+	cipher       *rc4.Cipher
+	clientCipher *rc4.Cipher
+	seq          uint64
 
-				logging.Error(moduleName, "Failed to read from HTTP server:", err)
-				return
-			}
+	// Decrypted data from the client that wasn't read yet
+	pending []byte
+	total   int
+}
 
-			// fmt.Printf("Sent:\n% X ", recvBuf[:n])
-			var record []byte
-			record, seq = encryptTLS(macFn, cipher, recvBuf[:n], seq, []byte{0x17, 0x03, 0x01, byte(n >> 8), byte(n)})
+func newConsoleConn(moduleName string, conn bufferedConn, version uint16, macFn macFunction, cipher *rc4.Cipher, clientCipher *rc4.Cipher) *consoleConn {
+	return &consoleConn{
+		bufferedConn: conn,
+		moduleName:   moduleName,
+		version:      version,
+		macFn:        macFn,
+		cipher:       cipher,
+		clientCipher: clientCipher,
+		seq:          1,
+	}
+}
 
-			_, err = conn.Write(record)
-			if err != nil {
-				logging.Error(moduleName, "Failed to write to client:", err)
-				return
-			}
+// Read decrypts the next application data record from the client. A close alert is returned as io.EOF.
+func (c *consoleConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if err := c.readRecord(); err != nil {
+			return 0, err
 		}
-	}()
+	}
 
-	// Read encrypted content from the client and forward it to the HTTP server
-	index := 0
-	total := 0
-	buf := make([]byte, 0x1000)
-	for {
-		n, err := conn.Read(buf[index:])
-		if err != nil {
-			if errors.Is(err, io.EOF) || strings.Contains(err.Error(), "use of closed network connection") {
-				logging.Info(moduleName, "Connection closed by client after", aurora.BrightCyan(total), "bytes")
-				return
-			}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
 
-			logging.Error(moduleName, "Failed to read from client:", err)
-			return
+func (c *consoleConn) readRecord() error {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(c.bufferedConn, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			logging.Info(c.moduleName, "Connection closed by client after", aurora.BrightCyan(c.total), "bytes")
 		}
+		return err
+	}
 
-		// fmt.Printf("Received:\n% X ", buf[index:index+n])
-		index += n
-		total += n
+	if header[0] < 0x15 || header[0] > 0x17 {
+		logging.Error(c.moduleName, "Invalid record type")
+		return errors.New("invalid record type")
+	}
 
-		for {
-			if index < 5 {
-				break
-			}
+	if header[1] != 0x03 || (c.version == VersionTLS10 && header[2] != 0x01) || (c.version == VersionSSL30 && header[2] != 0x00) {
+		logging.Error(c.moduleName, "Invalid TLS version")
+		return errors.New("invalid TLS version")
+	}
 
-			if buf[0] < 0x15 || buf[0] > 0x17 {
-				logging.Error(moduleName, "Invalid record type")
-				return
-			}
+	recordLength := binary.BigEndian.Uint16(header[3:5])
+	if recordLength < 17 || (recordLength+5) > maxConsoleRecordLength {
+		logging.Error(c.moduleName, "Invalid record length")
+		return errors.New("invalid record length")
+	}
 
-			if buf[1] != 0x03 || (version == VersionTLS10 && buf[2] != 0x01) || (version == VersionSSL30 && buf[2] != 0x00) {
-				logging.Error(moduleName, "Invalid TLS version")
-				return
-			}
+	body := make([]byte, recordLength)
+	if _, err := io.ReadFull(c.bufferedConn, body); err != nil {
+		return err
+	}
+	c.total += 5 + int(recordLength)
 
-			recordLength := binary.BigEndian.Uint16(buf[3:5])
-			if recordLength < 17 || (recordLength+5) > 0x1000 {
-				logging.Error(moduleName, "Invalid record length")
-				return
-			}
+	// Decrypt content
+	c.clientCipher.XORKeyStream(body, body)
+	// fmt.Printf("\nDecrypted content:\n% X \n", body)
 
-			if index < int(recordLength)+5 {
-				break
-			}
+	if header[0] != 0x17 {
+		if header[0] == 0x15 || body[0] == 0x01 || body[1] == 0x00 {
+			logging.Info(c.moduleName, "Alert connection close by client after", aurora.BrightCyan(c.total), "bytes")
+			return io.EOF
+		}
 
-			// Decrypt content
-			clientCipher.XORKeyStream(buf[5:5+recordLength], buf[5:5+recordLength])
-			// fmt.Printf("\nDecrypted content:\n% X \n", buf[5:5+recordLength])
+		logging.Error(c.moduleName, "Non-application data received:", aurora.Cyan(fmt.Sprintf("% X ", append(header, body...))))
+		return errors.New("non-application data received")
+	}
 
-			if buf[0] != 0x17 {
-				if buf[0] == 0x15 || buf[5] == 0x01 || buf[6] == 0x00 {
-					logging.Info(moduleName, "Alert connection close by client after", aurora.BrightCyan(total), "bytes")
-					return
-				}
+	// Strip the MAC
+	c.pending = body[:recordLength-16]
+	return nil
+}
 
-				logging.Error(moduleName, "Non-application data received:", aurora.Cyan(fmt.Sprintf("% X ", buf[:5+recordLength])))
-				return
-			} else {
-				// Send the decrypted content to the HTTP server
-				_, err = newConn.Write(buf[5 : 5+recordLength-16])
-				if err != nil {
-					logging.Error(moduleName, "Failed to write to HTTP server:", err)
-					return
-				}
-			}
+// Write encrypts the data into application data records for the client
+func (c *consoleConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n := min(len(p)-written, maxConsoleRecordPayload)
+
+		var record []byte
+		record, c.seq = encryptTLS(c.macFn, c.cipher, p[written:written+n], c.seq, []byte{0x17, 0x03, 0x01, byte(n >> 8), byte(n)})
 
-			buf = buf[5+recordLength:]
-			buf = append(buf, make([]byte, 0x1000-len(buf))...)
-			index -= 5 + int(recordLength)
+		if _, err := c.bufferedConn.Write(record); err != nil {
+			logging.Error(c.moduleName, "Failed to write to client:", err)
+			return written, err
 		}
+		written += n
+	}
+
+	return written, nil
+}
+
+// The client address of each connection proxyHTTP opened to the HTTP server, by the local address
+// of the connection, which the HTTP server sees as the remote address of the request
+var proxiedClients sync.Map
+
+// clientAddr returns the address of the client that sent the request. Requests decrypted by the
+// HTTPS proxy arrive from loopback, those carry the address the proxy accepted them from.
+func clientAddr(r *http.Request) string {
+	if addr, ok := proxiedClients.Load(r.RemoteAddr); ok {
+		return addr.(string)
 	}
+
+	return r.RemoteAddr
 }
 
-var realTLSConfig *tls.Config
+// proxyHTTP forwards a decrypted connection to the HTTP server
+func proxyHTTP(moduleName string, conn net.Conn, nasAddr string) {
+	defer conn.Close()
 
-func setupRealTLS(privKeyPath string, certsPath string) {
+	// Open a connection to NAS
+	newConn, err := net.Dial("tcp", nasAddr)
+	if err != nil {
+		logging.Error(moduleName, "Failed to connect to HTTP server:", err)
+		return
+	}
+
+	defer newConn.Close()
+
+	proxiedClients.Store(newConn.LocalAddr().String(), conn.RemoteAddr().String())
+	defer proxiedClients.Delete(newConn.LocalAddr().String())
+
+	// Read bytes from the HTTP server and forward them through the TLS connection
+	go func() {
+		io.Copy(conn, newConn)
+		conn.Close()
+	}()
+
+	// Read decrypted content from the client and forward it to the HTTP server
+	if _, err := io.Copy(newConn, conn); err != nil && !errors.Is(err, net.ErrClosed) {
+		logging.Error(moduleName, "Failed to forward to HTTP server:", err)
+	}
+}
+
+func (t *TLSTerminator) setupRealTLS() {
 	// Read server key and certs
 
-	serverKey, err := os.ReadFile(privKeyPath)
+	serverKey, err := os.ReadFile(t.privKeyPath)
 	if err != nil {
 		logging.Error("NAS-TLS", "Failed to read server key:", err)
 		return
 	}
 
-	serverCerts, err := os.ReadFile(certsPath)
+	serverCerts, err := os.ReadFile(t.certsPath)
 	if err != nil {
 		logging.Error("NAS-TLS", "Failed to read server certs:", err)
 		return
@@ -816,69 +887,24 @@ func setupRealTLS(privKeyPath string, certsPath string) {
 	config := tls.Config{
 		Certificates: []tls.Certificate{cert},
 	}
+	config.SetSessionTicketKeys([][32]byte{t.sessionTicketKey})
 
-	realTLSConfig = &config
+	t.realTLSConfig.Store(&config)
 }
 
-// handleRealTLS handles the TLS request legitimately using crypto/tls
-func handleRealTLS(moduleName string, conn net.Conn, nasAddr string) {
-	// Recover from panics
-	defer func() {
-		if r := recover(); r != nil {
-			logging.Error(moduleName, "Panic:", r)
-		}
-	}()
-
-	if realTLSConfig == nil {
-		return
+// handshakeRealTLS handles the TLS request legitimately using crypto/tls
+func (t *TLSTerminator) handshakeRealTLS(conn net.Conn) (net.Conn, error) {
+	config := t.realTLSConfig.Load()
+	if config == nil {
+		return nil, errors.New("no TLS certificate loaded")
 	}
 
-	tlsConn := tls.Server(conn, realTLSConfig)
-
-	err := tlsConn.Handshake()
-	if err != nil {
-		return
+	tlsConn := tls.Server(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
 	}
 
-	newConn, err := net.Dial("tcp", nasAddr)
-	if err != nil {
-		panic(err)
-	}
-
-	defer newConn.Close()
-
-	// Read bytes from the HTTP server and forward them through the TLS connection
-	go func() {
-		recvBuf := make([]byte, 0x100)
-
-		for {
-			n, err := newConn.Read(recvBuf)
-			if err != nil {
-				return
-			}
-
-			_, err = tlsConn.Write(recvBuf[:n])
-			if err != nil {
-				logging.Error(moduleName, "Failed to write to client:", err)
-				return
-			}
-		}
-	}()
-
-	// Read encrypted content from the client and forward it to the HTTP server
-	buf := make([]byte, 0x1000)
-	for {
-		n, err := tlsConn.Read(buf)
-		if err != nil {
-			return
-		}
-
-		_, err = newConn.Write(buf[:n])
-		if err != nil {
-			logging.Error(moduleName, "Failed to write to HTTP server:", err)
-			return
-		}
-	}
+	return tlsConn, nil
 }
 
 // The following functions are modified from the crypto standard library
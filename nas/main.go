@@ -4,15 +4,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 	"wwfc/api"
 	"wwfc/common"
+	"wwfc/database"
 	"wwfc/gamestats"
 	"wwfc/logging"
 	"wwfc/nhttp"
@@ -24,30 +27,78 @@ import (
 var (
 	serverName string
 	server     *nhttp.Server
+
+	ctx   = context.Background()
+	store database.Store
+
+	allowlistMode bool
+
+	stopCleanup chan struct{}
+
+	// Numbers the HTTP requests for their trace IDs
+	requestCount atomic.Uint64
 )
 
+// Header the trace ID of a request is returned in, so a failed request can be found in the logs
+const traceHeader = "X-Trace-Id"
+
 func StartServer(reload bool) {
 	// Get config
 	config := common.GetConfig()
 
 	serverName = config.ServerName
+	allowlistMode = config.AllowlistMode
+
+	// Start SQL
+	var err error
+	store, err = database.Connect(ctx, config)
+	if err != nil {
+		panic(err)
+	}
 
 	address := *config.NASAddress + ":" + config.NASPort
 
-	if config.EnableHTTPS {
+	if config.EnableHTTPS && !config.FrontendHTTPS {
 		go startHTTPSProxy(config)
 	}
 
-	err := CacheProfanityFile()
-	if err != nil {
-		logging.Info("NAS", err)
+	if *config.NASAuthAttemptsPerMinute > 0 {
+		authLimiter = newAuthRateLimiter(*config.NASAuthAttemptsPerMinute)
+		stopCleanup = make(chan struct{})
+		authLimiter.startCleanup(stopCleanup)
+	}
+
+	setupDownloads(config.DLCDirectory, *config.DLCMaxDownloads)
+	setupAuthWebhook(config)
+
+	var listener *pipeListener
+	if config.EnableHTTPS && config.FrontendHTTPS {
+		listener = newPipeListener()
 	}
+	frontendListener = listener
 
 	server = &nhttp.Server{
 		Addr:        address,
 		Handler:     http.HandlerFunc(handleRequest),
 		IdleTimeout: 20 * time.Second,
 		ReadTimeout: 10 * time.Second,
+		BaseContext: func(l net.Listener) context.Context {
+			if listener != nil && l == net.Listener(listener) {
+				return context.WithValue(context.Background(), frontendTLSKey{}, true)
+			}
+			return context.Background()
+		},
+	}
+
+	if listener != nil {
+		go func() {
+			logging.Notice("NAS", "Serving HTTPS requests forwarded by the frontend")
+
+			err := server.Serve(listener)
+			if err != nil && !errors.Is(err, nhttp.ErrServerClosed) {
+				panic(err)
+			}
+		}()
 	}
 
 	go func() {
@@ -61,10 +112,16 @@ func StartServer(reload bool) {
 }
 
 func Shutdown() {
+	if stopCleanup != nil {
+		close(stopCleanup)
+	}
+
 	if server == nil {
 		return
 	}
 
+	closeFrontendConns()
+
 	ctx, release := context.WithTimeout(context.Background(), 10*time.Second)
 	defer release()
 
@@ -79,6 +136,9 @@ var regexGamestatsHost = regexp.MustCompile(`^([a-z\-]+\.)?gamestats2?\.gs\.`)
 var regexStage1URL = regexp.MustCompile(`^/w([0-9])$`)
 
 func handleRequest(w http.ResponseWriter, r *http.Request) {
+	traceID := logging.NewTraceID("nas", requestCount.Add(1))
+	w.Header().Set(traceHeader, traceID)
+
 	// Check for *.sake.gs.* or sake.gs.*
 	if regexSakeHost.MatchString(r.Host) {
 		// Redirect to the sake server
@@ -93,7 +153,7 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	moduleName := "NAS:" + r.RemoteAddr
+	moduleName := logging.TraceModule("NAS:"+r.RemoteAddr, traceID)
 
 	// Handle conntest server
 	if strings.HasPrefix(r.Host, "conntest.") {
@@ -132,6 +192,16 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Path == "/healthz" {
+		api.HandleHealthz(w, r)
+		return
+	}
+
+	if r.URL.Path == "/api/version" {
+		api.HandleVersion(w, r)
+		return
+	}
+
 	// Check for /api/groups
 	if r.URL.Path == "/api/groups" {
 		api.HandleGroups(w, r)
@@ -167,6 +237,52 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Check for /admin/connections
+	if r.URL.Path == "/admin/connections" {
+		api.HandleConnections(w, r)
+		return
+	}
+
+	// Check for /api/traffic
+	if r.URL.Path == "/api/traffic" {
+		api.HandleTraffic(w, r)
+		return
+	}
+
+	if r.URL.Path == "/api/payload_events" {
+		api.HandlePayloadEvents(w, r)
+		return
+	}
+
+	// Check for /api/allowlist
+	if r.URL.Path == "/api/allowlist" {
+		api.HandleAllowlist(w, r)
+		return
+	}
+
+	// Check for /api/leaderboard
+	if r.URL.Path == "/api/leaderboard" {
+		api.HandleLeaderboard(w, r)
+		return
+	}
+
+	if r.URL.Path == "/api/leaderboard/player" {
+		api.HandleLeaderboardPlayer(w, r)
+		return
+	}
+
+	// Check for /api/profanity
+	if r.URL.Path == "/api/profanity" {
+		api.HandleProfanity(w, r)
+		return
+	}
+
+	// Check for /api/profile/{pid}
+	if strings.HasPrefix(r.URL.Path, "/api/profile/") {
+		api.HandleProfile(w, r)
+		return
+	}
+
 	if r.URL.Path == "/api/trusted" {
 		api.HandleFetch(w, r)
 		return
@@ -0,0 +1,132 @@
+package nas
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// First lockout after the bucket runs dry, doubled for each repeat offence
+	authBackoffBase = 30 * time.Second
+	authBackoffMax  = 1 * time.Hour
+
+	// Buckets untouched for this long are forgotten
+	authBucketIdleTime = 30 * time.Minute
+)
+
+type authBucket struct {
+	tokens       float64
+	lastUpdate   time.Time
+	strikes      int
+	blockedUntil time.Time
+}
+
+// authRateLimiter is a token bucket limiter keyed by IP address or console. A successful login
+// resets the console's bucket but not the address's, so failed attempts made from one address
+// between successful logins still add up.
+type authRateLimiter struct {
+	mutex    sync.Mutex
+	buckets  map[string]*authBucket
+	capacity float64
+	refill   float64 // Tokens per second
+}
+
+var authLimiter *authRateLimiter
+
+func newAuthRateLimiter(attemptsPerMinute int) *authRateLimiter {
+	return &authRateLimiter{
+		buckets:  map[string]*authBucket{},
+		capacity: float64(attemptsPerMinute),
+		refill:   float64(attemptsPerMinute) / 60,
+	}
+}
+
+// allow takes a token for the key. If the key is throttled, returns false and how long until it may retry.
+func (l *authRateLimiter) allow(key string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+
+	bucket := l.buckets[key]
+	if bucket == nil {
+		bucket = &authBucket{tokens: l.capacity, lastUpdate: now}
+		l.buckets[key] = bucket
+	}
+
+	if now.Before(bucket.blockedUntil) {
+		return false, bucket.blockedUntil.Sub(now)
+	}
+
+	bucket.tokens = min(l.capacity, bucket.tokens+now.Sub(bucket.lastUpdate).Seconds()*l.refill)
+	bucket.lastUpdate = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	// Out of tokens, lock the key out for exponentially longer each time
+	backoff := authBackoffMax
+	if bucket.strikes < 16 {
+		backoff = min(authBackoffMax, authBackoffBase<<bucket.strikes)
+	}
+
+	bucket.strikes++
+	bucket.blockedUntil = now.Add(backoff)
+	return false, backoff
+}
+
+// reset forgets the key, used for the console after a successful login
+func (l *authRateLimiter) reset(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.buckets, key)
+}
+
+// cleanup removes buckets that have been idle for a while and are no longer blocked
+func (l *authRateLimiter) cleanup() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.lastUpdate) > authBucketIdleTime && now.After(bucket.blockedUntil) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *authRateLimiter) startCleanup(stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				l.cleanup()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// getRateLimitIP returns the key for the client's IP address, or an empty string if the address
+// should not be limited. Requests forwarded by the local HTTPS proxy are limited by the address of
+// the client, only requests actually made from the host itself are left alone.
+func getRateLimitIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	if ip := net.ParseIP(host); ip == nil || ip.IsLoopback() {
+		return ""
+	}
+
+	return "ip:" + host
+}
@@ -0,0 +1,132 @@
+package nas
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"wwfc/common"
+	"wwfc/database"
+)
+
+func TestAuthRateLimiter(t *testing.T) {
+	limiter := newAuthRateLimiter(3)
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.allow("ip:192.0.2.1"); !allowed {
+			t.Fatalf("attempt %d was throttled", i+1)
+		}
+	}
+
+	allowed, retryAfter := limiter.allow("ip:192.0.2.1")
+	if allowed || retryAfter != authBackoffBase {
+		t.Fatalf("got %v %v after the bucket ran dry", allowed, retryAfter)
+	}
+	if allowed, _ := limiter.allow("ip:192.0.2.2"); !allowed {
+		t.Error("another address was throttled")
+	}
+
+	// The next lockout is twice as long
+	limiter.buckets["ip:192.0.2.1"].blockedUntil = time.Now()
+	if allowed, retryAfter := limiter.allow("ip:192.0.2.1"); allowed || retryAfter != 2*authBackoffBase {
+		t.Errorf("got %v %v for a repeat offence", allowed, retryAfter)
+	}
+}
+
+// testLogin sends a NAS login from the address and returns the status and return code
+func testLogin(remoteAddr string, fields map[string]string) (int, string) {
+	form := url.Values{"action": {common.Base64DwcEncoding.EncodeToString([]byte("login"))}}
+	for key, value := range fields {
+		form.Set(key, common.Base64DwcEncoding.EncodeToString([]byte(value)))
+	}
+
+	request := httptest.NewRequest("POST", "/ac", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.RemoteAddr = remoteAddr
+	recorder := httptest.NewRecorder()
+	handleAuthRequest("TEST", recorder, request)
+
+	reply, _ := url.ParseQuery(strings.TrimSuffix(recorder.Body.String(), "\x00"))
+	returncd, _ := common.Base64DwcEncoding.DecodeString(reply.Get("returncd"))
+	return recorder.Code, string(returncd)
+}
+
+func TestAuthRateLimiterLogin(t *testing.T) {
+	fileStore, err := database.Connect(ctx, common.Config{DatabaseDriver: common.DatabaseDriverFile, DatabaseFile: filepath.Join(t.TempDir(), "database.gob")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldStore, oldLimiter := store, authLimiter
+	store, authLimiter = fileStore, newAuthRateLimiter(3)
+	t.Cleanup(func() {
+		store.Close()
+		store, authLimiter = oldStore, oldLimiter
+	})
+
+	fields := map[string]string{"gamecd": "RMCE", "userid": "1234567890123", "gsbrcd": "AB", "unitcd": "1", "cfc": "1234567890123456"}
+	for i := 0; i < 2; i++ {
+		if status, returncd := testLogin("192.0.2.1:1000", fields); status != http.StatusOK || returncd != "103" {
+			t.Fatalf("failed login returned %d %q", status, returncd)
+		}
+	}
+
+	fields["gsbrcd"] = "RMCJ"
+	if status, returncd := testLogin("192.0.2.1:1000", fields); status != http.StatusOK || returncd != "001" {
+		t.Fatalf("login returned %d %q", status, returncd)
+	}
+
+	// The console starts over after logging in, the address it logged in from doesn't
+	for i := 0; i < 3; i++ {
+		if status, _ := testLogin("198.51.100.1:1000", fields); status != http.StatusOK {
+			t.Fatalf("attempt %d after logging in got %d", i+1, status)
+		}
+	}
+	delete(fields, "cfc")
+	fields["userid"] = "1234567890124"
+	if status, _ := testLogin("192.0.2.1:1000", fields); status != http.StatusTooManyRequests {
+		t.Errorf("the address got %d after running out of attempts", status)
+	}
+}
+
+func TestProxiedClientAddr(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make(chan string, 2)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys <- getRateLimitIP(clientAddr(r))
+	})}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	// A request made directly from the host isn't limited
+	response, err := http.Get("http://" + listener.Addr().String() + "/ac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if key := <-keys; key != "" {
+		t.Errorf("got key %q for a local request", key)
+	}
+
+	// A request decrypted by the HTTPS proxy is limited by the console's address
+	clientEnd, proxyEnd := net.Pipe()
+	defer clientEnd.Close()
+	go proxyHTTP("NAS-TLS", &pipeConn{Conn: proxyEnd, remoteAddr: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 5), Port: 4000}}, listener.Addr().String())
+
+	clientEnd.Write([]byte("GET /ac HTTP/1.1\r\nHost: naswii.nintendowifi.net\r\nConnection: close\r\n\r\n"))
+	if _, err := http.ReadResponse(bufio.NewReader(clientEnd), nil); err != nil {
+		t.Fatal(err)
+	}
+	if key := <-keys; key != "ip:203.0.113.5" {
+		t.Errorf("got key %q for a proxied request", key)
+	}
+}
@@ -0,0 +1,155 @@
+package nas
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"wwfc/common"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+const (
+	// Longest response body and reason accepted from the auth webhook
+	maxWebhookResponse = 4096
+	maxWebhookReason   = 200
+
+	webhookDeniedMessage      = "This server is only open to approved players."
+	webhookUnavailableMessage = "The login server is unavailable. Please try again later."
+)
+
+// authWebhookRequest is the console's identity, sent to the auth webhook for each login
+type authWebhookRequest struct {
+	UserID     string `json:"userid"`
+	GsbrCode   string `json:"gsbrcd"`
+	GameCode   string `json:"gamecd"`
+	UnitCode   string `json:"unitcd"`
+	CFC        string `json:"cfc,omitempty"`
+	MACAddress string `json:"macadr,omitempty"`
+	Serial     string `json:"csnum,omitempty"`
+	DeviceName string `json:"devname,omitempty"`
+	InGameName string `json:"ingamesn,omitempty"`
+	IP         string `json:"ip"`
+}
+
+type authWebhookResponse struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+var (
+	// Empty if the webhook is disabled
+	authWebhookURL      string
+	authWebhookFailOpen bool
+	authWebhookClient   *http.Client
+)
+
+func setupAuthWebhook(config common.Config) {
+	authWebhookURL = config.NASAuthWebhook
+	authWebhookFailOpen = config.NASAuthWebhookFailure == common.AuthWebhookFailOpen
+	authWebhookClient = &http.Client{Timeout: time.Duration(*config.NASAuthWebhookTimeout) * time.Millisecond}
+
+	if authWebhookURL != "" {
+		logging.Notice("NAS", "Asking", aurora.BrightCyan(authWebhookURL), "to approve logins")
+	}
+}
+
+// checkAuthWebhook asks the auth webhook whether the console may log in. Returns the reason to
+// show on the console if it may not. Each login waits for its own request only, so a slow webhook
+// doesn't hold up the others. The webhook is sent the address of the console, not the one of the
+// HTTPS proxy.
+func checkAuthWebhook(r *http.Request, moduleName string, fields map[string]string) (bool, string) {
+	if authWebhookURL == "" {
+		return true, ""
+	}
+
+	remoteAddr := clientAddr(r)
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+
+	request := authWebhookRequest{
+		UserID:     fields["userid"],
+		GsbrCode:   fields["gsbrcd"],
+		GameCode:   fields["gamecd"],
+		UnitCode:   fields["unitcd"],
+		CFC:        fields["cfc"],
+		MACAddress: fields["macadr"],
+		Serial:     fields["csnum"],
+		DeviceName: fields["devname"],
+		InGameName: fields["ingamesn"],
+		IP:         ip,
+	}
+
+	started := time.Now()
+	response, err := callAuthWebhook(r.Context(), request)
+	if err != nil {
+		if authWebhookFailOpen {
+			logging.Error(moduleName, "Auth webhook failed, allowing the login:", err)
+			return true, ""
+		}
+
+		logging.Error(moduleName, "Auth webhook failed, rejecting the login:", err)
+		return false, webhookUnavailableMessage
+	}
+
+	if !response.Allow {
+		reason := strings.TrimSpace(response.Reason)
+		if reason == "" {
+			reason = webhookDeniedMessage
+		} else if len(reason) > maxWebhookReason {
+			reason = reason[:maxWebhookReason]
+		}
+
+		logging.Warn(moduleName, "Auth webhook rejected", aurora.Cyan(request.UserID), aurora.Cyan(request.GsbrCode), "after", aurora.Cyan(time.Since(started).Round(time.Millisecond)).String()+":", reason)
+		return false, reason
+	}
+
+	logging.Info(moduleName, "Auth webhook approved the login in", aurora.Cyan(time.Since(started).Round(time.Millisecond)))
+	return true, ""
+}
+
+func callAuthWebhook(ctx context.Context, request authWebhookRequest) (authWebhookResponse, error) {
+	var response authWebhookResponse
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return response, err
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, authWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return response, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+
+	httpResponse, err := authWebhookClient.Do(httpRequest)
+	if err != nil {
+		return response, err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return response, fmt.Errorf("status %s", httpResponse.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(httpResponse.Body, maxWebhookResponse+1))
+	if err != nil {
+		return response, err
+	}
+	if len(data) > maxWebhookResponse {
+		return response, errors.New("response too large")
+	}
+
+	err = json.Unmarshal(data, &response)
+	return response, err
+}
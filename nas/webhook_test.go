@@ -0,0 +1,88 @@
+package nas
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"wwfc/common"
+)
+
+func testAuthWebhook(t *testing.T, handler http.HandlerFunc, failure string) {
+	server := httptest.NewServer(handler)
+	timeout := 100
+	setupAuthWebhook(common.Config{NASAuthWebhook: server.URL, NASAuthWebhookTimeout: &timeout, NASAuthWebhookFailure: failure})
+
+	t.Cleanup(func() {
+		server.Close()
+		authWebhookURL = ""
+	})
+}
+
+func TestAuthWebhook(t *testing.T) {
+	fields := map[string]string{"userid": "1234567890123", "gsbrcd": "RMCJ", "gamecd": "RMCJ", "unitcd": "1", "cfc": "1234567890123456"}
+
+	var received authWebhookRequest
+	testAuthWebhook(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		if received.CFC == "1234567890123456" {
+			w.Write([]byte(`{"allow": true}`))
+		} else {
+			w.Write([]byte(`{"allow": false, "reason": "Supporters only"}`))
+		}
+	}, common.AuthWebhookFailClosed)
+
+	if allowed, _ := checkAuthWebhook(httptest.NewRequest("POST", "/ac", nil), "TEST", fields); !allowed {
+		t.Error("approved login was rejected")
+	}
+	if received.UserID != "1234567890123" || received.GsbrCode != "RMCJ" || received.IP != "192.0.2.1" {
+		t.Errorf("webhook was sent %+v", received)
+	}
+
+	// A login decrypted by the HTTPS proxy sends the console's address
+	request := httptest.NewRequest("POST", "/ac", nil)
+	proxiedClients.Store(request.RemoteAddr, "203.0.113.5:4000")
+	t.Cleanup(func() { proxiedClients.Delete(request.RemoteAddr) })
+	if allowed, _ := checkAuthWebhook(request, "TEST", fields); !allowed || received.IP != "203.0.113.5" {
+		t.Errorf("proxied login sent the address %q", received.IP)
+	}
+
+	fields["cfc"] = "1"
+	if allowed, reason := checkAuthWebhook(httptest.NewRequest("POST", "/ac", nil), "TEST", fields); allowed || reason != "Supporters only" {
+		t.Errorf("rejected login returned %v %q", allowed, reason)
+	}
+}
+
+func TestAuthWebhookFailure(t *testing.T) {
+	fields := map[string]string{"userid": "1234567890123", "gsbrcd": "RMCJ"}
+	failing := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(300 * time.Millisecond):
+		}
+		w.Write([]byte(`{"allow": true}`))
+	}
+
+	testAuthWebhook(t, failing, common.AuthWebhookFailOpen)
+	if allowed, _ := checkAuthWebhook(httptest.NewRequest("POST", "/ac", nil), "TEST", fields); !allowed {
+		t.Error("failed webhook rejected the login with fail open")
+	}
+
+	testAuthWebhook(t, failing, common.AuthWebhookFailClosed)
+	if allowed, reason := checkAuthWebhook(httptest.NewRequest("POST", "/ac", nil), "TEST", fields); allowed || reason != webhookUnavailableMessage {
+		t.Errorf("failed webhook with fail closed returned %v %q", allowed, reason)
+	}
+
+	testAuthWebhook(t, slow, common.AuthWebhookFailClosed)
+	started := time.Now()
+	if allowed, _ := checkAuthWebhook(httptest.NewRequest("POST", "/ac", nil), "TEST", fields); allowed {
+		t.Error("timed out webhook allowed the login with fail closed")
+	}
+	if time.Since(started) > 250*time.Millisecond {
+		t.Error("the webhook timeout wasn't applied")
+	}
+}
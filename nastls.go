@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net"
+	"time"
+	"wwfc/nas"
+)
+
+// Decrypts the HTTPS connections to NAS when the frontend terminates TLS, nil otherwise
+var tlsTerminator *nas.TLSTerminator
+
+// handleTLSConnection does the TLS handshake for a client before forwarding its decrypted data to the backend
+func handleTLSConnection(server serverInfo, conn net.Conn, index uint64) {
+	tlsConn, err := tlsTerminator.Handshake("NAS-TLS:"+conn.RemoteAddr().String(), conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	// After the handshake, idle connections are closed by the read and idle timeouts of the backend's
+	// NAS HTTP server, which the decrypted data is piped to
+	tlsConn.SetDeadline(time.Time{})
+	handleConnection(server, tlsConn, index)
+}
@@ -26,6 +26,18 @@ func (session *NATNEGSession) sendConnectRequests(moduleName string) {
 			}
 
 			logging.Notice(moduleName, "Exchange connect requests between", aurora.BrightCyan(id), "and", aurora.BrightCyan(destID))
+
+			sender.RelayIP = ""
+			destination.RelayIP = ""
+			if shouldRelay(sender, destination) {
+				if err := startRelay(moduleName, sender, destination); err != nil {
+					logging.Error(moduleName, "Failed to start relay:", err)
+				}
+			}
+
+			// Each pairing gets the full timeout
+			session.Started = time.Now()
+
 			sender.ConnectingIndex = destID
 			sender.ConnectAck = false
 			destination.ConnectingIndex = id
@@ -60,10 +72,16 @@ func (session *NATNEGSession) sendConnectRequests(moduleName string) {
 	}
 }
 
+// sendConnectRequestPacket tells the destination to connect to the client, or to its relay port if relayed
 func (client *NATNEGClient) sendConnectRequestPacket(conn net.PacketConn, destination *NATNEGClient, version byte) {
+	address := client.ServerIP
+	if destination.RelayIP != "" {
+		address = destination.RelayIP
+	}
+
 	connectHeader := createPacketHeader(version, NNConnectRequest, destination.Cookie)
-	connectHeader = append(connectHeader, common.IPFormatBytes(client.ServerIP)...)
-	_, port := common.IPFormatToInt(client.ServerIP)
+	connectHeader = append(connectHeader, common.IPFormatBytes(address)...)
+	_, port := common.IPFormatToInt(address)
 	connectHeader = binary.BigEndian.AppendUint16(connectHeader, port)
 	// Two bytes: "gotyourdata" and "finished"
 	connectHeader = append(connectHeader, 0x42, 0x00)
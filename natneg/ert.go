@@ -0,0 +1,58 @@
+package natneg
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"wwfc/common"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+var (
+	ertProbes atomic.Uint64
+	ertAcks   atomic.Uint64
+)
+
+// handleAddressCheck tells the client the public address its packet came from
+func handleAddressCheck(conn net.PacketConn, addr net.Addr, buffer []byte, moduleName string, version byte, cookie uint32) {
+	if len(buffer) < 9 {
+		logging.Error(moduleName, "Invalid packet size")
+		return
+	}
+
+	reply := createPacketHeader(version, NNAddressCheckReply, cookie)
+	reply = append(reply, buffer[:3]...)
+	reply = append(reply, common.IPFormatBytes(addr.String())...)
+	_, port := common.IPFormatToInt(addr.String())
+	reply = binary.BigEndian.AppendUint16(reply, port)
+	conn.WriteTo(reply, addr)
+}
+
+// handleNatify answers a NAT detection request with an ERT probe. The client's NAT type depends on
+// which probes reach it: for NATNEG1 the probe comes from the secondary address, which the client
+// has never sent anything to, so only clients without a NAT or behind a full cone receive it.
+func handleNatify(conn net.PacketConn, addr net.Addr, buffer []byte, moduleName string, version byte, cookie uint32) {
+	if len(buffer) < 9 {
+		logging.Error(moduleName, "Invalid packet size")
+		return
+	}
+
+	portType := buffer[0]
+
+	probe := createPacketHeader(version, NNErtTestRequest, cookie)
+	probe = append(probe, buffer[:9]...)
+
+	sender := conn
+	if portType == PortTypeNATNEG1 {
+		if secondaryConn == nil {
+			logging.Info(moduleName, "No secondary address configured, not sending ERT probe for", aurora.Cyan(getPortTypeName(portType)))
+			return
+		}
+		sender = secondaryConn
+	}
+
+	ertProbes.Add(1)
+	sender.WriteTo(probe, addr)
+}
@@ -0,0 +1,49 @@
+package natneg
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadReportEnum(t *testing.T) {
+	if natType := readReportEnum([]byte{0, 0, 0, NATTypeSymmetric}); natType != NATTypeSymmetric {
+		t.Errorf("big endian NAT type read as %d", natType)
+	}
+
+	if natType := readReportEnum([]byte{NATTypeSymmetric, 0, 0, 0}); natType != NATTypeSymmetric {
+		t.Errorf("little endian NAT type read as %d", natType)
+	}
+}
+
+func TestAddressCheck(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	request := []byte{PortTypeNATNEG1, 0, 0, 0, 0, 0, 0, 0, 0}
+	handleAddressCheck(server, client.LocalAddr(), request, "NATNEG:test", 3, 0x12345678)
+
+	buffer := make([]byte, 64)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := client.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := client.LocalAddr().(*net.UDPAddr).Port
+	expected := createPacketHeader(3, NNAddressCheckReply, 0x12345678)
+	expected = append(expected, PortTypeNATNEG1, 0, 0, 127, 0, 0, 1, byte(port>>8), byte(port))
+	if !bytes.Equal(buffer[:n], expected) {
+		t.Errorf("got reply % x, expected % x", buffer[:n], expected)
+	}
+}
@@ -2,14 +2,18 @@ package natneg
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 	"wwfc/common"
+	"wwfc/database"
 	"wwfc/logging"
 
 	"github.com/logrusorgru/aurora/v3"
@@ -64,6 +68,10 @@ type NATNEGSession struct {
 	Cookie  uint32
 	mutex   sync.RWMutex
 	Clients map[byte]*NATNEGClient
+
+	// When the session was created or its last pairing began, it's discarded once this is longer
+	// than the pairing timeout ago
+	Started time.Time
 }
 
 type NATNEGClient struct {
@@ -76,13 +84,22 @@ type NATNEGClient struct {
 	LocalIP         string
 	ServerIP        string
 	GameName        string
+
+	// Relay address the client was told to connect to instead of its peer, if in the relay phase
+	RelayIP string
 }
 
 var (
+	ctx   = context.Background()
+	store database.Store
+
 	sessions   = map[uint32]*NATNEGSession{}
 	mutex      = sync.RWMutex{}
 	natnegConn net.PacketConn
 
+	// Sends ERT probes from a second IP, nil if not configured
+	secondaryConn net.PacketConn
+
 	inShutdown = false
 	waitGroup  = sync.WaitGroup{}
 )
@@ -90,8 +107,17 @@ var (
 func StartServer(reload bool) {
 	// Get config
 	config := common.GetConfig()
+	loadRelayConfig(config)
+	pairingTimeout = time.Duration(*config.NATNEGPairingTimeout) * time.Second
 
-	address := *config.GameSpyAddress + ":27901"
+	// Start SQL
+	var err error
+	store, err = database.Connect(ctx, config)
+	if err != nil {
+		panic(err)
+	}
+
+	address := net.JoinHostPort(config.GetServerAddress("natneg"), strconv.Itoa(config.GetServerPort("natneg")))
 	conn, err := net.ListenPacket("udp", address)
 	if err != nil {
 		panic(err)
@@ -100,6 +126,17 @@ func StartServer(reload bool) {
 	natnegConn = conn
 	inShutdown = false
 
+	secondaryConn = nil
+	if config.NATNEGSecondaryAddress != "" {
+		secondaryConn, err = net.ListenPacket("udp", config.NATNEGSecondaryAddress)
+		if err != nil {
+			panic(err)
+		}
+
+		waitGroup.Add(1)
+		go listen(secondaryConn)
+	}
+
 	if reload {
 		// Load state
 		file, err := os.Open("state/natneg_sessions.gob")
@@ -116,47 +153,51 @@ func StartServer(reload bool) {
 			panic(err)
 		}
 
-		for _, session := range sessions {
-			cur := session
-			time.AfterFunc(30*time.Second, func() {
-				closeSession("NATNEG:"+fmt.Sprintf("%08x", cur.Cookie), cur)
-			})
-		}
-
 		logging.Notice("NATNEG", "Loaded", aurora.Cyan(len(sessions)), "sessions")
 	}
 
+	startReaper()
+
 	waitGroup.Add(1)
+	go listen(conn)
+}
 
-	go func() {
-		defer waitGroup.Done()
+// listen handles packets on the connection until shutdown. Expects the wait group to already be incremented.
+func listen(conn net.PacketConn) {
+	defer waitGroup.Done()
 
-		// Close the listener when the application closes.
-		defer conn.Close()
-		logging.Notice("NATNEG", "Listening on", aurora.BrightCyan(address))
+	// Close the listener when the application closes.
+	defer conn.Close()
+	logging.Notice("NATNEG", "Listening on", aurora.BrightCyan(conn.LocalAddr().String()))
 
-		for {
-			if inShutdown {
-				return
-			}
+	for {
+		if inShutdown {
+			return
+		}
 
-			buffer := make([]byte, 1024)
-			size, addr, err := conn.ReadFrom(buffer)
-			if err != nil {
-				continue
-			}
+		buffer := make([]byte, 1024)
+		size, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			continue
+		}
 
-			waitGroup.Add(1)
+		waitGroup.Add(1)
 
-			go handleConnection(conn, addr, buffer[:size])
-		}
-	}()
+		go handleConnection(conn, addr, buffer[:size])
+	}
 }
 
 func Shutdown() {
 	inShutdown = true
-	natnegConn.Close()
+	stopReaping()
+	if natnegConn != nil {
+		natnegConn.Close()
+	}
+	if secondaryConn != nil {
+		secondaryConn.Close()
+	}
 	waitGroup.Wait()
+	closeRelays()
 
 	// Save state
 	mutex.Lock()
@@ -184,7 +225,7 @@ func handleConnection(conn net.PacketConn, addr net.Addr, buffer []byte) {
 
 	// Validate the packet magic
 	if len(buffer) < 12 || !bytes.Equal(buffer[:6], []byte{0xfd, 0xfc, 0x1e, 0x66, 0x6a, 0xb2}) {
-		logging.Error("NATNEG:"+addr.String(), "Invalid packet header")
+		logging.Info("NATNEG:"+addr.String(), "Invalid packet header:", hex.EncodeToString(buffer))
 		return
 	}
 
@@ -202,7 +243,7 @@ func handleConnection(conn net.PacketConn, addr net.Addr, buffer []byte) {
 
 	var session *NATNEGSession
 
-	if command != NNNatifyRequest && command != NNAddressCheckRequest {
+	if command != NNNatifyRequest && command != NNAddressCheckRequest && command != NNErtTestReply {
 		mutex.Lock()
 		var exists bool
 		session, exists = sessions[cookie]
@@ -214,13 +255,9 @@ func handleConnection(conn net.PacketConn, addr net.Addr, buffer []byte) {
 				Cookie:  cookie,
 				mutex:   sync.RWMutex{},
 				Clients: map[byte]*NATNEGClient{},
+				Started: time.Now(),
 			}
 			sessions[cookie] = session
-
-			// Session has TTL of 30 seconds
-			time.AfterFunc(30*time.Second, func() {
-				closeSession(moduleName, session)
-			})
 		}
 		mutex.Unlock()
 
@@ -235,7 +272,7 @@ func handleConnection(conn net.PacketConn, addr net.Addr, buffer []byte) {
 
 	switch command {
 	default:
-		logging.Error(moduleName, "Received unknown command type:", aurora.Cyan(command))
+		logging.Info(moduleName, "Received unknown command type:", aurora.Cyan(command), hex.EncodeToString(buffer))
 
 	case NNInitRequest:
 		// logging.Info(moduleName, "Command:", aurora.Yellow("NN_INIT"))
@@ -253,6 +290,7 @@ func handleConnection(conn net.PacketConn, addr net.Addr, buffer []byte) {
 
 	case NNErtTestReply:
 		logging.Info(moduleName, "Command:", aurora.Yellow("NN_ERTACK"))
+		ertAcks.Add(1)
 
 	case NNStateUpdate:
 		logging.Info(moduleName, "Command:", aurora.Yellow("NN_STATEUPDATE"))
@@ -275,12 +313,14 @@ func handleConnection(conn net.PacketConn, addr net.Addr, buffer []byte) {
 
 	case NNAddressCheckRequest:
 		logging.Info(moduleName, "Command:", aurora.Yellow("NN_ADDRESS_CHECK"))
+		handleAddressCheck(conn, addr, buffer[12:], moduleName, version, cookie)
 
 	case NNAddressCheckReply:
 		logging.Warn(moduleName, "Received server command:", aurora.Yellow("NN_ADDRESS_REPLY"))
 
 	case NNNatifyRequest:
 		logging.Info(moduleName, "Command:", aurora.Yellow("NN_NATIFY_REQUEST"))
+		handleNatify(conn, addr, buffer[12:], moduleName, version, cookie)
 
 	case NNReportRequest:
 		// logging.Info(moduleName, "Command:", aurora.Yellow("NN_REPORT"))
@@ -298,43 +338,6 @@ func handleConnection(conn net.PacketConn, addr net.Addr, buffer []byte) {
 	}
 }
 
-func closeSession(moduleName string, session *NATNEGSession) {
-	mutex.Lock()
-	if inShutdown {
-		mutex.Unlock()
-		return
-	}
-
-	session.Open = false
-	delete(sessions, session.Cookie)
-	mutex.Unlock()
-
-	session.mutex.Lock()
-	defer session.mutex.Unlock()
-
-	// Disconnect each client
-	for _, client := range session.Clients {
-		if client.ConnectingIndex == client.Index {
-			continue
-		}
-
-		logging.Info("NATNEG", "Disconnecting client", aurora.Cyan(client.Index))
-		// Send report ack, which will cause the client to cancel
-		reportAck := createPacketHeader(session.Version, NNReportReply, session.Cookie)
-		reportAck = append(reportAck, 0x00, client.Index, 0x00)
-		reportAck = append(reportAck, 0x00, 0x00, 0x00, 0x06, 0x00, 0x00)
-
-		addr, err := net.ResolveUDPAddr("udp", client.NegotiateIP)
-		if err != nil {
-			panic(err)
-		}
-
-		natnegConn.WriteTo(reportAck, addr)
-	}
-
-	logging.Info("NATNEG", "Deleted session")
-}
-
 func getPortTypeName(portType byte) string {
 	switch portType {
 	default:
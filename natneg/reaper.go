@@ -0,0 +1,160 @@
+package natneg
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+const reaperInterval = time.Second
+
+// Values of the finished byte of a CONNECT packet, anything but 0 makes the client give up
+const (
+	finishedErrorDeadbeatPartner = 0x01
+	finishedErrorInitTimedOut    = 0x02
+)
+
+var (
+	// A pairing that hasn't finished within this time is discarded
+	pairingTimeout = 30 * time.Second
+
+	// Pairings discarded with a client still waiting since the backend started
+	timedOutPairings atomic.Uint64
+
+	reaperMutex sync.Mutex
+	// nil while the reaper isn't running
+	stopReaper chan struct{}
+)
+
+func startReaper() {
+	reaperMutex.Lock()
+	defer reaperMutex.Unlock()
+
+	if stopReaper != nil {
+		return
+	}
+	stopReaper = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(reaperInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				reapSessions(now)
+				reapPairFailures(now)
+			}
+		}
+	}(stopReaper)
+}
+
+// stopReaping stops the reaper if it's running, so Shutdown can be called without StartServer
+// having got that far, or twice
+func stopReaping() {
+	reaperMutex.Lock()
+	defer reaperMutex.Unlock()
+
+	if stopReaper != nil {
+		close(stopReaper)
+		stopReaper = nil
+	}
+}
+
+// reapSessions discards the sessions whose current pairing started longer than the timeout ago,
+// and tells the clients still waiting on them to give up. Returns the number of sessions where a
+// client was still waiting.
+func reapSessions(now time.Time) int {
+	cutoff := now.Add(-pairingTimeout)
+
+	mutex.Lock()
+	var expired []*NATNEGSession
+	for cookie, session := range sessions {
+		session.mutex.RLock()
+		started := session.Started
+		session.mutex.RUnlock()
+
+		if started.After(cutoff) {
+			continue
+		}
+
+		session.Open = false
+		delete(sessions, cookie)
+		expired = append(expired, session)
+	}
+	mutex.Unlock()
+
+	timedOut := 0
+	for _, session := range expired {
+		if session.timeOut() {
+			timedOut++
+		}
+	}
+
+	timedOutPairings.Add(uint64(timedOut))
+	return timedOut
+}
+
+// timeOut sends a failed CONNECT to each client of a discarded session that hasn't finished its
+// pairing, so the game stops waiting for its peer. Returns false if every client had finished.
+func (session *NATNEGSession) timeOut() bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	var waiting []*NATNEGClient
+	var peers []string
+	for _, client := range session.Clients {
+		if client.NegotiateIP != "" {
+			peers = append(peers, client.NegotiateIP)
+		}
+		if client.ConnectingIndex != client.Index || len(client.Result) == 0 {
+			waiting = append(waiting, client)
+		}
+	}
+
+	if len(waiting) == 0 {
+		return false
+	}
+
+	sort.Strings(peers)
+	for len(peers) < 2 {
+		peers = append(peers, "none")
+	}
+
+	moduleName := "NATNEG:" + fmt.Sprintf("%08x", session.Cookie)
+	logging.Notice(moduleName, "Pairing timed out after", aurora.Cyan(pairingTimeout), "peers:", aurora.BrightCyan(strings.Join(peers, ", ")))
+
+	for _, client := range waiting {
+		if client.NegotiateIP == "" {
+			continue
+		}
+
+		// A mapped client was left waiting by its peer, any other didn't finish its own init
+		finished := byte(finishedErrorInitTimedOut)
+		if client.isMapped() {
+			finished = finishedErrorDeadbeatPartner
+		}
+
+		addr, err := net.ResolveUDPAddr("udp", client.NegotiateIP)
+		if err != nil {
+			continue
+		}
+
+		packet := createPacketHeader(session.Version, NNConnectRequest, session.Cookie)
+		packet = append(packet, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
+		// Two bytes: "gotyourdata" and "finished"
+		packet = append(packet, 0x00, finished)
+		natnegConn.WriteTo(packet, addr)
+	}
+
+	return true
+}
@@ -0,0 +1,81 @@
+package natneg
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReapSessions(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	waiting, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer waiting.Close()
+
+	oldConn := natnegConn
+	natnegConn = conn
+	t.Cleanup(func() {
+		natnegConn = oldConn
+		sessions = map[uint32]*NATNEGSession{}
+	})
+
+	now := time.Now()
+	address := waiting.LocalAddr().String()
+	sessions = map[uint32]*NATNEGSession{
+		// Mapped, but its peer never sent an init
+		1: {Open: true, Cookie: 1, Started: now.Add(-time.Minute), Clients: map[byte]*NATNEGClient{
+			0: {Cookie: 1, Index: 0, ConnectingIndex: 0, Result: map[byte]byte{}, NegotiateIP: address, ServerIP: address},
+		}},
+		// Both reported, nobody is waiting
+		2: {Open: true, Cookie: 2, Started: now.Add(-time.Minute), Clients: map[byte]*NATNEGClient{
+			0: {Cookie: 2, Index: 0, ConnectingIndex: 0, Result: map[byte]byte{1: 1}, NegotiateIP: "127.0.0.1:1", ServerIP: "127.0.0.1:1"},
+			1: {Cookie: 2, Index: 1, ConnectingIndex: 1, Result: map[byte]byte{0: 1}, NegotiateIP: "127.0.0.1:2", ServerIP: "127.0.0.1:2"},
+		}},
+		// Still within the timeout
+		3: {Open: true, Cookie: 3, Started: now, Clients: map[byte]*NATNEGClient{
+			0: {Cookie: 3, Index: 0, ConnectingIndex: 0, Result: map[byte]byte{}, NegotiateIP: address, ServerIP: address},
+		}},
+	}
+	expired := sessions[1]
+
+	if timedOut := reapSessions(now); timedOut != 1 {
+		t.Errorf("%d pairings timed out, expected 1", timedOut)
+	}
+	if len(sessions) != 1 || sessions[3] == nil {
+		t.Errorf("unexpected sessions left: %v", sessions)
+	}
+	if expired.Open {
+		t.Error("discarded session is still open")
+	}
+
+	waiting.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, 64)
+	n, _, err := waiting.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal("waiting client wasn't told:", err)
+	}
+	if n != 20 || buffer[7] != NNConnectRequest || buffer[11] != 1 || buffer[19] != finishedErrorDeadbeatPartner {
+		t.Errorf("unexpected packet: % x", buffer[:n])
+	}
+}
+
+func TestStopReaping(t *testing.T) {
+	// Not started
+	stopReaping()
+
+	startReaper()
+	startReaper()
+	stopReaping()
+	stopReaping()
+
+	if stopReaper != nil {
+		t.Error("reaper still running")
+	}
+}
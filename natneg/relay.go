@@ -0,0 +1,344 @@
+package natneg
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wwfc/common"
+	"wwfc/inspect"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// Relay settings, loaded in StartServer. An empty relay address disables the relay.
+var (
+	relayAddress       string
+	relayBindAddress   string
+	relayAfterFailures int
+	relayRate          int
+	relayMaxBytes      uint64
+	relayTimeout       time.Duration
+
+	// Shared by every relay
+	relayBandwidth *byteBucket
+)
+
+var (
+	relayMutex = sync.Mutex{}
+	relays     = map[*relay]bool{}
+
+	// Direct NATNEG failures per pair of public IPs, reset on success and forgotten by the reaper
+	// once the pair hasn't failed for pairFailureTimeout
+	pairFailures = map[string]*pairFailure{}
+
+	relaysCreated atomic.Uint64
+	relayedBytes  atomic.Uint64
+	relayDropped  atomic.Uint64
+)
+
+const pairFailureTimeout = 30 * time.Minute
+
+type pairFailure struct {
+	count    int
+	lastFail time.Time
+}
+
+type RelayStats struct {
+	Active  int    `json:"active"`
+	Created uint64 `json:"created"`
+	Bytes   uint64 `json:"bytes"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// relay forwards datagrams between two clients that couldn't connect directly. Each client is
+// sent a CONNECT pointing at its own relay port, and whatever arrives on one port from that
+// client's IP is sent out of the other port to the peer.
+type relay struct {
+	moduleName string
+	gameName   string
+	conns      [2]net.PacketConn
+	ports      [2]int
+	expectedIP [2]string
+
+	peerMutex sync.Mutex
+	peers     [2]net.Addr
+
+	bucket     *byteBucket
+	bytes      atomic.Uint64
+	lastActive atomic.Int64
+	closeOnce  sync.Once
+}
+
+// byteBucket is a token bucket counted in bytes, refilled every second up to the rate
+type byteBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newByteBucket(rate int) *byteBucket {
+	return &byteBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (b *byteBucket) take(n int, now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens < float64(n) {
+		return false
+	}
+
+	b.tokens -= float64(n)
+	return true
+}
+
+func loadRelayConfig(config common.Config) {
+	relayAddress = config.NATNEGRelayAddress
+	relayBindAddress = *config.GameSpyAddress
+	relayAfterFailures = *config.NATNEGRelayAfterFailures
+	relayRate = *config.NATNEGRelayRate
+	relayMaxBytes = uint64(*config.NATNEGRelayMaxBytes)
+	relayTimeout = time.Duration(*config.NATNEGRelayTimeout) * time.Second
+
+	relayBandwidth = nil
+	if config.NATNEGRelayBandwidth > 0 {
+		relayBandwidth = newByteBucket(config.NATNEGRelayBandwidth)
+	}
+
+	if relayAddress == "" {
+		return
+	}
+
+	// CONNECT packets only carry an IPv4 address
+	if ip := net.ParseIP(relayAddress); ip == nil || ip.To4() == nil {
+		logging.Error("NATNEG", "Relay address", aurora.BrightCyan(relayAddress), "is not an IPv4 address, relay disabled")
+		relayAddress = ""
+		return
+	}
+
+	// Each relay needs two ports from the shared range
+	if common.UDPPorts.Size() < 2 {
+		logging.Error("NATNEG", "The UDP port range has fewer than two ports, relay disabled")
+		relayAddress = ""
+	}
+}
+
+// GetRelayStats returns the relay counters for the stats API
+func GetRelayStats() RelayStats {
+	relayMutex.Lock()
+	active := len(relays)
+	relayMutex.Unlock()
+
+	return RelayStats{
+		Active:  active,
+		Created: relaysCreated.Load(),
+		Bytes:   relayedBytes.Load(),
+		Dropped: relayDropped.Load(),
+	}
+}
+
+func pairKey(ip1, ip2 string) string {
+	host1, _, _ := net.SplitHostPort(ip1)
+	host2, _, _ := net.SplitHostPort(ip2)
+	if host1 > host2 {
+		host1, host2 = host2, host1
+	}
+
+	return host1 + "/" + host2
+}
+
+// shouldRelay checks if the pair has failed direct negotiation enough times to use the relay
+func shouldRelay(sender *NATNEGClient, destination *NATNEGClient) bool {
+	if relayAddress == "" {
+		return false
+	}
+
+	relayMutex.Lock()
+	defer relayMutex.Unlock()
+
+	failure := pairFailures[pairKey(sender.ServerIP, destination.ServerIP)]
+	return failure != nil && failure.count >= relayAfterFailures
+}
+
+// recordNegotiationResult tracks direct connection failures between a pair of clients
+func recordNegotiationResult(sender *NATNEGClient, destination *NATNEGClient, success bool) {
+	if relayAddress == "" {
+		return
+	}
+
+	key := pairKey(sender.ServerIP, destination.ServerIP)
+
+	relayMutex.Lock()
+	defer relayMutex.Unlock()
+
+	if success {
+		delete(pairFailures, key)
+		return
+	}
+
+	failure := pairFailures[key]
+	if failure == nil {
+		failure = &pairFailure{}
+		pairFailures[key] = failure
+	}
+	failure.count++
+	failure.lastFail = time.Now()
+}
+
+// reapPairFailures forgets the pairs that haven't failed for pairFailureTimeout, they have most
+// likely stopped playing together
+func reapPairFailures(now time.Time) {
+	relayMutex.Lock()
+	defer relayMutex.Unlock()
+
+	for key, failure := range pairFailures {
+		if now.Sub(failure.lastFail) > pairFailureTimeout {
+			delete(pairFailures, key)
+		}
+	}
+}
+
+// startRelay allocates a relay for the two clients and sets the address each of them should connect to
+func startRelay(moduleName string, sender *NATNEGClient, destination *NATNEGClient) error {
+	r := &relay{
+		moduleName: moduleName,
+		gameName:   sender.GameName,
+		bucket:     newByteBucket(relayRate),
+	}
+	r.expectedIP[0], _, _ = net.SplitHostPort(sender.ServerIP)
+	r.expectedIP[1], _, _ = net.SplitHostPort(destination.ServerIP)
+	r.lastActive.Store(time.Now().UnixNano())
+
+	for i := range r.conns {
+		conn, port, err := common.UDPPorts.ListenUDP(relayBindAddress)
+		if err != nil {
+			if i == 1 {
+				r.conns[0].Close()
+				common.UDPPorts.Release(r.ports[0])
+			}
+			return err
+		}
+
+		r.conns[i] = conn
+		r.ports[i] = port
+	}
+
+	relayMutex.Lock()
+	relays[r] = true
+	relayMutex.Unlock()
+
+	relaysCreated.Add(1)
+
+	sender.RelayIP = net.JoinHostPort(relayAddress, strconv.Itoa(r.ports[0]))
+	destination.RelayIP = net.JoinHostPort(relayAddress, strconv.Itoa(r.ports[1]))
+
+	logging.Notice(moduleName, "Relaying", aurora.BrightCyan(sender.ServerIP), "via", aurora.Cyan(r.ports[0]), "and", aurora.BrightCyan(destination.ServerIP), "via", aurora.Cyan(r.ports[1]))
+
+	go r.forward(0)
+	go r.forward(1)
+	return nil
+}
+
+// forward reads from one side of the relay and writes to the other until the relay is closed
+func (r *relay) forward(side int) {
+	defer r.close()
+
+	other := 1 - side
+	buffer := make([]byte, 2048)
+
+	for {
+		r.conns[side].SetReadDeadline(time.Now().Add(relayTimeout))
+		n, addr, err := r.conns[side].ReadFrom(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				last := time.Unix(0, r.lastActive.Load())
+				if time.Since(last) < relayTimeout {
+					continue
+				}
+				logging.Info(r.moduleName, "Relay timed out after", aurora.Cyan(r.bytes.Load()), "bytes")
+			}
+			return
+		}
+
+		// Only the client this port was handed to may use it
+		host, _, _ := net.SplitHostPort(addr.String())
+		if host != r.expectedIP[side] {
+			relayDropped.Add(1)
+			continue
+		}
+
+		now := time.Now()
+		r.lastActive.Store(now.UnixNano())
+
+		r.peerMutex.Lock()
+		r.peers[side] = addr
+		peer := r.peers[other]
+		r.peerMutex.Unlock()
+
+		if peer == nil {
+			// The other client hasn't sent anything yet, so its mapped port is unknown
+			continue
+		}
+
+		if !inspect.Inspect(r.moduleName, inspect.Payload{
+			Target:  inspect.TargetRelay,
+			Game:    r.gameName,
+			Command: -1,
+			Data:    buffer[:n],
+			Address: addr.String(),
+		}) {
+			relayDropped.Add(1)
+			continue
+		}
+
+		if !r.bucket.take(n, now) || (relayBandwidth != nil && !relayBandwidth.take(n, now)) {
+			relayDropped.Add(1)
+			continue
+		}
+
+		if r.bytes.Add(uint64(n)) > relayMaxBytes {
+			logging.Warn(r.moduleName, "Relay reached the byte limit, closing")
+			return
+		}
+		relayedBytes.Add(uint64(n))
+
+		r.conns[other].WriteTo(buffer[:n], peer)
+	}
+}
+
+func (r *relay) close() {
+	r.closeOnce.Do(func() {
+		r.conns[0].Close()
+		r.conns[1].Close()
+
+		common.UDPPorts.Release(r.ports[0])
+		common.UDPPorts.Release(r.ports[1])
+
+		relayMutex.Lock()
+		delete(relays, r)
+		relayMutex.Unlock()
+	})
+}
+
+// closeRelays closes every active relay, they can't be carried over a backend reload
+func closeRelays() {
+	relayMutex.Lock()
+	active := make([]*relay, 0, len(relays))
+	for r := range relays {
+		active = append(active, r)
+	}
+	relayMutex.Unlock()
+
+	for _, r := range active {
+		r.close()
+	}
+}
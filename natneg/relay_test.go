@@ -0,0 +1,139 @@
+package natneg
+
+import (
+	"net"
+	"testing"
+	"time"
+	"wwfc/common"
+)
+
+func setupTestRelay(t *testing.T) {
+	relayAddress = "127.0.0.1"
+	relayBindAddress = "127.0.0.1"
+	relayAfterFailures = 1
+	relayRate = 1024 * 1024
+	relayMaxBytes = 1024 * 1024
+	relayTimeout = time.Second
+	relayBandwidth = nil
+
+	// Find a free range of ports
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	portStart := conn.LocalAddr().(*net.UDPAddr).Port + 1
+	common.UDPPorts.SetRange(portStart, portStart+10)
+	conn.Close()
+
+	t.Cleanup(func() {
+		closeRelays()
+		common.UDPPorts.SetRange(0, -1)
+		relayAddress = ""
+		pairFailures = map[string]*pairFailure{}
+	})
+}
+
+func TestRelayAfterFailures(t *testing.T) {
+	setupTestRelay(t)
+
+	sender := &NATNEGClient{ServerIP: "127.0.0.1:1000"}
+	destination := &NATNEGClient{ServerIP: "127.0.0.2:2000"}
+
+	if shouldRelay(sender, destination) {
+		t.Fatal("relaying before any failure")
+	}
+
+	recordNegotiationResult(sender, destination, false)
+	if !shouldRelay(destination, sender) {
+		t.Fatal("not relaying after a failure")
+	}
+
+	recordNegotiationResult(sender, destination, true)
+	if shouldRelay(sender, destination) {
+		t.Fatal("still relaying after a success")
+	}
+
+	// Forgotten once the pair hasn't failed for a while
+	recordNegotiationResult(sender, destination, false)
+	reapPairFailures(time.Now())
+	if !shouldRelay(sender, destination) {
+		t.Fatal("recent failure was forgotten")
+	}
+	reapPairFailures(time.Now().Add(pairFailureTimeout + time.Second))
+	if len(pairFailures) != 0 {
+		t.Fatalf("kept %d old failures", len(pairFailures))
+	}
+}
+
+func TestRelayForwarding(t *testing.T) {
+	setupTestRelay(t)
+
+	client1, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	before := GetRelayStats()
+
+	sender := &NATNEGClient{ServerIP: client1.LocalAddr().String()}
+	destination := &NATNEGClient{ServerIP: client2.LocalAddr().String()}
+	if err := startRelay("NATNEG:test", sender, destination); err != nil {
+		t.Fatal(err)
+	}
+
+	relay1, _ := net.ResolveUDPAddr("udp", sender.RelayIP)
+	relay2, _ := net.ResolveUDPAddr("udp", destination.RelayIP)
+
+	// Dropped since client2's port isn't known yet, but tells the relay where client1 is
+	client1.WriteTo([]byte("ping1"), relay1)
+	time.Sleep(50 * time.Millisecond)
+
+	client2.WriteTo([]byte("ping2"), relay2)
+
+	buffer := make([]byte, 64)
+	client1.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := client1.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer[:n]) != "ping2" || addr.String() != relay1.String() {
+		t.Errorf("client1 received %q from %s", buffer[:n], addr)
+	}
+
+	client1.WriteTo([]byte("data"), relay1)
+	client2.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err = client2.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer[:n]) != "data" || addr.String() != relay2.String() {
+		t.Errorf("client2 received %q from %s", buffer[:n], addr)
+	}
+
+	if stats := GetRelayStats(); stats.Active != 1 || stats.Bytes-before.Bytes != 9 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestByteBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newByteBucket(100)
+	bucket.last = now
+
+	if !bucket.take(100, now) {
+		t.Fatal("failed to take the full burst")
+	}
+	if bucket.take(1, now) {
+		t.Fatal("took more than the rate")
+	}
+	if !bucket.take(50, now.Add(500*time.Millisecond)) {
+		t.Fatal("bucket didn't refill")
+	}
+}
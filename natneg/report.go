@@ -1,15 +1,58 @@
 package natneg
 
 import (
+	"encoding/binary"
 	"fmt"
 	"net"
+	"sync/atomic"
 	"wwfc/logging"
 	"wwfc/qr2"
 
 	"github.com/logrusorgru/aurora/v3"
 )
 
+// Outcomes reported by clients since the backend started
+var (
+	reportedSuccesses atomic.Uint64
+	reportedFailures  atomic.Uint64
+)
+
+type ReportStats struct {
+	Successes uint64 `json:"successes"`
+	Failures  uint64 `json:"failures"`
+	ERTProbes uint64 `json:"ert_probes"`
+	ERTAcks   uint64 `json:"ert_acks"`
+	TimedOut  uint64 `json:"timed_out"`
+}
+
+// GetReportStats returns the negotiation outcomes reported since the backend started
+func GetReportStats() ReportStats {
+	return ReportStats{
+		Successes: reportedSuccesses.Load(),
+		Failures:  reportedFailures.Load(),
+		ERTProbes: ertProbes.Load(),
+		ERTAcks:   ertAcks.Load(),
+		TimedOut:  timedOutPairings.Load(),
+	}
+}
+
+// readReportEnum reads a 4 byte enum from a report, which is sent in the console's byte order
+func readReportEnum(buffer []byte) byte {
+	if value := binary.BigEndian.Uint32(buffer); value <= 0xff {
+		return byte(value)
+	}
+
+	return byte(binary.LittleEndian.Uint32(buffer))
+}
+
 func (session *NATNEGSession) handleReport(conn net.PacketConn, addr net.Addr, buffer []byte, _ string, version byte) {
+	moduleName := "NATNEG:" + fmt.Sprintf("%08x/", session.Cookie) + addr.String()
+
+	if len(buffer) < 11 {
+		logging.Error(moduleName, "Invalid packet size")
+		return
+	}
+
 	response := createPacketHeader(version, NNReportReply, session.Cookie)
 	response = append(response, buffer[:9]...)
 	response[14] = 0
@@ -18,14 +61,24 @@ func (session *NATNEGSession) handleReport(conn net.PacketConn, addr net.Addr, b
 	// portType := buffer[0]
 	clientIndex := buffer[1]
 	result := buffer[2]
-	// natType := buffer[3]
-	// mappingScheme := buffer[7]
+	natType := readReportEnum(buffer[3:7])
+	mappingScheme := readReportEnum(buffer[7:11])
 	// gameName, err := common.GetString(buffer[11:])
 
-	moduleName := "NATNEG:" + fmt.Sprintf("%08x/", session.Cookie) + addr.String()
-	logging.Notice(moduleName, "Report from", aurora.BrightCyan(clientIndex), "result:", aurora.Cyan(result))
+	logging.Notice(moduleName, "Report from", aurora.BrightCyan(clientIndex), "result:", aurora.Cyan(result), "NAT type:", aurora.Cyan(natType), "mapping:", aurora.Cyan(mappingScheme))
+
+	if result == 1 {
+		reportedSuccesses.Add(1)
+	} else {
+		reportedFailures.Add(1)
+	}
 
 	if client, exists := session.Clients[clientIndex]; exists {
+		profileId := qr2.GetProfileID(client.ServerIP)
+		if err := store.RecordNATReport(ctx, profileId, natType, mappingScheme, result == 1); err != nil {
+			logging.Error(moduleName, "Failed to record NAT report:", err)
+		}
+
 		client.Result[client.ConnectingIndex] = result
 		connecting := session.Clients[client.ConnectingIndex]
 		client.ConnectingIndex = clientIndex
@@ -35,6 +88,15 @@ func (session *NATNEGSession) handleReport(conn net.PacketConn, addr net.Addr, b
 			if otherResult != 1 {
 				result = otherResult
 			}
+
+			if client.RelayIP != "" {
+				logging.Notice(moduleName, "Relayed connection result:", aurora.Cyan(result))
+			} else {
+				recordNegotiationResult(client, connecting, result == 1)
+			}
+
+			client.RelayIP = ""
+			connecting.RelayIP = ""
 			qr2.ProcessNATNEGReport(result, client.ServerIP, connecting.ServerIP)
 		}
 	}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// pprofListenAddress binds an address given without a host to localhost, the profiles expose
+// memory contents and command lines so they shouldn't be reachable from outside by accident
+func pprofListenAddress(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host != "" {
+		return address
+	}
+
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// startPprofServer serves the runtime profiles under /debug/pprof/ for the process
+func startPprofServer(process string, address string) {
+	address = pprofListenAddress(address)
+
+	host, _, _ := net.SplitHostPort(address)
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		logging.Warn(process, "Profiling server is reachable from other hosts on", aurora.BrightCyan(address))
+	}
+
+	go func() {
+		logging.Notice(process, "Serving profiles on", aurora.BrightCyan(address))
+		err := serveHTTP("profiling", address, pprofHandler())
+		if err != nil {
+			logging.Error(process, "Profiling server failed:", err)
+		}
+	}()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPprofListenAddress(t *testing.T) {
+	for address, expected := range map[string]string{
+		":6060":          "127.0.0.1:6060",
+		"127.0.0.1:6060": "127.0.0.1:6060",
+		"[::1]:6060":     "[::1]:6060",
+		"0.0.0.0:6060":   "0.0.0.0:6060",
+	} {
+		if actual := pprofListenAddress(address); actual != expected {
+			t.Errorf("%s: got %s, expected %s", address, actual, expected)
+		}
+	}
+}
+
+func TestPprofHandler(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	pprofHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/pprof/goroutine?debug=1", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("goroutine profile returned %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	pprofHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("unrelated path returned %d", recorder.Code)
+	}
+}
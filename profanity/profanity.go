@@ -0,0 +1,227 @@
+// Word lists for names and other text players can set. Every check sees the current contents of the
+// files, which are reread when they change on disk.
+package profanity
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// AnyLanguage selects only the list shared by every language
+const AnyLanguage = -1
+
+// wordList is one file, with its entries normalized
+type wordList struct {
+	path    string
+	modTime time.Time
+	size    int64
+	loaded  bool
+
+	// Matched against a whole name or one of its words
+	words map[string]bool
+	// Matched anywhere in a name, from entries starting with '*'
+	fragments []string
+}
+
+var (
+	mutex     sync.Mutex
+	shared    *wordList
+	languages = map[int]*wordList{}
+	lastCheck time.Time
+
+	// How often the files are checked for changes
+	reloadInterval = time.Second
+)
+
+// leetspeak maps characters commonly substituted for letters back to the letter
+var leetspeak = map[rune]rune{
+	'0': 'o',
+	'1': 'i',
+	'3': 'e',
+	'4': 'a',
+	'5': 's',
+	'7': 't',
+	'@': 'a',
+	'$': 's',
+	'!': 'i',
+}
+
+// SetLists replaces the word lists: the file at path applies to every language, and the others to
+// the DWC language code they're keyed by. The files are loaded straight away, a missing file
+// is logged and treated as empty until it's created.
+func SetLists(path string, languageFiles map[int]string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	shared = nil
+	if path != "" {
+		shared = &wordList{path: path}
+		shared.reload()
+	}
+
+	languages = map[int]*wordList{}
+	for language, path := range languageFiles {
+		languages[language] = &wordList{path: path}
+		languages[language].reload()
+	}
+
+	lastCheck = time.Now()
+}
+
+// IsLoaded reports whether the list shared by every language has been read
+func IsLoaded() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return shared != nil && shared.loaded
+}
+
+// Check reports whether the text contains a listed word. Besides the shared list, the list for
+// the language is used if there is one.
+func Check(text string, language int) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if time.Since(lastCheck) >= reloadInterval {
+		lastCheck = time.Now()
+		if shared != nil {
+			shared.reloadIfChanged()
+		}
+		for _, list := range languages {
+			list.reloadIfChanged()
+		}
+	}
+
+	// The name with separators dropped catches "b.a.d", each word catches "Mr Bad". Both are
+	// also tried without undoing leetspeak, so "Bad!" isn't read as "badi".
+	var words []string
+	for _, word := range append([]string{text}, strings.FieldsFunc(text, isSeparator)...) {
+		words = append(words, normalize(word, true), normalize(word, false))
+	}
+	whole := words[:2]
+
+	for _, list := range []*wordList{shared, languages[language]} {
+		if list == nil {
+			continue
+		}
+
+		for _, word := range words {
+			if list.words[word] {
+				return true
+			}
+		}
+
+		for _, fragment := range list.fragments {
+			if strings.Contains(whole[0], fragment) || strings.Contains(whole[1], fragment) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// normalize lower cases the text and drops everything but letters and digits, optionally
+// replacing leetspeak with the letters
+func normalize(text string, leet bool) string {
+	var normalized strings.Builder
+	for _, c := range strings.ToLower(text) {
+		if letter, ok := leetspeak[c]; ok && leet {
+			c = letter
+		}
+
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			normalized.WriteRune(c)
+		}
+	}
+
+	return normalized.String()
+}
+
+func isSeparator(c rune) bool {
+	_, leet := leetspeak[c]
+	return !leet && !unicode.IsLetter(c) && !unicode.IsDigit(c)
+}
+
+func (l *wordList) reloadIfChanged() {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		if l.loaded && errors.Is(err, os.ErrNotExist) {
+			logging.Warn("PROFANITY", "Word list", aurora.Cyan(l.path), "was removed, keeping the last loaded words")
+			l.loaded = false
+		}
+		return
+	}
+
+	if !l.loaded || !info.ModTime().Equal(l.modTime) || info.Size() != l.size {
+		l.reload()
+	}
+}
+
+// reload reads the file. Blank lines and lines starting with '#' are skipped.
+func (l *wordList) reload() {
+	file, err := os.Open(l.path)
+	if err != nil {
+		logging.Warn("PROFANITY", "Failed to open word list", aurora.Cyan(l.path).String()+":", err)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		logging.Error("PROFANITY", "Failed to read word list", aurora.Cyan(l.path).String()+":", err)
+		return
+	}
+
+	words := map[string]bool{}
+	var fragments []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Entries are kept in both forms so digits in an entry can match literally
+		if fragment, ok := strings.CutPrefix(line, "*"); ok {
+			for _, leet := range []bool{true, false} {
+				if fragment := normalize(fragment, leet); fragment != "" {
+					fragments = append(fragments, fragment)
+				}
+			}
+			continue
+		}
+
+		for _, leet := range []bool{true, false} {
+			if word := normalize(line, leet); word != "" {
+				words[word] = true
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		logging.Error("PROFANITY", "Failed to read word list", aurora.Cyan(l.path).String()+":", err)
+		return
+	}
+
+	l.words = words
+	l.fragments = fragments
+	l.modTime = info.ModTime()
+	l.size = info.Size()
+
+	if l.loaded {
+		logging.Notice("PROFANITY", "Reloaded word list", aurora.Cyan(l.path))
+	} else {
+		logging.Info("PROFANITY", "Loaded word list", aurora.Cyan(l.path))
+	}
+	l.loaded = true
+}
@@ -0,0 +1,76 @@
+package profanity
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeList(t *testing.T, path string, data string) {
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	directory := t.TempDir()
+	writeList(t, filepath.Join(directory, "all.txt"), "# comment\nbadword\n\n*worse\n1488\n")
+	writeList(t, filepath.Join(directory, "ja.txt"), "baka\n")
+	SetLists(filepath.Join(directory, "all.txt"), map[int]string{0: filepath.Join(directory, "ja.txt")})
+	t.Cleanup(func() { SetLists("", nil) })
+
+	for text, profane := range map[string]bool{
+		"badword":       true,
+		"BadWord":       true,
+		"b4dw0rd":       true,
+		"b.a.d.w.o.r.d": true,
+		"Mr Badword":    true,
+		"Badword!":      true,
+		"badwords":      false,
+		"goodword":      false,
+		"soworsethan":   true,
+		"1488":          true,
+		"baka":          false,
+		"":              false,
+	} {
+		if Check(text, AnyLanguage) != profane {
+			t.Errorf("%q: expected profane %v", text, profane)
+		}
+	}
+
+	if !Check("Baka", 0) || Check("Baka", 1) {
+		t.Error("language list applied to the wrong language")
+	}
+}
+
+func TestCheckReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "all.txt")
+	writeList(t, path, "badword\n")
+
+	oldInterval := reloadInterval
+	reloadInterval = 0
+	SetLists(path, nil)
+	t.Cleanup(func() {
+		reloadInterval = oldInterval
+		SetLists("", nil)
+	})
+
+	if !IsLoaded() || !Check("badword", AnyLanguage) || Check("newword", AnyLanguage) {
+		t.Fatal("list not loaded")
+	}
+
+	writeList(t, path, "badword\nnewword\n")
+	// Some filesystems only keep the modification time to the second
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+
+	if !Check("newword", AnyLanguage) {
+		t.Error("list not reloaded")
+	}
+
+	// The last words are kept until the file is back
+	os.Remove(path)
+	if !Check("newword", AnyLanguage) || IsLoaded() {
+		t.Error("removed list not kept")
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"wwfc/api"
+	"wwfc/database"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// RPCPacket.Allowlist is called by the command interface to add a profile or console to the
+// allowlist, remove it, or list the allowlist. It makes the same change as /api/allowlist.
+func (r *RPCPacket) Allowlist(change api.AllowlistChange, entries *[]database.AllowlistEntry) error {
+	result, err := api.ChangeAllowlist(change)
+	if err != nil {
+		return err
+	}
+	*entries = result
+
+	switch {
+	case change.Action == "list":
+	case change.ConsoleFC != 0:
+		logging.Notice("BACKEND", "Allowlist", change.Action, "console", aurora.Cyan(change.ConsoleFC))
+	default:
+		logging.Notice("BACKEND", "Allowlist", change.Action, "profile", aurora.Cyan(change.ProfileID))
+	}
+	return nil
+}
@@ -5,3 +5,11 @@ var gpErrorCallback func(uint32, string)
 func SetGPErrorCallback(callback func(uint32, string)) {
 	gpErrorCallback = callback
 }
+
+// Called when a session is removed for repeatedly sending invalid heartbeats,
+// with the profile ID (0 if not logged in), address and the last violation
+var violationCallback func(uint32, string, string)
+
+func SetViolationCallback(callback func(uint32, string, string)) {
+	violationCallback = callback
+}
@@ -26,6 +26,7 @@ type Group struct {
 	LastJoinIndex int
 	server        *Session
 	players       map[*Session]bool
+	reservations  map[uint32]*groupReservation
 }
 
 var groups = map[string]*Group{}
@@ -82,10 +83,28 @@ func processResvOK(moduleName string, matchVersion int, reservation common.Match
 		groups[group.GroupName] = group
 
 		logging.Notice(moduleName, "Created new group", aurora.Cyan(group.GroupName))
+
+		event := logging.AuditEvent{
+			Event:   logging.AuditHost,
+			IP:      sender.Addr.IP.String(),
+			Game:    group.GameName,
+			Details: map[string]string{"group": group.GroupName, "matchType": group.MatchType},
+		}
+		if login := sender.login; login != nil {
+			event.ProfileID = login.ProfileID
+			event.CFC = login.ConsoleFriendCode
+		}
+		logging.Audit(event)
 	}
 
 	// Keep group ID updated
 	group.GroupID = resvOK.GroupID
+	stateVersion.Add(1)
+
+	// The joining player's slot is now taken by their membership
+	if destination.login != nil {
+		releaseReservation(destination.login.ProfileID)
+	}
 
 	// Set connecting
 	sender.Data["+conn_"+destination.Data["+joinindex"]] = "1"
@@ -120,6 +139,7 @@ func processTellAddr(moduleName string, sender *Session, destination *Session) {
 		// Just assume the connection is successful if TELL_ADDR is used
 		sender.Data["+conn_"+destination.Data["+joinindex"]] = "2"
 		destination.Data["+conn_"+sender.Data["+joinindex"]] = "2"
+		stateVersion.Add(1)
 	}
 }
 
@@ -245,6 +265,12 @@ func checkReservationAllowed(moduleName string, sender, destination *Session, jo
 		return ""
 	}
 
+	// Dropped without telling either player, the shadow banned player shouldn't notice anything
+	if sender.login.ShadowBanned || destination.login.ShadowBanned {
+		logging.Info(moduleName, "Dropping reservation involving a shadow banned player")
+		return "shadow_banned"
+	}
+
 	if !sender.login.Restricted && !destination.login.Restricted {
 		return "ok"
 	}
@@ -328,6 +354,15 @@ func ProcessNATNEGReport(result byte, ip1 string, ip2 string) {
 		return
 	}
 
+	if result != 1 {
+		// A failed negotiation won't lead to a join
+		for _, session := range []*Session{session1, session2} {
+			if session.login != nil {
+				releaseReservation(session.login.ProfileID)
+			}
+		}
+	}
+
 	if session1.groupPointer == nil || session1.groupPointer != session2.groupPointer {
 		logging.Warn(moduleName, "Received NATNEG report for two IPs in different groups")
 		return
@@ -339,6 +374,7 @@ func ProcessNATNEGReport(result byte, ip1 string, ip2 string) {
 		resultString = "2"
 	}
 
+	stateVersion.Add(1)
 	session1.Data["+conn_"+session2.Data["+joinindex"]] = resultString
 	session2.Data["+conn_"+session1.Data["+joinindex"]] = resultString
 
@@ -417,6 +453,7 @@ func ProcessUSER(senderPid uint32, senderIP uint64, packet []byte) {
 	mutex.Lock()
 	defer mutex.Unlock()
 
+	stateVersion.Add(1)
 	for i, name := range miiName {
 		session.Data["+mii"+strconv.Itoa(i)] = miiData[i]
 		session.Data["+mii_name"+strconv.Itoa(i)] = name
@@ -480,14 +517,16 @@ type PlayerInfo struct {
 }
 
 type GroupInfo struct {
-	GroupName   string                `json:"id"`
-	GameName    string                `json:"game"`
-	CreateTime  time.Time             `json:"created"`
-	MatchType   string                `json:"type"`
-	Suspend     bool                  `json:"suspend"`
-	ServerIndex string                `json:"host,omitempty"`
-	MKWRegion   string                `json:"rk,omitempty"`
-	Players     map[string]PlayerInfo `json:"players"`
+	GroupName    string                `json:"id"`
+	GameName     string                `json:"game"`
+	CreateTime   time.Time             `json:"created"`
+	MatchType    string                `json:"type"`
+	Suspend      bool                  `json:"suspend"`
+	ServerIndex  string                `json:"host,omitempty"`
+	MKWRegion    string                `json:"rk,omitempty"`
+	Players      map[string]PlayerInfo `json:"players"`
+	Capacity     int                   `json:"capacity,omitempty"`
+	Reservations []ReservationInfo     `json:"reservations,omitempty"`
 
 	PlayersRaw      map[string]map[string]string `json:"-"`
 	SortedJoinIndex []string                     `json:"-"`
@@ -533,11 +572,19 @@ func getGroupsRaw(gameNames []string, groupNames []string) []GroupInfo {
 			groupInfo.ServerIndex = group.server.Data["+joinindex"]
 		}
 
+		groupInfo.Capacity = group.capacity()
+		groupInfo.Reservations = group.getReservations(time.Now())
+
 		if groupInfo.GameName == "mariokartwii" {
 			groupInfo.MKWRegion = group.MKWRegion
 		}
 
 		for session := range group.players {
+			// Left out like in the server list, the public API doesn't show shadow banned players
+			if session.login != nil && session.login.ShadowBanned {
+				continue
+			}
+
 			mapData := map[string]string{}
 			for k, v := range session.Data {
 				mapData[k] = v
@@ -580,6 +627,11 @@ func getGroupsRaw(gameNames []string, groupNames []string) []GroupInfo {
 			}
 		}
 
+		// Nobody else can be in a shadow banned player's room, so it isn't listed at all
+		if len(groupInfo.PlayersRaw) == 0 {
+			continue
+		}
+
 		groupsCopy = append(groupsCopy, groupInfo)
 	}
 
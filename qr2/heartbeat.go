@@ -17,7 +17,7 @@ func heartbeat(moduleName string, conn net.PacketConn, addr net.UDPAddr, buffer
 
 	payload := map[string]string{}
 	unknowns := []string{}
-	for i := 0; i < len(values); i += 2 {
+	for i := 0; i+1 < len(values); i += 2 {
 		if len(values[i]) == 0 || values[i][0] == '+' {
 			continue
 		}
@@ -30,6 +30,12 @@ func heartbeat(moduleName string, conn net.PacketConn, addr net.UDPAddr, buffer
 		payload[values[i]] = values[i+1]
 	}
 
+	payload, violations := sanitizeHeartbeat(payload)
+	violations = append(violations, inspectHeartbeat(moduleName, addr, payload)...)
+	if len(violations) != 0 && !reportViolations(moduleName, "Heartbeat", addr, violations) {
+		return
+	}
+
 	if payload["dwc_mtype"] != "" {
 		logging.Info(moduleName, "Match type:", aurora.Cyan(payload["dwc_mtype"]))
 	}
@@ -76,6 +82,14 @@ func heartbeat(moduleName string, conn net.PacketConn, addr net.UDPAddr, buffer
 		return
 	}
 
+	if common.CheckGame(moduleName, payload["gamename"], common.GameServiceQR2) == nil {
+		// Delist the host if the game was disabled while it was up
+		mutex.Lock()
+		removeSession(lookupAddr)
+		mutex.Unlock()
+		return
+	}
+
 	if ratingError := checkValidRating(moduleName, payload); ratingError != "ok" {
 		mutex.Lock()
 		session, sessionExists := sessions[lookupAddr]
@@ -137,6 +151,43 @@ func heartbeat(moduleName string, conn net.PacketConn, addr net.UDPAddr, buffer
 	mutex.Unlock()
 }
 
+// Log violations in a heartbeat or message and count them against the session. Returns false if
+// the session has been removed for repeated violations.
+func reportViolations(moduleName string, kind string, addr net.UDPAddr, violations []string) bool {
+	mutex.Lock()
+	session := sessions[makeLookupAddr(addr.String())]
+
+	profileId := uint32(0)
+	if session != nil && session.login != nil {
+		profileId = session.login.ProfileID
+	}
+
+	for _, violation := range violations {
+		logging.Warn(moduleName, kind, "from profile", aurora.Cyan(profileId), "IP", aurora.BrightCyan(addr.String()), "rejected:", violation)
+	}
+
+	if session == nil {
+		mutex.Unlock()
+		return true
+	}
+
+	session.Violations++
+	if session.Violations < maxSessionViolations {
+		mutex.Unlock()
+		return true
+	}
+
+	logging.Error(moduleName, "Removing session after", aurora.Cyan(session.Violations), "violations")
+	removeSession(makeLookupAddr(addr.String()))
+	mutex.Unlock()
+
+	if violationCallback != nil {
+		violationCallback(profileId, addr.String(), violations[0])
+	}
+
+	return false
+}
+
 func checkValidRating(moduleName string, payload map[string]string) string {
 	if payload["gamename"] == "mariokartwii" {
 		// ev and eb values must be in range 1 to 9999
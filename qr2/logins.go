@@ -16,6 +16,7 @@ type LoginInfo struct {
 	NeedsExploit        bool
 	DeviceAuthenticated bool
 	Restricted          bool
+	ShadowBanned        bool
 	session             *Session
 	Trusted             bool
 	OpenHoster          bool
@@ -24,7 +25,7 @@ type LoginInfo struct {
 
 var logins = map[uint32]*LoginInfo{}
 
-func Login(profileID uint32, gameCode string, inGameName string, consoleFriendCode uint64, fcGame string, publicIP string, needsExploit bool, deviceAuthenticated bool, restricted bool, trusted bool, openhost bool, ctgpver string) {
+func Login(profileID uint32, gameCode string, inGameName string, consoleFriendCode uint64, fcGame string, publicIP string, needsExploit bool, deviceAuthenticated bool, restricted bool, shadowBanned bool, trusted bool, openhost bool, ctgpver string) {
 	mutex.Lock()
 	defer mutex.Unlock()
 
@@ -38,6 +39,7 @@ func Login(profileID uint32, gameCode string, inGameName string, consoleFriendCo
 		NeedsExploit:        needsExploit,
 		DeviceAuthenticated: deviceAuthenticated,
 		Restricted:          restricted,
+		ShadowBanned:        shadowBanned,
 		session:             nil,
 		Trusted:             trusted,
 		OpenHoster:          openhost,
@@ -54,14 +56,27 @@ func SetDeviceAuthenticated(profileID uint32) {
 		login.DeviceAuthenticated = true
 		if login.session != nil {
 			login.session.Data["+deviceauth"] = "1"
+			stateVersion.Add(1)
 		}
 	}
 }
 
+// SetShadowBanned hides a profile that is already logged in from matchmaking
+func SetShadowBanned(profileID uint32) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if login, exists := logins[profileID]; exists {
+		login.ShadowBanned = true
+	}
+}
+
 func Logout(profileID uint32) {
 	mutex.Lock()
 	defer mutex.Unlock()
 
+	releaseReservation(profileID)
+
 	// Delete login's session
 	if login, exists := logins[profileID]; exists {
 		if login.session != nil {
@@ -3,6 +3,8 @@ package qr2
 import (
 	"encoding/binary"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 	"wwfc/common"
@@ -27,6 +29,13 @@ const (
 	ClientExploitReply = 0x10
 )
 
+// Replies to an AvailableRequest
+const (
+	AvailableStatusAvailable              = 0
+	AvailableStatusUnavailable            = 1
+	AvailableStatusTemporarilyUnavailable = 2
+)
+
 var (
 	masterConn net.PacketConn
 	inShutdown = false
@@ -37,14 +46,25 @@ func StartServer(reload bool) {
 	// Get config
 	config := common.GetConfig()
 
-	address := *config.GameSpyAddress + ":27900"
+	address := net.JoinHostPort(config.GetServerAddress("qr2"), strconv.Itoa(config.GetServerPort("qr2")))
 	conn, err := net.ListenPacket("udp", address)
 	if err != nil {
 		panic(err)
 	}
 
+	StartServerOn(conn, reload)
+}
+
+// StartServerOn starts the server on a socket that is already listening, used by the tests to run
+// it on an ephemeral port
+func StartServerOn(conn net.PacketConn, reload bool) {
+	config := common.GetConfig()
+	address := conn.LocalAddr().String()
+
 	masterConn = conn
 	inShutdown = false
+	sessionTimeout = time.Duration(*config.QR2SessionTimeout) * time.Second
+	heartbeatInterval = time.Duration(*config.QR2HeartbeatInterval) * time.Millisecond
 
 	if reload {
 		err := loadSessions()
@@ -69,6 +89,8 @@ func StartServer(reload bool) {
 		logging.Notice("QR2", "Loaded", aurora.Cyan(len(groups)), "groups")
 	}
 
+	startReaper()
+
 	waitGroup.Add(1)
 
 	go func() {
@@ -97,6 +119,7 @@ func StartServer(reload bool) {
 }
 
 func Shutdown() {
+	close(stopReaper)
 	inShutdown = true
 	masterConn.Close()
 	waitGroup.Wait()
@@ -104,6 +127,8 @@ func Shutdown() {
 	mutex.Lock()
 	defer mutex.Unlock()
 
+	stopHeartbeatTimers()
+
 	err := saveSessions()
 	if err != nil {
 		logging.Error("QR2", "Failed to save sessions:", err)
@@ -172,6 +197,9 @@ func handleConnection(conn net.PacketConn, addr net.UDPAddr, buffer []byte) {
 
 	case HeartbeatRequest:
 		// logging.Info(moduleName, "Command:", aurora.Yellow("HEARTBEAT"))
+		if !allowHeartbeat(moduleName, conn, addr, buffer, time.Now()) {
+			return
+		}
 		heartbeat(moduleName, conn, addr, buffer)
 
 	case AddErrorRequest:
@@ -206,7 +234,14 @@ func handleConnection(conn net.PacketConn, addr net.UDPAddr, buffer []byte) {
 
 	case AvailableRequest:
 		logging.Info("QR2", "Command:", aurora.Yellow("AVAILABLE"))
-		conn.WriteTo(createResponseHeader(AvailableRequest, 0), &addr)
+
+		// The status goes where the session ID usually is
+		status := uint32(AvailableStatusAvailable)
+		if gameName, _, _ := strings.Cut(string(buffer[5:]), "\x00"); common.IsGameDisabled(gameName) {
+			logging.Warn(moduleName, "Reporting disabled game", aurora.Cyan(gameName), "as unavailable")
+			status = AvailableStatusTemporarilyUnavailable
+		}
+		conn.WriteTo(createResponseHeader(AvailableRequest, status), &addr)
 		return
 
 	case ClientRegisteredReply:
@@ -10,6 +10,7 @@ import (
 	"strings"
 	"time"
 	"wwfc/common"
+	"wwfc/inspect"
 	"wwfc/logging"
 
 	"github.com/logrusorgru/aurora/v3"
@@ -110,13 +111,27 @@ func SendClientMessage(senderIP string, destSearchID uint64, message []byte) {
 		}
 
 		mutex.Lock()
-		if sender.Data["gamename"] != receiver.Data["gamename"] {
+		gameName := sender.Data["gamename"]
+		if gameName != receiver.Data["gamename"] {
 			mutex.Unlock()
 			logging.Error(moduleName, "Sender and receiver are not playing the same game")
 			return
 		}
 		mutex.Unlock()
 
+		// Checked before decoding so signatures can match commands the decoder would accept
+		if !inspect.Inspect(moduleName, inspect.Payload{
+			Target:    inspect.TargetMatch,
+			Game:      gameName,
+			Command:   int(message[8]),
+			Data:      message[0x14:],
+			ProfileID: senderProfileID,
+			Address:   senderIP,
+		}) {
+			reportViolations(moduleName, "Match command", sender.Addr, []string{"blocked payload for command " + strconv.Itoa(int(message[8]))})
+			return
+		}
+
 		var ok bool
 		matchData, ok = common.DecodeMatchCommand(message[8], message[0x14:], version)
 		if !ok {
@@ -0,0 +1,90 @@
+package qr2
+
+import (
+	"sync/atomic"
+	"time"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+const reaperInterval = 10 * time.Second
+
+var (
+	// Sessions that haven't sent a heartbeat or keep alive within this time are removed
+	sessionTimeout = 180 * time.Second
+
+	reapedSessions atomic.Uint64
+	stopReaper     chan struct{}
+)
+
+// GetReapedSessionCount returns the number of sessions removed for timing out since the backend started
+func GetReapedSessionCount() uint64 {
+	return reapedSessions.Load()
+}
+
+func startReaper() {
+	stopReaper = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(reaperInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				reapSessions(now.Unix())
+			}
+		}
+	}(stopReaper)
+}
+
+// reapSessions removes timed out sessions and reservations, and dissolves groups left without a host.
+// Everything is done under the global mutex, which heartbeats also take before touching
+// LastKeepAlive, so a session refreshed before the sweep is never removed.
+func reapSessions(now int64) int {
+	cutoff := now - int64(sessionTimeout/time.Second)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var orphaned []*Group
+	reaped := 0
+	for lookupAddr, session := range sessions {
+		if session.LastKeepAlive >= cutoff {
+			continue
+		}
+
+		logging.Notice("QR2", "Reaping stale session", aurora.BrightCyan(session.Addr.String()), "last seen", aurora.Cyan(now-session.LastKeepAlive), "seconds ago")
+
+		group := session.groupPointer
+		isServer := group != nil && group.server == session
+
+		removeSession(lookupAddr)
+		reaped++
+
+		// removeFromGroup tries to find a new host, the group is only orphaned if that failed
+		if isServer && group.server == nil && len(group.players) != 0 {
+			orphaned = append(orphaned, group)
+		}
+	}
+
+	reapReservations(time.Unix(now, 0))
+	reapHeartbeatHosts(time.Unix(cutoff, 0))
+
+	for _, group := range orphaned {
+		if groups[group.GroupName] != group {
+			continue
+		}
+
+		logging.Notice("QR2", "Dissolving group", aurora.Cyan(group.GroupName), "after its host timed out")
+		for player := range group.players {
+			player.removeFromGroup()
+		}
+	}
+
+	reapedSessions.Add(uint64(reaped))
+	return reaped
+}
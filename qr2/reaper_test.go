@@ -0,0 +1,74 @@
+package qr2
+
+import (
+	"net"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/sleep"
+)
+
+func addTestSession(port int, lastKeepAlive int64, hostState string, group *Group) *Session {
+	session := &Session{
+		Addr:            net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port},
+		LastKeepAlive:   lastKeepAlive,
+		Data:            map[string]string{"dwc_hoststate": hostState, "+joinindex": "0"},
+		messageAckWaker: &sleep.Waker{},
+	}
+
+	sessions[makeLookupAddr(session.Addr.String())] = session
+	if group != nil {
+		group.players[session] = true
+		session.groupPointer = group
+		session.GroupName = group.GroupName
+	}
+
+	return session
+}
+
+func TestReapSessions(t *testing.T) {
+	defer func() {
+		sessions = map[uint64]*Session{}
+		groups = map[string]*Group{}
+	}()
+
+	now := int64(100000)
+	stale := now - int64(sessionTimeout.Seconds()) - 1
+
+	// Host timed out and no remaining player can take over
+	orphaned := &Group{GroupName: "orphaned", players: map[*Session]bool{}}
+	groups[orphaned.GroupName] = orphaned
+	orphaned.server = addTestSession(1000, stale, "2", orphaned)
+	member := addTestSession(1001, now, "0", orphaned)
+
+	// Host timed out but another player can host
+	migrated := &Group{GroupName: "migrated", players: map[*Session]bool{}}
+	groups[migrated.GroupName] = migrated
+	migrated.server = addTestSession(2000, stale, "2", migrated)
+	newHost := addTestSession(2001, now, "2", migrated)
+
+	// Refreshed exactly at the cutoff, must survive
+	survivor := addTestSession(3000, now-int64(sessionTimeout.Seconds()), "0", nil)
+
+	before := GetReapedSessionCount()
+	if reaped := reapSessions(now); reaped != 2 {
+		t.Errorf("reaped %d sessions, expected 2", reaped)
+	}
+
+	if GetReapedSessionCount()-before != 2 {
+		t.Error("reaped session count was not updated")
+	}
+
+	for _, session := range []*Session{member, newHost, survivor} {
+		if sessions[makeLookupAddr(session.Addr.String())] != session {
+			t.Errorf("active session %s was removed", session.Addr.String())
+		}
+	}
+
+	if groups["orphaned"] != nil || member.groupPointer != nil {
+		t.Error("orphaned group was not dissolved")
+	}
+
+	if groups["migrated"] == nil || migrated.server != newHost {
+		t.Error("group with a new host was dissolved")
+	}
+}
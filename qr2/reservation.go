@@ -0,0 +1,176 @@
+package qr2
+
+import (
+	"strconv"
+	"time"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// A reservation holds a slot in a group from the RESERVATION until the host answers it
+const reservationTimeout = 15 * time.Second
+
+// groupReservation is a slot held for a player on their way into a group
+type groupReservation struct {
+	players int
+	expires time.Time
+}
+
+// Group each profile holds a reservation in, a profile only holds one at a time
+var reservationGroups = map[uint32]*Group{}
+
+type ReservationInfo struct {
+	ProfileID uint32    `json:"pid"`
+	Players   int       `json:"count"`
+	Expires   time.Time `json:"expires"`
+}
+
+// capacity returns the players the group's host says it can hold, or 0 if it doesn't say.
+// Expects the mutex to be locked.
+func (g *Group) capacity() int {
+	if g.server == nil {
+		return 0
+	}
+
+	capacity, err := strconv.Atoi(g.server.Data["maxplayers"])
+	if err != nil || capacity <= 0 {
+		return 0
+	}
+
+	return capacity
+}
+
+// occupiedSlots returns the players in the group plus the ones with an unexpired reservation.
+// Expects the mutex to be locked.
+func (g *Group) occupiedSlots(now time.Time) int {
+	occupied := 0
+	for player := range g.players {
+		occupied += localPlayerCount(player.Data["+localplayers"])
+	}
+
+	for _, reservation := range g.reservations {
+		if now.Before(reservation.expires) {
+			occupied += reservation.players
+		}
+	}
+
+	return occupied
+}
+
+// isFull checks if every slot the host reported is taken or reserved. Expects the mutex to be locked.
+func (g *Group) isFull(now time.Time) bool {
+	capacity := g.capacity()
+	return capacity != 0 && g.occupiedSlots(now) >= capacity
+}
+
+func localPlayerCount(value string) int {
+	if count, err := strconv.Atoi(value); err == nil && count > 0 {
+		return count
+	}
+
+	return 1
+}
+
+// reserveSlot reserves slots for the profile's players in the group, releasing any reservation it
+// held elsewhere. Returns false if the group can't fit them. Expects the mutex to be locked.
+func (g *Group) reserveSlot(profileID uint32, players int, now time.Time) bool {
+	releaseReservation(profileID)
+
+	if capacity := g.capacity(); capacity != 0 && g.occupiedSlots(now)+players > capacity {
+		return false
+	}
+
+	if g.reservations == nil {
+		g.reservations = map[uint32]*groupReservation{}
+	}
+
+	g.reservations[profileID] = &groupReservation{players: players, expires: now.Add(reservationTimeout)}
+	reservationGroups[profileID] = g
+	stateVersion.Add(1)
+	return true
+}
+
+// releaseReservation frees the profile's reservation, if it has one. Expects the mutex to be locked.
+func releaseReservation(profileID uint32) {
+	group := reservationGroups[profileID]
+	if group == nil {
+		return
+	}
+
+	delete(group.reservations, profileID)
+	delete(reservationGroups, profileID)
+	stateVersion.Add(1)
+}
+
+// releaseGroupReservations frees every reservation in a group that was deleted. Expects the mutex to be locked.
+func (g *Group) releaseGroupReservations() {
+	for profileID := range g.reservations {
+		if reservationGroups[profileID] == g {
+			delete(reservationGroups, profileID)
+		}
+	}
+
+	g.reservations = nil
+}
+
+// reapReservations frees the reservations that expired. Expects the mutex to be locked.
+func reapReservations(now time.Time) {
+	for profileID, group := range reservationGroups {
+		if reservation := group.reservations[profileID]; reservation == nil || !now.Before(reservation.expires) {
+			releaseReservation(profileID)
+		}
+	}
+}
+
+// ReserveGroupSlot is called when a player sends a RESERVATION to join another player. If the
+// destination is in a group whose host reported its capacity, a slot is held for the sender's
+// local players until the host answers or the reservation expires. Returns false if the group is
+// already full, counting other players on their way in.
+func ReserveGroupSlot(senderPid uint32, destPid uint32, localPlayers uint32) bool {
+	moduleName := "QR2:Reservation:" + strconv.FormatUint(uint64(senderPid), 10) + "->" + strconv.FormatUint(uint64(destPid), 10)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	destLogin := logins[destPid]
+	if destLogin == nil || destLogin.session == nil || destLogin.session.groupPointer == nil {
+		// Not hosting or in a room yet, there's nothing to fill
+		releaseReservation(senderPid)
+		return true
+	}
+
+	group := destLogin.session.groupPointer
+	if senderLogin := logins[senderPid]; senderLogin != nil && senderLogin.session != nil && senderLogin.session.groupPointer == group {
+		// Already in the group, e.g. connecting to a player who joined after them
+		return true
+	}
+
+	players := int(min(max(localPlayers, 1), 4))
+	if !group.reserveSlot(senderPid, players, time.Now()) {
+		logging.Notice(moduleName, "Group", aurora.Cyan(group.GroupName), "is full, rejecting reservation")
+		return false
+	}
+
+	return true
+}
+
+// ReleaseGroupSlot frees the profile's reservation, for when the host denied it or told it to wait
+func ReleaseGroupSlot(profileID uint32) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	releaseReservation(profileID)
+}
+
+// getReservations returns a copy of the group's unexpired reservations. Expects the mutex to be locked.
+func (g *Group) getReservations(now time.Time) []ReservationInfo {
+	var reservations []ReservationInfo
+	for profileID, reservation := range g.reservations {
+		if now.Before(reservation.expires) {
+			reservations = append(reservations, ReservationInfo{ProfileID: profileID, Players: reservation.players, Expires: reservation.expires})
+		}
+	}
+
+	return reservations
+}
@@ -0,0 +1,92 @@
+package qr2
+
+import (
+	"strconv"
+	"testing"
+	"time"
+	"wwfc/common"
+)
+
+func addTestLogin(session *Session, profileID uint32) {
+	session.Authenticated = true
+	session.login = &LoginInfo{ProfileID: profileID, session: session}
+	session.Data["dwc_pid"] = strconv.FormatUint(uint64(profileID), 10)
+	logins[profileID] = session.login
+}
+
+func TestGroupReservations(t *testing.T) {
+	defer func() {
+		sessions = map[uint64]*Session{}
+		logins = map[uint32]*LoginInfo{}
+		groups = map[string]*Group{}
+		reservationGroups = map[uint32]*Group{}
+	}()
+
+	now := time.Now().Unix()
+
+	// Host reports room for three, with one member using two local players
+	room := &Group{GroupName: "room", players: map[*Session]bool{}}
+	groups[room.GroupName] = room
+	room.server = addTestSession(1000, now, "2", room)
+	room.server.Data["maxplayers"] = "3"
+	addTestLogin(room.server, 600000001)
+
+	other := &Group{GroupName: "other", players: map[*Session]bool{}}
+	groups[other.GroupName] = other
+	other.server = addTestSession(2000, now, "2", other)
+	other.server.Data["maxplayers"] = "12"
+	addTestLogin(other.server, 600000002)
+
+	first := addTestSession(3000, now, "0", nil)
+	addTestLogin(first, 600000003)
+	second := addTestSession(3001, now, "0", nil)
+	addTestLogin(second, 600000004)
+
+	if !ReserveGroupSlot(600000003, 600000001, 2) {
+		t.Fatal("reservation was rejected with free slots")
+	}
+	if room.occupiedSlots(time.Now()) != 3 || !room.isFull(time.Now()) {
+		t.Errorf("room holds %d players, expected it to be full", room.occupiedSlots(time.Now()))
+	}
+
+	// The room is hidden and turns away anyone else while the reservation holds
+	for _, server := range GetSessionServers() {
+		if server["dwc_pid"] == "600000001" {
+			t.Error("full room was listed")
+		}
+	}
+	if ReserveGroupSlot(600000004, 600000001, 1) {
+		t.Error("reservation to a full room was accepted")
+	}
+
+	groupInfo := getGroupsRaw(nil, []string{"room"})
+	if len(groupInfo) != 1 || groupInfo[0].Capacity != 3 || len(groupInfo[0].Reservations) != 1 || groupInfo[0].Reservations[0].ProfileID != 600000003 {
+		t.Errorf("unexpected group info: %+v", groupInfo)
+	}
+
+	// Joining a different room releases the first reservation
+	if !ReserveGroupSlot(600000003, 600000002, 2) {
+		t.Fatal("reservation to another room was rejected")
+	}
+	if room.isFull(time.Now()) || len(room.reservations) != 0 {
+		t.Error("reservation was not released after joining another room")
+	}
+
+	// A reservation the host never answered expires
+	if !ReserveGroupSlot(600000004, 600000001, 2) {
+		t.Fatal("reservation was rejected after a slot was freed")
+	}
+	reapSessions(time.Now().Add(reservationTimeout + time.Second).Unix())
+	if len(room.reservations) != 0 || reservationGroups[600000004] != nil {
+		t.Error("expired reservation was kept")
+	}
+
+	// The host accepting the player turns the reservation into membership
+	processResvOK("TEST", 3, common.MatchCommandDataReservation{}, common.MatchCommandDataResvOK{}, other.server, first)
+	if first.groupPointer != other || len(other.reservations) != 0 || reservationGroups[600000003] != nil {
+		t.Error("reservation was not released when the player joined")
+	}
+	if !ReserveGroupSlot(600000003, 600000002, 1) || len(other.reservations) != 0 {
+		t.Error("member of the room was given a reservation")
+	}
+}
@@ -3,11 +3,13 @@ package qr2
 import (
 	"encoding/gob"
 	"fmt"
+	"maps"
 	"math/rand"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 	"wwfc/common"
 	"wwfc/logging"
@@ -41,14 +43,25 @@ type Session struct {
 	messageAckWaker *sleep.Waker
 	groupPointer    *Group
 	GroupName       string
+	Violations      int
+	// Key of the host in heartbeatHosts
+	hostKey uint64
 }
 
 var (
 	sessions          = map[uint64]*Session{}
 	sessionBySearchID = map[uint64]*Session{}
 	mutex             = deadlock.Mutex{}
+
+	// Incremented whenever a session is added, removed or its data changes
+	stateVersion atomic.Uint64
 )
 
+// StateVersion returns a number that changes whenever the server list may have changed
+func StateVersion() uint64 {
+	return stateVersion.Load()
+}
+
 // Remove a session. Expects the global mutex to already be locked.
 func removeSession(addr uint64) {
 	session := sessions[addr]
@@ -56,13 +69,17 @@ func removeSession(addr uint64) {
 		return
 	}
 
+	stateVersion.Add(1)
 	session.messageAckWaker.Assert()
 
 	if session.groupPointer != nil {
 		session.removeFromGroup()
 	}
 
+	forgetHostSession(session, addr)
+
 	if session.login != nil {
+		releaseReservation(session.login.ProfileID)
 		session.login.session = nil
 		session.login = nil
 	}
@@ -79,11 +96,13 @@ func (session *Session) removeFromGroup() {
 		return
 	}
 
+	stateVersion.Add(1)
 	delete(session.groupPointer.players, session)
 
 	if len(session.groupPointer.players) == 0 {
 		logging.Notice("QR2", "Deleting group", aurora.Cyan(session.groupPointer.GroupName))
 		delete(groups, session.groupPointer.GroupName)
+		session.groupPointer.releaseGroupReservations()
 	} else if session.groupPointer.server == session {
 		logging.Notice("QR2", "Server down in group", aurora.Cyan(session.groupPointer.GroupName))
 		session.groupPointer.server = nil
@@ -156,7 +175,9 @@ func setSessionData(moduleName string, addr net.Addr, sessionId uint32, payload
 			}
 		}
 
+		replaceHostSession(moduleName, session, lookupAddr)
 		sessions[lookupAddr] = session
+		stateVersion.Add(1)
 		return *session, true
 	}
 
@@ -167,6 +188,11 @@ func setSessionData(moduleName string, addr net.Addr, sessionId uint32, payload
 		}
 	}
 
+	// Heartbeats mostly repeat the same data, only a change needs the server list to be rebuilt
+	if session.SessionID != sessionId || !maps.Equal(session.Data, payload) {
+		stateVersion.Add(1)
+	}
+
 	session.Data = payload
 	session.LastKeepAlive = time.Now().Unix()
 	session.SessionID = sessionId
@@ -220,6 +246,7 @@ func (session *Session) setProfileID(moduleName string, newPID string, gpcmIP st
 	}
 
 	session.login = loginInfo
+	stateVersion.Add(1)
 
 	// Constraint: only one session can exist with a given profile ID
 	if loginInfo.session != nil {
@@ -281,18 +308,15 @@ func makeLookupAddr(addr string) uint64 {
 // Get a copy of the list of servers
 func GetSessionServers() []map[string]string { //PP look into how to add ingamesn
 	var servers []map[string]string
-	var unreachable []uint64
-	currentTime := time.Now().Unix()
+	now := time.Now()
+	currentTime := now.Unix()
 
 	mutex.Lock()
 	defer mutex.Unlock()
-	for sessionAddr, session := range sessions {
-		// If the last keep alive was over a minute ago then consider the server unreachable
+	for _, session := range sessions {
+		// If the last keep alive was over a minute ago then consider the server unreachable.
+		// The reaper removes it entirely once sessionTimeout passes.
 		if session.LastKeepAlive < currentTime-60 {
-			// If the last keep alive was over an hour ago then remove the server
-			if session.LastKeepAlive < currentTime-((60*60)*1) {
-				unreachable = append(unreachable, sessionAddr)
-			}
 			continue
 		}
 
@@ -300,13 +324,17 @@ func GetSessionServers() []map[string]string { //PP look into how to add ingames
 			continue
 		}
 
-		servers = append(servers, session.Data)
-	}
+		// Nobody can join a shadow banned player, so nobody sees them
+		if session.login != nil && session.login.ShadowBanned {
+			continue
+		}
+
+		// Hide rooms with every slot taken or reserved, anyone picking them now would be kicked
+		if session.groupPointer != nil && session.groupPointer.isFull(now) {
+			continue
+		}
 
-	// Remove unreachable sessions
-	for _, sessionAddr := range unreachable {
-		logging.Notice("QR2", "Removing unreachable session", aurora.BrightCyan(sessions[sessionAddr].Addr.String()))
-		removeSession(sessionAddr)
+		servers = append(servers, session.Data)
 	}
 
 	return servers
@@ -323,6 +351,18 @@ func GetSearchID(addr uint64) uint64 {
 	return 0
 }
 
+// GetProfileID returns the profile ID logged in on the QR2 session at the public address, or 0 if there is none
+func GetProfileID(addr string) uint32 {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if session := sessions[makeLookupAddr(addr)]; session != nil && session.login != nil {
+		return session.login.ProfileID
+	}
+
+	return 0
+}
+
 // Save the sessions to a file. Expects the mutex to be locked.
 func saveSessions() error {
 	file, err := os.OpenFile("state/qr2_sessions.gob", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
@@ -350,11 +390,13 @@ func loadSessions() error {
 		return err
 	}
 
-	for _, session := range sessions {
+	for lookupAddr, session := range sessions {
 		if session.SearchID != 0 {
 			sessionBySearchID[session.SearchID] = session
 		}
 
+		replaceHostSession("QR2", session, lookupAddr)
+
 		session.messageMutex = &deadlock.Mutex{}
 		session.messageAckWaker = &sleep.Waker{}
 		session.groupPointer = nil
@@ -0,0 +1,106 @@
+package qr2
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShadowBannedMatchmaking(t *testing.T) {
+	defer func() {
+		sessions = map[uint64]*Session{}
+		logins = map[uint32]*LoginInfo{}
+	}()
+
+	now := time.Now().Unix()
+	player := addTestSession(1000, now, "2", nil)
+	player.Authenticated = true
+	player.login = &LoginInfo{ProfileID: 600000001, session: player}
+	player.Data["dwc_pid"] = "600000001"
+
+	shadowBanned := addTestSession(1001, now, "2", nil)
+	shadowBanned.Authenticated = true
+	shadowBanned.login = &LoginInfo{ProfileID: 600000002, session: shadowBanned}
+	shadowBanned.Data["dwc_pid"] = "600000002"
+
+	logins[600000001] = player.login
+	logins[600000002] = shadowBanned.login
+	SetShadowBanned(600000002)
+
+	servers := GetSessionServers()
+	if len(servers) != 1 || servers[0]["dwc_pid"] != "600000001" {
+		t.Errorf("shadow banned player was listed: %v", servers)
+	}
+
+	if resvError := checkReservationAllowed("TEST", player, shadowBanned, 3); resvError != "shadow_banned" {
+		t.Errorf("reservation to a shadow banned player returned %q", resvError)
+	}
+	if resvError := checkReservationAllowed("TEST", shadowBanned, player, 2); resvError != "shadow_banned" {
+		t.Errorf("reservation from a shadow banned player returned %q", resvError)
+	}
+}
+
+func TestShadowBannedGroups(t *testing.T) {
+	t.Cleanup(func() {
+		sessions = map[uint64]*Session{}
+		logins = map[uint32]*LoginInfo{}
+		groups = map[string]*Group{}
+	})
+
+	now := time.Now().Unix()
+
+	room := &Group{GroupName: "room", GameName: "mariokartwii", players: map[*Session]bool{}}
+	groups[room.GroupName] = room
+	room.server = addTestSession(1000, now, "2", room)
+	addTestLogin(room.server, 600000001)
+	member := addTestSession(1001, now, "0", room)
+	member.Data["+joinindex"] = "1"
+	addTestLogin(member, 600000002)
+
+	alone := &Group{GroupName: "alone", GameName: "mariokartwii", players: map[*Session]bool{}}
+	groups[alone.GroupName] = alone
+	alone.server = addTestSession(2000, now, "2", alone)
+	addTestLogin(alone.server, 600000003)
+
+	SetShadowBanned(600000002)
+	SetShadowBanned(600000003)
+
+	listed := GetGroups(nil, nil, false)
+	if len(listed) != 1 || listed[0].GroupName != "room" {
+		t.Fatalf("listed groups %+v", listed)
+	}
+	if len(listed[0].Players) != 1 || listed[0].Players["0"].ProfileID != "600000001" {
+		t.Errorf("listed players %+v", listed[0].Players)
+	}
+}
+
+func TestSessionDataStateVersion(t *testing.T) {
+	t.Cleanup(func() {
+		sessions = map[uint64]*Session{}
+		sessionBySearchID = map[uint64]*Session{}
+	})
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 27900}
+	heartbeat := func(payload map[string]string) {
+		if _, ok := setSessionData("TEST", addr, 1, payload); !ok {
+			t.Fatal("setSessionData failed")
+		}
+	}
+
+	version := StateVersion()
+	heartbeat(map[string]string{"gamename": "mariokartwii", "numplayers": "1"})
+	if StateVersion() == version {
+		t.Fatal("state version unchanged by a new session")
+	}
+
+	version = StateVersion()
+	heartbeat(map[string]string{"gamename": "mariokartwii", "numplayers": "1"})
+	if StateVersion() != version {
+		t.Error("state version changed by a heartbeat with the same data")
+	}
+
+	heartbeat(map[string]string{"gamename": "mariokartwii", "numplayers": "2"})
+	if StateVersion() == version {
+		t.Error("state version unchanged by a heartbeat with new data")
+	}
+}
@@ -0,0 +1,144 @@
+package qr2
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+	"wwfc/common"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// heartbeatHost is the state kept for a host reporting heartbeats, identified by its IP and the
+// session ID its QR2 instance picked. The session ID stays the same when a NAT gives the host a new
+// port, so it catches a host re-registering from another port.
+type heartbeatHost struct {
+	// Last heartbeat processed
+	last time.Time
+	// Latest heartbeat held back, processed when the interval is over
+	pending     []byte
+	pendingAddr net.UDPAddr
+	timer       *time.Timer
+	throttling  bool
+	// Session created by the host's heartbeats, 0 if it has none
+	lookupAddr uint64
+}
+
+var (
+	// Minimum time between two heartbeats processed for a host, 0 to disable
+	heartbeatInterval = 500 * time.Millisecond
+
+	heartbeatHosts = map[uint64]*heartbeatHost{}
+)
+
+func makeHeartbeatHostKey(addr string, sessionId uint32) uint64 {
+	ip, _ := common.IPFormatToInt(addr)
+	return (uint64(uint32(ip)) << 32) | uint64(sessionId)
+}
+
+// allowHeartbeat returns false if the heartbeat came too soon after the host's last one. The latest
+// of those is processed once the interval is over, so the host's final state isn't lost.
+func allowHeartbeat(moduleName string, conn net.PacketConn, addr net.UDPAddr, buffer []byte, now time.Time) bool {
+	if heartbeatInterval <= 0 {
+		return true
+	}
+
+	key := makeHeartbeatHostKey(addr.String(), binary.BigEndian.Uint32(buffer[1:5]))
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	host := heartbeatHosts[key]
+	if host == nil {
+		heartbeatHosts[key] = &heartbeatHost{last: now}
+		return true
+	}
+
+	if host.timer == nil && now.Sub(host.last) >= heartbeatInterval {
+		host.last = now
+		host.throttling = false
+		return true
+	}
+
+	if !host.throttling {
+		logging.Warn(moduleName, "Throttling heartbeats, processing at most one every", aurora.Cyan(heartbeatInterval))
+		host.throttling = true
+	}
+
+	host.pending = buffer
+	host.pendingAddr = addr
+	if host.timer == nil {
+		host.timer = time.AfterFunc(host.last.Add(heartbeatInterval).Sub(now), func() {
+			flushHeartbeat(conn, key, host)
+		})
+	}
+
+	return false
+}
+
+// flushHeartbeat processes the heartbeat held back for the host
+func flushHeartbeat(conn net.PacketConn, key uint64, host *heartbeatHost) {
+	mutex.Lock()
+	if heartbeatHosts[key] != host || host.pending == nil || inShutdown {
+		mutex.Unlock()
+		return
+	}
+
+	buffer, addr := host.pending, host.pendingAddr
+	host.pending = nil
+	host.timer = nil
+	host.last = time.Now()
+	mutex.Unlock()
+
+	heartbeat("QR2:"+addr.String(), conn, addr, buffer)
+}
+
+// replaceHostSession removes the session the host registered from another port, so it isn't listed
+// twice, and records the new one. Expects the global mutex to already be locked.
+func replaceHostSession(moduleName string, session *Session, lookupAddr uint64) {
+	key := makeHeartbeatHostKey(session.Addr.String(), session.SessionID)
+	session.hostKey = key
+
+	host := heartbeatHosts[key]
+	if host == nil {
+		host = &heartbeatHost{last: time.Now()}
+		heartbeatHosts[key] = host
+	}
+
+	if old := host.lookupAddr; old != 0 && old != lookupAddr && sessions[old] != nil {
+		logging.Notice(moduleName, "Replacing session", aurora.BrightCyan(sessions[old].Addr.String()), "from the same host")
+		removeSession(old)
+	}
+
+	host.lookupAddr = lookupAddr
+}
+
+// forgetHostSession is called when a session is removed. Expects the global mutex to already be locked.
+func forgetHostSession(session *Session, lookupAddr uint64) {
+	host := heartbeatHosts[session.hostKey]
+	if host != nil && host.lookupAddr == lookupAddr {
+		host.lookupAddr = 0
+	}
+}
+
+// reapHeartbeatHosts removes the state of hosts without a session that stopped sending heartbeats.
+// Expects the global mutex to already be locked.
+func reapHeartbeatHosts(cutoff time.Time) {
+	for key, host := range heartbeatHosts {
+		if host.lookupAddr == 0 && host.timer == nil && host.last.Before(cutoff) {
+			delete(heartbeatHosts, key)
+		}
+	}
+}
+
+// stopHeartbeatTimers drops the heartbeats held back. Expects the global mutex to already be locked.
+func stopHeartbeatTimers() {
+	for _, host := range heartbeatHosts {
+		if host.timer != nil {
+			host.timer.Stop()
+			host.timer = nil
+			host.pending = nil
+		}
+	}
+}
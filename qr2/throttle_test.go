@@ -0,0 +1,91 @@
+package qr2
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatThrottle(t *testing.T) {
+	oldInterval := heartbeatInterval
+	heartbeatInterval = time.Minute
+	defer func() {
+		stopHeartbeatTimers()
+		heartbeatInterval = oldInterval
+		heartbeatHosts = map[uint64]*heartbeatHost{}
+	}()
+
+	addr := net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	buffer := binary.BigEndian.AppendUint32([]byte{HeartbeatRequest}, 1234)
+	now := time.Unix(100000, 0)
+
+	if !allowHeartbeat("TEST", nil, addr, buffer, now) {
+		t.Fatal("first heartbeat was throttled")
+	}
+
+	// Another port with the same session ID is the same host
+	addr.Port = 1001
+	latest := append(append([]byte{}, buffer...), 'x')
+	if allowHeartbeat("TEST", nil, addr, buffer, now.Add(time.Second)) || allowHeartbeat("TEST", nil, addr, latest, now.Add(2*time.Second)) {
+		t.Fatal("heartbeat within the interval was allowed")
+	}
+
+	host := heartbeatHosts[makeHeartbeatHostKey(addr.String(), 1234)]
+	if host.timer == nil || string(host.pending) != string(latest) {
+		t.Error("the latest throttled heartbeat isn't held back")
+	}
+
+	other := binary.BigEndian.AppendUint32([]byte{HeartbeatRequest}, 5678)
+	if !allowHeartbeat("TEST", nil, addr, other, now.Add(time.Second)) {
+		t.Error("heartbeat from another session ID was throttled")
+	}
+}
+
+func TestHeartbeatHostDedupe(t *testing.T) {
+	defer func() {
+		sessions = map[uint64]*Session{}
+		sessionBySearchID = map[uint64]*Session{}
+		heartbeatHosts = map[uint64]*heartbeatHost{}
+	}()
+
+	first := net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+	if _, ok := setSessionData("TEST", &first, 1234, map[string]string{}); !ok {
+		t.Fatal("failed to create the first session")
+	}
+
+	second := net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1001}
+	if _, ok := setSessionData("TEST", &second, 1234, map[string]string{}); !ok {
+		t.Fatal("failed to create the second session")
+	}
+
+	if sessions[makeLookupAddr(first.String())] != nil {
+		t.Error("session from the old port was kept")
+	}
+	if sessions[makeLookupAddr(second.String())] == nil {
+		t.Error("session from the new port was removed")
+	}
+
+	// A different session ID from the same IP is another console behind the same NAT
+	third := net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1002}
+	if _, ok := setSessionData("TEST", &third, 5678, map[string]string{}); !ok {
+		t.Fatal("failed to create the third session")
+	}
+	if sessions[makeLookupAddr(second.String())] == nil {
+		t.Error("session with another session ID was removed")
+	}
+
+	// The host's state goes once its session is removed and it stops sending heartbeats
+	mutex.Lock()
+	removeSession(makeLookupAddr(second.String()))
+	reapHeartbeatHosts(time.Now().Add(time.Minute))
+	_, kept := heartbeatHosts[makeHeartbeatHostKey(second.String(), 1234)]
+	mutex.Unlock()
+
+	if kept {
+		t.Error("state of a host without a session wasn't reaped")
+	}
+	if len(heartbeatHosts) != 1 {
+		t.Errorf("%d hosts left, expected 1", len(heartbeatHosts))
+	}
+}
@@ -0,0 +1,188 @@
+package qr2
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"wwfc/common"
+	"wwfc/inspect"
+)
+
+const (
+	maxHeartbeatKeys     = 64
+	maxHeartbeatKey      = 64
+	maxHeartbeatValue    = 256
+	maxSessionViolations = 5
+	maxPlayerCount       = 32
+)
+
+// Charset checks for the standard keys every DWC host reports
+var heartbeatKeyCheckers = map[string]func(string) bool{
+	"gamename":      isAlphanumeric,
+	"publicip":      isInteger,
+	"publicport":    isInteger,
+	"localport":     isInteger,
+	"natneg":        isInteger,
+	"statechanged":  isInteger,
+	"numplayers":    isPlayerCount,
+	"maxplayers":    isPlayerCount,
+	"dwc_mver":      isInteger,
+	"dwc_pid":       isInteger,
+	"dwc_mtype":     isInteger,
+	"dwc_mresv":     isInteger,
+	"dwc_hoststate": isInteger,
+	"dwc_suspend":   isInteger,
+}
+
+func isInteger(value string) bool {
+	_, err := strconv.ParseInt(value, 10, 64)
+	return err == nil
+}
+
+// DWC rooms can't hold more than 32 players, a bigger count would throw off the reservations
+func isPlayerCount(value string) bool {
+	count, err := strconv.ParseUint(value, 10, 8)
+	return err == nil && count <= maxPlayerCount
+}
+
+func isAlphanumeric(value string) bool {
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func isIPv4(value string) bool {
+	ip := net.ParseIP(value)
+	return ip != nil && ip.To4() != nil
+}
+
+func isValidKey(key string) bool {
+	if len(key) == 0 || len(key) > maxHeartbeatKey {
+		return false
+	}
+
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Check a standard key's value, returns false if the key has no checker
+func checkKnownKey(key string, value string) (known bool, valid bool) {
+	if checker, ok := heartbeatKeyCheckers[key]; ok {
+		return true, checker(value)
+	}
+
+	if strings.HasPrefix(key, "localip") && isInteger(key[len("localip"):]) {
+		return true, isIPv4(value)
+	}
+
+	return false, false
+}
+
+// sanitizeHeartbeat returns a copy of the heartbeat payload with every invalid key removed,
+// and a description of each problem found. Only the sanitized copy may be stored in the
+// session, since session data is forwarded to other clients by the server browser.
+// The standard keys are always kept when valid, a payload with too many keys only loses the others.
+func sanitizeHeartbeat(payload map[string]string) (map[string]string, []string) {
+	var violations []string
+	sanitized := map[string]string{}
+	var others []string
+
+	var allowedKeys map[string]bool
+	var matchVersions []string
+	if gameInfo := common.GetGameInfoByName(payload["gamename"]); gameInfo != nil {
+		if len(gameInfo.QR2Keys) != 0 {
+			allowedKeys = map[string]bool{}
+			for _, key := range gameInfo.QR2Keys {
+				allowedKeys[key] = true
+			}
+		}
+		matchVersions = gameInfo.MatchVersions
+	}
+
+	if len(payload) > maxHeartbeatKeys {
+		violations = append(violations, "too many keys ("+strconv.Itoa(len(payload))+")")
+	}
+
+	for key, value := range payload {
+		if !isValidKey(key) {
+			violations = append(violations, "invalid key "+strconv.Quote(key[:min(len(key), maxHeartbeatKey)]))
+			continue
+		}
+
+		if len(value) > maxHeartbeatValue {
+			violations = append(violations, "value too long for key "+key)
+			continue
+		}
+
+		if known, valid := checkKnownKey(key, value); known {
+			if !valid {
+				violations = append(violations, "invalid value for key "+key+": "+strconv.Quote(value))
+				continue
+			}
+
+			if key == "dwc_mver" && matchVersions != nil && !slices.Contains(matchVersions, value) {
+				violations = append(violations, "unsupported dwc_mver "+value)
+				continue
+			}
+		} else if allowedKeys != nil && !allowedKeys[key] {
+			violations = append(violations, "unexpected key "+key)
+			continue
+		}
+
+		if _, standard := heartbeatKeyCheckers[key]; !standard {
+			others = append(others, key)
+			continue
+		}
+
+		sanitized[key] = value
+	}
+
+	// Sorted so the same payload always keeps the same keys
+	slices.Sort(others)
+	for _, key := range others {
+		if len(sanitized) >= maxHeartbeatKeys {
+			break
+		}
+		sanitized[key] = payload[key]
+	}
+
+	return sanitized, violations
+}
+
+// inspectHeartbeat removes the values matching a signature that drops them, and returns a
+// violation for each
+func inspectHeartbeat(moduleName string, addr net.UDPAddr, payload map[string]string) []string {
+	mutex.Lock()
+	profileId := uint32(0)
+	if session := sessions[makeLookupAddr(addr.String())]; session != nil && session.login != nil {
+		profileId = session.login.ProfileID
+	}
+	mutex.Unlock()
+
+	var violations []string
+	gameName := payload["gamename"]
+	for key, value := range payload {
+		if !inspect.Inspect(moduleName, inspect.Payload{
+			Target:    inspect.TargetHeartbeat,
+			Game:      gameName,
+			Command:   -1,
+			Key:       key,
+			Data:      []byte(value),
+			ProfileID: profileId,
+			Address:   addr.String(),
+		}) {
+			delete(payload, key)
+			violations = append(violations, "blocked payload for key "+key)
+		}
+	}
+
+	return violations
+}
@@ -0,0 +1,123 @@
+package qr2
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"wwfc/inspect"
+)
+
+func TestSanitizeHeartbeat(t *testing.T) {
+	payload := map[string]string{
+		"gamename":      "mariokartwii",
+		"localip0":      "192.168.1.20",
+		"localport":     "56789",
+		"natneg":        "1",
+		"statechanged":  "3",
+		"publicip":      "0",
+		"publicport":    "0",
+		"numplayers":    "1",
+		"maxplayers":    "12",
+		"dwc_mver":      "90",
+		"dwc_pid":       "600000000",
+		"dwc_mtype":     "0",
+		"dwc_hoststate": "2",
+		"rk":            "vs",
+		"ev":            "5000",
+
+		"localip1":    "not an ip",
+		"numplayers2": "1",
+		"dwc_suspend": "0 or 1=1",
+		"bad key":     "1",
+		"hostname":    strings.Repeat("A", maxHeartbeatValue+1),
+	}
+
+	sanitized, violations := sanitizeHeartbeat(payload)
+
+	for _, key := range []string{"gamename", "localip0", "dwc_pid", "rk", "ev", "numplayers2"} {
+		if sanitized[key] != payload[key] {
+			t.Errorf("valid key %s was not kept", key)
+		}
+	}
+
+	for _, key := range []string{"localip1", "dwc_suspend", "bad key", "hostname"} {
+		if _, ok := sanitized[key]; ok {
+			t.Errorf("invalid key %s was kept", key)
+		}
+	}
+
+	if len(violations) != 4 {
+		t.Errorf("got %d violations, expected 4: %v", len(violations), violations)
+	}
+
+	if _, ok := payload["localip1"]; !ok {
+		t.Error("the original payload was modified")
+	}
+}
+
+func TestSanitizeHeartbeatKeyCount(t *testing.T) {
+	payload := map[string]string{}
+	for i := 0; i < maxHeartbeatKeys*2; i++ {
+		payload["key"+strconv.Itoa(i)] = "1"
+	}
+	required := map[string]string{"gamename": "mariokartwii", "dwc_pid": "600000000", "dwc_mtype": "0", "publicip": "0", "publicport": "0", "dwc_hoststate": "2"}
+	for key, value := range required {
+		payload[key] = value
+	}
+
+	sanitized, violations := sanitizeHeartbeat(payload)
+	if len(sanitized) != maxHeartbeatKeys {
+		t.Errorf("kept %d keys, expected %d", len(sanitized), maxHeartbeatKeys)
+	}
+
+	for key, value := range required {
+		if sanitized[key] != value {
+			t.Errorf("standard key %s was dropped", key)
+		}
+	}
+
+	// The same keys are kept every time
+	again, _ := sanitizeHeartbeat(payload)
+	if !reflect.DeepEqual(sanitized, again) {
+		t.Error("a different set of keys was kept for the same payload")
+	}
+
+	if len(violations) == 0 {
+		t.Error("no violation reported for too many keys")
+	}
+}
+
+func TestInspectHeartbeat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signatures.xml")
+	err := os.WriteFile(path, []byte(`<payloadSignatures>
+	<signature name="long-name" game="mariokartwii" target="heartbeat" key="p0" maxLength="4" />
+	<signature name="flag-only" target="heartbeat" key="p1" maxLength="4" action="flag" />
+</payloadSignatures>`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inspect.SetFile(path)
+	t.Cleanup(func() { inspect.SetFile("") })
+
+	payload := map[string]string{"gamename": "mariokartwii", "p0": "AAAAA", "p1": "AAAAA", "p2": "AAAAA"}
+	violations := inspectHeartbeat("QR2:test", net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5678}, payload)
+
+	if _, ok := payload["p0"]; ok || len(violations) != 1 || !strings.Contains(violations[0], "p0") {
+		t.Errorf("p0 wasn't removed: %v %v", payload, violations)
+	}
+	if payload["p1"] != "AAAAA" || payload["p2"] != "AAAAA" {
+		t.Errorf("flagged or unmatched key was removed: %v", payload)
+	}
+}
+
+func TestPlayerCountKeys(t *testing.T) {
+	for value, expected := range map[string]bool{"0": true, "12": true, "32": true, "33": false, "-1": false, "4294967296": false} {
+		if _, valid := checkKnownKey("maxplayers", value); valid != expected {
+			t.Errorf("maxplayers %s: valid %v, expected %v", value, valid, expected)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+	"wwfc/common"
+)
+
+// Read buffers of each size in use, a connection holds one for as long as it's open
+var (
+	readBufferPools      = map[int]*sync.Pool{}
+	readBufferPoolsMutex sync.Mutex
+)
+
+func readBufferPool(size int) *sync.Pool {
+	readBufferPoolsMutex.Lock()
+	defer readBufferPoolsMutex.Unlock()
+
+	pool := readBufferPools[size]
+	if pool == nil {
+		pool = &sync.Pool{New: func() any {
+			buffer := make([]byte, size)
+			return &buffer
+		}}
+		readBufferPools[size] = pool
+	}
+
+	return pool
+}
+
+// getReadBuffer returns a buffer of the size from the pool, or of the default size if it's not set
+func getReadBuffer(size int) []byte {
+	if size <= 0 {
+		size = common.DefaultReadBufferSize
+	}
+
+	return *readBufferPool(size).Get().(*[]byte)
+}
+
+// putReadBuffer returns a buffer to the pool of its size once nothing refers to it
+func putReadBuffer(buffer []byte) {
+	readBufferPool(len(buffer)).Put(&buffer)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+	"wwfc/common"
+)
+
+// packetBackend passes on the packets forwarded by the frontend
+type packetBackend struct {
+	opened  chan uint64
+	packets chan []byte
+}
+
+func (b *packetBackend) NewConnection(args RPCPacket, _ *struct{}) error {
+	b.opened <- args.Index
+	return nil
+}
+
+func (b *packetBackend) HandlePacket(args RPCPacket, _ *struct{}) error {
+	data, err := common.DecompressData(args.Data, args.Compressed)
+	b.packets <- data
+	return err
+}
+
+func (b *packetBackend) CloseConnection(args RPCPacket, _ *struct{}) error {
+	return nil
+}
+
+func TestReadBufferSize(t *testing.T) {
+	backend := &packetBackend{opened: make(chan uint64, 1), packets: make(chan []byte, 4)}
+	server := rpc.NewServer()
+	if err := server.RegisterName("RPCPacket", backend); err != nil {
+		t.Fatal(err)
+	}
+
+	frontendSide, backendSide := net.Pipe()
+	go server.ServeConn(backendSide)
+	rpcClient = rpc.NewClient(frontendSide)
+
+	connections["buffertest"] = newConnectionMap()
+	t.Cleanup(func() {
+		rpcClient.Close()
+		rpcClient = nil
+		delete(connections, "buffertest")
+	})
+
+	receive := func() []byte {
+		select {
+		case data := <-backend.packets:
+			return data
+		case <-time.After(5 * time.Second):
+			t.Fatal("packet wasn't forwarded")
+			return nil
+		}
+	}
+
+	for _, size := range []int{0, 4096} {
+		client, remote := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			handleConnection(serverInfo{rpcName: "buffertest", readBufferSize: size}, remote, uint64(size+1))
+			close(done)
+		}()
+		<-backend.opened
+
+		// Reads of the same buffer must not change packets already forwarded
+		first := bytes.Repeat([]byte{1}, 3000)
+		second := bytes.Repeat([]byte{2}, 100)
+		go func() {
+			client.Write(first)
+			client.Write(second)
+		}()
+
+		expected := size
+		if size == 0 {
+			expected = common.DefaultReadBufferSize
+		}
+
+		var received []byte
+		if data := receive(); len(data) != min(expected, len(first)) {
+			t.Errorf("read %d bytes with a buffer of %d, expected %d", len(data), size, min(expected, len(first)))
+		} else {
+			received = append(received, data...)
+		}
+		for len(received) < len(first)+len(second) && !t.Failed() {
+			received = append(received, receive()...)
+		}
+
+		if !bytes.Equal(received, append(first, second...)) {
+			t.Errorf("packets were changed with a buffer of %d", size)
+		}
+
+		client.Close()
+		<-done
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync/atomic"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+var (
+	// Set once every frontend listener is started
+	listenersReady atomic.Bool
+	// Set once the backend reported every server started, cleared while it's restarting
+	backendServersReady atomic.Bool
+	// Backend servers that failed to start, reported by the health check
+	failedBackendServers atomic.Pointer[[]string]
+	// Set once READY is logged for the current backend
+	readyLogged atomic.Bool
+)
+
+// resetReadiness is called when the backend is about to start or restart
+func resetReadiness() {
+	backendServersReady.Store(false)
+	failedBackendServers.Store(nil)
+	readyLogged.Store(false)
+}
+
+// checkBackendReadiness asks the backend the frontend just connected to whether all of its
+// servers started. Expects the RPC mutex to be unlocked.
+func checkBackendReadiness() {
+	rpcMutex.RLock()
+	client := rpcClient
+	rpcMutex.RUnlock()
+
+	if client == nil {
+		return
+	}
+
+	var readiness BackendReadiness
+	if err := client.Call("RPCPacket.Readiness", struct{}{}, &readiness); err != nil {
+		logging.Error("FRONTEND", "Failed to get the backend's readiness:", err)
+		return
+	}
+
+	if len(readiness.Failed) != 0 {
+		failed := failedServerNames(readiness.Failed)
+		failedBackendServers.Store(&failed)
+		for _, name := range failed {
+			logging.Error("FRONTEND", "Backend server", aurora.Cyan(name), "failed to start:", readiness.Failed[name])
+		}
+		return
+	}
+
+	backendServersReady.Store(true)
+	logReady()
+}
+
+// setListenersReady is called once every listener is started
+func setListenersReady() {
+	listenersReady.Store(true)
+	logReady()
+}
+
+// logReady logs the READY line once the listeners and backend are both up
+func logReady() {
+	if !isReady() || !readyLogged.CompareAndSwap(false, true) {
+		return
+	}
+
+	var names []string
+	for name := range connections {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	logging.Notice("FRONTEND", aurora.BrightGreen("READY"), "- listening for", aurora.BrightCyan(strings.Join(names, ", ")), "with every backend server started")
+}
+
+func isReady() bool {
+	return listenersReady.Load() && backendServersReady.Load()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+)
+
+// readinessBackend reports a fixed readiness
+type readinessBackend struct {
+	readiness BackendReadiness
+}
+
+func (b *readinessBackend) Readiness(_ struct{}, readiness *BackendReadiness) error {
+	*readiness = b.readiness
+	return nil
+}
+
+func TestBackendReadiness(t *testing.T) {
+	backend := &readinessBackend{}
+	server := rpc.NewServer()
+	if err := server.RegisterName("RPCPacket", backend); err != nil {
+		t.Fatal(err)
+	}
+
+	frontendSide, backendSide := net.Pipe()
+	go server.ServeConn(backendSide)
+	rpcClient = rpc.NewClient(frontendSide)
+	t.Cleanup(func() {
+		rpcClient.Close()
+		rpcClient = nil
+		listenersReady.Store(false)
+		resetReadiness()
+	})
+
+	backend.readiness = BackendReadiness{Started: []string{"gpsp"}, Failed: map[string]string{"gpcm": "database unreachable"}}
+	resetReadiness()
+	setListenersReady()
+	checkBackendReadiness()
+
+	if failed := failedBackendServers.Load(); failed == nil || len(*failed) != 1 || (*failed)[0] != "gpcm" {
+		t.Errorf("failed servers weren't reported: %v", failed)
+	}
+	if isReady() || readyLogged.Load() {
+		t.Error("ready with a failed server")
+	}
+
+	// The backend restarted without the failure
+	backend.readiness = BackendReadiness{Started: []string{"gpcm", "gpsp"}}
+	resetReadiness()
+	checkBackendReadiness()
+
+	if failedBackendServers.Load() != nil || !isReady() || !readyLogged.Load() {
+		t.Error("not ready once every server started")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/rpc"
+	"sync/atomic"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// Servers that keep nothing between packets, so a connection that outlived a backend crash can
+// carry on with a new session. The others lose state the client won't send again (a GPCM login,
+// the server browser's encryption, a gamestats challenge, a half read HTTP request), their
+// clients only start over on a new connection.
+var recoverableServers = map[string]bool{
+	"gpsp": true,
+}
+
+var (
+	// Set from losing the backend until the backend that replaces it knows about the connections
+	// that were kept
+	backendRecovering atomic.Bool
+	// Set once the frontend shuts the backend down on exit
+	frontendStopping atomic.Bool
+
+	errNotRecoverable = errors.New("connection can't be recovered after a backend crash")
+)
+
+// isBackendLost checks if a call to the backend failed because the connection to it is gone
+func isBackendLost(err error) bool {
+	return errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// watchBackendProcess waits for the backend process started by the frontend to exit. A backend
+// that is shut down is replaced along with the client before the lock is released, so finding the
+// same client means it exited on its own.
+func watchBackendProcess(process *backendProcessState, client *rpc.Client) {
+	err := <-process.exited
+	if err != nil {
+		logging.Error("FRONTEND", "Backend process exited:", err)
+	}
+
+	backendLost(client)
+}
+
+// backendLost waits for a backend that crashed to come back, restarting it if the frontend runs
+// it. The connections are kept, the new backend is told about the ones it can carry on with and
+// the others are closed before anything else is forwarded.
+func backendLost(client *rpc.Client) {
+	if frontendStopping.Load() {
+		return
+	}
+
+	rpcMutex.Lock()
+	if rpcClient != client {
+		// Already recovered, or shut down on purpose and replaced
+		rpcMutex.Unlock()
+		return
+	}
+
+	// Calls to the lost backend fail right away
+	rpcBusyCount.Wait()
+
+	logging.Error("FRONTEND", "Lost the backend, keeping the connections until it restarts")
+	client.Close()
+	backendRecovering.Store(true)
+
+	// Unlocks the mutex once connected
+	if process := backendProcess; process != nil {
+		process.cmd.Process.Kill()
+		startBackendProcess(false, true)
+	} else {
+		waitForBackend()
+	}
+}
+
+// recoverConnections tells a backend that replaced a crashed one about the connections that were
+// kept. A connection its server can't recover is closed without telling the backend, which never
+// knew about it. Expects the RPC mutex to be locked, so no packet reaches the backend before the
+// connection does.
+func recoverConnections() {
+	recovered, closed := 0, 0
+	for server, serverConnections := range connections {
+		for index, conn := range serverConnections.all() {
+			if !conn.announced.Load() || conn.ctx.Err() != nil {
+				continue
+			}
+
+			err := rpcClient.Call("RPCPacket.NewConnection", RPCPacket{Server: server, Index: index, Address: conn.RemoteAddr().String(), Data: []byte{}, Recovered: true, TraceID: conn.traceID}, nil)
+			if err == nil {
+				recovered++
+				continue
+			}
+
+			if err.Error() != errNotRecoverable.Error() {
+				logging.Error("FRONTEND", "Failed to recover connection", aurora.BrightCyan(server), aurora.Cyan(index), "-", err)
+			}
+
+			if serverConnections.remove(index, conn) {
+				conn.cancel(closeReasonBackendLost)
+				closed++
+			}
+		}
+	}
+
+	logging.Notice("FRONTEND", "Recovered", aurora.Cyan(recovered), "connections after losing the backend, closed", aurora.Cyan(closed))
+}
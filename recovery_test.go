@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func TestRecoverConnections(t *testing.T) {
+	sessions, mutex := fakeServerSessions(t, "gpsp", func(uint64) {})
+	connections["gpcm"] = newConnectionMap()
+	defer delete(connections, "gpcm")
+
+	addConn := func(server string, index uint64, announced bool) *frontendConn {
+		client, remote := net.Pipe()
+		t.Cleanup(func() { client.Close() })
+
+		conn := newFrontendConn(remote)
+		t.Cleanup(func() { conn.cancel(nil) })
+		conn.announced.Store(announced)
+		connections[server].add(index, conn)
+		return conn
+	}
+
+	kept := addConn("gpsp", 1, true)
+	opening := addConn("gpsp", 2, false)
+	lost := addConn("gpcm", 3, true)
+
+	recoverConnections()
+
+	if connections["gpsp"].get(1) != kept || kept.ctx.Err() != nil {
+		t.Error("GPSP connection wasn't kept")
+	}
+	if connections["gpsp"].get(2) != opening || opening.ctx.Err() != nil {
+		t.Error("connection the backend didn't know about yet was touched")
+	}
+
+	if connections["gpcm"].get(3) != nil {
+		t.Error("GPCM connection is still in the map")
+	}
+	if cause := context.Cause(lost.ctx); cause != closeReasonBackendLost {
+		t.Errorf("GPCM connection closed with %v, expected %v", cause, closeReasonBackendLost)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(sessions) != 1 || !sessions[1] {
+		t.Errorf("backend has sessions %v, expected only 1", sessions)
+	}
+}
+
+func TestNewConnectionNotRecoverable(t *testing.T) {
+	opened := false
+	oldNew := newServerConnection
+	newServerConnection = func(string, uint64, string, string) { opened = true }
+	defer func() { newServerConnection = oldNew }()
+
+	err := (&RPCPacket{}).NewConnection(RPCPacket{Server: "gpcm", Index: 1, Address: "127.0.0.1:1", Recovered: true}, nil)
+	if err != errNotRecoverable {
+		t.Errorf("got %v, expected errNotRecoverable", err)
+	}
+	if opened {
+		t.Error("session was opened for a connection the server can't recover")
+	}
+}
+
+func TestVerifyStateAfterCrash(t *testing.T) {
+	rpcMutex.Lock()
+	defer rpcMutex.Unlock()
+
+	backendRecovering.Store(true)
+	defer backendRecovering.Store(false)
+
+	oldUuid := frontendUuid
+	frontendUuid = "saved"
+	defer func() { frontendUuid = oldUuid }()
+
+	connections["verifytest"] = newConnectionMap()
+	defer delete(connections, "verifytest")
+	conn := newFrontendConn(&discardConn{})
+	defer conn.cancel(nil)
+	connections["verifytest"].add(1, conn)
+
+	// Even a matching UUID is older than the connections that were kept
+	reload := true
+	if err := (&RPCFrontendPacket{}).VerifyState("saved", &reload); err != nil {
+		t.Fatal(err)
+	}
+	if reload {
+		t.Error("backend told to load its state after a crash")
+	}
+	if connections["verifytest"].get(1) != conn {
+		t.Error("connection was closed")
+	}
+}
+
+func TestBackendLostReplacedClient(t *testing.T) {
+	frontendSide, backendSide := net.Pipe()
+	defer backendSide.Close()
+	old := rpc.NewClient(frontendSide)
+	defer old.Close()
+
+	done := make(chan struct{})
+	go func() {
+		// Stands in for a backend that was shut down and replaced before its process exited
+		backendLost(old)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("backendLost waited for a backend that was already replaced")
+	}
+
+	if backendRecovering.Load() {
+		t.Error("recovering from a backend that was replaced")
+	}
+}
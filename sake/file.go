@@ -0,0 +1,438 @@
+package sake
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"wwfc/common"
+	"wwfc/database"
+	"wwfc/gamestats"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// Values of the Sake-File-Result header, from the GameSpy SDK
+const (
+	FileResultSuccess       = 0
+	FileResultBadHttpMethod = 1
+	FileResultBadFileCount  = 2
+	FileResultInvalidGameID = 3
+	FileResultInvalidFileID = 4
+	FileResultFileNotFound  = 5
+	FileResultFileTooLarge  = 6
+	FileResultServerError   = 7
+	FileResultUnknownError  = 8
+)
+
+const (
+	fileCleanupInterval = time.Hour
+	// Room for the multipart headers around the file itself
+	multipartOverhead = 16 * 1024
+)
+
+// fileValidator inspects the start of an uploaded file before it is accepted
+type fileValidator struct {
+	headerSize int
+	validate   func(header []byte, size int) error
+}
+
+var (
+	fileDirectory   string
+	maxFileSize     int
+	gameFileLimits  map[string]int
+	maxProfileFiles int
+	maxProfileBytes int64
+
+	fileValidators = map[string]fileValidator{}
+
+	filesUploaded      atomic.Uint64
+	filesDownloaded    atomic.Uint64
+	uploadsTooLarge    atomic.Uint64
+	uploadsOverQuota   atomic.Uint64
+	uploadsInvalid     atomic.Uint64
+	orphanedFilesFreed atomic.Uint64
+)
+
+// FileStats counts SAKE file transfers, rejected uploads are a sign of abuse
+type FileStats struct {
+	Uploaded      uint64 `json:"uploaded"`
+	Downloaded    uint64 `json:"downloaded"`
+	TooLarge      uint64 `json:"rejected_too_large"`
+	OverQuota     uint64 `json:"rejected_over_quota"`
+	Invalid       uint64 `json:"rejected_invalid"`
+	OrphansFreed  uint64 `json:"orphans_deleted"`
+	RejectedTotal uint64 `json:"rejected"`
+}
+
+func GetFileStats() FileStats {
+	stats := FileStats{
+		Uploaded:     filesUploaded.Load(),
+		Downloaded:   filesDownloaded.Load(),
+		TooLarge:     uploadsTooLarge.Load(),
+		OverQuota:    uploadsOverQuota.Load(),
+		Invalid:      uploadsInvalid.Load(),
+		OrphansFreed: orphanedFilesFreed.Load(),
+	}
+	stats.RejectedTotal = stats.TooLarge + stats.OverQuota + stats.Invalid
+	return stats
+}
+
+// RegisterFileValidator sets a check run on every file uploaded for the game. The first
+// headerSize bytes of the file are passed along with its full size, returning an error rejects it.
+func RegisterFileValidator(gameName string, headerSize int, validate func(header []byte, size int) error) {
+	fileValidators[gameName] = fileValidator{headerSize, validate}
+}
+
+func loadFileConfig(config common.Config) {
+	fileDirectory = config.SakeFileDirectory
+	maxFileSize = *config.SakeMaxFileSize
+	maxProfileFiles = *config.SakeMaxProfileFiles
+	maxProfileBytes = int64(*config.SakeMaxProfileBytes)
+
+	gameFileLimits = map[string]int{}
+	for _, limit := range config.SakeFileLimits {
+		gameFileLimits[limit.Name] = limit.MaxFileSize
+	}
+}
+
+// fileSizeLimit returns the largest file the game can upload
+func fileSizeLimit(gameName string) int {
+	if game := common.GetGameInfoByName(gameName); game != nil && game.SakeMaxFileSize > 0 {
+		return game.SakeMaxFileSize
+	}
+	if limit, ok := gameFileLimits[gameName]; ok {
+		return limit
+	}
+	return maxFileSize
+}
+
+func filePath(fileId int32) string {
+	return filepath.Join(fileDirectory, strconv.FormatInt(int64(fileId), 10))
+}
+
+func writeFileResult(w http.ResponseWriter, result int) {
+	w.Header().Set("Sake-File-Result", strconv.Itoa(result))
+	w.WriteHeader(http.StatusOK)
+}
+
+// readUploadedFile reads the single file from a multipart upload, failing with
+// FileResultFileTooLarge if it is larger than limit
+func readUploadedFile(r *http.Request, limit int) ([]byte, int, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, FileResultUnknownError, err
+	}
+
+	var data []byte
+	files := 0
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, FileResultUnknownError, err
+		}
+
+		if part.FileName() == "" {
+			continue
+		}
+
+		files++
+		if files > 1 {
+			return nil, FileResultBadFileCount, errors.New("more than one file uploaded")
+		}
+
+		data, err = readFilePart(part, limit)
+		if err != nil {
+			return nil, FileResultFileTooLarge, err
+		}
+	}
+
+	if files == 0 {
+		return nil, FileResultBadFileCount, errors.New("no file uploaded")
+	}
+
+	return data, FileResultSuccess, nil
+}
+
+func readFilePart(part *multipart.Part, limit int) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(part, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > limit {
+		return nil, fmt.Errorf("file is larger than %d bytes", limit)
+	}
+
+	return data, nil
+}
+
+// validateFile runs the game's validator on the file, if it has one
+func validateFile(gameName string, data []byte) error {
+	validator, ok := fileValidators[gameName]
+	if !ok {
+		return nil
+	}
+
+	header := data[:min(validator.headerSize, len(data))]
+	return validator.validate(header, len(data))
+}
+
+// getUploader authenticates the uploader from the login ticket GPCM issued it, like the storage
+// requests. The pid the game adds to the URL is only checked against the ticket.
+func getUploader(moduleName string, query url.Values) (uint32, bool) {
+	profileId, _, err := common.UnmarshalGPCMLoginTicket(query.Get("loginticket"))
+	if err != nil {
+		logging.Error(moduleName, "Invalid upload login ticket:", err)
+		return 0, false
+	}
+
+	if pid := query.Get("pid"); pid != "" && pid != strconv.FormatUint(uint64(profileId), 10) {
+		logging.Error(moduleName, "Upload profile ID", aurora.Cyan(pid), "doesn't match the login ticket's", aurora.Cyan(profileId))
+		return 0, false
+	}
+
+	return profileId, true
+}
+
+func handleFileUpload(moduleName string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeFileResult(w, FileResultBadHttpMethod)
+		return
+	}
+
+	query := r.URL.Query()
+	gameId, _ := strconv.Atoi(query.Get("gameid"))
+	gameInfo := common.CheckGameByID(moduleName, gameId, common.GameServiceSake)
+	if gameInfo == nil {
+		writeFileResult(w, FileResultInvalidGameID)
+		return
+	}
+
+	profileId, ok := getUploader(moduleName, query)
+	if !ok {
+		writeFileResult(w, FileResultUnknownError)
+		return
+	}
+
+	moduleName += ":" + strconv.FormatUint(uint64(profileId), 10)
+
+	limit := fileSizeLimit(gameInfo.Name)
+	r.Body = http.MaxBytesReader(w, r.Body, int64(limit)+multipartOverhead)
+
+	data, result, err := readUploadedFile(r, limit)
+	if result == FileResultFileTooLarge {
+		uploadsTooLarge.Add(1)
+		logging.Warn(moduleName, "Rejected", aurora.BrightCyan(gameInfo.Name), "upload of", aurora.Cyan(r.ContentLength), "bytes:", err)
+		writeFileResult(w, result)
+		return
+	}
+	if err != nil {
+		logging.Error(moduleName, "Invalid upload:", err)
+		writeFileResult(w, result)
+		return
+	}
+
+	if err := validateFile(gameInfo.Name, data); err != nil {
+		uploadsInvalid.Add(1)
+		logging.Warn(moduleName, "Rejected", aurora.BrightCyan(gameInfo.Name), "upload of", aurora.Cyan(len(data)), "bytes:", err)
+		writeFileResult(w, FileResultUnknownError)
+		return
+	}
+
+	fileId, err := store.InsertSakeFileRecord(ctx, gameId, profileId, int64(len(data)), maxProfileFiles, maxProfileBytes)
+	if errors.Is(err, database.ErrSakeQuotaExceeded) {
+		uploadsOverQuota.Add(1)
+		logging.Warn(moduleName, "Rejected", aurora.BrightCyan(gameInfo.Name), "upload of", aurora.Cyan(len(data)), "bytes: over the profile's quota")
+		writeFileResult(w, FileResultFileTooLarge)
+		return
+	}
+	if errors.Is(err, database.ErrSakeUnknownOwner) {
+		logging.Error(moduleName, "Rejected upload for a profile that doesn't exist")
+		writeFileResult(w, FileResultUnknownError)
+		return
+	}
+	if err != nil {
+		logging.Error(moduleName, "Failed to record file:", err)
+		writeFileResult(w, FileResultServerError)
+		return
+	}
+
+	if err := writeFileData(fileId, data); err != nil {
+		logging.Error(moduleName, "Failed to write file", aurora.Cyan(fileId).String()+":", err)
+		store.DeleteSakeFile(ctx, fileId)
+		writeFileResult(w, FileResultServerError)
+		return
+	}
+
+	filesUploaded.Add(1)
+	logging.Notice(moduleName, "Uploaded", aurora.BrightCyan(gameInfo.Name), "file", aurora.Cyan(fileId), "of", aurora.Cyan(len(data)), "bytes")
+
+	// The file is kept either way, a missing score only affects the leaderboards
+	scores, ascending := gamestats.FileScores(gameInfo.Name, data)
+	for _, score := range scores {
+		if err := store.SetGamestatsScore(ctx, profileId, gameInfo.Name, score.Board, ascending, score.Value, time.Now()); err != nil {
+			logging.Error(moduleName, "Failed to record leaderboard score:", err)
+		}
+	}
+
+	w.Header().Set("Sake-File-Id", strconv.FormatInt(int64(fileId), 10))
+	writeFileResult(w, FileResultSuccess)
+}
+
+// writeFileData writes to a temporary file first so a failed upload never leaves a partial file
+func writeFileData(fileId int32, data []byte) error {
+	if err := os.MkdirAll(fileDirectory, 0755); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(fileDirectory, "upload-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), filePath(fileId))
+}
+
+func handleFileDownload(moduleName string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeFileResult(w, FileResultBadHttpMethod)
+		return
+	}
+
+	query := r.URL.Query()
+	fileId, err := strconv.ParseInt(query.Get("fileid"), 10, 32)
+	if err != nil || fileId <= 0 {
+		writeFileResult(w, FileResultInvalidFileID)
+		return
+	}
+
+	file, err := store.GetSakeFile(ctx, int32(fileId))
+	if errors.Is(err, database.ErrNotFound) {
+		writeFileResult(w, FileResultFileNotFound)
+		return
+	}
+	if err != nil {
+		logging.Error(moduleName, "Failed to get file", aurora.Cyan(fileId).String()+":", err)
+		writeFileResult(w, FileResultServerError)
+		return
+	}
+
+	if gameId, err := strconv.Atoi(query.Get("gameid")); err == nil && int32(gameId) != file.GameID {
+		writeFileResult(w, FileResultFileNotFound)
+		return
+	}
+
+	content, err := os.Open(filePath(file.FileID))
+	if err != nil {
+		logging.Error(moduleName, "Failed to open file", aurora.Cyan(fileId).String()+":", err)
+		writeFileResult(w, FileResultFileNotFound)
+		return
+	}
+	defer content.Close()
+
+	filesDownloaded.Add(1)
+	logging.Info(moduleName, "Downloading file", aurora.Cyan(fileId), "of", aurora.Cyan(file.Size), "bytes, range", aurora.Cyan(r.Header.Get("Range")))
+
+	serveFileContent(w, r, file, content)
+}
+
+// fileETag identifies a version of a file. Files are never modified after upload, so the ID,
+// size and upload time are enough.
+func fileETag(file database.SakeFile) string {
+	return fmt.Sprintf(`"%d-%d-%d"`, file.FileID, file.Size, file.Created.Unix())
+}
+
+// serveFileContent writes the file, streamed from storage rather than read into memory. Handles
+// single range requests (206, or 416 if unsatisfiable) and conditional requests (304).
+func serveFileContent(w http.ResponseWriter, r *http.Request, file database.SakeFile, content io.ReadSeeker) {
+	w.Header().Set("Sake-File-Result", strconv.Itoa(FileResultSuccess))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", fileETag(file))
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+
+	http.ServeContent(w, r, "", file.Created, content)
+}
+
+// cleanupFiles deletes files whose owner's profile was removed, and files on disk that have no
+// record. Records without a file on disk are left for the download to report as not found.
+func cleanupFiles() {
+	orphans, err := store.DeleteOrphanedSakeFileRecords(ctx)
+	if err != nil {
+		logging.Error("SAKE", "Failed to delete orphaned files:", err)
+		return
+	}
+
+	for fileId := range orphans {
+		if err := os.Remove(filePath(fileId)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logging.Error("SAKE", "Failed to delete file", aurora.Cyan(fileId).String()+":", err)
+		}
+	}
+
+	known, err := store.GetAllSakeFileIDs(ctx)
+	if err != nil {
+		logging.Error("SAKE", "Failed to list files:", err)
+		return
+	}
+
+	entries, err := os.ReadDir(fileDirectory)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logging.Error("SAKE", "Failed to list file directory:", err)
+		}
+		return
+	}
+
+	// Uploads in progress are still temporary files, and anything from the last cleanup
+	// interval is left alone in case its record is being written
+	cutoff := time.Now().Add(-fileCleanupInterval)
+	stray := 0
+	for _, entry := range entries {
+		fileId, err := strconv.ParseInt(entry.Name(), 10, 32)
+		if err != nil || known[int32(fileId)] {
+			continue
+		}
+
+		if info, err := entry.Info(); err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(fileDirectory, entry.Name())); err == nil {
+			stray++
+		}
+	}
+
+	orphanedFilesFreed.Add(uint64(len(orphans) + stray))
+	if len(orphans)+stray != 0 {
+		logging.Notice("SAKE", "Deleted", aurora.Cyan(len(orphans)), "orphaned and", aurora.Cyan(stray), "stray files")
+	}
+}
+
+func startFileCleanup() {
+	go func() {
+		for range time.Tick(fileCleanupInterval) {
+			cleanupFiles()
+		}
+	}()
+}
@@ -0,0 +1,175 @@
+package sake
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+	"wwfc/common"
+	"wwfc/database"
+)
+
+func multipartBody(t *testing.T, files ...[]byte) (*bytes.Buffer, string) {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("note", "ignored")
+	for _, file := range files {
+		part, err := writer.CreateFormFile("file", "ghost.rkg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(file)
+	}
+	writer.Close()
+
+	return body, writer.FormDataContentType()
+}
+
+func TestReadUploadedFile(t *testing.T) {
+	tests := []struct {
+		files  [][]byte
+		result int
+	}{
+		{[][]byte{[]byte("small")}, FileResultSuccess},
+		{[][]byte{bytes.Repeat([]byte{1}, 65)}, FileResultFileTooLarge},
+		{nil, FileResultBadFileCount},
+		{[][]byte{[]byte("one"), []byte("two")}, FileResultBadFileCount},
+	}
+
+	for i, test := range tests {
+		body, contentType := multipartBody(t, test.files...)
+		request := httptest.NewRequest("POST", "/SakeFileServer/upload.aspx?gameid=1687&pid=2", body)
+		request.Header.Set("Content-Type", contentType)
+
+		data, result, _ := readUploadedFile(request, 64)
+		if result != test.result {
+			t.Errorf("test %d: got result %d, expected %d", i, result, test.result)
+		}
+		if result == FileResultSuccess && !bytes.Equal(data, test.files[0]) {
+			t.Errorf("test %d: got data %q", i, data)
+		}
+	}
+}
+
+func TestFileSizeLimit(t *testing.T) {
+	maxFileSize := 1000
+	zero := 0
+	loadFileConfig(common.Config{
+		SakeMaxFileSize:     &maxFileSize,
+		SakeMaxProfileFiles: &zero,
+		SakeMaxProfileBytes: &zero,
+		SakeFileLimits:      []common.SakeFileLimit{{Name: "mariokartwii", MaxFileSize: 0x2800}},
+	})
+
+	if limit := fileSizeLimit("mariokartwii"); limit != 0x2800 {
+		t.Errorf("got limit %d for mariokartwii", limit)
+	}
+	if limit := fileSizeLimit("smashbrawlx"); limit != 1000 {
+		t.Errorf("got limit %d for the default", limit)
+	}
+}
+
+func TestValidateMarioKartWiiGhost(t *testing.T) {
+	ghost := append([]byte("RKGD"), make([]byte, 0x400)...)
+	if err := validateFile("mariokartwii", ghost); err != nil {
+		t.Error("valid ghost rejected:", err)
+	}
+
+	if err := validateFile("mariokartwii", append([]byte("RIFF"), make([]byte, 0x400)...)); err == nil {
+		t.Error("file without the ghost magic accepted")
+	}
+
+	if err := validateFile("mariokartwii", []byte("RKGD")); err == nil {
+		t.Error("truncated ghost accepted")
+	}
+
+	if err := validateFile("mariokartwii", append([]byte("RKGD"), make([]byte, 0x2800)...)); err == nil {
+		t.Error("oversized ghost accepted")
+	}
+
+	if err := validateFile("smashbrawlx", []byte("anything")); err != nil {
+		t.Error("game without a validator rejected a file:", err)
+	}
+}
+
+func TestServeFileContent(t *testing.T) {
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	file := database.SakeFile{FileID: 7, Size: int64(len(data)), Created: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+
+	serve := func(headers map[string]string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", "/SakeFileServer/download.aspx?fileid=7", nil)
+		for key, value := range headers {
+			request.Header.Set(key, value)
+		}
+		recorder := httptest.NewRecorder()
+		serveFileContent(recorder, request, file, bytes.NewReader(data))
+		return recorder
+	}
+
+	response := serve(nil)
+	if response.Code != http.StatusOK || response.Header().Get("Content-Length") != "100" || !bytes.Equal(response.Body.Bytes(), data) {
+		t.Errorf("full download: got %d with length %s", response.Code, response.Header().Get("Content-Length"))
+	}
+	if response.Header().Get("Sake-File-Result") != "0" || response.Header().Get("Last-Modified") == "" {
+		t.Errorf("full download: missing headers %v", response.Header())
+	}
+
+	response = serve(map[string]string{"Range": "bytes=40-59"})
+	if response.Code != http.StatusPartialContent || response.Header().Get("Content-Range") != "bytes 40-59/100" || !bytes.Equal(response.Body.Bytes(), data[40:60]) {
+		t.Errorf("mid-file range: got %d %q %v", response.Code, response.Header().Get("Content-Range"), response.Body.Bytes())
+	}
+
+	response = serve(map[string]string{"Range": "bytes=200-300"})
+	if response.Code != http.StatusRequestedRangeNotSatisfiable || response.Header().Get("Content-Range") != "bytes */100" {
+		t.Errorf("unsatisfiable range: got %d %q", response.Code, response.Header().Get("Content-Range"))
+	}
+
+	response = serve(map[string]string{"If-None-Match": fileETag(file)})
+	if response.Code != http.StatusNotModified || response.Body.Len() != 0 {
+		t.Errorf("conditional GET: got %d with %d bytes", response.Code, response.Body.Len())
+	}
+
+	response = serve(map[string]string{"If-Modified-Since": file.Created.Add(time.Hour).Format(http.TimeFormat)})
+	if response.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since: got %d", response.Code)
+	}
+
+	response = serve(map[string]string{"If-None-Match": `"7-100-0"`})
+	if response.Code != http.StatusOK {
+		t.Errorf("stale ETag: got %d", response.Code)
+	}
+}
+
+func TestGetUploader(t *testing.T) {
+	ticket := common.MarshalGPCMLoginTicket(600000001)
+
+	for _, test := range []struct {
+		query   string
+		allowed bool
+	}{
+		{"gameid=1687&loginticket=" + url.QueryEscape(ticket), true},
+		{"gameid=1687&pid=600000001&loginticket=" + url.QueryEscape(ticket), true},
+		// The profile ID alone isn't trusted
+		{"gameid=1687&pid=600000001", false},
+		{"gameid=1687&pid=600000002&loginticket=" + url.QueryEscape(ticket), false},
+		{"gameid=1687&loginticket=invalid", false},
+	} {
+		query, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		profileId, ok := getUploader("SAKE", query)
+		if ok != test.allowed || (ok && profileId != 600000001) {
+			t.Errorf("%s: got %d, %v", test.query, profileId, ok)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package sake
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"wwfc/database"
+)
+
+// Result codes from the SAKE documentation, returned in place of "Success"
+const (
+	ResultTableNotFound       = "TableNotFound"
+	ResultFieldNotFound       = "FieldNotFound"
+	ResultFieldTypeInvalid    = "FieldTypeInvalid"
+	ResultFilterInvalid       = "FilterInvalid"
+	ResultSortInvalid         = "SortInvalid"
+	ResultDatabaseUnavailable = "DatabaseUnavailable"
+)
+
+const (
+	maxFilterLength = 1024
+	maxFilterDepth  = 16
+)
+
+var (
+	errFieldNotFound    = errors.New("field not found")
+	errFieldTypeInvalid = errors.New("field type invalid")
+	errFilterInvalid    = errors.New("filter invalid")
+	errSortInvalid      = errors.New("sort invalid")
+)
+
+// resultForError maps a filter or sort error to the SAKE result code
+func resultForError(err error) string {
+	switch {
+	case errors.Is(err, errFieldNotFound):
+		return ResultFieldNotFound
+	case errors.Is(err, errFieldTypeInvalid):
+		return ResultFieldTypeInvalid
+	case errors.Is(err, errSortInvalid):
+		return ResultSortInvalid
+	default:
+		return ResultFilterInvalid
+	}
+}
+
+type filterTokenType int
+
+const (
+	tokenIdent filterTokenType = iota
+	tokenNumber
+	tokenString
+	tokenOperator
+	tokenOpenParen
+	tokenCloseParen
+)
+
+type filterToken struct {
+	tokenType filterTokenType
+	value     string
+}
+
+func tokenizeFilter(filter string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(filter); {
+		c := filter[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+
+		case c == '(':
+			tokens = append(tokens, filterToken{tokenOpenParen, "("})
+			i++
+
+		case c == ')':
+			tokens = append(tokens, filterToken{tokenCloseParen, ")"})
+			i++
+
+		case c == '\'':
+			// Quotes inside strings are escaped by doubling them
+			var value strings.Builder
+			i++
+			for {
+				if i >= len(filter) {
+					return nil, errFilterInvalid
+				}
+				if filter[i] == '\'' {
+					if i+1 < len(filter) && filter[i+1] == '\'' {
+						value.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				value.WriteByte(filter[i])
+				i++
+			}
+			tokens = append(tokens, filterToken{tokenString, value.String()})
+
+		case c == '=' || c == '!' || c == '<' || c == '>':
+			op := string(c)
+			if i+1 < len(filter) && (filter[i+1] == '=' || (c == '<' && filter[i+1] == '>')) {
+				op += string(filter[i+1])
+			}
+			if op == "!" {
+				return nil, errFilterInvalid
+			}
+			tokens = append(tokens, filterToken{tokenOperator, op})
+			i += len(op)
+
+		case c == '-' || (c >= '0' && c <= '9'):
+			start := i
+			i++
+			for i < len(filter) && filter[i] >= '0' && filter[i] <= '9' {
+				i++
+			}
+			if filter[start:i] == "-" {
+				return nil, errFilterInvalid
+			}
+			tokens = append(tokens, filterToken{tokenNumber, filter[start:i]})
+
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			start := i
+			for i < len(filter) && (filter[i] == '_' || (filter[i] >= 'a' && filter[i] <= 'z') || (filter[i] >= 'A' && filter[i] <= 'Z') || (filter[i] >= '0' && filter[i] <= '9')) {
+				i++
+			}
+			tokens = append(tokens, filterToken{tokenIdent, filter[start:i]})
+
+		default:
+			return nil, errFilterInvalid
+		}
+	}
+
+	return tokens, nil
+}
+
+// filterParser parses a SAKE filter into a condition on the table's columns. Values are kept
+// apart from the column names, never pasted into a query.
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+	table  sakeTable
+	depth  int
+}
+
+// translateFilter returns the condition for the filter, nil for an empty filter
+func translateFilter(filter string, table sakeTable) (database.SakeCondition, error) {
+	if strings.TrimSpace(filter) == "" {
+		return nil, nil
+	}
+
+	if len(filter) > maxFilterLength {
+		return nil, errFilterInvalid
+	}
+
+	tokens, err := tokenizeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	p := filterParser{tokens: tokens, table: table}
+	condition, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos != len(p.tokens) {
+		return nil, errFilterInvalid
+	}
+
+	return condition, nil
+}
+
+func (p *filterParser) peek() *filterToken {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+func (p *filterParser) isKeyword(keyword string) bool {
+	token := p.peek()
+	return token != nil && token.tokenType == tokenIdent && strings.EqualFold(token.value, keyword)
+}
+
+func (p *filterParser) parseOr() (database.SakeCondition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("or") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = database.SakeOr{Left: left, Right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (database.SakeCondition, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("and") {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = database.SakeAnd{Left: left, Right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (database.SakeCondition, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxFilterDepth {
+		return nil, errFilterInvalid
+	}
+
+	if p.isKeyword("not") {
+		p.pos++
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return database.SakeNot{Inner: inner}, nil
+	}
+
+	token := p.peek()
+	if token == nil {
+		return nil, errFilterInvalid
+	}
+
+	if token.tokenType == tokenOpenParen {
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if token := p.peek(); token == nil || token.tokenType != tokenCloseParen {
+			return nil, errFilterInvalid
+		}
+		p.pos++
+		return inner, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (database.SakeCondition, error) {
+	if p.pos+3 > len(p.tokens) {
+		return nil, errFilterInvalid
+	}
+
+	name, op, value := p.tokens[p.pos], p.tokens[p.pos+1], p.tokens[p.pos+2]
+	p.pos += 3
+
+	if name.tokenType != tokenIdent {
+		return nil, errFilterInvalid
+	}
+
+	field, ok := p.table.fields[strings.ToLower(name.value)]
+	if !ok {
+		return nil, errFieldNotFound
+	}
+
+	sqlOp := ""
+	if op.tokenType == tokenOperator {
+		sqlOp = op.value
+		if sqlOp == "!=" {
+			sqlOp = "<>"
+		}
+	} else if op.tokenType == tokenIdent && strings.EqualFold(op.value, "like") {
+		sqlOp = "LIKE"
+	} else {
+		return nil, errFilterInvalid
+	}
+
+	var arg any
+	switch field.fieldType {
+	case fieldInt, fieldUint:
+		if value.tokenType != tokenNumber || sqlOp == "LIKE" {
+			return nil, errFieldTypeInvalid
+		}
+		number, err := strconv.ParseInt(value.value, 10, 64)
+		if err != nil {
+			return nil, errFieldTypeInvalid
+		}
+		arg = number
+
+	case fieldAsciiString, fieldUnicodeString:
+		if value.tokenType != tokenString {
+			return nil, errFieldTypeInvalid
+		}
+		arg = value.value
+
+	case fieldBoolean:
+		if sqlOp != "=" && sqlOp != "<>" {
+			return nil, errFieldTypeInvalid
+		}
+		switch strings.ToLower(value.value) {
+		case "true", "1":
+			arg = true
+		case "false", "0":
+			arg = false
+		default:
+			return nil, errFieldTypeInvalid
+		}
+
+	default:
+		// Binary data can't be compared
+		return nil, errFieldTypeInvalid
+	}
+
+	return database.SakeCompare{Column: field.column, Op: sqlOp, Value: arg}, nil
+}
+
+// translateSort turns a SAKE sort ("field [asc|desc], ...") into the columns to sort by
+func translateSort(sort string, table sakeTable) ([]database.SakeOrder, error) {
+	if strings.TrimSpace(sort) == "" {
+		return []database.SakeOrder{{Column: table.fields["recordid"].column}}, nil
+	}
+
+	var order []database.SakeOrder
+	for _, part := range strings.Split(sort, ",") {
+		words := strings.Fields(part)
+		if len(words) == 0 || len(words) > 2 {
+			return nil, errSortInvalid
+		}
+
+		field, ok := table.fields[strings.ToLower(words[0])]
+		if !ok {
+			return nil, errFieldNotFound
+		}
+		if field.fieldType == fieldBinaryData {
+			return nil, errSortInvalid
+		}
+
+		column := database.SakeOrder{Column: field.column}
+		if len(words) == 2 {
+			switch strings.ToLower(words[1]) {
+			case "asc":
+			case "desc":
+				column.Descending = true
+			default:
+				return nil, errSortInvalid
+			}
+		}
+
+		order = append(order, column)
+	}
+
+	return order, nil
+}
@@ -2,18 +2,17 @@ package sake
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 	"wwfc/common"
+	"wwfc/database"
 	"wwfc/logging"
 
-	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/logrusorgru/aurora/v3"
 )
 
 var (
-	ctx  = context.Background()
-	pool *pgxpool.Pool
+	ctx   = context.Background()
+	store database.Store
 )
 
 func StartServer(reload bool) {
@@ -23,16 +22,14 @@ func StartServer(reload bool) {
 	common.ReadGameList()
 
 	// Start SQL
-	dbString := fmt.Sprintf("postgres://%s:%s@%s/%s", config.Username, config.Password, config.DatabaseAddress, config.DatabaseName)
-	dbConf, err := pgxpool.ParseConfig(dbString)
+	var err error
+	store, err = database.Connect(ctx, config)
 	if err != nil {
 		panic(err)
 	}
 
-	pool, err = pgxpool.ConnectConfig(ctx, dbConf)
-	if err != nil {
-		panic(err)
-	}
+	loadFileConfig(config)
+	startFileCleanup()
 }
 
 func Shutdown() {
@@ -41,9 +38,17 @@ func Shutdown() {
 func HandleRequest(w http.ResponseWriter, r *http.Request) {
 	logging.Info("SAKE", aurora.Yellow(r.Method), aurora.Cyan(r.URL), "via", aurora.Cyan(r.Host), "from", aurora.BrightCyan(r.RemoteAddr))
 
-	switch r.URL.String() {
+	switch r.URL.Path {
 	case "/SakeStorageServer/StorageServer.asmx":
 		moduleName := "SAKE:Storage:" + r.RemoteAddr
 		handleStorageRequest(moduleName, w, r)
+
+	case "/SakeFileServer/upload.aspx":
+		moduleName := "SAKE:File:" + r.RemoteAddr
+		handleFileUpload(moduleName, w, r)
+
+	case "/SakeFileServer/download.aspx":
+		moduleName := "SAKE:File:" + r.RemoteAddr
+		handleFileDownload(moduleName, w, r)
 	}
 }
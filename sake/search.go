@@ -0,0 +1,228 @@
+package sake
+
+import (
+	"strings"
+	"wwfc/common"
+	"wwfc/database"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+const (
+	// Most records a single SearchForRecords can return, whatever max the client asks for
+	maxSearchResults = 100
+)
+
+type sakeFieldType int
+
+const (
+	fieldInt sakeFieldType = iota
+	fieldUint
+	fieldAsciiString
+	fieldUnicodeString
+	fieldBinaryData
+	fieldBoolean
+)
+
+type sakeField struct {
+	column    string
+	fieldType sakeFieldType
+}
+
+// sakeTable maps a SAKE table onto an SQL table. Every table needs "recordid" and "ownerid" fields.
+// A table shared by several games has a game column, searches only see the rows of the game asking.
+type sakeTable struct {
+	sqlTable   string
+	gameColumn string
+	fields     map[string]sakeField
+}
+
+// Tables by game name and table ID. A "*" game is a table every game has, used if the game doesn't
+// have its own table of that name.
+var sakeTables = map[string]sakeTable{
+	"mariokartwii/FriendInfo": {
+		sqlTable: "users",
+		fields: map[string]sakeField{
+			"ownerid":  {"profile_id", fieldUint},
+			"recordid": {"profile_id", fieldInt},
+			// Stored base64 encoded
+			"info": {"mariokartwii_friend_info", fieldBinaryData},
+		},
+	},
+	// Files uploaded to the file server, like ghosts and custom content, which are downloaded by
+	// the file ID found here
+	"*/Files": {
+		sqlTable:   "sake_files",
+		gameColumn: "game_id",
+		fields: map[string]sakeField{
+			"ownerid":  {"profile_id", fieldUint},
+			"recordid": {"file_id", fieldInt},
+			"fileid":   {"file_id", fieldInt},
+			"size":     {"size", fieldInt},
+		},
+	},
+}
+
+func getSakeTable(gameName string, tableId string) (sakeTable, bool) {
+	if table, ok := sakeTables[gameName+"/"+tableId]; ok {
+		return table, true
+	}
+
+	table, ok := sakeTables["*/"+tableId]
+	return table, ok
+}
+
+// buildSearch builds the search for a SearchForRecords request, along with the requested fields
+// in the order their columns are returned. Returns a SAKE result code on failure.
+// A search without a filter or owners only returns the records of the profile searching, rather
+// than every record in the table.
+func buildSearch(table sakeTable, gameId int, profileId uint32, request StorageRequestData) (database.SakeSearch, []string, string) {
+	search := database.SakeSearch{Table: table.sqlTable}
+	var fields []string
+	for _, name := range request.Fields.Fields {
+		field, ok := table.fields[strings.ToLower(name)]
+		if !ok {
+			return database.SakeSearch{}, nil, ResultFieldNotFound
+		}
+
+		fields = append(fields, name)
+		search.Columns = append(search.Columns, field.column)
+	}
+
+	if len(search.Columns) == 0 {
+		return database.SakeSearch{}, nil, ResultFieldNotFound
+	}
+
+	condition, err := translateFilter(request.Filter, table)
+	if err != nil {
+		return database.SakeSearch{}, nil, resultForError(err)
+	}
+
+	search.Order, err = translateSort(request.Sort, table)
+	if err != nil {
+		return database.SakeSearch{}, nil, resultForError(err)
+	}
+
+	search.Limit = request.Max
+	if search.Limit <= 0 || search.Limit > maxSearchResults {
+		search.Limit = maxSearchResults
+	}
+
+	ownerColumn := table.fields["ownerid"].column
+	if table.gameColumn != "" {
+		condition = database.SakeAll(condition, database.SakeCompare{Column: table.gameColumn, Op: "=", Value: int64(gameId)})
+	}
+	if strings.TrimSpace(request.Filter) == "" && len(request.OwnerIDs.IDs) == 0 {
+		condition = database.SakeAll(condition, database.SakeCompare{Column: ownerColumn, Op: "=", Value: int64(profileId)})
+	}
+
+	if len(request.OwnerIDs.IDs) != 0 && request.Surrounding > 0 {
+		// Records ranked around the owners' own records, used for leaderboards
+		search.Condition = condition
+		search.Surrounding = &database.SakeSurrounding{OwnerColumn: ownerColumn, Owners: request.OwnerIDs.IDs, Count: request.Surrounding}
+		return search, fields, ""
+	}
+
+	if len(request.OwnerIDs.IDs) != 0 {
+		condition = database.SakeAll(condition, database.SakeIn{Column: ownerColumn, Values: request.OwnerIDs.IDs})
+	}
+
+	search.Condition = condition
+	search.Offset = max(request.Offset, 0)
+	return search, fields, ""
+}
+
+// sakeValue converts a value scanned from the database into the typed SAKE value for the field.
+// NULL columns have no value.
+func sakeValue(fieldType sakeFieldType, value any) *StorageValue {
+	var result StorageValue
+	switch value := value.(type) {
+	case int64:
+		switch fieldType {
+		case fieldInt:
+			result = intValue(int32(value))
+		case fieldUint:
+			result = uintValue(uint32(value))
+		default:
+			return nil
+		}
+
+	case int32:
+		return sakeValue(fieldType, int64(value))
+
+	case int16:
+		return sakeValue(fieldType, int64(value))
+
+	case string:
+		switch fieldType {
+		case fieldAsciiString:
+			result = asciiStringValue(value)
+		case fieldUnicodeString:
+			result = unicodeStringValue(value)
+		case fieldBinaryData:
+			result = binaryDataValueBase64(value)
+		default:
+			return nil
+		}
+
+	case []byte:
+		if fieldType != fieldBinaryData {
+			return nil
+		}
+		result = binaryDataValue(value)
+
+	case bool:
+		if fieldType != fieldBoolean {
+			return nil
+		}
+		result = booleanValue(value)
+
+	default:
+		return nil
+	}
+
+	return &result
+}
+
+func searchForRecords(moduleName string, profileId uint32, gameInfo common.GameInfo, request StorageRequestData) *StorageSearchForRecordsResponse {
+	table, ok := getSakeTable(gameInfo.Name, request.TableID)
+	if !ok {
+		logging.Error(moduleName, "Unknown table")
+		for _, field := range request.Fields.Fields {
+			logging.Info(moduleName, "Field:", aurora.Cyan(field))
+		}
+		return &StorageSearchForRecordsResponse{SearchForRecordsResult: ResultTableNotFound}
+	}
+
+	search, fields, result := buildSearch(table, gameInfo.GameID, profileId, request)
+	if result != "" {
+		logging.Error(moduleName, "Rejected search with filter", aurora.Cyan(request.Filter), "sort", aurora.Cyan(request.Sort), "result:", aurora.Cyan(result))
+		return &StorageSearchForRecordsResponse{SearchForRecordsResult: result}
+	}
+
+	records, err := store.SearchSakeRecords(ctx, search)
+	if err != nil {
+		logging.Error(moduleName, "Search failed:", err)
+		return &StorageSearchForRecordsResponse{SearchForRecordsResult: ResultDatabaseUnavailable}
+	}
+
+	response := StorageSearchForRecordsResponse{
+		SearchForRecordsResult: "Success",
+	}
+
+	fieldCount := 0
+	valueArray := &response.Values.ArrayOfRecordValue
+	for _, values := range records {
+		for i, name := range fields {
+			value := sakeValue(table.fields[strings.ToLower(name)].fieldType, values[i])
+			if value != nil {
+				fieldCount++
+			}
+			valueArray.RecordValues = append(valueArray.RecordValues, StorageRecordValue{Value: value})
+		}
+	}
+
+	logging.Info(moduleName, "Wrote", aurora.BrightCyan(fieldCount), "field(s) across", aurora.BrightCyan(len(records)), "record(s)")
+	return &response
+}
@@ -0,0 +1,327 @@
+package sake
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"wwfc/common"
+	"wwfc/database"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+var testTable = sakeTable{
+	sqlTable: "records",
+	fields: map[string]sakeField{
+		"ownerid":  {"owner_id", fieldUint},
+		"recordid": {"record_id", fieldInt},
+		"score":    {"score", fieldInt},
+		"name":     {"name", fieldUnicodeString},
+		"region":   {"region", fieldAsciiString},
+		"ghost":    {"ghost", fieldBinaryData},
+		"verified": {"verified", fieldBoolean},
+	},
+}
+
+func TestTranslateFilter(t *testing.T) {
+	compare := func(column string, op string, value any) database.SakeCompare {
+		return database.SakeCompare{Column: column, Op: op, Value: value}
+	}
+
+	tests := []struct {
+		filter    string
+		condition database.SakeCondition
+		err       error
+	}{
+		{"", nil, nil},
+		{"ownerid = 12345", compare("owner_id", "=", int64(12345)), nil},
+		{"score >= -5 and score != 10", database.SakeAnd{Left: compare("score", ">=", int64(-5)), Right: compare("score", "<>", int64(10))}, nil},
+		{"name = 'it''s' or not (region like 'EU%')", database.SakeOr{Left: compare("name", "=", "it's"), Right: database.SakeNot{Inner: compare("region", "LIKE", "EU%")}}, nil},
+		{"verified = true", compare("verified", "=", true), nil},
+		{"missing = 1", nil, errFieldNotFound},
+		{"score = 'abc'", nil, errFieldTypeInvalid},
+		{"name = 5", nil, errFieldTypeInvalid},
+		{"ghost = 'AAAA'", nil, errFieldTypeInvalid},
+		{"verified < true", nil, errFieldTypeInvalid},
+		{"score = 1; DROP TABLE users", nil, errFilterInvalid},
+		{"(score = 1", nil, errFilterInvalid},
+		{"score = 1 score = 2", nil, errFilterInvalid},
+		{"name = 'unterminated", nil, errFilterInvalid},
+		{strings.Repeat("(", 20) + "score = 1" + strings.Repeat(")", 20), nil, errFilterInvalid},
+	}
+
+	for _, test := range tests {
+		condition, err := translateFilter(test.filter, testTable)
+		if err != test.err {
+			t.Errorf("%q: got error %v, expected %v", test.filter, err, test.err)
+			continue
+		}
+		if !reflect.DeepEqual(condition, test.condition) {
+			t.Errorf("%q: got %+v, expected %+v", test.filter, condition, test.condition)
+		}
+	}
+}
+
+func TestTranslateSort(t *testing.T) {
+	tests := []struct {
+		sort  string
+		order []database.SakeOrder
+		err   error
+	}{
+		{"", []database.SakeOrder{{Column: "record_id"}}, nil},
+		{"score desc, recordid", []database.SakeOrder{{Column: "score", Descending: true}, {Column: "record_id"}}, nil},
+		{"missing", nil, errFieldNotFound},
+		{"ghost", nil, errSortInvalid},
+		{"score sideways", nil, errSortInvalid},
+	}
+
+	for _, test := range tests {
+		order, err := translateSort(test.sort, testTable)
+		if err != test.err || !reflect.DeepEqual(order, test.order) {
+			t.Errorf("%q: got %+v %v, expected %+v %v", test.sort, order, err, test.order, test.err)
+		}
+	}
+}
+
+func TestSearchForRecordsResult(t *testing.T) {
+	tests := []struct {
+		request StorageRequestData
+		result  string
+	}{
+		{StorageRequestData{TableID: "Missing", Fields: StorageFields{Fields: []string{"recordid"}}}, ResultTableNotFound},
+		{StorageRequestData{TableID: "Records", Fields: StorageFields{Fields: []string{"score", "missing"}}}, ResultFieldNotFound},
+		{StorageRequestData{TableID: "Records", Fields: StorageFields{Fields: []string{"score"}}, Filter: "score = 'high'"}, ResultFieldTypeInvalid},
+		{StorageRequestData{TableID: "Records", Fields: StorageFields{Fields: []string{"score"}}, Sort: "ghost"}, ResultSortInvalid},
+	}
+
+	sakeTables["testgame/Records"] = testTable
+	t.Cleanup(func() { delete(sakeTables, "testgame/Records") })
+
+	// Rejected before the database is used
+	for _, test := range tests {
+		response := searchForRecords("SAKE", 1, common.GameInfo{GameID: 1, Name: "testgame"}, test.request)
+		if response.SearchForRecordsResult != test.result {
+			t.Errorf("%+v: got %q, expected %q", test.request, response.SearchForRecordsResult, test.result)
+		}
+	}
+}
+
+// testSearchPool connects to the database in WWFC_TEST_DATABASE and creates the tables searched in a
+// schema of their own, which is dropped at the end of the test
+func testSearchPool(t *testing.T) {
+	dbString := os.Getenv("WWFC_TEST_DATABASE")
+	if dbString == "" {
+		t.Skip("WWFC_TEST_DATABASE is not set")
+	}
+
+	dbConf, err := pgxpool.ParseConfig(dbString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := "wwfc_sake_test_" + strconv.Itoa(os.Getpid())
+	dbConf.ConnConfig.RuntimeParams["search_path"] = schema
+
+	testPool, err := pgxpool.ConnectConfig(ctx, dbConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldStore := store
+	store = database.NewPostgresStore(testPool)
+	t.Cleanup(func() {
+		testPool.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE")
+		store.Close()
+		store = oldStore
+	})
+
+	for _, statement := range []string{
+		"CREATE SCHEMA " + schema,
+		"CREATE TABLE records (record_id integer, owner_id bigint, score integer, name varchar, region varchar, ghost bytea, verified boolean)",
+		"CREATE TABLE users (profile_id bigint, mariokartwii_friend_info varchar)",
+		"CREATE TABLE sake_files (file_id integer, game_id integer, profile_id bigint, size bigint)",
+		`INSERT INTO records VALUES
+			(1, 100, 50, 'Mario', 'EU', '\x01', true),
+			(2, 100, 300, 'Luigi', 'US', NULL, false),
+			(3, 200, 150, 'Peach', 'EU', '\x0203', true),
+			(4, 300, 400, 'Yoshi', 'JP', NULL, true),
+			(5, 400, 250, 'Toad', 'EU', NULL, false)`,
+		"INSERT INTO users VALUES (12345, 'AQID'), (12346, 'BAUG')",
+		"INSERT INTO sake_files VALUES (1, 1687, 12345, 100), (2, 1687, 12346, 200), (3, 1000, 12345, 300)",
+	} {
+		if _, err := testPool.Exec(ctx, statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// searchValues runs the search and returns the values of each record, "-" for a missing value
+func searchValues(t *testing.T, profileId uint32, gameInfo common.GameInfo, request StorageRequestData) [][]string {
+	response := searchForRecords("SAKE", profileId, gameInfo, request)
+	if response.SearchForRecordsResult != "Success" {
+		t.Fatalf("%+v: got %q", request, response.SearchForRecordsResult)
+	}
+
+	values := response.Values.ArrayOfRecordValue.RecordValues
+	width := len(request.Fields.Fields)
+	var records [][]string
+	for i := 0; i+width <= len(values); i += width {
+		var record []string
+		for _, value := range values[i : i+width] {
+			if value.Value == nil {
+				record = append(record, "-")
+			} else {
+				record = append(record, value.Value.Value)
+			}
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestSearchForRecords(t *testing.T) {
+	testSearchPool(t)
+
+	sakeTables["testgame/Records"] = testTable
+	t.Cleanup(func() { delete(sakeTables, "testgame/Records") })
+	game := common.GameInfo{GameID: 1, Name: "testgame"}
+
+	tests := []struct {
+		request  StorageRequestData
+		expected [][]string
+	}{
+		{
+			StorageRequestData{Filter: "score > 100", Sort: "score desc", Max: 2, Fields: StorageFields{Fields: []string{"recordid", "score"}}},
+			[][]string{{"4", "400"}, {"2", "300"}},
+		},
+		{
+			StorageRequestData{Filter: "score > 100", Sort: "score desc", Offset: 2, Max: 10, Fields: StorageFields{Fields: []string{"recordid", "name"}}},
+			[][]string{{"5", "Toad"}, {"3", "Peach"}},
+		},
+		{
+			StorageRequestData{Filter: "region = 'EU' and not verified = false", Fields: StorageFields{Fields: []string{"name", "ghost", "verified"}}},
+			[][]string{{"Mario", "AQ==", "true"}, {"Peach", "AgM=", "true"}},
+		},
+		{
+			// No filter or owners, only the searching profile's own records
+			StorageRequestData{Fields: StorageFields{Fields: []string{"recordid", "ownerid"}}},
+			[][]string{{"1", "100"}, {"2", "100"}},
+		},
+		{
+			// Ranked by score, one record either side of owner 400's
+			StorageRequestData{Sort: "score desc", Surrounding: 1, OwnerIDs: StorageOwnerIDs{IDs: []int32{400}}, Fields: StorageFields{Fields: []string{"recordid", "score", "score"}}},
+			[][]string{{"2", "300", "300"}, {"5", "250", "250"}, {"3", "150", "150"}},
+		},
+	}
+
+	for _, test := range tests {
+		test.request.TableID = "Records"
+		if records := searchValues(t, 100, game, test.request); !reflect.DeepEqual(records, test.expected) {
+			t.Errorf("%+v: got %v, expected %v", test.request, records, test.expected)
+		}
+	}
+
+	testSearchSharedTables(t)
+}
+
+// testSearchFileStore opens an empty database file as the store for the test, with the users and
+// files of testSearchPool
+func testSearchFileStore(t *testing.T) {
+	fileStore, err := database.Connect(ctx, common.Config{DatabaseDriver: common.DatabaseDriverFile, DatabaseFile: filepath.Join(t.TempDir(), "database.gob")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldStore := store
+	store = fileStore
+	t.Cleanup(func() {
+		store.Close()
+		store = oldStore
+	})
+
+	for _, profileId := range []uint32{12345, 12346} {
+		if _, err := store.LoginUserToGPCM(ctx, uint64(profileId), "RMCJ", profileId, 0, "127.0.0.1", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.UpdateMKWFriendInfo(ctx, 12345, "AQID")
+	store.UpdateMKWFriendInfo(ctx, 12346, "BAUG")
+
+	for _, file := range []struct {
+		gameId    int
+		profileId uint32
+		size      int64
+	}{{1687, 12345, 100}, {1687, 12346, 200}, {1000, 12345, 300}} {
+		if _, err := store.InsertSakeFileRecord(ctx, file.gameId, file.profileId, file.size, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSearchForRecordsFile(t *testing.T) {
+	testSearchFileStore(t)
+	testSearchSharedTables(t)
+
+	// Ranked by size, the file either side of profile 12346's
+	request := StorageRequestData{TableID: "Files", Sort: "size desc", Surrounding: 1, OwnerIDs: StorageOwnerIDs{IDs: []int32{12346}}, Fields: StorageFields{Fields: []string{"fileid", "size"}}}
+	if records := searchValues(t, 12345, common.GameInfo{GameID: 1000, Name: "othergame"}, request); records != nil {
+		t.Errorf("got files of another game %v", records)
+	}
+	if records := searchValues(t, 12345, common.GameInfo{GameID: 1687, Name: "mariokartwii"}, request); !reflect.DeepEqual(records, [][]string{{"2", "200"}, {"1", "100"}}) {
+		t.Errorf("got surrounding files %v", records)
+	}
+}
+
+// testSearchSharedTables searches the tables of the servers' own data, which every store has
+func testSearchSharedTables(t *testing.T) {
+	// Files are only found by the game they were uploaded for
+	request := StorageRequestData{TableID: "Files", Filter: "size > 0", Fields: StorageFields{Fields: []string{"fileid", "ownerid", "size"}}}
+	if records := searchValues(t, 12345, common.GameInfo{GameID: 1687, Name: "mariokartwii"}, request); !reflect.DeepEqual(records, [][]string{{"1", "12345", "100"}, {"2", "12346", "200"}}) {
+		t.Errorf("got files %v", records)
+	}
+
+	// Mario Kart Wii looking up a friend's info
+	body := `<?xml version="1.0" encoding="UTF-8"?>
+<SOAP-ENV:Envelope xmlns:SOAP-ENV="http://schemas.xmlsoap.org/soap/envelope/" xmlns:ns1="http://gamespy.net/sake">
+<SOAP-ENV:Body><ns1:SearchForRecords><ns1:gameid>1687</ns1:gameid><ns1:secretKey>9r3Rmy</ns1:secretKey>
+<ns1:loginTicket>ticket</ns1:loginTicket><ns1:tableid>FriendInfo</ns1:tableid><ns1:filter>ownerid = 12345</ns1:filter>
+<ns1:sort>recordid</ns1:sort><ns1:offset>0</ns1:offset><ns1:max>1</ns1:max><ns1:surrounding>0</ns1:surrounding>
+<ns1:ownerids></ns1:ownerids><ns1:cacheFlag>0</ns1:cacheFlag>
+<ns1:fields><ns1:string>info</ns1:string></ns1:fields></ns1:SearchForRecords></SOAP-ENV:Body></SOAP-ENV:Envelope>`
+
+	var envelope StorageRequestEnvelope
+	if err := xml.Unmarshal([]byte(body), &envelope); err != nil {
+		t.Fatal(err)
+	}
+
+	if records := searchValues(t, 12346, common.GameInfo{GameID: 1687, Name: "mariokartwii"}, envelope.Body.Data); !reflect.DeepEqual(records, [][]string{{"AQID"}}) {
+		t.Errorf("got friend info %v", records)
+	}
+}
+
+func TestSakeValue(t *testing.T) {
+	tests := []struct {
+		fieldType sakeFieldType
+		value     any
+		expected  *StorageValue
+	}{
+		{fieldInt, int64(-3), &StorageValue{XMLName: xml.Name{Local: "intValue"}, Value: "-3"}},
+		{fieldUint, int64(12345), &StorageValue{XMLName: xml.Name{Local: "uintValue"}, Value: "12345"}},
+		{fieldAsciiString, "EU", &StorageValue{XMLName: xml.Name{Local: "asciiStringValue"}, Value: "EU"}},
+		{fieldUnicodeString, "Mario", &StorageValue{XMLName: xml.Name{Local: "unicodeStringValue"}, Value: "Mario"}},
+		{fieldBinaryData, []byte{1, 2, 3}, &StorageValue{XMLName: xml.Name{Local: "binaryDataValue"}, Value: "AQID"}},
+		{fieldBinaryData, "AQID", &StorageValue{XMLName: xml.Name{Local: "binaryDataValue"}, Value: "AQID"}},
+		{fieldBoolean, true, &StorageValue{XMLName: xml.Name{Local: "booleanValue"}, Value: "true"}},
+		{fieldInt, nil, nil},
+		{fieldBoolean, "true", nil},
+	}
+
+	for _, test := range tests {
+		if value := sakeValue(test.fieldType, test.value); !reflect.DeepEqual(value, test.expected) {
+			t.Errorf("%v %#v: got %+v, expected %+v", test.fieldType, test.value, value, test.expected)
+		}
+	}
+}
@@ -5,11 +5,8 @@ import (
 	"encoding/xml"
 	"io"
 	"net/http"
-	"regexp"
-	"sort"
 	"strconv"
 	"wwfc/common"
-	"wwfc/database"
 	"wwfc/logging"
 
 	"github.com/logrusorgru/aurora/v3"
@@ -42,7 +39,7 @@ type StorageRequestData struct {
 	Offset      int                       `xml:"offset"`
 	Max         int                       `xml:"max"`
 	Surrounding int                       `xml:"surrounding"`
-	OwnerIDs    string                    `xml:"ownerids"`
+	OwnerIDs    StorageOwnerIDs           `xml:"ownerids"`
 	CacheFlag   int                       `xml:"cacheFlag"`
 	Fields      StorageFields             `xml:"fields"`
 	Values      StorageUpdateRecordValues `xml:"values"`
@@ -53,6 +50,10 @@ type StorageFields struct {
 	Fields  []string `xml:"string"`
 }
 
+type StorageOwnerIDs struct {
+	IDs []int32 `xml:"int"`
+}
+
 type StorageUpdateRecordValues struct {
 	RecordFields []StorageRecordField `xml:"RecordField"`
 }
@@ -152,7 +153,7 @@ func handleStorageRequest(moduleName string, w http.ResponseWriter, r *http.Requ
 				response.Body.UpdateRecordResponse = updateRecord(moduleName, profileId, gameInfo, soap.Body.Data)
 
 			case SakeNamespace + "/SearchForRecords":
-				response.Body.SearchForRecordsResponse = searchForRecords(moduleName, gameInfo, soap.Body.Data)
+				response.Body.SearchForRecordsResponse = searchForRecords(moduleName, profileId, gameInfo, soap.Body.Data)
 
 			default:
 				logging.Error(moduleName, "Unknown SOAPAction:", aurora.Cyan(xmlName))
@@ -175,9 +176,8 @@ func handleStorageRequest(moduleName string, w http.ResponseWriter, r *http.Requ
 }
 
 func getRequestIdentity(moduleName string, request StorageRequestData) (uint32, common.GameInfo, bool) {
-	gameInfo := common.GetGameInfoByID(request.GameID)
+	gameInfo := common.CheckGameByID(moduleName, request.GameID, common.GameServiceSake)
 	if gameInfo == nil {
-		logging.Error(moduleName, "Invalid game ID:", aurora.Cyan(request.GameID))
 		return 0, common.GameInfo{}, false
 	}
 
@@ -228,6 +228,27 @@ func uintValue(value uint32) StorageValue {
 	}
 }
 
+func asciiStringValue(value string) StorageValue {
+	return StorageValue{
+		XMLName: xml.Name{Local: "asciiStringValue"},
+		Value:   value,
+	}
+}
+
+func unicodeStringValue(value string) StorageValue {
+	return StorageValue{
+		XMLName: xml.Name{Local: "unicodeStringValue"},
+		Value:   value,
+	}
+}
+
+func booleanValue(value bool) StorageValue {
+	return StorageValue{
+		XMLName: xml.Name{Local: "booleanValue"},
+		Value:   strconv.FormatBool(value),
+	}
+}
+
 func getMyRecords(moduleName string, profileId uint32, gameInfo common.GameInfo, request StorageRequestData) *StorageGetMyRecordsResponse {
 	errorResponse := StorageGetMyRecordsResponse{
 		GetMyRecordsResult: "Error",
@@ -248,7 +269,7 @@ func getMyRecords(moduleName string, profileId uint32, gameInfo common.GameInfo,
 		values = map[string]StorageValue{
 			"ownerid":  uintValue(profileId),
 			"recordid": intValue(int32(profileId)),
-			"info":     binaryDataValueBase64(database.GetMKWFriendInfo(pool, ctx, profileId)),
+			"info":     binaryDataValueBase64(store.GetMKWFriendInfo(ctx, profileId)),
 		}
 	}
 
@@ -292,7 +313,7 @@ func updateRecord(moduleName string, profileId uint32, gameInfo common.GameInfo,
 		}
 
 		// TODO: Validate record data
-		database.UpdateMKWFriendInfo(pool, ctx, profileId, request.Values.RecordFields[0].Value.Value.Value)
+		store.UpdateMKWFriendInfo(ctx, profileId, request.Values.RecordFields[0].Value.Value.Value)
 		logging.Notice(moduleName, "Updated Mario Kart Wii friend info")
 	}
 
@@ -300,89 +321,3 @@ func updateRecord(moduleName string, profileId uint32, gameInfo common.GameInfo,
 		UpdateRecordResult: "Success",
 	}
 }
-
-func searchForRecords(moduleName string, gameInfo common.GameInfo, request StorageRequestData) *StorageSearchForRecordsResponse {
-	errorResponse := StorageSearchForRecordsResponse{
-		SearchForRecordsResult: "Error",
-	}
-
-	var values []map[string]StorageValue
-
-	switch gameInfo.Name + "/" + request.TableID {
-	default:
-		logging.Error(moduleName, "Unknown table")
-		for _, field := range request.Fields.Fields {
-			logging.Info(moduleName, "Field:", aurora.Cyan(field))
-		}
-		return &errorResponse
-
-	case "mariokartwii/FriendInfo":
-		// Mario Kart Wii friend info
-		match := regexp.MustCompile(`^ownerid = (\d{1,10})$`).FindStringSubmatch(request.Filter)
-		if len(match) != 2 {
-			logging.Error(moduleName, "Invalid filter")
-			return &errorResponse
-		}
-
-		ownerId, err := strconv.ParseInt(match[1], 10, 32)
-		if err != nil {
-			logging.Error(moduleName, "Invalid owner ID")
-			return &errorResponse
-		}
-
-		values = []map[string]StorageValue{
-			{
-				"ownerid":  uintValue(uint32(ownerId)),
-				"recordid": intValue(int32(ownerId)),
-				"info":     binaryDataValueBase64(database.GetMKWFriendInfo(pool, ctx, uint32(ownerId))),
-			},
-		}
-	}
-
-	// Sort the values now
-	sort.Slice(values, func(l, r int) bool {
-		lVal, lExists := values[l][request.Sort]
-		rVal, rExists := values[r][request.Sort]
-		if !lExists || !rExists {
-			// Prioritises the one that exists or goes left if both false
-			return rExists
-		}
-
-		if lVal.XMLName.Local != "intValue" && lVal.XMLName.Local != "uintValue" {
-			panic(aurora.Cyan(lVal.XMLName.Local).String() + " used as sort value")
-		}
-		// Assuming the two use the same type
-
-		lValInt, err := strconv.ParseInt(lVal.Value, 10, 64)
-		if err != nil {
-			panic(err)
-		}
-		rValInt, err := strconv.ParseInt(rVal.Value, 10, 64)
-		if err != nil {
-			panic(err)
-		}
-
-		return lValInt < rValInt
-	})
-
-	response := StorageSearchForRecordsResponse{
-		SearchForRecordsResult: "Success",
-	}
-
-	fieldCount := 0
-	valueArray := &response.Values.ArrayOfRecordValue
-	var i int
-	for i = 0; i < len(values) && i < request.Max; i++ {
-		for _, field := range request.Fields.Fields {
-			if value, ok := values[i][field]; ok {
-				fieldCount++
-				valueArray.RecordValues = append(valueArray.RecordValues, StorageRecordValue{Value: &value})
-			} else {
-				valueArray.RecordValues = append(valueArray.RecordValues, StorageRecordValue{Value: nil})
-			}
-		}
-	}
-
-	logging.Info(moduleName, "Wrote", aurora.BrightCyan(fieldCount), "field(s) across", aurora.BrightCyan(i), "record(s)")
-	return &response
-}
@@ -0,0 +1,29 @@
+package sake
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	// Mario Kart Wii ghost files (RKG): a 0x88 byte header, the compressed input data and a CRC32
+	rkgHeaderSize  = 0x88
+	rkgMinimumSize = rkgHeaderSize + 4
+	rkgMaximumSize = 0x2800
+)
+
+func init() {
+	RegisterFileValidator("mariokartwii", 4, validateMarioKartWiiGhost)
+}
+
+func validateMarioKartWiiGhost(header []byte, size int) error {
+	if !bytes.Equal(header, []byte("RKGD")) {
+		return fmt.Errorf("not a ghost file, magic is %q", header)
+	}
+
+	if size < rkgMinimumSize || size > rkgMaximumSize {
+		return fmt.Errorf("ghost file size %d is out of range", size)
+	}
+
+	return nil
+}
@@ -78,6 +78,7 @@ CREATE TABLE public.users (
     ban_reason_hidden character varying,
     ban_moderator character varying,
     ban_tos boolean,
+    ban_shadow boolean DEFAULT false,
     open_host boolean DEFAULT false
 );
 
@@ -0,0 +1,140 @@
+package selftest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"wwfc/common"
+)
+
+var (
+	// How long to wait for a reply from a server
+	replyTimeout = 5 * time.Second
+	// How long to wait for an error after a command the server doesn't acknowledge
+	settleTimeout = 500 * time.Millisecond
+
+	// ErrUnexpectedReply is returned when a server replies with something other than what the
+	// protocol expects
+	ErrUnexpectedReply = errors.New("unexpected reply")
+)
+
+// GPError is an error message from GPCM or GPSP
+type GPError struct {
+	Code    int
+	Message string
+	Fatal   bool
+}
+
+func (e *GPError) Error() string {
+	return fmt.Sprintf("GP error %d: %s", e.Code, e.Message)
+}
+
+// gsConn is a TCP connection to GPCM or GPSP, which use backslash separated messages ending in \final\
+type gsConn struct {
+	conn   net.Conn
+	buffer []byte
+}
+
+func dialGameSpy(address string) (*gsConn, error) {
+	conn, err := net.DialTimeout("tcp", address, replyTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gsConn{conn: conn}, nil
+}
+
+func (c *gsConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *gsConn) write(data string) error {
+	c.conn.SetWriteDeadline(time.Now().Add(replyTimeout))
+	_, err := c.conn.Write([]byte(data))
+	return err
+}
+
+func (c *gsConn) send(command common.GameSpyCommand) error {
+	return c.write(common.CreateGameSpyMessage(command))
+}
+
+// readMessage returns the next message, including the \final\ at the end
+func (c *gsConn) readMessage(timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if end := strings.Index(string(c.buffer), `\final\`); end != -1 {
+			end += len(`\final\`)
+			message := string(c.buffer[:end])
+			c.buffer = c.buffer[end:]
+			return message, nil
+		}
+
+		c.conn.SetReadDeadline(deadline)
+		data := make([]byte, 0x1000)
+		n, err := c.conn.Read(data)
+		if err != nil {
+			return "", err
+		}
+
+		c.buffer = append(c.buffer, data[:n]...)
+	}
+}
+
+// readCommand returns the next message that is one of the commands, skipping any other. An error
+// message is returned as a *GPError.
+func (c *gsConn) readCommand(timeout time.Duration, commands ...string) (common.GameSpyCommand, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		message, err := c.readMessage(time.Until(deadline))
+		if err != nil {
+			return common.GameSpyCommand{}, err
+		}
+
+		parsed, err := common.ParseGameSpyMessage(message)
+		if err != nil || len(parsed) == 0 {
+			return common.GameSpyCommand{}, fmt.Errorf("%w: %q", ErrUnexpectedReply, message)
+		}
+
+		command := parsed[0]
+		if command.Command == "error" {
+			return command, parseGPError(command)
+		}
+
+		for _, name := range commands {
+			if command.Command == name {
+				return command, nil
+			}
+		}
+	}
+}
+
+// settle waits briefly for an error after a command the server doesn't reply to
+func (c *gsConn) settle() error {
+	_, err := c.readCommand(settleTimeout)
+
+	var netError net.Error
+	if errors.As(err, &netError) && netError.Timeout() {
+		return nil
+	}
+
+	return err
+}
+
+func parseGPError(command common.GameSpyCommand) error {
+	code, err := strconv.Atoi(command.OtherValues["err"])
+	if err != nil {
+		return fmt.Errorf("%w: error without a code", ErrUnexpectedReply)
+	}
+
+	_, fatal := command.OtherValues["fatal"]
+	return &GPError{Code: code, Message: command.OtherValues["errmsg"], Fatal: fatal}
+}
+
+// IsGPError checks if the error is an error message from the server with the code
+func IsGPError(err error, code int) bool {
+	var gpError *GPError
+	return errors.As(err, &gpError) && gpError.Code == code
+}
@@ -0,0 +1,176 @@
+package selftest
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"wwfc/common"
+)
+
+// GPCMClient logs in to GPCM the way the GameSpy SDK on a console does
+type GPCMClient struct {
+	conn *gsConn
+
+	// Sent by the server when the connection opens
+	ServerChallenge string
+
+	// Set by Login
+	SessionKey string
+	UserID     uint64
+	ProfileID  uint32
+	UniqueNick string
+}
+
+// GPCMLogin is what the client logs in with, the auth token and challenge are from the NAS login
+type GPCMLogin struct {
+	AuthToken    string
+	NASChallenge string
+	GameName     string
+}
+
+// DialGPCM connects to GPCM and waits for the server's challenge
+func DialGPCM(address string) (*GPCMClient, error) {
+	conn, err := dialGameSpy(address)
+	if err != nil {
+		return nil, err
+	}
+
+	command, err := conn.readCommand(replyTimeout, "lc")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if command.CommandValue != "1" || command.OtherValues["challenge"] == "" {
+		conn.Close()
+		return nil, fmt.Errorf("%w: lc %s without a challenge", ErrUnexpectedReply, command.CommandValue)
+	}
+
+	return &GPCMClient{conn: conn, ServerChallenge: command.OtherValues["challenge"]}, nil
+}
+
+func (c *GPCMClient) Close() error {
+	return c.conn.Close()
+}
+
+// Login logs in and checks the server's proof
+func (c *GPCMClient) Login(login GPCMLogin) error {
+	clientChallenge := common.RandomString(10)
+
+	err := c.conn.send(common.GameSpyCommand{
+		Command: "login",
+		OtherValues: map[string]string{
+			"challenge":   clientChallenge,
+			"authtoken":   login.AuthToken,
+			"partnerid":   "11",
+			"response":    loginResponse(c.ServerChallenge, login.NASChallenge, login.AuthToken, clientChallenge),
+			"firewall":    "1",
+			"port":        "0",
+			"productid":   "11059",
+			"gamename":    login.GameName,
+			"namespaceid": "16",
+			"sdkrevision": "3",
+			"quiet":       "0",
+			"id":          "1",
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	command, err := c.conn.readCommand(replyTimeout, "lc")
+	if err != nil {
+		return err
+	}
+
+	if command.CommandValue != "2" {
+		return fmt.Errorf("%w: lc %s after login", ErrUnexpectedReply, command.CommandValue)
+	}
+
+	// The proof is the response with the challenges swapped
+	if command.OtherValues["proof"] != loginResponse(clientChallenge, login.NASChallenge, login.AuthToken, c.ServerChallenge) {
+		return fmt.Errorf("%w: invalid login proof", ErrUnexpectedReply)
+	}
+
+	userId, err := strconv.ParseUint(command.OtherValues["userid"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid userid", ErrUnexpectedReply)
+	}
+
+	profileId, err := strconv.ParseUint(command.OtherValues["profileid"], 10, 32)
+	if err != nil {
+		return fmt.Errorf("%w: invalid profileid", ErrUnexpectedReply)
+	}
+
+	c.SessionKey = command.OtherValues["sesskey"]
+	c.UserID = userId
+	c.ProfileID = uint32(profileId)
+	c.UniqueNick = command.OtherValues["uniquenick"]
+	return nil
+}
+
+// Status sets the client's status. The server doesn't reply unless there's an error.
+func (c *GPCMClient) Status(status string, statString string, locString string) error {
+	err := c.conn.send(common.GameSpyCommand{
+		Command:      "status",
+		CommandValue: status,
+		OtherValues: map[string]string{
+			"sesskey":    c.SessionKey,
+			"statstring": statString,
+			"locstring":  locString,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.conn.settle()
+}
+
+// AddBuddy sends a friend request. The server doesn't reply unless there's an error.
+func (c *GPCMClient) AddBuddy(profileId uint32) error {
+	err := c.conn.send(common.GameSpyCommand{
+		Command: "addbuddy",
+		OtherValues: map[string]string{
+			"sesskey":      c.SessionKey,
+			"newprofileid": strconv.FormatUint(uint64(profileId), 10),
+			"reason":       "",
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.conn.settle()
+}
+
+// KeepAlive sends a keep alive and waits for the server to echo it
+func (c *GPCMClient) KeepAlive() error {
+	if err := c.conn.write(`\ka\\final\`); err != nil {
+		return err
+	}
+
+	_, err := c.conn.readCommand(replyTimeout, "ka")
+	return err
+}
+
+// SendRaw sends data as is and returns the first error message the server replies with, or nil if
+// it only replied with something else
+func (c *GPCMClient) SendRaw(data string) error {
+	if err := c.conn.write(data); err != nil {
+		return err
+	}
+
+	return c.conn.settle()
+}
+
+// loginResponse is the response to the server's challenge in the login request
+func loginResponse(serverChallenge, nasChallenge, authToken, clientChallenge string) string {
+	nasHash := md5.Sum([]byte(nasChallenge))
+	nasHashHex := hex.EncodeToString(nasHash[:])
+
+	response := md5.Sum([]byte(nasHashHex + strings.Repeat(" ", 48) + authToken + clientChallenge + serverChallenge + nasHashHex))
+	return hex.EncodeToString(response[:])
+}
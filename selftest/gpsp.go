@@ -0,0 +1,118 @@
+package selftest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"wwfc/common"
+)
+
+// SearchResult is a profile found by a GPSP search
+type SearchResult struct {
+	ProfileID  uint32
+	Nick       string
+	UniqueNick string
+	FirstName  string
+	LastName   string
+	Email      string
+}
+
+// SearchReply is the reply to a GPSP search
+type SearchReply struct {
+	Results []SearchResult
+	// Number of results after this page
+	More int
+}
+
+// Search connects to GPSP and searches for profiles with the fields, like a console adding a friend
+// by name. The session key is from the GPCM login of the profile.
+func Search(address string, profileId uint32, sessionKey string, fields map[string]string) (*SearchReply, error) {
+	conn, err := dialGameSpy(address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	otherValues := map[string]string{
+		"sesskey":     sessionKey,
+		"profileid":   strconv.FormatUint(uint64(profileId), 10),
+		"namespaceid": "16",
+	}
+	for key, value := range fields {
+		otherValues[key] = value
+	}
+
+	if err := conn.send(common.GameSpyCommand{Command: "search", OtherValues: otherValues}); err != nil {
+		return nil, err
+	}
+
+	message, err := conn.readMessage(replyTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSearchReply(message)
+}
+
+// parseSearchReply parses the results of a search, which repeat the same keys for every profile
+// so it can't be parsed as a regular message
+func parseSearchReply(message string) (*SearchReply, error) {
+	values := strings.Split(strings.TrimPrefix(message, `\`), `\`)
+
+	reply := &SearchReply{}
+	var result *SearchResult
+	for i := 0; i+1 < len(values); i += 2 {
+		key, value := values[i], values[i+1]
+
+		switch key {
+		case "error":
+			commands, err := common.ParseGameSpyMessage(message)
+			if err != nil || len(commands) == 0 {
+				return nil, fmt.Errorf("%w: %q", ErrUnexpectedReply, message)
+			}
+			return nil, parseGPError(commands[0])
+
+		case "bsr":
+			profileId, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid profile ID %q", ErrUnexpectedReply, value)
+			}
+
+			reply.Results = append(reply.Results, SearchResult{ProfileID: uint32(profileId)})
+			result = &reply.Results[len(reply.Results)-1]
+
+		case "bsrdone":
+			result = nil
+
+		case "more":
+			more, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid more %q", ErrUnexpectedReply, value)
+			}
+			reply.More = more
+
+		case "final":
+			return reply, nil
+
+		default:
+			if result == nil {
+				continue
+			}
+
+			switch key {
+			case "nick":
+				result.Nick = value
+			case "uniquenick":
+				result.UniqueNick = value
+			case "firstname":
+				result.FirstName = value
+			case "lastname":
+				result.LastName = value
+			case "email":
+				result.Email = value
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrUnexpectedReply, message)
+}
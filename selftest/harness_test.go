@@ -0,0 +1,136 @@
+package selftest
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"wwfc/common"
+	"wwfc/logging"
+)
+
+// testFrontend stands in for the frontend: it accepts the clients' connections on ephemeral ports,
+// passes their data to the servers, and takes the servers' replies over RPC like the frontend does
+type testFrontend struct {
+	mutex     sync.Mutex
+	conns     map[string]map[uint64]net.Conn
+	nextIndex uint64
+}
+
+// backendServer is the part of a server the frontend forwards connections to
+type backendServer struct {
+	newConnection   func(index uint64, address string, traceID string)
+	handlePacket    func(index uint64, data []byte, address string)
+	closeConnection func(index uint64)
+}
+
+var errTestBadIndex = errors.New("connection not found")
+
+func newTestFrontend() *testFrontend {
+	return &testFrontend{conns: map[string]map[uint64]net.Conn{}}
+}
+
+// serveRPC listens for the backend's calls, returns the address for backendFrontendAddress
+func (f *testFrontend) serveRPC() (string, error) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("RPCFrontendPacket", f); err != nil {
+		return "", err
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	go server.Accept(l)
+	return l.Addr().String(), nil
+}
+
+func (f *testFrontend) SendPacket(args common.RPCFrontendPacket, _ *struct{}) error {
+	conn := f.getConn(args.Server, args.Index)
+	if conn == nil {
+		return errTestBadIndex
+	}
+
+	data, err := common.DecompressData(args.Data, args.Compressed)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(data)
+	return err
+}
+
+func (f *testFrontend) CloseConnection(args common.RPCFrontendPacket, _ *struct{}) error {
+	conn := f.getConn(args.Server, args.Index)
+	if conn == nil {
+		return errTestBadIndex
+	}
+
+	return conn.Close()
+}
+
+func (f *testFrontend) getConn(server string, index uint64) net.Conn {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.conns[server][index]
+}
+
+// listen accepts connections for the server on an ephemeral port and returns the address
+func (f *testFrontend) listen(name string, server backendServer) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	f.mutex.Lock()
+	f.conns[name] = map[uint64]net.Conn{}
+	f.mutex.Unlock()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go f.handleConnection(name, server, conn)
+		}
+	}()
+
+	return l.Addr().String(), nil
+}
+
+func (f *testFrontend) handleConnection(name string, server backendServer, conn net.Conn) {
+	address := conn.RemoteAddr().String()
+
+	f.mutex.Lock()
+	f.nextIndex++
+	index := f.nextIndex
+	f.conns[name][index] = conn
+	f.mutex.Unlock()
+
+	defer func() {
+		conn.Close()
+
+		f.mutex.Lock()
+		delete(f.conns[name], index)
+		f.mutex.Unlock()
+
+		server.closeConnection(index)
+	}()
+
+	server.newConnection(index, address, logging.NewTraceID(name, index))
+
+	buffer := make([]byte, 0x1000)
+	for {
+		n, err := conn.Read(buffer)
+		if n > 0 {
+			server.handlePacket(index, append([]byte{}, buffer[:n]...), address)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package selftest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"wwfc/common"
+)
+
+// NASLogin is the account a console logs in to NAS with
+type NASLogin struct {
+	GameCode string
+	UserID   uint64
+	GsbrCode string
+	// Console friend code
+	CFC string
+}
+
+// NASLoginReply is what GPCM needs from a successful NAS login
+type NASLoginReply struct {
+	ReturnCode string
+	Token      string
+	Challenge  string
+}
+
+// LoginNAS logs in to NAS over HTTP as a Wii
+func LoginNAS(address string, login NASLogin) (*NASLoginReply, error) {
+	form := url.Values{}
+	for key, value := range map[string]string{
+		"action":  "login",
+		"gamecd":  login.GameCode,
+		"userid":  fmt.Sprint(login.UserID),
+		"gsbrcd":  login.GsbrCode,
+		"cfc":     login.CFC,
+		"unitcd":  "1",
+		"region":  "ff",
+		"lang":    "01",
+		"sdkver":  "001000",
+		"makercd": "01",
+	} {
+		form.Set(key, common.Base64DwcEncoding.EncodeToString([]byte(value)))
+	}
+
+	client := http.Client{Timeout: replyTimeout}
+	request, err := http.NewRequest("POST", "http://"+address+"/ac", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Host = "nas.nintendowifi.net"
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: HTTP status %s", ErrUnexpectedReply, response.Status)
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// DWC reads the reply as a null terminated string
+	values, err := url.ParseQuery(strings.TrimRight(string(body), "\x00"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnexpectedReply, err)
+	}
+
+	decoded := map[string]string{}
+	for key := range values {
+		value, err := common.Base64DwcEncoding.DecodeString(values.Get(key))
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid %s", ErrUnexpectedReply, key)
+		}
+		decoded[key] = string(value)
+	}
+
+	reply := &NASLoginReply{ReturnCode: decoded["returncd"], Token: decoded["token"], Challenge: decoded["challenge"]}
+	if reply.ReturnCode != "001" && reply.ReturnCode != "040" {
+		return reply, fmt.Errorf("%w: NAS login returned %s", ErrUnexpectedReply, reply.ReturnCode)
+	}
+
+	return reply, nil
+}
@@ -0,0 +1,130 @@
+package selftest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+	"wwfc/qr2"
+)
+
+// QR2Host advertises a server through QR2, the way a console hosting a room does
+type QR2Host struct {
+	conn      net.Conn
+	sessionID uint32
+	gameName  string
+}
+
+// DialQR2 opens a socket to QR2 for the game
+func DialQR2(address string, gameName string) (*QR2Host, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QR2Host{conn: conn, sessionID: rand.Uint32(), gameName: gameName}, nil
+}
+
+func (h *QR2Host) Close() error {
+	return h.conn.Close()
+}
+
+// Port is the host's port, which the server list shows when the host is on the client's network
+func (h *QR2Host) Port() uint16 {
+	return uint16(h.conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// Available checks if QR2 is accepting servers for the game
+func (h *QR2Host) Available() error {
+	request := []byte{qr2.AvailableRequest, 0, 0, 0, 0}
+	request = append(request, h.gameName...)
+	request = append(request, 0)
+
+	reply, err := h.exchange(request, qr2.AvailableRequest)
+	if err != nil {
+		return err
+	}
+
+	if binary.BigEndian.Uint32(reply[3:7]) != 0 {
+		return errors.New("QR2 is unavailable for " + h.gameName)
+	}
+	return nil
+}
+
+// Register sends a heartbeat with the fields and answers the challenge, after which the host is
+// listed by the server browser
+func (h *QR2Host) Register(fields map[string]string) error {
+	reply, err := h.exchange(h.heartbeat(fields), qr2.ChallengeRequest)
+	if err != nil {
+		return err
+	}
+
+	// The server doesn't verify the response yet, so send the challenge back like an old SDK would
+	response := []byte{qr2.ChallengeRequest}
+	response = binary.BigEndian.AppendUint32(response, h.sessionID)
+	response = append(response, reply[7:]...)
+
+	_, err = h.exchange(response, qr2.ClientRegisteredReply)
+	return err
+}
+
+// Heartbeat updates the host's fields, the server doesn't reply once the host is registered
+func (h *QR2Host) Heartbeat(fields map[string]string) error {
+	h.conn.SetWriteDeadline(time.Now().Add(replyTimeout))
+	_, err := h.conn.Write(h.heartbeat(fields))
+	return err
+}
+
+// Exit removes the host from the server list
+func (h *QR2Host) Exit() error {
+	return h.Heartbeat(map[string]string{"statechanged": "2"})
+}
+
+func (h *QR2Host) heartbeat(fields map[string]string) []byte {
+	heartbeat := []byte{qr2.HeartbeatRequest}
+	heartbeat = binary.BigEndian.AppendUint32(heartbeat, h.sessionID)
+
+	// Without a public IP the host is challenged every time, like a console that hasn't seen its
+	// public address yet
+	heartbeat = appendKey(heartbeat, "gamename", h.gameName)
+	heartbeat = appendKey(heartbeat, "publicip", "0")
+	heartbeat = appendKey(heartbeat, "publicport", "0")
+	for key, value := range fields {
+		heartbeat = appendKey(heartbeat, key, value)
+	}
+
+	return append(heartbeat, 0)
+}
+
+func appendKey(data []byte, key string, value string) []byte {
+	data = append(data, key...)
+	data = append(data, 0)
+	data = append(data, value...)
+	return append(data, 0)
+}
+
+// exchange sends the packet and waits for a reply with the command, skipping others
+func (h *QR2Host) exchange(packet []byte, command byte) ([]byte, error) {
+	h.conn.SetDeadline(time.Now().Add(replyTimeout))
+	if _, err := h.conn.Write(packet); err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, 0x800)
+	for {
+		n, err := h.conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 7 || buffer[0] != 0xfe || buffer[1] != 0xfd {
+			return nil, fmt.Errorf("%w: %d bytes from QR2", ErrUnexpectedReply, n)
+		}
+
+		if buffer[2] == command {
+			return append([]byte{}, buffer[:n]...), nil
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Package selftest has minimal GameSpy clients for checking the servers end to end, the way a
+// console talks to them. The checks run in the tests against servers started in process, and
+// against a deployment with "cmd b selftest".
+package selftest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+	"wwfc/common"
+	"wwfc/gpcm"
+	"wwfc/serverbrowser"
+)
+
+// Target is where the checks find the servers, each address is host:port
+type Target struct {
+	NAS           string
+	GPCM          string
+	GPSP          string
+	ServerBrowser string
+	QR2           string
+
+	GameName  string
+	SecretKey string
+
+	// The account the login check uses, it's created on the first run
+	Login NASLogin
+}
+
+// DefaultLogin is the account used by the login check. The user ID is the highest NAS accepts, far
+// from the random ones consoles are given.
+var DefaultLogin = NASLogin{
+	GameCode: "RMCJ",
+	UserID:   0x7ffffffffff,
+	GsbrCode: "RMCJselftest",
+	CFC:      "1000000000000000",
+}
+
+// NewTarget finds the servers on the host at the ports in the config
+func NewTarget(config common.Config, host string) Target {
+	address := func(name string) string {
+		return net.JoinHostPort(host, strconv.Itoa(config.GetServerPort(name)))
+	}
+
+	target := Target{
+		GPCM:          address("gpcm"),
+		GPSP:          address("gpsp"),
+		ServerBrowser: address("serverbrowser"),
+		QR2:           address("qr2"),
+		GameName:      "mariokartwii",
+		Login:         DefaultLogin,
+	}
+
+	if config.IsServerEnabled("nas") {
+		target.NAS = net.JoinHostPort(host, config.NASPort)
+	}
+
+	return target
+}
+
+// Result is the outcome of one check
+type Result struct {
+	Name     string
+	Err      error
+	Duration time.Duration
+}
+
+// Check is a single end to end check
+type Check struct {
+	Name string
+	Run  func(target Target) error
+}
+
+// ErrSkipped is returned by a check that can't run against the target
+var ErrSkipped = errors.New("skipped")
+
+// Checks are run in order by Run
+var Checks = []Check{
+	{"gpcm challenge", CheckGPCMChallenge},
+	{"gpcm malformed", CheckGPCMMalformed},
+	{"gpsp malformed", CheckGPSPMalformed},
+	{"login", CheckLogin},
+	{"server list", CheckServerList},
+	{"server list malformed", CheckServerListMalformed},
+}
+
+// Run runs every check against the target
+func Run(target Target) []Result {
+	var results []Result
+	for _, check := range Checks {
+		start := time.Now()
+		err := check.Run(target)
+		results = append(results, Result{Name: check.Name, Err: err, Duration: time.Since(start)})
+	}
+
+	return results
+}
+
+// CheckGPCMChallenge checks GPCM sends a challenge and answers a keep alive
+func CheckGPCMChallenge(target Target) error {
+	client, err := DialGPCM(target.GPCM)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.KeepAlive()
+}
+
+// CheckGPCMMalformed checks GPCM replies to invalid requests with the right errors
+func CheckGPCMMalformed(target Target) error {
+	for _, test := range []struct {
+		description string
+		data        string
+		code        int
+	}{
+		{"command before login", `\status\1\sesskey\1\statstring\\locstring\\final\`, gpcm.ErrNotLoggedIn.ErrorCode},
+		{"null byte", "\\login\\\x00\\final\\", gpcm.ErrParse.ErrorCode},
+		{"login without an auth token", `\login\\challenge\abcdefghij\response\0\gamename\mariokartwii\id\1\final\`, gpcm.ErrLogin.ErrorCode},
+	} {
+		client, err := DialGPCM(target.GPCM)
+		if err != nil {
+			return err
+		}
+
+		err = client.SendRaw(test.data)
+		client.Close()
+		if !IsGPError(err, test.code) {
+			return fmt.Errorf("%s: expected error %d, got %v", test.description, test.code, err)
+		}
+	}
+
+	return nil
+}
+
+// CheckGPSPMalformed checks GPSP refuses a search with an invalid session key
+func CheckGPSPMalformed(target Target) error {
+	_, err := Search(target.GPSP, 1, "1", map[string]string{"uniquenick": "selftest"})
+	if !IsGPError(err, gpcm.ErrSearch.ErrorCode) {
+		return fmt.Errorf("expected error %d, got %v", gpcm.ErrSearch.ErrorCode, err)
+	}
+
+	return nil
+}
+
+// CheckLogin logs in through NAS and GPCM, sets a status, adds itself as a friend which GPCM refuses,
+// and searches GPSP with the session
+func CheckLogin(target Target) error {
+	if target.NAS == "" {
+		return ErrSkipped
+	}
+
+	nasReply, err := LoginNAS(target.NAS, target.Login)
+	if err != nil {
+		return fmt.Errorf("NAS: %w", err)
+	}
+
+	client, err := DialGPCM(target.GPCM)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	err = client.Login(GPCMLogin{AuthToken: nasReply.Token, NASChallenge: nasReply.Challenge, GameName: target.GameName})
+	if err != nil {
+		return fmt.Errorf("GPCM login: %w", err)
+	}
+
+	if err := client.Status("1", "", ""); err != nil {
+		return fmt.Errorf("status: %w", err)
+	}
+
+	if err := client.AddBuddy(client.ProfileID); !IsGPError(err, gpcm.ErrAddFriendBadNew.ErrorCode) {
+		return fmt.Errorf("addbuddy self: expected error %d, got %v", gpcm.ErrAddFriendBadNew.ErrorCode, err)
+	}
+
+	if err := client.KeepAlive(); err != nil {
+		return fmt.Errorf("keep alive: %w", err)
+	}
+
+	// Nothing to search for, but the session key has to be accepted
+	if _, err := Search(target.GPSP, client.ProfileID, client.SessionKey, nil); err != nil {
+		return fmt.Errorf("GPSP search: %w", err)
+	}
+
+	return nil
+}
+
+// CheckServerList registers a QR2 host and finds it in the server list with a self lookup, the way a
+// console finds its own room. A self lookup only lists hosts on the caller's network, so the host
+// doesn't show up for anyone else.
+func CheckServerList(target Target) error {
+	host, err := DialQR2(target.QR2, target.GameName)
+	if err != nil {
+		return err
+	}
+	defer host.Close()
+
+	if err := host.Available(); err != nil {
+		return fmt.Errorf("available: %w", err)
+	}
+
+	if err := host.Register(map[string]string{"natneg": "1", "statechanged": "1"}); err != nil {
+		return fmt.Errorf("QR2: %w", err)
+	}
+	defer host.Exit()
+
+	list, err := RequestServerList(target.ServerBrowser, ListRequest{
+		QueryGame: target.GameName,
+		GameName:  target.GameName,
+		SecretKey: target.SecretKey,
+		Filter:    "dwc_pid = 1",
+		Fields:    []string{"dwc_pid", "natneg"},
+	})
+	if err != nil {
+		return fmt.Errorf("server list: %w", err)
+	}
+
+	for _, server := range list.Servers {
+		if server.Port == host.Port() && server.Fields["natneg"] == "1" {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("host on port %d isn't in the server list of %d servers", host.Port(), len(list.Servers))
+}
+
+// CheckServerListMalformed checks the server browser closes the connection on requests it can't answer
+func CheckServerListMalformed(target Target) error {
+	request := ListRequest{QueryGame: target.GameName, GameName: target.GameName}
+	if err := SendListRequest(target.ServerBrowser, request, serverbrowser.EncodingEnctype1); err != nil {
+		return fmt.Errorf("enctype 1: %w", err)
+	}
+
+	// Shorter than the length and command
+	if err := ExpectServerBrowserClose(target.ServerBrowser, []byte{0x00, 0x02, 0x00}); err != nil {
+		return fmt.Errorf("invalid length: %w", err)
+	}
+
+	return nil
+}
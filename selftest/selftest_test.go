@@ -0,0 +1,246 @@
+package selftest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"wwfc/common"
+	"wwfc/gpcm"
+	"wwfc/gpsp"
+	"wwfc/qr2"
+	"wwfc/serverbrowser"
+)
+
+// Where the servers started by TestMain listen
+var target Target
+
+// TestMain starts QR2 and the server browser, and the parts of GPCM and GPSP that don't need the
+// database. The login check needs a database, it only runs against a deployment.
+func TestMain(m *testing.M) {
+	os.Exit(runServers(m))
+}
+
+func runServers(m *testing.M) int {
+	frontend := newTestFrontend()
+	rpcAddress, err := frontend.serveRPC()
+	if err != nil {
+		panic(err)
+	}
+
+	// The servers read the config from the working directory
+	dir, err := os.MkdirTemp("", "selftest")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := fmt.Sprintf("<Config><backendFrontendAddress>%s</backendFrontendAddress></Config>", rpcAddress)
+	if err := os.WriteFile(filepath.Join(dir, "config.xml"), []byte(config), 0644); err != nil {
+		panic(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	defer os.Chdir(wd)
+
+	gameId := 1687
+	common.ApplyGameConfig(common.Config{Games: []common.GameConfig{{Name: "mariokartwii", GameID: &gameId, SecretKey: "9r3Rmy"}}})
+
+	qr2Conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	qr2.StartServerOn(qr2Conn, false)
+	serverbrowser.StartServer(false)
+
+	target = Target{
+		QR2:       qr2Conn.LocalAddr().String(),
+		GameName:  "mariokartwii",
+		SecretKey: "9r3Rmy",
+	}
+
+	target.GPCM, err = frontend.listen(gpcm.ServerName, backendServer{
+		newConnection:   gpcm.NewConnection,
+		handlePacket:    func(index uint64, data []byte, _ string) { gpcm.HandlePacket(index, data) },
+		closeConnection: gpcm.CloseConnection,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	target.GPSP, err = frontend.listen(gpsp.ServerName, backendServer{
+		newConnection:   gpsp.NewConnection,
+		handlePacket:    func(index uint64, data []byte, _ string) { gpsp.HandlePacket(index, data) },
+		closeConnection: gpsp.CloseConnection,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	target.ServerBrowser, err = frontend.listen(serverbrowser.ServerName, backendServer{
+		newConnection:   serverbrowser.NewConnection,
+		handlePacket:    serverbrowser.HandlePacket,
+		closeConnection: serverbrowser.CloseConnection,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return m.Run()
+}
+
+func TestGPCMChallenge(t *testing.T) {
+	if err := CheckGPCMChallenge(target); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGPCMMalformed(t *testing.T) {
+	if err := CheckGPCMMalformed(target); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGPCMLoginBadResponse(t *testing.T) {
+	client, err := DialGPCM(target.GPCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	authToken, _ := common.MarshalNASAuthToken("RMCJ", DefaultLogin.UserID, DefaultLogin.GsbrCode, 1000000000000000, 0xff, 1, "", 1, false, "")
+	err = client.Login(GPCMLogin{AuthToken: authToken, NASChallenge: "wrong", GameName: "mariokartwii"})
+	if !IsGPError(err, gpcm.ErrLogin.ErrorCode) {
+		t.Errorf("expected error %d, got %v", gpcm.ErrLogin.ErrorCode, err)
+	}
+}
+
+func TestGPSPMalformed(t *testing.T) {
+	if err := CheckGPSPMalformed(target); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServerList(t *testing.T) {
+	if err := CheckServerList(target); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServerListLoggedIn(t *testing.T) {
+	// Stands in for the GPCM login, which needs the database
+	const profileId = 600000001
+	qr2.Login(profileId, "RMCJ", "", 0, "RMCJ", "127.0.0.1:1", false, true, false, false, false, false, "")
+	defer qr2.Logout(profileId)
+
+	host, err := DialQR2(target.QR2, target.GameName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+
+	if err := host.Register(map[string]string{"dwc_pid": fmt.Sprint(profileId), "natneg": "1", "statechanged": "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	request := ListRequest{
+		QueryGame: target.GameName,
+		GameName:  target.GameName,
+		SecretKey: target.SecretKey,
+		Filter:    fmt.Sprintf("dwc_pid = %d and natneg = 1", profileId),
+		Fields:    []string{"dwc_pid", "natneg"},
+	}
+
+	list, err := RequestServerList(target.ServerBrowser, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Servers) != 1 || list.Servers[0].Port != host.Port() || list.Servers[0].Fields["dwc_pid"] != fmt.Sprint(profileId) {
+		t.Fatalf("unexpected server list: %+v", list)
+	}
+	if !list.ClientIP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("unexpected client IP %s", list.ClientIP)
+	}
+
+	if err := host.Exit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The heartbeat isn't acknowledged
+	for i := 0; ; i++ {
+		list, err = RequestServerList(target.ServerBrowser, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Servers) == 0 {
+			break
+		}
+		if i == 20 {
+			t.Fatalf("host is still listed after exiting: %+v", list)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestServerListMalformed(t *testing.T) {
+	if err := CheckServerListMalformed(target); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDisabledGame(t *testing.T) {
+	common.SetGameEnabled(1687, false)
+	defer common.SetGameEnabled(1687, true)
+
+	host, err := DialQR2(target.QR2, target.GameName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+
+	if err := host.Available(); err == nil {
+		t.Error("QR2 is available for a disabled game")
+	}
+
+	request := ListRequest{QueryGame: target.GameName, GameName: target.GameName, SecretKey: target.SecretKey}
+	if _, err := RequestServerList(target.ServerBrowser, request); err == nil {
+		t.Error("server list was sent for a disabled game")
+	}
+
+	client, err := DialGPCM(target.GPCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	authToken, _ := common.MarshalNASAuthToken("RMCJ", DefaultLogin.UserID, DefaultLogin.GsbrCode, 1000000000000000, 0xff, 1, "", 1, false, "")
+	err = client.Login(GPCMLogin{AuthToken: authToken, NASChallenge: "challenge", GameName: target.GameName})
+	var gpError *GPError
+	if !errors.As(err, &gpError) || gpError.Message != common.GameUnavailableMessage {
+		t.Errorf("expected the game to be unavailable, got %v", err)
+	}
+}
+
+func TestParseSearchReply(t *testing.T) {
+	reply, err := parseSearchReply(`\bsr\1\nick\one\uniquenick\u1\bsr\2\nick\two\bsrdone\\more\3\final\`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Results) != 2 || reply.Results[0].Nick != "one" || reply.Results[0].UniqueNick != "u1" || reply.Results[1].ProfileID != 2 || reply.More != 3 {
+		t.Errorf("unexpected reply: %+v", reply)
+	}
+
+	_, err = parseSearchReply(gpcm.ErrSearch.GetMessage())
+	if !IsGPError(err, gpcm.ErrSearch.ErrorCode) {
+		t.Errorf("expected error %d, got %v", gpcm.ErrSearch.ErrorCode, err)
+	}
+}
@@ -0,0 +1,254 @@
+package selftest
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+	"wwfc/common"
+	"wwfc/serverbrowser"
+)
+
+// ListRequest is a server list request, the way DWC looks for rooms to join
+type ListRequest struct {
+	QueryGame string
+	GameName  string
+	// The game's secret key, used to decrypt the list
+	SecretKey string
+	Filter    string
+	Fields    []string
+	Options   uint32
+}
+
+// ListedServer is an entry in the server list
+type ListedServer struct {
+	Flags byte
+	// The public address, or the search ID for servers not on the client's network
+	IP   uint32
+	Port uint16
+
+	LocalIP   uint32
+	LocalPort uint16
+
+	// The requested fields, in the order of the request
+	Fields map[string]string
+}
+
+// ServerList is the reply to a ListRequest
+type ServerList struct {
+	// The client's address as seen by the server
+	ClientIP   net.IP
+	ClientPort uint16
+
+	Fields  []string
+	Servers []ListedServer
+}
+
+// errIncomplete is returned while parsing a server list that wasn't fully received
+var errIncomplete = errors.New("incomplete server list")
+
+// RequestServerList connects to the server browser and requests a server list
+func RequestServerList(address string, request ListRequest) (*ServerList, error) {
+	conn, err := net.DialTimeout("tcp", address, replyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	challenge := make([]byte, 8)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(replyTimeout))
+	if _, err := conn.Write(request.encode(serverbrowser.EncodingEnctypeX, challenge)); err != nil {
+		return nil, err
+	}
+
+	var received []byte
+	buffer := make([]byte, 0x1000)
+	for {
+		n, err := conn.Read(buffer)
+		received = append(received, buffer[:n]...)
+
+		if n > 0 {
+			list, parseErr := decodeServerList(request, challenge, received)
+			if parseErr == nil {
+				return list, nil
+			}
+			if !errors.Is(parseErr, errIncomplete) && !errors.Is(parseErr, common.ErrInvalidTypeXHeader) {
+				return nil, parseErr
+			}
+		}
+
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("connection closed after %d bytes of the server list", len(received))
+			}
+			return nil, err
+		}
+	}
+}
+
+// SendListRequest sends a list request with the encoding and waits for the server to close the
+// connection, to check that requests the server can't answer are refused
+func SendListRequest(address string, request ListRequest, encoding byte) error {
+	challenge := make([]byte, 8)
+	return ExpectServerBrowserClose(address, request.encode(encoding, challenge))
+}
+
+// ExpectServerBrowserClose sends the data to the server browser and checks it closes the connection
+// without replying
+func ExpectServerBrowserClose(address string, data []byte) error {
+	conn, err := net.DialTimeout("tcp", address, replyTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(replyTimeout))
+	if _, err := conn.Write(data); err != nil {
+		return err
+	}
+
+	n, err := conn.Read(make([]byte, 0x1000))
+	if n > 0 {
+		return fmt.Errorf("%w: server replied with %d bytes", ErrUnexpectedReply, n)
+	}
+	if !errors.Is(err, io.EOF) {
+		return fmt.Errorf("connection wasn't closed: %w", err)
+	}
+
+	return nil
+}
+
+// encode creates the request, including the length at the start
+func (r ListRequest) encode(encoding byte, challenge []byte) []byte {
+	// Length, command, protocol version, encoding version, game version
+	data := []byte{0, 0, serverbrowser.ServerListRequest, 1, encoding, 0, 0, 0, 0}
+	data = append(data, r.QueryGame...)
+	data = append(data, 0)
+	data = append(data, r.GameName...)
+	data = append(data, 0)
+	data = append(data, challenge...)
+	data = append(data, r.Filter...)
+	data = append(data, 0)
+	if len(r.Fields) != 0 {
+		data = append(data, `\`+strings.Join(r.Fields, `\`)...)
+	}
+	data = append(data, 0)
+	data = binary.BigEndian.AppendUint32(data, r.Options)
+
+	binary.BigEndian.PutUint16(data, uint16(len(data)))
+	return data
+}
+
+// decodeServerList decrypts and parses the list, returns errIncomplete if more data is needed
+func decodeServerList(request ListRequest, challenge []byte, data []byte) (*ServerList, error) {
+	decrypted, err := common.DecryptTypeX([]byte(request.SecretKey), challenge, data)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := listReader{data: decrypted}
+
+	list := &ServerList{}
+	list.ClientIP = net.IP(reader.bytes(4))
+	list.ClientPort = reader.uint16()
+
+	fieldCount := reader.byte()
+	for i := byte(0); i < fieldCount && reader.err == nil; i++ {
+		if keyType := reader.byte(); keyType != serverbrowser.KeyTypeString && reader.err == nil {
+			return nil, fmt.Errorf("%w: field key type %d", ErrUnexpectedReply, keyType)
+		}
+		list.Fields = append(list.Fields, reader.string())
+	}
+
+	// Popular values, the server never sends any
+	if count := reader.byte(); count != 0 && reader.err == nil {
+		return nil, fmt.Errorf("%w: %d popular values", ErrUnexpectedReply, count)
+	}
+
+	if request.Options&serverbrowser.NoServerListOption != 0 {
+		return list, reader.err
+	}
+
+	for reader.err == nil {
+		server := ListedServer{Flags: reader.byte(), IP: reader.uint32()}
+		if server.Flags == 0 && server.IP == 0xffffffff {
+			return list, reader.err
+		}
+
+		if server.Flags&serverbrowser.NonstandardPortFlag != 0 {
+			server.Port = reader.uint16()
+		}
+		if server.Flags&serverbrowser.PrivateIPFlag != 0 {
+			server.LocalIP = reader.uint32()
+		}
+		if server.Flags&serverbrowser.NonstandardPrivatePortFlag != 0 {
+			server.LocalPort = reader.uint16()
+		}
+		if server.Flags&serverbrowser.ICMPIPFlag != 0 {
+			reader.uint32()
+		}
+
+		if server.Flags&serverbrowser.HasKeysFlag != 0 {
+			server.Fields = map[string]string{}
+			for _, field := range list.Fields {
+				if valueType := reader.byte(); valueType != 0xff && reader.err == nil {
+					return nil, fmt.Errorf("%w: value type %d", ErrUnexpectedReply, valueType)
+				}
+				server.Fields[field] = reader.string()
+			}
+		}
+
+		list.Servers = append(list.Servers, server)
+	}
+
+	return nil, reader.err
+}
+
+// listReader reads values from a server list, setting errIncomplete if it runs out of data
+type listReader struct {
+	data []byte
+	err  error
+}
+
+func (r *listReader) bytes(n int) []byte {
+	if r.err != nil || len(r.data) < n {
+		r.err = errIncomplete
+		return make([]byte, n)
+	}
+
+	value := r.data[:n]
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *listReader) byte() byte {
+	return r.bytes(1)[0]
+}
+
+func (r *listReader) uint16() uint16 {
+	return binary.BigEndian.Uint16(r.bytes(2))
+}
+
+func (r *listReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(r.bytes(4))
+}
+
+func (r *listReader) string() string {
+	end := strings.IndexByte(string(r.data), 0)
+	if r.err != nil || end == -1 {
+		r.err = errIncomplete
+		return ""
+	}
+
+	value := string(r.data[:end])
+	r.data = r.data[end+1:]
+	return value
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// Bytes that can wait to be written to one connection before it's considered dead, 0 for no limit
+var sendQueueLimit atomic.Int64
+
+// sendQueue holds the packets the backend sent to a connection until its writer goroutine writes
+// them, so a slow client only holds up its own packets
+type sendQueue struct {
+	mutex   sync.Mutex
+	packets [][]byte
+	// Bytes queued and not yet written
+	queued int
+	// Set by CloseConnection, the connection is closed with the reason once the queue is empty
+	closeReason error
+	// Wakes the writer, never blocks the sender
+	wake chan struct{}
+}
+
+// queuePacket queues the data for the writer. Returns false if the connection has too much data
+// waiting, in which case it's closed and nothing is queued.
+func (c *frontendConn) queuePacket(data []byte) bool {
+	c.send.mutex.Lock()
+
+	if limit := sendQueueLimit.Load(); limit > 0 && int64(c.send.queued+len(data)) > limit {
+		queued := c.send.queued
+		c.send.mutex.Unlock()
+
+		logging.Error("FRONTEND", "Closing", aurora.BrightCyan(c.RemoteAddr().String()), "with", aurora.Cyan(queued), "bytes waiting to be sent")
+		c.cancel(closeReasonSendQueueFull)
+		return false
+	}
+
+	c.send.packets = append(c.send.packets, data)
+	c.send.queued += len(data)
+	c.send.mutex.Unlock()
+
+	c.wakeWriter()
+	return true
+}
+
+// closeAfterSend closes the connection once every queued packet is written
+func (c *frontendConn) closeAfterSend(reason error) {
+	c.send.mutex.Lock()
+	if c.send.closeReason == nil {
+		c.send.closeReason = reason
+	}
+	c.send.mutex.Unlock()
+
+	c.wakeWriter()
+}
+
+func (c *frontendConn) wakeWriter() {
+	select {
+	case c.send.wake <- struct{}{}:
+	default:
+	}
+}
+
+// writeLoop writes the queued packets in order until the connection is cancelled. A failed write
+// cancels the connection, which then tells the backend it closed.
+func (c *frontendConn) writeLoop() {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.send.wake:
+		}
+
+		for {
+			c.send.mutex.Lock()
+			packets := c.send.packets
+			c.send.packets = nil
+			closeReason := c.send.closeReason
+			c.send.mutex.Unlock()
+
+			if len(packets) == 0 {
+				if closeReason != nil {
+					c.cancel(closeReason)
+					return
+				}
+				break
+			}
+
+			for _, data := range packets {
+				n, err := writeFull(c.ctx, c.Conn, data, time.Duration(sendTimeout.Load()))
+				c.bytesOut.Add(uint64(n))
+				c.packetsOut.Add(1)
+
+				c.send.mutex.Lock()
+				c.send.queued -= len(data)
+				c.send.mutex.Unlock()
+
+				if err != nil {
+					if c.ctx.Err() == nil {
+						logging.Error("FRONTEND", "Failed to send packet to", aurora.BrightCyan(c.RemoteAddr().String()), "sent", aurora.Cyan(n), "of", aurora.Cyan(len(data)), "bytes:", err)
+						c.cancel(closeReasonWriteError)
+					}
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package serverbrowser
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wwfc/qr2"
+)
+
+// Above this many entries, expired ones are removed before adding another
+const maxListCacheEntries = 1024
+
+type listCacheKey struct {
+	queryGame string
+	filter    string
+	fields    string
+}
+
+// cachedServer is a server matched by a list query. The encoded entry is what every client on
+// another network receives, clients on the server's own network get it encoded for them.
+type cachedServer struct {
+	data       map[string]string
+	publicIP   string
+	gpPublicIP string
+	encoded    []byte
+}
+
+type listCacheEntry struct {
+	version uint64
+	expires time.Time
+	servers []cachedServer
+}
+
+type ListCacheStats struct {
+	Hits    uint64  `json:"hits"`
+	Misses  uint64  `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+var (
+	listCache      = map[listCacheKey]*listCacheEntry{}
+	listCacheMutex sync.Mutex
+	listCacheTTL   time.Duration
+
+	listCacheHits   atomic.Uint64
+	listCacheMisses atomic.Uint64
+
+	// Replaced in tests
+	getSessionServers = qr2.GetSessionServers
+	getStateVersion   = qr2.StateVersion
+)
+
+// GetListCacheStats returns how many server list queries were answered from the cache
+func GetListCacheStats() ListCacheStats {
+	stats := ListCacheStats{
+		Hits:   listCacheHits.Load(),
+		Misses: listCacheMisses.Load(),
+	}
+
+	if total := stats.Hits + stats.Misses; total != 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+
+	return stats
+}
+
+// getServerList returns the servers matching the filter, reusing the result of an identical
+// query if QR2 state hasn't changed since and it is younger than the cache TTL
+func getServerList(moduleName string, queryGame string, filter string, fieldList []string) ([]cachedServer, error) {
+	key := listCacheKey{queryGame: queryGame, filter: filter, fields: strings.Join(fieldList, `\`)}
+	// Read before the server list so a change made while filtering invalidates the result
+	version := getStateVersion()
+	now := time.Now()
+
+	if listCacheTTL > 0 {
+		listCacheMutex.Lock()
+		entry := listCache[key]
+		listCacheMutex.Unlock()
+
+		if entry != nil && entry.version == version && now.Before(entry.expires) {
+			listCacheHits.Add(1)
+			return entry.servers, nil
+		}
+
+		listCacheMisses.Add(1)
+	}
+
+	servers, err := filterServers(moduleName, getSessionServers(), queryGame, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	cached := make([]cachedServer, len(servers))
+	for i, server := range servers {
+		cached[i] = cachedServer{
+			data:       server,
+			publicIP:   server["publicip"],
+			gpPublicIP: server["+gppublicip"],
+			encoded:    encodeServer(moduleName, server, fieldList, false),
+		}
+	}
+
+	if listCacheTTL > 0 {
+		listCacheMutex.Lock()
+		if len(listCache) >= maxListCacheEntries {
+			for key, entry := range listCache {
+				if entry.version != version || !now.Before(entry.expires) {
+					delete(listCache, key)
+				}
+			}
+		}
+
+		if len(listCache) < maxListCacheEntries {
+			listCache[key] = &listCacheEntry{version: version, expires: now.Add(listCacheTTL), servers: cached}
+		}
+		listCacheMutex.Unlock()
+	}
+
+	return cached, nil
+}
@@ -0,0 +1,124 @@
+package serverbrowser
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func testServerList(t *testing.T) (*uint64, *int) {
+	version := uint64(1)
+	queries := 0
+
+	oldServers, oldVersion, oldTTL := getSessionServers, getStateVersion, listCacheTTL
+	getSessionServers = func() []map[string]string {
+		queries++
+		return []map[string]string{{
+			"gamename":      "mariokartwii",
+			"+deviceauth":   "1",
+			"dwc_mver":      "90",
+			"dwc_hoststate": "2",
+			"dwc_pid":       "600000001",
+			"rk":            "vs",
+			"natneg":        "1",
+			"publicip":      "16909060",
+			"+gppublicip":   "16909060",
+			"publicport":    "50000",
+			"localip0":      "192.168.1.2",
+			"localport":     "50001",
+			"+searchid":     "123456",
+		}}
+	}
+	getStateVersion = func() uint64 { return version }
+	listCacheTTL = time.Minute
+	listCache = map[listCacheKey]*listCacheEntry{}
+	listCacheHits.Store(0)
+	listCacheMisses.Store(0)
+
+	t.Cleanup(func() {
+		getSessionServers, getStateVersion, listCacheTTL = oldServers, oldVersion, oldTTL
+		listCache = map[listCacheKey]*listCacheEntry{}
+	})
+
+	return &version, &queries
+}
+
+func TestListCache(t *testing.T) {
+	version, queries := testServerList(t)
+	fields := []string{"dwc_pid", "rk"}
+
+	for i := 0; i < 3; i++ {
+		servers, err := getServerList("SB", "mariokartwii", "rk = 'vs'", fields)
+		if err != nil || len(servers) != 1 {
+			t.Fatal(servers, err)
+		}
+	}
+
+	if *queries != 1 {
+		t.Errorf("server list built %d times", *queries)
+	}
+
+	// Different fields are encoded differently
+	getServerList("SB", "mariokartwii", "rk = 'vs'", []string{"dwc_pid"})
+	// QR2 state changed
+	*version++
+	getServerList("SB", "mariokartwii", "rk = 'vs'", fields)
+
+	if *queries != 3 {
+		t.Errorf("server list built %d times", *queries)
+	}
+
+	if stats := GetListCacheStats(); stats.Hits != 2 || stats.Misses != 3 || stats.HitRate != 0.4 {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	// Expired
+	*version++
+	listCacheTTL = time.Nanosecond
+	getServerList("SB", "mariokartwii", "rk = 'vs'", fields)
+	time.Sleep(time.Millisecond)
+	getServerList("SB", "mariokartwii", "rk = 'vs'", fields)
+	if *queries != 5 {
+		t.Errorf("server list built %d times", *queries)
+	}
+
+	// Invalid filters aren't cached
+	listCacheTTL = time.Minute
+	if _, err := getServerList("SB", "mariokartwii", "(rk = 'vs'", fields); err == nil {
+		t.Error("expected an error for an invalid filter")
+	}
+	if _, err := getServerList("SB", "mariokartwii", "(rk = 'vs'", fields); err == nil {
+		t.Error("expected an error for an invalid filter")
+	}
+}
+
+func TestListCacheCallerNetwork(t *testing.T) {
+	testServerList(t)
+	fields := []string{"dwc_pid"}
+
+	servers, _ := getServerList("SB", "mariokartwii", "rk = 'vs'", fields)
+	server := servers[0]
+
+	// The shared entry only reveals the search ID
+	hidden := []byte{HasKeysFlag | ConnectNegotiateFlag | NonstandardPortFlag | PrivateIPFlag | NonstandardPrivatePortFlag | ICMPIPFlag,
+		0x00, 0x01, 0xe2, 0x40, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, '6', '0', '0', '0', '0', '0', '0', '0', '1', 0x00}
+	if !bytes.Equal(server.encoded, hidden) {
+		t.Errorf("got shared entry % x", server.encoded)
+	}
+
+	if isCallerNetwork(server.publicIP, server.gpPublicIP, "84281096") {
+		t.Error("server matched another network")
+	}
+
+	// A client behind the same public IP gets the real addresses
+	if !isCallerNetwork(server.publicIP, server.gpPublicIP, "16909060") {
+		t.Fatal("server didn't match its own network")
+	}
+
+	real := encodeServer("SB", server.data, fields, true)
+	expected := []byte{HasKeysFlag | ConnectNegotiateFlag | NonstandardPortFlag | PrivateIPFlag | NonstandardPrivatePortFlag | ICMPIPFlag,
+		0x01, 0x02, 0x03, 0x04, 0xc3, 0x50, 192, 168, 1, 2, 0xc3, 0x51, 0, 0, 0, 0, 0xff, '6', '0', '0', '0', '0', '0', '0', '0', '1', 0x00}
+	if !bytes.Equal(real, expected) {
+		t.Errorf("got own network entry % x", real)
+	}
+}
@@ -21,12 +21,13 @@ import (
 
 // Example: dwc_mver = 90 and dwc_pid != 43 and maxplayers = 11 and numplayers < 11 and dwc_mtype = 0 and dwc_hoststate = 2 and dwc_suspend = 0 and (rk = 'vs' and ev >= 4250 and ev <= 5750 and p = 0)
 
-func filterServers(moduleName string, servers []map[string]string, queryGame string, expression string, publicIP string) []map[string]string {
+// The result must not depend on the client making the request, as it is shared through the list cache
+func filterServers(moduleName string, servers []map[string]string, queryGame string, expression string) ([]map[string]string, error) {
 	// Matchmaking search
 	tree, err := filter.Parse(expression)
 	if err != nil {
 		logging.Error(moduleName, "Error parsing filter:", err.Error())
-		return []map[string]string{}
+		return nil, err
 	}
 
 	var filtered []map[string]string
@@ -46,8 +47,9 @@ func filterServers(moduleName string, servers []map[string]string, queryGame str
 
 		ret, err := filter.Eval(tree, server, queryGame)
 		if err != nil {
-			logging.Error(moduleName, "Error evaluating filter:", err.Error())
-			return []map[string]string{}
+			// Usually a non-numeric value in a numeric comparison, only this server is affected
+			logging.Warn(moduleName, "Error evaluating filter:", err.Error())
+			continue
 		}
 		if server["gamename"] == "mariokartwii" {
 			if strings.HasPrefix(server["rk"], "vp") || strings.HasPrefix(server["rk"], "bp") {
@@ -85,7 +87,7 @@ func filterServers(moduleName string, servers []map[string]string, queryGame str
 		logging.Info(moduleName, "Matched", aurora.BrightCyan(len(filtered)), "servers")
 	}
 
-	return filtered
+	return filtered, nil
 }
 
 func filterSelfLookup(moduleName string, servers []map[string]string, queryGame string, dwcPid string, publicIP string) []map[string]string {
@@ -129,6 +129,10 @@ func (this *expression) evalEquals(args []*TreeNode) int64 {
 			}
 		}
 
+		if this.hasUnknownKey(args) {
+			return 0
+		}
+
 		if this.getString(args[0]) == this.getString(args[1]) {
 			return 1
 		}
@@ -197,6 +201,10 @@ func (this *expression) evalNotEquals(args []*TreeNode) int64 {
 	case cnt < 2:
 		panic("operator missing arguments")
 	case cnt == 2:
+		if this.hasUnknownKey(args) {
+			return 0
+		}
+
 		if this.getString(args[0]) != this.getString(args[1]) {
 			return 1
 		}
@@ -275,6 +283,10 @@ func (this *expression) evalMathOperator(fn func(int64, int64) int64, args []*Tr
 			}
 		}
 
+		if this.hasUnknownKey(args) {
+			return 0
+		}
+
 		return fn(this.getNumber(args[0]), this.getNumber(args[1]))
 	default:
 		answ := fn(this.getNumber(args[0]), this.getNumber(args[1]))
@@ -327,6 +339,10 @@ func (this *expression) evalLike(args []*TreeNode) int64 {
 	case cnt < 2:
 		panic("operator missing arguments")
 	case cnt == 2:
+		if this.hasUnknownKey(args) {
+			return 0
+		}
+
 		return this.evalLikeSingle(args[0], args[1])
 	default:
 		panic("operator like does not support multiple arguments")
@@ -383,6 +399,20 @@ func (this *expression) evalLikeSingle(arg1, arg2 *TreeNode) int64 {
 	return 0
 }
 
+// Check if any of the arguments is a key the server doesn't have.
+// Comparisons against unknown keys never match, the same as retail.
+func (this *expression) hasUnknownKey(args []*TreeNode) bool {
+	for _, arg := range args {
+		if token, ok := arg.Value.(*IdentityToken); ok {
+			if _, exists := this.context[token.Name]; !exists {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 // Get a value from the context.
 func (this *expression) getValue(token *IdentityToken) string {
 	return this.context[token.Name]
@@ -0,0 +1,133 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+type filterTest struct {
+	name     string
+	server   map[string]string
+	expected int64
+}
+
+func runFilterTests(t *testing.T, queryGame string, expression string, tests []filterTest) {
+	tree, err := Parse(expression)
+	if err != nil {
+		t.Fatalf("failed to parse %q: %s", expression, err)
+	}
+
+	for _, test := range tests {
+		result, err := Eval(tree, test.server, queryGame)
+		if err != nil {
+			t.Errorf("%s: eval failed: %s", test.name, err)
+			continue
+		}
+
+		if result != test.expected {
+			t.Errorf("%s: got %d, expected %d", test.name, result, test.expected)
+		}
+	}
+}
+
+func TestMarioKartWiiFilter(t *testing.T) {
+	// Worldwide VS search sent by Mario Kart Wii
+	expression := "dwc_mver = 90 and dwc_pid != 43 and maxplayers = 11 and numplayers < 11 and dwc_mtype = 0 and dwc_mresv != dwc_pid and (rk = 'vs_0' and ev >= 4250 and ev <= 5750 and p = 0)"
+
+	base := map[string]string{
+		"dwc_mver":   "90",
+		"dwc_pid":    "100",
+		"maxplayers": "11",
+		"numplayers": "3",
+		"dwc_mtype":  "0",
+		"dwc_mresv":  "5",
+		"rk":         "vs",
+		"ev":         "9000",
+		"p":          "0",
+	}
+
+	with := func(key, value string) map[string]string {
+		server := map[string]string{}
+		for k, v := range base {
+			server[k] = v
+		}
+
+		if value == "" {
+			delete(server, key)
+		} else {
+			server[key] = value
+		}
+		return server
+	}
+
+	runFilterTests(t, "mariokartwii", expression, []filterTest{
+		{"match", base, 1},
+		{"regional rk matches worldwide", with("rk", "vs_3"), 1},
+		{"battle room", with("rk", "bt"), 0},
+		{"full room", with("numplayers", "11"), 0},
+		{"own room", with("dwc_pid", "43"), 0},
+		{"reserved", with("dwc_mresv", "100"), 0},
+		{"old matching version", with("dwc_mver", "3"), 0},
+		{"missing key", with("p", ""), 0},
+	})
+}
+
+func TestBrawlFilter(t *testing.T) {
+	// Super Smash Bros. Brawl uses the older matching version and upper case operators
+	expression := "dwc_mver = 3 and dwc_pid != 1234 and maxplayers = 4 and numplayers < 4 and dwc_mtype = 0 and dwc_hoststate = 2 and dwc_suspend = 0 AND (rule = 1 OR rule = 3)"
+
+	base := map[string]string{
+		"dwc_mver":      "3",
+		"dwc_pid":       "5678",
+		"maxplayers":    "4",
+		"numplayers":    "2",
+		"dwc_mtype":     "0",
+		"dwc_hoststate": "2",
+		"dwc_suspend":   "0",
+		"rule":          "3",
+	}
+
+	suspended := map[string]string{}
+	otherRule := map[string]string{}
+	for k, v := range base {
+		suspended[k] = v
+		otherRule[k] = v
+	}
+	suspended["dwc_suspend"] = "1"
+	otherRule["rule"] = "2"
+
+	runFilterTests(t, "smashbrosxwii", expression, []filterTest{
+		{"match", base, 1},
+		{"suspended", suspended, 0},
+		{"other rule", otherRule, 0},
+	})
+}
+
+func TestUnknownKeys(t *testing.T) {
+	server := map[string]string{"numplayers": "2"}
+
+	for _, expression := range []string{
+		"missing = 1",
+		"missing != 1",
+		"missing < 5",
+		"missing = 'text'",
+		"numplayers < 4 and missing >= 0",
+	} {
+		runFilterTests(t, "", expression, []filterTest{{expression, server, 0}})
+	}
+
+	runFilterTests(t, "", "missing = 1 or numplayers < 4", []filterTest{{"or", server, 1}})
+}
+
+func TestMalformedFilters(t *testing.T) {
+	for _, expression := range []string{
+		"= 1",
+		"(numplayers < 4",
+		"numplayers < 4)",
+		strings.Repeat("numplayers < 4 and ", MaxFilterLength/10) + "numplayers < 4",
+	} {
+		if _, err := Parse(expression); err == nil {
+			t.Errorf("expected an error parsing %q", expression[:min(len(expression), 40)])
+		}
+	}
+}
@@ -8,6 +8,9 @@ import (
 	"unicode"
 )
 
+// Longest filter accepted, anything longer is rejected before parsing
+const MaxFilterLength = 1024
+
 type stateFn func(*parser) stateFn
 
 type parser struct {
@@ -26,10 +29,22 @@ func Parse(input string) (root *TreeNode, err error) {
 		}
 	}()
 
+	if len(input) > MaxFilterLength {
+		return nil, errors.New("filter is too long")
+	}
+
 	root = NewTreeNode(NewEmptyToken())
 	parse := &parser{NewScanner(input), root, root, nil, nil}
 	parse.parse()
 	err = parse.err
+
+	// Any bracket group still open at the end was never closed
+	for node := parse.curr; err == nil && node != nil; node = node.Parent() {
+		if group, ok := node.Value.(*GroupToken); ok && group.GroupType == "()" {
+			err = errors.New("brackets not closed")
+		}
+	}
+
 	return root, err
 }
 
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"encoding/gob"
 	"os"
+	"time"
 	"wwfc/common"
 	"wwfc/logging"
 
@@ -37,6 +38,9 @@ var (
 )
 
 func StartServer(reload bool) {
+	config := common.GetConfig()
+	listCacheTTL = time.Duration(*config.ServerBrowserCacheTTL) * time.Millisecond
+
 	if !reload {
 		return
 	}
@@ -77,17 +81,20 @@ func Shutdown() {
 	logging.Notice("SB", "Saved", aurora.Cyan(len(connBuffers)), "connections")
 }
 
-func NewConnection(index uint64, address string) {
+func NewConnection(index uint64, address string, traceID string) {
+	logging.SetConnectionTrace("SB", index, traceID)
 }
 
 func CloseConnection(index uint64) {
+	logging.ClearConnectionTrace("SB", index)
+
 	mutex.Lock()
 	delete(connBuffers, index)
 	mutex.Unlock()
 }
 
 func HandlePacket(index uint64, data []byte, address string) {
-	moduleName := "SB:" + address
+	moduleName := logging.ConnectionModule("SB", index, address)
 
 	mutex.RLock()
 	buffer := connBuffers[index]
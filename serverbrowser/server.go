@@ -38,6 +38,11 @@ const (
 	SendGroupsOption        = 1 << 5 // 0x20 / 32
 	NoListCacheOption       = 1 << 6 // 0x40 / 64
 	LimitResultCountOption  = 1 << 7 // 0x80 / 128
+
+	// List encoding versions, the fifth byte of ServerListRequest
+	EncodingEnctype1 = 1
+	EncodingEnctype2 = 2
+	EncodingEnctypeX = 3
 )
 
 var (
@@ -82,6 +87,26 @@ func popUint32(buffer []byte, index int) (uint32, int, error) {
 var regexSelfLookup = regexp.MustCompile(`^dwc_pid ?= ?(\d{1,10})$`)
 
 func handleServerListRequest(moduleName string, connIndex uint64, address string, buffer []byte) {
+	if len(buffer) < 9 {
+		logging.Error(moduleName, "Server list request is too short")
+		return
+	}
+
+	// Every SB v2 client uses enctypex. Enctype 1 and 2 belong to the old text based
+	// master server protocol and aren't implemented, so refuse instead of sending a list
+	// the client can't decode.
+	switch encoding := buffer[4]; encoding {
+	case EncodingEnctypeX:
+	case EncodingEnctype1, EncodingEnctype2:
+		logging.Error(moduleName, "Unsupported list encoding: enctype", aurora.Cyan(encoding))
+		common.CloseConnection(ServerName, connIndex)
+		return
+	default:
+		logging.Error(moduleName, "Invalid list encoding:", aurora.Cyan(encoding))
+		common.CloseConnection(ServerName, connIndex)
+		return
+	}
+
 	index := 9
 	queryGame, index, err := popString(buffer, index)
 	if err != nil {
@@ -121,9 +146,12 @@ func handleServerListRequest(moduleName string, connIndex uint64, address string
 
 	logging.Info(moduleName, "Server list:", aurora.Cyan(queryGame), "/", aurora.Cyan(filter[:min(len(filter), 200)]))
 
-	gameInfo := common.GetGameInfoByName(gameName)
+	gameInfo := common.CheckGame(moduleName, gameName, common.GameServiceServerBrowser)
 	if gameInfo == nil {
-		// Game doesn't exist in the game list.
+		// There's no way to show a message, closing the connection makes the game give up on the list
+		if common.IsGameDisabled(gameName) {
+			common.CloseConnection(ServerName, connIndex)
+		}
 		return
 	}
 
@@ -172,171 +200,204 @@ func handleServerListRequest(moduleName string, connIndex uint64, address string
 
 	callerPublicIP, _ := common.IPFormatToString(address)
 
-	servers := []map[string]string{}
 	if options&NoServerListOption == 0 && filter != "" && filter != " " && filter != "0" {
 		if match := regexSelfLookup.FindStringSubmatch(filter); match != nil {
-			// Self lookup is handled differently
-			servers = filterSelfLookup(moduleName, qr2.GetSessionServers(), queryGame, match[1], callerPublicIP)
+			// Self lookup is handled differently, and depends on the caller so it isn't cached
+			servers := filterSelfLookup(moduleName, qr2.GetSessionServers(), queryGame, match[1], callerPublicIP)
+			for _, server := range servers {
+				callerNetwork := isCallerNetwork(server["publicip"], server["+gppublicip"], callerPublicIP)
+				output = append(output, encodeServer(moduleName, server, fieldList, callerNetwork)...)
+			}
 		} else {
-			servers = filterServers(moduleName, qr2.GetSessionServers(), queryGame, filter, callerPublicIP)
+			servers, err := getServerList(moduleName, queryGame, filter, fieldList)
+			if err != nil {
+				// Closing the connection makes the client report a server browser error
+				// rather than treating it as an empty list
+				common.CloseConnection(ServerName, connIndex)
+				return
+			}
+
+			for _, server := range servers {
+				if isCallerNetwork(server.publicIP, server.gpPublicIP, callerPublicIP) {
+					// Only the entries of servers on the caller's network differ between clients
+					output = append(output, encodeServer(moduleName, server.data, fieldList, true)...)
+				} else {
+					output = append(output, server.encoded...)
+				}
+			}
 		}
 	}
 
-	for _, server := range servers {
-		var flags byte
-		var flagsBuffer []byte
+	if options&NoServerListOption == 0 {
+		// Server with 0 flags and IP of 0xffffffff terminates the list
+		output = append(output, []byte{0x00, 0xff, 0xff, 0xff, 0xff}...)
+	}
 
-		// Server will always have keys
-		flags |= HasKeysFlag
+	// Write the encrypted reply
+	common.SendPacket(ServerName, connIndex, common.EncryptTypeX([]byte(gameInfo.SecretKey), challenge, output))
+}
 
-		var natneg string
-		var exists bool
-		if natneg, exists = server["natneg"]; exists && natneg != "0" {
-			flags |= ConnectNegotiateFlag
-		}
+func handleSendMessageRequest(moduleName string, connIndex uint64, address string, buffer []byte) {
+	// Read search ID from buffer
+	searchID := uint64(binary.BigEndian.Uint32(buffer[3:7]))
+	searchID |= uint64(binary.BigEndian.Uint16(buffer[7:9])) << 32
 
-		var publicip string
-		if publicip, exists = server["publicip"]; !exists {
-			logging.Error(moduleName, "Server exists without public IP")
-			continue
-		}
+	logging.Notice(moduleName, "Send message from to", aurora.Cyan(fmt.Sprintf("%012x", searchID)))
 
-		if publicip == callerPublicIP || server["+gppublicip"] == callerPublicIP {
-			// Use the real public IP if it matches the caller's
-			ip, err := strconv.ParseInt(publicip, 10, 32)
-			if err != nil {
-				logging.Error(moduleName, "Server has invalid public IP value:", aurora.Cyan(publicip))
-			}
+	// A replayed message must not reach the host
+	if common.IsReplaying(ServerName, connIndex) {
+		return
+	}
 
-			flagsBuffer = binary.BigEndian.AppendUint32(flagsBuffer, uint32(ip))
+	go qr2.SendClientMessage(address, searchID, buffer[9:])
+}
 
-			var port string
-			port, exists = server["publicport"]
-			if !exists {
-				// Fall back to local port if public port doesn't exist
-				if port, exists = server["localport"]; !exists {
-					logging.Error(moduleName, "Server exists without port (publicip =", aurora.Cyan(publicip).String()+")")
-					continue
-				}
-			}
+// isCallerNetwork checks if the server is on the same network as the client requesting the list
+func isCallerNetwork(publicIP string, gpPublicIP string, callerPublicIP string) bool {
+	return publicIP == callerPublicIP || gpPublicIP == callerPublicIP
+}
 
-			portValue, err := strconv.ParseUint(port, 10, 16)
-			if err != nil {
-				logging.Error(moduleName, "Server has invalid port value:", aurora.Cyan(port))
-				continue
-			}
+// encodeServer encodes a server's list entry, or returns nil if the server can't be listed.
+// Servers on the caller's network are sent with their real address, others only by search ID.
+func encodeServer(moduleName string, server map[string]string, fieldList []string, callerNetwork bool) []byte {
+	var output []byte
+	var flags byte
+	var flagsBuffer []byte
 
-			if portValue < 1024 {
-				logging.Error(moduleName, "Server uses reserved port:", aurora.Cyan(portValue))
-				continue
-			}
+	// Server will always have keys
+	flags |= HasKeysFlag
 
-			flags |= NonstandardPortFlag
-			flagsBuffer = binary.BigEndian.AppendUint16(flagsBuffer, uint16(portValue))
+	var natneg string
+	var exists bool
+	if natneg, exists = server["natneg"]; exists && natneg != "0" {
+		flags |= ConnectNegotiateFlag
+	}
 
-			// Use the first local IP if it exists
-			if localip0, exists := server["localip0"]; exists {
-				flags |= PrivateIPFlag
+	var publicip string
+	if publicip, exists = server["publicip"]; !exists {
+		logging.Error(moduleName, "Server exists without public IP")
+		return nil
+	}
 
-				// localip is written like "192.168.255.255" for example, so it needs to be parsed
-				ipSplit := strings.Split(localip0, ".")
-				if len(ipSplit) != 4 {
-					logging.Error(moduleName, "Server has invalid local IP:", aurora.Cyan(localip0))
-					continue
-				}
+	if callerNetwork {
+		// Use the real public IP if it matches the caller's
+		ip, err := strconv.ParseInt(publicip, 10, 32)
+		if err != nil {
+			logging.Error(moduleName, "Server has invalid public IP value:", aurora.Cyan(publicip))
+		}
 
-				err = nil
-				for _, s := range ipSplit {
-					val, err := strconv.ParseUint(s, 10, 8)
-					if err != nil {
-						break
-					}
+		flagsBuffer = binary.BigEndian.AppendUint32(flagsBuffer, uint32(ip))
 
-					flagsBuffer = append(flagsBuffer, byte(val))
-				}
+		var port string
+		port, exists = server["publicport"]
+		if !exists {
+			// Fall back to local port if public port doesn't exist
+			if port, exists = server["localport"]; !exists {
+				logging.Error(moduleName, "Server exists without port (publicip =", aurora.Cyan(publicip).String()+")")
+				return nil
+			}
+		}
 
-				if err != nil {
-					logging.Error(moduleName, "Server has invalid local IP value:", aurora.Cyan(localip0))
-					continue
-				}
+		portValue, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			logging.Error(moduleName, "Server has invalid port value:", aurora.Cyan(port))
+			return nil
+		}
+
+		if portValue < 1024 {
+			logging.Error(moduleName, "Server uses reserved port:", aurora.Cyan(portValue))
+			return nil
+		}
+
+		flags |= NonstandardPortFlag
+		flagsBuffer = binary.BigEndian.AppendUint16(flagsBuffer, uint16(portValue))
+
+		// Use the first local IP if it exists
+		if localip0, exists := server["localip0"]; exists {
+			flags |= PrivateIPFlag
+
+			// localip is written like "192.168.255.255" for example, so it needs to be parsed
+			ipSplit := strings.Split(localip0, ".")
+			if len(ipSplit) != 4 {
+				logging.Error(moduleName, "Server has invalid local IP:", aurora.Cyan(localip0))
+				return nil
 			}
 
-			if localport, exists := server["localport"]; exists {
-				portValue, err = strconv.ParseUint(localport, 10, 16)
+			err = nil
+			for _, s := range ipSplit {
+				val, err := strconv.ParseUint(s, 10, 8)
 				if err != nil {
-					logging.Error(moduleName, "Server has invalid local port value:", aurora.Cyan(localport))
-					continue
+					break
 				}
 
-				flags |= NonstandardPrivatePortFlag
-				flagsBuffer = binary.BigEndian.AppendUint16(flagsBuffer, uint16(portValue))
+				flagsBuffer = append(flagsBuffer, byte(val))
 			}
 
-			flags |= ICMPIPFlag
-			flagsBuffer = append(flagsBuffer, 0, 0, 0, 0)
-		} else {
-			// Regular server, hide the public IP until match reservation is made
-			var searchIDStr string
-			if searchIDStr, exists = server["+searchid"]; !exists {
-				logging.Error(moduleName, "Server exists without search ID")
-				continue
+			if err != nil {
+				logging.Error(moduleName, "Server has invalid local IP value:", aurora.Cyan(localip0))
+				return nil
 			}
+		}
 
-			searchID, err := strconv.ParseInt(searchIDStr, 10, 64)
+		if localport, exists := server["localport"]; exists {
+			portValue, err = strconv.ParseUint(localport, 10, 16)
 			if err != nil {
-				logging.Error(moduleName, "Server has invalid search ID value:", aurora.Cyan(searchIDStr))
+				logging.Error(moduleName, "Server has invalid local port value:", aurora.Cyan(localport))
+				return nil
 			}
 
-			// Append low value as public IP
-			flagsBuffer = binary.BigEndian.AppendUint32(flagsBuffer, uint32(searchID&0xffffffff))
-			// Append high value as public port
-			flags |= NonstandardPortFlag
-			flagsBuffer = binary.BigEndian.AppendUint16(flagsBuffer, uint16((searchID>>32)&0xffff))
-
-			flags |= PrivateIPFlag | NonstandardPrivatePortFlag
-			flagsBuffer = append(flagsBuffer, 0, 0, 0, 0, 0, 0)
-
-			flags |= ICMPIPFlag
-			flagsBuffer = append(flagsBuffer, 0, 0, 0, 0)
+			flags |= NonstandardPrivatePortFlag
+			flagsBuffer = binary.BigEndian.AppendUint16(flagsBuffer, uint16(portValue))
 		}
 
-		// Append the server buffer to the output
-		output = append(output, flags)
-		output = append(output, flagsBuffer...)
+		flags |= ICMPIPFlag
+		flagsBuffer = append(flagsBuffer, 0, 0, 0, 0)
+	} else {
+		// Regular server, hide the public IP until match reservation is made
+		var searchIDStr string
+		if searchIDStr, exists = server["+searchid"]; !exists {
+			logging.Error(moduleName, "Server exists without search ID")
+			return nil
+		}
 
-		if (flags & HasKeysFlag) == 0 {
-			// Server does not have keys, so skip them
-			continue
+		searchID, err := strconv.ParseInt(searchIDStr, 10, 64)
+		if err != nil {
+			logging.Error(moduleName, "Server has invalid search ID value:", aurora.Cyan(searchIDStr))
 		}
 
-		// Add the requested fields
-		for _, field := range fieldList {
-			output = append(output, 0xff)
+		// Append low value as public IP
+		flagsBuffer = binary.BigEndian.AppendUint32(flagsBuffer, uint32(searchID&0xffffffff))
+		// Append high value as public port
+		flags |= NonstandardPortFlag
+		flagsBuffer = binary.BigEndian.AppendUint16(flagsBuffer, uint16((searchID>>32)&0xffff))
 
-			if str, exists := server[field]; exists {
-				output = append(output, []byte(str)...)
-			}
+		flags |= PrivateIPFlag | NonstandardPrivatePortFlag
+		flagsBuffer = append(flagsBuffer, 0, 0, 0, 0, 0, 0)
 
-			// Add null terminator
-			output = append(output, 0x00)
-		}
+		flags |= ICMPIPFlag
+		flagsBuffer = append(flagsBuffer, 0, 0, 0, 0)
 	}
 
-	if options&NoServerListOption == 0 {
-		// Server with 0 flags and IP of 0xffffffff terminates the list
-		output = append(output, []byte{0x00, 0xff, 0xff, 0xff, 0xff}...)
+	// Append the server buffer to the output
+	output = append(output, flags)
+	output = append(output, flagsBuffer...)
+
+	if (flags & HasKeysFlag) == 0 {
+		// Server does not have keys, so skip them
+		return output
 	}
 
-	// Write the encrypted reply
-	common.SendPacket(ServerName, connIndex, common.EncryptTypeX([]byte(gameInfo.SecretKey), challenge, output))
-}
+	// Add the requested fields
+	for _, field := range fieldList {
+		output = append(output, 0xff)
 
-func handleSendMessageRequest(moduleName string, connIndex uint64, address string, buffer []byte) {
-	// Read search ID from buffer
-	searchID := uint64(binary.BigEndian.Uint32(buffer[3:7]))
-	searchID |= uint64(binary.BigEndian.Uint16(buffer[7:9])) << 32
+		if str, exists := server[field]; exists {
+			output = append(output, []byte(str)...)
+		}
 
-	logging.Notice(moduleName, "Send message from to", aurora.Cyan(fmt.Sprintf("%012x", searchID)))
+		// Add null terminator
+		output = append(output, 0x00)
+	}
 
-	go qr2.SendClientMessage(address, searchID, buffer[9:])
+	return output
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"wwfc/common"
+	"wwfc/database"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+// startupPhase orders the backend servers at startup. The servers in a phase start concurrently,
+// and a phase only begins once every server in the one before it has returned from StartServer.
+type startupPhase int
+
+const (
+	// Servers only reached through the frontend, which other servers call into
+	phaseServices startupPhase = iota
+	// QR2 and the server browser reading its sessions. QR2 takes heartbeats as soon as it starts,
+	// which can call back into GPCM.
+	phaseMatchmaking
+	// Servers with their own listeners that call into the matchmaking state, e.g. NATNEG reports
+	phaseListeners
+	startupPhaseCount
+)
+
+var startupPhaseNames = [startupPhaseCount]string{"services", "matchmaking", "listeners"}
+
+func (phase startupPhase) String() string {
+	return startupPhaseNames[phase]
+}
+
+// prepareDatabase creates and migrates the tables before any server can query them. Exits if the
+// database can't be reached.
+func prepareDatabase() {
+	target := config.DatabaseAddress
+	if config.DatabaseDriver == common.DatabaseDriverFile {
+		target = config.DatabaseFile
+	}
+	logging.Notice("BACKEND", "Starting phase", aurora.Cyan("database"), "- connecting to", aurora.BrightCyan(target))
+	started := time.Now()
+
+	ctx := context.Background()
+	store, err := database.Connect(ctx, config)
+	if err != nil {
+		logging.Error("BACKEND", "Failed to connect to the database:", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	store.UpdateTables(ctx)
+	logging.Notice("BACKEND", "Phase", aurora.Cyan("database"), "ready in", aurora.Cyan(time.Since(started).Round(time.Millisecond)))
+}
+
+// startBackendServers starts the servers one phase at a time. A server that panics in StartServer
+// is marked as failed, and with failFast no later phase is started. Returns the failed servers and
+// why they failed.
+func startBackendServers(servers []backendServer, reload bool, failFast bool) map[string]string {
+	failed := map[string]string{}
+	failedMutex := sync.Mutex{}
+
+	for _, server := range servers {
+		if server.database {
+			prepareDatabase()
+			break
+		}
+	}
+
+	for phase := startupPhase(0); phase < startupPhaseCount; phase++ {
+		var inPhase []backendServer
+		var names []string
+		for _, server := range servers {
+			if server.phase == phase {
+				inPhase = append(inPhase, server)
+				names = append(names, server.name)
+			}
+		}
+
+		if len(inPhase) == 0 {
+			continue
+		}
+
+		logging.Notice("BACKEND", "Starting phase", aurora.Cyan(phase), "-", aurora.BrightCyan(strings.Join(names, ", ")))
+		started := time.Now()
+
+		wg := &sync.WaitGroup{}
+		wg.Add(len(inPhase))
+		for _, server := range inPhase {
+			go func(server backendServer) {
+				defer wg.Done()
+				defer func() {
+					if r := recover(); r != nil {
+						logging.Error("BACKEND", "Server", aurora.Cyan(server.name), "failed to start:", r)
+						setServerFailed(server.name, fmt.Sprint(r))
+
+						failedMutex.Lock()
+						failed[server.name] = fmt.Sprint(r)
+						failedMutex.Unlock()
+					}
+				}()
+
+				server.start(reload)
+				setServerStarted(server.name)
+			}(server)
+		}
+
+		wg.Wait()
+		if len(failed) != 0 && failFast {
+			return failed
+		}
+
+		logging.Notice("BACKEND", "Phase", aurora.Cyan(phase), "ready in", aurora.Cyan(time.Since(started).Round(time.Millisecond)))
+	}
+
+	return failed
+}
+
+// failedServerNames returns the names of the failed servers in order
+func failedServerNames(failed map[string]string) []string {
+	names := make([]string, 0, len(failed))
+	for name := range failed {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+	return names
+}
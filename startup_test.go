@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestStartupPhaseOrder(t *testing.T) {
+	var mutex sync.Mutex
+	var started []string
+	ready := map[string]bool{}
+
+	// Each server checks that every server of an earlier phase is ready when it starts
+	var servers []backendServer
+	for _, server := range []backendServer{
+		{name: "listener", phase: phaseListeners},
+		{name: "qr2", phase: phaseMatchmaking},
+		{name: "gpcm", phase: phaseServices},
+		{name: "sb", phase: phaseMatchmaking},
+		{name: "gpsp", phase: phaseServices},
+	} {
+		server := server
+		server.start = func(bool) {
+			mutex.Lock()
+			for _, other := range servers {
+				if other.phase < server.phase && !ready[other.name] {
+					t.Errorf("%s started before %s was ready", server.name, other.name)
+				}
+			}
+			started = append(started, server.name)
+			ready[server.name] = true
+			mutex.Unlock()
+		}
+		servers = append(servers, server)
+	}
+
+	startBackendServers(servers, false, true)
+
+	if len(started) != len(servers) {
+		t.Fatalf("started %v", started)
+	}
+	if started[len(started)-1] != "listener" {
+		t.Errorf("listener phase didn't start last: %v", started)
+	}
+}
+
+func TestStartupFailure(t *testing.T) {
+	defer func() {
+		startedServers = map[string]bool{}
+		failedServers = map[string]string{}
+	}()
+
+	for _, failFast := range []bool{true, false} {
+		listenerStarted := false
+		servers := []backendServer{
+			{name: "gpcm", phase: phaseServices, start: func(bool) { panic("database unreachable") }},
+			{name: "gpsp", phase: phaseServices, start: func(bool) {}},
+			{name: "api", phase: phaseListeners, start: func(bool) { listenerStarted = true }},
+		}
+
+		failed := startBackendServers(servers, false, failFast)
+		if len(failed) != 1 || failed["gpcm"] != "database unreachable" {
+			t.Errorf("failFast %v: unexpected failures %v", failFast, failed)
+		}
+		if listenerStarted == failFast {
+			t.Errorf("failFast %v: later phase started %v", failFast, listenerStarted)
+		}
+		if failedServers["gpcm"] == "" || !startedServers["gpsp"] {
+			t.Errorf("failFast %v: status wasn't updated", failFast)
+		}
+	}
+}
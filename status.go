@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+	"wwfc/api"
+	"wwfc/common"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+)
+
+type ServerStatus struct {
+	Name    string
+	Started bool
+	// Why the server failed to start, empty if it didn't
+	Error string
+}
+
+// BackendReadiness is returned by RPCPacket.Readiness once the backend is listening
+type BackendReadiness struct {
+	Started []string
+	// Why each server that failed to start did
+	Failed map[string]string
+}
+
+type MemoryStatus struct {
+	Alloc       uint64
+	Sys         uint64
+	HeapObjects uint64
+	NumGC       uint32
+	Goroutines  int
+}
+
+type BackendStatus struct {
+	StartTime time.Time
+	Uptime    time.Duration
+	Reload    bool
+	Ready     bool
+	Servers   []ServerStatus
+	Memory    MemoryStatus
+}
+
+var (
+	backendStartTime time.Time
+	backendReload    bool
+
+	startedServers      = map[string]bool{}
+	failedServers       = map[string]string{}
+	startedServersMutex sync.Mutex
+)
+
+func setServerStarted(name string) {
+	startedServersMutex.Lock()
+	defer startedServersMutex.Unlock()
+
+	startedServers[name] = true
+}
+
+func setServerFailed(name string, reason string) {
+	startedServersMutex.Lock()
+	defer startedServersMutex.Unlock()
+
+	failedServers[name] = reason
+}
+
+// RPCPacket.Readiness is called by the frontend once it connected to the backend, to check every
+// enabled server started
+func (r *RPCPacket) Readiness(_ struct{}, readiness *BackendReadiness) error {
+	startedServersMutex.Lock()
+	defer startedServersMutex.Unlock()
+
+	readiness.Failed = map[string]string{}
+	for _, server := range enabledBackendServers() {
+		if startedServers[server.name] {
+			readiness.Started = append(readiness.Started, server.name)
+		} else if reason, failed := failedServers[server.name]; failed {
+			readiness.Failed[server.name] = reason
+		} else {
+			readiness.Failed[server.name] = "not started"
+		}
+	}
+
+	return nil
+}
+
+// RPCPacket.Status is called by the command interface to get the backend's status.
+// Doesn't touch any of the connection state.
+func (r *RPCPacket) Status(_ struct{}, status *BackendStatus) error {
+	status.StartTime = backendStartTime
+	status.Uptime = time.Since(backendStartTime)
+	status.Reload = backendReload
+	status.Ready = api.IsBackendReady()
+
+	startedServersMutex.Lock()
+	for _, server := range enabledBackendServers() {
+		status.Servers = append(status.Servers, ServerStatus{
+			Name:    server.name,
+			Started: startedServers[server.name],
+			Error:   failedServers[server.name],
+		})
+	}
+	startedServersMutex.Unlock()
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	status.Memory = MemoryStatus{
+		Alloc:       memStats.Alloc,
+		Sys:         memStats.Sys,
+		HeapObjects: memStats.HeapObjects,
+		NumGC:       memStats.NumGC,
+		Goroutines:  runtime.NumGoroutine(),
+	}
+
+	return nil
+}
+
+// GCResult is the heap before and after a forced garbage collection
+type GCResult struct {
+	HeapBefore uint64
+	HeapAfter  uint64
+	// Memory returned to the operating system after the collection
+	Released uint64
+	Duration time.Duration
+}
+
+// RPCPacket.SetLogLevel is called by the command interface to change the backend's log level
+// until the next config reload. Module overrides from <logLevels> still apply.
+func (r *RPCPacket) SetLogLevel(level int, previous *int) error {
+	if level < 0 || level > 4 {
+		return errors.New("log level must be 0-4")
+	}
+
+	*previous = logging.GetLevel()
+	logging.SetLevel(level)
+	logging.Notice("BACKEND", "Log level changed from", aurora.Cyan(*previous), "to", aurora.Cyan(level))
+	return nil
+}
+
+// RPCPacket.Trace is called by the command interface to get the recent log lines for a trace ID,
+// which the frontend logs with each connection and NAS returns with each response
+func (r *RPCPacket) Trace(traceID string, lines *[]string) error {
+	*lines = logging.GetTrace(traceID)
+	return nil
+}
+
+// RPCPacket.GC is called by the command interface to force a garbage collection and return the
+// freed memory to the operating system
+func (r *RPCPacket) GC(_ struct{}, result *GCResult) error {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	start := time.Now()
+	debug.FreeOSMemory()
+	result.Duration = time.Since(start)
+
+	runtime.ReadMemStats(&after)
+	result.HeapBefore = before.HeapAlloc
+	result.HeapAfter = after.HeapAlloc
+	result.Released = after.HeapReleased - min(after.HeapReleased, before.HeapReleased)
+
+	logging.Notice("BACKEND", "Forced GC freed", aurora.Cyan(result.HeapBefore-min(result.HeapBefore, result.HeapAfter)), "bytes in", aurora.Cyan(result.Duration))
+	return nil
+}
+
+// FrontendVersion is the build of the frontend and of the backend it's connected to
+type FrontendVersion struct {
+	Frontend common.VersionInfo
+	Backend  common.VersionInfo
+	// Set instead of Backend if the backend couldn't be asked
+	BackendError string
+}
+
+// RPCPacket.Version is called by the command interface and the frontend to get the backend's build
+func (r *RPCPacket) Version(_ struct{}, reply *common.VersionInfo) error {
+	*reply = common.GetVersionInfo()
+	return nil
+}
+
+// RPCFrontendPacket.Version is called by the command interface to get the frontend's build and
+// the backend's, so a mismatch between the two shows up in one place
+func (r *RPCFrontendPacket) Version(_ struct{}, reply *FrontendVersion) error {
+	reply.Frontend = common.GetVersionInfo()
+
+	// The RPC mutex is held for writing while the backend is starting or reloading
+	if !rpcMutex.TryRLock() {
+		reply.BackendError = "reloading"
+		return nil
+	}
+	client := rpcClient
+	rpcMutex.RUnlock()
+
+	if client == nil {
+		reply.BackendError = "starting"
+		return nil
+	}
+
+	// A reply arriving after the timeout is decoded into this copy, not into the reply already sent
+	backend := new(common.VersionInfo)
+	call := client.Go("RPCPacket.Version", struct{}{}, backend, nil)
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			reply.BackendError = call.Error.Error()
+		} else {
+			reply.Backend = *backend
+		}
+
+	case <-time.After(healthCheckTimeout):
+		reply.BackendError = "timeout"
+	}
+
+	return nil
+}
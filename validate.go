@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"wwfc/common"
+	"wwfc/geoip"
+)
+
+// listenAddress is a socket one of the processes binds on startup
+type listenAddress struct {
+	name     string
+	protocol string
+	address  string
+}
+
+// validateMain checks the config without starting any listeners, prints a summary and returns the
+// exit code. The database isn't contacted so this can run where it isn't reachable, e.g. in CI.
+func validateMain() int {
+	errs := common.ValidateConfig(config, false)
+	errs = append(errs, checkDeployment(config)...)
+
+	fmt.Println("Listeners:")
+	for _, listener := range configListeners(config) {
+		fmt.Printf("  %-4s %-22s %s\n", listener.protocol, listener.name, listener.address)
+	}
+	if config.UDPPortStart != 0 {
+		fmt.Printf("  udp  %-22s %d-%d\n", "udp port range", config.UDPPortStart, config.UDPPortEnd)
+	}
+
+	if len(errs) == 0 {
+		fmt.Println("config.xml is valid")
+		return 0
+	}
+
+	fmt.Fprintln(os.Stderr, "Found", len(errs), "problems in config.xml:")
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, "  -", err)
+	}
+	return 1
+}
+
+// configListeners returns every address the frontend and backend bind with the config
+func configListeners(config common.Config) []listenAddress {
+	var listeners []listenAddress
+	for _, server := range gameSpyServers(config) {
+		listeners = append(listeners, listenAddress{server.rpcName, server.protocol, net.JoinHostPort(server.address, strconv.Itoa(server.port))})
+	}
+
+	for _, name := range []string{"qr2", "natneg"} {
+		if config.IsServerEnabled(name) {
+			listeners = append(listeners, listenAddress{name, "udp", net.JoinHostPort(config.GetServerAddress(name), strconv.Itoa(config.GetServerPort(name)))})
+		}
+	}
+
+	nasEnabled := config.IsServerEnabled("nas")
+	if nasEnabled {
+		listeners = append(listeners, listenAddress{"nas", "tcp", net.JoinHostPort(*config.NASAddress, config.NASPort)})
+	}
+
+	listeners = append(listeners,
+		listenAddress{"frontendAddress", "tcp", config.FrontendAddress},
+		listenAddress{"backendAddress", "tcp", config.BackendAddress},
+	)
+
+	if nasEnabled && config.EnableHTTPS && !config.FrontendHTTPS {
+		listeners = append(listeners, listenAddress{"nas https", "tcp", net.JoinHostPort(*config.NASAddressHTTPS, config.NASPortHTTPS)})
+	}
+	if config.WebSocketPort != "" {
+		listeners = append(listeners, listenAddress{"websocket", "tcp", net.JoinHostPort(*config.GameSpyAddress, config.WebSocketPort)})
+	}
+	if config.FrontendHealthAddress != "" {
+		listeners = append(listeners, listenAddress{"frontendHealthAddress", "tcp", config.FrontendHealthAddress})
+	}
+	if config.FrontendPprofAddress != "" {
+		listeners = append(listeners, listenAddress{"frontendPprofAddress", "tcp", pprofListenAddress(config.FrontendPprofAddress)})
+	}
+	if config.BackendPprofAddress != "" {
+		listeners = append(listeners, listenAddress{"backendPprofAddress", "tcp", pprofListenAddress(config.BackendPprofAddress)})
+	}
+	if config.NATNEGSecondaryAddress != "" && config.IsServerEnabled("natneg") {
+		listeners = append(listeners, listenAddress{"natnegSecondaryAddress", "udp", config.NATNEGSecondaryAddress})
+	}
+
+	return listeners
+}
+
+// checkDeployment checks what ValidateConfig leaves to startup: that the addresses resolve and
+// don't collide, and that every file the config references can be loaded
+func checkDeployment(config common.Config) []error {
+	var errs []error
+	addError := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	listeners := configListeners(config)
+	for _, listener := range listeners {
+		host, _, err := net.SplitHostPort(listener.address)
+		if err != nil {
+			// Already reported by ValidateConfig
+			continue
+		}
+
+		if host != "" && net.ParseIP(host) == nil {
+			if _, err := net.LookupHost(host); err != nil {
+				addError("%s address %q doesn't resolve: %v", listener.name, listener.address, err)
+			}
+		}
+	}
+
+	errs = append(errs, checkListenerCollisions(config)...)
+
+	if config.EnableHTTPS {
+		if _, err := tls.LoadX509KeyPair(config.CertPath, config.KeyPath); err != nil {
+			addError("<certPath> and <keyPath> can't be loaded: %v", err)
+		}
+
+		if *config.EnableHTTPSExploitWii {
+			if err := checkPrivateKey(config.KeyPathWii); err != nil {
+				addError("<keyPathWii>: %v", err)
+			}
+		}
+
+		if *config.EnableHTTPSExploitDS {
+			if err := checkPrivateKey(config.KeyPathDS); err != nil {
+				addError("<keyPathDS>: %v", err)
+			}
+		}
+	}
+
+	if config.GeoIPDatabase != "" {
+		if _, err := geoip.Open(config.GeoIPDatabase); err != nil {
+			addError("<geoIPDatabase> can't be loaded: %v", err)
+		}
+	}
+
+	// The ban list doesn't have to exist yet, it's created on the first ban
+	if config.IPBanFile != "" {
+		data, err := os.ReadFile(config.IPBanFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			addError("<ipBanFile>: %v", err)
+		} else if err == nil {
+			var bans []IPBan
+			if err := json.Unmarshal(data, &bans); err != nil {
+				addError("<ipBanFile> is corrupt: %v", err)
+			}
+		}
+	}
+
+	if config.GameOverrideFile != "" {
+		data, err := os.ReadFile(config.GameOverrideFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			addError("<gameOverrideFile>: %v", err)
+		} else if err == nil {
+			var overrides []GameOverride
+			if err := json.Unmarshal(data, &overrides); err != nil {
+				addError("<gameOverrideFile> is corrupt: %v", err)
+			}
+		}
+	}
+
+	return errs
+}
+
+// checkListenerCollisions finds the listeners that would fail to bind because another one already
+// has the port. Run on startup as well, so the error names both services.
+func checkListenerCollisions(config common.Config) []error {
+	var errs []error
+	listeners := configListeners(config)
+	for i, a := range listeners {
+		for _, b := range listeners[i+1:] {
+			if a.protocol == b.protocol && addressesOverlap(a.address, b.address) {
+				errs = append(errs, fmt.Errorf("%s and %s both listen on %s port %s", a.name, b.name, a.protocol, portOf(a.address)))
+			}
+		}
+
+		if a.protocol == "udp" && config.UDPPortStart != 0 {
+			if port, err := strconv.Atoi(portOf(a.address)); err == nil && port >= config.UDPPortStart && port <= config.UDPPortEnd {
+				errs = append(errs, fmt.Errorf("%s listens on UDP port %d inside <udpPortStart> to <udpPortEnd>", a.name, port))
+			}
+		}
+	}
+
+	return errs
+}
+
+// checkPrivateKey parses a PEM PKCS #8 RSA key the way the NAS HTTPS server loads it
+func checkPrivateKey(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.New("not a PEM file")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := key.(*rsa.PrivateKey); !ok {
+		return errors.New("not an RSA key")
+	}
+
+	return nil
+}
+
+// addressesOverlap reports whether binding both addresses would conflict, which is the case when
+// the ports match and either host is the same or listens on all interfaces
+func addressesOverlap(a string, b string) bool {
+	hostA, portA, errA := net.SplitHostPort(a)
+	hostB, portB, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil || portA != portB {
+		return false
+	}
+
+	return hostA == hostB || isUnspecifiedHost(hostA) || isUnspecifiedHost(hostB)
+}
+
+func isUnspecifiedHost(host string) bool {
+	if host == "" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+func portOf(address string) string {
+	_, port, _ := net.SplitHostPort(address)
+	return port
+}
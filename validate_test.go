@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"wwfc/common"
+)
+
+func deploymentTestConfig() common.Config {
+	gsAddress := "0.0.0.0"
+	nasAddress := "127.0.0.1"
+	return common.Config{
+		GameSpyAddress:  &gsAddress,
+		NASAddress:      &nasAddress,
+		NASPort:         "80",
+		FrontendAddress: "127.0.0.1:29998",
+		BackendAddress:  "127.0.0.1:29999",
+	}
+}
+
+func TestCheckDeployment(t *testing.T) {
+	config := deploymentTestConfig()
+	if errs := checkDeployment(config); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	// Same port on all interfaces and on one address
+	config.Servers = []common.ServerConfig{{Name: "gpsp", Address: "127.0.0.1"}}
+	config.WebSocketPort = "29901"
+	// Different protocols don't collide
+	config.NATNEGSecondaryAddress = "127.0.0.1:28910"
+	config.UDPPortStart, config.UDPPortEnd = 27000, 27900
+
+	banFile := filepath.Join(t.TempDir(), "bans.json")
+	os.WriteFile(banFile, []byte("[{"), 0644)
+	config.IPBanFile = banFile
+	overrideFile := filepath.Join(t.TempDir(), "game_overrides.json")
+	os.WriteFile(overrideFile, []byte("{"), 0644)
+	config.GameOverrideFile = overrideFile
+
+	var messages []string
+	for _, err := range checkDeployment(config) {
+		messages = append(messages, err.Error())
+	}
+
+	expected := []string{
+		"gpsp and websocket both listen on tcp port 29901",
+		"qr2 listens on UDP port 27900 inside <udpPortStart> to <udpPortEnd>",
+		"<ipBanFile> is corrupt: unexpected end of JSON input",
+		"<gameOverrideFile> is corrupt: unexpected end of JSON input",
+	}
+	if strings.Join(messages, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got errors:\n%s", strings.Join(messages, "\n"))
+	}
+
+	// A missing ban list is created later
+	config = deploymentTestConfig()
+	config.IPBanFile = filepath.Join(t.TempDir(), "missing.json")
+	if errs := checkDeployment(config); len(errs) != 0 {
+		t.Error(errs)
+	}
+}
+
+func TestConfiguredListeners(t *testing.T) {
+	disabled := false
+	config := deploymentTestConfig()
+	config.Servers = []common.ServerConfig{
+		{Name: "gpcm", Port: 29901},
+		{Name: "gamestats", Enabled: &disabled},
+		{Name: "qr2", Address: "127.0.0.1", Port: 27901},
+		{Name: "nas", Enabled: &disabled},
+	}
+
+	var names []string
+	for _, server := range gameSpyServers(config) {
+		names = append(names, server.rpcName+":"+strconv.Itoa(server.port))
+	}
+	if strings.Join(names, " ") != "serverbrowser:28910 gpcm:29901 gpsp:29901" {
+		t.Errorf("got servers %v", names)
+	}
+
+	var messages []string
+	for _, err := range checkListenerCollisions(config) {
+		messages = append(messages, err.Error())
+	}
+
+	expected := []string{
+		"gpcm and gpsp both listen on tcp port 29901",
+		"qr2 and natneg both listen on udp port 27901",
+	}
+	if strings.Join(messages, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got errors:\n%s", strings.Join(messages, "\n"))
+	}
+
+	// The defaults don't collide
+	if errs := checkListenerCollisions(deploymentTestConfig()); len(errs) != 0 {
+		t.Error(errs)
+	}
+}
+
+func TestAddressesOverlap(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"127.0.0.1:80", "127.0.0.1:80", true},
+		{"0.0.0.0:80", "127.0.0.1:80", true},
+		{":80", "[::1]:80", true},
+		{"127.0.0.1:80", "127.0.0.2:80", false},
+		{"0.0.0.0:80", "0.0.0.0:81", false},
+	}
+
+	for _, test := range tests {
+		if overlap := addressesOverlap(test.a, test.b); overlap != test.overlap {
+			t.Errorf("%s and %s: got %v", test.a, test.b, overlap)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"wwfc/logging"
+
+	"github.com/logrusorgru/aurora/v3"
+	"golang.org/x/net/websocket"
+)
+
+// webSocketConn adapts a WebSocket connection to look like a raw TCP connection to the backend.
+// The remote address of a websocket.Conn is the origin URL, so replace it with the peer address.
+type webSocketConn struct {
+	*websocket.Conn
+	remoteAddr net.Addr
+}
+
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// startWebSocketListener starts the optional WebSocket listener, bridging each frame to the configured server
+func startWebSocketListener(servers []serverInfo) {
+	var server *serverInfo
+	for i := range servers {
+		if servers[i].rpcName == config.WebSocketServer {
+			server = &servers[i]
+			break
+		}
+	}
+
+	if server == nil {
+		logging.Error("FRONTEND", "Unknown WebSocket server", aurora.Cyan(config.WebSocketServer))
+		return
+	}
+
+	address := *config.GameSpyAddress + ":" + config.WebSocketPort
+	pressure := &backpressure{server: server.rpcName}
+
+	wsServer := websocket.Server{
+		// Accept any origin, this is meant for internal tooling
+		Handshake: func(*websocket.Config, *http.Request) error {
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			remoteAddr, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
+			if err != nil {
+				logging.Error("FRONTEND", "Invalid WebSocket remote address", aurora.BrightCyan(ws.Request().RemoteAddr))
+				return
+			}
+
+			if isServerDrained(server.rpcName) {
+				return
+			}
+
+			// The connection is already accepted by the HTTP server, so in pause mode the handshake
+			// waits here instead
+			pressure.waitBeforeAccept()
+			if !admitConnection(server.rpcName, remoteAddr, pressure) {
+				return
+			}
+
+			ws.PayloadType = websocket.BinaryFrame
+			handleConnection(*server, &webSocketConn{Conn: ws, remoteAddr: remoteAddr}, nextConnectionIndex())
+		},
+	}
+
+	go func() {
+		logging.Notice("FRONTEND", "Listening on", aurora.BrightCyan(address), "for", aurora.BrightCyan(server.rpcName), "(WebSocket)")
+
+		err := serveHTTP("WebSocket", address, wsServer)
+		if err != nil {
+			logging.Error("FRONTEND", "Failed to listen on", aurora.BrightCyan(address), err)
+		}
+	}()
+}